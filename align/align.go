@@ -0,0 +1,396 @@
+// Package align lines up two captures of the same tape, by the edges that
+// were detected in each of them, so that a position in one of them can be
+// mapped to the same place on the tape in the other. This is needed to
+// compare or combine the captures, e.g. to vote on the bits of a block,
+// to take a region that is bad in one of them from the other, or to show
+// them side by side.
+//
+// As the tape may have played at a slightly different speed in each
+// capture (and the speed may have varied), the captures are aligned in
+// short steps, each of which gets its own offset; positions between them
+// are mapped by interpolating between those offsets.
+package align
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/edorfaus/sb-mfm-decode/mfm"
+)
+
+// The defaults of the Config.
+const (
+	// DefaultStep is the default length of the steps, in samples.
+	DefaultStep = 4096
+
+	// DefaultWindow is the default length of the windows that the steps
+	// are found in coarsely, in samples (about 5.5 seconds at 48kHz).
+	DefaultWindow = 1 << 18
+
+	// DefaultDrift is the default for how much faster or slower the tape
+	// can have played in one capture than in the other.
+	DefaultDrift = 0.02
+
+	// DefaultTolerance is the default for how far apart (in samples) the
+	// starts of the bursts can be and still match, in the coarse alignment.
+	DefaultTolerance = 32
+)
+
+// minEdges is the fewest edges that a step must have to be aligned; the
+// steps with fewer (e.g. in the gaps between blocks) are skipped.
+const minEdges = 32
+
+// Config holds the settings for Edges.
+type Config struct {
+	// The length of each step of the first capture that is aligned on
+	// its own, in samples; if 0, DefaultStep is used. Each step gives a
+	// Point of the alignment, if it has enough edges to be aligned.
+	Step int
+
+	// The length of the window of bursts that is used to find a step
+	// coarsely, in samples; if 0, DefaultWindow is used. This should be
+	// long enough to hold several blocks.
+	Window int
+
+	// How far apart (in samples) the captures can be at the first step
+	// that is aligned, in either direction; if 0, Window is used.
+	MaxLag int
+
+	// How much faster or slower the tape can have played in one capture
+	// than in the other, as a fraction; if 0, DefaultDrift is used. This
+	// limits how far a step is searched for, from the previous one.
+	Drift float64
+
+	// How far apart (in samples) the starts of two bursts of edges can be
+	// and still be taken as the same, in the coarse alignment; if 0,
+	// DefaultTolerance is used. This is also how far from the coarse (or
+	// predicted) position the fine alignment searches.
+	Tolerance float64
+}
+
+// Point is an aligned position: the middle of a step of the first
+// capture, and where it is in the second.
+type Point struct {
+	From, To float64
+
+	// How much the offset changes per sample around the point, which is
+	// how much faster (if negative) or slower the tape played in the
+	// second capture than in the first, as a fraction.
+	Slope float64
+
+	// The number of edges of the step, and how many of them had an edge
+	// of the second capture close to their aligned position (within a
+	// quarter of the median pulse width).
+	Edges, Matched int
+}
+
+// Offset returns how far the second capture is after the first, at the
+// point.
+func (p Point) Offset() float64 {
+	return p.To - p.From
+}
+
+// Alignment maps the sample positions of one capture onto another, by a
+// list of aligned points, sorted by their position in the first capture.
+type Alignment []Point
+
+// Map returns the position in the second capture of the given position in
+// the first, interpolated between the points around it. Before the first
+// point and after the last, the offset of that point is used. With no
+// points, the position is returned as it is.
+func (a Alignment) Map(pos float64) float64 {
+	if len(a) == 0 {
+		return pos
+	}
+	i := sort.Search(len(a), func(i int) bool { return a[i].From > pos })
+	if i == 0 {
+		return pos + a[0].Offset()
+	}
+	if i == len(a) {
+		return pos + a[len(a)-1].Offset()
+	}
+	p, q := a[i-1], a[i]
+	f := (pos - p.From) / (q.From - p.From)
+	return p.To + f*(q.To-p.To)
+}
+
+// Inverse returns the alignment the other way, from the second capture
+// to the first.
+func (a Alignment) Inverse() Alignment {
+	out := make(Alignment, len(a))
+	for i, p := range a {
+		p.From, p.To = p.To, p.From
+		p.Slope = -p.Slope / (1 + p.Slope)
+		out[i] = p
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].From < out[j].From })
+	return out
+}
+
+// Edges aligns the edges of two captures of the same tape (as found by
+// mfm.EdgeDetect, and collected by mfm.CollectEdges), by cross-correlating
+// them. The edges are taken by their position alone, so the polarity of
+// the captures does not matter.
+//
+// Each step of the first capture is aligned finely, by the offset that
+// lines up the most of its edges with those of the second capture, around
+// where the previous steps predict it to be. The first step, and those
+// after a gap that is too long to predict over, are first found coarsely,
+// by lining up the starts of the bursts of edges (such as the blocks)
+// from there on. It returns an error if no step could be aligned.
+func Edges(from, to *mfm.EdgeList, cfg Config) (Alignment, error) {
+	if cfg.Step <= 0 {
+		cfg.Step = DefaultStep
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = DefaultWindow
+	}
+	if cfg.MaxLag <= 0 {
+		cfg.MaxLag = cfg.Window
+	}
+	if cfg.Drift <= 0 {
+		cfg.Drift = DefaultDrift
+	}
+	if cfg.Tolerance <= 0 {
+		cfg.Tolerance = DefaultTolerance
+	}
+
+	a, b := positions(from), positions(to)
+	aStarts, bStarts := bursts(from), bursts(to)
+	tol := pulseWidth(a) / 4
+
+	var out Alignment
+	for start := 0; start < from.Samples; start += cfg.Step {
+		end := start + cfg.Step
+		win := between(a, float64(start), float64(end))
+		if len(win) < minEdges {
+			continue
+		}
+		mid := float64(start+end) / 2
+
+		// The prediction can be relied on if the last point is close
+		// enough; otherwise, the step is first found coarsely.
+		off, lag := predict(out, mid), 0.0
+		if n := len(out); n == 0 {
+			lag = float64(cfg.MaxLag)
+		} else if d := mid - out[n-1].From; d > float64(cfg.Window) {
+			lag = cfg.Drift * d
+		}
+		coarsely := lag > cfg.Tolerance
+		if coarsely {
+			ctx := between(
+				aStarts, float64(start), float64(start+cfg.Window),
+			)
+			var ok bool
+			off, ok = coarse(ctx, bStarts, off, lag, cfg.Tolerance, cfg.Drift)
+			if !ok {
+				continue
+			}
+		}
+
+		// Within the step, the offset changes with the difference in speed,
+		// which is the slope of the offsets; when that is not known from
+		// the previous point, a range of them is tried.
+		var slopes []float64
+		if coarsely {
+			slopes = slopeRange(cfg.Drift, float64(cfg.Step), tol)
+		} else {
+			slopes = []float64{out[len(out)-1].Slope}
+		}
+		pt := Point{From: mid, Edges: len(win), Matched: -1}
+		for _, sl := range slopes {
+			o, sl, m := fine(win, b, mid, off, sl, cfg.Tolerance, tol)
+			if m > pt.Matched {
+				pt.To, pt.Slope, pt.Matched = mid+o, sl, m
+			}
+		}
+		if pt.Matched < len(win)/2 {
+			// Too few of the edges line up for it to be the right place.
+			continue
+		}
+		out = append(out, pt)
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("align: no part of the captures lined up")
+	}
+	return out, nil
+}
+
+// predict returns the offset that the last of the given points predicts
+// at the given position, by its offset and slope; or 0 if there are none.
+func predict(points Alignment, pos float64) float64 {
+	n := len(points)
+	if n == 0 {
+		return 0
+	}
+	last := points[n-1]
+	return last.Offset() + last.Slope*(pos-last.From)
+}
+
+// slopeRange returns the slopes to try when it is not known, from -drift
+// to drift, close enough together that the edges at the ends of a step of
+// the given length are within tol of one of them.
+func slopeRange(drift, step, tol float64) []float64 {
+	inc := tol / (step / 2)
+	n := int(math.Ceil(drift / inc))
+	slopes := []float64{0}
+	for k := 1; k <= n; k++ {
+		slopes = append(slopes, float64(k)*inc, -float64(k)*inc)
+	}
+	return slopes
+}
+
+// positions returns the positions of the high and low edges of the list.
+func positions(l *mfm.EdgeList) []float64 {
+	pos := make([]float64, 0, len(l.Edges))
+	for _, e := range l.Edges {
+		if e.Type != mfm.EdgeToNone {
+			pos = append(pos, e.Zero)
+		}
+	}
+	sort.Float64s(pos)
+	return pos
+}
+
+// bursts returns the positions of the first edge of each burst of high
+// and low edges of the list, i.e. of each of them that follows an edge to
+// none (or is the first).
+func bursts(l *mfm.EdgeList) []float64 {
+	var pos []float64
+	prev := mfm.EdgeToNone
+	for _, e := range l.Edges {
+		if prev == mfm.EdgeToNone && e.Type != mfm.EdgeToNone {
+			pos = append(pos, e.Zero)
+		}
+		prev = e.Type
+	}
+	sort.Float64s(pos)
+	return pos
+}
+
+// between returns the part of the given sorted positions that is from
+// start up to end.
+func between(pos []float64, start, end float64) []float64 {
+	i := sort.SearchFloat64s(pos, start)
+	j := sort.SearchFloat64s(pos, end)
+	return pos[i:j]
+}
+
+// pulseWidth returns the median distance between neighbouring edges, which
+// is about the width of the most common pulse, or 1 if there are too few
+// edges to tell.
+func pulseWidth(pos []float64) float64 {
+	var d []float64
+	for i := 1; i < len(pos); i++ {
+		d = append(d, pos[i]-pos[i-1])
+	}
+	if len(d) == 0 {
+		return 1
+	}
+	sort.Float64s(d)
+	return math.Max(d[len(d)/2], 1)
+}
+
+// coarse finds the offset (within lag of the guess) that lines up the
+// first of the given burst starts of the first capture with one of those
+// of the second capture, such that the most of the others also line up
+// with one (within tol, widened by the drift over the distance from the
+// first). It returns false if there are no bursts that could line up.
+func coarse(ctx, other []float64, guess, lag, tol, drift float64) (
+	float64, bool,
+) {
+	if len(ctx) == 0 {
+		return 0, false
+	}
+	first := ctx[0]
+	cands := between(other, first+guess-lag, first+guess+lag)
+
+	best, bestScore := 0.0, 0
+	for _, c := range cands {
+		off, score := c-first, 0
+		for _, p := range ctx {
+			within := tol + drift*(p-first)
+			if _, ok := closest(other, p+off, within); ok {
+				score++
+			}
+		}
+		// Prefer the one closest to the guess, if several are as good.
+		if score > bestScore || score == bestScore &&
+			math.Abs(off-guess) < math.Abs(best-guess) {
+			best, bestScore = off, score
+		}
+	}
+	return best, bestScore > 0
+}
+
+// fineStep is the step (in samples) of the offsets that fine tries.
+const fineStep = 0.25
+
+// fine refines the given offset (at mid) of the step of edges, which is
+// within the given range of the right one, with the offset changing by
+// the given slope over the step: it tries each offset within that range
+// (in steps of fineStep), and takes the one where the most edges have an
+// edge of the other capture within tol of them, preferring the one that
+// is closest to the given offset if several are as good (as they are in
+// a lead-in, which is the same all along). The offset and slope are then
+// fitted to the edges that matched, by least squares. It returns the
+// offset and slope, and how many edges matched.
+func fine(
+	win, other []float64, mid, off, slope, rng, tol float64,
+) (float64, float64, int) {
+	at := func(p, off float64) float64 {
+		return p + off + slope*(p-mid)
+	}
+
+	steps := int(rng / fineStep)
+	best, bestMatched := off, -1
+	for k := 0; k <= 2*steps; k++ {
+		// Go outward from the given offset: 0, -1, +1, -2, +2, ...
+		d := float64((k+1)/2) * fineStep
+		if k%2 == 1 {
+			d = -d
+		}
+		matched := 0
+		for _, p := range win {
+			if _, ok := closest(other, at(p, off+d), tol); ok {
+				matched++
+			}
+		}
+		if matched > bestMatched {
+			best, bestMatched = off+d, matched
+		}
+	}
+
+	// Fit the offset (at mid) and slope to the differences of the edges
+	// that matched, by their distance from mid.
+	var n, sx, sy, sxx, sxy float64
+	for _, p := range win {
+		if q, ok := closest(other, at(p, best), tol); ok {
+			x, y := p-mid, q-p
+			n, sx, sy, sxx, sxy = n+1, sx+x, sy+y, sxx+x*x, sxy+x*y
+		}
+	}
+	if n < 2 || n*sxx == sx*sx {
+		return best, slope, bestMatched
+	}
+	slope = (n*sxy - sx*sy) / (n*sxx - sx*sx)
+	return (sy - slope*sx) / n, slope, bestMatched
+}
+
+// closest returns the position of the given ones that is closest to p, if
+// it is within the given distance of it.
+func closest(pos []float64, p, within float64) (float64, bool) {
+	i := sort.SearchFloat64s(pos, p)
+	best, ok := 0.0, false
+	for _, k := range []int{i - 1, i} {
+		if k < 0 || k >= len(pos) {
+			continue
+		}
+		d := math.Abs(pos[k] - p)
+		if d <= within && (!ok || d < math.Abs(best-p)) {
+			best, ok = pos[k], true
+		}
+	}
+	return best, ok
+}
@@ -0,0 +1,100 @@
+//go:build alsa
+
+package audioin
+
+// #cgo LDFLAGS: -lasound
+// #include <errno.h>
+// #include <stdlib.h>
+// #include <alsa/asoundlib.h>
+import "C"
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// Backend is the name of the audio input backend that was built in.
+const Backend = "alsa"
+
+// alsaLatency is the latency to ask ALSA for, in microseconds. A read
+// waits for at most this long, so that the reader can stop quickly.
+const alsaLatency = 100000
+
+// alsaDevice is a capture device opened with ALSA.
+type alsaDevice struct {
+	pcm      *C.snd_pcm_t
+	channels int
+
+	// The most frames to read at once, to not wait longer than the
+	// latency for a read to fill the buffer.
+	maxFrames int
+}
+
+func openDevice(name string, rate, channels int) (device, error) {
+	if name == "" {
+		name = "default"
+	}
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+
+	var pcm *C.snd_pcm_t
+	rc := C.snd_pcm_open(&pcm, cName, C.SND_PCM_STREAM_CAPTURE, 0)
+	if rc < 0 {
+		return nil, alsaError("open "+name, rc)
+	}
+
+	rc = C.snd_pcm_set_params(
+		pcm, C.SND_PCM_FORMAT_S16, C.SND_PCM_ACCESS_RW_INTERLEAVED,
+		C.uint(channels), C.uint(rate), 1, alsaLatency,
+	)
+	if rc < 0 {
+		C.snd_pcm_close(pcm)
+		return nil, alsaError("set up "+name, rc)
+	}
+
+	maxFrames := rate / (1000000 / alsaLatency)
+	if maxFrames < 1 {
+		maxFrames = 1
+	}
+	return &alsaDevice{
+		pcm: pcm, channels: channels, maxFrames: maxFrames,
+	}, nil
+}
+
+func (d *alsaDevice) read(buf []int16) (int, error) {
+	frames := len(buf) / d.channels
+	if frames > d.maxFrames {
+		frames = d.maxFrames
+	}
+	if frames == 0 {
+		return 0, nil
+	}
+
+	n := C.snd_pcm_readi(
+		d.pcm, unsafe.Pointer(&buf[0]), C.snd_pcm_uframes_t(frames),
+	)
+	if n >= 0 {
+		return int(n), nil
+	}
+
+	// Try to recover from the error, e.g. an overrun (which ALSA reports
+	// as EPIPE) or being suspended, so that the reading can continue.
+	if rc := C.snd_pcm_recover(d.pcm, C.int(n), 1); rc < 0 {
+		return 0, alsaError("read", C.int(n))
+	}
+	if n == -C.EPIPE {
+		return 0, errOverrun
+	}
+	return 0, nil
+}
+
+func (d *alsaDevice) close() error {
+	if rc := C.snd_pcm_close(d.pcm); rc < 0 {
+		return alsaError("close", rc)
+	}
+	return nil
+}
+
+func alsaError(op string, rc C.int) error {
+	return fmt.Errorf("alsa: %v: %v", op, C.GoString(C.snd_strerror(rc)))
+}
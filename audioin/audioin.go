@@ -0,0 +1,153 @@
+// Package audioin reads samples live from an audio input device, such as
+// the line input of a sound card, so that a tape can be decoded while it
+// is being played.
+//
+// The device is read by a backend that is chosen when building: with the
+// "alsa" build tag, ALSA is used (which needs cgo and the ALSA library).
+// Without a backend, Open returns ErrNoBackend.
+package audioin
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/edorfaus/sb-mfm-decode/log"
+	"github.com/edorfaus/sb-mfm-decode/wav"
+)
+
+// logger is the logger used by this package.
+var logger = log.Named("audioin")
+
+// BitDepth is the bit depth of the samples read from a device.
+const BitDepth = 16
+
+// ErrNoBackend is returned by Open when the program was built without an
+// audio input backend.
+var ErrNoBackend = errors.New(
+	"no audio input backend; rebuild with -tags alsa to use ALSA",
+)
+
+// errOverrun is returned by a device when the input was not read quickly
+// enough, so that some of it was lost; the device can still be read.
+var errOverrun = errors.New("input overrun")
+
+// device is an open audio input device, as opened by a backend.
+type device interface {
+	// read reads interleaved frames into buf, waiting until at least one
+	// is available, and returns how many frames were read.
+	read(buf []int16) (int, error)
+	close() error
+}
+
+// Config holds the settings for opening a device.
+type Config struct {
+	// The name of the device, as known to the backend; if empty, the
+	// default device is used.
+	Device string
+
+	// The sample rate and the number of channels to record with.
+	SampleRate int
+	Channels   int
+
+	// The channel to read the samples of; if negative, the data channel
+	// is used, as given by wav.DataChannel.
+	Channel int
+}
+
+// Input is an open audio input device, that reads the samples of one of
+// its channels. It is a pipeline.SampleSource.
+type Input struct {
+	Meta    wav.Meta
+	Channel int
+
+	dev      device
+	raw      []int16
+	pos      int
+	overruns int
+}
+
+// Open opens the given device for recording, with the given settings.
+func Open(cfg Config) (*Input, error) {
+	if cfg.SampleRate < 1 || cfg.Channels < 1 {
+		return nil, fmt.Errorf(
+			"bad sample rate or channels: %v, %v",
+			cfg.SampleRate, cfg.Channels,
+		)
+	}
+	if cfg.Channel < 0 {
+		cfg.Channel = wav.DataChannel(cfg.Channels)
+	}
+	if cfg.Channel >= cfg.Channels {
+		return nil, fmt.Errorf("bad channel: %v", cfg.Channel)
+	}
+
+	dev, err := openDevice(cfg.Device, cfg.SampleRate, cfg.Channels)
+	if err != nil {
+		return nil, err
+	}
+	return &Input{
+		Meta: wav.Meta{
+			SampleRate:  cfg.SampleRate,
+			BitDepth:    BitDepth,
+			NumChannels: cfg.Channels,
+		},
+		Channel: cfg.Channel,
+		dev:     dev,
+	}, nil
+}
+
+// ReadSamples reads up to len(buf) samples of the channel into buf, and
+// returns how many were read. It waits until some samples are available,
+// but not until buf is full. After Close, it returns 0 and io.EOF.
+//
+// If some of the input was lost because it was not read quickly enough,
+// this is logged as a warning, and the reading continues after the gap.
+func (in *Input) ReadSamples(buf []int) (int, error) {
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	if in.dev == nil {
+		return 0, io.EOF
+	}
+
+	frame := in.Meta.NumChannels
+	if size := len(buf) * frame; cap(in.raw) < size {
+		in.raw = make([]int16, size)
+	}
+	raw := in.raw[:len(buf)*frame]
+
+	for {
+		n, err := in.dev.read(raw)
+		if err == errOverrun {
+			in.overruns++
+			logger.WarnAt(in.pos, "input overrun, some samples were lost")
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		for i := 0; i < n; i++ {
+			buf[i] = int(raw[i*frame+in.Channel])
+		}
+		in.pos += n
+		return n, nil
+	}
+}
+
+// Overruns returns how many times some of the input has been lost since
+// the device was opened, because it was not read quickly enough.
+func (in *Input) Overruns() int {
+	return in.overruns
+}
+
+// Close closes the device.
+func (in *Input) Close() error {
+	if in.dev == nil {
+		return nil
+	}
+	err := in.dev.close()
+	in.dev = nil
+	return err
+}
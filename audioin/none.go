@@ -0,0 +1,10 @@
+//go:build !alsa
+
+package audioin
+
+// Backend is the name of the audio input backend that was built in.
+const Backend = "none"
+
+func openDevice(name string, rate, channels int) (device, error) {
+	return nil, ErrNoBackend
+}
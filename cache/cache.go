@@ -0,0 +1,136 @@
+// Package cache stores intermediate results of a decode on disk, so that
+// when the same capture is decoded again with only some of the settings
+// changed (e.g. to try another decoder option), the stages whose inputs
+// have not changed can be skipped. Each entry is keyed by a hash of the
+// input and of the settings that its stage depends on, so an entry is
+// never used for a decode that would have given a different result.
+//
+// The cache is only an optimization: an entry that cannot be read or
+// written is logged as a warning and otherwise ignored, as if it was not
+// there.
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/edorfaus/sb-mfm-decode/log"
+)
+
+// logger is the logger used by this package.
+var logger = log.Named("cache")
+
+// Cache is a directory of cached results. A nil *Cache is valid, and
+// caches nothing.
+type Cache struct {
+	// The directory that the entries are stored in.
+	Dir string
+
+	// The logger to use; if nil, the package logger is used.
+	Log *log.Logger
+}
+
+// Open opens the cache in the given directory, creating the directory if
+// it does not exist.
+func Open(dir string) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0o777); err != nil {
+		return nil, err
+	}
+	return &Cache{Dir: dir}, nil
+}
+
+// Key returns the key of the given parts, which are typically the hash of
+// the input and the settings of a stage. The parts are hashed by their Go
+// syntax representation (as by %#v), so they must not contain pointers,
+// or anything else that differs between runs with the same settings.
+func Key(parts ...any) string {
+	h := sha256.New()
+	for _, p := range parts {
+		fmt.Fprintf(h, "%#v\n", p)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// HashFile returns the SHA-256 of the contents of the given file, in hex,
+// for use in keys as the identity of an input.
+func HashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Load reads the entry of the given kind (e.g. "clean") and key into v,
+// which must be a pointer, and returns whether it was found.
+func (c *Cache) Load(kind, key string, v any) bool {
+	if c == nil {
+		return false
+	}
+	f, err := os.Open(c.path(kind, key))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			c.log().Warn("cache:", err)
+		}
+		return false
+	}
+	defer f.Close()
+
+	if err := gob.NewDecoder(f).Decode(v); err != nil {
+		c.log().Warn("cache: bad entry:", f.Name()+":", err)
+		return false
+	}
+	return true
+}
+
+// Store writes v as the entry of the given kind and key, replacing any
+// entry that was already there. The entry is written to a temporary file
+// first, so that an interrupted write does not leave a partial entry.
+func (c *Cache) Store(kind, key string, v any) {
+	if c == nil {
+		return
+	}
+	if err := c.store(c.path(kind, key), v); err != nil {
+		c.log().Warn("cache:", err)
+	}
+}
+
+func (c *Cache) store(path string, v any) error {
+	f, err := os.CreateTemp(c.Dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := gob.NewEncoder(f).Encode(v); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// path returns the path of the file of the given entry.
+func (c *Cache) path(kind, key string) string {
+	return filepath.Join(c.Dir, kind+"-"+key+".gob")
+}
+
+func (c *Cache) log() *log.Logger {
+	if c.Log != nil {
+		return c.Log
+	}
+	return logger
+}
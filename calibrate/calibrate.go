@@ -0,0 +1,299 @@
+// Package calibrate measures a tape deck against a reference recording:
+// a capture of a tape that has the known data of the Reference on it, as
+// played back by the deck. From the differences between that capture and
+// the reference, it derives the settings to decode other captures from
+// the same deck with: its speed and the noise floor to use, along with
+// hints about its equalization.
+package calibrate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/edorfaus/sb-mfm-decode/mfm"
+	"github.com/edorfaus/sb-mfm-decode/pipeline"
+	"github.com/edorfaus/sb-mfm-decode/schema"
+	"github.com/edorfaus/sb-mfm-decode/tune"
+)
+
+// The number of noise floors that Analyze tries, to pick one.
+const noiseFloorSteps = 13
+
+// The most noise pulses to trim off the end of a block, so that a block
+// whose data is intact still matches if its fade-out is not clean.
+const noisePulses = 4
+
+// The relative difference from the nominal width of a class of pulses,
+// and of the speed, that is taken to be worth a hint.
+const (
+	widthTolerance = 0.03
+	speedTolerance = 0.005
+)
+
+// Calibration is the result of analyzing a reference recording, in the
+// JSON form that it is saved in.
+type Calibration struct {
+	schema.Header
+
+	// The speed that the deck plays at, relative to the nominal, e.g.
+	// 1.02 if it plays 2% fast; as for pipeline.Config.Speed.
+	Speed float64 `json:"speed"`
+
+	// The noise floor to use, as picked by tune.PickNoiseFloor.
+	NoiseFloor int `json:"noise_floor"`
+
+	// The mean widths of the Short, Medium and Long pulses, after the
+	// speed is corrected for, relative to their nominal widths (1, 1.5
+	// and 2 bit widths). A deck that loses treble makes the narrow pulses
+	// wider and the wide ones narrower, as the transitions spread out.
+	PulseWidths [3]float64 `json:"pulse_widths"`
+
+	// The number of blocks that were decoded, and how many of them had
+	// the data of a reference block, of the number of reference blocks.
+	Blocks    int `json:"blocks"`
+	Matched   int `json:"matched"`
+	Reference int `json:"reference_blocks"`
+
+	// Advice about the deck and capture, in words.
+	Hints []string `json:"hints,omitempty"`
+}
+
+// Analyze analyzes the given capture of the reference recording, which
+// has the given sample rate and bit depth.
+func Analyze(
+	ctx context.Context, samples []int, rate, bits int,
+) (*Calibration, error) {
+	if _, err := mfm.BitWidthFor(mfm.DefaultBitRate, rate); err != nil {
+		return nil, err
+	}
+	ref := ReferenceData()
+	c := &Calibration{
+		Header: schema.Header{
+			Schema:  schema.CalibrationSchema,
+			Version: schema.Version,
+		},
+		Reference: len(ref),
+	}
+
+	if err := c.measure(ctx, samples, rate, bits, ref); err != nil {
+		return nil, err
+	}
+	if c.Matched == 0 {
+		return nil, fmt.Errorf(
+			"none of the %v blocks found had reference data", c.Blocks,
+		)
+	}
+
+	grid, err := tune.DefaultGrid(rate, bits)
+	if err != nil {
+		return nil, err
+	}
+	bitWidth := mfm.ExpectedBitWidth(mfm.DefaultBitRate, rate) / c.Speed
+	floors := tune.NoiseFloors(bits, noiseFloorSteps)
+	scores, err := tune.Thresholds(ctx, samples, floors, bitWidth, grid)
+	if err != nil {
+		return nil, err
+	}
+	c.NoiseFloor = tune.PickNoiseFloor(scores)
+
+	c.Hints = c.hints()
+	return c, nil
+}
+
+// measure decodes the samples, and measures the speed and pulse widths
+// from the blocks that have reference data.
+func (c *Calibration) measure(
+	ctx context.Context, samples []int, rate, bits int, ref [][]byte,
+) error {
+	s := pipeline.NewStream(
+		pipeline.NewSliceSource(samples), rate, bits,
+		pipeline.Config{
+			NoiseFloor:     -1,
+			BufferSamples:  len(samples) + 1,
+			MaxNoisePulses: noisePulses,
+		},
+	)
+	defer s.Close()
+	expected := mfm.ExpectedBitWidth(mfm.DefaultBitRate, s.SampleRate())
+
+	var pulses []mfm.Pulse
+	s.Pulses = mfm.PulseFunc(func(p mfm.Pulse) {
+		pulses = append(pulses, p)
+	})
+
+	// The sums of the nominal and measured widths of the pulses of the
+	// matched blocks, in all and by class.
+	var nominal, measured float64
+	var classNominal, classMeasured [3]float64
+	for {
+		b, err := s.NextContext(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		c.Blocks++
+
+		matched := b.Err == nil && referenceIndex(ref, b.Data) >= 0
+		if matched {
+			c.Matched++
+		}
+		// Keep the pulses after the block, in case they were found before
+		// the block was returned.
+		rest := pulses[:0]
+		for _, p := range pulses {
+			if p.Start >= float64(b.End) {
+				rest = append(rest, p)
+				continue
+			}
+			if !matched || p.Start < float64(b.Start) {
+				continue
+			}
+			i := int(p.Class - mfm.PulseShort)
+			if i < 0 || i >= len(classNominal) {
+				continue
+			}
+			// Short, Medium and Long are 2, 3 and 4 half-bits.
+			w := float64(i+2) / 2 * expected
+			nominal += w
+			measured += p.Width()
+			classNominal[i] += w
+			classMeasured[i] += p.Width()
+		}
+		pulses = rest
+	}
+
+	if measured == 0 {
+		c.Speed = 1
+		return nil
+	}
+	c.Speed = nominal / measured
+	for i := range c.PulseWidths {
+		if classNominal[i] > 0 {
+			c.PulseWidths[i] = classMeasured[i] * c.Speed / classNominal[i]
+		}
+	}
+	return nil
+}
+
+// hints returns the advice that follows from the measurements.
+func (c *Calibration) hints() []string {
+	var hints []string
+	if c.Matched < c.Reference {
+		hints = append(hints, fmt.Sprintf(
+			"only %v of the %v reference blocks decoded correctly; "+
+				"check the levels and the heads, and calibrate again",
+			c.Matched, c.Reference,
+		))
+	}
+	if math.Abs(c.Speed-1) > speedTolerance {
+		hints = append(hints, fmt.Sprintf(
+			"the deck plays %.1f%% %v; decode with --speed %.4f",
+			math.Abs(c.Speed-1)*100, fastSlow(c.Speed), c.Speed,
+		))
+	}
+	short, long := c.PulseWidths[0], c.PulseWidths[2]
+	switch {
+	case short == 0 || long == 0:
+	case short > 1+widthTolerance && long < 1-widthTolerance:
+		hints = append(hints, fmt.Sprintf(
+			"the short pulses are %.1f%% wide and the long ones %.1f%% "+
+				"narrow, as with a loss of treble: clean and demagnetize "+
+				"the heads, check the azimuth, or raise the treble",
+			(short-1)*100, (1-long)*100,
+		))
+	case short < 1-widthTolerance && long > 1+widthTolerance:
+		hints = append(hints, fmt.Sprintf(
+			"the short pulses are %.1f%% narrow and the long ones %.1f%% "+
+				"wide, as with too much treble: turn down any treble boost "+
+				"or noise reduction",
+			(1-short)*100, (long-1)*100,
+		))
+	}
+	return hints
+}
+
+func fastSlow(speed float64) string {
+	if speed > 1 {
+		return "fast"
+	}
+	return "slow"
+}
+
+// Apply sets up the given config to decode captures from the calibrated
+// deck, for the settings that it does not already have: the speed, if
+// its Speed is 0; and the noise floor, if its NoiseFloor is negative (for
+// the default).
+func (c *Calibration) Apply(cfg *pipeline.Config) {
+	if cfg.Speed == 0 {
+		cfg.Speed = c.Speed
+	}
+	if cfg.NoiseFloor < 0 {
+		cfg.NoiseFloor = c.NoiseFloor
+	}
+}
+
+// Write writes the calibration to the given writer, as indented JSON.
+func (c *Calibration) Write(w io.Writer) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// Summary writes the calibration to the given writer in a readable form.
+func (c *Calibration) Summary(w io.Writer) error {
+	var sb strings.Builder
+	fmt.Fprintf(
+		&sb, "Reference blocks: %v of %v found (%v blocks decoded)\n",
+		c.Matched, c.Reference, c.Blocks,
+	)
+	fmt.Fprintf(&sb, "Speed: %.4f\n", c.Speed)
+	fmt.Fprintf(&sb, "Noise floor: %v\n", c.NoiseFloor)
+	fmt.Fprintf(
+		&sb, "Pulse widths: short %.3f, medium %.3f, long %.3f\n",
+		c.PulseWidths[0], c.PulseWidths[1], c.PulseWidths[2],
+	)
+	for _, h := range c.Hints {
+		fmt.Fprintf(&sb, "Hint: %v\n", h)
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// Load reads a calibration from the given JSON file.
+func Load(filename string) (*Calibration, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	c := &Calibration{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("reading calibration %v: %w", filename, err)
+	}
+	if err := c.Check(schema.CalibrationSchema); err != nil {
+		return nil, fmt.Errorf("reading calibration %v: %w", filename, err)
+	}
+	return c, nil
+}
+
+// Save writes the calibration to the given file, as JSON.
+func (c *Calibration) Save(filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := c.Write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
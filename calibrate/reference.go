@@ -0,0 +1,64 @@
+package calibrate
+
+import (
+	"bytes"
+	"math/rand"
+
+	"github.com/edorfaus/sb-mfm-decode/synth"
+)
+
+// The size of each block of the reference recording, in bytes, and the
+// length of its lead-in, in 0-bits.
+const (
+	referenceBytes  = 256
+	referenceLeadIn = 80
+)
+
+// ReferenceData returns the data of the blocks of the reference recording.
+// The first blocks are patterns that give long runs of each class of
+// pulse (all Short, all Long, and a mix of Medium and Short), so that the
+// width of each class can be measured on its own; the rest are random
+// bytes, with a fixed seed, for a mix like that of real data.
+func ReferenceData() [][]byte {
+	// The mix repeats every 3 bytes, so it is cut to length.
+	mix := bytes.Repeat([]byte{0x92, 0x49, 0x24}, referenceBytes/3+1)
+	blocks := [][]byte{
+		bytes.Repeat([]byte{0x00}, referenceBytes),
+		bytes.Repeat([]byte{0x55}, referenceBytes),
+		mix[:referenceBytes],
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 5; i++ {
+		data := make([]byte, referenceBytes)
+		r.Read(data)
+		blocks = append(blocks, data)
+	}
+	return blocks
+}
+
+// Reference renders the reference recording, with the given settings of
+// the signal (usually only the sample rate and bit depth), as the samples
+// to write to a tape with the deck to calibrate (or with a deck that is
+// known to be good). Each block is followed by a tenth of a second of
+// silence, and there is as much before the first.
+func Reference(sig synth.Signal) []int {
+	s := synth.New(sig)
+	gap := s.SampleRate / 10
+	s.Silence(gap)
+	for _, data := range ReferenceData() {
+		s.Block(data, referenceLeadIn)
+		s.Silence(gap)
+	}
+	return s.Render()
+}
+
+// referenceIndex returns the index of the reference block with the given
+// data, or -1 if it is not one of them.
+func referenceIndex(ref [][]byte, data []byte) int {
+	for i, r := range ref {
+		if bytes.Equal(r, data) {
+			return i
+		}
+	}
+	return -1
+}
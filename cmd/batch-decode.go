@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/edorfaus/sb-mfm-decode/exitcode"
+	"github.com/edorfaus/sb-mfm-decode/log"
+	"github.com/edorfaus/sb-mfm-decode/metrics"
+	"github.com/edorfaus/sb-mfm-decode/mfm"
+	"github.com/edorfaus/sb-mfm-decode/pipeline"
+	"github.com/edorfaus/sb-mfm-decode/sample"
+	"github.com/edorfaus/sb-mfm-decode/studybox"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(exitcode.Of(err))
+	}
+}
+
+var args = struct {
+	Inputs []string `arg:"positional,required" help:"input wav files or dirs"`
+
+	LogLevel  int    `help:"set the logging level (verbosity)"`
+	Log       string `help:"per-module log levels, e.g. 2,filter=3,mfm=1"`
+	LogTo     string `help:"log output per level, e.g. *=stderr,1=stdout"`
+	WarnLimit int    `help:"max warnings of each kind to show; 0=no limit"`
+	Metrics   string `help:"write timing metrics as JSON" placeholder:"FILE"`
+	NoClean   bool   `help:"do not clean the input signal first"`
+
+	OutDir  string  `help:"directory to write the output text files to"`
+	Job     string  `help:"job file; default: job.jsonl in the output dir"`
+	Redo    bool    `help:"decode all inputs, even those that are done"`
+	Workers int     `help:"files to decode at once; 0=number of CPUs"`
+	Timeout float64 `help:"max seconds to spend on each file; 0=no limit"`
+
+	NoiseFloor sample.Level `help:"noise floor, e.g. 655 or -34dB; -1 means use 2% of max"`
+
+	Retry   bool `help:"retry failed blocks with other settings"`
+	Reclean bool `help:"reclean failed blocks with settings from their lead-in"`
+	Reverse bool `help:"also decode failed blocks backwards, from the end"`
+
+	MaxGap      float64 `help:"bridge dropouts up to this many bit widths"`
+	NoisePulses int     `help:"trim up to this many noise pulses at block end"`
+	Heal        bool    `help:"merge tiny pulse pairs that make a valid one"`
+	ML          bool    `help:"find the most likely pulse sequence per block"`
+	Inherit     bool    `help:"start blocks from the last good block's bit width"`
+	Interleave  int     `help:"deinterleave bytes with this block depth"`
+	Check       string  `help:"data check: none, xor, sum, parity, crc16"`
+}{
+	LogLevel:   log.Level,
+	NoiseFloor: sample.Level{Value: -1},
+	WarnLimit:  log.DefaultWarnLimit,
+	OutDir:     ".",
+}
+
+func run() (retErr error) {
+	defer log.WarnSummary()
+	defer func() {
+		if err := outputMetrics(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+
+	argParser := exitcode.MustParse(&args)
+	if args.Workers < 0 || args.Timeout < 0 {
+		argParser.Fail("workers and timeout cannot be negative")
+	}
+	check, err := studybox.ParseChecker(args.Check)
+	if err != nil {
+		argParser.Fail(err.Error())
+	}
+
+	log.Level = args.LogLevel
+	if err := log.SetLevels(args.Log); err != nil {
+		argParser.Fail(err.Error())
+	}
+	if err := log.SetTargets(args.LogTo); err != nil {
+		argParser.Fail(err.Error())
+	}
+	log.Collected.SetLimit(args.WarnLimit)
+
+	inputs, outputs, err := findInputs(args.Inputs)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(args.OutDir, 0o777); err != nil {
+		return err
+	}
+	jobFile := args.Job
+	if jobFile == "" {
+		jobFile = filepath.Join(args.OutDir, "job.jsonl")
+	}
+	job, err := pipeline.OpenJob(jobFile)
+	if err != nil {
+		return err
+	}
+	defer job.Close()
+
+	pending := inputs
+	if !args.Redo {
+		pending = job.Pending(inputs)
+	}
+	log.F(
+		1, "Inputs: %v files, %v already done, %v to decode\n",
+		len(inputs), len(inputs)-len(pending), len(pending),
+	)
+
+	// The first ^C stops starting new files, and the ones being decoded
+	// are left to be redone on the next run.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	cfg := pipeline.Config{
+		NoiseFloor:   args.NoiseFloor.Value,
+		NoiseFloorDB: args.NoiseFloor.DB,
+		NoClean:      args.NoClean,
+		Retry:        args.Retry,
+		Reclean:      args.Reclean,
+		Reverse:      args.Reverse,
+
+		MaxGap:          args.MaxGap,
+		MaxNoisePulses:  args.NoisePulses,
+		HealTiny:        args.Heal,
+		MaxLikelihood:   args.ML,
+		InheritBitWidth: args.Inherit,
+		Check:           check,
+	}
+	if args.Interleave > 1 {
+		cfg.Interleaving = studybox.BlockInterleave{Depth: args.Interleave}
+	}
+
+	var recordErr, firstErr error
+	sched := pipeline.Scheduler{
+		Workers:     args.Workers,
+		FileTimeout: time.Duration(args.Timeout * float64(time.Second)),
+		Config:      cfg,
+		OnResult: func(res *pipeline.Result) {
+			if recordErr != nil || errors.Is(res.Err, context.Canceled) {
+				return
+			}
+			if len(res.Blocks) > 0 {
+				err := writeBlocks(outputs[res.Input], res.Blocks)
+				if err != nil {
+					recordErr = err
+					stop()
+					return
+				}
+			}
+			if err := job.Record(res); err != nil {
+				recordErr = err
+				stop()
+				return
+			}
+			showResult(res)
+			if firstErr == nil {
+				firstErr = res.Err
+			}
+
+			// The blocks have been written, so don't keep them around
+			// until all of the files are done.
+			res.Blocks = nil
+		},
+	}
+	sched.Run(ctx, pending)
+	if recordErr != nil {
+		return recordErr
+	}
+
+	return summarize(job, inputs, ctx.Err() != nil, firstErr)
+}
+
+func outputMetrics() error {
+	if err := metrics.Default.Summary(log.Writer(2)); err != nil {
+		return err
+	}
+	if args.Metrics == "" {
+		return nil
+	}
+	return metrics.Default.SaveJSON(args.Metrics)
+}
+
+// findInputs returns the input files, with the directories replaced by
+// the WAVE files in them (and their subdirectories), along with the name
+// of the output file for each of them.
+func findInputs(paths []string) ([]string, map[string]string, error) {
+	var inputs []string
+	outputs := map[string]string{}
+	owner := map[string]string{}
+
+	add := func(input, name string) error {
+		out := filepath.Join(
+			args.OutDir, strings.TrimSuffix(name, filepath.Ext(name))+".txt",
+		)
+		if other, ok := owner[out]; ok && other != input {
+			return fmt.Errorf(
+				"inputs %v and %v would both be output to %v",
+				other, input, out,
+			)
+		}
+		if _, ok := outputs[input]; !ok {
+			inputs = append(inputs, input)
+		}
+		owner[out], outputs[input] = input, out
+		return nil
+	}
+
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !fi.IsDir() {
+			if err := add(p, filepath.Base(p)); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+
+		var found []string
+		walk := func(fn string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() && strings.EqualFold(filepath.Ext(fn), ".wav") {
+				found = append(found, fn)
+			}
+			return nil
+		}
+		if err := filepath.WalkDir(p, walk); err != nil {
+			return nil, nil, err
+		}
+		sort.Strings(found)
+		for _, fn := range found {
+			rel, err := filepath.Rel(p, fn)
+			if err != nil {
+				return nil, nil, err
+			}
+			if err := add(fn, rel); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return inputs, outputs, nil
+}
+
+// writeBlocks writes the given blocks to the given file, in the same form
+// as stream-decode does.
+func writeBlocks(fn string, blocks []*pipeline.Block) (retErr error) {
+	if err := os.MkdirAll(filepath.Dir(fn), 0o777); err != nil {
+		return err
+	}
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := f.Close(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+	out := bufio.NewWriter(f)
+
+	for _, b := range blocks {
+		fmt.Fprintf(
+			out, "block: start %v, end %v, bit width %v, bits %v, id %v",
+			b.Start, b.End, b.BitWidth, b.Bits.Len(), b.ID(),
+		)
+		if b.Err != nil {
+			fmt.Fprintf(out, ", error: %v\n", b.Err)
+			continue
+		}
+		if b.Ending == mfm.EndNoise {
+			fmt.Fprint(out, ", ended in noise")
+		}
+		fmt.Fprintf(out, ", bytes %v\n  %x\n", len(b.Data), b.Data)
+	}
+	return out.Flush()
+}
+
+func showResult(res *pipeline.Result) {
+	if res.Err != nil {
+		log.F(0, "%v: FAILED: %v\n", res.Input, res.Err)
+		return
+	}
+	log.F(
+		1, "%v: %v blocks (%v failed) in %v\n", res.Input, len(res.Blocks),
+		res.FailedBlocks(), res.Duration.Round(time.Millisecond),
+	)
+}
+
+// summarize shows the state of the job for the given inputs, and returns
+// an error if they are not all done. The exit code for failed files is
+// that of the first one that failed in this run (the earlier ones were
+// redone), and failed blocks are counted as a decode failure.
+func summarize(
+	job *pipeline.Job, inputs []string, stopped bool, firstErr error,
+) error {
+	var done, failed, blocks, failedBlocks, bytes int
+	for _, in := range inputs {
+		e := job.Entry(in)
+		switch {
+		case e == nil:
+			continue
+		case e.Status == pipeline.JobFailed:
+			failed++
+		default:
+			done++
+		}
+		blocks += e.Blocks
+		failedBlocks += e.FailedBlocks
+		bytes += e.Bytes
+	}
+
+	log.F(
+		1, "Files: %v done, %v failed, %v not done, of %v\n"+
+			"Blocks: %v (%v failed), %v bytes\n",
+		done, failed, len(inputs)-done-failed, len(inputs),
+		blocks, failedBlocks, bytes,
+	)
+
+	switch {
+	case stopped:
+		return exitcode.New(
+			exitcode.Interrupted, "interrupted; run again to resume",
+		)
+	case failed > 0:
+		return exitcode.New(
+			exitcode.Of(firstErr), "%v of %v files failed",
+			failed, len(inputs),
+		)
+	case failedBlocks > 0:
+		return exitcode.New(
+			exitcode.Decode, "%v of %v blocks failed to decode",
+			failedBlocks, blocks,
+		)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/edorfaus/sb-mfm-decode/calibrate"
+	"github.com/edorfaus/sb-mfm-decode/exitcode"
+	"github.com/edorfaus/sb-mfm-decode/log"
+	"github.com/edorfaus/sb-mfm-decode/metrics"
+	"github.com/edorfaus/sb-mfm-decode/synth"
+	"github.com/edorfaus/sb-mfm-decode/wav"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(exitcode.Of(err))
+	}
+}
+
+var args = struct {
+	Input  string `arg:"positional" help:"capture of the reference (wav)"`
+	Output string `arg:"positional" help:"calibration output file (JSON)"`
+
+	LogLevel  int    `help:"set the logging level (verbosity)"`
+	Log       string `help:"per-module log levels, e.g. 2,filter=3,mfm=1"`
+	LogTo     string `help:"log output per level, e.g. *=stderr,1=stdout"`
+	WarnLimit int    `help:"max warnings of each kind to show; 0=no limit"`
+	Metrics   string `help:"write timing metrics as JSON" placeholder:"FILE"`
+
+	Reference string `help:"instead, write the reference" placeholder:"FILE"`
+	Rate      int    `help:"sample rate of the reference"`
+}{
+	LogLevel:  log.Level,
+	WarnLimit: log.DefaultWarnLimit,
+	Rate:      48000,
+}
+
+func run() (retErr error) {
+	defer log.WarnSummary()
+	defer func() {
+		if err := outputMetrics(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+
+	argParser := exitcode.MustParse(&args)
+	if (args.Input == "") == (args.Reference == "") {
+		argParser.Fail("give either an input or --reference")
+	}
+	if args.Rate <= 0 {
+		argParser.Fail("rate must be positive")
+	}
+
+	log.Level = args.LogLevel
+	if err := log.SetLevels(args.Log); err != nil {
+		argParser.Fail(err.Error())
+	}
+	if err := log.SetTargets(args.LogTo); err != nil {
+		argParser.Fail(err.Error())
+	}
+	log.Collected.SetLimit(args.WarnLimit)
+
+	if args.Reference != "" {
+		samples := calibrate.Reference(synth.Signal{SampleRate: args.Rate})
+		log.F(
+			1, "Reference: %v samples at %v Hz\n", len(samples), args.Rate,
+		)
+		return wav.SaveMono(args.Reference, args.Rate, 16, samples)
+	}
+
+	samples, meta, err := wav.LoadDataChannel(args.Input)
+	if err != nil {
+		return err
+	}
+	rate, bits := meta.SampleRate, meta.BitDepth
+	log.F(1, "Input: %v-bit samples at %v Hz\n", bits, rate)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	c, err := calibrate.Analyze(ctx, samples, rate, bits)
+	if err != nil {
+		if ctx.Err() != nil {
+			return exitcode.New(exitcode.Interrupted, "%w", err)
+		}
+		if exitcode.Of(err) == exitcode.Internal {
+			return exitcode.New(exitcode.Decode, "%w", err)
+		}
+		return err
+	}
+	if err := c.Summary(log.Writer(1)); err != nil {
+		return err
+	}
+
+	if args.Output == "" {
+		return nil
+	}
+	return c.Save(args.Output)
+}
+
+func outputMetrics() error {
+	if err := metrics.Default.Summary(log.Writer(2)); err != nil {
+		return err
+	}
+	if args.Metrics == "" {
+		return nil
+	}
+	return metrics.Default.SaveJSON(args.Metrics)
+}
@@ -2,22 +2,25 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"os"
 	"time"
 
-	"github.com/alexflint/go-arg"
-
+	"github.com/edorfaus/sb-mfm-decode/events"
+	"github.com/edorfaus/sb-mfm-decode/exitcode"
 	"github.com/edorfaus/sb-mfm-decode/filter"
 	"github.com/edorfaus/sb-mfm-decode/log"
+	"github.com/edorfaus/sb-mfm-decode/metrics"
 	"github.com/edorfaus/sb-mfm-decode/mfm"
+	"github.com/edorfaus/sb-mfm-decode/sample"
 	"github.com/edorfaus/sb-mfm-decode/wav"
 )
 
 func main() {
 	if err := run(); err != nil {
 		fmt.Fprintln(os.Stderr, "Error:", err)
-		os.Exit(1)
+		os.Exit(exitcode.Of(err))
 	}
 }
 
@@ -27,33 +30,72 @@ var args = struct {
 	// TODO: remove default value text from above help text, when go-arg
 	// is updated to a newer version with the fix for auto-printing it.
 
-	LogLevel int  `help:"set the logging level (verbosity)"`
-	NoClean  bool `help:"do not clean the input signal first"`
+	LogLevel  int    `help:"set the logging level (verbosity)"`
+	Log       string `help:"per-module log levels, e.g. 2,filter=3,mfm=1"`
+	LogTo     string `help:"log output per level, e.g. *=stderr,1=stdout"`
+	WarnLimit int    `help:"max warnings of each kind to show; 0=no limit"`
+	Metrics   string `help:"write timing metrics as JSON" placeholder:"FILE"`
+	NoClean   bool   `help:"do not clean the input signal first"`
+
+	NoiseFloor sample.Level `help:"noise floor, e.g. 655 or -34dB; -1 means use 2% of max"`
 
-	NoiseFloor int `help:"noise floor; -1 means use 2% of max"`
+	Normalize string  `help:"normalize the input first: peak or rms"`
+	Level     float64 `help:"level to normalize to; 0=default for the kind"`
 
 	BitWidth float64 `help:"base bit width; 0=by sample rate, -1=none"`
 
-	All bool `help:"output detail info about all pulses"`
+	All  bool `help:"output detail info about all pulses"`
+	Heal bool `help:"merge pairs of tiny pulses that make a valid one"`
+
+	Events string `help:"write events as JSON lines" placeholder:"FILE"`
+
+	Validate string `help:"write pulse disagreements" placeholder:"FILE"`
 }{
 	Output:     "out.txt",
 	LogLevel:   log.Level,
-	NoiseFloor: -1,
+	NoiseFloor: sample.Level{Value: -1},
+	WarnLimit:  log.DefaultWarnLimit,
 }
 
 func run() (retErr error) {
-	argParser := arg.MustParse(&args)
+	defer log.WarnSummary()
+	defer func() {
+		if err := outputMetrics(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+
+	argParser := exitcode.MustParse(&args)
 	if args.BitWidth < 2 && args.BitWidth != 0 && args.BitWidth != -1 {
 		argParser.Fail("bit width must be 0, -1, or at least 2")
 	}
 
 	log.Level = args.LogLevel
+	if err := log.SetLevels(args.Log); err != nil {
+		argParser.Fail(err.Error())
+	}
+	if err := log.SetTargets(args.LogTo); err != nil {
+		argParser.Fail(err.Error())
+	}
+	log.Collected.SetLimit(args.WarnLimit)
+
+	norm, err := wav.ParseNormalizer(args.Normalize, args.Level)
+	if err != nil {
+		argParser.Fail(err.Error())
+	}
 
 	samples, meta, err := wav.LoadDataChannel(args.Input)
 	if err != nil {
 		return err
 	}
 	rate, bits := meta.SampleRate, meta.BitDepth
+	if err := args.NoiseFloor.Check(bits); err != nil {
+		argParser.Fail(err.Error())
+	}
+	if norm != nil {
+		gain := norm.Normalize(samples, bits)
+		log.F(1, "Normalized to %v, gain %.3f\n", norm, gain)
+	}
 
 	type d = time.Duration
 	log.F(
@@ -88,22 +130,54 @@ func run() (retErr error) {
 		}
 	}()
 
-	if err := classify(samples, rate, bits, out); err != nil {
+	var sink events.Sink
+	if args.Events != "" {
+		w, closeEvents, err := events.CreateJSONFile(args.Events)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := closeEvents(); err != nil && retErr == nil {
+				retErr = err
+			}
+		}()
+		sink = w
+	}
+
+	if err := classify(samples, rate, bits, out, sink); err != nil {
 		return err
 	}
 
+	if args.Validate != "" {
+		if err := validate(samples, rate, bits); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+func outputMetrics() error {
+	if err := metrics.Default.Summary(log.Writer(2)); err != nil {
+		return err
+	}
+	if args.Metrics == "" {
+		return nil
+	}
+	return metrics.Default.SaveJSON(args.Metrics)
+}
+
 func getNoiseFloor(bits int) int {
-	if args.NoiseFloor >= 0 {
-		return args.NoiseFloor
+	if !args.NoiseFloor.Unset() {
+		return args.NoiseFloor.Samples(bits)
 	}
 	return filter.DefaultNoiseFloor(bits)
 }
 
 func cleanSamples(samples []int, rate, bits int) error {
-	defer log.Time(1, "Cleaning waveform...\n")("Cleaning done in")
+	defer log.TimeStage(
+		1, "clean", len(samples), "Cleaning waveform...\n",
+	)("Cleaning done in")
 
 	noiseFloor := getNoiseFloor(bits)
 	var peakWidth int
@@ -119,11 +193,17 @@ func cleanSamples(samples []int, rate, bits int) error {
 	return f.Run(samples, samples)
 }
 
-func classify(samples []int, rate, bits int, out *bufio.Writer) error {
-	defer log.Time(1, "Classifying pulses...\n")("Classifying done in")
+func classify(
+	samples []int, rate, bits int, out *bufio.Writer, sink events.Sink,
+) error {
+	defer log.TimeStage(
+		1, "classify", len(samples), "Classifying pulses...\n",
+	)("Classifying done in")
 
 	noiseFloor := getNoiseFloor(bits)
 	pc := mfm.NewPulseClassifier(mfm.NewEdgeDetect(samples, noiseFloor))
+	pc.Events = sink
+	pc.HealTiny = args.Heal
 
 	switch {
 	case args.BitWidth < 0:
@@ -220,9 +300,49 @@ func classify(samples []int, rate, bits int, out *bufio.Writer) error {
 	return nil
 }
 
-func max(a, b int) int {
-	if a > b {
-		return a
+// validate runs the classifier and the decoder over the samples, and
+// writes the pulses that they classify differently to a file.
+func validate(samples []int, rate, bits int) (retErr error) {
+	defer log.TimeStage(
+		1, "validate", len(samples), "Cross-validating pulses...\n",
+	)("Validating done in")
+
+	opts := []mfm.Option{mfm.WithNoiseFloor(getNoiseFloor(bits))}
+	switch {
+	case args.BitWidth < 0:
+		// Do not set the bit width, use the lead-in to find it.
+		bitWidth := mfm.ExpectedBitWidth(mfm.DefaultBitRate, rate)
+		opts = append(opts, mfm.WithMaxCrossingTime(int(bitWidth+0.5)))
+	case args.BitWidth == 0:
+		opts = append(opts, mfm.WithBitRate(mfm.DefaultBitRate, rate))
+	default:
+		opts = append(opts, mfm.WithBitWidth(args.BitWidth))
+	}
+
+	found, err := mfm.CrossValidate(context.Background(), samples, opts...)
+	if err != nil {
+		return err
+	}
+	log.Ln(1, "  disagreements found:", len(found))
+
+	f, err := os.Create(args.Validate)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := f.Close(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+	out := bufio.NewWriter(f)
+
+	fmt.Fprintln(out, "From To Classifier BitWidth Decoder BitWidth")
+	for _, d := range found {
+		fmt.Fprintf(
+			out, "%v %v %v %.4f %v %v\n", d.Start, d.End,
+			d.Classifier, d.ClassifierBitWidth, d.Decoder, d.DecoderBitWidth,
+		)
 	}
-	return b
+
+	return out.Flush()
 }
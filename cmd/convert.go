@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/edorfaus/sb-mfm-decode/exitcode"
+	"github.com/edorfaus/sb-mfm-decode/log"
+	"github.com/edorfaus/sb-mfm-decode/metrics"
+	"github.com/edorfaus/sb-mfm-decode/mfm"
+	"github.com/edorfaus/sb-mfm-decode/pipeline"
+	"github.com/edorfaus/sb-mfm-decode/sample"
+	"github.com/edorfaus/sb-mfm-decode/studybox"
+	"github.com/edorfaus/sb-mfm-decode/synth"
+	"github.com/edorfaus/sb-mfm-decode/wav"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(exitcode.Of(err))
+	}
+}
+
+var args = struct {
+	Input  string `arg:"positional,required" help:"input file"`
+	Output string `arg:"positional,required" help:"output file"`
+
+	From string `help:"input format: wav, bits, studybox; default: by name"`
+	To   string `help:"output format: wav, bits, studybox; default: by name"`
+	Rate int    `help:"sample rate to render at, if there is no audio"`
+
+	LogLevel  int    `help:"set the logging level (verbosity)"`
+	Log       string `help:"per-module log levels, e.g. 2,filter=3,mfm=1"`
+	LogTo     string `help:"log output per level, e.g. *=stderr,1=stdout"`
+	WarnLimit int    `help:"max warnings of each kind to show; 0=no limit"`
+	Metrics   string `help:"write timing metrics as JSON" placeholder:"FILE"`
+	NoClean   bool   `help:"do not clean the input signal first"`
+
+	NoiseFloor sample.Level `help:"noise floor, e.g. 655 or -34dB; -1 means use 2% of max"`
+
+	Retry   bool `help:"retry failed blocks with other settings"`
+	Reverse bool `help:"also decode failed blocks backwards, from the end"`
+
+	MaxGap      float64 `help:"bridge dropouts up to this many bit widths"`
+	NoisePulses int     `help:"trim up to this many noise pulses at block end"`
+	Heal        bool    `help:"merge tiny pulse pairs that make a valid one"`
+	ML          bool    `help:"find the most likely pulse sequence per block"`
+	Interleave  int     `help:"deinterleave bytes with this block depth"`
+	Check       string  `help:"data check: none, xor, sum, parity, crc16"`
+}{
+	Rate:       44100,
+	LogLevel:   log.Level,
+	NoiseFloor: sample.Level{Value: -1},
+	WarnLimit:  log.DefaultWarnLimit,
+}
+
+// The formats that can be converted between, by their usual extensions.
+var formats = map[string]string{
+	".wav":      "wav",
+	".bits":     "bits",
+	".studybox": "studybox",
+}
+
+func run() (retErr error) {
+	defer log.WarnSummary()
+	defer func() {
+		if err := outputMetrics(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+
+	argParser := exitcode.MustParse(&args)
+	from, err := format(args.From, args.Input)
+	if err != nil {
+		argParser.Fail(err.Error())
+	}
+	to, err := format(args.To, args.Output)
+	if err != nil {
+		argParser.Fail(err.Error())
+	}
+	if args.Rate <= 0 {
+		argParser.Fail("rate must be positive")
+	}
+	check, err := studybox.ParseChecker(args.Check)
+	if err != nil {
+		argParser.Fail(err.Error())
+	}
+
+	log.Level = args.LogLevel
+	if err := log.SetLevels(args.Log); err != nil {
+		argParser.Fail(err.Error())
+	}
+	if err := log.SetTargets(args.LogTo); err != nil {
+		argParser.Fail(err.Error())
+	}
+	log.Collected.SetLimit(args.WarnLimit)
+
+	cfg := pipeline.Config{
+		NoiseFloor:   args.NoiseFloor.Value,
+		NoiseFloorDB: args.NoiseFloor.DB,
+		NoClean:      args.NoClean,
+		Retry:        args.Retry,
+		Reverse:      args.Reverse,
+
+		MaxGap:         args.MaxGap,
+		MaxNoisePulses: args.NoisePulses,
+		HealTiny:       args.Heal,
+		MaxLikelihood:  args.ML,
+		Check:          check,
+	}
+	if args.Interleave > 1 {
+		cfg.Interleaving = studybox.BlockInterleave{Depth: args.Interleave}
+	}
+
+	var t *tape
+	switch from {
+	case "wav":
+		t, err = readWAV(args.Input, cfg)
+	case "bits":
+		t, err = readBits(args.Input, cfg)
+	case "studybox":
+		t, err = readTape(args.Input, cfg)
+	}
+	if err != nil {
+		return err
+	}
+	log.F(
+		1, "Read %v blocks from %v (%v)\n", len(t.blocks), args.Input, from,
+	)
+
+	switch to {
+	case "wav":
+		return writeWAV(t, args.Output)
+	case "bits":
+		return writeBits(t, args.Output)
+	}
+	return writeTape(t, args.Output)
+}
+
+func outputMetrics() error {
+	if err := metrics.Default.Summary(log.Writer(2)); err != nil {
+		return err
+	}
+	if args.Metrics == "" {
+		return nil
+	}
+	return metrics.Default.SaveJSON(args.Metrics)
+}
+
+// format returns the given format, or if it is empty, the format of the
+// given file as given by its extension.
+func format(name, fn string) (string, error) {
+	if name == "" {
+		name = formats[strings.ToLower(filepath.Ext(fn))]
+		if name == "" {
+			return "", fmt.Errorf("unknown format of %v; use --from/--to", fn)
+		}
+	}
+	for _, f := range formats {
+		if f == name {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("unknown format: %v", name)
+}
+
+// tape is what is converted: the blocks of a tape, and its audio.
+type tape struct {
+	// The sample rate that the positions of the blocks are given in.
+	rate int
+
+	blocks []block
+
+	// The audio of the tape, if known, as a WAVE file; either as its
+	// data, or as the file that it is in.
+	audio     []byte
+	audioFile string
+}
+
+// block is a block of a tape, which has its MFM bits or its data, or both.
+type block struct {
+	// The sample indexes of the start and end of the block, and of the
+	// start of its data (after the lead-in); dataStart is 0 if unknown.
+	start, end, dataStart int
+
+	bits mfm.PackedBits
+
+	// The data of the block, and the error if it could not be decoded.
+	data []byte
+	err  error
+}
+
+func readWAV(fn string, cfg pipeline.Config) (*tape, error) {
+	res := pipeline.DecodeFile(context.Background(), fn, cfg)
+	if res.Err != nil && len(res.Blocks) == 0 {
+		return nil, res.Err
+	}
+	if res.Err != nil {
+		log.Warn("decode stopped early:", res.Err)
+	}
+
+	t := &tape{rate: res.Meta.SampleRate, audioFile: fn}
+	for _, b := range res.Blocks {
+		tb := block{start: b.Start, end: b.End, bits: b.Bits, err: b.Err}
+		if b.Err == nil {
+			tb.data = b.Data
+		}
+		tb.setDataStart()
+		t.blocks = append(t.blocks, tb)
+	}
+	return t, nil
+}
+
+func readBits(fn string, cfg pipeline.Config) (*tape, error) {
+	l, err := mfm.LoadBitLog(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	f := studybox.Format{Interleaving: cfg.Interleaving, Check: cfg.Check}
+	t := &tape{rate: l.SampleRate}
+	for _, b := range l.Blocks {
+		tb := block{start: b.Start, end: b.End, bits: b.Bits}
+		if data, err := f.DecodeBlock(b.Bits.Unpack(nil)); err == nil {
+			tb.data = data
+		} else {
+			tb.err = err
+		}
+		tb.setDataStart()
+		t.blocks = append(t.blocks, tb)
+	}
+	return t, nil
+}
+
+func readTape(fn string, cfg pipeline.Config) (*tape, error) {
+	st, err := studybox.LoadTape(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &tape{rate: args.Rate}
+	switch {
+	case st.Audio == nil:
+		log.Ln(1, "The tape image has no audio")
+	case st.AudioType != studybox.AudioWAV:
+		log.Warn(fmt.Sprintf(
+			"ignoring the audio, as it is %v, not WAV", st.AudioType,
+		))
+	default:
+		meta, err := wav.ReadMeta(bytes.NewReader(st.Audio))
+		if err != nil {
+			return nil, fmt.Errorf("audio of %v: %w", fn, err)
+		}
+		t.rate, t.audio = meta.SampleRate, st.Audio
+	}
+
+	// The pages are encoded again, at the usual bit rate, with as much of
+	// a lead-in as fits before the start of their data. The pages whose
+	// position is not known (a Start of 0) are laid out one after another,
+	// a gap after the previous block, with a lead-in of unknownLeadIn.
+	bitWidth := float64(t.rate) / mfm.DefaultBitRate
+	gap := t.rate / 10
+	end := 0
+	for _, p := range st.Pages {
+		data := p.Data
+		if cfg.Interleaving != nil {
+			data, err = studybox.Interleave(cfg.Interleaving, nil, data)
+			if err != nil {
+				return nil, err
+			}
+		}
+		dataStart := p.Start
+		leadIn := int(math.Round(float64(p.Start-p.LeadIn)/bitWidth)) - 1
+		if dataStart == 0 {
+			leadIn = unknownLeadIn
+			dataStart = end + gap + int(math.Round(float64(leadIn+1)*bitWidth))
+		}
+		if leadIn < minLeadIn {
+			leadIn = minLeadIn
+		}
+		bits := studybox.EncodeBlock(data, leadIn)
+		start := dataStart - int(math.Round(float64(leadIn+1)*bitWidth))
+		end = start + int(float64(len(bits))*bitWidth/2)
+		t.blocks = append(t.blocks, block{
+			start:     start,
+			end:       end,
+			dataStart: dataStart,
+			bits:      mfm.PackBits(bits),
+			data:      p.Data,
+		})
+	}
+	return t, nil
+}
+
+// minLeadIn is the least number of lead-in bits to encode a page with,
+// and unknownLeadIn is the number to encode a page whose position is not
+// known with.
+const minLeadIn, unknownLeadIn = 8, 64
+
+// setDataStart sets the dataStart of the block from its bits, assuming
+// that they are evenly spaced from its start to its end.
+func (b *block) setDataStart() {
+	bits := b.bits.Unpack(nil)
+	rest, err := studybox.SkipLeadIn(bits)
+	if err != nil || len(bits) == 0 {
+		return
+	}
+	leadIn := len(bits) - len(rest)
+	b.dataStart = b.start + (b.end-b.start)*leadIn/len(bits)
+}
+
+// loadAudio reads the audio of the tape from its file, if it is in one.
+func (t *tape) loadAudio() error {
+	if t.audioFile == "" || t.audio != nil {
+		return nil
+	}
+	data, err := os.ReadFile(t.audioFile)
+	if err != nil {
+		return err
+	}
+	t.audio = data
+	return nil
+}
+
+func writeWAV(t *tape, fn string) error {
+	if err := t.loadAudio(); err != nil {
+		return err
+	}
+	if t.audio != nil {
+		return os.WriteFile(fn, t.audio, 0o666)
+	}
+	return render(t, fn)
+}
+
+func writeBits(t *tape, fn string) (retErr error) {
+	l := &mfm.BitLog{SampleRate: t.rate}
+	for _, b := range t.blocks {
+		if b.bits.Len() == 0 {
+			continue
+		}
+		l.Blocks = append(l.Blocks, mfm.BitBlock{
+			Start: b.start, End: b.end, Bits: b.bits,
+		})
+	}
+
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := f.Close(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+	return mfm.WriteBitLog(f, l)
+}
+
+// writeTape writes the blocks that have data as the pages of a tape
+// image, with the audio of the tape, rendering it from the blocks if it
+// is not known. The blocks that failed to decode are left out.
+func writeTape(t *tape, fn string) error {
+	st := &studybox.Tape{AudioType: studybox.AudioWAV}
+	var errs []error
+	for _, b := range t.blocks {
+		if b.data == nil {
+			errs = append(errs, b.err)
+			continue
+		}
+		leadIn := b.start
+		if b.dataStart == 0 {
+			leadIn = 0
+		}
+		st.Pages = append(st.Pages, studybox.TapePage{
+			LeadIn: leadIn,
+			Start:  b.dataStart,
+			Data:   b.data,
+		})
+	}
+	if len(errs) > 0 {
+		log.Warn("leaving out", len(errs), "blocks that failed to decode")
+	}
+
+	if err := t.loadAudio(); err != nil {
+		return err
+	}
+	if t.audio == nil {
+		data, err := renderData(t)
+		if err != nil {
+			return err
+		}
+		t.audio = data
+	}
+	st.Audio = t.audio
+
+	if err := st.Save(fn); err != nil {
+		return err
+	}
+	return exitcode.FailedBlocks(errs, len(t.blocks))
+}
+
+// render renders the MFM bits of the blocks into an ideal signal, and
+// saves it as a WAVE file. The blocks that failed to decode are left out,
+// as their bits may stop partway, and so do not tell where they belong.
+func render(t *tape, fn string) error {
+	sig := synth.New(synth.Signal{SampleRate: t.rate})
+	for _, b := range t.blocks {
+		if b.bits.Len() == 0 || b.data == nil {
+			continue
+		}
+		if b.start < sig.Len() {
+			log.WarnAt(b.start, "skipping a block that overlaps the last")
+			continue
+		}
+		halfBit := float64(b.end-b.start) / float64(b.bits.Len())
+		sig.MFMAt(b.bits.Unpack(nil), func(i int) float64 {
+			return float64(b.start) + float64(i)*halfBit
+		})
+	}
+	// End with a bit of silence, like a recording would.
+	sig.Silence(t.rate / 10)
+
+	return wav.SaveMono(fn, sig.SampleRate, sig.BitDepth, sig.Render())
+}
+
+// renderData is like render, but returns the data of the WAVE file.
+func renderData(t *tape) ([]byte, error) {
+	f, err := os.CreateTemp("", "convert-*.wav")
+	if err != nil {
+		return nil, err
+	}
+	fn := f.Name()
+	defer os.Remove(fn)
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+
+	if err := render(t, fn); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(fn)
+}
@@ -1,23 +1,27 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"golang.org/x/exp/slices"
 
-	"github.com/alexflint/go-arg"
-
+	"github.com/edorfaus/sb-mfm-decode/exitcode"
 	"github.com/edorfaus/sb-mfm-decode/filter"
 	"github.com/edorfaus/sb-mfm-decode/log"
+	"github.com/edorfaus/sb-mfm-decode/metrics"
+	"github.com/edorfaus/sb-mfm-decode/sample"
 	"github.com/edorfaus/sb-mfm-decode/wav"
 )
 
 func main() {
 	if err := run(); err != nil {
 		fmt.Fprintln(os.Stderr, "Error:", err)
-		os.Exit(1)
+		os.Exit(exitcode.Of(err))
 	}
 }
 
@@ -27,29 +31,82 @@ var args = struct {
 	Output string `arg:"positional" help:"output wav file [out.wav]"`
 	// TODO: remove default value text from above help text, when go-arg
 	// is updated to a newer version with the fix for auto-printing it.
-	Debug bool `help:"print verbose debug info (log level 4)"`
+	Debug     bool   `help:"print verbose debug info (log level 4)"`
+	Log       string `help:"per-module log levels, e.g. 2,filter=3,mfm=1"`
+	LogTo     string `help:"log output per level, e.g. *=stderr,1=stdout"`
+	WarnLimit int    `help:"max warnings of each kind to show; 0=no limit"`
+	Metrics   string `help:"write timing metrics as JSON" placeholder:"FILE"`
+
+	NoiseFloor sample.Level `help:"noise floor, e.g. 655 or -34dB; -1 means use 2% of max"`
+	PeakWidth  int          `help:"width of a peak; 0 means use default"`
+	Offsets    bool         `help:"output offsets instead of adjusted samples"`
+	Stereo     bool         `help:"output both offsets and samples as stereo"`
+
+	Normalize string  `help:"normalize the input first: peak or rms"`
+	Level     float64 `help:"level to normalize to; 0=default for the kind"`
+
+	Diff   bool   `arg:"--differential" help:"use left minus right as input"`
+	Wiener bool   `help:"also reduce noise with a Wiener filter"`
+	Gate   bool   `help:"use a noise gate instead of the cleanup"`
+	Curve  string `help:"offset curve to use (CSV or WAV)" placeholder:"FILE"`
 
-	NoiseFloor int  `help:"noise floor; -1 means use 2% of max"`
-	PeakWidth  int  `help:"width of a peak; 0 means use default"`
-	Offsets    bool `help:"output offsets instead of adjusted samples"`
-	Stereo     bool `help:"output both offsets and samples as stereo"`
+	Groups    string `help:"write the groups of peaks as CSV" placeholder:"FILE"`
+	SaveCurve string `help:"write the offset curve as CSV" placeholder:"FILE"`
 }{
 	Output:     "out.wav",
-	NoiseFloor: -1,
+	NoiseFloor: sample.Level{Value: -1},
+	WarnLimit:  log.DefaultWarnLimit,
 }
 
-func run() error {
-	arg.MustParse(&args)
+func run() (retErr error) {
+	defer log.WarnSummary()
+	defer func() {
+		if err := outputMetrics(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+
+	argParser := exitcode.MustParse(&args)
 
 	if args.Debug {
 		log.Level = 4
 	}
+	if err := log.SetLevels(args.Log); err != nil {
+		argParser.Fail(err.Error())
+	}
+	if err := log.SetTargets(args.LogTo); err != nil {
+		argParser.Fail(err.Error())
+	}
+	log.Collected.SetLimit(args.WarnLimit)
+
+	if args.Gate && args.Curve != "" {
+		argParser.Fail("gate cannot be used with an offset curve")
+	}
+	if args.Gate && (args.Groups != "" || args.SaveCurve != "") {
+		argParser.Fail("gate cannot be used with --groups or --savecurve")
+	}
+
+	norm, err := wav.ParseNormalizer(args.Normalize, args.Level)
+	if err != nil {
+		argParser.Fail(err.Error())
+	}
 
-	samples, meta, err := wav.LoadDataChannel(args.Input)
+	load := wav.LoadDataChannel
+	if args.Diff {
+		load = wav.LoadDifference
+	}
+	samples, meta, err := load(args.Input)
 	if err != nil {
 		return err
 	}
 	rate, bits := meta.SampleRate, meta.BitDepth
+	if err := args.NoiseFloor.Check(bits); err != nil {
+		argParser.Fail(err.Error())
+	}
+	if norm != nil {
+		gain := norm.Normalize(samples, bits)
+		log.F(1, "Normalized to %v, gain %.3f\n", norm, gain)
+	}
 
 	type d = time.Duration
 	fmt.Printf(
@@ -62,7 +119,15 @@ func run() error {
 		fmt.Printf("Input sample min: %v, max: %v\n", l, h)
 	}
 
-	output, err := runFilter(samples, rate, bits)
+	var curve filter.OffsetCurve
+	if args.Curve != "" {
+		curve, err = loadCurve(args.Curve, len(samples))
+		if err != nil {
+			return err
+		}
+	}
+
+	output, err := runFilter(samples, rate, bits, curve)
 	if err != nil {
 		return err
 	}
@@ -96,17 +161,58 @@ func run() error {
 	return nil
 }
 
-func runFilter(samples []int, rate, bits int) ([]int, error) {
+func outputMetrics() error {
+	if err := metrics.Default.Summary(log.Writer(2)); err != nil {
+		return err
+	}
+	if args.Metrics == "" {
+		return nil
+	}
+	return metrics.Default.SaveJSON(args.Metrics)
+}
+
+// loadCurve loads the offset curve in the given file, which is either a
+// CSV file of index,offset points, or a WAVE file of offsets (in its first
+// channel), as written by --offsets or --stereo. The input has the given
+// number of samples, which a WAVE file must match.
+func loadCurve(fn string, samples int) (filter.OffsetCurve, error) {
+	if !strings.EqualFold(filepath.Ext(fn), ".wav") {
+		c, err := filter.LoadOffsetCurve(fn)
+		if err != nil && exitcode.Of(err) == exitcode.Internal {
+			// Not an I/O error, so the file is not a valid curve.
+			return nil, exitcode.New(exitcode.Format, "%w", err)
+		}
+		return c, err
+	}
+
+	channels, _, err := wav.LoadChannels(fn)
+	if err != nil {
+		return nil, err
+	}
+	if len(channels[0]) != samples {
+		return nil, exitcode.New(
+			exitcode.Format, "offset curve has %v samples, input has %v",
+			len(channels[0]), samples,
+		)
+	}
+	return filter.OffsetCurveOf(channels[0]), nil
+}
+
+func runFilter(
+	samples []int, rate, bits int, curve filter.OffsetCurve,
+) ([]int, error) {
 	output := samples
 	if args.Stats || args.Offsets || args.Stereo {
 		output = make([]int, len(samples))
 	}
 
-	defer log.Time(1, "Running filter...\n")("Filter done in")
+	defer log.TimeStage(
+		1, "clean", len(samples), "Running filter...\n",
+	)("Filter done in")
 
 	noiseFloor := filter.DefaultNoiseFloor(bits)
-	if args.NoiseFloor >= 0 {
-		noiseFloor = args.NoiseFloor
+	if !args.NoiseFloor.Unset() {
+		noiseFloor = args.NoiseFloor.Samples(bits)
 	}
 
 	peakWidth := filter.MfmPeakWidth(4800, rate)
@@ -114,10 +220,84 @@ func runFilter(samples []int, rate, bits int) ([]int, error) {
 		peakWidth = args.PeakWidth
 	}
 
-	log.F(1, "Noise floor: %v, peak width: %v\n", noiseFloor, peakWidth)
+	if args.Gate {
+		log.F(
+			1, "Gate: noise floor %v, peak width %v\n", noiseFloor, peakWidth,
+		)
+		f := filter.NewGate(noiseFloor, peakWidth)
+		if err := f.Run(samples, output); err != nil {
+			return output, err
+		}
+		return output, runWiener(output, noiseFloor)
+	}
 
 	f := filter.NewDCOffset(noiseFloor, peakWidth)
-	return output, f.Run(samples, output)
+	if len(curve) > 0 {
+		log.F(1, "Offset curve: %v points\n", len(curve))
+		f.Curve = curve
+	} else {
+		log.F(1, "Noise floor: %v, peak width: %v\n", noiseFloor, peakWidth)
+	}
+	if args.Groups == "" && args.SaveCurve == "" {
+		if err := f.Run(samples, output); err != nil {
+			return output, err
+		}
+		return output, runWiener(output, noiseFloor)
+	}
+
+	// Run the detection and the application as separate passes, to save
+	// what was detected.
+	seg, err := f.Segment(samples)
+	if err != nil {
+		return output, err
+	}
+	log.F(
+		1, "Found %v groups of peaks, offset curve of %v points\n",
+		len(seg.Groups), len(seg.Offsets),
+	)
+	if err := saveSegmentation(seg); err != nil {
+		return output, err
+	}
+	if err := filter.ApplyOffsets(seg.Offsets, samples, output); err != nil {
+		return output, err
+	}
+	return output, runWiener(output, noiseFloor)
+}
+
+// saveSegmentation writes the groups of peaks and the offset curve that
+// the filter found to the files given for them, if any.
+func saveSegmentation(seg *filter.Segmentation) error {
+	if args.SaveCurve != "" {
+		if err := seg.Offsets.Save(args.SaveCurve); err != nil {
+			return err
+		}
+	}
+	if args.Groups == "" {
+		return nil
+	}
+	f, err := os.Create(args.Groups)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	fmt.Fprintln(w, "start,end,peaks")
+	for _, g := range seg.Groups {
+		fmt.Fprintf(w, "%v,%v,%v\n", g.Start, g.End, g.Peaks)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// runWiener runs the Wiener filter on the output, if it was asked for.
+func runWiener(output []int, noiseFloor int) error {
+	if !args.Wiener {
+		return nil
+	}
+	w := filter.NewWiener(noiseFloor, filter.DefaultWienerFrame)
+	return w.Run(output, output)
 }
 
 func outputStats(samples, output []int) {
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/edorfaus/sb-mfm-decode/exitcode"
+	"github.com/edorfaus/sb-mfm-decode/filter"
+	"github.com/edorfaus/sb-mfm-decode/log"
+	"github.com/edorfaus/sb-mfm-decode/mfm"
+	"github.com/edorfaus/sb-mfm-decode/quality"
+	"github.com/edorfaus/sb-mfm-decode/sample"
+	"github.com/edorfaus/sb-mfm-decode/wav"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(exitcode.Of(err))
+	}
+}
+
+var args = struct {
+	Input  string `arg:"positional,required" help:"input wav file"`
+	Output string `arg:"positional" help:"output text file [-]"`
+	// TODO: remove default value text from above help text, when go-arg
+	// is updated to a newer version with the fix for auto-printing it.
+
+	LogLevel  int    `help:"set the logging level (verbosity)"`
+	Log       string `help:"per-module log levels, e.g. 2,filter=3,mfm=1"`
+	LogTo     string `help:"log output per level, e.g. *=stderr,1=stdout"`
+	WarnLimit int    `help:"max warnings of each kind to show; 0=no limit"`
+
+	NoiseFloor sample.Level `help:"noise floor, e.g. 655 or -34dB; -1 means use 2% of max"`
+	BitRate    int          `help:"the MFM bit rate of the data"`
+}{
+	Output:     "-",
+	LogLevel:   log.Level,
+	NoiseFloor: sample.Level{Value: -1},
+	WarnLimit:  log.DefaultWarnLimit,
+	BitRate:    mfm.DefaultBitRate,
+}
+
+func run() (retErr error) {
+	defer log.WarnSummary()
+
+	argParser := exitcode.MustParse(&args)
+	if args.BitRate < 1 {
+		argParser.Fail("bit rate must be positive")
+	}
+
+	log.Level = args.LogLevel
+	if err := log.SetLevels(args.Log); err != nil {
+		argParser.Fail(err.Error())
+	}
+	if err := log.SetTargets(args.LogTo); err != nil {
+		argParser.Fail(err.Error())
+	}
+	log.Collected.SetLimit(args.WarnLimit)
+
+	channels, meta, err := wav.LoadChannels(args.Input)
+	if err != nil {
+		return err
+	}
+	rate, bits := meta.SampleRate, meta.BitDepth
+	if err := args.NoiseFloor.Check(bits); err != nil {
+		argParser.Fail(err.Error())
+	}
+
+	type d = time.Duration
+	n := len(channels[0])
+	log.F(
+		1, "Input: %v channels of %v %v-bit samples at %v Hz = %v\n",
+		len(channels), n, bits, rate, d(n)*time.Second/d(rate),
+	)
+
+	noiseFloor := args.NoiseFloor.Samples(bits)
+	if noiseFloor < 0 {
+		noiseFloor = filter.DefaultNoiseFloor(bits)
+	}
+	if noiseFloor == 0 {
+		argParser.Fail("noise floor must be at least 1 sample value")
+	}
+
+	findings := quality.CheckCapture(quality.Capture{
+		Channels:   channels,
+		Data:       wav.DataChannel(len(channels)),
+		SampleRate: rate,
+		BitDepth:   bits,
+		NoiseFloor: noiseFloor,
+		BitRate:    args.BitRate,
+	})
+
+	var out *bufio.Writer
+	if args.Output == "-" {
+		out = bufio.NewWriter(os.Stdout)
+	} else {
+		f, err := os.Create(args.Output)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := f.Close(); err != nil && retErr == nil {
+				retErr = err
+			}
+		}()
+		out = bufio.NewWriter(f)
+	}
+
+	problems := 0
+	for _, f := range findings {
+		fmt.Fprintf(out, "%-7s %-11s %s\n", f.Severity, f.Check, f.Message)
+		if f.Advice != "" {
+			fmt.Fprintf(out, "%19s -> %s\n", "", f.Advice)
+		}
+		if f.Severity == quality.SeverityProblem {
+			problems++
+		}
+	}
+	if err := out.Flush(); err != nil {
+		return err
+	}
+
+	// Fail if there were problems, so that scripts can check a capture
+	// before starting a long decode of it. They are reported as a bad
+	// input, as the capture should be redone.
+	if problems > 0 {
+		return exitcode.New(
+			exitcode.Format, "found %v problems with the capture", problems,
+		)
+	}
+	return nil
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"os"
+
+	"github.com/edorfaus/sb-mfm-decode/exitcode"
+	"github.com/edorfaus/sb-mfm-decode/log"
+	"github.com/edorfaus/sb-mfm-decode/metrics"
+	"github.com/edorfaus/sb-mfm-decode/mfm"
+	"github.com/edorfaus/sb-mfm-decode/pipeline"
+	"github.com/edorfaus/sb-mfm-decode/sample"
+	"github.com/edorfaus/sb-mfm-decode/wav"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(exitcode.Of(err))
+	}
+}
+
+var args = struct {
+	Input  string `arg:"positional,required" help:"input wav file"`
+	Output string `arg:"positional" help:"output csv file [drift.csv]"`
+
+	PNG      string  `help:"also plot the tape speed to this PNG file"`
+	Curve    string  `help:"write the speed curve as CSV" placeholder:"FILE"`
+	Resample string  `help:"write the input corrected for the speed"`
+	Interval float64 `help:"seconds of the capture per row"`
+	BitRate  int     `help:"the nominal MFM bit rate of the tape"`
+
+	LogLevel  int    `help:"set the logging level (verbosity)"`
+	Log       string `help:"per-module log levels, e.g. 2,filter=3,mfm=1"`
+	LogTo     string `help:"log output per level, e.g. *=stderr,1=stdout"`
+	WarnLimit int    `help:"max warnings of each kind to show; 0=no limit"`
+	Metrics   string `help:"write timing metrics as JSON" placeholder:"FILE"`
+	NoClean   bool   `help:"do not clean the input signal first"`
+
+	NoiseFloor sample.Level `help:"noise floor, e.g. 655 or -34dB; -1 means use 2% of max"`
+
+	MaxGap float64 `help:"bridge dropouts up to this many bit widths"`
+	Heal   bool    `help:"merge tiny pulse pairs that make a valid one"`
+}{
+	Output:     "drift.csv",
+	Interval:   0.1,
+	BitRate:    mfm.DefaultBitRate,
+	LogLevel:   log.Level,
+	NoiseFloor: sample.Level{Value: -1},
+	WarnLimit:  log.DefaultWarnLimit,
+}
+
+func run() (retErr error) {
+	defer log.WarnSummary()
+	defer func() {
+		if err := outputMetrics(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+
+	argParser := exitcode.MustParse(&args)
+	if args.Interval <= 0 || args.BitRate <= 0 {
+		argParser.Fail("interval and bit rate must be positive")
+	}
+
+	log.Level = args.LogLevel
+	if err := log.SetLevels(args.Log); err != nil {
+		argParser.Fail(err.Error())
+	}
+	if err := log.SetTargets(args.LogTo); err != nil {
+		argParser.Fail(err.Error())
+	}
+	log.Collected.SetLimit(args.WarnLimit)
+
+	r, err := wav.OpenReader(args.Input)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	rate, bits := r.Meta.SampleRate, r.Meta.BitDepth
+
+	cfg := pipeline.Config{
+		NoiseFloor:   args.NoiseFloor.Value,
+		NoiseFloorDB: args.NoiseFloor.DB,
+		NoClean:      args.NoClean,
+
+		MaxGap:   args.MaxGap,
+		HealTiny: args.Heal,
+	}
+	s := pipeline.NewStream(r, rate, bits, cfg)
+	defer s.Close()
+
+	tracker := mfm.NewSpeedTracker(
+		int(args.Interval*float64(rate)), float64(rate)/float64(args.BitRate),
+	)
+	s.Pulses = tracker
+	for {
+		_, err := s.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	points := speedPoints(tracker, rate)
+	if len(points) == 0 {
+		return exitcode.New(exitcode.Decode, "no MFM pulses found")
+	}
+	showSummary(points)
+
+	if err := writeCSV(args.Output, points); err != nil {
+		return err
+	}
+	if args.PNG != "" {
+		if err := plot(args.PNG, points); err != nil {
+			return err
+		}
+	}
+	if args.Curve != "" {
+		if err := writeCurve(args.Curve, tracker.Curve()); err != nil {
+			return err
+		}
+	}
+	if args.Resample != "" {
+		return resample(args.Resample, tracker.Curve())
+	}
+	return nil
+}
+
+func outputMetrics() error {
+	if err := metrics.Default.Summary(log.Writer(2)); err != nil {
+		return err
+	}
+	if args.Metrics == "" {
+		return nil
+	}
+	return metrics.Default.SaveJSON(args.Metrics)
+}
+
+// point is the speed in an interval of the capture.
+type point struct {
+	// The time of the middle of the interval, in seconds.
+	Time float64
+
+	mfm.SpeedPoint
+}
+
+// speedPoints returns the intervals that had enough pulses in them.
+func speedPoints(t *mfm.SpeedTracker, rate int) []point {
+	var ps []point
+	for _, p := range t.Points() {
+		ps = append(ps, point{
+			Time:       (p.Start + p.End) / 2 / float64(rate),
+			SpeedPoint: p,
+		})
+	}
+	return ps
+}
+
+// showSummary logs the mean, slowest and fastest speed.
+func showSummary(points []point) {
+	sum, lo, hi := 0.0, points[0], points[0]
+	for _, p := range points {
+		sum += p.Speed
+		if p.Speed < lo.Speed {
+			lo = p
+		}
+		if p.Speed > hi.Speed {
+			hi = p
+		}
+	}
+	log.F(
+		1, "Speed: mean %.2f%%, slowest %.2f%% at %.1f s,"+
+			" fastest %.2f%% at %.1f s\n",
+		sum/float64(len(points))*100, lo.Speed*100, lo.Time,
+		hi.Speed*100, hi.Time,
+	)
+}
+
+func writeCSV(fn string, points []point) (retErr error) {
+	var out *bufio.Writer
+	if fn == "-" {
+		out = bufio.NewWriter(os.Stdout)
+	} else {
+		f, err := os.Create(fn)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := f.Close(); err != nil && retErr == nil {
+				retErr = err
+			}
+		}()
+		out = bufio.NewWriter(f)
+	}
+
+	fmt.Fprintln(out, "time_s,bit_width,speed,pulses")
+	for _, p := range points {
+		fmt.Fprintf(
+			out, "%.3f,%.4f,%.5f,%v\n", p.Time, p.BitWidth, p.Speed, p.Pulses,
+		)
+	}
+	return out.Flush()
+}
+
+func writeCurve(fn string, c sample.SpeedCurve) (retErr error) {
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := f.Close(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+	return sample.WriteSpeedCurve(f, c)
+}
+
+// resample writes the data channel of the input to the given file, after
+// resampling it by the given speed curve so it has the nominal speed.
+func resample(fn string, c sample.SpeedCurve) error {
+	r, err := wav.OpenReader(args.Input)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	out, err := func() ([]int, error) {
+		defer log.TimeStage(
+			1, "resample", r.Frames, "Correcting the speed...",
+		)(" done in")
+		src := pipeline.NewResampler(r, c)
+		var out []int
+		buf := make([]int, 64*1024)
+		for {
+			n, err := src.ReadSamples(buf)
+			out = append(out, buf[:n]...)
+			if err == io.EOF {
+				return out, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	return wav.SaveMono(fn, r.Meta.SampleRate, r.Meta.BitDepth, out)
+}
+
+// The size of the plot, in pixels.
+const plotWidth, plotHeight = 1000, 400
+
+var (
+	plotBackground = color.RGBA{255, 255, 255, 255}
+	plotGrid       = color.RGBA{220, 220, 220, 255}
+	plotNominal    = color.RGBA{128, 128, 128, 255}
+	plotLine       = color.RGBA{0, 64, 192, 255}
+)
+
+// plot draws the speed over time as a PNG image, with the nominal speed as
+// a dark line, grid lines every 1% of speed and every 10 seconds, and gaps
+// where there was no signal.
+func plot(fn string, points []point) (retErr error) {
+	lo, hi := 1.0, 1.0
+	for _, p := range points {
+		lo, hi = math.Min(lo, p.Speed), math.Max(hi, p.Speed)
+	}
+	lo, hi = math.Floor(lo*100-0.5)/100, math.Ceil(hi*100+0.5)/100
+	end := points[len(points)-1].Time + args.Interval/2
+
+	img := image.NewRGBA(image.Rect(0, 0, plotWidth, plotHeight))
+	x := func(t float64) int {
+		return int(t / end * (plotWidth - 1))
+	}
+	y := func(speed float64) int {
+		return int((hi - speed) / (hi - lo) * (plotHeight - 1))
+	}
+
+	for i := 0; i < plotWidth*plotHeight; i++ {
+		img.Set(i%plotWidth, i/plotWidth, plotBackground)
+	}
+	for t := 10.0; t < end; t += 10 {
+		for j := 0; j < plotHeight; j++ {
+			img.Set(x(t), j, plotGrid)
+		}
+	}
+	for pct := math.Round(lo * 100); pct <= hi*100; pct++ {
+		c := plotGrid
+		if pct == 100 {
+			c = plotNominal
+		}
+		for i := 0; i < plotWidth; i++ {
+			img.Set(i, y(pct/100), c)
+		}
+	}
+
+	for i, p := range points {
+		x1, y1 := x(p.Time), y(p.Speed)
+		if i == 0 || p.Time-points[i-1].Time > args.Interval*1.5 {
+			img.Set(x1, y1, plotLine)
+			continue
+		}
+		prev := points[i-1]
+		drawLine(img, x(prev.Time), y(prev.Speed), x1, y1, plotLine)
+	}
+
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := f.Close(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+	return png.Encode(f, img)
+}
+
+// drawLine draws a straight line between the given points.
+func drawLine(img *image.RGBA, x0, y0, x1, y1 int, c color.Color) {
+	n := abs(x1 - x0)
+	if dy := abs(y1 - y0); dy > n {
+		n = dy
+	}
+	for i := 0; i <= n; i++ {
+		t := 0.0
+		if n > 0 {
+			t = float64(i) / float64(n)
+		}
+		img.Set(
+			x0+int(math.Round(t*float64(x1-x0))),
+			y0+int(math.Round(t*float64(y1-y0))), c,
+		)
+	}
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
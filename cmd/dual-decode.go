@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/edorfaus/sb-mfm-decode/exitcode"
+	"github.com/edorfaus/sb-mfm-decode/log"
+	"github.com/edorfaus/sb-mfm-decode/metrics"
+	"github.com/edorfaus/sb-mfm-decode/mfm"
+	"github.com/edorfaus/sb-mfm-decode/pipeline"
+	"github.com/edorfaus/sb-mfm-decode/sample"
+	"github.com/edorfaus/sb-mfm-decode/wav"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(exitcode.Of(err))
+	}
+}
+
+var args = struct {
+	Input  string `arg:"positional,required" help:"input wav file"`
+	Output string `arg:"positional" help:"output text file [out.txt]"`
+	// TODO: remove default value text from above help text, when go-arg
+	// is updated to a newer version with the fix for auto-printing it.
+
+	LogLevel  int    `help:"set the logging level (verbosity)"`
+	Log       string `help:"per-module log levels, e.g. 2,filter=3,mfm=1"`
+	LogTo     string `help:"log output per level, e.g. *=stderr,1=stdout"`
+	WarnLimit int    `help:"max warnings of each kind to show; 0=no limit"`
+	Metrics   string `help:"write timing metrics as JSON" placeholder:"FILE"`
+	NoClean   bool   `help:"do not clean the input signal first"`
+
+	NoiseFloor sample.Level `help:"noise floor, e.g. 655 or -34dB; -1 means use 2% of max"`
+}{
+	Output:     "out.txt",
+	LogLevel:   log.Level,
+	NoiseFloor: sample.Level{Value: -1},
+	WarnLimit:  log.DefaultWarnLimit,
+}
+
+func run() (retErr error) {
+	defer log.WarnSummary()
+	defer func() {
+		if err := outputMetrics(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+
+	argParser := exitcode.MustParse(&args)
+
+	log.Level = args.LogLevel
+	if err := log.SetLevels(args.Log); err != nil {
+		argParser.Fail(err.Error())
+	}
+	if err := log.SetTargets(args.LogTo); err != nil {
+		argParser.Fail(err.Error())
+	}
+	log.Collected.SetLimit(args.WarnLimit)
+
+	r, err := wav.OpenReader(args.Input)
+	if err != nil {
+		return err
+	}
+	meta, n := r.Meta, r.Frames
+	if err := r.Close(); err != nil {
+		return err
+	}
+	if meta.NumChannels < 2 {
+		return exitcode.New(
+			exitcode.Format, "input has only %v channel", meta.NumChannels,
+		)
+	}
+	rate, bits := meta.SampleRate, meta.BitDepth
+	if err := args.NoiseFloor.Check(bits); err != nil {
+		argParser.Fail(err.Error())
+	}
+
+	type d = time.Duration
+	log.F(
+		1, "Input: %v channels of %v %v-bit samples at %v Hz = %v\n",
+		meta.NumChannels, n, bits, rate, d(n)*time.Second/d(rate),
+	)
+
+	roles := make([]wav.Role, meta.NumChannels)
+	for i := range roles {
+		roles[i] = wav.RoleData
+	}
+	cfg := pipeline.Config{
+		NoiseFloor:   args.NoiseFloor.Value,
+		NoiseFloorDB: args.NoiseFloor.DB,
+		NoClean:      args.NoClean,
+	}
+	blocks, err := decodeChannels(cfg, roles, n)
+	if err != nil {
+		return err
+	}
+
+	var out *bufio.Writer
+	if args.Output == "-" {
+		out = bufio.NewWriter(os.Stdout)
+	} else {
+		f, err := os.Create(args.Output)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := f.Close(); err != nil && retErr == nil {
+				retErr = err
+			}
+		}()
+		out = bufio.NewWriter(f)
+	}
+	defer func() {
+		if err := out.Flush(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+
+	failed := 0
+	for _, b := range blocks {
+		writeBlock(out, b)
+		if b.Err != nil {
+			failed++
+		}
+	}
+	log.F(1, "Decoded %v blocks (%v failed)\n", len(blocks), failed)
+
+	return nil
+}
+
+// decodeChannels decodes each of the channels with the given roles on its
+// own, and merges their blocks into one list (see pipeline.MergeChannels).
+func decodeChannels(
+	cfg pipeline.Config, roles []wav.Role, frames int,
+) ([]*pipeline.Block, error) {
+	defer log.TimeStage(
+		1, "decode", frames*len(roles), "Decoding channels...\n",
+	)("Decoding done in")
+
+	results, err := pipeline.DecodeChannels(
+		context.Background(), args.Input, roles, cfg,
+	)
+	if err != nil && exitcode.Of(err) == exitcode.Internal {
+		// Not an I/O error, so the roles do not fit the input.
+		return nil, exitcode.New(exitcode.Format, "%w", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, res := range results {
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		log.F(
+			1, "Channel %v: decoded %v blocks (%v failed)\n",
+			res.Channel, len(res.Blocks), len(res.BlockErrors()),
+		)
+	}
+
+	return pipeline.MergeChannels(args.Input, roles, results, cfg)
+}
+
+func outputMetrics() error {
+	if err := metrics.Default.Summary(log.Writer(2)); err != nil {
+		return err
+	}
+	if args.Metrics == "" {
+		return nil
+	}
+	return metrics.Default.SaveJSON(args.Metrics)
+}
+
+// writeBlock writes the given block to the output.
+func writeBlock(out *bufio.Writer, b *pipeline.Block) {
+	fmt.Fprintf(
+		out, "block: start %v, end %v, bit width %v, bits %v, id %v",
+		b.Start, b.End, b.BitWidth, b.Bits.Len(), b.ID(),
+	)
+	if b.Err != nil {
+		fmt.Fprintf(out, ", error: %v\n", b.Err)
+		return
+	}
+	if b.Ending == mfm.EndNoise {
+		fmt.Fprint(out, ", ended in noise")
+	}
+	fmt.Fprintf(out, ", bytes %v\n  %x\n", len(b.Data), b.Data)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/edorfaus/sb-mfm-decode/exitcode"
+	"github.com/edorfaus/sb-mfm-decode/log"
+	"github.com/edorfaus/sb-mfm-decode/metrics"
+	"github.com/edorfaus/sb-mfm-decode/mfm"
+	"github.com/edorfaus/sb-mfm-decode/studybox"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(exitcode.Of(err))
+	}
+}
+
+var args = struct {
+	Input  string `arg:"positional,required" help:"input edge log file"`
+	Output string `arg:"positional" help:"output text file [out.txt]"`
+	// TODO: remove default value text from above help text, when go-arg
+	// is updated to a newer version with the fix for auto-printing it.
+
+	LogLevel  int    `help:"set the logging level (verbosity)"`
+	Log       string `help:"per-module log levels, e.g. 2,filter=3,mfm=1"`
+	LogTo     string `help:"log output per level, e.g. *=stderr,1=stdout"`
+	WarnLimit int    `help:"max warnings of each kind to show; 0=no limit"`
+	Metrics   string `help:"write timing metrics as JSON" placeholder:"FILE"`
+
+	BitWidth int `help:"initial bit width; 0=take it from the lead-in"`
+}{
+	Output:    "out.txt",
+	LogLevel:  log.Level,
+	WarnLimit: log.DefaultWarnLimit,
+}
+
+func run() (retErr error) {
+	defer log.WarnSummary()
+	defer func() {
+		if err := outputMetrics(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+
+	argParser := exitcode.MustParse(&args)
+	if args.BitWidth != 0 && args.BitWidth < 2 {
+		argParser.Fail("bit width must be at least 2")
+	}
+
+	log.Level = args.LogLevel
+	if err := log.SetLevels(args.Log); err != nil {
+		argParser.Fail(err.Error())
+	}
+	if err := log.SetTargets(args.LogTo); err != nil {
+		argParser.Fail(err.Error())
+	}
+	log.Collected.SetLimit(args.WarnLimit)
+
+	edges, err := mfm.LoadEdgeLog(args.Input)
+	if err != nil {
+		return err
+	}
+	log.F(
+		1, "Input: %v edges in %v samples\n",
+		len(edges.Edges), edges.Samples,
+	)
+
+	var out *bufio.Writer
+	if args.Output == "-" {
+		out = bufio.NewWriter(os.Stdout)
+	} else {
+		f, err := os.Create(args.Output)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := f.Close(); err != nil && retErr == nil {
+				retErr = err
+			}
+		}()
+		out = bufio.NewWriter(f)
+	}
+	defer func() {
+		if err := out.Flush(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+
+	d := mfm.NewDecoder(edges)
+	if args.BitWidth != 0 {
+		d.SetBitWidth(args.BitWidth)
+	}
+
+	return decode(d, out)
+}
+
+func outputMetrics() error {
+	if err := metrics.Default.Summary(log.Writer(2)); err != nil {
+		return err
+	}
+	if args.Metrics == "" {
+		return nil
+	}
+	return metrics.Default.SaveJSON(args.Metrics)
+}
+
+func decode(d *mfm.Decoder, out *bufio.Writer) error {
+	defer log.TimeStage(
+		1, "decode", d.Edge.Len(), "Decoding edges...\n",
+	)("Decoding done in")
+
+	blocks, failed := 0, 0
+	for {
+		err := d.NextBlock()
+		if errors.Is(err, mfm.EOD) {
+			break
+		}
+		blocks++
+
+		var data []byte
+		if err != nil {
+			// Skip the rest of the failed block, to continue after it.
+			for d.Edge.Cur().Type != mfm.EdgeToNone && d.Edge.Next() {
+			}
+		} else {
+			data, err = studybox.DecodeBlock(d.Bits)
+		}
+		id := studybox.BlockID(d.StartIndex, data)
+		if err != nil {
+			id = studybox.BlockID(d.StartIndex, d.Bits)
+		}
+
+		fmt.Fprintf(
+			out, "block: start %v, end %v, bit width %v, bits %v, id %v",
+			d.StartIndex, d.EndIndex, d.BitWidth, len(d.Bits), id,
+		)
+		if err != nil {
+			failed++
+			fmt.Fprintf(out, ", error: %v\n", err)
+			continue
+		}
+		fmt.Fprintf(out, ", bytes %v\n  %x\n", len(data), data)
+	}
+
+	log.F(1, "Decoded %v blocks (%v failed)\n", blocks, failed)
+
+	return nil
+}
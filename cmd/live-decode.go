@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/edorfaus/sb-mfm-decode/audioin"
+	"github.com/edorfaus/sb-mfm-decode/exitcode"
+	"github.com/edorfaus/sb-mfm-decode/log"
+	"github.com/edorfaus/sb-mfm-decode/metrics"
+	"github.com/edorfaus/sb-mfm-decode/mfm"
+	"github.com/edorfaus/sb-mfm-decode/pipeline"
+	"github.com/edorfaus/sb-mfm-decode/quality"
+	"github.com/edorfaus/sb-mfm-decode/report"
+	"github.com/edorfaus/sb-mfm-decode/sample"
+	"github.com/edorfaus/sb-mfm-decode/studybox"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(exitcode.Of(err))
+	}
+}
+
+var args = struct {
+	Output string `arg:"positional" help:"output text file for the data"`
+
+	LogLevel  int    `help:"set the logging level (verbosity)"`
+	Log       string `help:"per-module log levels, e.g. 2,filter=3,mfm=1"`
+	LogTo     string `help:"log output per level, e.g. *=stderr,1=stdout"`
+	WarnLimit int    `help:"max warnings of each kind to show; 0=no limit"`
+	Metrics   string `help:"write timing metrics as JSON" placeholder:"FILE"`
+	NoClean   bool   `help:"do not clean the input signal first"`
+
+	Device   string  `help:"audio input device; empty=default"`
+	Rate     int     `help:"sample rate to record at"`
+	Channels int     `help:"number of channels to record"`
+	Channel  int     `help:"channel with the data; -1=the usual one"`
+	Seconds  float64 `help:"stop after this many seconds; 0=until ^C"`
+	Meter    float64 `help:"show input meters every this many seconds; 0=off"`
+
+	NoiseFloor sample.Level `help:"noise floor, e.g. 655 or -34dB; -1 means use 2% of max"`
+
+	Retry   bool `help:"retry failed blocks with other settings"`
+	Reverse bool `help:"also decode failed blocks backwards, from the end"`
+
+	MaxGap      float64 `help:"bridge dropouts up to this many bit widths"`
+	NoisePulses int     `help:"trim up to this many noise pulses at block end"`
+	Heal        bool    `help:"merge tiny pulse pairs that make a valid one"`
+	ML          bool    `help:"find the most likely pulse sequence per block"`
+	Interleave  int     `help:"deinterleave bytes with this block depth"`
+	Check       string  `help:"data check: none, xor, sum, parity, crc16"`
+}{
+	LogLevel:   log.Level,
+	NoiseFloor: sample.Level{Value: -1},
+	WarnLimit:  log.DefaultWarnLimit,
+	Rate:       44100,
+	Channels:   2,
+	Channel:    -1,
+	Meter:      1,
+}
+
+func run() (retErr error) {
+	defer log.WarnSummary()
+	defer func() {
+		if err := outputMetrics(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+
+	argParser := exitcode.MustParse(&args)
+	if args.Seconds < 0 || args.Meter < 0 {
+		argParser.Fail("seconds and meter cannot be negative")
+	}
+	check, err := studybox.ParseChecker(args.Check)
+	if err != nil {
+		argParser.Fail(err.Error())
+	}
+
+	log.Level = args.LogLevel
+	if err := log.SetLevels(args.Log); err != nil {
+		argParser.Fail(err.Error())
+	}
+	if err := log.SetTargets(args.LogTo); err != nil {
+		argParser.Fail(err.Error())
+	}
+	log.Collected.SetLimit(args.WarnLimit)
+
+	in, err := audioin.Open(audioin.Config{
+		Device:     args.Device,
+		SampleRate: args.Rate,
+		Channels:   args.Channels,
+		Channel:    args.Channel,
+	})
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	rate, bits := in.Meta.SampleRate, in.Meta.BitDepth
+
+	log.F(
+		1, "Input: %v (%v), channel %v of %v, %v-bit samples at %v Hz\n",
+		deviceName(), audioin.Backend, in.Channel, in.Meta.NumChannels,
+		bits, rate,
+	)
+
+	// Failed blocks are returned as the error, unless writing the output
+	// file fails, which is then returned instead.
+	var failed error
+	var out *bufio.Writer
+	if args.Output != "" {
+		f, err := os.Create(args.Output)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := f.Close(); err != nil && retErr == failed {
+				retErr = err
+			}
+		}()
+		out = bufio.NewWriter(f)
+		defer func() {
+			if err := out.Flush(); err != nil && retErr == failed {
+				retErr = err
+			}
+		}()
+	}
+
+	// The first ^C stops the recording, but still decodes what was read;
+	// after that, it is handled as usual, to allow stopping right away.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	cfg := pipeline.Config{
+		NoiseFloor:   args.NoiseFloor.Value,
+		NoiseFloorDB: args.NoiseFloor.DB,
+		NoClean:      args.NoClean,
+		Live:         true,
+		End:          int(args.Seconds * float64(rate)),
+		Retry:        args.Retry,
+		Reverse:      args.Reverse,
+
+		MaxGap:         args.MaxGap,
+		MaxNoisePulses: args.NoisePulses,
+		HealTiny:       args.Heal,
+		MaxLikelihood:  args.ML,
+		Check:          check,
+	}
+	if args.Interleave > 1 {
+		cfg.Interleaving = studybox.BlockInterleave{Depth: args.Interleave}
+	}
+	src := &stopSource{src: in, ctx: ctx}
+	s := pipeline.NewStream(src, rate, bits, cfg)
+	defer s.Close()
+
+	if args.Meter > 0 {
+		m := &quality.Meter{
+			SampleRate: rate,
+			BitDepth:   bits,
+			NoiseFloor: s.Config().NoiseFloor,
+		}
+		src.meter, src.every = m, int(args.Meter*float64(rate))
+		s.Pulses = m
+	}
+
+	log.Ln(0, "Recording; press ^C to stop.")
+	res, err := decode(s, rate, out)
+	if err != nil {
+		return err
+	}
+	res.Meta, res.Samples = in.Meta, src.read
+	if n := in.Overruns(); n > 0 {
+		log.Warn(fmt.Sprintf("input overruns: %v, some samples were lost", n))
+	}
+
+	if err := report.Summarize(res).WriteText(os.Stdout); err != nil {
+		return err
+	}
+	failed = exitcode.FailedBlocks(res.BlockErrors(), len(res.Blocks))
+	return failed
+}
+
+func outputMetrics() error {
+	if err := metrics.Default.Summary(log.Writer(2)); err != nil {
+		return err
+	}
+	if args.Metrics == "" {
+		return nil
+	}
+	return metrics.Default.SaveJSON(args.Metrics)
+}
+
+func deviceName() string {
+	if args.Device == "" {
+		return "default device"
+	}
+	return args.Device
+}
+
+// stopSource is a source that ends (with io.EOF) when its context is
+// done, so that the stream can decode what it has read before stopping.
+// It also feeds the samples to the meter, if any, and shows its reading
+// every so many samples.
+type stopSource struct {
+	src  pipeline.SampleSource
+	ctx  context.Context
+	read int
+
+	meter *quality.Meter
+	every int
+	next  int
+}
+
+func (s *stopSource) ReadSamples(buf []int) (int, error) {
+	if s.ctx.Err() != nil {
+		return 0, io.EOF
+	}
+	n, err := s.src.ReadSamples(buf)
+	s.read += n
+
+	if s.meter != nil {
+		s.meter.AddSamples(buf[:n])
+		if s.read >= s.next {
+			s.next = s.read + s.every
+			showMeter(s.meter.Reading())
+		}
+	}
+	return n, err
+}
+
+// showMeter shows a meter reading, with hints about what may be wrong.
+func showMeter(r quality.Reading) {
+	msg := fmt.Sprintf(
+		"  level %5.1f dBFS (peak %5.1f), "+
+			"noise %5.1f dBFS (%3.0f%% of floor)",
+		r.RMS, r.Peak, r.Noise, r.NoiseRatio*100,
+	)
+	if r.Pulses > 0 {
+		msg += fmt.Sprintf(
+			", %4.0f bit/s, confidence %3.0f%%, bad pulses %v/%v",
+			r.BitRate, r.Confidence*100, r.BadPulses, r.Pulses,
+		)
+	}
+	if r.Clipped > 0 {
+		msg += fmt.Sprintf(", CLIPPING (%v samples)", r.Clipped)
+	}
+	if r.NoiseRatio > 1.0/3 {
+		msg += ", NOISY"
+	}
+	log.Ln(0, msg)
+}
+
+// decode decodes the blocks of the stream as they are read, showing each
+// of them as it is done, and writing their data to out (if not nil).
+func decode(
+	s *pipeline.Stream, rate int, out *bufio.Writer,
+) (*pipeline.Result, error) {
+	start := time.Now()
+	res := &pipeline.Result{Input: deviceName()}
+	for {
+		b, err := s.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		res.Blocks = append(res.Blocks, b)
+
+		at := float64(b.Start) / float64(rate)
+		if b.Err != nil {
+			fmt.Printf(
+				"%9.3f s: block %v: FAILED: %v\n", at, len(res.Blocks), b.Err,
+			)
+		} else {
+			fmt.Printf(
+				"%9.3f s: block %v: ok, %v bytes\n",
+				at, len(res.Blocks), len(b.Data),
+			)
+		}
+
+		if out == nil {
+			continue
+		}
+		fmt.Fprintf(
+			out, "block: start %v, end %v, bit width %v, bits %v, id %v",
+			b.Start, b.End, b.BitWidth, b.Bits.Len(), b.ID(),
+		)
+		if b.Err != nil {
+			fmt.Fprintf(out, ", error: %v\n", b.Err)
+			continue
+		}
+		if b.Ending == mfm.EndNoise {
+			fmt.Fprint(out, ", ended in noise")
+		}
+		fmt.Fprintf(out, ", bytes %v\n  %x\n", len(b.Data), b.Data)
+	}
+	res.Duration = time.Since(start)
+	res.Quality = s.Quality()
+	return res, nil
+}
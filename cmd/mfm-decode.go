@@ -5,13 +5,15 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/edorfaus/sb-mfm-decode/exitcode"
 	"github.com/edorfaus/sb-mfm-decode/mfm"
+	"github.com/edorfaus/sb-mfm-decode/studybox"
 )
 
 func main() {
 	if err := run(); err != nil {
 		fmt.Fprintln(os.Stderr, "Error:", err)
-		os.Exit(1)
+		os.Exit(exitcode.Of(err))
 	}
 }
 
@@ -35,7 +37,7 @@ func run() error {
 			)
 			continue
 		}
-		bits, liErr := skipLeadIn(d.Bits)
+		bits, liErr := studybox.SkipLeadIn(d.Bits)
 		fmt.Printf(
 			"block: start %v, end %v, bit width %v, lead-in %v: %v\n",
 			d.StartIndex, d.EndIndex, d.BitWidth,
@@ -77,28 +79,3 @@ func buildSamples(halfBits ...int) []int {
 	}
 	return out
 }
-
-// In studybox, after the MFM lead-in (0s then 1), there's a 0-bit
-// before each byte of data. So, more or less, each byte takes 9 bits.
-
-func skipLeadIn(bits []byte) ([]byte, error) {
-	// The lead-in is a data sequence of 0s followed by a single 1.
-	// Adding the clock, each data bit gets expanded into 2 stored bits,
-	// such that the lead-in becomes a sequence of 10 followed by a 01,
-	// like this: 101010...101001.
-
-	i := 0
-	for i+1 < len(bits) && bits[i] == 1 && bits[i+1] == 0 {
-		i += 2
-	}
-
-	if i == 0 {
-		return bits, fmt.Errorf("lead-in: no lead-in found")
-	}
-
-	if i+1 >= len(bits) || bits[i] != 0 || bits[i+1] != 1 {
-		return bits, fmt.Errorf("lead-in: end marker not found")
-	}
-
-	return bits[i+2:], nil
-}
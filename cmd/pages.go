@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/edorfaus/sb-mfm-decode/exitcode"
+	"github.com/edorfaus/sb-mfm-decode/log"
+	"github.com/edorfaus/sb-mfm-decode/metrics"
+	"github.com/edorfaus/sb-mfm-decode/pipeline"
+	"github.com/edorfaus/sb-mfm-decode/sample"
+	"github.com/edorfaus/sb-mfm-decode/studybox"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(exitcode.Of(err))
+	}
+}
+
+var args = struct {
+	Input string `arg:"positional,required" help:"input wav file"`
+
+	Extract int    `help:"extract the data of this page (from 1)"`
+	Output  string `help:"file to extract to [page.bin]; -=stdout"`
+	Force   bool   `help:"extract the page even if it failed to decode"`
+	Diagram string `help:"write a diagram of its bits" placeholder:"FILE"`
+
+	LogLevel  int    `help:"set the logging level (verbosity)"`
+	Log       string `help:"per-module log levels, e.g. 2,filter=3,mfm=1"`
+	LogTo     string `help:"log output per level, e.g. *=stderr,1=stdout"`
+	WarnLimit int    `help:"max warnings of each kind to show; 0=no limit"`
+	Metrics   string `help:"write timing metrics as JSON" placeholder:"FILE"`
+	NoClean   bool   `help:"do not clean the input signal first"`
+
+	NoiseFloor sample.Level `help:"noise floor, e.g. 655 or -34dB; -1 means use 2% of max"`
+
+	Retry   bool `help:"retry failed blocks with other settings"`
+	Reverse bool `help:"also decode failed blocks backwards, from the end"`
+
+	MaxGap      float64 `help:"bridge dropouts up to this many bit widths"`
+	NoisePulses int     `help:"trim up to this many noise pulses at block end"`
+	Heal        bool    `help:"merge tiny pulse pairs that make a valid one"`
+	ML          bool    `help:"find the most likely pulse sequence per block"`
+	Interleave  int     `help:"deinterleave bytes with this block depth"`
+	Check       string  `help:"data check: none, xor, sum, parity, crc16"`
+}{
+	Output:     "page.bin",
+	LogLevel:   log.Level,
+	NoiseFloor: sample.Level{Value: -1},
+	WarnLimit:  log.DefaultWarnLimit,
+}
+
+func run() (retErr error) {
+	defer log.WarnSummary()
+	defer func() {
+		if err := outputMetrics(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+
+	argParser := exitcode.MustParse(&args)
+	if args.Extract < 0 {
+		argParser.Fail("extract cannot be negative")
+	}
+	if args.Diagram != "" && args.Extract == 0 {
+		argParser.Fail("--diagram needs the page to --extract")
+	}
+	check, err := studybox.ParseChecker(args.Check)
+	if err != nil {
+		argParser.Fail(err.Error())
+	}
+
+	log.Level = args.LogLevel
+	if err := log.SetLevels(args.Log); err != nil {
+		argParser.Fail(err.Error())
+	}
+	if err := log.SetTargets(args.LogTo); err != nil {
+		argParser.Fail(err.Error())
+	}
+	log.Collected.SetLimit(args.WarnLimit)
+
+	cfg := pipeline.Config{
+		NoiseFloor:   args.NoiseFloor.Value,
+		NoiseFloorDB: args.NoiseFloor.DB,
+		NoClean:      args.NoClean,
+		Retry:        args.Retry,
+		Reverse:      args.Reverse,
+
+		MaxGap:         args.MaxGap,
+		MaxNoisePulses: args.NoisePulses,
+		HealTiny:       args.Heal,
+		MaxLikelihood:  args.ML,
+		Check:          check,
+	}
+	if args.Interleave > 1 {
+		cfg.Interleaving = studybox.BlockInterleave{Depth: args.Interleave}
+	}
+
+	res := pipeline.DecodeFile(context.Background(), args.Input, cfg)
+	if res.Err != nil && len(res.Blocks) == 0 {
+		return res.Err
+	}
+	if res.Err != nil {
+		log.Warn("decode stopped early:", res.Err)
+	}
+
+	// The list goes to stderr if the page is extracted to stdout, so that
+	// it does not get mixed into the page data.
+	list := io.Writer(os.Stdout)
+	if args.Extract > 0 && args.Output == "-" {
+		list = os.Stderr
+	}
+	if err := listPages(list, res.Blocks, check != nil); err != nil {
+		return err
+	}
+
+	if args.Extract == 0 {
+		return exitcode.FailedBlocks(res.BlockErrors(), len(res.Blocks))
+	}
+	if args.Extract > len(res.Blocks) {
+		return exitcode.New(
+			exitcode.Decode, "page %v not found; there are only %v pages",
+			args.Extract, len(res.Blocks),
+		)
+	}
+	b := res.Blocks[args.Extract-1]
+	if args.Diagram != "" {
+		if err := writeDiagram(args.Diagram, b); err != nil {
+			return err
+		}
+	}
+	return extract(args.Extract, b)
+}
+
+func outputMetrics() error {
+	if err := metrics.Default.Summary(log.Writer(2)); err != nil {
+		return err
+	}
+	if args.Metrics == "" {
+		return nil
+	}
+	return metrics.Default.SaveJSON(args.Metrics)
+}
+
+// listPages writes a table of the given blocks, as the pages of the tape.
+func listPages(w io.Writer, blocks []*pipeline.Block, checked bool) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "page\tbytes\tcheck\tstart s\tend s\tid\t")
+	for i, b := range blocks {
+		fmt.Fprintf(
+			tw, "%v\t%v\t%v\t%.3f\t%.3f\t%v\t",
+			i+1, len(b.Data),
+			checkStatus(b.Err, checked), b.Info.StartTime, b.Info.EndTime,
+			b.ID(),
+		)
+		if b.Err != nil {
+			fmt.Fprintf(tw, "  %v", b.Err)
+		}
+		fmt.Fprintln(tw)
+	}
+	return tw.Flush()
+}
+
+// checkStatus returns how the data of a page fared, for the list.
+func checkStatus(err error, checked bool) string {
+	var ce *studybox.CheckError
+	switch {
+	case errors.As(err, &ce):
+		return "BAD"
+	case err != nil:
+		return "FAILED"
+	case !checked:
+		return "none"
+	}
+	return "ok"
+}
+
+// writeDiagram writes a timing diagram of the bits of the given page to
+// the given file. This is done even if the page failed to decode, as that
+// is when the diagram is most useful.
+func writeDiagram(file string, b *pipeline.Block) (retErr error) {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := f.Close(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+	d := studybox.Diagram{}
+	return d.Write(f, b.Bits.Unpack(nil))
+}
+
+// extract writes the data of the given page to the output file.
+func extract(page int, b *pipeline.Block) (retErr error) {
+	if b.Err != nil && !args.Force {
+		code := exitcode.Decode
+		var ce *studybox.CheckError
+		if errors.As(b.Err, &ce) {
+			code = exitcode.Checksum
+		}
+		return exitcode.New(
+			code, "page %v failed to decode: %v (use --force to extract it)",
+			page, b.Err,
+		)
+	}
+	if b.Err != nil {
+		log.Warn(fmt.Sprintf("page %v failed to decode: %v", page, b.Err))
+	}
+
+	var out *bufio.Writer
+	if args.Output == "-" {
+		out = bufio.NewWriter(os.Stdout)
+	} else {
+		f, err := os.Create(args.Output)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := f.Close(); err != nil && retErr == nil {
+				retErr = err
+			}
+		}()
+		out = bufio.NewWriter(f)
+	}
+
+	if _, err := out.Write(b.Data); err != nil {
+		return err
+	}
+	if err := out.Flush(); err != nil {
+		return err
+	}
+	log.F(1, "Extracted page %v: %v bytes\n", page, len(b.Data))
+	return nil
+}
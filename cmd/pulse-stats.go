@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"os"
 	"regexp"
@@ -9,18 +10,20 @@ import (
 	"strings"
 	"time"
 
-	"github.com/alexflint/go-arg"
-
+	"github.com/edorfaus/sb-mfm-decode/exitcode"
 	"github.com/edorfaus/sb-mfm-decode/filter"
 	"github.com/edorfaus/sb-mfm-decode/log"
+	"github.com/edorfaus/sb-mfm-decode/metrics"
 	"github.com/edorfaus/sb-mfm-decode/mfm"
+	"github.com/edorfaus/sb-mfm-decode/sample"
+	"github.com/edorfaus/sb-mfm-decode/schema"
 	"github.com/edorfaus/sb-mfm-decode/wav"
 )
 
 func main() {
 	if err := run(); err != nil {
 		fmt.Fprintln(os.Stderr, "Error:", err)
-		os.Exit(1)
+		os.Exit(exitcode.Of(err))
 	}
 }
 
@@ -28,30 +31,70 @@ var args = struct {
 	Input  string `arg:"positional,required" help:"input wav file"`
 	Output string `arg:"positional" help:"output text file"`
 
-	LogLevel int  `help:"set the logging level (verbosity)"`
-	NoClean  bool `help:"do not clean the input signal first"`
+	LogLevel  int    `help:"set the logging level (verbosity)"`
+	Log       string `help:"per-module log levels, e.g. 2,filter=3,mfm=1"`
+	LogTo     string `help:"log output per level, e.g. *=stderr,1=stdout"`
+	WarnLimit int    `help:"max warnings of each kind to show; 0=no limit"`
+	Metrics   string `help:"write timing metrics as JSON" placeholder:"FILE"`
+	NoClean   bool   `help:"do not clean the input signal first"`
+
+	NoiseFloor sample.Level `help:"noise floor, e.g. 655 or -34dB; -1 means use 2% of max"`
 
-	NoiseFloor int `help:"noise floor; -1 means use 2% of max"`
+	Normalize string  `help:"normalize the input first: peak or rms"`
+	Level     float64 `help:"level to normalize to; 0=default for the kind"`
 
 	BitWidth float64 `help:"base bit width; 0=by sample rate, -1=none"`
+
+	Jitter       string `help:"write jitter over time" placeholder:"FILE"`
+	JitterWindow int    `help:"jitter window in samples; 0=1 second"`
+
+	Cluster bool `help:"classify by clustering the pulse widths"`
+	JSON    bool `help:"output the statistics as JSON"`
 }{
 	LogLevel:   log.Level,
-	NoiseFloor: -1,
+	NoiseFloor: sample.Level{Value: -1},
+	WarnLimit:  log.DefaultWarnLimit,
 }
 
 func run() (retErr error) {
-	argParser := arg.MustParse(&args)
+	defer log.WarnSummary()
+	defer func() {
+		if err := outputMetrics(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+
+	argParser := exitcode.MustParse(&args)
 	if args.BitWidth < 2 && args.BitWidth != 0 && args.BitWidth != -1 {
 		argParser.Fail("bit width must be 0, -1, or at least 2")
 	}
 
 	log.Level = args.LogLevel
+	if err := log.SetLevels(args.Log); err != nil {
+		argParser.Fail(err.Error())
+	}
+	if err := log.SetTargets(args.LogTo); err != nil {
+		argParser.Fail(err.Error())
+	}
+	log.Collected.SetLimit(args.WarnLimit)
+
+	norm, err := wav.ParseNormalizer(args.Normalize, args.Level)
+	if err != nil {
+		argParser.Fail(err.Error())
+	}
 
 	samples, meta, err := wav.LoadDataChannel(args.Input)
 	if err != nil {
 		return err
 	}
 	rate, bits := meta.SampleRate, meta.BitDepth
+	if err := args.NoiseFloor.Check(bits); err != nil {
+		argParser.Fail(err.Error())
+	}
+	if norm != nil {
+		gain := norm.Normalize(samples, bits)
+		log.F(1, "Normalized to %v, gain %.3f\n", norm, gain)
+	}
 
 	type d = time.Duration
 	log.F(
@@ -93,15 +136,27 @@ func run() (retErr error) {
 	return nil
 }
 
+func outputMetrics() error {
+	if err := metrics.Default.Summary(log.Writer(2)); err != nil {
+		return err
+	}
+	if args.Metrics == "" {
+		return nil
+	}
+	return metrics.Default.SaveJSON(args.Metrics)
+}
+
 func getNoiseFloor(bits int) int {
-	if args.NoiseFloor >= 0 {
-		return args.NoiseFloor
+	if !args.NoiseFloor.Unset() {
+		return args.NoiseFloor.Samples(bits)
 	}
 	return filter.DefaultNoiseFloor(bits)
 }
 
 func cleanSamples(samples []int, rate, bits int) error {
-	defer log.Time(1, "Cleaning waveform...\n")("Cleaning done in")
+	defer log.TimeStage(
+		1, "clean", len(samples), "Cleaning waveform...\n",
+	)("Cleaning done in")
 
 	noiseFloor := getNoiseFloor(bits)
 	var peakWidth int
@@ -118,7 +173,9 @@ func cleanSamples(samples []int, rate, bits int) error {
 }
 
 func runStats(samples []int, rate, bits int, out *bufio.Writer) error {
-	defer log.Time(1, "Processing pulses...\n")("Processing done in")
+	defer log.TimeStage(
+		1, "classify", len(samples), "Processing pulses...\n",
+	)("Processing done in")
 
 	noiseFloor := getNoiseFloor(bits)
 	pc := mfm.NewPulseClassifier(mfm.NewEdgeDetect(samples, noiseFloor))
@@ -142,32 +199,56 @@ func runStats(samples []int, rate, bits int, out *bufio.Writer) error {
 		bwStats.Add(pc.BitWidth)
 	}
 
+	var src mfm.PulseSource = pc
+	if args.Cluster {
+		if pc.BitWidth == 0 {
+			return fmt.Errorf("clustering needs a starting bit width")
+		}
+		src = mfm.NewClusterClassifier(pc.Edges, pc.BitWidth)
+	}
+
 	// 0:first pulse, 1:second pulse, 2:difference (1-0)
 	pulseStats := map[[2]mfm.PulseClass][3]Stats{}
 
 	var overall Stats
 
-	if !pc.Next() {
+	window := args.JitterWindow
+	if window <= 0 {
+		window = rate
+	}
+	jitter := mfm.NewJitterAnalyzer(window)
+
+	if !src.Next() {
 		return fmt.Errorf("no pulses were found")
 	}
-	bwStats.Add(pc.BitWidth)
-	overall.Add(pc.Width)
+	p := src.Pulse()
+	bwStats.Add(p.BitWidth)
+	overall.Add(p.Width())
+	jitter.Pulse(p)
 
-	prevClass, prevWidth := pc.Class, pc.Width
+	prev := p
 
-	for pc.Next() {
-		bwStats.Add(pc.BitWidth)
+	for src.Next() {
+		p = src.Pulse()
+		bwStats.Add(p.BitWidth)
 
-		key := [2]mfm.PulseClass{prevClass, pc.Class}
+		key := [2]mfm.PulseClass{prev.Class, p.Class}
 		s := pulseStats[key]
-		s[0].Add(prevWidth)
-		s[1].Add(pc.Width)
-		s[2].Add(pc.Width - prevWidth)
+		s[0].Add(prev.Width())
+		s[1].Add(p.Width())
+		s[2].Add(p.Width() - prev.Width())
 		pulseStats[key] = s
 
-		overall.Add(pc.Width)
+		overall.Add(p.Width())
+		jitter.Pulse(p)
 
-		prevClass, prevWidth = pc.Class, pc.Width
+		prev = p
+	}
+
+	if args.Jitter != "" {
+		if err := writeJitter(args.Jitter, jitter.Series()); err != nil {
+			return err
+		}
 	}
 
 	// Stats generated, now format and output them.
@@ -201,6 +282,10 @@ func runStats(samples []int, rate, bits int, out *bufio.Writer) error {
 		return a[second] < b[second]
 	})
 
+	if args.JSON {
+		return writeStatsJSON(out, keys, pulseStats, overall, bwStats)
+	}
+
 	c.Headers(
 		"a", "b", "count",
 		"A: min", "max", "avg",
@@ -238,6 +323,71 @@ func runStats(samples []int, rate, bits int, out *bufio.Writer) error {
 	return nil
 }
 
+// writeStatsJSON writes the statistics in their machine-readable form,
+// with the pairs of pulse classes in the given order.
+func writeStatsJSON(
+	out *bufio.Writer, keys [][2]mfm.PulseClass,
+	pulseStats map[[2]mfm.PulseClass][3]Stats, overall, bwStats Stats,
+) error {
+	res := schema.NewPulseStats()
+	res.Pairs = make([]schema.PulsePair, 0, len(keys))
+	for _, k := range keys {
+		v := pulseStats[k]
+		res.Pairs = append(res.Pairs, schema.PulsePair{
+			First:       k[0].String(),
+			Second:      k[1].String(),
+			Count:       v[0].Count,
+			FirstWidth:  v[0].Summary(),
+			SecondWidth: v[1].Summary(),
+			Difference:  v[2].Summary(),
+		})
+	}
+	res.Pulses = overall.Summary()
+	res.BitWidths = bwStats.Summary()
+
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(res); err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+// writeJitter writes the given jitter series to the given file, as one
+// line per class and window, with space-separated columns for plotting.
+func writeJitter(filename string, series mfm.JitterSeries) (retErr error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := f.Close(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+	out := bufio.NewWriter(f)
+
+	fmt.Fprintln(out, "# class start end count mean stddev")
+	classes := []struct {
+		class  mfm.PulseClass
+		points []mfm.JitterPoint
+	}{
+		{mfm.PulseShort, series.Short},
+		{mfm.PulseMedium, series.Medium},
+		{mfm.PulseLong, series.Long},
+	}
+	for _, c := range classes {
+		for _, p := range c.points {
+			fmt.Fprintf(
+				out, "%v %.0f %.0f %v %.4f %.4f\n",
+				c.class, p.Start, p.End, p.Count, p.Mean, p.StdDev,
+			)
+		}
+	}
+
+	return out.Flush()
+}
+
 type Stats struct {
 	Min, Max, Tot float64
 
@@ -263,6 +413,16 @@ func (s *Stats) Avg() float64 {
 	return s.Tot / float64(s.Count)
 }
 
+// Summary returns the statistics in their machine-readable form.
+func (s *Stats) Summary() schema.Summary {
+	if s.Count == 0 {
+		return schema.Summary{}
+	}
+	return schema.Summary{
+		Count: s.Count, Min: s.Min, Max: s.Max, Mean: s.Avg(),
+	}
+}
+
 type Columnar struct {
 	Output *bufio.Writer
 	Format []string
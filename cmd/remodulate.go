@@ -0,0 +1,404 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/edorfaus/sb-mfm-decode/events"
+	"github.com/edorfaus/sb-mfm-decode/exitcode"
+	"github.com/edorfaus/sb-mfm-decode/log"
+	"github.com/edorfaus/sb-mfm-decode/metrics"
+	"github.com/edorfaus/sb-mfm-decode/mfm"
+	"github.com/edorfaus/sb-mfm-decode/pipeline"
+	"github.com/edorfaus/sb-mfm-decode/sample"
+	"github.com/edorfaus/sb-mfm-decode/studybox"
+	"github.com/edorfaus/sb-mfm-decode/synth"
+	"github.com/edorfaus/sb-mfm-decode/wav"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(exitcode.Of(err))
+	}
+}
+
+var args = struct {
+	Input  string `arg:"positional,required" help:"input wav file"`
+	Output string `arg:"positional" help:"output wav file [out.wav]"`
+	// TODO: remove default value text from above help text, when go-arg
+	// is updated to a newer version with the fix for auto-printing it.
+
+	LogLevel  int    `help:"set the logging level (verbosity)"`
+	Log       string `help:"per-module log levels, e.g. 2,filter=3,mfm=1"`
+	LogTo     string `help:"log output per level, e.g. *=stderr,1=stdout"`
+	WarnLimit int    `help:"max warnings of each kind to show; 0=no limit"`
+	Metrics   string `help:"write timing metrics as JSON" placeholder:"FILE"`
+	NoClean   bool   `help:"do not clean the input signal first"`
+
+	NoiseFloor sample.Level `help:"noise floor, e.g. 655 or -34dB; -1 means use 2% of max"`
+
+	Retry      bool   `help:"retry failed blocks with other settings"`
+	Heal       bool   `help:"merge tiny pulse pairs that make a valid one"`
+	ML         bool   `help:"find the most likely pulse sequence per block"`
+	Interleave int    `help:"deinterleave bytes with this block depth"`
+	Check      string `help:"data check: none, xor, sum, parity, crc16"`
+	Cells      bool   `help:"add a channel with the decoder's bit cells"`
+	Markers    string `help:"mark decode errors with: cue, tone or both"`
+}{
+	Output:     "out.wav",
+	LogLevel:   log.Level,
+	NoiseFloor: sample.Level{Value: -1},
+	WarnLimit:  log.DefaultWarnLimit,
+}
+
+func run() (retErr error) {
+	defer log.WarnSummary()
+	defer func() {
+		if err := outputMetrics(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+
+	argParser := exitcode.MustParse(&args)
+	check, err := studybox.ParseChecker(args.Check)
+	if err != nil {
+		argParser.Fail(err.Error())
+	}
+	switch args.Markers {
+	case "", "cue", "tone", "both":
+	default:
+		argParser.Fail("unknown --markers: " + args.Markers)
+	}
+
+	log.Level = args.LogLevel
+	if err := log.SetLevels(args.Log); err != nil {
+		argParser.Fail(err.Error())
+	}
+	if err := log.SetTargets(args.LogTo); err != nil {
+		argParser.Fail(err.Error())
+	}
+	log.Collected.SetLimit(args.WarnLimit)
+
+	samples, meta, err := wav.LoadDataChannel(args.Input)
+	if err != nil {
+		return err
+	}
+	rate, bits := meta.SampleRate, meta.BitDepth
+
+	type d = time.Duration
+	log.F(
+		1, "Input: %v %v-bit samples at %v Hz = %v\n",
+		len(samples), bits, rate, d(len(samples))*time.Second/d(rate),
+	)
+
+	cfg := pipeline.Config{
+		NoiseFloor:   args.NoiseFloor.Value,
+		NoiseFloorDB: args.NoiseFloor.DB,
+		NoClean:      args.NoClean,
+		Retry:        args.Retry,
+
+		HealTiny:      args.Heal,
+		MaxLikelihood: args.ML,
+		Check:         check,
+	}
+	if args.Interleave > 1 {
+		cfg.Interleaving = studybox.BlockInterleave{Depth: args.Interleave}
+	}
+	s := pipeline.NewStream(pipeline.NewSliceSource(samples), rate, bits, cfg)
+	defer s.Close()
+
+	var cells *cellTrack
+	if args.Cells {
+		cells = newCellTrack(s, len(samples), bits)
+	}
+
+	var markers []wav.Marker
+	if args.Markers != "" {
+		s.Events = events.Func(func(ev events.Event) {
+			if m, ok := errorMarker(ev); ok {
+				markers = append(markers, m)
+			}
+		})
+	}
+
+	remod, err := remodulate(s, samples, rate, bits, cfg.Interleaving, cells)
+	if err != nil {
+		return err
+	}
+
+	if len(markers) > 0 {
+		log.F(1, "  marked %v decode errors\n", len(markers))
+	}
+	if args.Markers == "tone" || args.Markers == "both" {
+		// The tones go in the re-encoded signal, which is silent where
+		// the blocks failed, so that they do not hide the input.
+		wav.AddMarkerTones(remod, rate, bits, markers)
+	}
+	if args.Markers == "tone" {
+		markers = nil
+	}
+
+	out := [][]int{samples, remod}
+	if cells != nil {
+		out = append(out, cells.output)
+	}
+	return wav.SaveMarked(args.Output, rate, bits, markers, out...)
+}
+
+// errorMarker returns the marker of the given event, if it is of a decode
+// error: a block that failed, a bridged dropout, or a failed check.
+func errorMarker(ev events.Event) (wav.Marker, bool) {
+	label := ""
+	switch ev.Type {
+	case events.BlockError:
+		label = "block error"
+	case events.Dropout:
+		label = "dropout"
+	case events.ChecksumFailure:
+		label = "check failed"
+	default:
+		return wav.Marker{}, false
+	}
+	if ev.Detail != "" {
+		label += ": " + ev.Detail
+	}
+	return wav.Marker{Frame: int(ev.Pos), Label: label}, true
+}
+
+func outputMetrics() error {
+	if err := metrics.Default.Summary(log.Writer(2)); err != nil {
+		return err
+	}
+	if args.Metrics == "" {
+		return nil
+	}
+	return metrics.Default.SaveJSON(args.Metrics)
+}
+
+// remodulate decodes the blocks of the stream, and returns an ideal MFM
+// signal of the same length as the samples, with each block that had its
+// data decoded encoded again in the same place as it was found.
+func remodulate(
+	s *pipeline.Stream, samples []int, rate, bits int,
+	il studybox.Interleaving, cells *cellTrack,
+) ([]int, error) {
+	defer log.TimeStage(
+		1, "remodulate", len(samples), "Decoding and re-encoding...\n",
+	)("Re-encoding done in")
+
+	sig := synth.New(synth.Signal{SampleRate: rate, BitDepth: bits})
+
+	// The pulses of the blocks, to line the new ones up with; a block has
+	// all of its pulses by the time it is returned.
+	var pulses []mfm.Pulse
+	s.Pulses = mfm.PulseFunc(func(p mfm.Pulse) {
+		pulses = append(pulses, p)
+	})
+
+	blocks, encoded := 0, 0
+	for {
+		b, err := s.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		blocks++
+		cells.block(b)
+
+		// Keep the pulses after the block, in case they were found before
+		// the block was returned.
+		var edges []float64
+		rest := pulses[:0]
+		for _, p := range pulses {
+			switch {
+			case p.Start >= float64(b.End):
+				rest = append(rest, p)
+			case p.Start >= float64(b.Start) && p.End <= float64(b.End):
+				if len(edges) == 0 {
+					edges = append(edges, p.Start)
+				}
+				edges = append(edges, p.End)
+			}
+		}
+		pulses = rest
+		// The decoder takes the first pulse of the lead-in as the bit width
+		// without sending it, so the first 1-bit is at the start of the
+		// block rather than at the first pulse that was sent.
+		if len(edges) > 0 && edges[0] > float64(b.Start) {
+			edges = append([]float64{float64(b.Start)}, edges...)
+		}
+
+		if b.Data == nil {
+			log.F(2, "  block at %v: not decoded: %v\n", b.Start, b.Err)
+			continue
+		}
+		data := b.Data
+		if il != nil {
+			if data, err = studybox.Interleave(il, nil, data); err != nil {
+				return nil, err
+			}
+		}
+
+		// Use the same length of lead-in as the block had, so that the
+		// data starts in the same place.
+		bits := b.Bits.Unpack(nil)
+		leadIn := 0
+		if rest, err := studybox.SkipLeadIn(bits); err == nil {
+			leadIn = (len(bits)-len(rest))/2 - 1
+		}
+
+		bitWidth := b.Info.BitWidth
+		if bitWidth <= 0 {
+			bitWidth = float64(b.BitWidth)
+		}
+
+		sig.StartLow = startsLow(samples, b.Start, b.End, bitWidth)
+		sig.MFMAt(
+			studybox.EncodeBlock(data, leadIn),
+			newTimeline(bits, edges, float64(b.Start), bitWidth).at,
+		)
+		encoded++
+	}
+	if n := len(samples) - sig.Len(); n > 0 {
+		sig.Silence(n)
+	}
+
+	log.F(1, "  blocks: %v, re-encoded: %v\n", blocks, encoded)
+
+	out := sig.Render()
+	return out[:len(samples)], nil
+}
+
+// cellTrack draws the half-bit cells that the decoder laid over the
+// signal, as a track to view along with it: a tick at the start of each
+// cell, which goes up for a 1-bit and down for a 0-bit, and is twice as
+// tall for a data bit as for a clock bit.
+type cellTrack struct {
+	output []int
+	high   int
+
+	// The cells that have not been drawn yet, as their block has not been
+	// returned, and so their bits are not known.
+	cells []mfm.Cell
+}
+
+// newCellTrack returns a cellTrack of the given length, with the cells of
+// the given stream, for samples of the given bit depth.
+func newCellTrack(s *pipeline.Stream, length, bits int) *cellTrack {
+	t := &cellTrack{
+		output: make([]int, length),
+		high:   1 << (bits - 2),
+	}
+	s.Cells = mfm.CellFunc(func(c mfm.Cell) {
+		t.cells = append(t.cells, c)
+	})
+	return t
+}
+
+// block draws the cells of the given block, which was just returned.
+func (t *cellTrack) block(b *pipeline.Block) {
+	if t == nil {
+		return
+	}
+	// The cells of a retried or reversed block are from its first decode,
+	// and so do not match its bits.
+	redone := b.Retry != nil || b.Reversed
+	rest := t.cells[:0]
+	for _, c := range t.cells {
+		if c.Pos >= float64(b.End) {
+			rest = append(rest, c)
+			continue
+		}
+		i := int(c.Pos + 0.5)
+		if redone || c.Pos < float64(b.Start) || i >= len(t.output) {
+			continue
+		}
+		if c.Bit < 0 || c.Bit >= b.Bits.Len() {
+			continue
+		}
+		v := t.high / 2
+		if c.Bit%2 == 1 {
+			v = t.high
+		}
+		if b.Bits.Bit(c.Bit) == 0 {
+			v = -v
+		}
+		t.output[i] = v
+	}
+	t.cells = rest
+}
+
+// timeline gives the time of each half-bit of a block, by interpolating
+// between the known times of some of them.
+type timeline struct {
+	// The indexes of the half-bits whose times are known, in order, and
+	// their times.
+	index []int
+	time  []float64
+}
+
+// newTimeline returns the timeline of a block with the given bits, whose
+// 1-bits were at the given edges; each 1-bit is an edge, in order.
+//
+// If there are not enough edges, it uses the given start and bit width.
+func newTimeline(
+	bits []byte, edges []float64, start, bitWidth float64,
+) *timeline {
+	t := &timeline{}
+	for i, bit := range bits {
+		if bit == 1 && len(t.index) < len(edges) {
+			t.index = append(t.index, i)
+			t.time = append(t.time, edges[len(t.index)-1])
+		}
+	}
+	if len(t.index) < 2 {
+		t.index = []int{0, 2}
+		t.time = []float64{start, start + bitWidth}
+	}
+	return t
+}
+
+// at returns the time of the half-bit with the given index, which is
+// extrapolated at the mean rate of the block if it is outside of the
+// known ones.
+func (t *timeline) at(i int) float64 {
+	last := len(t.index) - 1
+	k := sort.SearchInts(t.index, i)
+	if k == 0 || k > last {
+		if k > last {
+			k = last
+		}
+		rate := (t.time[last] - t.time[0]) /
+			float64(t.index[last]-t.index[0])
+		return t.time[k] + float64(i-t.index[k])*rate
+	}
+	frac := float64(i-t.index[k-1]) / float64(t.index[k]-t.index[k-1])
+	return t.time[k-1] + frac*(t.time[k]-t.time[k-1])
+}
+
+// startsLow returns true if the block that starts and ends at the given
+// sample indexes starts by going low, judging by the first half-bit of it
+// compared to the mean of the whole block.
+func startsLow(samples []int, start, end int, bitWidth float64) bool {
+	end = min(end, len(samples))
+	if start >= end {
+		return false
+	}
+	mean := 0.0
+	for _, v := range samples[start:end] {
+		mean += float64(v)
+	}
+	mean /= float64(end - start)
+
+	first := 0.0
+	for _, v := range samples[start:min(start+int(bitWidth/2)+1, end)] {
+		first += float64(v) - mean
+	}
+	return first < 0
+}
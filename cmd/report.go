@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/edorfaus/sb-mfm-decode/exitcode"
+	"github.com/edorfaus/sb-mfm-decode/log"
+	"github.com/edorfaus/sb-mfm-decode/metrics"
+	"github.com/edorfaus/sb-mfm-decode/pipeline"
+	"github.com/edorfaus/sb-mfm-decode/report"
+	"github.com/edorfaus/sb-mfm-decode/sample"
+	"github.com/edorfaus/sb-mfm-decode/studybox"
+	"github.com/edorfaus/sb-mfm-decode/wav"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(exitcode.Of(err))
+	}
+}
+
+var args = struct {
+	Inputs  []string `arg:"positional,required" help:"input wav files"`
+	Output  string   `help:"output html file [report.html]" placeholder:"FILE"`
+	Summary string   `help:"write the tape summary as JSON" placeholder:"FILE"`
+
+	LogLevel  int    `help:"set the logging level (verbosity)"`
+	Log       string `help:"per-module log levels, e.g. 2,filter=3,mfm=1"`
+	LogTo     string `help:"log output per level, e.g. *=stderr,1=stdout"`
+	WarnLimit int    `help:"max warnings of each kind to show; 0=no limit"`
+	Metrics   string `help:"write timing metrics as JSON" placeholder:"FILE"`
+	NoClean   bool   `help:"do not clean the input signal first"`
+	NoWave    bool   `help:"do not show the waveform around each error"`
+
+	NoiseFloor sample.Level `help:"noise floor, e.g. 655 or -34dB; -1 means use 2% of max"`
+
+	Retry   bool `help:"retry failed blocks with other settings"`
+	Reverse bool `help:"also decode failed blocks backwards, from the end"`
+
+	MaxGap      float64 `help:"bridge dropouts up to this many bit widths"`
+	NoisePulses int     `help:"trim up to this many noise pulses at block end"`
+	Heal        bool    `help:"merge tiny pulse pairs that make a valid one"`
+	ML          bool    `help:"find the most likely pulse sequence per block"`
+	Interleave  int     `help:"deinterleave bytes with this block depth"`
+	Check       string  `help:"data check: none, xor, sum, parity, crc16"`
+}{
+	Output:     "report.html",
+	LogLevel:   log.Level,
+	NoiseFloor: sample.Level{Value: -1},
+	WarnLimit:  log.DefaultWarnLimit,
+}
+
+func run() (retErr error) {
+	defer log.WarnSummary()
+	defer func() {
+		if err := outputMetrics(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+
+	argParser := exitcode.MustParse(&args)
+	check, err := studybox.ParseChecker(args.Check)
+	if err != nil {
+		argParser.Fail(err.Error())
+	}
+
+	log.Level = args.LogLevel
+	if err := log.SetLevels(args.Log); err != nil {
+		argParser.Fail(err.Error())
+	}
+	if err := log.SetTargets(args.LogTo); err != nil {
+		argParser.Fail(err.Error())
+	}
+	log.Collected.SetLimit(args.WarnLimit)
+
+	cfg := pipeline.Config{
+		NoiseFloor:   args.NoiseFloor.Value,
+		NoiseFloorDB: args.NoiseFloor.DB,
+		NoClean:      args.NoClean,
+		Retry:        args.Retry,
+		Reverse:      args.Reverse,
+
+		MaxGap:         args.MaxGap,
+		MaxNoisePulses: args.NoisePulses,
+		HealTiny:       args.Heal,
+		MaxLikelihood:  args.ML,
+		Check:          check,
+	}
+	if args.Interleave > 1 {
+		cfg.Interleaving = studybox.BlockInterleave{Depth: args.Interleave}
+	}
+
+	var captures []*report.Capture
+	for _, input := range args.Inputs {
+		c, err := decode(input, cfg)
+		if err != nil {
+			return err
+		}
+		captures = append(captures, c)
+	}
+
+	results := make([]*pipeline.Result, len(captures))
+	for i, c := range captures {
+		results[i] = c.Result
+	}
+	sum := report.Summarize(results...)
+	if err := sum.WriteText(log.Writer(1)); err != nil {
+		return err
+	}
+	if args.Summary != "" {
+		if err := writeSummary(args.Summary, sum); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.Create(args.Output)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := f.Close(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+	out := bufio.NewWriter(f)
+
+	if err := report.WriteHTML(out, captures...); err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+// decode decodes the given input file, and returns it for the report.
+func decode(input string, cfg pipeline.Config) (*report.Capture, error) {
+	res := pipeline.DecodeFile(context.Background(), input, cfg)
+	if res.Err != nil && len(res.Blocks) == 0 {
+		return nil, res.Err
+	}
+	if res.Err != nil {
+		log.Warn(input+": decode stopped early:", res.Err)
+	}
+	log.F(
+		1, "%v: decoded %v blocks (%v failed) in %v\n",
+		input, len(res.Blocks), res.FailedBlocks(), res.Duration,
+	)
+
+	c := &report.Capture{Result: res, Params: params()}
+	if !args.NoWave {
+		// The waveforms are shown as they were captured, before cleaning.
+		samples, _, err := wav.LoadDataChannel(input)
+		if err != nil {
+			return nil, err
+		}
+		c.Samples = samples
+	}
+	return c, nil
+}
+
+func writeSummary(fn string, sum *report.Summary) (retErr error) {
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := f.Close(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+	return sum.WriteJSON(f)
+}
+
+func outputMetrics() error {
+	if err := metrics.Default.Summary(log.Writer(2)); err != nil {
+		return err
+	}
+	if args.Metrics == "" {
+		return nil
+	}
+	return metrics.Default.SaveJSON(args.Metrics)
+}
+
+// params returns the decode settings that were given, for the report.
+func params() []report.Param {
+	check := args.Check
+	if check == "" {
+		check = "none"
+	}
+	noiseFloor := fmt.Sprint(args.NoiseFloor)
+	if args.NoiseFloor.Unset() {
+		noiseFloor = "2% of max"
+	}
+	return []report.Param{
+		{Name: "Noise floor", Value: noiseFloor},
+		{Name: "Clean input", Value: fmt.Sprint(!args.NoClean)},
+		{Name: "Retry", Value: fmt.Sprint(args.Retry)},
+		{Name: "Reverse", Value: fmt.Sprint(args.Reverse)},
+		{Name: "Max gap", Value: fmt.Sprint(args.MaxGap)},
+		{Name: "Noise pulses", Value: fmt.Sprint(args.NoisePulses)},
+		{Name: "Heal tiny pulses", Value: fmt.Sprint(args.Heal)},
+		{Name: "Max likelihood", Value: fmt.Sprint(args.ML)},
+		{Name: "Interleave depth", Value: fmt.Sprint(args.Interleave)},
+		{Name: "Check", Value: check},
+	}
+}
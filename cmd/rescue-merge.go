@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/edorfaus/sb-mfm-decode/exitcode"
+	"github.com/edorfaus/sb-mfm-decode/rescue"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(exitcode.Of(err))
+	}
+}
+
+var args = struct {
+	Output string   `arg:"positional,required" help:"merged payload file"`
+	Inputs []string `arg:"positional,required" help:"payload files to merge"`
+
+	Gaps      bool `help:"list the ranges that are still bad"`
+	BlockSize int  `help:"bytes that each block takes in the payloads"`
+}{
+	BlockSize: rescue.DefaultBlockSize,
+}
+
+func run() error {
+	argParser := exitcode.MustParse(&args)
+	if args.BlockSize <= 0 {
+		argParser.Fail("blocksize must be positive")
+	}
+
+	var payloads []*rescue.Payload
+	for _, fn := range args.Inputs {
+		p, err := rescue.LoadPayload(fn)
+		if err != nil && exitcode.Of(err) == exitcode.Internal {
+			// Not an I/O error, so the map is not valid.
+			return exitcode.New(exitcode.Format, "%v: %w", fn, err)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf(
+			"%v: %v bytes, %v bad\n", fn, len(p.Data), p.Map.BadBytes(),
+		)
+		payloads = append(payloads, p)
+	}
+
+	out, conflicts, err := rescue.Merge(args.BlockSize, payloads...)
+	if err != nil {
+		return exitcode.New(exitcode.Format, "%v", err)
+	}
+	if err := out.Save(args.Output, "rescue-merge"); err != nil {
+		return err
+	}
+
+	bad := out.Map.Bad()
+	fmt.Printf(
+		"%v: %v bytes, %v bad in %v ranges\n", args.Output, len(out.Data),
+		out.Map.BadBytes(), len(bad),
+	)
+	if args.Gaps {
+		for _, r := range bad {
+			fmt.Printf("  bad: %v-%v (%v bytes)\n", r.Pos, r.End(), r.Size)
+		}
+	}
+	if conflicts > 0 {
+		return exitcode.New(
+			exitcode.Checksum, "%v good bytes differ between the inputs, "+
+				"and were marked bad; are they of the same tape?", conflicts,
+		)
+	}
+	if len(bad) > 0 {
+		return exitcode.New(
+			exitcode.Decode, "%v bytes are still bad", out.Map.BadBytes(),
+		)
+	}
+	return nil
+}
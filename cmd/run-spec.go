@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/edorfaus/sb-mfm-decode/exitcode"
+	"github.com/edorfaus/sb-mfm-decode/log"
+	"github.com/edorfaus/sb-mfm-decode/metrics"
+	"github.com/edorfaus/sb-mfm-decode/mfm"
+	"github.com/edorfaus/sb-mfm-decode/pipeline"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(exitcode.Of(err))
+	}
+}
+
+var args = struct {
+	Spec string `arg:"positional,required" help:"pipeline spec (JSON) file"`
+
+	LogLevel  int    `help:"set the logging level (verbosity)"`
+	Log       string `help:"per-module log levels, e.g. 2,filter=3,mfm=1"`
+	LogTo     string `help:"log output per level, e.g. *=stderr,1=stdout"`
+	WarnLimit int    `help:"max warnings of each kind to show; 0=no limit"`
+	Metrics   string `help:"write timing metrics as JSON" placeholder:"FILE"`
+
+	Check bool `help:"only check the spec, without decoding anything"`
+}{
+	LogLevel:  log.Level,
+	WarnLimit: log.DefaultWarnLimit,
+}
+
+func run() (retErr error) {
+	defer log.WarnSummary()
+	defer func() {
+		if err := outputMetrics(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+
+	argParser := exitcode.MustParse(&args)
+
+	log.Level = args.LogLevel
+	if err := log.SetLevels(args.Log); err != nil {
+		argParser.Fail(err.Error())
+	}
+	if err := log.SetTargets(args.LogTo); err != nil {
+		argParser.Fail(err.Error())
+	}
+	log.Collected.SetLimit(args.WarnLimit)
+
+	spec, err := pipeline.LoadSpec(args.Spec)
+	if err != nil {
+		return specError(err)
+	}
+	p, err := pipeline.FromSpec(spec)
+	if err != nil {
+		return specError(err)
+	}
+	outputs, err := outputNames(p)
+	if err != nil {
+		return exitcode.New(exitcode.Format, "%w", err)
+	}
+	log.F(
+		1, "Spec: %v inputs, %v stages, output to %v\n",
+		len(p.Inputs), len(spec.Stages), p.OutDir,
+	)
+	if args.Check {
+		return nil
+	}
+
+	if err := os.MkdirAll(p.OutDir, 0o777); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var writeErr error
+	var errs []error
+	blocks := 0
+	results := p.Run(ctx, func(res *pipeline.Result) {
+		if writeErr != nil || errors.Is(res.Err, context.Canceled) {
+			return
+		}
+		if len(res.Blocks) > 0 {
+			if err := writeBlocks(outputs[res.Input], res.Blocks); err != nil {
+				writeErr = err
+				stop()
+				return
+			}
+		}
+		showResult(res)
+		blocks += len(res.Blocks)
+		errs = append(errs, res.BlockErrors()...)
+		res.Blocks = nil
+	})
+	if writeErr != nil {
+		return writeErr
+	}
+	if err := ctx.Err(); err != nil {
+		return exitcode.New(exitcode.Interrupted, "%w", err)
+	}
+	for _, res := range results {
+		if res.Err != nil {
+			return fmt.Errorf("%v: %w", res.Input, res.Err)
+		}
+	}
+	return exitcode.FailedBlocks(errs, blocks)
+}
+
+// specError returns the given error from loading the spec, as a Format
+// error if it is not an I/O error.
+func specError(err error) error {
+	if exitcode.Of(err) == exitcode.Internal {
+		return exitcode.New(exitcode.Format, "%w", err)
+	}
+	return err
+}
+
+func outputMetrics() error {
+	if err := metrics.Default.Summary(log.Writer(2)); err != nil {
+		return err
+	}
+	if args.Metrics == "" {
+		return nil
+	}
+	return metrics.Default.SaveJSON(args.Metrics)
+}
+
+// outputNames returns the name of the output file for each input of the
+// pipeline, which is named after the input, in the output directory.
+func outputNames(p *pipeline.Pipeline) (map[string]string, error) {
+	outputs := map[string]string{}
+	owner := map[string]string{}
+	for _, in := range p.Inputs {
+		name := filepath.Base(in)
+		out := filepath.Join(
+			p.OutDir, strings.TrimSuffix(name, filepath.Ext(name))+".txt",
+		)
+		if other, ok := owner[out]; ok && other != in {
+			return nil, fmt.Errorf(
+				"inputs %v and %v would both be output to %v", other, in, out,
+			)
+		}
+		owner[out], outputs[in] = in, out
+	}
+	return outputs, nil
+}
+
+// writeBlocks writes the given blocks to the given file, in the same form
+// as stream-decode does.
+func writeBlocks(fn string, blocks []*pipeline.Block) (retErr error) {
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := f.Close(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+	out := bufio.NewWriter(f)
+
+	for _, b := range blocks {
+		fmt.Fprintf(
+			out, "block: start %v, end %v, bit width %v, bits %v, id %v",
+			b.Start, b.End, b.BitWidth, b.Bits.Len(), b.ID(),
+		)
+		if b.Err != nil {
+			fmt.Fprintf(out, ", error: %v\n", b.Err)
+			continue
+		}
+		if b.Ending == mfm.EndNoise {
+			fmt.Fprint(out, ", ended in noise")
+		}
+		fmt.Fprintf(out, ", bytes %v\n  %x\n", len(b.Data), b.Data)
+	}
+	return out.Flush()
+}
+
+func showResult(res *pipeline.Result) {
+	if res.Err != nil {
+		log.F(0, "%v: FAILED: %v\n", res.Input, res.Err)
+		return
+	}
+	log.F(
+		1, "%v: %v blocks (%v failed) in %v\n", res.Input, len(res.Blocks),
+		res.FailedBlocks(), res.Duration.Round(time.Millisecond),
+	)
+}
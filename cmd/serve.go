@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/edorfaus/sb-mfm-decode/exitcode"
+	"github.com/edorfaus/sb-mfm-decode/log"
+	"github.com/edorfaus/sb-mfm-decode/service"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(exitcode.Of(err))
+	}
+}
+
+// The log output always goes to stderr, since stdout has the responses.
+var args = struct {
+	LogLevel  int    `help:"set the logging level (verbosity)"`
+	Log       string `help:"per-module log levels, e.g. 2,filter=3,mfm=1"`
+	WarnLimit int    `help:"max warnings of each kind to show; 0=no limit"`
+}{
+	LogLevel:  log.Level,
+	WarnLimit: log.DefaultWarnLimit,
+}
+
+func run() error {
+	defer log.WarnSummary()
+
+	argParser := exitcode.MustParse(&args)
+
+	log.Level = args.LogLevel
+	if err := log.SetLevels(args.Log); err != nil {
+		argParser.Fail(err.Error())
+	}
+	log.Target = os.Stderr
+	log.Collected.SetLimit(args.WarnLimit)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	s := service.New()
+	s.Log, s.LogLevel = os.Stderr, args.LogLevel
+
+	log.F(1, "Serving requests on stdin\n")
+	err := s.Serve(ctx, os.Stdin, os.Stdout)
+	if errors.Is(err, context.Canceled) {
+		return exitcode.New(exitcode.Interrupted, "interrupted")
+	}
+	return err
+}
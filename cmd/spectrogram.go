@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+
+	"github.com/edorfaus/sb-mfm-decode/exitcode"
+	"github.com/edorfaus/sb-mfm-decode/filter"
+	"github.com/edorfaus/sb-mfm-decode/log"
+	"github.com/edorfaus/sb-mfm-decode/metrics"
+	"github.com/edorfaus/sb-mfm-decode/mfm"
+	"github.com/edorfaus/sb-mfm-decode/spectrum"
+	"github.com/edorfaus/sb-mfm-decode/wav"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(exitcode.Of(err))
+	}
+}
+
+var args = struct {
+	Input  string `arg:"positional,required" help:"input wav file"`
+	Output string `arg:"positional" help:"output png file [spectrogram.png]"`
+
+	CSV     string  `help:"write the mean spectrum as CSV" placeholder:"FILE"`
+	Width   int     `help:"width of the image, in columns of time"`
+	Frame   int     `help:"FFT frame size (a power of 2), sets the height"`
+	MaxFreq float64 `help:"highest frequency to show; 0=half the rate"`
+	Range   float64 `help:"dB below the loudest point to show"`
+	BitRate int     `help:"the nominal MFM bit rate of the tape"`
+
+	LogLevel  int    `help:"set the logging level (verbosity)"`
+	Log       string `help:"per-module log levels, e.g. 2,filter=3,mfm=1"`
+	LogTo     string `help:"log output per level, e.g. *=stderr,1=stdout"`
+	WarnLimit int    `help:"max warnings of each kind to show; 0=no limit"`
+	Metrics   string `help:"write timing metrics as JSON" placeholder:"FILE"`
+}{
+	Output:    "spectrogram.png",
+	Width:     1000,
+	Frame:     1024,
+	Range:     80,
+	BitRate:   mfm.DefaultBitRate,
+	LogLevel:  log.Level,
+	WarnLimit: log.DefaultWarnLimit,
+}
+
+func run() (retErr error) {
+	defer log.WarnSummary()
+	defer func() {
+		if err := outputMetrics(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+
+	argParser := exitcode.MustParse(&args)
+	if args.Width <= 0 || args.Range <= 0 || args.BitRate <= 0 {
+		argParser.Fail("width, range and bit rate must be positive")
+	}
+	if args.Frame < 4 || args.Frame&(args.Frame-1) != 0 {
+		argParser.Fail("frame size must be a power of 2")
+	}
+
+	log.Level = args.LogLevel
+	if err := log.SetLevels(args.Log); err != nil {
+		argParser.Fail(err.Error())
+	}
+	if err := log.SetTargets(args.LogTo); err != nil {
+		argParser.Fail(err.Error())
+	}
+	log.Collected.SetLimit(args.WarnLimit)
+
+	samples, meta, err := wav.LoadDataChannel(args.Input)
+	if err != nil {
+		return err
+	}
+	rate, bits := meta.SampleRate, meta.BitDepth
+	if len(samples) == 0 {
+		return exitcode.New(exitcode.Format, "input has no samples")
+	}
+
+	showAnalysis(samples, rate, bits)
+
+	sg := func() *spectrum.Spectrogram {
+		defer log.TimeStage(
+			1, "spectrum", len(samples), "Computing spectrogram...",
+		)(" done in")
+		return spectrum.NewSpectrogram(samples, rate, args.Frame, args.Width)
+	}()
+
+	maxFreq := args.MaxFreq
+	if maxFreq <= 0 || maxFreq > float64(rate)/2 {
+		maxFreq = float64(rate) / 2
+	}
+	bins := int(maxFreq*float64(args.Frame)/float64(rate)) + 1
+
+	if args.CSV != "" {
+		if err := writeCSV(args.CSV, sg.Total(), bins); err != nil {
+			return err
+		}
+	}
+	return plot(args.Output, sg, bins)
+}
+
+func outputMetrics() error {
+	if err := metrics.Default.Summary(log.Writer(2)); err != nil {
+		return err
+	}
+	if args.Metrics == "" {
+		return nil
+	}
+	return metrics.Default.SaveJSON(args.Metrics)
+}
+
+// showAnalysis logs the MFM bit rate and the periodic interference that
+// the spectrum shows, if any.
+func showAnalysis(samples []int, rate, bits int) {
+	nominal := float64(args.BitRate)
+	if br := spectrum.BitRate(samples, rate, nominal); br > 0 {
+		log.F(
+			1, "Bit rate: %.1f bps (%.2f%% of nominal)\n",
+			br, br/nominal*100,
+		)
+	} else {
+		log.Ln(1, "Bit rate: not found")
+	}
+
+	noiseFloor := filter.DefaultNoiseFloor(bits)
+	if f := filter.DetectInterference(samples, rate, noiseFloor); f > 0 {
+		log.F(1, "Interference: %.2f Hz\n", f)
+	} else {
+		log.Ln(1, "Interference: none found")
+	}
+}
+
+// decibels returns the given power in dB, with a lower limit for 0.
+func decibels(power float64) float64 {
+	return 10 * math.Log10(math.Max(power, 1e-12))
+}
+
+func writeCSV(fn string, p *spectrum.Power, bins int) (retErr error) {
+	var out *bufio.Writer
+	if fn == "-" {
+		out = bufio.NewWriter(os.Stdout)
+	} else {
+		f, err := os.Create(fn)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := f.Close(); err != nil && retErr == nil {
+				retErr = err
+			}
+		}()
+		out = bufio.NewWriter(f)
+	}
+
+	fmt.Fprintln(out, "freq_hz,power_db")
+	for i := 0; i < bins; i++ {
+		fmt.Fprintf(out, "%.2f,%.2f\n", p.Freq(i), decibels(p.Mean(i)))
+	}
+	return out.Flush()
+}
+
+// plot draws the spectrogram as a PNG image, with time from left to right
+// and frequency from the bottom up, colored by the power in dB, from black
+// at the bottom of the range to white at the loudest point.
+func plot(fn string, sg *spectrum.Spectrogram, bins int) (retErr error) {
+	top := math.Inf(-1)
+	for _, c := range sg.Columns {
+		for i := 0; i < bins; i++ {
+			top = math.Max(top, decibels(c.Mean(i)))
+		}
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, len(sg.Columns), bins))
+	for x, c := range sg.Columns {
+		for i := 0; i < bins; i++ {
+			level := 1 - (top-decibels(c.Mean(i)))/args.Range
+			img.Set(x, bins-1-i, heat(level))
+		}
+	}
+
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := f.Close(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+	return png.Encode(f, img)
+}
+
+// heatColors are the colors of the heat scale, from lowest to highest.
+var heatColors = []color.RGBA{
+	{0, 0, 0, 255},
+	{32, 0, 128, 255},
+	{192, 0, 64, 255},
+	{255, 160, 0, 255},
+	{255, 255, 255, 255},
+}
+
+// heat returns the color of the given level on the heat scale, from 0 to
+// 1; levels outside of that are clamped to it.
+func heat(level float64) color.RGBA {
+	level = math.Max(0, math.Min(1, level))
+	pos := level * float64(len(heatColors)-1)
+	i := min(int(pos), len(heatColors)-2)
+	t := pos - float64(i)
+	a, b := heatColors[i], heatColors[i+1]
+	mix := func(u, v uint8) uint8 {
+		return uint8(float64(u) + t*(float64(v)-float64(u)) + 0.5)
+	}
+	return color.RGBA{mix(a.R, b.R), mix(a.G, b.G), mix(a.B, b.B), 255}
+}
@@ -0,0 +1,822 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/edorfaus/sb-mfm-decode/cache"
+	"github.com/edorfaus/sb-mfm-decode/calibrate"
+	"github.com/edorfaus/sb-mfm-decode/exitcode"
+	"github.com/edorfaus/sb-mfm-decode/log"
+	"github.com/edorfaus/sb-mfm-decode/manifest"
+	"github.com/edorfaus/sb-mfm-decode/metrics"
+	"github.com/edorfaus/sb-mfm-decode/mfm"
+	"github.com/edorfaus/sb-mfm-decode/pipeline"
+	"github.com/edorfaus/sb-mfm-decode/rescue"
+	"github.com/edorfaus/sb-mfm-decode/sample"
+	"github.com/edorfaus/sb-mfm-decode/studybox"
+	"github.com/edorfaus/sb-mfm-decode/wav"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(exitcode.Of(err))
+	}
+}
+
+var args = struct {
+	Input  string `arg:"positional,required" help:"input wav file"`
+	Output string `arg:"positional" help:"output text file [out.txt]"`
+	// TODO: remove default value text from above help text, when go-arg
+	// is updated to a newer version with the fix for auto-printing it.
+
+	LogLevel  int    `help:"set the logging level (verbosity)"`
+	Log       string `help:"per-module log levels, e.g. 2,filter=3,mfm=1"`
+	LogTo     string `help:"log output per level, e.g. *=stderr,1=stdout"`
+	WarnLimit int    `help:"max warnings of each kind to show; 0=no limit"`
+	Metrics   string `help:"write timing metrics as JSON" placeholder:"FILE"`
+	Quality   string `help:"write a quality report as JSON" placeholder:"FILE"`
+	BlockInfo string `help:"write block metadata as JSON" placeholder:"FILE"`
+	Soft      string `help:"write data confidence as JSON" placeholder:"FILE"`
+	Labels    string `help:"write Audacity labels of blocks" placeholder:"FILE"`
+	Features  string `help:"write pulse features as CSV" placeholder:"FILE"`
+	Manifest  string `help:"write a checksum manifest" placeholder:"FILE"`
+	Payload   string `help:"write the data with a map of bad bytes" placeholder:"FILE"`
+	MinConf   int    `help:"bytes below this confidence are bad in --payload"`
+	BlockSize int    `help:"bytes that each block takes in --payload"`
+	Cache     string `help:"cache cleaned samples in DIR" placeholder:"DIR"`
+	NoClean   bool   `help:"do not clean the input signal first"`
+	Wiener    bool   `help:"also reduce noise with a Wiener filter"`
+	Gate      bool   `help:"use a noise gate instead of the cleanup"`
+
+	NoiseFloor   sample.Level `help:"noise floor, e.g. 655 or -34dB; -1 means use 2% of max"`
+	NoiseProfile string       `help:"CSV of noise floor over time" placeholder:"FILE"`
+
+	Normalize string  `help:"normalize the input first: peak or rms"`
+	Level     float64 `help:"level to normalize to; 0=default for the kind"`
+
+	Buffer  int  `help:"max samples to keep in memory; 0=default"`
+	Mmap    bool `help:"memory-map the input file instead of reading it"`
+	Diff    bool `arg:"--differential" help:"use left minus right as the data"`
+	Retry   bool `help:"retry failed blocks with other settings"`
+	Reclean bool `help:"reclean failed blocks with settings from their lead-in"`
+	Reverse bool `help:"also decode failed blocks backwards, from the end"`
+
+	Rate  int     `help:"sample rate to use instead of the file's; 0=file's"`
+	Speed float64 `help:"speed the tape was played at, e.g. 1.02 = 2% fast"`
+	Curve string  `arg:"--speedcurve" help:"speed over time" placeholder:"FILE"`
+
+	Calibration string `help:"deck calibration to apply" placeholder:"FILE"`
+	Roles       string `arg:"--channels" help:"channel roles, e.g. a,d,a,d"`
+
+	Hum       float64 `help:"remove interference at this Hz; -1=detect it"`
+	Harmonics int     `help:"number of harmonics of --hum to remove"`
+
+	Weighted    bool    `help:"place edges by the slope between the peaks"`
+	MaxGap      float64 `help:"bridge dropouts up to this many bit widths"`
+	NoisePulses int     `help:"trim up to this many noise pulses at block end"`
+	Heal        bool    `help:"merge tiny pulse pairs that make a valid one"`
+	ML          bool    `help:"find the most likely pulse sequence per block"`
+	Inherit     bool    `help:"start blocks from the last good block's bit width"`
+	Interleave  int     `help:"deinterleave bytes with this block depth"`
+	Check       string  `help:"data check: none, xor, sum, parity, crc16"`
+
+	MaxBits    int `help:"fail blocks with more MFM bits; 0=no limit"`
+	MaxSamples int `help:"fail blocks longer than this; 0=no limit"`
+	MaxPeak    int `help:"fail on peaks longer than this many peak widths"`
+	MaxFailed  int `help:"stop after this many failed blocks in a row"`
+
+	Start int `help:"sample index to start decoding at"`
+	End   int `help:"sample index to stop decoding at; 0=end of input"`
+
+	SkipAudio bool `help:"find the data bursts first, and decode only those"`
+}{
+	Output:     "out.txt",
+	LogLevel:   log.Level,
+	NoiseFloor: sample.Level{Value: -1},
+	WarnLimit:  log.DefaultWarnLimit,
+	MinConf:    1,
+	BlockSize:  rescue.DefaultBlockSize,
+}
+
+func run() (retErr error) {
+	defer log.WarnSummary()
+	defer func() {
+		if err := outputMetrics(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+
+	argParser := exitcode.MustParse(&args)
+	if args.Start < 0 || args.End < 0 {
+		argParser.Fail("start and end cannot be negative")
+	}
+	if args.End != 0 && args.End <= args.Start {
+		argParser.Fail("end must be after start")
+	}
+	if args.Rate < 0 || args.Speed < 0 {
+		argParser.Fail("rate and speed cannot be negative")
+	}
+	if min(args.MaxBits, args.MaxSamples, args.MaxPeak, args.MaxFailed) < 0 {
+		argParser.Fail("limits cannot be negative")
+	}
+	if args.MinConf < 0 || args.MinConf > 256 {
+		argParser.Fail("minconf must be from 0 to 256")
+	}
+	if args.BlockSize <= 0 {
+		argParser.Fail("blocksize must be positive")
+	}
+	check, err := studybox.ParseChecker(args.Check)
+	if err != nil {
+		argParser.Fail(err.Error())
+	}
+	norm, err := wav.ParseNormalizer(args.Normalize, args.Level)
+	if err != nil {
+		argParser.Fail(err.Error())
+	}
+
+	log.Level = args.LogLevel
+	if err := log.SetLevels(args.Log); err != nil {
+		argParser.Fail(err.Error())
+	}
+	if err := log.SetTargets(args.LogTo); err != nil {
+		argParser.Fail(err.Error())
+	}
+	log.Collected.SetLimit(args.WarnLimit)
+
+	var roles []wav.Role
+	if args.Roles != "" {
+		if args.Diff {
+			argParser.Fail("channels cannot be used with differential")
+		}
+		roles, err = wav.ParseRoles(args.Roles)
+		if err != nil {
+			argParser.Fail(err.Error())
+		}
+	}
+	multi := dataChannels(roles) > 1
+	if multi && args.Output == "-" {
+		argParser.Fail("several data channels need an output file")
+	}
+	if multi && args.Mmap {
+		argParser.Fail("mmap is not supported with several data channels")
+	}
+	if multi && (args.BlockInfo != "" || args.Soft != "" ||
+		args.Labels != "" || args.Features != "" || args.Quality != "" ||
+		args.Manifest != "" || args.Payload != "") {
+		argParser.Fail(
+			"only the block listing is written for several data channels",
+		)
+	}
+
+	r, meta, err := openInput(roles)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	rate, bits := meta.SampleRate, meta.BitDepth
+	if err := args.NoiseFloor.Check(bits); err != nil {
+		return exitcode.New(exitcode.Usage, "%w", err)
+	}
+
+	log.F(1, "Input: %v-bit samples at %v Hz\n", bits, rate)
+
+	var profile sample.NoiseProfile
+	if args.NoiseProfile != "" {
+		profile, err = sample.LoadNoiseProfile(args.NoiseProfile)
+		if err != nil && exitcode.Of(err) == exitcode.Internal {
+			// Not an I/O error, so the file is not a valid profile.
+			return exitcode.New(exitcode.Format, "%w", err)
+		}
+		if err != nil {
+			return err
+		}
+		log.F(2, "Noise profile: %v levels\n", len(profile))
+	}
+
+	var curve sample.SpeedCurve
+	if args.Curve != "" {
+		curve, err = sample.LoadSpeedCurve(args.Curve)
+		if err != nil && exitcode.Of(err) == exitcode.Internal {
+			// Not an I/O error, so the file is not a valid curve.
+			return exitcode.New(exitcode.Format, "%w", err)
+		}
+		if err != nil {
+			return err
+		}
+		log.F(2, "Speed curve: %v points\n", len(curve))
+	}
+
+	// If some blocks failed, that is returned as the error, but the
+	// outputs (and the manifest) are still written, and errors in writing
+	// them take precedence, as they are more serious.
+	var failed error
+
+	// The manifest is written last, after the other outputs are closed, so
+	// that it has their final checksums.
+	var man *manifest.Manifest
+	if args.Manifest != "" {
+		man = manifest.New("stream-decode", params())
+		defer func() {
+			if retErr == failed {
+				if err := saveManifest(man); err != nil {
+					retErr = err
+				}
+			}
+		}()
+	}
+
+	cfg := pipeline.Config{
+		NoiseFloor:    args.NoiseFloor.Value,
+		NoiseFloorDB:  args.NoiseFloor.DB,
+		NoiseProfile:  profile,
+		Normalize:     norm,
+		SampleRate:    args.Rate,
+		Speed:         args.Speed,
+		SpeedCurve:    curve,
+		NoClean:       args.NoClean || args.Gate,
+		Gate:          args.Gate,
+		Wiener:        args.Wiener,
+		BufferSamples: args.Buffer,
+		Start:         args.Start,
+		End:           args.End,
+		SkipAudio:     args.SkipAudio,
+		Retry:         args.Retry,
+		Reclean:       args.Reclean,
+		Reverse:       args.Reverse,
+
+		Interference:          args.Hum,
+		InterferenceHarmonics: args.Harmonics,
+
+		WeightedEdges:   args.Weighted,
+		MaxGap:          args.MaxGap,
+		MaxNoisePulses:  args.NoisePulses,
+		HealTiny:        args.Heal,
+		MaxLikelihood:   args.ML,
+		InheritBitWidth: args.Inherit,
+		Check:           check,
+
+		MaxBlockBits:    args.MaxBits,
+		MaxBlockSamples: args.MaxSamples,
+		MaxPeakWidths:   args.MaxPeak,
+		MaxFailedBlocks: args.MaxFailed,
+	}
+	if args.Interleave > 1 {
+		cfg.Interleaving = studybox.BlockInterleave{Depth: args.Interleave}
+	}
+	if args.Calibration != "" {
+		cal, err := calibrate.Load(args.Calibration)
+		if err != nil && exitcode.Of(err) == exitcode.Internal {
+			// Not an I/O error, so the file is not a valid calibration.
+			return exitcode.New(exitcode.Format, "%w", err)
+		}
+		if err != nil {
+			return err
+		}
+		cal.Apply(&cfg)
+		log.F(
+			2, "Calibration: speed %.4f, noise floor %v\n",
+			cfg.Speed, cfg.NoiseFloor,
+		)
+	}
+	if args.Cache != "" {
+		if err := setupCache(&cfg, roles, meta); err != nil {
+			return err
+		}
+	}
+
+	if multi {
+		failed, err = decodeChannels(cfg, roles)
+		if err != nil {
+			return err
+		}
+		return failed
+	}
+
+	var out *bufio.Writer
+	if args.Output == "-" {
+		out = bufio.NewWriter(os.Stdout)
+	} else {
+		f, err := os.Create(args.Output)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := f.Close(); err != nil && retErr == failed {
+				retErr = err
+			}
+		}()
+		out = bufio.NewWriter(f)
+	}
+	defer func() {
+		if err := out.Flush(); err != nil && retErr == failed {
+			retErr = err
+		}
+	}()
+
+	s := pipeline.NewStream(r, rate, bits, cfg)
+	defer s.Close()
+	if s.SampleRate() != rate {
+		rate = s.SampleRate()
+		log.F(1, "Corrected sample rate: %v Hz\n", rate)
+	}
+
+	var feat *featureOutput
+	if args.Features != "" {
+		f, err := os.Create(args.Features)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := f.Close(); err != nil && retErr == failed {
+				retErr = err
+			}
+		}()
+		feat = &featureOutput{
+			c: pipeline.NewFeatureCollector(s),
+			w: pipeline.NewFeatureWriter(f),
+		}
+	}
+
+	res, err := decode(s, rate, out, man, feat)
+	if err != nil {
+		return err
+	}
+
+	if feat != nil {
+		if err := feat.w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if args.BlockInfo != "" {
+		if err := saveJSON(res.infos, args.BlockInfo); err != nil {
+			return err
+		}
+	}
+	if args.Soft != "" {
+		if err := saveJSON(res.soft, args.Soft); err != nil {
+			return err
+		}
+	}
+	if args.Labels != "" {
+		// The labels are placed on the input as it is, so they are timed
+		// by its own sample rate, not the one corrected for the speed.
+		speed := cfg.Speed
+		if speed <= 0 {
+			speed = 1
+		}
+		labelRate := float64(s.SampleRate()) * speed
+		if err := saveLabels(res.labels, labelRate, args.Labels); err != nil {
+			return err
+		}
+	}
+	if args.Quality != "" {
+		if err := saveJSON(s.Quality(), args.Quality); err != nil {
+			return err
+		}
+	}
+	if args.Payload != "" {
+		err := res.payload.Save(args.Payload, "stream-decode")
+		if err != nil {
+			return err
+		}
+		log.F(
+			1, "Payload: %v bytes, %v of them bad in %v ranges\n",
+			len(res.payload.Data), res.payload.Map.BadBytes(),
+			len(res.payload.Map.Bad()),
+		)
+	}
+
+	failed = exitcode.FailedBlocks(res.errs, res.blocks)
+	return failed
+}
+
+// setupCache sets up the config to cache the cleaned samples in the cache
+// directory, keyed by the contents of the input file and how it is read.
+func setupCache(cfg *pipeline.Config, roles []wav.Role, meta wav.Meta) error {
+	c, err := cache.Open(args.Cache)
+	if err != nil {
+		return err
+	}
+	hash, err := cache.HashFile(args.Input)
+	if err != nil {
+		return err
+	}
+	cfg.Cache = c
+	cfg.CacheKey = cache.Key(hash, args.Diff)
+	if chs := meta.Channels(wav.RoleData); roles != nil && len(chs) == 1 {
+		// Another channel than the default one has other samples.
+		cfg.CacheKey = cache.Key(cfg.CacheKey, chs[0])
+	}
+	return nil
+}
+
+type sampleReader interface {
+	pipeline.SampleSource
+	io.Closer
+}
+
+// openInput opens the input file, to be read from its data channel as
+// given by the roles (if any); with several data channels, the reader is
+// of the first of them.
+func openInput(roles []wav.Role) (sampleReader, wav.Meta, error) {
+	var r sampleReader
+	var meta wav.Meta
+	var channel *int
+	if args.Mmap {
+		m, err := wav.OpenMapped(args.Input)
+		if err != nil {
+			return nil, wav.Meta{}, err
+		}
+		m.Differential = args.Diff
+		r, meta, channel = m, m.Meta, &m.Channel
+	} else {
+		f, err := wav.OpenReader(args.Input)
+		if err != nil {
+			return nil, wav.Meta{}, err
+		}
+		f.Differential = args.Diff
+		r, meta, channel = f, f.Meta, &f.Channel
+	}
+
+	if roles != nil {
+		if err := meta.SetRoles(roles); err != nil {
+			r.Close()
+			return nil, meta, exitcode.New(exitcode.Format, "%w", err)
+		}
+		*channel = meta.Channels(wav.RoleData)[0]
+	}
+
+	if args.Diff && meta.NumChannels < 2 {
+		r.Close()
+		return nil, meta, exitcode.New(
+			exitcode.Format, "differential input needs 2 channels, got %v",
+			meta.NumChannels,
+		)
+	}
+	return r, meta, nil
+}
+
+func saveJSON(v any, fn string) (retErr error) {
+	if fn == "-" {
+		return writeJSON(os.Stdout, v)
+	}
+
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := f.Close(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+
+	return writeJSON(f, v)
+}
+
+func writeJSON(out io.Writer, v any) error {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// saveManifest adds the input and output files to the manifest, and
+// saves it.
+func saveManifest(man *manifest.Manifest) error {
+	if err := man.AddInput(args.Input); err != nil {
+		return err
+	}
+	outputs := []string{
+		args.Output, args.BlockInfo, args.Soft, args.Labels, args.Quality,
+		args.Features, args.Payload,
+	}
+	if args.Payload != "" {
+		outputs = append(outputs, rescue.MapName(args.Payload))
+	}
+	for _, fn := range outputs {
+		if fn == "" || fn == "-" {
+			continue
+		}
+		if err := man.AddOutput(fn); err != nil {
+			return err
+		}
+	}
+	return man.Save(args.Manifest)
+}
+
+// params returns the decode settings that were given, for the manifest,
+// by the names of their options.
+func params() []manifest.Param {
+	check := args.Check
+	if check == "" {
+		check = "none"
+	}
+	return []manifest.Param{
+		{Name: "noisefloor", Value: fmt.Sprint(args.NoiseFloor)},
+		{Name: "noiseprofile", Value: args.NoiseProfile},
+		{Name: "normalize", Value: args.Normalize},
+		{Name: "level", Value: fmt.Sprint(args.Level)},
+		{Name: "noclean", Value: fmt.Sprint(args.NoClean)},
+		{Name: "wiener", Value: fmt.Sprint(args.Wiener)},
+		{Name: "gate", Value: fmt.Sprint(args.Gate)},
+		{Name: "hum", Value: fmt.Sprint(args.Hum)},
+		{Name: "harmonics", Value: fmt.Sprint(args.Harmonics)},
+		{Name: "differential", Value: fmt.Sprint(args.Diff)},
+		{Name: "channels", Value: args.Roles},
+		{Name: "rate", Value: fmt.Sprint(args.Rate)},
+		{Name: "speed", Value: fmt.Sprint(args.Speed)},
+		{Name: "speedcurve", Value: args.Curve},
+		{Name: "calibration", Value: args.Calibration},
+		{Name: "buffer", Value: fmt.Sprint(args.Buffer)},
+		{Name: "start", Value: fmt.Sprint(args.Start)},
+		{Name: "end", Value: fmt.Sprint(args.End)},
+		{Name: "skipaudio", Value: fmt.Sprint(args.SkipAudio)},
+		{Name: "retry", Value: fmt.Sprint(args.Retry)},
+		{Name: "reclean", Value: fmt.Sprint(args.Reclean)},
+		{Name: "reverse", Value: fmt.Sprint(args.Reverse)},
+		{Name: "weighted", Value: fmt.Sprint(args.Weighted)},
+		{Name: "maxgap", Value: fmt.Sprint(args.MaxGap)},
+		{Name: "noisepulses", Value: fmt.Sprint(args.NoisePulses)},
+		{Name: "heal", Value: fmt.Sprint(args.Heal)},
+		{Name: "ml", Value: fmt.Sprint(args.ML)},
+		{Name: "inherit", Value: fmt.Sprint(args.Inherit)},
+		{Name: "interleave", Value: fmt.Sprint(args.Interleave)},
+		{Name: "check", Value: check},
+		{Name: "maxbits", Value: fmt.Sprint(args.MaxBits)},
+		{Name: "maxsamples", Value: fmt.Sprint(args.MaxSamples)},
+		{Name: "maxpeak", Value: fmt.Sprint(args.MaxPeak)},
+		{Name: "maxfailed", Value: fmt.Sprint(args.MaxFailed)},
+	}
+}
+
+func outputMetrics() error {
+	if err := metrics.Default.Summary(log.Writer(2)); err != nil {
+		return err
+	}
+	if args.Metrics == "" {
+		return nil
+	}
+	return metrics.Default.SaveJSON(args.Metrics)
+}
+
+// dataChannels returns the number of data channels among the given roles,
+// which is 1 if none were given (for the default data channel).
+func dataChannels(roles []wav.Role) int {
+	if roles == nil {
+		return 1
+	}
+	n := 0
+	for _, r := range roles {
+		if r == wav.RoleData {
+			n++
+		}
+	}
+	return n
+}
+
+// decodeChannels decodes each of the data channels of the input through
+// a pipeline of its own, and writes the blocks of each to an output file
+// of its own (see channelOutput), as the main output is for one channel.
+// It returns the error for the blocks that failed, if any, as failed.
+func decodeChannels(
+	cfg pipeline.Config, roles []wav.Role,
+) (failed, err error) {
+	results, err := pipeline.DecodeChannels(
+		context.Background(), args.Input, roles, cfg,
+	)
+	if err != nil && exitcode.Of(err) == exitcode.Internal {
+		// Not an I/O error, so the roles do not fit the input.
+		return nil, exitcode.New(exitcode.Format, "%w", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	blocks := 0
+	for _, res := range results {
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		fn := channelOutput(args.Output, res.Channel)
+		if err := saveBlocks(res.Blocks, fn); err != nil {
+			return nil, err
+		}
+		blockErrs := res.BlockErrors()
+		log.F(
+			1, "Channel %v: decoded %v blocks (%v failed) to %v\n",
+			res.Channel, len(res.Blocks), len(blockErrs), fn,
+		)
+		blocks += len(res.Blocks)
+		errs = append(errs, blockErrs...)
+	}
+	return exitcode.FailedBlocks(errs, blocks), nil
+}
+
+// channelOutput returns the name of the output file for the given channel,
+// which is the output file name with ".chN" before its extension, e.g.
+// "out.ch1.txt" for channel 1.
+func channelOutput(fn string, channel int) string {
+	ext := filepath.Ext(fn)
+	return fmt.Sprintf("%v.ch%v%v", strings.TrimSuffix(fn, ext), channel, ext)
+}
+
+// saveBlocks writes a listing of the given blocks to the given file, in
+// the same form as the main output.
+func saveBlocks(blocks []*pipeline.Block, fn string) (retErr error) {
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := f.Close(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+
+	out := bufio.NewWriter(f)
+	for _, b := range blocks {
+		writeBlock(out, b)
+	}
+	return out.Flush()
+}
+
+// writeBlock writes the listing of the given block to the output.
+func writeBlock(out *bufio.Writer, b *pipeline.Block) {
+	fmt.Fprintf(
+		out, "block: start %v, end %v, bit width %v, bits %v, id %v",
+		b.Start, b.End, b.BitWidth, b.Bits.Len(), b.ID(),
+	)
+	if b.Err != nil {
+		fmt.Fprintf(out, ", error: %v\n", b.Err)
+		return
+	}
+	if b.Ending == mfm.EndNoise {
+		fmt.Fprint(out, ", ended in noise")
+	}
+	fmt.Fprintf(out, ", bytes %v\n  %x\n", len(b.Data), b.Data)
+}
+
+// decoded holds what is collected from the blocks while decoding them,
+// for writing to the output files afterwards.
+type decoded struct {
+	blocks int
+	errs   []error
+	infos  []mfm.BlockInfo
+	soft   []softBlock
+	labels []label
+
+	// The data of the blocks with the map of its bad bytes, for --payload.
+	payload rescue.Payload
+}
+
+// label is a label of a block, for --labels.
+type label struct {
+	start, end int
+	text       string
+}
+
+// saveLabels writes the given labels as an Audacity label track, which
+// has a line for each label with its start and end in seconds (at the
+// given sample rate) and its text, separated by tabs.
+func saveLabels(labels []label, rate float64, fn string) (retErr error) {
+	out := io.Writer(os.Stdout)
+	if fn != "-" {
+		f, err := os.Create(fn)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := f.Close(); err != nil && retErr == nil {
+				retErr = err
+			}
+		}()
+		out = f
+	}
+
+	w := bufio.NewWriter(out)
+	for _, l := range labels {
+		fmt.Fprintf(
+			w, "%.6f\t%.6f\t%v\n",
+			float64(l.start)/rate, float64(l.end)/rate, l.text,
+		)
+	}
+	return w.Flush()
+}
+
+// softBlock is the confidence of the data of a decoded block, for use in
+// soft-decision error correction or merging of several dumps. The values
+// go from 0 (unknown) to 255 (certain).
+type softBlock struct {
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+	Data  string `json:"data"`
+
+	// The confidence of each byte, and of each of their bits (8 per
+	// byte, most significant first).
+	Confidence    []int `json:"confidence"`
+	BitConfidence []int `json:"bit_confidence"`
+}
+
+func newSoftBlock(b *pipeline.Block) softBlock {
+	sb := softBlock{
+		Start: b.Start,
+		End:   b.End,
+		Data:  hex.EncodeToString(b.Data),
+	}
+	for _, c := range b.DataConfidence {
+		sb.Confidence = append(sb.Confidence, int(c))
+	}
+	for _, c := range b.DataBitConfidence {
+		sb.BitConfidence = append(sb.BitConfidence, int(c))
+	}
+	return sb
+}
+
+// featureOutput is where the features of the pulses of each block are
+// written to, for --features.
+type featureOutput struct {
+	c *pipeline.FeatureCollector
+	w *pipeline.FeatureWriter
+}
+
+func decode(
+	s *pipeline.Stream, rate int, out *bufio.Writer, man *manifest.Manifest,
+	feat *featureOutput,
+) (decoded, error) {
+	cfg := s.Config()
+	log.F(
+		2, "  noise floor: %v, peak width: %v, buffer: %v samples\n",
+		cfg.NoiseFloor, cfg.PeakWidth, cfg.BufferSamples,
+	)
+
+	start := time.Now()
+	end := 0
+	var res decoded
+	res.payload.BlockSize = args.BlockSize
+	for {
+		b, err := s.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return res, err
+		}
+		res.blocks++
+		if args.BlockInfo != "" {
+			res.infos = append(res.infos, b.Info)
+		}
+		if args.Soft != "" && b.Err == nil {
+			res.soft = append(res.soft, newSoftBlock(b))
+		}
+		if args.Labels != "" {
+			l := label{start: b.Start, end: b.End, text: b.ID()}
+			if b.Err != nil {
+				l.text += " (failed)"
+			}
+			res.labels = append(res.labels, l)
+		}
+		if args.Payload != "" {
+			err := res.payload.AddBlock(
+				b.Data, b.DataConfidence, args.MinConf, b.Err != nil,
+			)
+			if err != nil {
+				return res, fmt.Errorf("block at %v: %w", b.Start, err)
+			}
+		}
+		if man != nil {
+			man.AddBlock(b)
+		}
+		if feat != nil {
+			if err := feat.w.Write(feat.c.Block(b)); err != nil {
+				return res, err
+			}
+		}
+		end = b.End
+
+		writeBlock(out, b)
+		if b.Err != nil {
+			res.errs = append(res.errs, b.Err)
+		}
+	}
+	metrics.Add("decode", end, time.Since(start))
+
+	type d = time.Duration
+	log.F(
+		1, "Decoded %v blocks (%v failed) in %v samples = %v\n",
+		res.blocks, len(res.errs), end, d(end)*time.Second/d(rate),
+	)
+
+	return res, nil
+}
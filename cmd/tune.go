@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/edorfaus/sb-mfm-decode/exitcode"
+	"github.com/edorfaus/sb-mfm-decode/log"
+	"github.com/edorfaus/sb-mfm-decode/metrics"
+	"github.com/edorfaus/sb-mfm-decode/mfm"
+	"github.com/edorfaus/sb-mfm-decode/tune"
+	"github.com/edorfaus/sb-mfm-decode/wav"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(exitcode.Of(err))
+	}
+}
+
+var args = struct {
+	Input string `arg:"positional,required" help:"input wav file"`
+
+	LogLevel  int    `help:"set the logging level (verbosity)"`
+	Log       string `help:"per-module log levels, e.g. 2,filter=3,mfm=1"`
+	LogTo     string `help:"log output per level, e.g. *=stderr,1=stdout"`
+	WarnLimit int    `help:"max warnings of each kind to show; 0=no limit"`
+	Metrics   string `help:"write timing metrics as JSON" placeholder:"FILE"`
+	NoClean   bool   `help:"do not clean the input signal first"`
+
+	Start  float64 `help:"start of the part to tune on, in seconds"`
+	Length float64 `help:"length of the part to tune on, in seconds"`
+
+	Top        int `help:"number of results to show; 0=all"`
+	Thresholds int `help:"instead, show stats for this many noise floors"`
+}{
+	LogLevel:  log.Level,
+	WarnLimit: log.DefaultWarnLimit,
+	Length:    30,
+	Top:       10,
+}
+
+func run() (retErr error) {
+	defer log.WarnSummary()
+	defer func() {
+		if err := outputMetrics(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+
+	argParser := exitcode.MustParse(&args)
+	if args.Start < 0 || args.Length <= 0 {
+		argParser.Fail("start must be >= 0, and length must be > 0")
+	}
+	if args.Thresholds < 0 {
+		argParser.Fail("thresholds cannot be negative")
+	}
+
+	log.Level = args.LogLevel
+	if err := log.SetLevels(args.Log); err != nil {
+		argParser.Fail(err.Error())
+	}
+	if err := log.SetTargets(args.LogTo); err != nil {
+		argParser.Fail(err.Error())
+	}
+	log.Collected.SetLimit(args.WarnLimit)
+
+	samples, meta, err := wav.LoadDataChannel(args.Input)
+	if err != nil {
+		return err
+	}
+	rate, bits := meta.SampleRate, meta.BitDepth
+
+	start := int(args.Start * float64(rate))
+	end := start + int(args.Length*float64(rate))
+	if start >= len(samples) {
+		return fmt.Errorf("start is past the end of the input")
+	}
+	if end > len(samples) {
+		end = len(samples)
+	}
+	samples = samples[start:end]
+
+	type d = time.Duration
+	log.F(
+		1, "Tuning on: %v %v-bit samples at %v Hz = %v\n",
+		len(samples), bits, rate, d(len(samples))*time.Second/d(rate),
+	)
+
+	grid, err := tune.DefaultGrid(rate, bits)
+	if err != nil {
+		return exitcode.New(exitcode.Format, "%w", err)
+	}
+	grid.NoClean = args.NoClean
+
+	if args.Thresholds > 0 {
+		floors := tune.NoiseFloors(bits, args.Thresholds)
+		bw := mfm.ExpectedBitWidth(mfm.DefaultBitRate, rate)
+		return thresholds(samples, floors, bw, grid)
+	}
+
+	scores, err := sweep(samples, grid)
+	if err != nil {
+		return err
+	}
+
+	if args.Top > 0 && len(scores) > args.Top {
+		scores = scores[:args.Top]
+	}
+	for _, s := range scores {
+		fmt.Printf(
+			"noise floor %v, bit width %.2f, limits %v/%v/%v/%v:"+
+				" %v/%v blocks (%v bytes), %v/%v valid pulses (%.1f%%)\n",
+			s.NoiseFloor, s.BitWidth,
+			s.Limits.Tiny, s.Limits.Short, s.Limits.Medium, s.Limits.Long,
+			s.GoodBlocks, s.Blocks, s.Bytes, s.ValidPulses, s.Pulses,
+			s.ValidRatio()*100,
+		)
+	}
+
+	return nil
+}
+
+func outputMetrics() error {
+	if err := metrics.Default.Summary(log.Writer(2)); err != nil {
+		return err
+	}
+	if args.Metrics == "" {
+		return nil
+	}
+	return metrics.Default.SaveJSON(args.Metrics)
+}
+
+func sweep(samples []int, grid tune.Grid) ([]tune.Score, error) {
+	n := len(grid.NoiseFloors) * len(grid.BitWidths) * len(grid.Limits)
+	defer log.TimeStage(
+		1, "tune", len(samples)*n,
+		"Trying %v sets of settings...\n", n,
+	)("Tuning done in")
+
+	return tune.Sweep(context.Background(), samples, grid)
+}
+
+// thresholds shows how the edges, pulses and blocks change with the noise
+// floor, and which floor looks best.
+func thresholds(
+	samples []int, floors []int, bitWidth float64, grid tune.Grid,
+) error {
+	scores, err := func() ([]tune.Score, error) {
+		defer log.TimeStage(
+			1, "tune", len(samples)*len(floors),
+			"Trying %v noise floors...\n", len(floors),
+		)("Tuning done in")
+		return tune.Thresholds(
+			context.Background(), samples, floors, bitWidth, grid,
+		)
+	}()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(
+		tw, "noise floor\tedges\tpulses\tvalid %\tblocks\tgood\tbytes\t",
+	)
+	for _, s := range scores {
+		fmt.Fprintf(
+			tw, "%v\t%v\t%v\t%.1f\t%v\t%v\t%v\t\n",
+			s.NoiseFloor, s.Edges, s.Pulses, s.ValidRatio()*100,
+			s.Blocks, s.GoodBlocks, s.Bytes,
+		)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if len(scores) > 0 {
+		fmt.Println("Suggested noise floor:", tune.PickNoiseFloor(scores))
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/edorfaus/sb-mfm-decode/exitcode"
+	"github.com/edorfaus/sb-mfm-decode/manifest"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(exitcode.Of(err))
+	}
+}
+
+var args = struct {
+	Manifests []string `arg:"positional,required" help:"manifest files"`
+
+	Dir string `help:"resolve relative paths from here; default: by manifest"`
+}{}
+
+func run() error {
+	exitcode.MustParse(&args)
+
+	// Files that differ are a checksum failure, but if they all just could
+	// not be read, it is an I/O failure instead.
+	failed, code := 0, exitcode.IO
+	for _, fn := range args.Manifests {
+		m, err := manifest.Load(fn)
+		if err != nil {
+			return err
+		}
+
+		dir := args.Dir
+		if dir == "" {
+			dir = filepath.Dir(fn)
+		}
+		bad := m.Verify(dir)
+		for _, b := range bad {
+			fmt.Printf("%v: MISMATCH: %v\n", fn, b.Error())
+			if b.Err == nil {
+				code = exitcode.Checksum
+			}
+		}
+		if len(bad) > 0 {
+			failed++
+			continue
+		}
+		fmt.Printf(
+			"%v: OK (%v inputs, %v outputs; made by %v %v at %v)\n",
+			fn, len(m.Inputs), len(m.Outputs), m.Tool, m.Version,
+			m.Created.Format("2006-01-02 15:04:05 MST"),
+		)
+	}
+
+	if failed > 0 {
+		return exitcode.New(
+			code, "%v of %v manifests did not match",
+			failed, len(args.Manifests),
+		)
+	}
+	return nil
+}
@@ -6,47 +6,96 @@ import (
 	"sort"
 	"time"
 
-	"github.com/alexflint/go-arg"
-
+	"github.com/edorfaus/sb-mfm-decode/exitcode"
 	"github.com/edorfaus/sb-mfm-decode/filter"
 	"github.com/edorfaus/sb-mfm-decode/log"
+	"github.com/edorfaus/sb-mfm-decode/metrics"
 	"github.com/edorfaus/sb-mfm-decode/mfm"
+	"github.com/edorfaus/sb-mfm-decode/sample"
 	"github.com/edorfaus/sb-mfm-decode/wav"
 )
 
 func main() {
 	if err := run(); err != nil {
 		fmt.Fprintln(os.Stderr, "Error:", err)
-		os.Exit(1)
+		os.Exit(exitcode.Of(err))
 	}
 }
 
 var args = struct {
 	Stats  bool   `help:"print some statistics"`
-	Input  string `arg:"positional,required" help:"input wav file"`
+	Input  string `arg:"positional,required" help:"input wav or edge log"`
 	Output string `arg:"positional" help:"output wav file [out.wav]"`
 	// TODO: remove default value text from above help text, when go-arg
 	// is updated to a newer version with the fix for auto-printing it.
 
-	NoiseFloor      int `help:"noise floor; -1 means use 2% of max"`
-	MaxCrossingTime int `help:"max samples for 0-crossing before None"`
+	NoiseFloor      sample.Level `help:"noise floor, e.g. 655 or -34dB; -1 means use 2% of max"`
+	MaxCrossingTime int          `help:"max samples for 0-crossing before None"`
+
+	Normalize string  `help:"normalize the input first: peak or rms"`
+	Level     float64 `help:"level to normalize to; 0=default for the kind"`
 
 	NoClean bool `help:"do not clean the input signal first"`
+
+	EdgeLog    bool `help:"input is an edge log, as from zc-edges"`
+	SampleRate int  `help:"output sample rate, for an edge log input"`
+	BitDepth   int  `help:"output bit depth, for an edge log input"`
+
+	Log       string `help:"per-module log levels, e.g. 2,filter=3,mfm=1"`
+	LogTo     string `help:"log output per level, e.g. *=stderr,1=stdout"`
+	WarnLimit int    `help:"max warnings of each kind to show; 0=no limit"`
+	Metrics   string `help:"write timing metrics as JSON" placeholder:"FILE"`
 }{
 	Output: "out.wav",
 
-	NoiseFloor:      -1,
+	NoiseFloor:      sample.Level{Value: -1},
 	MaxCrossingTime: -1,
+	WarnLimit:       log.DefaultWarnLimit,
+
+	SampleRate: 44100,
+	BitDepth:   16,
 }
 
-func run() error {
-	arg.MustParse(&args)
+func run() (retErr error) {
+	defer log.WarnSummary()
+	defer func() {
+		if err := outputMetrics(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+
+	argParser := exitcode.MustParse(&args)
+	if err := log.SetLevels(args.Log); err != nil {
+		argParser.Fail(err.Error())
+	}
+	if err := log.SetTargets(args.LogTo); err != nil {
+		argParser.Fail(err.Error())
+	}
+	log.Collected.SetLimit(args.WarnLimit)
+	if args.EdgeLog && (args.SampleRate < 1 || args.BitDepth < 2) {
+		argParser.Fail("sample rate must be positive, bit depth at least 2")
+	}
+	norm, err := wav.ParseNormalizer(args.Normalize, args.Level)
+	if err != nil {
+		argParser.Fail(err.Error())
+	}
+
+	if args.EdgeLog {
+		return runEdgeLog()
+	}
 
 	samples, meta, err := wav.LoadDataChannel(args.Input)
 	if err != nil {
 		return err
 	}
 	rate, bits := meta.SampleRate, meta.BitDepth
+	if err := args.NoiseFloor.Check(bits); err != nil {
+		argParser.Fail(err.Error())
+	}
+	if norm != nil {
+		gain := norm.Normalize(samples, bits)
+		log.F(1, "Normalized to %v, gain %.3f\n", norm, gain)
+	}
 
 	type d = time.Duration
 	fmt.Printf(
@@ -73,6 +122,7 @@ func run() error {
 
 	start := time.Now()
 	output, err := processSamples(samples, rate, bits)
+	metrics.Add("edges", len(samples), time.Since(start))
 	fmt.Println("Processing done in", time.Since(start))
 	if err != nil {
 		return err
@@ -86,15 +136,54 @@ func run() error {
 	return nil
 }
 
+// runEdgeLog outputs the edges of an edge log instead of those detected
+// in a wav file, so that it does not need the original input.
+func runEdgeLog() error {
+	edges, err := mfm.LoadEdgeLog(args.Input)
+	if err != nil {
+		return err
+	}
+	rate, bits := args.SampleRate, args.BitDepth
+
+	type d = time.Duration
+	fmt.Printf(
+		"Input: %v edges in %v samples at %v Hz = %v\n",
+		len(edges.Edges), edges.Samples, rate,
+		d(edges.Samples)*time.Second/d(rate),
+	)
+
+	start := time.Now()
+	output, err := drawEdges(edges, edges.Samples, bits)
+	metrics.Add("edges", edges.Samples, time.Since(start))
+	fmt.Println("Processing done in", time.Since(start))
+	if err != nil {
+		return err
+	}
+
+	return wav.SaveMono(args.Output, rate, bits, output)
+}
+
+func outputMetrics() error {
+	if err := metrics.Default.Summary(log.Writer(2)); err != nil {
+		return err
+	}
+	if args.Metrics == "" {
+		return nil
+	}
+	return metrics.Default.SaveJSON(args.Metrics)
+}
+
 func getNoiseFloor(bits int) int {
-	if args.NoiseFloor >= 0 {
-		return args.NoiseFloor
+	if !args.NoiseFloor.Unset() {
+		return args.NoiseFloor.Samples(bits)
 	}
 	return filter.DefaultNoiseFloor(bits)
 }
 
 func cleanSamples(samples []int, rate, bits int) error {
-	defer log.Time(1, "Cleaning waveform...\n")("Cleaning done in")
+	defer log.TimeStage(
+		1, "clean", len(samples), "Cleaning waveform...\n",
+	)("Cleaning done in")
 
 	noiseFloor := getNoiseFloor(bits)
 	peakWidth := filter.MfmPeakWidth(mfm.DefaultBitRate, rate)
@@ -127,7 +216,14 @@ func processSamples(samples []int, rate, bits int) ([]int, error) {
 	)
 
 	// The output will have the same size as the input.
-	output := make([]int, len(samples))
+	return drawEdges(ed, len(samples), bits)
+}
+
+// drawEdges returns a square wave of the given length with the edges of
+// the given source, which is high after an edge to high, low after one to
+// low, and zero after one to none.
+func drawEdges(ed mfm.EdgeSource, length, bits int) ([]int, error) {
+	output := make([]int, length)
 
 	// For simplicity, put the high and low values at 1/2 max amplitude.
 	high := 1 << (bits - 2)
@@ -177,14 +273,25 @@ func processSamples(samples []int, rate, bits int) ([]int, error) {
 	for ed.Next() {
 		edges++
 
-		err := fill(ed.PrevType, ed.PrevIndex, ed.CurIndex)
-		if err != nil {
+		prev, cur := ed.Prev(), ed.Cur()
+		if err := fill(prev.Type, prev.Index, cur.Index); err != nil {
 			return nil, err
 		}
 	}
 
-	if err := fill(ed.PrevType, ed.PrevIndex, ed.CurIndex); err != nil {
-		return nil, err
+	// The edge detector ends with the end of the data as its current
+	// edge, while an edge list ends with its last edge, so the rest of the
+	// output is filled after whichever of those is not yet done.
+	prev, cur := ed.Prev(), ed.Cur()
+	if fillFrom < cur.Index {
+		if err := fill(prev.Type, prev.Index, cur.Index); err != nil {
+			return nil, err
+		}
+	}
+	if fillFrom < len(output) {
+		if err := fill(cur.Type, cur.Index, len(output)); err != nil {
+			return nil, err
+		}
 	}
 
 	if fillFrom != len(output) {
@@ -234,10 +341,3 @@ func processSamples(samples []int, rate, bits int) ([]int, error) {
 
 	return output, nil
 }
-
-func max(a, b int) int {
-	if a > b {
-		return a
-	}
-	return b
-}
@@ -5,16 +5,16 @@ import (
 	"os"
 	"time"
 
-	"github.com/alexflint/go-arg"
-
+	"github.com/edorfaus/sb-mfm-decode/exitcode"
 	"github.com/edorfaus/sb-mfm-decode/log"
+	"github.com/edorfaus/sb-mfm-decode/metrics"
 	"github.com/edorfaus/sb-mfm-decode/wav"
 )
 
 func main() {
 	if err := run(); err != nil {
 		fmt.Fprintln(os.Stderr, "Error:", err)
-		os.Exit(1)
+		os.Exit(exitcode.Of(err))
 	}
 }
 
@@ -23,12 +23,32 @@ var args = struct {
 	Output string `arg:"positional" help:"output wav file [out.wav]"`
 	// TODO: remove default value text from above help text, when go-arg
 	// is updated to a newer version with the fix for auto-printing it.
+
+	Log       string `help:"per-module log levels, e.g. 2,filter=3,mfm=1"`
+	LogTo     string `help:"log output per level, e.g. *=stderr,1=stdout"`
+	WarnLimit int    `help:"max warnings of each kind to show; 0=no limit"`
+	Metrics   string `help:"write timing metrics as JSON" placeholder:"FILE"`
 }{
-	Output: "out.wav",
+	Output:    "out.wav",
+	WarnLimit: log.DefaultWarnLimit,
 }
 
-func run() error {
-	arg.MustParse(&args)
+func run() (retErr error) {
+	defer log.WarnSummary()
+	defer func() {
+		if err := outputMetrics(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+
+	argParser := exitcode.MustParse(&args)
+	if err := log.SetLevels(args.Log); err != nil {
+		argParser.Fail(err.Error())
+	}
+	if err := log.SetTargets(args.LogTo); err != nil {
+		argParser.Fail(err.Error())
+	}
+	log.Collected.SetLimit(args.WarnLimit)
 
 	samples, meta, err := wav.LoadDataChannel(args.Input)
 	if err != nil {
@@ -45,7 +65,9 @@ func run() error {
 	il, ih := samples[0], samples[0]
 	ol, oh := il, ih
 	func() {
-		defer log.Time(1, "Calculating slope...")(" done in")
+		defer log.TimeStage(
+			1, "slope", len(samples), "Calculating slope...",
+		)(" done in")
 
 		prev := 0
 		for i := 0; i < len(samples); i++ {
@@ -88,3 +110,13 @@ func run() error {
 
 	return nil
 }
+
+func outputMetrics() error {
+	if err := metrics.Default.Summary(log.Writer(2)); err != nil {
+		return err
+	}
+	if args.Metrics == "" {
+		return nil
+	}
+	return metrics.Default.SaveJSON(args.Metrics)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"math"
@@ -8,18 +9,20 @@ import (
 	"sort"
 	"time"
 
-	"github.com/alexflint/go-arg"
-
+	"github.com/edorfaus/sb-mfm-decode/exitcode"
 	"github.com/edorfaus/sb-mfm-decode/filter"
 	"github.com/edorfaus/sb-mfm-decode/log"
+	"github.com/edorfaus/sb-mfm-decode/metrics"
 	"github.com/edorfaus/sb-mfm-decode/mfm"
+	"github.com/edorfaus/sb-mfm-decode/sample"
+	"github.com/edorfaus/sb-mfm-decode/schema"
 	"github.com/edorfaus/sb-mfm-decode/wav"
 )
 
 func main() {
 	if err := run(); err != nil {
 		fmt.Fprintln(os.Stderr, "Error:", err)
-		os.Exit(1)
+		os.Exit(exitcode.Of(err))
 	}
 }
 
@@ -27,24 +30,49 @@ var args = struct {
 	Input string `arg:"positional,required" help:"input wave file"`
 	Edges string `help:"output edges to this file" placeholder:"FILE"`
 	Stats string `help:"output some statistics" placeholder:"FILE"`
+	JSON  bool   `help:"output the statistics as JSON"`
+
+	NoiseFloor      sample.Level `help:"noise floor, e.g. 655 or -34dB; -1 means use 2% of max"`
+	MaxCrossingTime int          `help:"max samples for 0-crossing before None"`
 
-	NoiseFloor      int `help:"noise floor; -1 means use 2% of max"`
-	MaxCrossingTime int `help:"max samples for 0-crossing before None"`
+	NoClean  bool `help:"do not clean the input signal first"`
+	Weighted bool `help:"place edges by the slope between the peaks"`
 
-	NoClean bool `help:"do not clean the input signal first"`
+	Log       string `help:"per-module log levels, e.g. 2,filter=3,mfm=1"`
+	LogTo     string `help:"log output per level, e.g. *=stderr,1=stdout"`
+	WarnLimit int    `help:"max warnings of each kind to show; 0=no limit"`
+	Metrics   string `help:"write timing metrics as JSON" placeholder:"FILE"`
 }{
-	NoiseFloor:      -1,
+	NoiseFloor:      sample.Level{Value: -1},
 	MaxCrossingTime: -1,
+	WarnLimit:       log.DefaultWarnLimit,
 }
 
-func run() error {
-	arg.MustParse(&args)
+func run() (retErr error) {
+	defer log.WarnSummary()
+	defer func() {
+		if err := outputMetrics(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+
+	argParser := exitcode.MustParse(&args)
+	if err := log.SetLevels(args.Log); err != nil {
+		argParser.Fail(err.Error())
+	}
+	if err := log.SetTargets(args.LogTo); err != nil {
+		argParser.Fail(err.Error())
+	}
+	log.Collected.SetLimit(args.WarnLimit)
 
 	samples, meta, err := wav.LoadDataChannel(args.Input)
 	if err != nil {
 		return err
 	}
 	rate, bits := meta.SampleRate, meta.BitDepth
+	if err := args.NoiseFloor.Check(bits); err != nil {
+		argParser.Fail(err.Error())
+	}
 
 	type d = time.Duration
 	log.F(
@@ -74,6 +102,16 @@ func run() error {
 	return nil
 }
 
+func outputMetrics() error {
+	if err := metrics.Default.Summary(log.Writer(2)); err != nil {
+		return err
+	}
+	if args.Metrics == "" {
+		return nil
+	}
+	return metrics.Default.SaveJSON(args.Metrics)
+}
+
 func openOutput(fn string, retErr *error) (io.Writer, func()) {
 	if *retErr != nil || fn == "" {
 		return nil, func() {}
@@ -97,14 +135,16 @@ func openOutput(fn string, retErr *error) (io.Writer, func()) {
 }
 
 func getNoiseFloor(bits int) int {
-	if args.NoiseFloor >= 0 {
-		return args.NoiseFloor
+	if !args.NoiseFloor.Unset() {
+		return args.NoiseFloor.Samples(bits)
 	}
 	return filter.DefaultNoiseFloor(bits)
 }
 
 func cleanSamples(samples []int, rate, bits int) error {
-	defer log.Time(1, "Cleaning waveform...\n")("Cleaning done in")
+	defer log.TimeStage(
+		1, "clean", len(samples), "Cleaning waveform...\n",
+	)("Cleaning done in")
 
 	noiseFloor := getNoiseFloor(bits)
 	peakWidth := filter.MfmPeakWidth(mfm.DefaultBitRate, rate)
@@ -117,6 +157,7 @@ func cleanSamples(samples []int, rate, bits int) error {
 
 func initEdgeDetector(samples []int, rate, bits int) *mfm.EdgeDetect {
 	ed := mfm.NewEdgeDetect(samples, getNoiseFloor(bits))
+	ed.WeightedZero = args.Weighted
 
 	// If a max crossing time was given, use it as-is. Otherwise, we use
 	// the expected bit width as the max crossing time, which matches
@@ -137,7 +178,9 @@ func initEdgeDetector(samples []int, rate, bits int) *mfm.EdgeDetect {
 }
 
 func runEdges(ed *mfm.EdgeDetect, doStats bool) (s *Stats, e error) {
-	defer log.Time(1, "Processing edges...\n")("Processing done in")
+	defer log.TimeStage(
+		1, "edges", len(ed.Samples), "Processing edges...\n",
+	)("Processing done in")
 
 	var stats *Stats
 	if doStats {
@@ -150,13 +193,14 @@ func runEdges(ed *mfm.EdgeDetect, doStats bool) (s *Stats, e error) {
 	var esz, ssz, csz int
 	if outEdges != nil {
 		// Header line:
-		// Edge Type Sample 0-crossing Size Duration
+		// Edge Type Sample 0-crossing Size Duration Method
 		const (
 			hdrEdge      = "Edge"
 			hdrSample    = "Sample"
 			hdrZeroCross = "0-crossing"
 			hdrSize      = "Size"
 			hdrDuration  = "Duration"
+			hdrMethod    = "Method"
 		)
 
 		esz = max(len(fmt.Sprint((len(ed.Samples)+1)/2)), len(hdrEdge))
@@ -165,9 +209,9 @@ func runEdges(ed *mfm.EdgeDetect, doStats bool) (s *Stats, e error) {
 		ssz = max(max(ssz, len(hdrSample)), len(hdrSize))
 
 		_, err := fmt.Fprintf(
-			outEdges, "%*v Type %*v %*v %*v %*v\n",
+			outEdges, "%*v Type %*v %*v %*v %*v %v\n",
 			esz, hdrEdge, ssz, hdrSample, csz, hdrZeroCross,
-			ssz, hdrSize, csz, hdrDuration,
+			ssz, hdrSize, csz, hdrDuration, hdrMethod,
 		)
 		if err != nil {
 			return nil, err
@@ -180,10 +224,10 @@ func runEdges(ed *mfm.EdgeDetect, doStats bool) (s *Stats, e error) {
 
 		if outEdges != nil {
 			_, err := fmt.Fprintf(
-				outEdges, "%*v  %v-%v %*v %*.3f %*v %*.3f\n",
+				outEdges, "%*v  %v-%v %*v %*.3f %*v %*.3f %v\n",
 				esz, edges, ed.PrevType, ed.CurType, ssz, ed.CurIndex,
 				csz, ed.CurZero, ssz, ed.CurIndex-ed.PrevIndex,
-				csz, ed.CurZero-ed.PrevZero,
+				csz, ed.CurZero-ed.PrevZero, ed.CurMethod,
 			)
 			if err != nil {
 				return nil, err
@@ -199,10 +243,10 @@ func runEdges(ed *mfm.EdgeDetect, doStats bool) (s *Stats, e error) {
 
 	if outEdges != nil {
 		_, err := fmt.Fprintf(
-			outEdges, "%*v  %v-%v %*v %*.3f %*v %*.3f\n",
+			outEdges, "%*v  %v-%v %*v %*.3f %*v %*.3f %v\n",
 			esz, "End", ed.PrevType, ed.CurType, ssz, ed.CurIndex,
 			csz, ed.CurZero, ssz, ed.CurIndex-ed.PrevIndex,
-			csz, ed.CurZero-ed.PrevZero,
+			csz, ed.CurZero-ed.PrevZero, ed.CurMethod,
 		)
 		if err != nil {
 			return nil, err
@@ -221,6 +265,12 @@ func outputStats(stats *Stats, fn string) (retErr error) {
 		return retErr
 	}
 
+	if args.JSON {
+		enc := json.NewEncoder(outStats)
+		enc.SetIndent("", "  ")
+		return enc.Encode(stats.Schema())
+	}
+
 	if err := stats.Output(outStats); err != nil {
 		return err
 	}
@@ -299,6 +349,44 @@ func (s *Stats) AddEdge(ed *mfm.EdgeDetect) error {
 	return nil
 }
 
+// Schema returns the statistics in their machine-readable form.
+func (s *Stats) Schema() *schema.EdgeStats {
+	keys := make([]int, 0, len(s.durations))
+	for k := range s.durations {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+
+	res := schema.NewEdgeStats()
+	res.Groups = make([]schema.EdgeGroup, 0, len(keys))
+	d := &res.Distinct
+	for _, k := range keys {
+		g := s.durations[k]
+		res.Groups = append(res.Groups, schema.EdgeGroup{
+			Group: k,
+			EdgeCounts: schema.EdgeCounts{
+				High: g.High, Low: g.Low, None: g.None, Total: g.Count,
+			},
+			Min:      g.Min,
+			Max:      g.Max,
+			Mean:     g.Mean,
+			StDev:    g.StDev(),
+			Variance: g.Variance(),
+		})
+		if g.High > 0 {
+			d.High++
+		}
+		if g.Low > 0 {
+			d.Low++
+		}
+		if g.None > 0 {
+			d.None++
+		}
+	}
+	d.Total = len(keys)
+	return res
+}
+
 func (s *Stats) Output(out io.Writer) error {
 	durations := s.durations
 
@@ -390,10 +478,3 @@ func (s *Stats) Output(out io.Writer) error {
 
 	return nil
 }
-
-func max(a, b int) int {
-	if a > b {
-		return a
-	}
-	return b
-}
@@ -0,0 +1,132 @@
+package events
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Type is the type of a pipeline event.
+type Type string
+
+const (
+	// BlockStart is sent when the decoder starts on a new block.
+	BlockStart Type = "block_start"
+	// BlockEnd is sent when the decoder successfully ends a block.
+	BlockEnd Type = "block_end"
+	// BlockError is sent when the decoder fails to decode a block.
+	BlockError Type = "block_error"
+	// Anomaly is sent for pulses that could not be classified properly.
+	Anomaly Type = "anomaly"
+	// Resync is sent when the bit width is (re)established from a
+	// lead-in, after having been unknown.
+	Resync Type = "resync"
+	// Dropout is sent when the decoder bridges a dropout within a block,
+	// instead of ending the block there.
+	Dropout Type = "dropout"
+	// ChecksumFailure is sent by a pipeline Stream when the MFM of a
+	// block decoded, but its bytes did not (such as when they fail their
+	// integrity check), instead of BlockEnd.
+	ChecksumFailure Type = "checksum_failure"
+)
+
+// Event is a single pipeline event.
+type Event struct {
+	// The type of event.
+	Type Type `json:"type"`
+
+	// The time at which the event happened.
+	Time time.Time `json:"time"`
+
+	// The sample position where the event starts, and where it ends (if
+	// the event covers a range of samples, otherwise End is 0).
+	Pos float64 `json:"pos"`
+	End float64 `json:"end,omitempty"`
+
+	// The bit width (in samples) in use at the time of the event.
+	BitWidth float64 `json:"bit_width,omitempty"`
+
+	// The number of bits involved, e.g. the number of bits in a block.
+	Bits int `json:"bits,omitempty"`
+
+	// Details about the event, such as the pulse class or the error.
+	Detail string `json:"detail,omitempty"`
+}
+
+// Sink is something that receives pipeline events.
+type Sink interface {
+	Event(ev Event)
+}
+
+// Func is an adapter that allows using an ordinary function as a Sink.
+type Func func(ev Event)
+
+func (f Func) Event(ev Event) {
+	f(ev)
+}
+
+// Send sends the given event to the given sink, setting the time of the
+// event if it is not already set. It does nothing if the sink is nil.
+func Send(s Sink, ev Event) {
+	if s == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	s.Event(ev)
+}
+
+// JSONWriter is a Sink that writes each event as a line of JSON.
+//
+// It is safe for concurrent use. Since Sink has no way to return an
+// error, the first error that occurs is kept, and can be checked with
+// Err; after an error, further events are discarded.
+type JSONWriter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	err error
+}
+
+func NewJSONWriter(w io.Writer) *JSONWriter {
+	return &JSONWriter{
+		enc: json.NewEncoder(w),
+	}
+}
+
+func (w *JSONWriter) Event(ev Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err == nil {
+		w.err = w.enc.Encode(ev)
+	}
+}
+
+// Err returns the first error that occurred while writing events.
+func (w *JSONWriter) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.err
+}
+
+// CreateJSONFile creates the given file and returns a JSONWriter for it,
+// along with a function that closes the file, and returns the first
+// error that occurred while writing to it or closing it.
+func CreateJSONFile(filename string) (*JSONWriter, func() error, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	w := NewJSONWriter(f)
+	return w, func() error {
+		err := w.Err()
+		if cErr := f.Close(); err == nil {
+			err = cErr
+		}
+		return err
+	}, nil
+}
@@ -0,0 +1,67 @@
+package events
+
+// Observer receives the main pipeline events through a callback for each
+// kind, for applications that want to follow the decode (e.g. to drive a
+// UI or their own logging) while the pipeline runs the decode loop. Use
+// Observe to get a Sink that calls it.
+type Observer interface {
+	// OnBlockStart is called when the decoder starts on a new block.
+	OnBlockStart(ev Event)
+
+	// OnBlockEnd is called when a block has been decoded successfully.
+	// With a pipeline Stream, that is once its bytes have also been
+	// decoded and checked; if they fail, OnError is called instead.
+	OnBlockEnd(ev Event)
+
+	// OnError is called when a block fails to decode, either as MFM
+	// (BlockError) or in its data (ChecksumFailure).
+	OnError(ev Event)
+
+	// OnResync is called when the bit width has been found from a
+	// lead-in, after having been unknown.
+	OnResync(ev Event)
+}
+
+// Observe returns a Sink that calls the given observer for each event of
+// the kinds that it has callbacks for; other events are ignored.
+func Observe(o Observer) Sink {
+	return Func(func(ev Event) {
+		switch ev.Type {
+		case BlockStart:
+			o.OnBlockStart(ev)
+		case BlockEnd:
+			o.OnBlockEnd(ev)
+		case BlockError, ChecksumFailure:
+			o.OnError(ev)
+		case Resync:
+			o.OnResync(ev)
+		}
+	})
+}
+
+// Callbacks is an Observer that calls the given functions; any of them
+// may be nil, to ignore that kind of event.
+type Callbacks struct {
+	BlockStart, BlockEnd, Error, Resync func(ev Event)
+}
+
+func (c Callbacks) OnBlockStart(ev Event) { call(c.BlockStart, ev) }
+func (c Callbacks) OnBlockEnd(ev Event)   { call(c.BlockEnd, ev) }
+func (c Callbacks) OnError(ev Event)      { call(c.Error, ev) }
+func (c Callbacks) OnResync(ev Event)     { call(c.Resync, ev) }
+
+func call(fn func(ev Event), ev Event) {
+	if fn != nil {
+		fn(ev)
+	}
+}
+
+// Tee returns a Sink that sends each event to all of the given sinks, in
+// order; any of them may be nil.
+func Tee(sinks ...Sink) Sink {
+	return Func(func(ev Event) {
+		for _, s := range sinks {
+			Send(s, ev)
+		}
+	})
+}
@@ -0,0 +1,129 @@
+// Package exitcode defines the exit codes of the commands, by the category
+// of the error that made them fail, so that scripts can tell the kinds of
+// failure apart without parsing the error messages.
+package exitcode
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"syscall"
+
+	"github.com/alexflint/go-arg"
+
+	"github.com/edorfaus/sb-mfm-decode/sample"
+	"github.com/edorfaus/sb-mfm-decode/studybox"
+	"github.com/edorfaus/sb-mfm-decode/wav"
+)
+
+// The exit codes, by category.
+const (
+	// OK means that the command succeeded.
+	OK = 0
+	// Internal is for unexpected errors, and those of no other category.
+	Internal = 1
+	// Usage means that the command line arguments were bad.
+	Usage = 2
+	// IO means that a file could not be read or written.
+	IO = 3
+	// Format means that an input is not in a supported format, or is
+	// damaged (e.g. truncated).
+	Format = 4
+	// Decode means that some of the data could not be decoded, or that
+	// the input went past one of the safety limits of the decoding.
+	Decode = 5
+	// Checksum means that some of the data was decoded, but failed its
+	// integrity check; or that files did not match their checksums.
+	Checksum = 6
+	// Interrupted means that the command was stopped by ^C (SIGINT), as
+	// in the usual shell convention.
+	Interrupted = 130
+)
+
+// Error is an error with a given exit code.
+type Error struct {
+	Code int
+	Err  error
+}
+
+// New returns an error with the given exit code and message.
+func New(code int, format string, v ...any) error {
+	return &Error{Code: code, Err: fmt.Errorf(format, v...)}
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Of returns the exit code for the given error: the code of the first
+// Error in its chain, if any, or otherwise the code of its category.
+func Of(err error) int {
+	if err == nil {
+		return OK
+	}
+
+	var e *Error
+	var fe *wav.FormatError
+	var ce *studybox.CheckError
+	var le *sample.LimitError
+	var pe *fs.PathError
+	var errno syscall.Errno
+	switch {
+	case errors.As(err, &e):
+		return e.Code
+	case errors.As(err, &fe), errors.Is(err, io.ErrUnexpectedEOF):
+		return Format
+	case errors.As(err, &ce):
+		return Checksum
+	case errors.As(err, &le):
+		return Decode
+	case errors.As(err, &pe), errors.As(err, &errno):
+		return IO
+	}
+	return Internal
+}
+
+// FailedBlocks returns an error for the given errors of the blocks that
+// failed, out of the given total number of blocks, or nil if none did.
+// The code is Checksum if they all failed only their integrity check,
+// and Decode otherwise.
+func FailedBlocks(errs []error, total int) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	code := Checksum
+	for _, err := range errs {
+		var ce *studybox.CheckError
+		if !errors.As(err, &ce) {
+			code = Decode
+			break
+		}
+	}
+	return New(code, "%v of %v blocks failed to decode", len(errs), total)
+}
+
+// MustParse is like arg.MustParse, but it exits with the Usage code when
+// the arguments are bad, instead of -1 (which is 255).
+func MustParse(dest ...any) *arg.Parser {
+	cfg := arg.Config{Exit: exitUsage, Out: os.Stdout}
+	p, err := arg.NewParser(cfg, dest...)
+	if err != nil {
+		fmt.Fprintln(os.Stdout, err)
+		os.Exit(Internal)
+	}
+	p.MustParse(os.Args[1:])
+	return p
+}
+
+func exitUsage(code int) {
+	if code != OK {
+		code = Usage
+	}
+	os.Exit(code)
+}
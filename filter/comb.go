@@ -0,0 +1,165 @@
+package filter
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/edorfaus/sb-mfm-decode/log"
+	"github.com/edorfaus/sb-mfm-decode/sample"
+	"github.com/edorfaus/sb-mfm-decode/spectrum"
+)
+
+// DefaultCombWidth is the default width of the notches of the Comb
+// filter, in Hz, which is wide enough to allow for some error in the
+// frequency (and changes in it), and narrow enough to not noticeably
+// change the MFM signal.
+const DefaultCombWidth = 10
+
+// The frame size that periodic interference is detected with, the lowest
+// frequency that is considered, and how many times stronger than the
+// nearby frequencies it must be to be found.
+const (
+	detectFrame     = 4096
+	detectMinFreq   = 20
+	detectThreshold = 30
+)
+
+// Comb is a filter that removes a periodic interference from the samples,
+// such as leakage of the recorder's bias tone or the whine of a switching
+// power supply, with a narrow notch at its frequency and at each of its
+// harmonics up to the given number of them.
+//
+// Each notch works by fitting a sine wave of its frequency to the samples
+// around each sample, and subtracting it. This adapts to changes in the
+// strength and phase of the interference, does not shift the edges of the
+// signal, and works right up to the ends of the samples.
+type Comb struct {
+	SampleRate int
+
+	// The frequency of the interference, in Hz; if 0, it is detected from
+	// the quiet parts of the samples, as by DetectInterference, and the
+	// samples are left as they are if none is found.
+	Freq float64
+
+	// The number of harmonics to remove, including the fundamental; if 0,
+	// only the fundamental is removed.
+	Harmonics int
+
+	// The width of each notch, in Hz; if 0, DefaultCombWidth is used.
+	Width float64
+
+	// The noise floor, for finding the quiet parts when detecting the
+	// frequency.
+	NoiseFloor int
+
+	// Log is the logger to use; if nil, the package logger is used.
+	Log *log.Logger
+}
+
+func NewComb(sampleRate int, freq float64) *Comb {
+	return &Comb{SampleRate: sampleRate, Freq: freq}
+}
+
+// Run filters the input into the output, which may be the same slice.
+func (f *Comb) Run(input, output []int) error {
+	if len(output) < len(input) {
+		return fmt.Errorf("output cannot be shorter than input")
+	}
+	if f.SampleRate <= 0 {
+		return fmt.Errorf("bad sample rate: %v", f.SampleRate)
+	}
+
+	freq := f.Freq
+	if freq == 0 {
+		freq = DetectInterference(input, f.SampleRate, f.NoiseFloor)
+		if freq == 0 {
+			f.log().Ln(2, "Comb: no periodic interference found")
+			copy(output, input)
+			return nil
+		}
+		f.log().F(2, "Comb: found interference at %.2f Hz\n", freq)
+	}
+	harmonics, width := max(f.Harmonics, 1), f.Width
+	if width <= 0 {
+		width = DefaultCombWidth
+	}
+
+	// Each fit is over about one period of the width, which makes the
+	// notches about that wide.
+	window := int(float64(f.SampleRate)/width + 0.5)
+	fit := make([]float64, len(input))
+	for h := 1; h <= harmonics; h++ {
+		hf := freq * float64(h)
+		if hf >= float64(f.SampleRate)/2 {
+			break
+		}
+		fitSine(input, fit, 2*math.Pi*hf/float64(f.SampleRate), window)
+	}
+	for i, v := range input {
+		output[i] = sample.Clamp[int](int(math.Round(float64(v) - fit[i])))
+	}
+	return nil
+}
+
+func (f *Comb) log() *log.Logger {
+	if f.Log != nil {
+		return f.Log
+	}
+	return logger
+}
+
+// fitSine adds to fit the sine wave of the given angular frequency (in
+// radians per sample) that best fits the samples in the window around
+// each sample (less what is already in fit), by least squares.
+func fitSine(samples []int, fit []float64, w float64, window int) {
+	// Prefix sums of the products that the least squares fit needs, for
+	// the sine and cosine of the frequency (s and c) and the residue (x).
+	type sums struct{ xc, xs, cc, ss, cs float64 }
+	prefix := make([]sums, len(samples)+1)
+	for i, v := range samples {
+		x := float64(v) - fit[i]
+		sin, cos := math.Sincos(w * float64(i))
+		p := prefix[i]
+		prefix[i+1] = sums{
+			p.xc + x*cos, p.xs + x*sin, p.cc + cos*cos, p.ss + sin*sin,
+			p.cs + cos*sin,
+		}
+	}
+
+	for i := range samples {
+		from := max(i-window/2, 0)
+		to := min(i+window/2+1, len(samples))
+		a, b := prefix[to], prefix[from]
+		xc, xs := a.xc-b.xc, a.xs-b.xs
+		cc, ss, cs := a.cc-b.cc, a.ss-b.ss, a.cs-b.cs
+
+		det := cc*ss - cs*cs
+		if det <= 1e-9 {
+			continue
+		}
+		ampC, ampS := (xc*ss-xs*cs)/det, (xs*cc-xc*cs)/det
+		sin, cos := math.Sincos(w * float64(i))
+		fit[i] += ampC*cos + ampS*sin
+	}
+}
+
+// DetectInterference returns the frequency of the strongest periodic
+// interference in the quiet parts of the given samples (as found by the
+// noise floor), or 0 if there is none: a frequency that is much stronger
+// than those near it, which the tape noise is not.
+func DetectInterference(samples []int, sampleRate, noiseFloor int) float64 {
+	quiet := quietFrames(samples, detectFrame, noiseFloor)
+	p := spectrum.MeasurePower(
+		samples, sampleRate, detectFrame, func(i int) bool { return quiet[i] },
+	)
+	if p.Frames < minNoiseFrames {
+		// Too few to tell a line from the randomness of the noise.
+		return 0
+	}
+
+	freq, prominence := p.Line(detectMinFreq, float64(sampleRate)/2)
+	if prominence < detectThreshold {
+		return 0
+	}
+	return freq
+}
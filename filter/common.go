@@ -1,40 +1,64 @@
 package filter
 
 import (
+	"fmt"
+
 	"golang.org/x/exp/slices"
+
+	"github.com/edorfaus/sb-mfm-decode/log"
+	"github.com/edorfaus/sb-mfm-decode/sample"
 )
 
+// logger is the logger used by this package.
+var logger = log.Named("filter")
+
 func DefaultNoiseFloor(bits int) int {
 	maxValue := 1 << (bits - 1)
 	return maxValue * 2 / 100
 }
 
+// MfmPeakWidth returns the peak width for the DC offset filter for the
+// given MFM bit rate and sample rate. It panics if the rates are not
+// valid; PeakWidthFor is the same, but returns an error instead.
 func MfmPeakWidth(mfmBitRate, sampleRate int) int {
-	// ceil(sampleRate / mfmBitRate)
-	return (sampleRate + mfmBitRate - 1) / mfmBitRate
+	peakWidth, err := PeakWidthFor(mfmBitRate, sampleRate)
+	if err != nil {
+		panic(err)
+	}
+	return peakWidth
 }
 
-func lowHigh(v []int) (low, high int) {
-	return slices.Min(v), slices.Max(v)
+// PeakWidthFor returns the peak width for the DC offset filter for the
+// given MFM bit rate and sample rate, or an error if they are not valid.
+func PeakWidthFor(mfmBitRate, sampleRate int) (int, error) {
+	if mfmBitRate <= 0 {
+		return 0, fmt.Errorf("invalid MFM bit rate: %v", mfmBitRate)
+	}
+	if sampleRate <= 0 {
+		return 0, fmt.Errorf("invalid sample rate: %v", sampleRate)
+	}
+	// ceil(sampleRate / mfmBitRate)
+	return (sampleRate + mfmBitRate - 1) / mfmBitRate, nil
 }
 
-func abs(v int) int {
-	if v < 0 {
-		return -v
-	}
-	return v
+func lowHigh[S sample.Type](v []S) (low, high int) {
+	return int(slices.Min(v)), int(slices.Max(v))
 }
 
-func min(a, b int) int {
-	if a < b {
-		return a
+// isDone reports whether the given done channel of a context has been
+// closed, without blocking. A nil channel (never done) is allowed.
+func isDone(done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
 	}
-	return b
 }
 
-func max(a, b int) int {
-	if a > b {
-		return a
+func abs(v int) int {
+	if v < 0 {
+		return -v
 	}
-	return b
+	return v
 }
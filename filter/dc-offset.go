@@ -1,39 +1,92 @@
 package filter
 
 import (
+	"context"
 	"fmt"
+	"math"
 
 	"github.com/edorfaus/sb-mfm-decode/log"
+	"github.com/edorfaus/sb-mfm-decode/progress"
+	"github.com/edorfaus/sb-mfm-decode/sample"
 )
 
-type DCOffset struct {
+// DCOffset is a DCOffsetOf that works on int samples.
+type DCOffset = DCOffsetOf[int]
+
+// DCOffsetOf is a filter that removes the DC offset from the samples,
+// along with some of the noise that is between the peaks of the signal.
+// The S type parameter is the type used for the samples.
+type DCOffsetOf[S sample.Type] struct {
 	NoiseFloor int
 	PeakWidth  int
 
-	data   []int
+	// NoiseProfile, if not empty, gives the noise floor at each sample,
+	// and is then used instead of NoiseFloor.
+	NoiseProfile sample.NoiseProfile
+
+	// Curve, if not empty, is subtracted from the samples as their DC
+	// offset, instead of estimating it from the peaks. No noise is then
+	// removed, so the noise floor and peak width are not used.
+	Curve OffsetCurve
+
+	// MaxPeakWidths is the longest that a single peak can be, in peak
+	// widths, before the input is taken to be damaged, failing with a
+	// sample.LimitError; if 0, there is no limit.
+	MaxPeakWidths int
+
+	// Log is the logger to use; if nil, the package logger is used.
+	Log *log.Logger
+
+	data   []S
 	offset int
-	out    []int
+	out    []S
 	pos    int
 
+	// The offset of each sample, and the groups of peaks, which are only
+	// kept (when not nil) for Segment.
+	offsets []int
+	groups  []PeakGroup
+
 	// noiseLevel is the level at which samples go from noise to data.
-	// It is set to either NoiseFloor or a value calculated from nearby
-	// peaks, whichever is higher at that point.
+	// It is set to either the noise floor or a value calculated from
+	// nearby peaks, whichever is higher at that point.
 	noiseLevel int
+
+	progress progress.Reporter
 }
 
 func NewDCOffset(noiseFloor, peakWidth int) *DCOffset {
-	return &DCOffset{
+	return NewDCOffsetOf[int](noiseFloor, peakWidth)
+}
+
+func NewDCOffsetOf[S sample.Type](noiseFloor, peakWidth int) *DCOffsetOf[S] {
+	return &DCOffsetOf[S]{
 		NoiseFloor: noiseFloor,
 		PeakWidth:  peakWidth,
 		noiseLevel: noiseFloor,
 	}
 }
 
-func (f *DCOffset) Run(input, output []int) error {
+// SetProgressFunc sets a function that Run will call to report on its
+// progress, after every given number of samples (roughly; it is called
+// between peaks, so it may be a little later than that).
+func (f *DCOffsetOf[S]) SetProgressFunc(every int, fn progress.Func) {
+	f.progress.Set(every, fn)
+}
+
+func (f *DCOffsetOf[S]) Run(input, output []S) error {
+	return f.RunContext(context.Background(), input, output)
+}
+
+// RunContext is like Run, but it stops early (returning the context's
+// error) if the context is cancelled; the output is then incomplete.
+func (f *DCOffsetOf[S]) RunContext(
+	ctx context.Context, input, output []S,
+) error {
 	if f.PeakWidth <= 0 {
 		f.PeakWidth = 48000 / 4800
 	}
-	f.noiseLevel = f.NoiseFloor
+	f.noiseLevel = f.floorAt(0)
 
 	if len(output) < len(input) {
 		return fmt.Errorf("output cannot be shorter than input")
@@ -47,7 +100,23 @@ func (f *DCOffset) Run(input, output []int) error {
 	f.offset = 0
 	f.out = output
 	f.pos = 0
+	if len(f.Curve) > 0 {
+		return f.subtractCurve(ctx)
+	}
+	return f.detect(ctx)
+}
+
+// detect runs the detection of the peaks and their DC offset over the
+// data, applying the offsets to the output (if any) as it goes, and
+// keeping them along with the groups of peaks (if they are being kept).
+func (f *DCOffsetOf[S]) detect(ctx context.Context) error {
+	done := ctx.Done()
 	for f.pos < len(f.data) {
+		if isDone(done) {
+			return ctx.Err()
+		}
+		f.progress.Update(f.pos, len(f.data))
+
 		// Initial state: we're at the start of the leading noise
 		f.leadingNoise()
 		if f.pos >= len(f.data) {
@@ -71,31 +140,202 @@ func (f *DCOffset) Run(input, output []int) error {
 		// the next peak in that sequence (including the last peak).
 
 		for f.outsideNoise(f.pos) {
+			if isDone(done) {
+				return ctx.Err()
+			}
 			if err := f.nextPeak(); err != nil {
 				return fmt.Errorf("nextPeak: %w", err)
 			}
+			f.progress.Update(f.pos, len(f.data))
+		}
+	}
+
+	f.progress.Done(len(f.data))
+
+	return nil
+}
+
+// PeakGroup is a group of peaks that the DC offset filter found, with no
+// more than a peak width of noise between them, such as a block of data.
+type PeakGroup struct {
+	// The index of the first sample of the group, and the index just
+	// after its last one.
+	Start, End int
+
+	// The number of peaks in the group.
+	Peaks int
+}
+
+// Segmentation is the result of the detection pass of the DC offset
+// filter, as done by Segment: the groups of peaks that it found, and the
+// DC offset that it found for each sample, as an offset curve.
+//
+// Subtracting the offsets from the input, as by ApplyOffsets, gives the
+// same output as running the filter, so the detection results can be
+// looked at (or changed) before they are applied.
+type Segmentation struct {
+	Groups  []PeakGroup
+	Offsets OffsetCurve
+}
+
+// Segment runs only the detection pass of the filter over the input,
+// returning the groups of peaks and the offsets that it found, instead of
+// applying them. If the filter has a Curve, that is returned as it is, as
+// there is nothing to detect.
+//
+// This keeps the offset of each sample while it runs, so it takes as much
+// memory as an []int of the length of the input.
+func (f *DCOffsetOf[S]) Segment(input []S) (*Segmentation, error) {
+	return f.SegmentContext(context.Background(), input)
+}
+
+// SegmentContext is like Segment, but it stops early (returning the
+// context's error) if the context is cancelled.
+func (f *DCOffsetOf[S]) SegmentContext(
+	ctx context.Context, input []S,
+) (*Segmentation, error) {
+	if len(f.Curve) > 0 {
+		return &Segmentation{Offsets: f.Curve}, nil
+	}
+	if f.PeakWidth <= 0 {
+		f.PeakWidth = 48000 / 4800
+	}
+	f.noiseLevel = f.floorAt(0)
+
+	defer func() {
+		f.data, f.offsets, f.groups = nil, nil, nil
+	}()
+
+	f.data = input
+	f.offset = 0
+	f.out = nil
+	f.pos = 0
+	f.offsets = make([]int, len(input))
+	f.groups = []PeakGroup{}
+	if err := f.detect(ctx); err != nil {
+		return nil, err
+	}
+	return &Segmentation{
+		Groups:  f.groups,
+		Offsets: OffsetCurveOf(f.offsets),
+	}, nil
+}
+
+// ApplyOffsets is the application pass of the DC offset filter: it
+// subtracts the given offsets (e.g. those of a Segmentation) from the
+// input into the output, which may be the same slice.
+func ApplyOffsets[S sample.Type](c OffsetCurve, input, output []S) error {
+	return ApplyOffsetsContext(context.Background(), c, input, output)
+}
+
+// ApplyOffsetsContext is like ApplyOffsets, but it stops early (returning
+// the context's error) if the context is cancelled.
+func ApplyOffsetsContext[S sample.Type](
+	ctx context.Context, c OffsetCurve, input, output []S,
+) error {
+	f := &DCOffsetOf[S]{Curve: c}
+	return f.RunContext(ctx, input, output)
+}
+
+// put applies the given offset to the sample at the given index, keeping
+// the offset if the offsets are being kept.
+func (f *DCOffsetOf[S]) put(pos, offset int) {
+	if f.out != nil {
+		f.out[pos] = sample.Clamp[S](int(f.data[pos]) - offset)
+	}
+	if f.offsets != nil {
+		f.offsets[pos] = offset
+	}
+}
+
+// beginGroup starts a new group of peaks at the given index, with one
+// peak, if the groups are being kept.
+func (f *DCOffsetOf[S]) beginGroup(start int) {
+	if f.groups != nil {
+		f.groups = append(f.groups, PeakGroup{Start: start, Peaks: 1})
+	}
+}
+
+// addPeak adds a peak to the current group of peaks.
+func (f *DCOffsetOf[S]) addPeak() {
+	if n := len(f.groups); n > 0 {
+		f.groups[n-1].Peaks++
+	}
+}
+
+// endGroup ends the current group of peaks just before the given index.
+func (f *DCOffsetOf[S]) endGroup(end int) {
+	if n := len(f.groups); n > 0 {
+		f.groups[n-1].End = end
+	}
+}
+
+// curveChunk is the number of samples that subtractCurve handles between
+// checking if it should stop and reporting its progress.
+const curveChunk = 64 * 1024
+
+// subtractCurve subtracts the offset curve from the data, instead of the
+// estimated offset, stopping early if the context is cancelled.
+func (f *DCOffsetOf[S]) subtractCurve(ctx context.Context) error {
+	done := ctx.Done()
+	c := f.Curve
+	n := c.after(f.pos)
+	for f.pos < len(f.data) {
+		if isDone(done) {
+			return ctx.Err()
+		}
+		f.progress.Update(f.pos, len(f.data))
+
+		end := min(f.pos+curveChunk, len(f.data))
+		for ; f.pos < end; f.pos++ {
+			for n < len(c) && c[n].Index <= f.pos {
+				n++
+			}
+			offset := c.at(n, f.pos)
+			f.out[f.pos] = sample.Clamp[S](int(f.data[f.pos]) - offset)
 		}
 	}
 
+	f.progress.Done(len(f.data))
+
 	return nil
 }
 
-func (f *DCOffset) outsideNoise(pos int) bool {
+func (f *DCOffsetOf[S]) log() *log.Logger {
+	if f.Log != nil {
+		return f.Log
+	}
+	return logger
+}
+
+// floorAt returns the noise floor at the given sample index.
+func (f *DCOffsetOf[S]) floorAt(pos int) int {
+	if len(f.NoiseProfile) == 0 {
+		return f.NoiseFloor
+	}
+	return f.NoiseProfile.At(pos)
+}
+
+func (f *DCOffsetOf[S]) outsideNoise(pos int) bool {
 	data := f.data
-	return pos < len(data) && abs(data[pos]-f.offset) > f.noiseLevel
+	return pos < len(data) && abs(int(data[pos])-f.offset) > f.noiseLevel
 }
 
-func (f *DCOffset) withinNoise(pos int) bool {
+func (f *DCOffsetOf[S]) withinNoise(pos int) bool {
 	data := f.data
-	return pos < len(data) && abs(data[pos]-f.offset) <= f.noiseLevel
+	return pos < len(data) && abs(int(data[pos])-f.offset) <= f.noiseLevel
 }
 
 // Move past the leading noise in the data, while adjusting the offset.
-func (f *DCOffset) leadingNoise() {
-	pw, nf, nl, data := f.PeakWidth, f.NoiseFloor, f.noiseLevel, f.data
-	out, pos, offset := f.out, f.pos, f.offset
+func (f *DCOffsetOf[S]) leadingNoise() {
+	pw, nl, data := f.PeakWidth, f.noiseLevel, f.data
+	pos, offset := f.pos, f.offset
 
 	for pos < len(data) {
+		// The noise floor can rise here, if it follows a profile.
+		nf := f.floorAt(pos)
+		nl = max(nl, nf)
+
 		to := min(pos+pw, len(data))
 		lo, hi := lowHigh(data[pos:to])
 		dlo, dhi := abs(lo-offset), abs(hi-offset)
@@ -118,7 +358,7 @@ func (f *DCOffset) leadingNoise() {
 		// No peak here, just noise, so adjust the offset by averaging
 		// the old value with the new middle-point.
 		offset = (offset + ((lo + hi) / 2)) / 2
-		out[pos] = data[pos] - offset
+		f.put(pos, offset)
 		pos++
 	}
 
@@ -131,7 +371,7 @@ func (f *DCOffset) leadingNoise() {
 // If this is a lone peak, the position will be left in the noise after,
 // or at the end of the data if the peak goes that far.
 // Otherwise, the position will be left at the tip of the peak.
-func (f *DCOffset) firstPeak() error {
+func (f *DCOffsetOf[S]) firstPeak() error {
 	// This is only called with at most one peak-width of noise before
 	// the peak starts. This peak is likely to mark a boundary where the
 	// DC offset significantly changes, so look for the peak before
@@ -145,19 +385,21 @@ func (f *DCOffset) firstPeak() error {
 	}
 
 	peak := f.findPeakAt(start)
-	log.F(3, "First peak: %+v\n", peak)
+	f.log().F(3, "First peak: %+v\n", peak)
+	f.beginGroup(start)
 
 	if peak.End < 0 {
-		//log.Warn("peak too long at", start)
+		//f.log().WarnAt(start, "peak too long")
 		// TODO: handle this, e.g. by re-doing with new offset based on
 		// the min/max of the following area (longer than peak width).
-		return fmt.Errorf("peak too long at %v", start)
+		return f.peakLimit(start)
 	}
 	if peak.Next >= len(data) {
 		// This is a single peak that runs to the end of the data.
 		// There's not much we can do here, so just apply the offset.
-		log.Warn("single peak to end detected at", start)
+		f.log().WarnAt(start, "single peak to end detected")
 		f.applyOffsetUntil(len(data))
+		f.endGroup(len(data))
 		return nil
 	}
 	if f.withinNoise(peak.Next) {
@@ -165,7 +407,7 @@ func (f *DCOffset) firstPeak() error {
 		// We don't want this lone peak to skew the offset too much, so
 		// we instead find the offset of the noise after the peak, and
 		// apply the average of that and the current offset.
-		log.Warn("single peak detected at", start)
+		f.log().WarnAt(start, "single peak detected")
 		// TODO: should we adjust the noiseLevel here? it might affect
 		// whether there's a next peak detected, so we might have to
 		// re-do the peak?
@@ -175,6 +417,7 @@ func (f *DCOffset) firstPeak() error {
 		peakOffset := (f.offset + nextOffset) / 2
 		f.handleLeadingEdge(peak, peakOffset)
 		f.handleTrailingEdge(peak, nextOffset)
+		f.endGroup(peak.End + 1)
 		return nil
 	}
 
@@ -184,18 +427,18 @@ func (f *DCOffset) firstPeak() error {
 	nextOffset := f.offset
 
 	nextPeak := f.findPeakAt(peak.Next)
-	log.F(3, "Second peak: %+v\n", nextPeak)
+	f.log().F(3, "Second peak: %+v\n", nextPeak)
 
 	if nextPeak.End < 0 {
-		//log.Warn("next peak too long at", nextPeak.Start)
+		//f.log().WarnAt(nextPeak.Start, "next peak too long")
 		// TODO: handle this somehow?
-		return fmt.Errorf("next peak too long at %v", nextPeak.Start)
+		return fmt.Errorf("next peak: %w", f.peakLimit(nextPeak.Start))
 	}
 	if nextPeak.Next >= len(data) {
 		// This peak went off the end of the data, so we might not have
 		// found its tip. Without that, the new offset would be wrong.
 		// There's not much we can do here, so just keep the old offset.
-		log.Warn("peak runs off end of data at", start)
+		f.log().WarnAt(start, "peak runs off end of data")
 	} else {
 		nextOffset = (peak.Value + nextPeak.Value) / 2
 
@@ -210,19 +453,19 @@ func (f *DCOffset) firstPeak() error {
 // This applies the offset to the leading edge of the given peak, while
 // ensuring that doing so does not create an artificial inverse peak.
 // This is only intended to be used for the first peak in a group.
-func (f *DCOffset) handleLeadingEdge(peak Peak, peakOffset int) {
-	data, out := f.data, f.out
+func (f *DCOffsetOf[S]) handleLeadingEdge(peak Peak, peakOffset int) {
+	data := f.data
 
 	// This works backwards, to properly detect the first zero crossing.
 	// Apply the offset until the start, or until the data crosses zero.
 	peakSign := data[peak.Index] < 0
 	pos := peak.Index - 1
 	for pos >= peak.Start {
-		v := data[pos] - peakOffset
+		v := int(data[pos]) - peakOffset
 		if (v < 0) != peakSign {
 			break
 		}
-		out[pos] = v
+		f.put(pos, peakOffset)
 		pos--
 	}
 
@@ -232,8 +475,8 @@ func (f *DCOffset) handleLeadingEdge(peak Peak, peakOffset int) {
 	// to move closer to the earlier offset, but still within noise.
 	offset := peakOffset
 	for pos >= f.pos {
-		offset = f.clampToNoise(offset, data[pos])
-		out[pos] = data[pos] - offset
+		offset = f.clampToNoise(offset, int(data[pos]), pos)
+		f.put(pos, offset)
 		pos--
 		// Move the offset closer to the earlier offset.
 		offset = (offset + f.offset) / 2
@@ -247,17 +490,17 @@ func (f *DCOffset) handleLeadingEdge(peak Peak, peakOffset int) {
 // ensuring that doing so does not create an artificial inverse peak.
 // This is only intended to be used for the last peak in a group, and
 // expects that the current position is at the tip of that peak.
-func (f *DCOffset) handleTrailingEdge(peak Peak, nextOffset int) {
-	data, out, offset, pos := f.data, f.out, f.offset, f.pos
+func (f *DCOffsetOf[S]) handleTrailingEdge(peak Peak, nextOffset int) {
+	data, offset, pos := f.data, f.offset, f.pos
 
 	// Apply the offset until the end, or until the data crosses zero.
 	peakSign := data[peak.Index] < 0
 	for pos <= peak.End {
-		v := data[pos] - offset
+		v := int(data[pos]) - offset
 		if (v < 0) != peakSign {
 			break
 		}
-		out[pos] = v
+		f.put(pos, offset)
 		pos++
 	}
 
@@ -266,8 +509,8 @@ func (f *DCOffset) handleTrailingEdge(peak Peak, nextOffset int) {
 	// crossing point as close to correct as possible. The rest we try
 	// to move closer to the target offset, but still within noise.
 	for pos < peak.Next {
-		offset = f.clampToNoise(offset, data[pos])
-		out[pos] = data[pos] - offset
+		offset = f.clampToNoise(offset, int(data[pos]), pos)
+		f.put(pos, offset)
 		pos++
 		// Move the offset closer to the next offset.
 		offset = (offset + nextOffset) / 2
@@ -277,11 +520,12 @@ func (f *DCOffset) handleTrailingEdge(peak Peak, nextOffset int) {
 	f.pos = pos
 }
 
-// clampToNoise clamps the given offset such that the given sample would
-// be within the noise. If it already is, the offset is returned as-is.
-func (f *DCOffset) clampToNoise(offset, val int) int {
-	// Note: this purposely uses NoiseFloor instead of noiseLevel.
-	nf := f.NoiseFloor
+// clampToNoise clamps the given offset such that the given sample (at the
+// given index) would be within the noise. If it already is, the offset is
+// returned as-is.
+func (f *DCOffsetOf[S]) clampToNoise(offset, val, pos int) int {
+	// Note: this purposely uses the noise floor instead of noiseLevel.
+	nf := f.floorAt(pos)
 	if val-offset > nf {
 		// we want v-ofs = nf => v = nf+ofs => v-nf = ofs
 		return val - nf
@@ -297,7 +541,7 @@ func (f *DCOffset) clampToNoise(offset, val int) int {
 // This expects to be called with f.pos at the tip of the previous peak,
 // and will leave f.pos at the tip of the next peak (if there is one),
 // or in the noise after the peak if it was the last one.
-func (f *DCOffset) nextPeak() error {
+func (f *DCOffsetOf[S]) nextPeak() error {
 	pw, data := f.PeakWidth, f.data
 
 	// Find the end of the previous peak, and the start of the current.
@@ -305,16 +549,17 @@ func (f *DCOffset) nextPeak() error {
 	// on later repetitions it might not, if the previously current peak
 	// was the last one in this sequence.
 	prev := f.findPeakAt(f.pos)
-	log.F(4, "Previous peak: %+v\n", prev)
+	f.log().F(4, "Previous peak: %+v\n", prev)
 	if prev.End < 0 {
 		// TODO: handle this somehow? (I'm not sure it can happen)
-		return fmt.Errorf("previous peak too long at %v", prev.Start)
+		return fmt.Errorf("previous peak: %w", f.peakLimit(prev.Start))
 	}
 	if prev.Next >= len(data) {
 		// This peak went off the end of the data.
 		// There's not much we can do here, so just apply the offset.
-		log.Warn("peak runs off end of data at", prev.Start)
+		f.log().WarnAt(prev.Start, "peak runs off end of data")
 		f.applyOffsetUntil(len(data))
+		f.endGroup(len(data))
 		return nil
 	}
 	if f.withinNoise(prev.Next) {
@@ -323,21 +568,24 @@ func (f *DCOffset) nextPeak() error {
 		lo, hi := lowHigh(data[prev.Next:to])
 		nextOffset := (lo + hi) / 2
 		f.handleTrailingEdge(prev, nextOffset)
+		f.endGroup(prev.End + 1)
 		return nil
 	}
 
 	// We have a current peak, so find its details, and look for a next.
 	cur := f.findPeakAt(prev.Next)
-	log.F(4, "Current peak: %+v\n", cur)
+	f.log().F(4, "Current peak: %+v\n", cur)
 	if cur.End < 0 {
 		// TODO: handle this somehow?
-		return fmt.Errorf("current peak too long at %v", cur.Start)
+		return fmt.Errorf("current peak: %w", f.peakLimit(cur.Start))
 	}
+	f.addPeak()
 	if cur.Next >= len(data) {
 		// This peak went off the end of the data.
 		// There's not much we can do here, so just apply the offset.
-		log.Warn("peak runs off end of data at", prev.Start)
+		f.log().WarnAt(prev.Start, "peak runs off end of data")
 		f.applyOffsetUntil(len(data))
+		f.endGroup(len(data))
 		return nil
 	}
 
@@ -352,11 +600,10 @@ func (f *DCOffset) nextPeak() error {
 		// be the same polarity as the previous peak. To smooth things
 		// out a little, average its value with the previous peak.
 		next := f.findPeakAt(cur.Next)
-		log.F(4, "Next peak: %+v\n", next)
+		f.log().F(4, "Next peak: %+v\n", next)
 		if next.End < 0 {
 			// TODO: handle this somehow?
-			err := fmt.Errorf("next peak too long at %v", next.Start)
-			return err
+			return fmt.Errorf("next peak: %w", f.peakLimit(next.Start))
 		}
 		// If the peak goes off the end of the data, we can't really use
 		// it safely, so just ignore it. Otherwise, add in its value.
@@ -376,19 +623,19 @@ func (f *DCOffset) nextPeak() error {
 	return nil
 }
 
-func (f *DCOffset) updateNoiseLevel(offset, tip1, tip2 int) {
+func (f *DCOffsetOf[S]) updateNoiseLevel(offset, tip1, tip2 int) {
 	// The peak tips should be equally far from the offset, under normal
 	// conditions, but if the offset is done differently, or the integer
 	// math interferes, they might not be. Therefore, use the smaller of
 	// the two to calculate the noise level.
 	tipLevel := min(abs(tip1-offset), abs(tip2-offset))
-	f.noiseLevel = max(f.NoiseFloor, tipLevel/10)
+	f.noiseLevel = max(f.floorAt(f.pos), tipLevel/10)
 }
 
-func (f *DCOffset) applyOffsetUntil(end int) {
-	data, out, pos, offset := f.data, f.out, f.pos, f.offset
+func (f *DCOffsetOf[S]) applyOffsetUntil(end int) {
+	pos, offset := f.pos, f.offset
 	for pos < end {
-		out[pos] = data[pos] - offset
+		f.put(pos, offset)
 		pos++
 	}
 	f.pos = pos
@@ -402,30 +649,49 @@ type Peak struct {
 	Next  int // The index that the next peak (or noise area) starts at
 }
 
-func (f *DCOffset) findPeakAt(start int) Peak {
-	if f.data[start]-f.offset < 0 {
+// peakSearch returns the most samples to search for the end of a peak.
+func (f *DCOffsetOf[S]) peakSearch() int {
+	if f.MaxPeakWidths <= 0 {
+		return math.MaxInt
+	}
+	return f.PeakWidth * f.MaxPeakWidths
+}
+
+// peakLimit returns the error of a peak, starting at the given index, that
+// is longer than the peak search allows.
+func (f *DCOffsetOf[S]) peakLimit(start int) error {
+	return &sample.LimitError{
+		Limit: "samples in a peak",
+		Max:   f.PeakWidth * f.MaxPeakWidths,
+		Index: start,
+	}
+}
+
+func (f *DCOffsetOf[S]) findPeakAt(start int) Peak {
+	if int(f.data[start])-f.offset < 0 {
 		return f.findLowPeak(start)
 	} else {
 		return f.findHighPeak(start)
 	}
 }
 
-func (f *DCOffset) findLowPeak(start int) Peak {
+func (f *DCOffsetOf[S]) findLowPeak(start int) Peak {
 	pw, nf, data, offset := f.PeakWidth, f.noiseLevel, f.data, f.offset
 	p := start
 	peak := Peak{
-		Value: data[p],
+		Value: int(data[p]),
 		Index: p,
 		Start: start,
 		End:   p,
 	}
-	stop := start + pw*6
-	for stop > 0 && p < len(data) && data[p]-offset <= nf {
-		if data[p] < peak.Value {
-			peak.Value = data[p]
+	stop := f.peakSearch()
+	for stop > 0 && p < len(data) && int(data[p])-offset <= nf {
+		v := int(data[p])
+		if v < peak.Value {
+			peak.Value = v
 			peak.Index = p
 		}
-		if data[p]-offset < -nf {
+		if v-offset < -nf {
 			peak.End = p
 		} else if p-peak.End > pw {
 			// Full peak width of noise, so this was the last peak.
@@ -442,22 +708,23 @@ func (f *DCOffset) findLowPeak(start int) Peak {
 	return peak
 }
 
-func (f *DCOffset) findHighPeak(start int) Peak {
+func (f *DCOffsetOf[S]) findHighPeak(start int) Peak {
 	pw, nf, data, offset := f.PeakWidth, f.noiseLevel, f.data, f.offset
 	p := start
 	peak := Peak{
-		Value: data[p],
+		Value: int(data[p]),
 		Index: p,
 		Start: start,
 		End:   p,
 	}
-	stop := start + pw*6
-	for stop > 0 && p < len(data) && data[p]-offset >= -nf {
-		if data[p] > peak.Value {
-			peak.Value = data[p]
+	stop := f.peakSearch()
+	for stop > 0 && p < len(data) && int(data[p])-offset >= -nf {
+		v := int(data[p])
+		if v > peak.Value {
+			peak.Value = v
 			peak.Index = p
 		}
-		if data[p]-offset > nf {
+		if v-offset > nf {
 			peak.End = p
 		} else if p-peak.End > pw {
 			// Full peak width of noise, so this was the last peak.
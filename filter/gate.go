@@ -0,0 +1,127 @@
+package filter
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/edorfaus/sb-mfm-decode/log"
+	"github.com/edorfaus/sb-mfm-decode/sample"
+)
+
+// Gate is a noise gate: it zeroes the samples in the quiet parts of the
+// input, where they stay within the noise floor, and leaves the rest as
+// they are, fading in and out over the attack and release times around
+// them so that the signal is not cut off abruptly.
+//
+// This is a much cheaper alternative to DCOffset for clean captures, such
+// as those taken straight from a line output, which have little DC offset
+// to remove, but whose noise between the blocks could still be taken for
+// edges. Since the whole input is known, the gate opens early enough for
+// the attack to be done by the time the signal starts.
+type Gate struct {
+	NoiseFloor int
+
+	// The time (in samples) that the gate takes to open and to close.
+	Attack, Release int
+
+	// How long (in samples) the samples must stay within the noise floor
+	// before the gate closes; shorter quiet parts (such as those between
+	// the pulses of a block) are left open.
+	Hold int
+
+	// Log is the logger to use; if nil, the package logger is used.
+	Log *log.Logger
+}
+
+// NewGate returns a Gate with the given noise floor, and the attack,
+// release and hold times based on the given peak width: 2 peak widths to
+// open and to close, and 8 to hold (as for the gap between two blocks).
+func NewGate(noiseFloor, peakWidth int) *Gate {
+	return &Gate{
+		NoiseFloor: noiseFloor,
+		Attack:     2 * peakWidth,
+		Release:    2 * peakWidth,
+		Hold:       8 * peakWidth,
+	}
+}
+
+// Run filters the input into the output, which may be the same slice.
+func (f *Gate) Run(input, output []int) error {
+	if len(output) < len(input) {
+		return fmt.Errorf("output cannot be shorter than input")
+	}
+	if f.Attack < 0 || f.Release < 0 || f.Hold < 0 {
+		return fmt.Errorf(
+			"bad gate times: attack %v, release %v, hold %v",
+			f.Attack, f.Release, f.Hold,
+		)
+	}
+
+	gain := make([]float64, len(input))
+	opened := 0
+	for _, r := range f.openRanges(input) {
+		opened += r[1] - r[0]
+		for i := r[0]; i < r[1]; i++ {
+			gain[i] = 1
+		}
+		ramp(gain, r[0]-1, -1, f.Attack)
+		ramp(gain, r[1], 1, f.Release)
+	}
+	f.log().F(
+		2, "Gate: open for %v of %v samples\n", opened, len(input),
+	)
+
+	for i, v := range input {
+		switch g := gain[i]; g {
+		case 0:
+			output[i] = 0
+		case 1:
+			output[i] = v
+		default:
+			output[i] = sample.Clamp[int](int(math.Round(float64(v) * g)))
+		}
+	}
+	return nil
+}
+
+// openRanges returns the ranges (start and end) of the input where the
+// gate is fully open: from the first sample outside the noise floor to
+// the last one, joining those that are less than Hold samples apart.
+func (f *Gate) openRanges(input []int) [][2]int {
+	var out [][2]int
+	for i, v := range input {
+		if abs(v) <= f.NoiseFloor {
+			continue
+		}
+		if n := len(out); n > 0 && i-out[n-1][1] < f.Hold {
+			out[n-1][1] = i + 1
+		} else {
+			out = append(out, [2]int{i, i + 1})
+		}
+	}
+	return out
+}
+
+// ramp fades the gain from 1 down to 0 over the given number of samples,
+// starting at the given index and going in the given direction, without
+// lowering any gain that is already higher (as from a nearby range).
+func ramp(gain []float64, from, dir, length int) {
+	for k := 0; k < length; k++ {
+		i := from + k*dir
+		if i < 0 || i >= len(gain) {
+			return
+		}
+		// A raised cosine, from just below 1 to just above 0.
+		g := 0.5 + 0.5*math.Cos(math.Pi*float64(k+1)/float64(length+1))
+		if g > gain[i] {
+			gain[i] = g
+		}
+	}
+}
+
+func (f *Gate) log() *log.Logger {
+	if f.Log != nil {
+		return f.Log
+	}
+	return logger
+}
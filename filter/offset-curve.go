@@ -0,0 +1,145 @@
+package filter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// OffsetCurve is a DC offset that is given instead of estimated, as a list
+// of points with straight lines between them. Before the first point and
+// after the last, the offset stays at the value of that point.
+//
+// The points must be sorted by their index.
+type OffsetCurve []CurvePoint
+
+// CurvePoint is the DC offset at a given sample index.
+type CurvePoint struct {
+	Index  int
+	Offset int
+}
+
+// OffsetCurveOf returns the curve that gives the given offsets for each
+// sample, e.g. as output by the DC offset filter, keeping only the points
+// where the slope changes.
+func OffsetCurveOf(offsets []int) OffsetCurve {
+	var c OffsetCurve
+	for i, v := range offsets {
+		if i > 0 && i < len(offsets)-1 {
+			if v-offsets[i-1] == offsets[i+1]-v {
+				continue
+			}
+		}
+		c = append(c, CurvePoint{Index: i, Offset: v})
+	}
+	return c
+}
+
+// At returns the offset at the given sample index, or 0 if the curve is
+// empty.
+func (c OffsetCurve) At(i int) int {
+	if len(c) == 0 {
+		return 0
+	}
+	return c.at(c.after(i), i)
+}
+
+// after returns the index in c of the first point after the given sample
+// index, or len(c) if there is none.
+func (c OffsetCurve) after(i int) int {
+	return sort.Search(len(c), func(j int) bool { return c[j].Index > i })
+}
+
+// at returns the offset at the given sample index, given the index in c of
+// the first point after it, as returned by after.
+func (c OffsetCurve) at(n, i int) int {
+	if n == 0 {
+		return c[0].Offset
+	}
+	if n == len(c) {
+		return c[n-1].Offset
+	}
+	a, b := c[n-1], c[n]
+	return a.Offset + (b.Offset-a.Offset)*(i-a.Index)/(b.Index-a.Index)
+}
+
+// ReadOffsetCurve reads an offset curve in CSV form, with the sample index
+// and the offset of one point per line, in order. Empty lines, lines
+// starting with #, and a header line, are ignored.
+func ReadOffsetCurve(r io.Reader) (OffsetCurve, error) {
+	var c OffsetCurve
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || text[0] == '#' || text == "index,offset" {
+			continue
+		}
+
+		index, offset, ok := strings.Cut(text, ",")
+		var p CurvePoint
+		var err error
+		if ok {
+			p.Index, err = strconv.Atoi(strings.TrimSpace(index))
+		}
+		if ok && err == nil {
+			p.Offset, err = strconv.Atoi(strings.TrimSpace(offset))
+		}
+		if !ok || err != nil || p.Index < 0 {
+			return nil, fmt.Errorf(
+				"offset curve line %v: bad point %q", line, text,
+			)
+		}
+		if len(c) > 0 && p.Index <= c[len(c)-1].Index {
+			return nil, fmt.Errorf(
+				"offset curve line %v: points are out of order", line,
+			)
+		}
+		c = append(c, p)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(c) == 0 {
+		return nil, fmt.Errorf("offset curve has no points")
+	}
+	return c, nil
+}
+
+// Write writes the offset curve in CSV form, as read by ReadOffsetCurve.
+func (c OffsetCurve) Write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "index,offset")
+	for _, p := range c {
+		fmt.Fprintf(bw, "%v,%v\n", p.Index, p.Offset)
+	}
+	return bw.Flush()
+}
+
+// Save writes the offset curve to the given file, as by Write.
+func (c OffsetCurve) Save(filename string) (retErr error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := f.Close(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+	return c.Write(f)
+}
+
+// LoadOffsetCurve reads the offset curve in the given file, as by
+// ReadOffsetCurve.
+func LoadOffsetCurve(filename string) (OffsetCurve, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadOffsetCurve(f)
+}
@@ -0,0 +1,146 @@
+package filter
+
+import (
+	"github.com/edorfaus/sb-mfm-decode/log"
+	"github.com/edorfaus/sb-mfm-decode/sample"
+)
+
+// Option configures a filter that is created with one of the With
+// constructors, such as NewDCOffsetWith.
+type Option func(*options)
+
+type options struct {
+	noiseFloor   int
+	noiseProfile sample.NoiseProfile
+	curve        OffsetCurve
+	peakWidth    int
+	maxPeak      int
+	log          *log.Logger
+
+	// The first error from an option, if any.
+	err error
+}
+
+func defaultOptions() options {
+	return options{
+		noiseFloor: DefaultNoiseFloor(16),
+		peakWidth:  MfmPeakWidth(4800, 48000),
+	}
+}
+
+// WithNoiseFloor sets the noise floor; the default is the one that
+// DefaultNoiseFloor gives for 16-bit samples.
+func WithNoiseFloor(noiseFloor int) Option {
+	return func(o *options) {
+		o.noiseFloor = noiseFloor
+	}
+}
+
+// WithNoiseFloorDB sets the noise floor to the given level in dBFS (below
+// 0), for samples of the given number of bits.
+func WithNoiseFloorDB(db float64, bits int) Option {
+	return func(o *options) {
+		if err := sample.CheckDB(db, bits); err != nil {
+			if o.err == nil {
+				o.err = err
+			}
+			return
+		}
+		o.noiseFloor = sample.FromDB(db, bits)
+	}
+}
+
+// WithNoiseProfile sets a noise floor that varies over the samples, which
+// is used instead of the single noise floor if it is not empty.
+func WithNoiseProfile(p sample.NoiseProfile) Option {
+	return func(o *options) {
+		o.noiseProfile = p
+	}
+}
+
+// WithOffsetCurve sets an offset curve that is subtracted from the
+// samples instead of the estimated DC offset, if it is not empty.
+func WithOffsetCurve(c OffsetCurve) Option {
+	return func(o *options) {
+		o.curve = c
+	}
+}
+
+// WithBitDepth sets the noise floor to the default for the given number
+// of bits per sample.
+func WithBitDepth(bits int) Option {
+	return func(o *options) {
+		o.noiseFloor = DefaultNoiseFloor(bits)
+	}
+}
+
+// WithPeakWidth sets the peak width; the default is the MFM peak width
+// for the StudyBox bit rate at 48kHz.
+func WithPeakWidth(peakWidth int) Option {
+	return func(o *options) {
+		o.peakWidth = peakWidth
+	}
+}
+
+// WithBitRate sets the peak width to the MFM peak width for the given
+// MFM bit rate and sample rate.
+func WithBitRate(mfmBitRate, sampleRate int) Option {
+	return func(o *options) {
+		peakWidth, err := PeakWidthFor(mfmBitRate, sampleRate)
+		if err != nil && o.err == nil {
+			o.err = err
+		}
+		o.peakWidth = peakWidth
+	}
+}
+
+// WithMaxPeakWidths sets the longest that a single peak can be, in peak
+// widths, before the input is taken to be damaged; by default, there is
+// no limit.
+func WithMaxPeakWidths(n int) Option {
+	return func(o *options) {
+		o.maxPeak = n
+	}
+}
+
+// WithLogger sets the logger to use, instead of the package logger.
+func WithLogger(l *log.Logger) Option {
+	return func(o *options) {
+		o.log = l
+	}
+}
+
+// CheckOptions returns an error if any of the given options is not
+// valid, such as a bit rate of 0. The With constructors panic on such
+// options, so options that come from outside the program should be
+// checked with this first.
+func CheckOptions(opts ...Option) error {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o.err
+}
+
+// NewDCOffsetWith creates a DCOffset filter configured by the given
+// options, using the defaults for any settings they do not give.
+func NewDCOffsetWith(opts ...Option) *DCOffset {
+	return NewDCOffsetOfWith[int](opts...)
+}
+
+// NewDCOffsetOfWith is like NewDCOffsetWith, for other sample types.
+func NewDCOffsetOfWith[S sample.Type](opts ...Option) *DCOffsetOf[S] {
+	if err := CheckOptions(opts...); err != nil {
+		panic(err)
+	}
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	f := NewDCOffsetOf[S](o.noiseFloor, o.peakWidth)
+	f.NoiseProfile = o.noiseProfile
+	f.Curve = o.curve
+	f.MaxPeakWidths = o.maxPeak
+	f.Log = o.log
+	return f
+}
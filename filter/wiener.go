@@ -0,0 +1,171 @@
+package filter
+
+import (
+	"fmt"
+	"math"
+
+	"golang.org/x/exp/slices"
+
+	"github.com/edorfaus/sb-mfm-decode/log"
+	"github.com/edorfaus/sb-mfm-decode/sample"
+	"github.com/edorfaus/sb-mfm-decode/spectrum"
+)
+
+// DefaultWienerFrame is the default frame size of the Wiener filter, in
+// samples, which at 44.1kHz is about 50 MFM bits.
+const DefaultWienerFrame = 512
+
+// minNoiseFrames is the least number of quiet frames that the Wiener
+// filter estimates the noise from; if there are fewer, it uses the
+// quietest tenth of the frames instead.
+const minNoiseFrames = 4
+
+// Wiener is a filter that attenuates the noise in the samples, at the
+// frequencies where the noise is strong compared to the signal. The
+// spectra of both are estimated from the samples themselves: the noise
+// from the frames that are within the noise floor, and the signal from
+// the rest, minus the noise.
+//
+// It is meant for very poor captures, to run after DCOffset (as it finds
+// the quiet frames by the noise floor around 0) and before the edge
+// detection.
+type Wiener struct {
+	NoiseFloor int
+
+	// The size of the frames that the spectra are estimated from and the
+	// filter is applied to; it must be a power of 2.
+	FrameSize int
+
+	// Log is the logger to use; if nil, the package logger is used.
+	Log *log.Logger
+}
+
+func NewWiener(noiseFloor, frameSize int) *Wiener {
+	return &Wiener{NoiseFloor: noiseFloor, FrameSize: frameSize}
+}
+
+// Run filters the input into the output, which may be the same slice.
+func (f *Wiener) Run(input, output []int) error {
+	if len(output) < len(input) {
+		return fmt.Errorf("output cannot be shorter than input")
+	}
+	size := f.FrameSize
+	if size <= 0 {
+		size = DefaultWienerFrame
+	}
+	if size < 4 || size&(size-1) != 0 {
+		return fmt.Errorf("frame size is not a power of 2: %v", size)
+	}
+
+	gain := f.gain(input, size)
+	if gain == nil {
+		f.log().Ln(2, "Wiener: no signal or noise found, skipping")
+		copy(output, input)
+		return nil
+	}
+
+	// The frames overlap by half, so when a frame has been added to acc,
+	// the first half of it is done and can be output. That part has
+	// already been read for the next frame, so output can be input.
+	acc, w := make([]float64, size), spectrum.Window(size)
+	half := size / 2
+	spectrum.Frames(input, size, func(start int, x []complex128) {
+		for i, g := range gain {
+			x[i] *= complex(g, 0)
+			if i > 0 && i < half {
+				x[size-i] *= complex(g, 0)
+			}
+		}
+		spectrum.FFT(x, true)
+
+		for i := range acc {
+			acc[i] += real(x[i]) * w[i]
+		}
+		for i := 0; i < half; i++ {
+			if j := start + i; j >= 0 && j < len(input) {
+				output[j] = sample.Clamp[int](int(math.Round(acc[i])))
+			}
+		}
+		copy(acc, acc[half:])
+		clear(acc[half:])
+	})
+	return nil
+}
+
+// gain estimates the spectra of the signal and the noise in the samples,
+// and returns the gain of the filter for each frequency bin, or nil if
+// the samples do not have both signal and noise.
+func (f *Wiener) gain(samples []int, size int) []float64 {
+	quiet := quietFrames(samples, size, f.NoiseFloor)
+
+	noise, signal := spectrum.NewPower(size), spectrum.NewPower(size)
+	n := 0
+	spectrum.Frames(samples, size, func(start int, x []complex128) {
+		if quiet[n] {
+			noise.Add(x)
+		} else {
+			signal.Add(x)
+		}
+		n++
+	})
+	f.log().F(
+		2, "Wiener: %v noise frames, %v signal frames\n",
+		noise.Frames, signal.Frames,
+	)
+	if noise.Frames == 0 || signal.Frames == 0 {
+		return nil
+	}
+
+	gain := make([]float64, len(noise.Sum))
+	for i := range gain {
+		pn := noise.Mean(i)
+		ps := math.Max(signal.Mean(i)-pn, 0)
+		if ps+pn > 0 {
+			gain[i] = ps / (ps + pn)
+		}
+	}
+	return gain
+}
+
+// quietFrames returns whether each of the frames of the samples (as given
+// by spectrum.Frames) is noise: those whose peak is within the given noise
+// floor, or if there are too few of them, the quietest tenth (but at least
+// minNoiseFrames of them).
+func quietFrames(samples []int, size, noiseFloor int) []bool {
+	var peaks []int
+	for start := -size / 2; start < len(samples); start += size / 2 {
+		from, to := max(start, 0), min(start+size, len(samples))
+		peak := 0
+		for _, v := range samples[from:to] {
+			peak = max(peak, max(v, -v))
+		}
+		peaks = append(peaks, peak)
+	}
+
+	limit := noiseFloor
+	n := 0
+	for _, p := range peaks {
+		if p <= limit {
+			n++
+		}
+	}
+	if n < minNoiseFrames {
+		sorted := slices.Clone(peaks)
+		slices.Sort(sorted)
+		i := max(len(sorted)/10, minNoiseFrames-1)
+		limit = sorted[min(i, len(sorted)-1)]
+	}
+
+	quiet := make([]bool, len(peaks))
+	for i, p := range peaks {
+		quiet[i] = p <= limit
+	}
+	return quiet
+}
+
+func (f *Wiener) log() *log.Logger {
+	if f.Log != nil {
+		return f.Log
+	}
+	return logger
+}
@@ -0,0 +1,124 @@
+// Package fuzz provides entry points into the decoding pipeline that are
+// meant for fuzzing, e.g. from a go test fuzz target. They accept any
+// input, and bound the amount of memory and work they use on it, so that
+// any panic or runaway growth they run into is a bug in the pipeline.
+package fuzz
+
+import (
+	"context"
+
+	"github.com/edorfaus/sb-mfm-decode/filter"
+	"github.com/edorfaus/sb-mfm-decode/mfm"
+	"github.com/edorfaus/sb-mfm-decode/sample"
+	"github.com/edorfaus/sb-mfm-decode/studybox"
+)
+
+// The settings that the input is decoded with.
+const (
+	SampleRate = 44100
+	BitDepth   = 16
+)
+
+// MaxSamples is the maximum number of samples that are decoded; any
+// samples after this are ignored.
+const MaxSamples = 1 << 20
+
+// MaxBits is the maximum number of MFM bits in a block; a block with
+// more bits than this fails to decode. This is a little more than the
+// largest block that fits in MaxSamples.
+const MaxBits = 2*MaxSamples/(SampleRate/mfm.DefaultBitRate) + 64
+
+// Result is the result of decoding a fuzzing input.
+type Result struct {
+	// The number of blocks that were decoded, and how many of them
+	// failed to decode (either as MFM or as StudyBox bytes).
+	Blocks, Failed int
+
+	// The total number of bytes that were decoded.
+	Bytes int
+
+	// The number of pulses that the pulse classifier found, and how many
+	// of them were valid MFM pulses.
+	Pulses, ValidPulses int
+}
+
+// DecodeBytes decodes the given bytes, as 16-bit little-endian mono
+// samples, as by DecodeSamples. A trailing odd byte is ignored.
+func DecodeBytes(data []byte) Result {
+	n := len(data) / 2
+	if n > MaxSamples {
+		n = MaxSamples
+	}
+	samples := make([]int, n)
+	for i := range samples {
+		samples[i] = int(int16(uint16(data[2*i]) | uint16(data[2*i+1])<<8))
+	}
+	return decode(samples)
+}
+
+// DecodeSamples decodes the given samples through the whole pipeline:
+// cleaning them, detecting edges, decoding the MFM blocks, and decoding
+// the bytes of those blocks. The samples are clamped to 16 bits, and
+// the given slice is not modified.
+func DecodeSamples(samples []int) Result {
+	if len(samples) > MaxSamples {
+		samples = samples[:MaxSamples]
+	}
+	buf := make([]int, len(samples))
+	for i, v := range samples {
+		buf[i] = int(sample.Clamp[int16](v))
+	}
+	return decode(buf)
+}
+
+// decode runs the pipeline on the given samples, cleaning them in place.
+func decode(samples []int) Result {
+	noiseFloor := filter.DefaultNoiseFloor(BitDepth)
+	peakWidth := filter.MfmPeakWidth(mfm.DefaultBitRate, SampleRate)
+
+	f := filter.NewDCOffset(noiseFloor, peakWidth)
+	if err := f.Run(samples, samples); err != nil {
+		return Result{}
+	}
+
+	opts := []mfm.Option{
+		mfm.WithNoiseFloor(noiseFloor),
+		mfm.WithBitRate(mfm.DefaultBitRate, SampleRate),
+		mfm.WithMaxBits(MaxBits),
+	}
+	d := mfm.NewDecoderWith(mfm.NewEdgeDetectWith(samples, opts...), opts...)
+
+	var res Result
+	sink := blockSink{&res}
+	_ = d.DecodeTo(context.Background(), sink)
+
+	// The classifier is run separately, as it has its own edge detector.
+	c := mfm.NewPulseClassifierWith(mfm.NewEdgeDetectWith(samples, opts...))
+	for c.Next() {
+		res.Pulses++
+		if c.Class.Valid() {
+			res.ValidPulses++
+		}
+	}
+
+	return res
+}
+
+// blockSink is a BitSink that decodes the bytes of the blocks, and counts
+// the results.
+type blockSink struct {
+	res *Result
+}
+
+func (s blockSink) Block(start, end int, bits []byte, err error) error {
+	s.res.Blocks++
+	if err == nil {
+		var data []byte
+		data, err = studybox.DecodeBlock(bits)
+		s.res.Bytes += len(data)
+	}
+	if err != nil {
+		s.res.Failed++
+	}
+	return nil
+}
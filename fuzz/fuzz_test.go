@@ -0,0 +1,103 @@
+package fuzz
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/edorfaus/sb-mfm-decode/synth"
+)
+
+// seedSamples returns the samples of a short recording with a few blocks
+// on it, for the seed corpus: one that decodes, one with its pulses
+// glitched, and one cut off partway.
+func seedSamples() [][]int {
+	// The bit rate is close to the default, but gives a whole number of
+	// samples per bit, as the decoder does not yet follow the pulse widths
+	// of a fractional bit width well enough to decode an ideal signal.
+	sig := synth.Signal{
+		SampleRate: SampleRate,
+		BitDepth:   BitDepth,
+		BitRate:    SampleRate / 10,
+	}
+
+	s := synth.New(sig)
+	s.Silence(SampleRate / 20)
+	s.Block([]byte("StudyBox fuzzing seed"), 40)
+	s.Silence(SampleRate / 20)
+	clean := s.Render()
+
+	s = synth.New(sig)
+	s.Silence(SampleRate / 20)
+	s.Block([]byte{0x00, 0xff, 0x55, 0xaa, 0x92, 0x49, 0x24}, 40)
+	s.Silence(SampleRate / 20)
+	in := synth.NewInjector(s, 1)
+	in.RandomGlitches(3, 2)
+	in.RandomFlips(2)
+	glitched := s.Render()
+
+	return [][]int{clean, glitched, clean[:len(clean)/2]}
+}
+
+// samplesToBytes encodes the given samples as 16-bit little-endian, as
+// DecodeBytes takes them.
+func samplesToBytes(samples []int) []byte {
+	data := make([]byte, 2*len(samples))
+	for i, v := range samples {
+		binary.LittleEndian.PutUint16(data[2*i:], uint16(int16(v)))
+	}
+	return data
+}
+
+// checkResult fails the test if the counts of the result do not add up.
+func checkResult(t *testing.T, res Result) {
+	if res.Failed < 0 || res.Failed > res.Blocks {
+		t.Errorf("%v of %v blocks failed", res.Failed, res.Blocks)
+	}
+	if res.ValidPulses < 0 || res.ValidPulses > res.Pulses {
+		t.Errorf("%v of %v pulses valid", res.ValidPulses, res.Pulses)
+	}
+	if res.Bytes < 0 {
+		t.Errorf("negative byte count: %v", res.Bytes)
+	}
+}
+
+func FuzzDecodeBytes(f *testing.F) {
+	for _, samples := range seedSamples() {
+		f.Add(samplesToBytes(samples))
+	}
+	f.Add([]byte{})
+	f.Add([]byte{0x7f})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkResult(t, DecodeBytes(data))
+	})
+}
+
+// FuzzDecodeSamples takes the samples as 32-bit little-endian values, so
+// that they go past the 16 bits that DecodeSamples clamps them to.
+func FuzzDecodeSamples(f *testing.F) {
+	for _, samples := range seedSamples() {
+		data := make([]byte, 4*len(samples))
+		for i, v := range samples {
+			binary.LittleEndian.PutUint32(data[4*i:], uint32(int32(v*3)))
+		}
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		samples := make([]int, len(data)/4)
+		for i := range samples {
+			samples[i] = int(int32(binary.LittleEndian.Uint32(data[4*i:])))
+		}
+		checkResult(t, DecodeSamples(samples))
+	})
+}
+
+// TestSeedDecodes checks that the clean seed decodes, so that the seed
+// corpus reaches past the edge detector into the block decoding.
+func TestSeedDecodes(t *testing.T) {
+	res := DecodeSamples(seedSamples()[0])
+	if res.Blocks == 0 || res.Bytes == 0 {
+		t.Errorf("seed did not decode: %+v", res)
+	}
+}
@@ -1,6 +1,6 @@
 module github.com/edorfaus/sb-mfm-decode
 
-go 1.19
+go 1.22.0
 
 require (
 	github.com/alexflint/go-arg v1.5.1
@@ -0,0 +1,91 @@
+package log
+
+import (
+	"strings"
+	"sync"
+)
+
+// Event is a structured log event, as given to hooks.
+type Event struct {
+	// The name of the logger that the event was logged by.
+	Logger string
+
+	// The level that the event was logged at; warnings are level 0.
+	Level int
+
+	// The logged message, without any trailing newline. For warnings,
+	// this does not include the "Warning:" prefix or the position.
+	Message string
+
+	// Whether this event is a warning.
+	Warning bool
+
+	// The position (sample index) that the event is about, or -1 if it
+	// does not have one. Only warnings logged with WarnAt have this.
+	Pos int
+}
+
+// Hook is a function that receives log events.
+//
+// Hooks receive the events that are output (as allowed by the level),
+// and all warnings, including those suppressed by the warning limit.
+// They may be called concurrently if the logger is used concurrently.
+type Hook func(Event)
+
+// hooks is a list of hooks, that can be added to and removed from.
+type hooks struct {
+	mu   sync.Mutex
+	list []*Hook
+}
+
+// globalHooks holds the hooks that receive events from all loggers.
+var globalHooks hooks
+
+// AddHook installs a hook that receives events from all loggers, and
+// returns a function that removes it again.
+func AddHook(h Hook) (remove func()) {
+	return globalHooks.add(h)
+}
+
+// AddHook installs a hook that receives the events from this logger,
+// and returns a function that removes it again.
+func (l *Logger) AddHook(h Hook) (remove func()) {
+	return l.hooks.add(h)
+}
+
+func (hs *hooks) add(h Hook) func() {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	p := &h
+	hs.list = append(hs.list, p)
+	return func() {
+		hs.mu.Lock()
+		defer hs.mu.Unlock()
+
+		for i, v := range hs.list {
+			if v == p {
+				hs.list = append(hs.list[:i:i], hs.list[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+func (hs *hooks) call(ev Event) {
+	hs.mu.Lock()
+	list := hs.list
+	hs.mu.Unlock()
+
+	for _, h := range list {
+		(*h)(ev)
+	}
+}
+
+// emit sends the given event to this logger's hooks and the global ones.
+func (l *Logger) emit(ev Event) {
+	ev.Logger = l.name
+	ev.Message = strings.TrimSuffix(ev.Message, "\n")
+	l.hooks.call(ev)
+	globalHooks.call(ev)
+}
@@ -4,50 +4,408 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/edorfaus/sb-mfm-decode/metrics"
 )
 
+// The global settings below (Level, Levels, Target and Targets) may only
+// be set directly while setting up the program, before anything logs
+// from more than one goroutine; after that, they must only be changed by
+// SetLevels and SetTargets, which are safe for concurrent use, as are the
+// loggers themselves.
+
 // Level is the current logging level - the maximum level of logs that
-// will actually be output.
+// will actually be output. Named loggers use this unless they have a
+// level of their own in Levels.
 var Level int = 1
 
-// Target is where the logging will be output to.
-var Target io.Writer = os.Stdout
+// Levels holds the logging levels of named loggers, by name. A logger
+// whose name is not in this map uses the global Level instead.
+var Levels = map[string]int{}
 
-func Log(level int, v ...any) {
-	if Level >= level {
-		fmt.Fprint(Target, v...)
+// Target is where the logging will be output to, unless overridden for
+// a given level in Targets. This defaults to stderr, to keep the logs
+// separate from any primary output that a command writes to stdout.
+var Target io.Writer = os.Stderr
+
+// Targets holds where logs of specific levels are output to, overriding
+// Target for those levels. Warnings are level 0.
+var Targets = map[int]io.Writer{}
+
+// loggers holds all the named loggers that have been created, by name.
+var loggers = map[string]*Logger{}
+
+// mu guards the global settings and loggers, and the settings of each
+// logger (its level, target and warning collector).
+var mu sync.RWMutex
+
+// std is the logger used by the package-level logging functions, which
+// are mainly used by the commands.
+var std = Named("cmd")
+
+// Logger is a named logger, whose level can be set separately from the
+// global Level by adding its name to Levels.
+//
+// A logger can also be given its own level and target, making it
+// independent of the global state, so that e.g. concurrent pipelines
+// can each log with different verbosity to different places.
+type Logger struct {
+	name string
+
+	// level is this logger's own level, if hasLevel is true.
+	level    int
+	hasLevel bool
+
+	// target is this logger's own target, if it is not nil.
+	target io.Writer
+
+	// warnings is this logger's own warning collector, if not nil.
+	warnings *Warnings
+
+	// hooks holds the hooks that receive this logger's events.
+	hooks hooks
+}
+
+// New creates a new logger with its own level and target, that does not
+// depend on the global Level, Levels or Target. It is not registered as
+// a named logger, so it is not affected by SetLevels either.
+func New(name string, level int, target io.Writer) *Logger {
+	return &Logger{
+		name:     name,
+		level:    level,
+		hasLevel: true,
+		target:   target,
 	}
 }
 
-func Ln(level int, v ...any) {
-	if Level >= level {
-		fmt.Fprintln(Target, v...)
+// Named returns the logger with the given name, creating it if needed.
+// This is normally only called once per package, to make its logger.
+func Named(name string) *Logger {
+	mu.Lock()
+	defer mu.Unlock()
+	if l, ok := loggers[name]; ok {
+		return l
 	}
+	l := &Logger{name: name}
+	loggers[name] = l
+	return l
 }
 
-func F(level int, f string, v ...any) {
-	if Level >= level {
-		fmt.Fprintf(Target, f, v...)
+// Names returns the names of all the named loggers, sorted by name.
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return names()
+}
+
+// names returns the names of all the named loggers, sorted by name. The
+// caller must hold mu.
+func names() []string {
+	names := make([]string, 0, len(loggers))
+	for name := range loggers {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	return names
 }
 
-func Warn(v ...any) {
-	if Level >= 0 {
-		fmt.Fprintln(
-			Target, append(append([]any(nil), "Warning:"), v...)...,
+// SetLevels sets the logging levels from a comma-separated list, where
+// each item is either a plain level (which sets the global Level), or a
+// name=level pair (which sets the level of that named logger).
+//
+// For example, "2,filter=3,mfm=1" sets the global level to 2, and the
+// levels of the filter and mfm loggers to 3 and 1 respectively.
+func SetLevels(spec string) error {
+	if spec == "" {
+		return nil
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, item := range strings.Split(spec, ",") {
+		name, value, named := strings.Cut(item, "=")
+		if !named {
+			name, value = "", item
+		}
+		level, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("bad log level in %q: %w", item, err)
+		}
+		if !named {
+			Level = level
+			continue
+		}
+		name = strings.TrimSpace(name)
+		if _, ok := loggers[name]; !ok {
+			return fmt.Errorf(
+				"unknown logger %q (known: %v)",
+				name, strings.Join(names(), ", "),
+			)
+		}
+		Levels[name] = level
+	}
+	return nil
+}
+
+// SetTargets sets the output targets of specific logging levels, from a
+// comma-separated list of level=target pairs, where the target is either
+// "stdout" or "stderr". A level of "*" sets the default Target instead.
+//
+// For example, "*=stderr,1=stdout" sends level 1 logs to stdout, and all
+// the other levels to stderr.
+func SetTargets(spec string) error {
+	if spec == "" {
+		return nil
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, item := range strings.Split(spec, ",") {
+		level, name, ok := strings.Cut(item, "=")
+		if !ok {
+			return fmt.Errorf("bad log target %q: missing =", item)
+		}
+		var target io.Writer
+		switch strings.TrimSpace(name) {
+		case "stdout":
+			target = os.Stdout
+		case "stderr":
+			target = os.Stderr
+		default:
+			return fmt.Errorf("bad log target %q: unknown target", item)
+		}
+		if level = strings.TrimSpace(level); level == "*" {
+			Target = target
+			continue
+		}
+		lv, err := strconv.Atoi(level)
+		if err != nil {
+			return fmt.Errorf("bad log level in %q: %w", item, err)
+		}
+		Targets[lv] = target
+	}
+	return nil
+}
+
+// Name returns the name of the logger.
+func (l *Logger) Name() string {
+	return l.name
+}
+
+// Level returns the current logging level of this logger.
+func (l *Logger) Level() int {
+	mu.RLock()
+	defer mu.RUnlock()
+	if l.hasLevel {
+		return l.level
+	}
+	if level, ok := Levels[l.name]; ok {
+		return level
+	}
+	return Level
+}
+
+// SetLevel gives this logger its own level, which is then used instead
+// of the global level settings.
+func (l *Logger) SetLevel(level int) {
+	mu.Lock()
+	defer mu.Unlock()
+	l.level, l.hasLevel = level, true
+}
+
+// Target returns where this logger currently outputs logs of the given
+// level to.
+func (l *Logger) Target(level int) io.Writer {
+	mu.RLock()
+	defer mu.RUnlock()
+	if l.target != nil {
+		return l.target
+	}
+	if t, ok := Targets[level]; ok {
+		return t
+	}
+	return Target
+}
+
+// SetTarget gives this logger its own target, which is then used for all
+// levels instead of the global Target and Targets. Setting it to nil
+// reverts to using the global ones.
+func (l *Logger) SetTarget(target io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+	l.target = target
+}
+
+// Warnings returns the warning collector that this logger records its
+// warnings in.
+func (l *Logger) Warnings() *Warnings {
+	mu.RLock()
+	defer mu.RUnlock()
+	if l.warnings != nil {
+		return l.warnings
+	}
+	return Collected
+}
+
+// SetWarnings gives this logger its own warning collector, which is then
+// used instead of Collected. Setting it to nil reverts to Collected.
+func (l *Logger) SetWarnings(w *Warnings) {
+	mu.Lock()
+	defer mu.Unlock()
+	l.warnings = w
+}
+
+func (l *Logger) Log(level int, v ...any) {
+	if l.Level() >= level {
+		l.output(l.Target(level), level, fmt.Sprint(v...))
+	}
+}
+
+func (l *Logger) Ln(level int, v ...any) {
+	if l.Level() >= level {
+		l.output(l.Target(level), level, fmt.Sprintln(v...))
+	}
+}
+
+func (l *Logger) F(level int, f string, v ...any) {
+	if l.Level() >= level {
+		l.output(l.Target(level), level, fmt.Sprintf(f, v...))
+	}
+}
+
+// output writes the given message to the target, and emits it as an
+// event to the hooks.
+func (l *Logger) output(target io.Writer, level int, msg string) {
+	io.WriteString(target, msg)
+	l.emit(Event{Level: level, Message: msg, Pos: -1})
+}
+
+// Warn outputs a warning, and records it in the warning collector, with
+// the whole message as the kind of warning.
+//
+// If the collector's limit for this kind of warning has been reached,
+// the warning is only recorded, not output.
+func (l *Logger) Warn(v ...any) {
+	msg := strings.TrimSuffix(fmt.Sprintln(v...), "\n")
+	l.emit(Event{Message: msg, Warning: true, Pos: -1})
+	if l.recordWarning(msg, -1) {
+		fmt.Fprintln(l.Target(0), "Warning:", msg)
+	}
+}
+
+// WarnAt outputs a warning about something at the given position, and
+// records it in the warning collector, with the message as the kind.
+//
+// If the collector's limit for this kind of warning has been reached,
+// the warning is only recorded, not output.
+func (l *Logger) WarnAt(pos int, msg string) {
+	l.emit(Event{Message: msg, Warning: true, Pos: pos})
+	if l.recordWarning(msg, pos) {
+		fmt.Fprintln(l.Target(0), "Warning:", msg, "at", pos)
+	}
+}
+
+// recordWarning records a warning, and returns whether it should also
+// be output. When the limit is first exceeded, it outputs a note saying
+// that further warnings of that kind will be suppressed.
+func (l *Logger) recordWarning(kind string, pos int) bool {
+	w := l.Warnings()
+	count := w.Add(kind, pos)
+	if l.Level() < 0 {
+		return false
+	}
+	switch w.Suppressed(count) {
+	case 0:
+		return true
+	case 1:
+		fmt.Fprintf(
+			l.Target(0), "Warning: suppressing further %q warnings\n", kind,
 		)
 	}
+	return false
 }
 
-func Time(level int, f string, v ...any) func(...any) {
-	if Level < level {
+// WarnSummary outputs a summary of the warnings that have been recorded
+// in this logger's warning collector, if there were any.
+func (l *Logger) WarnSummary() {
+	if l.Level() >= 0 {
+		l.Warnings().Summary(l.Target(0))
+	}
+}
+
+func (l *Logger) Time(level int, f string, v ...any) func(...any) {
+	if l.Level() < level {
 		return func(...any) {}
 	}
-	fmt.Fprintf(Target, f, v...)
+	target := l.Target(level)
+	l.output(target, level, fmt.Sprintf(f, v...))
 	start := time.Now()
 	return func(v ...any) {
 		dur := time.Since(start)
-		fmt.Fprintln(Target, append(v, dur)...)
+		l.output(target, level, fmt.Sprintln(append(v, dur)...))
 	}
 }
+
+// TimeStage is like Time, but also records the duration of the named
+// processing stage, and how many samples it processed, in the default
+// metrics registry. This is done regardless of the logging level.
+func (l *Logger) TimeStage(
+	level int, stage string, samples int, f string, v ...any,
+) func(...any) {
+	done := l.Time(level, f, v...)
+	stop := metrics.Start(stage, samples)
+	return func(v ...any) {
+		stop()
+		done(v...)
+	}
+}
+
+// Writer returns the target of this logger if logs of the given level
+// would be output, or io.Discard otherwise.
+func (l *Logger) Writer(level int) io.Writer {
+	if l.Level() < level {
+		return io.Discard
+	}
+	return l.Target(level)
+}
+
+func Log(level int, v ...any) {
+	std.Log(level, v...)
+}
+
+func Ln(level int, v ...any) {
+	std.Ln(level, v...)
+}
+
+func F(level int, f string, v ...any) {
+	std.F(level, f, v...)
+}
+
+func Warn(v ...any) {
+	std.Warn(v...)
+}
+
+func WarnAt(pos int, msg string) {
+	std.WarnAt(pos, msg)
+}
+
+func WarnSummary() {
+	std.WarnSummary()
+}
+
+func Time(level int, f string, v ...any) func(...any) {
+	return std.Time(level, f, v...)
+}
+
+func TimeStage(
+	level int, stage string, samples int, f string, v ...any,
+) func(...any) {
+	return std.TimeStage(level, stage, samples, f, v...)
+}
+
+func Writer(level int) io.Writer {
+	return std.Writer(level)
+}
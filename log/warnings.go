@@ -0,0 +1,182 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Warnings collects warnings, grouping them by kind, and keeping track
+// of how many there were of each kind, and where the first and last of
+// them were reported.
+//
+// It is safe for concurrent use.
+type Warnings struct {
+	mu    sync.Mutex
+	kinds map[string]*WarningKind
+	order []*WarningKind
+	limit int
+}
+
+// WarningKind holds the collected information about one kind of warning.
+type WarningKind struct {
+	// The kind of warning; this is the warning message, minus position.
+	Kind string
+
+	// The number of warnings of this kind that have been reported.
+	Count int
+
+	// The positions (sample indexes) of the first and last warnings of
+	// this kind, or -1 if those warnings did not have a position.
+	First, Last int
+}
+
+// DefaultWarnLimit is the default limit on how many warnings of each
+// kind are output before the rest of them are suppressed.
+const DefaultWarnLimit = 10
+
+// Collected is the warning collector used by loggers that have not been
+// given their own collector.
+var Collected = NewWarnings()
+
+func NewWarnings() *Warnings {
+	return &Warnings{
+		kinds: map[string]*WarningKind{},
+		limit: DefaultWarnLimit,
+	}
+}
+
+// Limit returns the maximum number of warnings of each kind that should
+// be output, or 0 if there is no limit.
+func (w *Warnings) Limit() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.limit
+}
+
+// SetLimit sets the maximum number of warnings of each kind that should
+// be output, before further warnings of that kind are only counted.
+// Setting it to 0 (or less) removes the limit.
+func (w *Warnings) SetLimit(limit int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if limit < 0 {
+		limit = 0
+	}
+	w.limit = limit
+}
+
+// Suppressed returns how many of the given count of warnings of a single
+// kind should be (or have been) suppressed, given the current limit.
+func (w *Warnings) Suppressed(count int) int {
+	limit := w.Limit()
+	if limit <= 0 || count <= limit {
+		return 0
+	}
+	return count - limit
+}
+
+// Add records a warning of the given kind at the given position (or -1
+// if it has no position), and returns how many warnings of that kind
+// have now been recorded.
+func (w *Warnings) Add(kind string, pos int) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	k := w.kinds[kind]
+	if k == nil {
+		k = &WarningKind{Kind: kind, First: pos}
+		w.kinds[kind] = k
+		w.order = append(w.order, k)
+	}
+	k.Count++
+	k.Last = pos
+	if k.First < 0 {
+		k.First = pos
+	}
+	return k.Count
+}
+
+// Kinds returns the kinds of warnings that have been recorded, in the
+// order that they were first seen.
+func (w *Warnings) Kinds() []WarningKind {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	kinds := make([]WarningKind, len(w.order))
+	for i, k := range w.order {
+		kinds[i] = *k
+	}
+	return kinds
+}
+
+// Total returns the total number of warnings that have been recorded.
+func (w *Warnings) Total() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	total := 0
+	for _, k := range w.order {
+		total += k.Count
+	}
+	return total
+}
+
+// Reset forgets all the warnings that have been recorded so far.
+func (w *Warnings) Reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.kinds = map[string]*WarningKind{}
+	w.order = nil
+}
+
+// Summary writes a summary of the recorded warnings to the given output.
+// If no warnings have been recorded, nothing is written.
+func (w *Warnings) Summary(out io.Writer) error {
+	kinds := w.Kinds()
+	if len(kinds) == 0 {
+		return nil
+	}
+
+	total, csz := 0, 0
+	for _, k := range kinds {
+		total += k.Count
+		if s := len(fmt.Sprint(k.Count)); s > csz {
+			csz = s
+		}
+	}
+
+	_, err := fmt.Fprintf(
+		out, "Warning summary: %v warnings of %v kinds\n",
+		total, len(kinds),
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, k := range kinds {
+		var pos, hidden string
+		switch {
+		case k.First < 0:
+			// No position to show.
+		case k.Count == 1:
+			pos = fmt.Sprintf(" (at %v)", k.First)
+		default:
+			pos = fmt.Sprintf(
+				" (first at %v, last at %v)", k.First, k.Last,
+			)
+		}
+		if n := w.Suppressed(k.Count); n > 0 {
+			hidden = fmt.Sprintf(" [%v not shown]", n)
+		}
+		_, err = fmt.Fprintf(
+			out, "  %*v x %v%v%v\n", csz, k.Count, k.Kind, pos, hidden,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,278 @@
+// Package manifest makes checksum manifests of decoded data: the SHA-256
+// of each decoded block and of each output file, along with the settings
+// and the version of the tool that made them, so that an archive of the
+// output can later be verified to still match what was decoded.
+package manifest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"time"
+
+	"github.com/edorfaus/sb-mfm-decode/pipeline"
+	"github.com/edorfaus/sb-mfm-decode/schema"
+)
+
+// Manifest is a checksum manifest of a decode, in the JSON form that it is
+// saved in.
+type Manifest struct {
+	schema.Header
+
+	// The tool that made the manifest, its version, and when it was made.
+	Tool    string    `json:"tool"`
+	Version string    `json:"tool_version"`
+	Created time.Time `json:"created"`
+
+	// The settings that the decode was done with, in order.
+	Params []Param `json:"params,omitempty"`
+
+	// The input files that were decoded, and the output files that were
+	// written from them.
+	Inputs  []File `json:"inputs,omitempty"`
+	Outputs []File `json:"outputs,omitempty"`
+
+	// The blocks that were decoded, including the ones that failed.
+	Blocks []Block `json:"blocks"`
+}
+
+// Param is a setting that the decode was done with.
+type Param struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// File is a file listed in a manifest. When the manifest is saved, the
+// paths are made relative to the directory of the manifest, if possible.
+type File struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Block is a decoded block listed in a manifest. The checksum is of its
+// decoded data, and is empty if it could not be decoded; the ID is that
+// of pipeline.Block.ID.
+type Block struct {
+	Index  int    `json:"index"`
+	ID     string `json:"id"`
+	Start  int    `json:"start"`
+	End    int    `json:"end"`
+	Bytes  int    `json:"bytes"`
+	SHA256 string `json:"sha256,omitempty"`
+	Err    string `json:"error,omitempty"`
+}
+
+// New returns a new, empty manifest for the given tool and settings.
+func New(tool string, params []Param) *Manifest {
+	return &Manifest{
+		Header: schema.Header{
+			Schema:  schema.ManifestSchema,
+			Version: schema.Version,
+		},
+		Tool:    tool,
+		Version: ToolVersion(),
+		Created: time.Now().UTC().Truncate(time.Second),
+		Params:  params,
+	}
+}
+
+// ToolVersion returns the version of the running program, as recorded in
+// it by the Go toolchain: the module version, and the VCS revision if it
+// is known (which it is not for go run, or for builds outside of a VCS).
+func ToolVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	v := info.Main.Version
+	if v == "" {
+		v = "(devel)"
+	}
+	var rev, modified string
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			rev = s.Value
+		case "vcs.modified":
+			if s.Value == "true" {
+				modified = "+dirty"
+			}
+		}
+	}
+	if rev != "" {
+		v += " " + rev + modified
+	}
+	return v
+}
+
+// AddBlock adds a decoded block to the manifest.
+func (m *Manifest) AddBlock(b *pipeline.Block) {
+	mb := Block{
+		Index: len(m.Blocks),
+		ID:    b.ID(),
+		Start: b.Start,
+		End:   b.End,
+		Bytes: len(b.Data),
+	}
+	if b.Err != nil {
+		mb.Err = b.Err.Error()
+	} else {
+		mb.SHA256 = Sum(b.Data)
+	}
+	m.Blocks = append(m.Blocks, mb)
+}
+
+// AddInput adds an input file to the manifest, reading it to checksum it.
+func (m *Manifest) AddInput(path string) error {
+	f, err := HashFile(path)
+	if err != nil {
+		return err
+	}
+	m.Inputs = append(m.Inputs, f)
+	return nil
+}
+
+// AddOutput adds an output file to the manifest, reading it to checksum
+// it; so it should be complete (and closed) before this is called.
+func (m *Manifest) AddOutput(path string) error {
+	f, err := HashFile(path)
+	if err != nil {
+		return err
+	}
+	m.Outputs = append(m.Outputs, f)
+	return nil
+}
+
+// Sum returns the SHA-256 of the given data, in hex.
+func Sum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// HashFile returns the given file as listed in a manifest, with its size
+// and SHA-256.
+func HashFile(path string) (File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return File{}, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return File{}, err
+	}
+	return File{
+		Path:   path,
+		Size:   n,
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
+
+// Load reads a manifest from the given JSON file.
+func Load(filename string) (*Manifest, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("reading manifest %v: %w", filename, err)
+	}
+	if err := m.Check(schema.ManifestSchema); err != nil {
+		return nil, fmt.Errorf("reading manifest %v: %w", filename, err)
+	}
+	return m, nil
+}
+
+// Save writes the manifest to the given file as JSON, with the paths of
+// the files made relative to the directory of that file (if possible).
+func (m *Manifest) Save(filename string) error {
+	dir := filepath.Dir(filename)
+	c := *m
+	c.Inputs = relativeFiles(dir, m.Inputs)
+	c.Outputs = relativeFiles(dir, m.Outputs)
+
+	data, err := json.MarshalIndent(&c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append(data, '\n'), 0o666)
+}
+
+func relativeFiles(dir string, files []File) []File {
+	out := make([]File, len(files))
+	for i, f := range files {
+		out[i] = f
+		abs, err := filepath.Abs(f.Path)
+		if err != nil {
+			continue
+		}
+		absDir, err := filepath.Abs(dir)
+		if err != nil {
+			continue
+		}
+		if rel, err := filepath.Rel(absDir, abs); err == nil {
+			out[i].Path = filepath.ToSlash(rel)
+		}
+	}
+	return out
+}
+
+// Mismatch is a file that does not match its entry in a manifest.
+type Mismatch struct {
+	File File
+
+	// What is wrong with it: either it could not be read (Err is set), or
+	// its size or checksum is different (Got is what it has now).
+	Err error
+	Got File
+}
+
+func (m Mismatch) Error() string {
+	if m.Err != nil {
+		return fmt.Sprintf("%v: %v", m.File.Path, m.Err)
+	}
+	if m.Got.Size != m.File.Size {
+		return fmt.Sprintf(
+			"%v: size is %v, expected %v", m.File.Path, m.Got.Size,
+			m.File.Size,
+		)
+	}
+	return fmt.Sprintf(
+		"%v: SHA-256 is %v, expected %v", m.File.Path, m.Got.SHA256,
+		m.File.SHA256,
+	)
+}
+
+// Verify checks that the files listed in the manifest (inputs and
+// outputs) still match it, and returns the ones that do not. Relative
+// paths are taken as relative to the given directory, which should be the
+// directory of the manifest.
+func (m *Manifest) Verify(dir string) []Mismatch {
+	var bad []Mismatch
+	for _, files := range [][]File{m.Inputs, m.Outputs} {
+		for _, f := range files {
+			path := filepath.FromSlash(f.Path)
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(dir, path)
+			}
+			got, err := HashFile(path)
+			if err != nil {
+				bad = append(bad, Mismatch{File: f, Err: err})
+				continue
+			}
+			if got.Size != f.Size || got.SHA256 != f.SHA256 {
+				bad = append(bad, Mismatch{File: f, Got: got})
+			}
+		}
+	}
+	return bad
+}
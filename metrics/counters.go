@@ -0,0 +1,100 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+)
+
+// Counter is a named count of things, such as the number of edges found
+// or blocks decoded.
+type Counter struct {
+	Name  string `json:"name"`
+	Value int64  `json:"value"`
+}
+
+// Allocs holds memory allocation statistics.
+type Allocs struct {
+	// The number of heap objects allocated.
+	Count uint64 `json:"count"`
+
+	// The total number of bytes allocated for heap objects.
+	Bytes uint64 `json:"bytes"`
+}
+
+// Count adds n to the named counter, creating it if necessary.
+func (r *Registry) Count(name string, n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c := r.countersByName[name]
+	if c == nil {
+		c = &Counter{Name: name}
+		r.countersByName[name] = c
+		r.counters = append(r.counters, c)
+	}
+	c.Value += int64(n)
+}
+
+// Counters returns a copy of the counters, in the order they were first
+// counted.
+func (r *Registry) Counters() []Counter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	counters := make([]Counter, len(r.counters))
+	for i, c := range r.counters {
+		counters[i] = *c
+	}
+	return counters
+}
+
+// Allocs returns the allocations that have been made (by the whole
+// program) since the registry was created or reset.
+func (r *Registry) Allocs() Allocs {
+	now := readAllocs()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return Allocs{
+		Count: now.Count - r.allocBase.Count,
+		Bytes: now.Bytes - r.allocBase.Bytes,
+	}
+}
+
+func readAllocs() Allocs {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return Allocs{Count: ms.Mallocs, Bytes: ms.TotalAlloc}
+}
+
+func counterSummary(out io.Writer, counters []Counter) error {
+	if len(counters) == 0 {
+		return nil
+	}
+
+	nsz := len("Counter")
+	for _, c := range counters {
+		if len(c.Name) > nsz {
+			nsz = len(c.Name)
+		}
+	}
+
+	_, err := fmt.Fprintf(out, "%-*s %12s\n", nsz, "Counter", "Value")
+	if err != nil {
+		return err
+	}
+	for _, c := range counters {
+		_, err := fmt.Fprintf(out, "%-*s %12v\n", nsz, c.Name, c.Value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Count adds n to the named counter in the Default registry.
+func Count(name string, n int) {
+	Default.Count(name, n)
+}
@@ -0,0 +1,206 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Stage holds the timing metrics of one named processing stage.
+type Stage struct {
+	Name string `json:"name"`
+
+	// The number of times this stage has been run.
+	Runs int `json:"runs"`
+
+	// The total time spent in this stage, over all the runs.
+	Duration time.Duration `json:"duration_ns"`
+
+	// The total number of samples processed by this stage.
+	Samples int64 `json:"samples"`
+}
+
+// Throughput returns the number of samples processed per second.
+func (s Stage) Throughput() float64 {
+	if s.Duration <= 0 {
+		return 0
+	}
+	return float64(s.Samples) / s.Duration.Seconds()
+}
+
+// Registry records metrics for named stages, in the order they were
+// first recorded. It is safe for concurrent use.
+type Registry struct {
+	mu     sync.Mutex
+	stages []*Stage
+	byName map[string]*Stage
+
+	counters       []*Counter
+	countersByName map[string]*Counter
+
+	// The allocation statistics at the time the registry was created
+	// (or reset), so Allocs can report the difference.
+	allocBase Allocs
+}
+
+// Default is the registry that the package-level functions use.
+var Default = New()
+
+func New() *Registry {
+	return &Registry{
+		byName:         map[string]*Stage{},
+		countersByName: map[string]*Counter{},
+		allocBase:      readAllocs(),
+	}
+}
+
+// Start starts timing a run of the named stage, which will process the
+// given number of samples. Call the returned function when it is done.
+func (r *Registry) Start(name string, samples int) func() {
+	start := time.Now()
+	return func() {
+		r.Add(name, samples, time.Since(start))
+	}
+}
+
+// Add records a run of the named stage, that took the given duration to
+// process the given number of samples.
+func (r *Registry) Add(name string, samples int, dur time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := r.byName[name]
+	if s == nil {
+		s = &Stage{Name: name}
+		r.byName[name] = s
+		r.stages = append(r.stages, s)
+	}
+	s.Runs++
+	s.Duration += dur
+	s.Samples += int64(samples)
+}
+
+// Stages returns a copy of the metrics recorded for each stage.
+func (r *Registry) Stages() []Stage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stages := make([]Stage, len(r.stages))
+	for i, s := range r.stages {
+		stages[i] = *s
+	}
+	return stages
+}
+
+// Reset forgets all the metrics that have been recorded so far.
+func (r *Registry) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.stages = nil
+	r.byName = map[string]*Stage{}
+	r.counters = nil
+	r.countersByName = map[string]*Counter{}
+	r.allocBase = readAllocs()
+}
+
+// Summary writes a human-readable summary of the recorded metrics.
+func (r *Registry) Summary(out io.Writer) error {
+	stages, counters := r.Stages(), r.Counters()
+	if len(stages) == 0 && len(counters) == 0 {
+		return nil
+	}
+	if err := stageSummary(out, stages); err != nil {
+		return err
+	}
+	if err := counterSummary(out, counters); err != nil {
+		return err
+	}
+	a := r.Allocs()
+	_, err := fmt.Fprintf(
+		out, "Allocations: %v (%.1f MiB)\n",
+		a.Count, float64(a.Bytes)/(1024*1024),
+	)
+	return err
+}
+
+func stageSummary(out io.Writer, stages []Stage) error {
+	if len(stages) == 0 {
+		return nil
+	}
+
+	nsz := len("Stage")
+	var total time.Duration
+	for _, s := range stages {
+		if len(s.Name) > nsz {
+			nsz = len(s.Name)
+		}
+		total += s.Duration
+	}
+
+	_, err := fmt.Fprintf(
+		out, "%-*s %4s %14s %12s %14s\n",
+		nsz, "Stage", "Runs", "Duration", "Samples", "Samples/sec",
+	)
+	if err != nil {
+		return err
+	}
+	for _, s := range stages {
+		_, err := fmt.Fprintf(
+			out, "%-*s %4v %14v %12v %14.0f\n",
+			nsz, s.Name, s.Runs, s.Duration.Round(time.Microsecond),
+			s.Samples, s.Throughput(),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(
+		out, "%-*s %4s %14v\n", nsz, "Total", "", total.Round(time.Microsecond),
+	)
+	return err
+}
+
+// WriteJSON writes the recorded metrics as JSON.
+func (r *Registry) WriteJSON(out io.Writer) error {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		Stages   []Stage   `json:"stages"`
+		Counters []Counter `json:"counters"`
+		Allocs   Allocs    `json:"allocs"`
+	}{r.Stages(), r.Counters(), r.Allocs()})
+}
+
+// SaveJSON writes the recorded metrics as JSON to the given file, or to
+// stdout if the filename is "-".
+func (r *Registry) SaveJSON(filename string) (retErr error) {
+	if filename == "-" {
+		return r.WriteJSON(os.Stdout)
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := f.Close(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+
+	return r.WriteJSON(f)
+}
+
+// Start starts timing a run of the named stage in the Default registry.
+func Start(name string, samples int) func() {
+	return Default.Start(name, samples)
+}
+
+// Add records a run of the named stage in the Default registry.
+func Add(name string, samples int, dur time.Duration) {
+	Default.Add(name, samples, dur)
+}
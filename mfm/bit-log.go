@@ -0,0 +1,121 @@
+package mfm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// BitLog is the MFM bits of the blocks of a recording, without the
+// samples, as a bitstream that can be decoded again, or turned back into
+// a signal.
+//
+// As text, it starts with a "Rate" line with the sample rate, and a header
+// line, followed by one line per block, with the sample indexes of its
+// start and end, and its MFM bits (both clock and data bits) as 0s and 1s.
+type BitLog struct {
+	// The sample rate of the recording the blocks are from.
+	SampleRate int
+
+	Blocks []BitBlock
+}
+
+// BitBlock is the MFM bits of a block, and where it was in the recording.
+type BitBlock struct {
+	Start, End int
+	Bits       PackedBits
+}
+
+// maxBitLogLine is the max length of a line of a bit log, which is long
+// enough for any block that fits in a StudyBox page.
+const maxBitLogLine = 16 << 20
+
+// ReadBitLog reads a bit log, as written by WriteBitLog.
+func ReadBitLog(r io.Reader) (*BitLog, error) {
+	l := &BitLog{}
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), maxBitLogLine)
+	for line := 1; sc.Scan(); line++ {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 || fields[0] == "Start" {
+			continue
+		}
+		if len(fields) != 3 && (fields[0] != "Rate" || len(fields) != 2) {
+			return nil, fmt.Errorf(
+				"bit log line %v: wrong number of fields", line,
+			)
+		}
+
+		if fields[0] == "Rate" {
+			rate, err := strconv.Atoi(fields[1])
+			if err != nil || rate <= 0 {
+				return nil, fmt.Errorf(
+					"bit log line %v: bad sample rate %q", line, fields[1],
+				)
+			}
+			l.SampleRate = rate
+			continue
+		}
+
+		b, err := parseBitBlock(fields)
+		if err != nil {
+			return nil, fmt.Errorf("bit log line %v: %w", line, err)
+		}
+		l.Blocks = append(l.Blocks, b)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	if l.SampleRate == 0 {
+		return nil, fmt.Errorf("bit log: no sample rate")
+	}
+	return l, nil
+}
+
+// LoadBitLog reads the bit log in the given file, as by ReadBitLog.
+func LoadBitLog(filename string) (*BitLog, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadBitLog(f)
+}
+
+// parseBitBlock parses the fields of a block line of a bit log.
+func parseBitBlock(fields []string) (BitBlock, error) {
+	var b BitBlock
+	var err error
+	if b.Start, err = strconv.Atoi(fields[0]); err != nil {
+		return b, fmt.Errorf("bad start: %w", err)
+	}
+	if b.End, err = strconv.Atoi(fields[1]); err != nil {
+		return b, fmt.Errorf("bad end: %w", err)
+	}
+	for i, c := range fields[2] {
+		if c != '0' && c != '1' {
+			return b, fmt.Errorf("bad bit %q at %v", c, i)
+		}
+		b.Bits.Append(byte(c - '0'))
+	}
+	return b, nil
+}
+
+// WriteBitLog writes the given bit log as text.
+func WriteBitLog(w io.Writer, l *BitLog) error {
+	out := bufio.NewWriter(w)
+	fmt.Fprintf(out, "Rate %v\nStart End Bits\n", l.SampleRate)
+	for _, b := range l.Blocks {
+		fmt.Fprintf(out, "%v %v ", b.Start, b.End)
+		for i := 0; i < b.Bits.Len(); i++ {
+			out.WriteByte('0' + b.Bits.Bit(i))
+		}
+		out.WriteByte('\n')
+	}
+	return out.Flush()
+}
@@ -0,0 +1,74 @@
+package mfm
+
+// BlockInfo is the metadata of a block decoded by a Decoder: where it
+// is, what its pulses and bit width were like, and how it went.
+type BlockInfo struct {
+	// The identifier of the block, as given by whatever decodes its data
+	// (see studybox.BlockID); the Decoder leaves this empty.
+	ID string `json:"id,omitempty"`
+
+	// The start and end sample index of the block.
+	Start int `json:"start"`
+	End   int `json:"end"`
+
+	// The start and end of the block, in seconds from the start of the
+	// input; these are only set if the sample rate is known.
+	StartTime float64 `json:"start_time,omitempty"`
+	EndTime   float64 `json:"end_time,omitempty"`
+
+	// The mean, min and max bit width (in samples) that the pulses of
+	// the block were classified with.
+	BitWidth    float64 `json:"bit_width"`
+	MinBitWidth float64 `json:"min_bit_width"`
+	MaxBitWidth float64 `json:"max_bit_width"`
+
+	// The number of pulses of each class, indexed by the PulseClass.
+	Classes [PulseHuge + 1]int `json:"classes"`
+
+	// The number of errors in the block: the pulses that were not valid
+	// (including any that were trimmed off as noise), the dropouts that
+	// were bridged, and the error that the block failed with, if any.
+	Errors int `json:"errors"`
+
+	// The number of bits of the block, both clock and data bits.
+	Bits int `json:"bits"`
+
+	// The number of bytes of data in the block. The Decoder does not know
+	// the format of the data, so this is left for whatever decodes it.
+	Bytes int `json:"bytes"`
+
+	// How the block ended.
+	Ending Ending `json:"ending"`
+
+	// The sum of the bit widths of the pulses, for the mean.
+	bitWidthSum float64
+}
+
+// Pulses returns the total number of pulses in the block.
+func (b *BlockInfo) Pulses() int {
+	n := 0
+	for _, c := range b.Classes {
+		n += c
+	}
+	return n
+}
+
+// addPulse adds a pulse of the given class, that was classified with the
+// given bit width, to the metadata.
+func (b *BlockInfo) addPulse(class PulseClass, bitWidth float64) {
+	b.Classes[class]++
+	switch class {
+	case PulseShort, PulseMedium, PulseLong:
+	default:
+		b.Errors++
+	}
+
+	if bitWidth < b.MinBitWidth || b.MinBitWidth == 0 {
+		b.MinBitWidth = bitWidth
+	}
+	if bitWidth > b.MaxBitWidth {
+		b.MaxBitWidth = bitWidth
+	}
+	b.bitWidthSum += bitWidth
+	b.BitWidth = b.bitWidthSum / float64(b.Pulses())
+}
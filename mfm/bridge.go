@@ -0,0 +1,92 @@
+package mfm
+
+import (
+	"math"
+
+	"github.com/edorfaus/sb-mfm-decode/events"
+	"github.com/edorfaus/sb-mfm-decode/metrics"
+)
+
+// Bridge is a dropout within a block that the Decoder bridged, instead
+// of ending the block there.
+type Bridge struct {
+	// The sample indexes of the last edge before the dropout, and of the
+	// first edge after it.
+	Start, End int
+
+	// The index of the first bit of the block (counting both clock and
+	// data bits) that was filled in for the dropout, and the number of
+	// those bits. Their values are unknown, and they are set to 0.
+	FirstBit, Bits int
+}
+
+// bridge checks whether the edge source is at a dropout that should be
+// bridged, and if so, bridges it: it adds unknown bits for the missing
+// half-bits, moves to the first edge after the dropout, and returns true
+// along with the new previous data bit. Otherwise, it returns false, and
+// leaves the edge source at the edge to none.
+//
+// This needs the edge source to be a Snapshotter, to look past the edge
+// to none (through the lookahead) without losing its place if the
+// dropout is not bridged.
+func (d *Decoder) bridge(prevBit byte) (byte, bool) {
+	last := d.Edge.Prev()
+	if d.MaxGap <= 0 || d.BitWidth < 2 || last.Type == EdgeToNone {
+		return prevBit, false
+	}
+	st, ok := d.peekEdge(1)
+	if !ok || st.Cur.Type == EdgeToNone {
+		return prevBit, false
+	}
+
+	next := st.Cur
+	gap := float64(next.Index - last.Index)
+	n := int(math.Round(gap / (float64(d.BitWidth) / 2)))
+	if gap > d.MaxGap*float64(d.BitWidth) || n < 2 {
+		return prevBit, false
+	}
+	d.nextEdge()
+
+	// The pulse from the last edge to the next one is n half-bits long,
+	// with the half-bits in between unknown. The bits up to the last
+	// edge have already been added, except for the one of that edge, if
+	// it is a clock bit; and the one of the next edge is only added now
+	// if it is a data bit, as with the other pulses.
+	from, to := 1, n
+	if prevBit == 0 {
+		from = 0
+	}
+	if (int(prevBit)+n)%2 == 0 {
+		to = n - 1
+	}
+	b := Bridge{
+		Start:    last.Index,
+		End:      next.Index,
+		FirstBit: len(d.Bits) + 1 - from,
+		Bits:     n - 1,
+	}
+	d.addCells(prevBit, last.Index, next.Index, n)
+	for i := from; i <= to; i++ {
+		if i == 0 || i == n {
+			d.addBits(0, 1)
+		} else {
+			d.addBits(0, 0)
+		}
+	}
+	d.Bridges = append(d.Bridges, b)
+	d.Info.Errors++
+
+	d.log().F(
+		3, "Bridged dropout at %v-%v: %v half-bits\n", b.Start, b.End, n,
+	)
+	metrics.Count("bridged-dropouts", 1)
+	events.Send(d.Events, events.Event{
+		Type:     events.Dropout,
+		Pos:      float64(b.Start),
+		End:      float64(b.End),
+		BitWidth: float64(d.BitWidth),
+		Bits:     b.Bits,
+	})
+
+	return byte((int(prevBit) + n) % 2), true
+}
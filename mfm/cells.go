@@ -0,0 +1,48 @@
+package mfm
+
+// Cell is a half-bit cell of a block, as the Decoder laid the bit clock
+// over the signal: each pulse of n half-bits is split into n cells of the
+// same width, so the cells follow the speed of the tape from pulse to
+// pulse. Dropouts that were bridged are split the same way.
+type Cell struct {
+	// The index of the bit of the block (counting both clock and data
+	// bits, so even for a clock bit) that the cell holds.
+	Bit int
+
+	// The sample offset of the start of the cell, which is where the cell
+	// before it ends.
+	Pos float64
+}
+
+// CellSink is something that receives the cells of the blocks as they
+// are decoded, such as for drawing them over the signal.
+type CellSink interface {
+	Cell(c Cell)
+}
+
+// CellFunc is an adapter that allows using an ordinary function as a
+// CellSink.
+type CellFunc func(c Cell)
+
+func (f CellFunc) Cell(c Cell) {
+	f(c)
+}
+
+// addCells sends the n cells of a pulse from start to end to the Cells
+// sink, if there is one, given the data bit before the pulse; this must
+// be called before the bits of the pulse are added.
+//
+// The 1-bit of the edge that starts a pulse is added along with the pulse
+// before it if it is a data bit (which is then the data bit before the
+// pulse), so it is already there in that case.
+func (d *Decoder) addCells(prevBit byte, start, end, n int) {
+	if d.Cells == nil {
+		return
+	}
+	first := len(d.Bits) - int(prevBit)
+	w := float64(end-start) / float64(n)
+	for i := 0; i < n; i++ {
+		pos := float64(start) + float64(i)*w
+		d.Cells.Cell(Cell{Bit: first + i, Pos: pos})
+	}
+}
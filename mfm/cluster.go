@@ -0,0 +1,263 @@
+package mfm
+
+import (
+	"math"
+	"sort"
+
+	"github.com/edorfaus/sb-mfm-decode/log"
+)
+
+// ClusterClassifier is a PulseSource that classifies the pulses between
+// the edges of an EdgeSource, like the PulseClassifier, but with limits
+// that are derived from the pulse widths themselves instead of fixed
+// ratios of the bit width.
+//
+// It reads one region (the edges up to the next edge to none) at a time,
+// and clusters the widths of its high and low pulses separately into the
+// three valid classes, using the limits halfway between the clusters.
+// This copes better with a signal whose duty cycle is distorted, so that
+// e.g. the high pulses are all somewhat longer than the low ones.
+//
+// When a region has too few pulses, or they do not cluster as expected,
+// the fallback Limits and the previous bit width are used instead.
+type ClusterClassifier struct {
+	Edges EdgeSource
+
+	// The bit width to start from, which is replaced by the one found
+	// from each region. It must be set before the first call to Next.
+	BitWidth float64
+
+	// The limits to use for regions that cannot be clustered; if zero,
+	// the defaults are used.
+	Limits ClassLimits
+
+	// The minimum number of pulses of a polarity that a region must have
+	// for them to be clustered.
+	MinPulses int
+
+	// The logger to use; if nil, the edge source's logger is used, if
+	// it has one.
+	Log *log.Logger
+
+	pulses []Pulse
+	pos    int
+}
+
+// DefaultMinClusterPulses is the default for ClusterClassifier.MinPulses.
+const DefaultMinClusterPulses = 16
+
+func NewClusterClassifier(
+	edges EdgeSource, bitWidth float64,
+) *ClusterClassifier {
+	return &ClusterClassifier{
+		Edges:     edges,
+		BitWidth:  bitWidth,
+		MinPulses: DefaultMinClusterPulses,
+	}
+}
+
+func (c *ClusterClassifier) Next() bool {
+	if c.pos+1 < len(c.pulses) {
+		c.pos++
+		return true
+	}
+	c.pulses, c.pos = c.pulses[:0], 0
+	return c.readRegion()
+}
+
+// Pulse returns the current pulse.
+func (c *ClusterClassifier) Pulse() Pulse {
+	if c.pos >= len(c.pulses) {
+		return Pulse{}
+	}
+	return c.pulses[c.pos]
+}
+
+func (c *ClusterClassifier) log() *log.Logger {
+	if c.Log != nil {
+		return c.Log
+	}
+	if ls, ok := c.Edges.(logSource); ok {
+		return ls.Logger()
+	}
+	return logger
+}
+
+// readRegion reads the pulses up to and including the next edge to none,
+// and classifies them. It returns false if there were no more pulses.
+func (c *ClusterClassifier) readRegion() bool {
+	c.Edges.SetMaxCrossingTime(int(c.BitWidth + 0.5))
+
+	// The widths of the high (0) and low (1) pulses that do not touch a
+	// none, and which pulses those are, for setting their classes later.
+	var widths [2][]float64
+	var index [2][]int
+	for c.Edges.Next() {
+		prev, cur := c.Edges.Prev(), c.Edges.Cur()
+		c.pulses = append(c.pulses, Pulse{Start: prev.Zero, End: cur.Zero})
+		if prev.Type != EdgeToNone && cur.Type != EdgeToNone {
+			pol := 0
+			if prev.Type == EdgeToLow {
+				pol = 1
+			}
+			widths[pol] = append(widths[pol], cur.Zero-prev.Zero)
+			index[pol] = append(index[pol], len(c.pulses)-1)
+		}
+		if cur.Type == EdgeToNone {
+			break
+		}
+	}
+	if len(c.pulses) == 0 {
+		return false
+	}
+
+	// Find the limits for each polarity, and use their average bit width
+	// for the pulses that touch a none, and for the next region.
+	var limits [2]ClassLimits
+	var bitWidths [2]float64
+	found := false
+	for i := range widths {
+		limits[i], bitWidths[i] = c.Limits, c.BitWidth
+		if len(widths[i]) < c.MinPulses {
+			continue
+		}
+		l, bw, ok := ClusterLimits(widths[i], c.BitWidth)
+		if !ok {
+			c.log().WarnAt(
+				int(c.pulses[0].End), "pulse widths did not cluster",
+			)
+			continue
+		}
+		limits[i], bitWidths[i] = l, bw
+		found = true
+	}
+	if found {
+		c.BitWidth = (bitWidths[0] + bitWidths[1]) / 2
+		c.log().F(
+			3, "Cluster bit width: %.4f (high %.4f, low %.4f) at %.3f\n",
+			c.BitWidth, bitWidths[0], bitWidths[1], c.pulses[0].End,
+		)
+	}
+
+	for i := range c.pulses {
+		p := &c.pulses[i]
+		p.BitWidth = c.BitWidth
+		p.Class = c.Limits.Classify(p.Width(), p.BitWidth)
+	}
+	for i := range index {
+		for _, k := range index[i] {
+			p := &c.pulses[k]
+			p.BitWidth = bitWidths[i]
+			p.Class = limits[i].Classify(p.Width(), p.BitWidth)
+		}
+	}
+
+	return true
+}
+
+// ClusterLimits clusters the given pulse widths into the three valid
+// pulse classes, using 1-D k-means starting from the expected widths for
+// the given bit width, and returns the class limits halfway between the
+// clusters, along with the bit width that those limits are relative to.
+//
+// It returns false if the widths do not cluster as MFM pulses should,
+// e.g. if the clusters are too close together or too far apart.
+func ClusterLimits(
+	widths []float64, bitWidth float64,
+) (ClassLimits, float64, bool) {
+	if len(widths) == 0 || bitWidth <= 0 {
+		return ClassLimits{}, 0, false
+	}
+
+	// The expected widths relative to the bit width; see the comment in
+	// PulseClassifierOf.Next for why these are the ones.
+	ratios := [3]float64{1, 1.5, 2}
+
+	sorted := append([]float64(nil), widths...)
+	sort.Float64s(sorted)
+
+	var centers [3]float64
+	for i := range centers {
+		centers[i] = bitWidth * ratios[i]
+	}
+
+	var counts [3]int
+	for iter := 0; iter < 20; iter++ {
+		// Widths that are far outside of all the clusters are glitches or
+		// gaps, and would only drag the centers away from the real ones.
+		lo := centers[0] - (centers[1]-centers[0])/2
+		hi := centers[2] + (centers[2]-centers[1])/2
+
+		var sums [3]float64
+		counts = [3]int{}
+		k := 0
+		for _, w := range sorted {
+			if w < lo || w >= hi {
+				continue
+			}
+			for k < 2 && w >= (centers[k]+centers[k+1])/2 {
+				k++
+			}
+			sums[k] += w
+			counts[k]++
+		}
+
+		bw := 0.0
+		n := 0
+		for i := range centers {
+			if counts[i] > 0 {
+				bw += sums[i] / ratios[i]
+				n += counts[i]
+			}
+		}
+		if n == 0 {
+			return ClassLimits{}, 0, false
+		}
+		bw /= float64(n)
+
+		// A class that is missing from the region keeps its expected
+		// width relative to the others.
+		changed := false
+		for i := range centers {
+			c := bw * ratios[i]
+			if counts[i] > 0 {
+				c = sums[i] / float64(counts[i])
+			}
+			if math.Abs(c-centers[i]) > 1e-9 {
+				changed = true
+			}
+			centers[i] = c
+		}
+		if !changed {
+			break
+		}
+	}
+
+	// The longest pulses should be about twice as long as the shortest,
+	// with the middle ones roughly halfway between them.
+	spread := (centers[2] - centers[0]) / centers[0]
+	mid := (centers[1] - centers[0]) / (centers[2] - centers[0])
+	if spread < 0.6 || spread > 1.4 || mid < 0.3 || mid > 0.7 {
+		return ClassLimits{}, 0, false
+	}
+
+	bw, n := 0.0, 0
+	for i := range centers {
+		bw += centers[i] / ratios[i] * float64(counts[i])
+		n += counts[i]
+	}
+	bw /= float64(n)
+
+	limits := ClassLimits{
+		Tiny:   centers[0] - (centers[1]-centers[0])/2,
+		Short:  (centers[0] + centers[1]) / 2,
+		Medium: (centers[1] + centers[2]) / 2,
+		Long:   centers[2] + (centers[2]-centers[1])/2,
+	}
+	limits.Tiny /= bw
+	limits.Short /= bw
+	limits.Medium /= bw
+	limits.Long /= bw
+
+	return limits, bw, true
+}
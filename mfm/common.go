@@ -1,22 +1,82 @@
 package mfm
 
+import (
+	"fmt"
+
+	"github.com/edorfaus/sb-mfm-decode/log"
+)
+
+// logger is the logger used by this package.
+var logger = log.Named("mfm")
+
 // DefaultBitRate is the default MFM bit rate, as used for the StudyBox.
 const DefaultBitRate = 4800
 
 // ExpectedBitWidth calculates the expected MFM bit width for the given
-// MFM bit rate and input sampling rate.
+// MFM bit rate and input sampling rate. It panics if the rates are not
+// valid; BitWidthFor is the same, but returns an error instead.
 func ExpectedBitWidth(mfmBitRate, sampleRate int) float64 {
+	bitWidth, err := BitWidthFor(mfmBitRate, sampleRate)
+	if err != nil {
+		panic(err)
+	}
+	return bitWidth
+}
+
+// BitWidthFor calculates the expected MFM bit width for the given MFM bit
+// rate (0 for DefaultBitRate) and input sampling rate, or returns an
+// error if the rates are not valid.
+func BitWidthFor(mfmBitRate, sampleRate int) (float64, error) {
 	if mfmBitRate == 0 {
 		mfmBitRate = DefaultBitRate
 	}
 	if mfmBitRate <= 0 {
-		panic("invalid MFM bit rate")
+		return 0, fmt.Errorf("invalid MFM bit rate: %v", mfmBitRate)
 	}
 	// While more is preferred, minimum 2x bit rate is needed, because
 	// we need to distinguish between pulse widths of 1, 1.5 and 2.
+	// Lower rates must be upsampled first (see UpsampleFactor).
 	if sampleRate < 2*mfmBitRate {
-		panic("invalid sample rate: must be at least 2 * bit rate")
+		return 0, fmt.Errorf(
+			"invalid sample rate: %v: must be at least 2 * bit rate (%v)",
+			sampleRate, mfmBitRate,
+		)
+	}
+	return float64(sampleRate) / float64(mfmBitRate), nil
+}
+
+// CheckBitWidth returns an error if the given bit width (in samples) is
+// too small to tell the MFM pulse widths apart, and so cannot be given
+// to SetBitWidth.
+func CheckBitWidth(bitWidth float64) error {
+	if !(bitWidth >= 2) {
+		return fmt.Errorf("invalid bit width: %v", bitWidth)
+	}
+	return nil
+}
+
+// UpsampleFactor returns the factor that the given sample rate must be
+// upsampled by (by interpolating the samples) before it can be decoded at
+// the given MFM bit rate, or 1 if it can be decoded as it is. A rate that
+// is too low is taken up to at least 4 * bit rate, rather than just to
+// the minimum, since the interpolated pulse edges are not very precise.
+func UpsampleFactor(mfmBitRate, sampleRate int) int {
+	if mfmBitRate == 0 {
+		mfmBitRate = DefaultBitRate
+	}
+	if sampleRate <= 0 || sampleRate >= 2*mfmBitRate {
+		return 1
+	}
+	return (4*mfmBitRate + sampleRate - 1) / sampleRate
+}
+
+// isDone returns true if the given channel (from a context) is closed.
+// This is cheaper than ctx.Err(), and works with a nil channel too.
+func isDone(done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
 	}
-	// This is my attempt at doing proper half-way rounding in int math.
-	return float64(sampleRate) / float64(mfmBitRate)
 }
@@ -0,0 +1,29 @@
+package mfm
+
+import (
+	"math"
+)
+
+// maxConfidence is the confidence of a bit that the decoder is sure of.
+const maxConfidence = 255
+
+// softConfidence converts a pulse confidence, as from pulseConfidence,
+// into the form used for the confidence of bits: from 0 to maxConfidence.
+func softConfidence(c float64) byte {
+	if c <= 0 {
+		return 0
+	}
+	if c >= 1 {
+		return maxConfidence
+	}
+	return byte(math.Round(c * maxConfidence))
+}
+
+// addBits adds the given bits to the current block, with the given
+// confidence for each of them.
+func (d *Decoder) addBits(conf byte, bits ...byte) {
+	d.Bits = append(d.Bits, bits...)
+	for range bits {
+		d.Confidence = append(d.Confidence, conf)
+	}
+}
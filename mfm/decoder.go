@@ -1,13 +1,22 @@
 package mfm
 
 import (
+	"context"
 	"fmt"
+
+	"github.com/edorfaus/sb-mfm-decode/events"
+	"github.com/edorfaus/sb-mfm-decode/log"
+	"github.com/edorfaus/sb-mfm-decode/metrics"
+	"github.com/edorfaus/sb-mfm-decode/progress"
+	"github.com/edorfaus/sb-mfm-decode/sample"
 )
 
 var EOD = fmt.Errorf("end of input data")
 
+// Decoder decodes MFM blocks from the edges of an EdgeSource, which is
+// usually an EdgeDetect.
 type Decoder struct {
-	Edge *EdgeDetect
+	Edge EdgeSource
 
 	// Width of the latest data bit (two half-bits).
 	// This should not be set directly, use SetBitWidth() instead.
@@ -19,53 +28,280 @@ type Decoder struct {
 
 	// The bits of the current MFM block - both clock and data bits.
 	Bits []byte
+
+	// How sure the decoder is of each of the bits, from 0 (not at all,
+	// e.g. for bridged dropouts) to 255 (the pulse that gave the bit was
+	// exactly as wide as expected), for soft-decision error correction.
+	Confidence []byte
+
+	// The dropouts that were bridged in the current block, in order.
+	Bridges []Bridge
+
+	// The maximum number of bits in a block, and its maximum length in
+	// samples; if a block gets longer than either, it fails to decode,
+	// with a sample.LimitError. If 0, there is no limit.
+	MaxBits    int
+	MaxSamples int
+
+	// The limits between the pulse classes; if zero, the defaults are
+	// used.
+	Limits ClassLimits
+
+	// The longest dropout within a block (from the last edge before it
+	// to the first edge after it), in bit widths, that is bridged with
+	// unknown bits instead of ending the block; if 0, dropouts are not
+	// bridged. This needs the edge source to be a Snapshotter.
+	MaxGap float64
+
+	// The most pulses at the end of a block that are trimmed off as noise
+	// if they are not valid, instead of failing the block; if 0, nothing
+	// is trimmed. This needs the edge source to be a Snapshotter.
+	MaxNoisePulses int
+
+	// Whether to heal pulses that were split in two by a glitch, when the
+	// two Tiny halves together make a valid pulse, instead of failing the
+	// block. This needs the edge source to be a Snapshotter.
+	HealTiny bool
+
+	// Whether to decode each block as a whole, by finding the sequence of
+	// valid pulse lengths that best fits it, instead of pulse by pulse.
+	// This can recover blocks where a single pulse is misclassified, but
+	// does not bridge dropouts, trim noise, or heal pulses.
+	MaxLikelihood bool
+
+	// Whether to start each block from the bit width of the last block
+	// that decoded successfully (if there has been one), with widened
+	// limits for the pulse classes for its first DefaultLeadInPulses
+	// pulses, instead of from the lead-in or the end of the block before
+	// it. This recovers blocks whose lead-in was damaged (such as by a
+	// dropout), and blocks after a failed block that left the bit width
+	// far off. Invalid pulses before the first valid one, such as the
+	// partial pulse at the end of a dropout, are skipped, and the block
+	// starts after them.
+	InheritBitWidth bool
+
+	// The bit width at the end of the last block that decoded
+	// successfully with at least DefaultLeadInPulses pulses, or 0 if there
+	// has not been one. This can be set to
+	// carry it over from another decoder, for InheritBitWidth.
+	LastGoodBitWidth int
+
+	// How the current block ended; set when it has been decoded.
+	Ending Ending
+
+	// The metadata of the current block; complete when it has been
+	// decoded.
+	Info BlockInfo
+
+	// The sample rate of the input, for the times in the block metadata;
+	// if 0, those are not set.
+	SampleRate int
+
+	// The logger to use; if nil, the edge source's logger is used (if it
+	// has one, otherwise the package logger).
+	Log *log.Logger
+
+	// Where to send pipeline events (block start/end); may be nil.
+	Events events.Sink
+
+	// Where to send each pulse as it is classified; may be nil. The bit
+	// width of the pulse is the one used to classify it.
+	Pulses PulseSink
+
+	// Where to send the half-bit cells that the bits of each block were
+	// decoded from, as they are; may be nil. This is only sent the cells
+	// of pulses that were decoded, not of those that failed the block or
+	// were trimmed off as noise.
+	Cells CellSink
+
+	progress progress.Reporter
+
+	// Whether the current block started from the LastGoodBitWidth.
+	inherited bool
+
+	// The number of invalid pulses skipped at the start of the current
+	// block.
+	skipped int
+
+	// The edges that have been looked ahead at, to bridge dropouts, trim
+	// noise, or heal pulses.
+	ahead lookahead
+
+	// Buffers that are reused by the max-likelihood decoder.
+	mlEdges []int
+	mlSteps [][2]mlStep
 }
 
-func NewDecoder(ed *EdgeDetect) *Decoder {
+func NewDecoder(ed EdgeSource) *Decoder {
 	d := &Decoder{
 		Edge: ed,
 	}
 	return d
 }
 
+// NewDecoderOf returns a decoder for the edges found by the given edge
+// detector, which works on samples of any type.
+//
+// Deprecated: The Decoder takes any EdgeSource, including an EdgeDetectOf
+// of any sample type, so it no longer needs a type parameter, and the
+// DecoderOf type that this used to return is now just Decoder. Use
+// NewDecoder instead.
+func NewDecoderOf[S sample.Type](ed *EdgeDetectOf[S]) *Decoder {
+	return NewDecoder(ed)
+}
+
+func (d *Decoder) log() *log.Logger {
+	if d.Log != nil {
+		return d.Log
+	}
+	if ls, ok := d.Edge.(logSource); ok {
+		return ls.Logger()
+	}
+	return logger
+}
+
+// SetProgressFunc sets a function that NextBlock will call to report on
+// its progress, after every given number of samples.
+func (d *Decoder) SetProgressFunc(every int, fn progress.Func) {
+	d.progress.Set(every, fn)
+}
+
 // SetBitWidth sets the bit width in samples for the input edges.
 //
 // It also updates the underlying edge detector's settings accordingly.
 //
 // Calling this before starting to decode data is optional, but makes it
 // possible to decode data that does not have an initial lead-in.
+//
+// It panics if the bit width is not valid (see CheckBitWidth); for bit
+// widths that come from outside the program, use TrySetBitWidth instead.
 func (d *Decoder) SetBitWidth(bitWidth int) {
-	if bitWidth < 2 {
-		panic(fmt.Errorf("invalid bit width: %v", bitWidth))
+	if err := CheckBitWidth(float64(bitWidth)); err != nil {
+		panic(err)
 	}
 	// TODO: should we use a weighted average of recent bit widths?
 	// If so, should we change it to be a float, for higher precision?
 	// If so, we might need another float field for current position.
 	d.BitWidth = bitWidth
 	// TODO: figure out what would be a good value for this
-	d.Edge.MaxCrossingTime = bitWidth
+	d.Edge.SetMaxCrossingTime(bitWidth)
 }
 
+// TrySetBitWidth is like SetBitWidth, but returns an error instead of
+// panicking if the bit width is not valid.
+func (d *Decoder) TrySetBitWidth(bitWidth int) error {
+	if err := CheckBitWidth(float64(bitWidth)); err != nil {
+		return err
+	}
+	d.SetBitWidth(bitWidth)
+	return nil
+}
+
+// NextBlock decodes the next block of bits from the edge detector.
+//
+// It returns EOD if there are no more blocks, or an error if the block
+// could not be decoded.
 func (d *Decoder) NextBlock() error {
-	if d.Edge.CurType != EdgeToNone {
+	return d.NextBlockContext(context.Background())
+}
+
+// NextBlockContext is like NextBlock, but it stops early (returning the
+// context's error) if the context is cancelled. The current block is then
+// left incomplete, and the decoder must not be used for more blocks.
+func (d *Decoder) NextBlockContext(ctx context.Context) error {
+	err := d.nextBlock(ctx)
+	if err != nil && err == ctx.Err() {
+		return err
+	}
+	if err != EOD {
+		d.finishInfo(err)
+	}
+
+	ev := events.Event{
+		Type:     events.BlockEnd,
+		Pos:      float64(d.StartIndex),
+		End:      float64(d.EndIndex),
+		BitWidth: float64(d.BitWidth),
+		Bits:     len(d.Bits),
+		Detail:   d.Ending.String(),
+	}
+	switch {
+	case err == EOD:
+		return err
+	case err != nil:
+		ev.Type = events.BlockError
+		ev.Detail = err.Error()
+		metrics.Count("failed-blocks", 1)
+	default:
+		metrics.Count("blocks", 1)
+		// A burst of noise can decode as a few pulses without an error,
+		// but its bit width is meaningless.
+		if d.Info.Pulses() >= DefaultLeadInPulses {
+			d.LastGoodBitWidth = d.BitWidth
+		}
+	}
+	events.Send(d.Events, ev)
+
+	return err
+}
+
+// DecodeTo decodes all the remaining blocks, giving each of them to the
+// given sink, until the end of the data (or the context is cancelled).
+// Blocks that fail to decode are also given to the sink, with their error.
+func (d *Decoder) DecodeTo(ctx context.Context, sink BitSink) error {
+	for {
+		err := d.NextBlockContext(ctx)
+		if err == EOD {
+			return nil
+		}
+		if err != nil && err == ctx.Err() {
+			return err
+		}
+		sinkErr := sink.Block(d.StartIndex, d.EndIndex, d.Bits, err)
+		if sinkErr != nil {
+			return sinkErr
+		}
+		if err != nil {
+			// Skip the rest of the failed block, to continue after it.
+			for d.Edge.Cur().Type != EdgeToNone && d.nextEdge() {
+			}
+		}
+	}
+}
+
+func (d *Decoder) nextBlock(ctx context.Context) error {
+	if d.Edge.Cur().Type != EdgeToNone {
 		return fmt.Errorf("edge detector in bad state for next block")
 	}
 
 	d.Bits = d.Bits[:0]
+	d.Confidence = d.Confidence[:0]
+	d.Bridges = d.Bridges[:0]
+	d.Ending = EndUnknown
+	d.Info = BlockInfo{}
+	d.inherited = false
+	d.skipped = 0
 
 	defer func() {
-		d.EndIndex = d.Edge.CurIndex
+		d.EndIndex = d.Edge.Cur().Index
 	}()
 
 	if !d.Edge.Next() {
-		d.StartIndex = d.Edge.PrevIndex
+		d.StartIndex = d.Edge.Prev().Index
+		d.progress.Done(d.Edge.Len())
 		return EOD
 	}
 
 	// At this point, the previous edge is ToNone, the current is not.
 	// (Assuming the edge detector is functioning correctly.)
 
-	d.StartIndex = d.Edge.CurIndex
+	d.StartIndex = d.Edge.Cur().Index
+
+	events.Send(d.Events, events.Event{
+		Type:     events.BlockStart,
+		Pos:      float64(d.StartIndex),
+		BitWidth: float64(d.BitWidth),
+	})
 
 	// In MFM encoding, the distance between edges is either 2, 3 or 4
 	// half-bit-widths. Both tape speed variability and the likely
@@ -90,10 +326,27 @@ func (d *Decoder) NextBlock() error {
 	// Thus, at (w*1/2+w*2/2)/2 = w*(1/2+2/2)/2 = w*(3/2)/2 = w*3/4
 	// and at   (w*4/2+w*5/2)/2 = w*(4/2+5/2)/2 = w*(9/2)/2 = w*9/4
 	//
-	// For comparisons, we use the fact that t < w*5/4 => t*4 < w*5,
-	// to avoid the precision loss of the integer division.
+	// These split points are the DefaultClassLimits, and are used unless
+	// the Limits field is set.
 
-	if d.BitWidth == 0 {
+	if d.InheritBitWidth && d.LastGoodBitWidth > 0 {
+		// Whether or not the lead-in is intact, start from the bit width
+		// of the last good block; if it is intact, its first pulse is
+		// Short and resyncs the bit width just as measuring it would.
+		// The tape speed may have drifted since then, so the limits are
+		// widened until the bit width has had a few pulses to follow it.
+		d.SetBitWidth(d.LastGoodBitWidth)
+		d.inherited = true
+		d.log().F(
+			3, "Inherited bit width: %v at %v\n", d.BitWidth, d.StartIndex,
+		)
+		metrics.Count("inherited-bit-widths", 1)
+		events.Send(d.Events, events.Event{
+			Type:     events.Resync,
+			Pos:      float64(d.StartIndex),
+			BitWidth: float64(d.BitWidth),
+		})
+	} else if d.BitWidth == 0 {
 		// We don't have any data about the bit-width, so a lead-in is
 		// required, to figure out what the bit-width should be. That
 		// lead-in must start with at least one 0-bit, so grab it and
@@ -103,48 +356,118 @@ func (d *Decoder) NextBlock() error {
 			// returns a final EdgeToNone after any other edge.
 			return fmt.Errorf("edge detector gave only one edge")
 		}
-		d.SetBitWidth(d.Edge.CurIndex - d.Edge.PrevIndex)
-		d.Bits = append(d.Bits, 1, 0)
+		bitWidth := d.Edge.Cur().Index - d.Edge.Prev().Index
+		if bitWidth < 2 {
+			return fmt.Errorf("bad lead-in: bit width %v", bitWidth)
+		}
+		d.SetBitWidth(bitWidth)
+		d.addCells(0, d.Edge.Prev().Index, d.Edge.Cur().Index, 2)
+		d.addBits(maxConfidence, 1, 0)
+		d.log().F(
+			3, "Lead-in bit width: %v at %v\n", d.BitWidth, d.StartIndex,
+		)
+		events.Send(d.Events, events.Event{
+			Type:     events.Resync,
+			Pos:      float64(d.StartIndex),
+			BitWidth: float64(d.BitWidth),
+		})
 	}
 
 	prevBit := byte(0)
+	if d.MaxLikelihood {
+		return d.decodeML(ctx, prevBit)
+	}
+
+	done := ctx.Done()
 	// TODO: should the last edge (to none) be included in the data?
-	for d.Edge.CurType != EdgeToNone && d.Edge.Next() {
-		delta := d.Edge.CurIndex - d.Edge.PrevIndex
-		switch {
-		case delta*4 < d.BitWidth*3:
+	for d.Edge.Cur().Type != EdgeToNone && d.nextEdge() {
+		if isDone(done) {
+			return ctx.Err()
+		}
+		d.progress.Update(d.Edge.Cur().Index, d.Edge.Len())
+
+		if err := d.checkLimits(len(d.Bits)); err != nil {
+			return err
+		}
+
+		if d.Edge.Cur().Type == EdgeToNone {
+			var bridged bool
+			if prevBit, bridged = d.bridge(prevBit); bridged {
+				continue
+			}
+		}
+
+		start := d.Edge.Prev().Index
+		delta := d.Edge.Cur().Index - start
+		class := d.classify(delta)
+		if class == PulseTiny && d.HealTiny {
+			class = d.healTiny(start)
+			delta = d.Edge.Cur().Index - start
+		}
+		if d.skipDamaged(class) {
+			continue
+		}
+		d.Info.addPulse(class, float64(d.BitWidth))
+		if d.inherited && d.Info.Pulses() >= DefaultLeadInPulses {
+			d.inherited = false
+		}
+		if d.Pulses != nil {
+			d.Pulses.Pulse(Pulse{
+				Class:    class,
+				Start:    float64(start),
+				End:      float64(d.Edge.Cur().Index),
+				BitWidth: float64(d.BitWidth),
+			})
+		}
+		conf := softConfidence(
+			pulseConfidence(float64(delta), float64(d.BitWidth)),
+		)
+		switch class {
+		case PulseTiny:
 			// TODO: do I want to handle glitches here or in EdgeDetect?
+			if d.trimNoise() {
+				continue
+			}
 			return fmt.Errorf(
 				"bad data: edge distance too short: delta %v, bw %v",
 				delta, d.BitWidth,
 			)
-		case delta*4 < d.BitWidth*5:
+		case PulseShort:
 			// 2 half-bit widths: same data bit as previous
-			d.Bits = append(d.Bits, 1-prevBit, prevBit)
+			d.addCells(prevBit, start, d.Edge.Cur().Index, 2)
+			d.addBits(conf, 1-prevBit, prevBit)
 			d.SetBitWidth(delta)
-		case delta*4 < d.BitWidth*7:
+		case PulseMedium:
 			// 3 half-bit widths
+			d.addCells(prevBit, start, d.Edge.Cur().Index, 3)
 			if prevBit == 0 {
-				d.Bits = append(d.Bits, 1, 0, 0, 1)
+				d.addBits(conf, 1, 0, 0, 1)
 				prevBit = 1
 			} else {
-				d.Bits = append(d.Bits, 0, 0)
+				d.addBits(conf, 0, 0)
 				prevBit = 0
 			}
 			d.SetBitWidth(delta * 2 / 3)
-		case delta*4 < d.BitWidth*9:
+		case PulseLong:
 			// 4 half-bit widths
 			// This only happens when the previous bit was 1, and the
 			// next data is a 0 followed by a 1.
 			if prevBit != 1 {
+				if d.trimNoise() {
+					continue
+				}
 				return fmt.Errorf(
 					"bad data: delta too large after 0: %v, with bw %v",
 					delta, d.BitWidth,
 				)
 			}
-			d.Bits = append(d.Bits, 0, 0, 0, 1)
+			d.addCells(prevBit, start, d.Edge.Cur().Index, 4)
+			d.addBits(conf, 0, 0, 0, 1)
 			d.SetBitWidth(delta / 2)
 		default:
+			if d.trimNoise() {
+				continue
+			}
 			return fmt.Errorf(
 				"bad data: edge distance too long: delta %v, bw %v",
 				delta, d.BitWidth,
@@ -152,11 +475,105 @@ func (d *Decoder) NextBlock() error {
 		}
 	}
 
-	if d.Edge.CurType != EdgeToNone {
+	if d.Edge.Cur().Type != EdgeToNone {
 		// This means d.Edge.Next() returned false without a final edge
 		// to none, which should never happen with a working detector.
 		return fmt.Errorf("edge detector did not end with EdgeToNone")
 	}
 
+	if d.Ending == EndUnknown {
+		d.Ending = EndClean
+	}
+	return nil
+}
+
+// finishInfo fills in the rest of the metadata of the current block, now
+// that it has been decoded, with the given result.
+func (d *Decoder) finishInfo(err error) {
+	b := &d.Info
+	b.Start, b.End = d.StartIndex, d.EndIndex
+	if d.SampleRate > 0 {
+		b.StartTime = float64(b.Start) / float64(d.SampleRate)
+		b.EndTime = float64(b.End) / float64(d.SampleRate)
+	}
+	b.Bits = len(d.Bits)
+	b.Ending = d.Ending
+	if err != nil {
+		b.Errors++
+	}
+}
+
+// peekEdge returns the state that the edge source would have after
+// moving on n edges (from 1) from the current one, without moving it; ok
+// is false if there are not that many edges left, or if the edge source
+// is not a Snapshotter, as it cannot then be looked ahead in.
+func (d *Decoder) peekEdge(n int) (st EdgeState, ok bool) {
+	src, ok := d.Edge.(aheadSource)
+	if !ok {
+		return EdgeState{}, false
+	}
+	return d.ahead.peek(src, n)
+}
+
+// nextEdge moves the edge source on to the next edge, as by its Next
+// method, but taking the edge from the lookahead buffer if it is there.
+func (d *Decoder) nextEdge() bool {
+	if src, ok := d.Edge.(aheadSource); ok {
+		return d.ahead.next(src).ok
+	}
+	return d.Edge.Next()
+}
+
+// skipDamaged returns whether the current pulse, of the given class, is
+// skipped as damage before the start of the block, which then starts at
+// its end. Only invalid pulses before the first valid one of a block with
+// an inherited bit width are skipped, and at most DefaultLeadInPulses of
+// them, as its lead-in may have been cut short by a dropout.
+func (d *Decoder) skipDamaged(class PulseClass) bool {
+	if !d.inherited || len(d.Bits) > 0 || d.skipped >= DefaultLeadInPulses {
+		return false
+	}
+	if class == PulseShort || class == PulseMedium {
+		return false
+	}
+	d.skipped++
+	d.StartIndex = d.Edge.Cur().Index
+	d.log().F(
+		3, "Skipped %v pulse before block at %v\n", class, d.StartIndex,
+	)
+	metrics.Count("skipped-lead-in-pulses", 1)
+	return true
+}
+
+// classify returns the class of a pulse with the given width (the edge
+// distance in samples), according to the current bit width.
+func (d *Decoder) classify(delta int) PulseClass {
+	return d.limits().Classify(float64(delta), float64(d.BitWidth))
+}
+
+// limits returns the limits between the pulse classes for the current
+// pulse, which are widened at the start of a block with an inherited bit
+// width.
+func (d *Decoder) limits() ClassLimits {
+	if d.inherited {
+		return d.Limits.widened()
+	}
+	return d.Limits
+}
+
+// checkLimits returns a sample.LimitError if the current block, with the
+// given number of bits, has gone past the MaxBits or MaxSamples limit.
+func (d *Decoder) checkLimits(bits int) error {
+	pos := d.Edge.Cur().Index
+	if d.MaxBits > 0 && bits > d.MaxBits {
+		return &sample.LimitError{
+			Limit: "bits in a block", Max: d.MaxBits, Index: pos,
+		}
+	}
+	if d.MaxSamples > 0 && pos-d.StartIndex > d.MaxSamples {
+		return &sample.LimitError{
+			Limit: "samples in a block", Max: d.MaxSamples, Index: pos,
+		}
+	}
 	return nil
 }
@@ -1,5 +1,12 @@
 package mfm
 
+import (
+	"github.com/edorfaus/sb-mfm-decode/log"
+	"github.com/edorfaus/sb-mfm-decode/metrics"
+	"github.com/edorfaus/sb-mfm-decode/progress"
+	"github.com/edorfaus/sb-mfm-decode/sample"
+)
+
 type EdgeType int
 
 const (
@@ -16,65 +23,175 @@ const (
 
 // TODO: add minimum pulse length or something to avoid glitches?
 
-type EdgeDetect struct {
+// EdgeDetect is an EdgeDetectOf that works on int samples.
+type EdgeDetect = EdgeDetectOf[int]
+
+// EdgeDetectOf finds the edges in a list of samples, where the S type
+// parameter is the type used for the samples.
+type EdgeDetectOf[S sample.Type] struct {
 	// The list of samples that this edge detector is finding edges in.
-	Samples []int
+	Samples []S
 
 	// The maximum absolute sample value that is considered to not be a
 	// signal (meaning it is within the noise).
 	NoiseFloor int
 
+	// If not empty, this gives the noise floor at each sample, and is
+	// then used instead of NoiseFloor. The noise floor that is used to
+	// find an edge is the one where the search starts (at the previous
+	// edge), as it is expected to change slowly.
+	NoiseProfile sample.NoiseProfile
+
 	// The maximum time (in samples) allowed for crossing the zero point
 	// when switching from high to low (or vice versa); if it takes
 	// longer than this, it is instead detected as an edge to none.
 	MaxCrossingTime int
 
+	// Whether to place the edges between high and low by the slope between
+	// the peaks on either side, weighted by the height of those peaks,
+	// instead of by only the two samples around zero; this reduces the
+	// bias of asymmetric pulses. See ZeroWeighted.
+	WeightedZero bool
+
 	// The index (in samples) and type of the current edge.
 	CurIndex int
 	CurType  EdgeType
-	// The interpolated sample offset of the current edge.
-	CurZero float64
+	// The interpolated sample offset of the current edge, and how it was
+	// found.
+	CurZero   float64
+	CurMethod ZeroMethod
 
 	// The index (in samples) and type of the previous edge.
 	PrevIndex int
 	PrevType  EdgeType
-	// The interpolated sample offset of the previous edge.
-	PrevZero float64
+	// The interpolated sample offset of the previous edge, and how it was
+	// found.
+	PrevZero   float64
+	PrevMethod ZeroMethod
+
+	// The logger to use; if nil, the package logger is used. This is
+	// also used by the pulse classifier and decoder, unless they have
+	// their own logger set.
+	Log *log.Logger
+
+	progress progress.Reporter
+
+	// The number of edges found that have not been counted in the
+	// metrics yet; they are counted when the end of the data is reached.
+	edges int
 }
 
 func NewEdgeDetect(samples []int, noiseFloor int) *EdgeDetect {
-	return &EdgeDetect{
+	return NewEdgeDetectOf(samples, noiseFloor)
+}
+
+func NewEdgeDetectOf[S sample.Type](
+	samples []S, noiseFloor int,
+) *EdgeDetectOf[S] {
+	return &EdgeDetectOf[S]{
 		Samples:    samples,
 		NoiseFloor: noiseFloor,
 	}
 }
 
-func (e *EdgeDetect) Next() bool {
+func (e *EdgeDetectOf[S]) log() *log.Logger {
+	if e.Log != nil {
+		return e.Log
+	}
+	return logger
+}
+
+// SetProgressFunc sets a function that Next will call to report on its
+// progress, after every given number of samples.
+func (e *EdgeDetectOf[S]) SetProgressFunc(every int, fn progress.Func) {
+	e.progress.Set(every, fn)
+}
+
+func (e *EdgeDetectOf[S]) Next() bool {
 	e.PrevIndex, e.PrevType = e.CurIndex, e.CurType
-	e.PrevZero = e.CurZero
+	e.PrevZero, e.PrevMethod = e.CurZero, e.CurMethod
 
 	if e.CurIndex >= len(e.Samples) {
 		// We are already past the end of the data, so there are no more
 		// edges to be found.
 		e.CurType = EdgeToNone
+		e.progress.Done(len(e.Samples))
+		e.countEdges()
 		return false
 	}
 
+	e.progress.Update(e.CurIndex, len(e.Samples))
+
+	var found bool
 	switch e.CurType {
 	case EdgeToNone:
-		return e.nextFromNone()
+		found = e.nextFromNone()
 	case EdgeToLow:
-		return e.nextFromLow()
+		found = e.nextFromLow()
 	case EdgeToHigh:
-		return e.nextFromHigh()
+		found = e.nextFromHigh()
+	default:
+		panic("bad state: unknown value in EdgeDetect.CurType")
 	}
 
-	panic("bad state: unknown value in EdgeDetect.CurType")
+	if found {
+		e.edges++
+	} else {
+		e.countEdges()
+	}
+	return found
+}
+
+// countEdges adds the edges found so far to the metrics.
+func (e *EdgeDetectOf[S]) countEdges() {
+	if e.edges > 0 {
+		metrics.Count("edges", e.edges)
+		e.edges = 0
+	}
+}
+
+// Cur returns the current edge.
+func (e *EdgeDetectOf[S]) Cur() Edge {
+	return Edge{
+		Index: e.CurIndex, Type: e.CurType, Zero: e.CurZero,
+		Method: e.CurMethod,
+	}
+}
+
+// Prev returns the previous edge.
+func (e *EdgeDetectOf[S]) Prev() Edge {
+	return Edge{
+		Index: e.PrevIndex, Type: e.PrevType, Zero: e.PrevZero,
+		Method: e.PrevMethod,
+	}
+}
+
+// SetMaxCrossingTime sets the MaxCrossingTime field.
+func (e *EdgeDetectOf[S]) SetMaxCrossingTime(samples int) {
+	e.MaxCrossingTime = samples
+}
+
+// Len returns the number of samples.
+func (e *EdgeDetectOf[S]) Len() int {
+	return len(e.Samples)
+}
+
+// Logger returns the logger that the edge detector uses.
+func (e *EdgeDetectOf[S]) Logger() *log.Logger {
+	return e.log()
+}
+
+// noise returns the noise floor at the current edge as a sample value.
+func (e *EdgeDetectOf[S]) noise() S {
+	if len(e.NoiseProfile) > 0 {
+		return sample.Clamp[S](e.NoiseProfile.At(e.CurIndex))
+	}
+	return sample.Clamp[S](e.NoiseFloor)
 }
 
 // nextFromNone is called by Next to find an edge (or EOD) from a none.
-func (e *EdgeDetect) nextFromNone() bool {
-	i, s, noise := e.CurIndex, e.Samples, e.NoiseFloor
+func (e *EdgeDetectOf[S]) nextFromNone() bool {
+	i, s, noise := e.CurIndex, e.Samples, e.noise()
 
 	// Look for the first non-noise sample on either side of zero.
 	for i < len(s) && s[i] <= noise && s[i] >= -noise {
@@ -86,7 +203,7 @@ func (e *EdgeDetect) nextFromNone() bool {
 	e.CurIndex = i
 	if i >= len(s) {
 		e.CurType = EdgeToNone
-		e.CurZero = float64(i)
+		e.CurZero, e.CurMethod = float64(i), ZeroBoundary
 		return false
 	}
 
@@ -99,7 +216,7 @@ func (e *EdgeDetect) nextFromNone() bool {
 	if i <= 0 {
 		// Immediate edge at the start of the data, so there's no better
 		// index to place it at.
-		e.CurZero = float64(i)
+		e.CurZero, e.CurMethod = float64(i), ZeroBoundary
 		return true
 	}
 
@@ -129,6 +246,7 @@ func (e *EdgeDetect) nextFromNone() bool {
 	}
 
 	end := int(0.5 + zc)
+	method := ZeroExtrapolated
 
 	// Next: in the area around that extrapolated zero-crossing, look
 	// for an actual zero-crossing, since the cleanup often makes one.
@@ -141,6 +259,7 @@ func (e *EdgeDetect) nextFromNone() bool {
 			if s[j] <= 0 {
 				end = j + 1
 				zc = float64(j) + intersectXAxis(s[j], s[j+1])
+				method = ZeroLinear
 				break
 			}
 		}
@@ -149,19 +268,20 @@ func (e *EdgeDetect) nextFromNone() bool {
 			if s[j] >= 0 {
 				end = j + 1
 				zc = float64(j) + intersectXAxis(s[j], s[j+1])
+				method = ZeroLinear
 				break
 			}
 		}
 	}
 
 	e.CurIndex = end
-	e.CurZero = zc
+	e.CurZero, e.CurMethod = zc, method
 	return true
 }
 
 // nextFromLow is called by Next to find a high (or none) from a low.
-func (e *EdgeDetect) nextFromLow() bool {
-	i, s, noise := e.CurIndex, e.Samples, e.NoiseFloor
+func (e *EdgeDetectOf[S]) nextFromLow() bool {
+	i, s, noise := e.CurIndex, e.Samples, e.noise()
 	maxTime := e.MaxCrossingTime
 
 	// Look for the first non-noise sample on the other side of zero.
@@ -182,7 +302,7 @@ func (e *EdgeDetect) nextFromLow() bool {
 		}
 		e.CurIndex = i + 1
 		e.CurType = EdgeToHigh
-		e.CurZero = float64(i) + intersectXAxis(s[i], s[i+1])
+		e.CurZero, e.CurMethod = e.crossing(i)
 		return true
 	}
 
@@ -193,7 +313,7 @@ func (e *EdgeDetect) nextFromLow() bool {
 	if ld+1 >= len(s) {
 		// The last data was at the end, so the edge is at the end too.
 		e.CurIndex = len(s)
-		e.CurZero = float64(len(s))
+		e.CurZero, e.CurMethod = float64(len(s)), ZeroBoundary
 		return true
 	}
 
@@ -214,6 +334,7 @@ func (e *EdgeDetect) nextFromLow() bool {
 	}
 
 	end := int(0.5 + zc)
+	method := ZeroExtrapolated
 
 	// Next: in the area around that extrapolated zero-crossing, look
 	// for an actual zero-crossing, just in case there is one.
@@ -225,18 +346,19 @@ func (e *EdgeDetect) nextFromLow() bool {
 		if s[j] >= 0 {
 			end = j
 			zc = float64(j) - 1 + intersectXAxis(s[j-1], s[j])
+			method = ZeroLinear
 			break
 		}
 	}
 
 	e.CurIndex = end
-	e.CurZero = zc
+	e.CurZero, e.CurMethod = zc, method
 	return true
 }
 
 // nextFromHigh is called by Next to find a low (or none) from a high.
-func (e *EdgeDetect) nextFromHigh() bool {
-	i, s, noise := e.CurIndex, e.Samples, e.NoiseFloor
+func (e *EdgeDetectOf[S]) nextFromHigh() bool {
+	i, s, noise := e.CurIndex, e.Samples, e.noise()
 	maxTime := e.MaxCrossingTime
 
 	// Look for the first non-noise sample on the other side of zero.
@@ -257,7 +379,7 @@ func (e *EdgeDetect) nextFromHigh() bool {
 		}
 		e.CurIndex = i + 1
 		e.CurType = EdgeToLow
-		e.CurZero = float64(i) + intersectXAxis(s[i], s[i+1])
+		e.CurZero, e.CurMethod = e.crossing(i)
 		return true
 	}
 
@@ -268,7 +390,7 @@ func (e *EdgeDetect) nextFromHigh() bool {
 	if ld+1 >= len(s) {
 		// The last data was at the end, so the edge is at the end too.
 		e.CurIndex = len(s)
-		e.CurZero = float64(len(s))
+		e.CurZero, e.CurMethod = float64(len(s)), ZeroBoundary
 		return true
 	}
 
@@ -289,6 +411,7 @@ func (e *EdgeDetect) nextFromHigh() bool {
 	}
 
 	end := int(0.5 + zc)
+	method := ZeroExtrapolated
 
 	// Next: in the area around that extrapolated zero-crossing, look
 	// for an actual zero-crossing, just in case there is one.
@@ -301,12 +424,13 @@ func (e *EdgeDetect) nextFromHigh() bool {
 		if s[j] <= 0 {
 			end = j
 			zc = float64(j) - 1 + intersectXAxis(s[j-1], s[j])
+			method = ZeroLinear
 			break
 		}
 	}
 
 	e.CurIndex = end
-	e.CurZero = zc
+	e.CurZero, e.CurMethod = zc, method
 	return true
 }
 
@@ -314,7 +438,7 @@ func (e *EdgeDetect) nextFromHigh() bool {
 // The line is given as the Y values of two points that are assumed to
 // be 1 unit apart along the X axis. The returned value is the distance
 // along the X axis to the intersection point from the first point.
-func intersectXAxis(y1, y2 int) float64 {
+func intersectXAxis[S sample.Type](y1, y2 S) float64 {
 	// Line 1: given: from x1,y1 to x2,y2 (where x2 = x1 + 1)
 	// Line 2: X axis: from x3,y3 = -inf,0 to x4,y4 = inf,0
 	// To simplify, since we know what the second line is, we eliminate
@@ -333,7 +457,8 @@ func intersectXAxis(y1, y2 int) float64 {
 	// X = ( -y1 * -1 ) / ( 0 - -(y1 - y2) )
 	// X = ( y1 * 1 ) / ( 0 + (y1 - y2) ) = y1 / ( y1 - y2 )
 
-	return float64(y1) / float64(y1-y2)
+	// The subtraction is done as floats, since it could overflow S.
+	return float64(y1) / (float64(y1) - float64(y2))
 }
 
 func (t EdgeType) String() string {
@@ -0,0 +1,109 @@
+package mfm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ReadEdgeLog reads an edge log, as written by the zc-edges program, and
+// returns the edges in it as an EdgeList, so they can be decoded again
+// without having the original input.
+//
+// Each line of the log has the edge number, the previous and current edge
+// type (e.g. "L-H"), the sample index and the zero crossing, followed by
+// some columns that are ignored here, except for the method the crossing
+// was placed by (see ZeroMethod), if the log has it; older logs do not, so
+// their edges are taken to be ZeroLinear. The header line, and the final line
+// (with "End" as the edge number), are also ignored, except that the
+// sample index of the latter is used as the total number of samples.
+func ReadEdgeLog(r io.Reader) (*EdgeList, error) {
+	l := &EdgeList{}
+
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 || fields[0] == "Edge" {
+			continue
+		}
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("edge log line %v: too few fields", line)
+		}
+
+		e, err := parseEdge(fields)
+		if err != nil {
+			return nil, fmt.Errorf("edge log line %v: %w", line, err)
+		}
+
+		if fields[0] == "End" {
+			l.Samples = e.Index
+			continue
+		}
+		l.Edges = append(l.Edges, e)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	if l.Samples == 0 && len(l.Edges) > 0 {
+		l.Samples = l.Edges[len(l.Edges)-1].Index
+	}
+
+	return l, nil
+}
+
+// LoadEdgeLog reads the edge log in the given file, as by ReadEdgeLog.
+func LoadEdgeLog(filename string) (*EdgeList, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadEdgeLog(f)
+}
+
+// parseEdge parses the type, index, zero crossing and (if present) zero
+// method fields of an edge log line.
+func parseEdge(fields []string) (Edge, error) {
+	var e Edge
+
+	_, typ, ok := strings.Cut(fields[1], "-")
+	if !ok {
+		return e, fmt.Errorf("bad edge types %q", fields[1])
+	}
+	var err error
+	if e.Type, err = parseEdgeType(typ); err != nil {
+		return e, err
+	}
+
+	if e.Index, err = strconv.Atoi(fields[2]); err != nil {
+		return e, fmt.Errorf("bad sample index: %w", err)
+	}
+	if e.Zero, err = strconv.ParseFloat(fields[3], 64); err != nil {
+		return e, fmt.Errorf("bad zero crossing: %w", err)
+	}
+	if len(fields) > 6 {
+		if e.Method, err = parseZeroMethod(fields[6]); err != nil {
+			return e, err
+		}
+	}
+
+	return e, nil
+}
+
+// parseEdgeType returns the edge type with the given name, as given by
+// its String method.
+func parseEdgeType(s string) (EdgeType, error) {
+	switch s {
+	case EdgeToNone.String():
+		return EdgeToNone, nil
+	case EdgeToHigh.String():
+		return EdgeToHigh, nil
+	case EdgeToLow.String():
+		return EdgeToLow, nil
+	}
+	return EdgeToNone, fmt.Errorf("bad edge type %q", s)
+}
@@ -0,0 +1,131 @@
+package mfm
+
+import "fmt"
+
+// ZeroMethod is how the zero crossing of an edge was placed, for comparing
+// the methods on the same signal.
+type ZeroMethod int
+
+const (
+	// ZeroLinear is a crossing between the two samples that straddle zero,
+	// by the line through them.
+	ZeroLinear ZeroMethod = iota
+
+	// ZeroWeighted is a crossing between high and low that is placed where
+	// the slope between the peaks on either side crosses the level halfway
+	// between those peaks (see EdgeDetectOf.WeightedZero).
+	ZeroWeighted
+
+	// ZeroExtrapolated is an edge to or from none that did not cross zero,
+	// so it is placed by extending the slope where it crossed the noise.
+	ZeroExtrapolated
+
+	// ZeroBoundary is an edge at the start or end of the samples.
+	ZeroBoundary
+)
+
+var zeroMethodNames = [...]string{
+	ZeroLinear:       "linear",
+	ZeroWeighted:     "weighted",
+	ZeroExtrapolated: "extrapolated",
+	ZeroBoundary:     "boundary",
+}
+
+func (m ZeroMethod) String() string {
+	if m >= 0 && int(m) < len(zeroMethodNames) {
+		return zeroMethodNames[m]
+	}
+	return fmt.Sprintf("ZeroMethod(%d)", int(m))
+}
+
+// parseZeroMethod returns the zero method with the given name, as given by
+// its String method.
+func parseZeroMethod(s string) (ZeroMethod, error) {
+	for m, name := range zeroMethodNames {
+		if s == name {
+			return ZeroMethod(m), nil
+		}
+	}
+	return ZeroLinear, fmt.Errorf("bad zero method %q", s)
+}
+
+// crossing returns where the signal crosses zero between the samples at i
+// and i+1, on an edge between high and low, and how that was found.
+func (e *EdgeDetectOf[S]) crossing(i int) (float64, ZeroMethod) {
+	if e.WeightedZero {
+		if zc, ok := e.weightedZero(i); ok {
+			return zc, ZeroWeighted
+		}
+	}
+	return float64(i) + intersectXAxis(e.Samples[i], e.Samples[i+1]),
+		ZeroLinear
+}
+
+// weightedZero returns the weighted crossing between the samples at i and
+// i+1, which are on either side of zero; ok is false if it could not be
+// found, so that the linear crossing should be used instead.
+//
+// The slope is followed back and ahead to the peaks on either side, and a
+// line is fitted to the samples of the middle half of the swing between
+// them, which is where the slope is the steepest and least affected by the
+// shape of the peaks. The edge is where that line crosses the level that is
+// halfway between the peaks, so a pulse whose peaks are not the same height
+// on both sides (e.g. from a leftover DC offset, or the response of the
+// deck) is not placed early or late by the difference.
+func (e *EdgeDetectOf[S]) weightedZero(i int) (zc float64, ok bool) {
+	s := e.Samples
+	// The values are flipped for a falling edge, so the slope rises.
+	sign := 1.0
+	if s[i+1] < s[i] {
+		sign = -1
+	}
+	v := func(j int) float64 {
+		return sign * float64(s[j])
+	}
+
+	first, last := e.PrevIndex, len(s)-1
+	if e.MaxCrossingTime > 0 {
+		first = max(first, i-e.MaxCrossingTime)
+		last = min(last, i+1+e.MaxCrossingTime)
+	}
+	lo, hi := i, i+1
+	for lo > first && v(lo-1) < v(lo) {
+		lo--
+	}
+	for hi < last && v(hi+1) > v(hi) {
+		hi++
+	}
+
+	low, high := v(lo), v(hi)
+	mid := (low + high) / 2
+	bandLow, bandHigh := low+(high-low)/4, high-(high-low)/4
+
+	// Least squares fit of the samples in the band, relative to i.
+	var n, sx, sy, sxx, sxy float64
+	for j := lo; j <= hi; j++ {
+		if y := v(j); y >= bandLow && y <= bandHigh {
+			x := float64(j - i)
+			n, sx, sy, sxx, sxy = n+1, sx+x, sy+y, sxx+x*x, sxy+x*y
+		}
+	}
+	if d := n*sxx - sx*sx; n >= 2 && d != 0 {
+		slope := (n*sxy - sx*sy) / d
+		if slope > 0 {
+			zc, ok = float64(i)+(mid-(sy-slope*sx)/n)/slope, true
+		}
+	}
+	if !ok {
+		// Too few samples on the slope, so use the two around the level.
+		for j := lo; j < hi; j++ {
+			if v(j) <= mid && v(j+1) > mid {
+				zc, ok = float64(j)+(mid-v(j))/(v(j+1)-v(j)), true
+				break
+			}
+		}
+	}
+
+	if !ok || zc < float64(lo) || zc > float64(hi) {
+		return 0, false
+	}
+	return zc, true
+}
@@ -0,0 +1,79 @@
+package mfm
+
+import (
+	"github.com/edorfaus/sb-mfm-decode/metrics"
+)
+
+// A glitch in the middle of a pulse can split it in two, giving a pair of
+// Tiny pulses instead of the real one. When healing is enabled, such a
+// pair is merged back into one pulse, if the two together are as wide as
+// a valid pulse, instead of the Tiny pulse failing the block.
+
+// healedClass returns the class of the pulse made by merging two Tiny
+// pulses of the given widths, or PulseTiny if they should not be merged.
+func healedClass(
+	limits ClassLimits, first, second, bitWidth float64,
+) PulseClass {
+	if limits.Classify(second, bitWidth) != PulseTiny {
+		return PulseTiny
+	}
+	class := limits.Classify(first+second, bitWidth)
+	if !class.Valid() {
+		return PulseTiny
+	}
+	return class
+}
+
+// healTiny checks whether the Tiny pulse that ends at the current edge,
+// which started at the given index, is half of a split pulse. If so, it
+// moves to the end of the other half, and returns the class of the whole
+// pulse; otherwise, it leaves the edge source where it was, and returns
+// PulseTiny. This needs the edge source to be a Snapshotter, to look at
+// the other half through the lookahead.
+func (d *Decoder) healTiny(start int) PulseClass {
+	if d.Edge.Cur().Type == EdgeToNone {
+		return PulseTiny
+	}
+	next, ok := d.peekEdge(1)
+	if !ok || next.Cur.Type == EdgeToNone {
+		return PulseTiny
+	}
+	mid := d.Edge.Cur().Index
+	class := healedClass(
+		d.limits(), float64(mid-start), float64(next.Cur.Index-mid),
+		float64(d.BitWidth),
+	)
+	if class == PulseTiny {
+		return PulseTiny
+	}
+	d.nextEdge()
+	d.log().WarnAt(start, "healed a pulse split by a glitch")
+	metrics.Count("healed-pulses", 1)
+	return class
+}
+
+// healTiny checks whether the current pulse, which is Tiny, is half of a
+// split pulse. If so, it moves to the end of the other half, and makes
+// that whole pulse the current one, with its class; otherwise, it leaves
+// the current pulse as it is.
+func (c *PulseClassifierOf[S]) healTiny() {
+	if c.Edges.CurType == EdgeToNone {
+		return
+	}
+	next, ok := c.peekEdge(1)
+	if !ok || next.Cur.Type == EdgeToNone {
+		return
+	}
+	mid := c.Edges.CurZero
+	class := healedClass(
+		c.Limits, mid-c.start, next.Cur.Zero-mid, c.BitWidth,
+	)
+	if class == PulseTiny {
+		return
+	}
+	c.nextEdge()
+	c.log().WarnAt(int(c.start), "healed a pulse split by a glitch")
+	metrics.Count("healed-pulses", 1)
+	c.Class = class
+	c.Width = c.Edges.CurZero - c.start
+}
@@ -0,0 +1,128 @@
+package mfm
+
+import (
+	"math"
+)
+
+// JitterPoint is the timing jitter of the pulses of one class within a
+// window of the input, as the deviation of their widths from the expected
+// width for the class (in samples).
+type JitterPoint struct {
+	// The start and end of the window (sample offsets).
+	Start, End float64
+
+	// The number of pulses of the class in the window.
+	Count int
+
+	// The mean and standard deviation of the deviation of the widths.
+	Mean, StdDev float64
+}
+
+// JitterSeries is the timing jitter of each of the valid pulse classes
+// over the input, one point per window that had pulses of that class,
+// in order of position; e.g. for plotting how it changes over a tape.
+type JitterSeries struct {
+	Short, Medium, Long []JitterPoint
+}
+
+// JitterAnalyzer collects the timing jitter of pulses into a series of
+// windows of a fixed length. It is a PulseSink, so it can be given the
+// pulses of a Decoder as they are decoded; the pulses must be given in
+// order.
+type JitterAnalyzer struct {
+	// The length of each window, in samples.
+	Window int
+
+	series JitterSeries
+
+	// The start of the current window, and the sums of the deviations
+	// and their squares in it, for each class.
+	start  float64
+	counts [3]int
+	sums   [3]float64
+	sqSums [3]float64
+}
+
+// NewJitterAnalyzer creates a new JitterAnalyzer with the given window
+// length, in samples.
+func NewJitterAnalyzer(window int) *JitterAnalyzer {
+	if window < 1 {
+		window = 1
+	}
+	return &JitterAnalyzer{Window: window}
+}
+
+// AnalyzeJitter reads all the pulses from the given source, and returns
+// their timing jitter in windows of the given length, in samples.
+func AnalyzeJitter(src PulseSource, window int) JitterSeries {
+	a := NewJitterAnalyzer(window)
+	for src.Next() {
+		a.Pulse(src.Pulse())
+	}
+	return a.Series()
+}
+
+// Pulse implements PulseSink. Pulses that are not of a valid class, or
+// that do not have a bit width, are ignored.
+func (a *JitterAnalyzer) Pulse(p Pulse) {
+	var i int
+	var expected float64
+	switch p.Class {
+	case PulseShort:
+		i, expected = 0, p.BitWidth
+	case PulseMedium:
+		i, expected = 1, p.BitWidth*3/2
+	case PulseLong:
+		i, expected = 2, p.BitWidth*2
+	default:
+		return
+	}
+	if p.BitWidth <= 0 {
+		return
+	}
+
+	w := float64(a.Window)
+	if p.Start >= a.start+w {
+		a.flush()
+		a.start = math.Floor(p.Start/w) * w
+	}
+
+	dev := p.Width() - expected
+	a.counts[i]++
+	a.sums[i] += dev
+	a.sqSums[i] += dev * dev
+}
+
+// Series returns the series of the pulses given so far.
+func (a *JitterAnalyzer) Series() JitterSeries {
+	a.flush()
+	return a.series
+}
+
+// flush adds the points of the current window to the series, and resets
+// the sums for the next window.
+func (a *JitterAnalyzer) flush() {
+	series := [3]*[]JitterPoint{
+		&a.series.Short, &a.series.Medium, &a.series.Long,
+	}
+	for i, s := range series {
+		n := a.counts[i]
+		if n == 0 {
+			continue
+		}
+		mean := a.sums[i] / float64(n)
+		variance := a.sqSums[i]/float64(n) - mean*mean
+		if variance < 0 {
+			// This can happen due to rounding errors.
+			variance = 0
+		}
+		*s = append(*s, JitterPoint{
+			Start:  a.start,
+			End:    a.start + float64(a.Window),
+			Count:  n,
+			Mean:   mean,
+			StdDev: math.Sqrt(variance),
+		})
+		a.counts[i], a.sums[i], a.sqSums[i] = 0, 0, 0
+	}
+}
@@ -0,0 +1,93 @@
+package mfm
+
+import (
+	"fmt"
+
+	"github.com/edorfaus/sb-mfm-decode/metrics"
+)
+
+// Ending is how the Decoder saw a block end.
+type Ending int
+
+const (
+	// EndUnknown means that the block did not end properly, as it could
+	// not be decoded (or has not been yet).
+	EndUnknown Ending = iota
+
+	// EndClean means that the block ended cleanly: its last pulse was a
+	// valid one, after which the signal faded out (the lead-out).
+	EndClean
+
+	// EndNoise means that the block ran into noise: it had pulses that
+	// were not valid shortly before the signal faded out, which were
+	// trimmed off instead of being decoded.
+	EndNoise
+)
+
+func (e Ending) String() string {
+	switch e {
+	case EndUnknown:
+		return "unknown"
+	case EndClean:
+		return "clean"
+	case EndNoise:
+		return "noise"
+	}
+	return fmt.Sprintf("[bad Ending=%d]", int(e))
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (e Ending) MarshalText() ([]byte, error) {
+	return []byte(e.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (e *Ending) UnmarshalText(text []byte) error {
+	for _, v := range []Ending{EndUnknown, EndClean, EndNoise} {
+		if string(text) == v.String() {
+			*e = v
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown block ending: %q", text)
+}
+
+// trimNoise checks whether the invalid pulse that ends at the current
+// edge is part of noise at the end of the block, by looking for the end
+// of the signal within the next MaxNoisePulses pulses. If so, it moves
+// the edge source to that end, sets the block to have ended in noise,
+// and returns true; the bits of the noise are not added to the block.
+// Otherwise, it returns false, and leaves the edge source where it was.
+//
+// This needs the edge source to be a Snapshotter, to look ahead for the
+// end through the lookahead, unless the invalid pulse is the one that ends
+// at the edge to none.
+func (d *Decoder) trimNoise() bool {
+	if d.MaxNoisePulses <= 0 {
+		return false
+	}
+	start, skipped := d.Edge.Prev().Index, 0
+	for at := d.Edge.Cur(); at.Type != EdgeToNone; {
+		skipped++
+		if skipped > d.MaxNoisePulses {
+			return false
+		}
+		st, ok := d.peekEdge(skipped)
+		if !ok {
+			return false
+		}
+		at = st.Cur
+	}
+	for i := 0; i < skipped; i++ {
+		d.nextEdge()
+	}
+
+	d.Ending = EndNoise
+	d.Info.Errors += skipped
+	d.log().F(
+		3, "Trimmed noise at end of block: %v-%v\n",
+		start, d.Edge.Cur().Index,
+	)
+	metrics.Count("trimmed-noise", 1)
+	return true
+}
@@ -0,0 +1,191 @@
+package mfm
+
+// The PulseClassifierOf and the Decoder keep a buffer of the edges after
+// their current one, that they have looked ahead at, so that they can look
+// at the pulses to come (to find the bit width from the lead-in, to heal
+// split pulses, to bridge dropouts, to find noise at the end of a block,
+// or for a user that wants to weigh more than one reading of them) without
+// losing their place, and without finding those edges again when they
+// move on to them. Each edge is kept as a snapshot of the edge source
+// after it, so moving on to it is only a matter of restoring that
+// snapshot.
+
+// aheadEdge is an edge in the lookahead buffer, as the state of the edge
+// source after it was found, and what Next returned when finding it.
+type aheadEdge struct {
+	st EdgeState
+	ok bool
+}
+
+// aheadSource is an edge source that can be looked ahead in.
+type aheadSource interface {
+	EdgeSource
+	Snapshotter
+}
+
+// lookahead is a lookahead buffer of edges.
+type lookahead struct {
+	// The current edge of the edge source when the buffer was filled;
+	// if the edge source has been moved since, the buffer is stale.
+	from Edge
+
+	// The edges after that, in order; the last one may have ok false, if
+	// there were no more edges after the ones before it.
+	edges []aheadEdge
+}
+
+// check empties the buffer if the edge source has been moved since it
+// was filled, e.g. by restoring a snapshot.
+func (a *lookahead) check(src EdgeSource) {
+	if cur := src.Cur(); cur != a.from {
+		a.from, a.edges = cur, a.edges[:0]
+	}
+}
+
+// peek returns the state that the edge source would have after moving on
+// n edges (from 1) from the current one, without moving it, finding the
+// edges up to that one if they are not in the buffer yet; ok is false if
+// there are not that many edges left.
+//
+// The edges are found with the max crossing time that is current when
+// they are first looked at; if that has changed by the time that one of
+// them is looked at again (or next moves on to it), it and the ones after
+// it are found again instead.
+func (a *lookahead) peek(src aheadSource, n int) (st EdgeState, ok bool) {
+	a.check(src)
+	cur := src.Snapshot()
+	buf := a.edges
+	if len(buf) >= n && buf[n-1].st.MaxCrossingTime != cur.MaxCrossingTime {
+		buf = buf[:n-1]
+	}
+	if len(buf) >= n {
+		return buf[n-1].st, buf[n-1].ok
+	}
+	if len(buf) > 0 && !buf[len(buf)-1].ok {
+		return buf[len(buf)-1].st, false
+	}
+
+	defer src.Restore(cur)
+	if len(buf) > 0 {
+		src.Restore(buf[len(buf)-1].st)
+		src.SetMaxCrossingTime(cur.MaxCrossingTime)
+	}
+	for len(buf) < n {
+		ok = src.Next()
+		buf = append(buf, aheadEdge{st: src.Snapshot(), ok: ok})
+		if !ok {
+			break
+		}
+	}
+	a.edges = buf
+	return buf[len(buf)-1].st, ok
+}
+
+// next moves the edge source on to the next edge, as by its Next method,
+// but taking the edge from the buffer if it is there; it returns that
+// edge, as it would be kept in the buffer.
+func (a *lookahead) next(src aheadSource) aheadEdge {
+	a.check(src)
+	buf := a.edges
+	maxTime := src.Snapshot().MaxCrossingTime
+	if len(buf) == 0 || buf[0].st.MaxCrossingTime != maxTime {
+		// The edges ahead (if any) were found with another max crossing
+		// time, so they may not be the same with this one.
+		a.edges = buf[:0]
+		ok := src.Next()
+		return aheadEdge{src.Snapshot(), ok}
+	}
+
+	next := buf[0]
+	src.Restore(next.st)
+	a.from, a.edges = src.Cur(), buf[1:]
+	return next
+}
+
+// peekEdge returns the state that the edge detector would have after
+// moving on n edges (from 1) from the current one, without moving it; ok
+// is false if there are not that many edges left. See lookahead.peek.
+func (c *PulseClassifierOf[S]) peekEdge(n int) (st EdgeState, ok bool) {
+	return c.ahead.peek(c.Edges, n)
+}
+
+// nextEdge moves the edge detector on to the next edge, as by its Next
+// method, but taking the edge from the lookahead buffer if it is there.
+func (c *PulseClassifierOf[S]) nextEdge() bool {
+	next := c.ahead.next(c.Edges)
+	c.consumed = append(c.consumed, next)
+	return next.ok
+}
+
+// Peek returns the n-th pulse (from 1) after the current one, as it would
+// be classified with the current bit width, without moving on to it; ok
+// is false if there are not that many pulses left. The pulses that it
+// looks at are kept, so Next does not need to find them again, as long as
+// the bit width does not change by much before then. Pulses that are
+// peeked at are not healed, and do not change the bit width.
+//
+// This returns PulseUnknown as the class if the bit width is not known
+// yet, as it is only found from the lead-in when Next gets to it.
+func (c *PulseClassifierOf[S]) Peek(n int) (p Pulse, ok bool) {
+	if n < 1 {
+		return c.Pulse(), true
+	}
+	st, ok := c.peekEdge(n)
+	if !ok {
+		return Pulse{}, false
+	}
+	p = Pulse{Start: st.Prev.Zero, End: st.Cur.Zero, BitWidth: c.BitWidth}
+	if c.BitWidth > 0 {
+		p.Class = c.Limits.Classify(p.Width(), c.BitWidth)
+	}
+	return p, true
+}
+
+// Undo moves back to the pulse before the current one, as it was before
+// Next moved on from it, including the bit width; the pulse that it moved
+// back from is then the first one in the lookahead. It returns false if
+// there is nothing to undo: only the last call to Next can be undone.
+func (c *PulseClassifierOf[S]) Undo() bool {
+	if !c.canUndo {
+		return false
+	}
+	consumed := append([]aheadEdge(nil), c.consumed...)
+	ahead := c.ahead.edges
+	if c.Edges.Cur() != c.ahead.from {
+		ahead = nil
+	}
+	c.Restore(c.undo)
+	c.ahead.from = c.Edges.Cur()
+	c.ahead.edges = append(consumed, ahead...)
+	c.canUndo = false
+	return true
+}
+
+// Revise changes the class of the current pulse, e.g. when the pulses
+// after it show that it was misread, and updates the bit width as if the
+// pulse had been given that class to begin with. It must be called before
+// Next moves on from the pulse; if it was healed, it stays healed.
+func (c *PulseClassifierOf[S]) Revise(class PulseClass) {
+	c.BitWidth = c.revise.BitWidth
+	c.BitWidths = append(c.BitWidths[:0], c.revise.BitWidths...)
+	c.BWIndex, c.BWTotal = c.revise.BWIndex, c.revise.BWTotal
+	c.Edges.MaxCrossingTime = c.revise.Edges.MaxCrossingTime
+	c.Class = class
+	c.addClassWidth()
+}
+
+// saveState saves the state of the classifier in the given snapshot,
+// reusing its slice of bit widths, unlike Snapshot.
+func (c *PulseClassifierOf[S]) saveState(st *PulseState) {
+	widths := append(st.BitWidths[:0], c.BitWidths...)
+	*st = PulseState{
+		Edges:     c.Edges.Snapshot(),
+		BitWidth:  c.BitWidth,
+		Class:     c.Class,
+		Width:     c.Width,
+		Start:     c.start,
+		BitWidths: widths,
+		BWIndex:   c.BWIndex,
+		BWTotal:   c.BWTotal,
+	}
+}
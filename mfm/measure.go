@@ -0,0 +1,72 @@
+package mfm
+
+import (
+	"sort"
+
+	"github.com/edorfaus/sb-mfm-decode/sample"
+)
+
+// leadInTolerance is how far (as a fraction) the width of a pulse can be
+// from the mean width of the run it is in, for MeasureBitWidth to count
+// it as part of the same lead-in.
+const leadInTolerance = 0.2
+
+// MeasureBitWidth measures the bit width (in samples) of the given
+// samples, which need not have been cleaned, from the spacing of their
+// pulses; it returns 0 if it cannot be found.
+//
+// This is a quick pre-scan, that does not know the expected bit width:
+// it finds the pulses by where the signal crosses from above the noise
+// floor to below it (or the other way), and takes the runs of at least
+// leadInRun pulses of about the same width to be lead-ins, whose pulses
+// are each one bit wide. The result is the median width of the pulses in
+// those runs, which is a good guess even if some runs were something else
+// (e.g. a stretch of data that repeats the same bit).
+func MeasureBitWidth[S sample.Type](samples []S, noiseFloor int) float64 {
+	var widths []float64
+	var run []float64
+	runSum := 0.0
+	endRun := func() {
+		if len(run) >= leadInRun {
+			widths = append(widths, run...)
+		}
+		run, runSum = run[:0], 0
+	}
+
+	level, last := 0, -1
+	for i, v := range samples {
+		cur := 0
+		switch {
+		case int(v) > noiseFloor:
+			cur = 1
+		case int(v) < -noiseFloor:
+			cur = -1
+		}
+		if cur == 0 || cur == level {
+			continue
+		}
+		if level == 0 || last < 0 {
+			// The start of a signal, so there is no pulse before it.
+			level, last = cur, i
+			continue
+		}
+		w := float64(i - last)
+		level, last = cur, i
+
+		if len(run) > 0 {
+			mean := runSum / float64(len(run))
+			if w < mean*(1-leadInTolerance) || w > mean*(1+leadInTolerance) {
+				endRun()
+			}
+		}
+		run = append(run, w)
+		runSum += w
+	}
+	endRun()
+
+	if len(widths) == 0 {
+		return 0
+	}
+	sort.Float64s(widths)
+	return widths[len(widths)/2]
+}
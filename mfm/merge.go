@@ -0,0 +1,203 @@
+package mfm
+
+import (
+	"math"
+)
+
+// CollectEdges reads all the remaining edges from the given source into
+// an EdgeList.
+func CollectEdges(src EdgeSource) *EdgeList {
+	l := &EdgeList{Samples: src.Len()}
+	for src.Next() {
+		l.Edges = append(l.Edges, src.Cur())
+	}
+	return l
+}
+
+// MergeEdges merges the edges of several channels that recorded the same
+// signal (e.g. through different preamps) into a single list of edges,
+// which can then be decoded as usual. It also returns how many pulses it
+// took from each of the channels.
+//
+// The merge is done pulse by pulse: at each edge, the next pulse of each
+// channel that has an edge there is compared, and the one that is the
+// closest to the width of a valid MFM pulse is used. The channels must be
+// in sync, to within a quarter of the bit width; their polarity does not
+// matter, as the merged edges get their type from the merged sequence.
+//
+// The bit width is used for the first pulse of each block, and is then
+// updated from the pulses that are used, like the Decoder does. It must
+// be at least 2, or no edges are returned.
+func MergeEdges(
+	channels []*EdgeList, bitWidth float64,
+) (*EdgeList, []int) {
+	m := &edgeMerger{
+		channels: channels,
+		pos:      make([]int, len(channels)),
+		used:     make([]int, len(channels)),
+		bitWidth: bitWidth,
+		out:      &EdgeList{},
+	}
+	for _, ch := range channels {
+		if ch.Samples > m.out.Samples {
+			m.out.Samples = ch.Samples
+		}
+	}
+	if bitWidth >= 2 {
+		m.run()
+	}
+	return m.out, m.used
+}
+
+// edgeMerger holds the state of MergeEdges.
+type edgeMerger struct {
+	channels []*EdgeList
+
+	// The index of the current edge in each channel, and the number of
+	// pulses that were used from each channel.
+	pos  []int
+	used []int
+
+	bitWidth float64
+	out      *EdgeList
+}
+
+func (m *edgeMerger) run() {
+	for {
+		// Start a block at the earliest edge of any of the channels.
+		ch, start := -1, Edge{}
+		for i, l := range m.channels {
+			p := m.skipNone(i)
+			if p >= len(l.Edges) {
+				continue
+			}
+			if ch < 0 || l.Edges[p].Index < start.Index {
+				ch, start = i, l.Edges[p]
+			}
+		}
+		if ch < 0 {
+			return
+		}
+		bitWidth := m.bitWidth
+		m.emit(start)
+
+		// Then follow the pulses for as long as any channel has one.
+		cur, end := start, Edge{}
+		for {
+			next, ok := m.nextPulse(cur, bitWidth)
+			if !ok {
+				end = next
+				break
+			}
+			width := float64(next.Index - cur.Index)
+			bitWidth = pulseBitWidth(width, bitWidth)
+			m.emit(next)
+			cur = next
+		}
+
+		// None of the channels has a pulse from here, so end the block,
+		// unless it has no pulses at all, as that is only a glitch.
+		if cur == start {
+			m.out.Edges = m.out.Edges[:len(m.out.Edges)-1]
+		} else {
+			end.Type = EdgeToNone
+			m.emit(end)
+		}
+		for i := range m.channels {
+			m.skipTo(i, float64(cur.Index)+m.bitWidth/4)
+		}
+	}
+}
+
+// nextPulse returns the end of the best next pulse of the channels that
+// have an edge at the given one. If none of them has a valid pulse, it
+// instead returns false, and the edge where the block should end: the
+// next edge of the first channel that has one, or else the given edge.
+func (m *edgeMerger) nextPulse(cur Edge, bitWidth float64) (Edge, bool) {
+	tolerance := bitWidth / 4
+	best, bestConf, bestCh := cur, math.Inf(-1), -1
+	for i, l := range m.channels {
+		// Find this channel's edge at the current one, if it has one.
+		p := m.skipTo(i, float64(cur.Index)-tolerance)
+		if p+1 >= len(l.Edges) || l.Edges[p].Type == EdgeToNone {
+			continue
+		}
+		if math.Abs(float64(l.Edges[p].Index-cur.Index)) > tolerance {
+			continue
+		}
+
+		next := l.Edges[p+1]
+		conf := -1.0
+		if next.Type != EdgeToNone {
+			width := float64(next.Index - l.Edges[p].Index)
+			conf = pulseConfidence(width, bitWidth)
+		}
+		if bestCh < 0 || conf > bestConf {
+			best, bestConf, bestCh = next, conf, i
+		}
+	}
+	if bestCh < 0 || bestConf <= 0 {
+		return best, false
+	}
+	m.used[bestCh]++
+	return best, true
+}
+
+// emit adds the given edge to the output, with its type set to follow
+// the previous one.
+func (m *edgeMerger) emit(e Edge) {
+	if e.Type != EdgeToNone {
+		e.Type = EdgeToHigh
+		if n := len(m.out.Edges); n > 0 {
+			if m.out.Edges[n-1].Type == EdgeToHigh {
+				e.Type = EdgeToLow
+			}
+		}
+	}
+	m.out.Edges = append(m.out.Edges, e)
+}
+
+// skipTo moves the given channel to its first edge at or after the given
+// index, and returns the position of that edge.
+func (m *edgeMerger) skipTo(ch int, index float64) int {
+	l, p := m.channels[ch], m.pos[ch]
+	for p < len(l.Edges) && float64(l.Edges[p].Index) < index {
+		p++
+	}
+	m.pos[ch] = p
+	return p
+}
+
+// skipNone moves the given channel past any edges to none at its current
+// position, and returns the position of the next other edge.
+func (m *edgeMerger) skipNone(ch int) int {
+	l, p := m.channels[ch], m.pos[ch]
+	for p < len(l.Edges) && l.Edges[p].Type == EdgeToNone {
+		p++
+	}
+	m.pos[ch] = p
+	return p
+}
+
+// pulseConfidence returns how close a pulse of the given width is to the
+// middle of a valid MFM pulse class, for the given bit width: 1 if it is
+// exactly in the middle, falling to 0 at the limits of the class. Pulses
+// that are outside of the valid classes get a negative value.
+func pulseConfidence(width, bitWidth float64) float64 {
+	halfBits := width / (bitWidth / 2)
+	n := math.Round(halfBits)
+	if n < 2 || n > 4 {
+		return -1
+	}
+	return 1 - 2*math.Abs(halfBits-n)
+}
+
+// pulseBitWidth returns the bit width as updated by a valid pulse of the
+// given width.
+func pulseBitWidth(width, bitWidth float64) float64 {
+	n := math.Round(width / (bitWidth / 2))
+	if n < 2 || n > 4 {
+		return bitWidth
+	}
+	return width * 2 / n
+}
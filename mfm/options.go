@@ -0,0 +1,310 @@
+package mfm
+
+import (
+	"github.com/edorfaus/sb-mfm-decode/events"
+	"github.com/edorfaus/sb-mfm-decode/log"
+	"github.com/edorfaus/sb-mfm-decode/sample"
+)
+
+// Option configures a component that is created with one of the With
+// constructors, such as NewEdgeDetectWith or NewDecoderWith. Options
+// that do not apply to the component being created are ignored.
+type Option func(*options)
+
+type options struct {
+	noiseFloor      int
+	noiseProfile    sample.NoiseProfile
+	maxCrossingTime int
+	weightedZero    bool
+	bitWidth        float64
+	sampleRate      int
+	maxBits         int
+	maxSamples      int
+	leadInPulses    int
+	maxGap          float64
+	maxNoisePulses  int
+	healTiny        bool
+	maxLikelihood   bool
+	inheritBitWidth bool
+	limits          ClassLimits
+	log             *log.Logger
+	events          events.Sink
+
+	// The first error from an option, if any.
+	err error
+}
+
+func defaultOptions() options {
+	return options{
+		// 2% of the max value of 16-bit samples.
+		noiseFloor: 32768 * 2 / 100,
+	}
+}
+
+// WithNoiseFloor sets the noise floor of the edge detector; the default
+// is 2% of the max value of 16-bit samples.
+func WithNoiseFloor(noiseFloor int) Option {
+	return func(o *options) {
+		o.noiseFloor = noiseFloor
+	}
+}
+
+// WithNoiseFloorDB sets the noise floor of the edge detector to the given
+// level in dBFS (below 0), for samples of the given number of bits.
+func WithNoiseFloorDB(db float64, bits int) Option {
+	return func(o *options) {
+		if err := sample.CheckDB(db, bits); err != nil {
+			if o.err == nil {
+				o.err = err
+			}
+			return
+		}
+		o.noiseFloor = sample.FromDB(db, bits)
+	}
+}
+
+// WithNoiseProfile sets a noise floor for the edge detector that varies
+// over the samples, which is used instead of the single noise floor if it
+// is not empty.
+func WithNoiseProfile(p sample.NoiseProfile) Option {
+	return func(o *options) {
+		o.noiseProfile = p
+	}
+}
+
+// WithMaxCrossingTime sets the max crossing time of the edge detector;
+// by default, it is set from the bit width, if that is given.
+func WithMaxCrossingTime(maxCrossingTime int) Option {
+	return func(o *options) {
+		o.maxCrossingTime = maxCrossingTime
+	}
+}
+
+// WithWeightedZero sets whether the edge detector places the edges
+// between high and low by the slope between the peaks; by default, it does
+// not. See EdgeDetectOf.WeightedZero.
+func WithWeightedZero(weighted bool) Option {
+	return func(o *options) {
+		o.weightedZero = weighted
+	}
+}
+
+// WithBitWidth sets the initial bit width (in samples). By default, the
+// bit width is not set, so the data must start with a lead-in.
+func WithBitWidth(bitWidth float64) Option {
+	return func(o *options) {
+		o.bitWidth = bitWidth
+	}
+}
+
+// WithBitRate sets the initial bit width to the expected bit width for
+// the given MFM bit rate and sample rate, and the sample rate as with
+// WithSampleRate.
+func WithBitRate(mfmBitRate, sampleRate int) Option {
+	return func(o *options) {
+		bitWidth, err := BitWidthFor(mfmBitRate, sampleRate)
+		if err != nil && o.err == nil {
+			o.err = err
+		}
+		o.bitWidth = bitWidth
+		o.sampleRate = sampleRate
+	}
+}
+
+// WithSampleRate sets the sample rate of the input, which the decoder
+// uses for the times in the block metadata. By default, it is not set.
+func WithSampleRate(sampleRate int) Option {
+	return func(o *options) {
+		o.sampleRate = sampleRate
+	}
+}
+
+// WithMaxBits sets the maximum number of bits in a block, for the
+// decoder. By default, there is no limit.
+func WithMaxBits(maxBits int) Option {
+	return func(o *options) {
+		o.maxBits = maxBits
+	}
+}
+
+// WithMaxSamples sets the maximum length of a block in samples, for the
+// decoder. By default, there is no limit.
+func WithMaxSamples(maxSamples int) Option {
+	return func(o *options) {
+		o.maxSamples = maxSamples
+	}
+}
+
+// WithLeadInPulses sets the number of pulses of the lead-in that the
+// pulse classifier finds the initial bit width from; by default, it is
+// DefaultLeadInPulses.
+func WithLeadInPulses(n int) Option {
+	return func(o *options) {
+		o.leadInPulses = n
+	}
+}
+
+// WithMaxGap sets the longest dropout within a block (in bit widths)
+// that the decoder bridges instead of ending the block. By default,
+// dropouts are not bridged.
+func WithMaxGap(maxGap float64) Option {
+	return func(o *options) {
+		o.maxGap = maxGap
+	}
+}
+
+// WithMaxNoisePulses sets the most invalid pulses at the end of a block
+// that the decoder trims off as noise instead of failing the block. By
+// default, nothing is trimmed.
+func WithMaxNoisePulses(n int) Option {
+	return func(o *options) {
+		o.maxNoisePulses = n
+	}
+}
+
+// WithHealTiny sets whether pulses that were split in two by a glitch
+// are healed, for the classifier and decoder. By default, they are not.
+func WithHealTiny(heal bool) Option {
+	return func(o *options) {
+		o.healTiny = heal
+	}
+}
+
+// WithMaxLikelihood sets whether the decoder finds the most likely
+// sequence of pulses for each block as a whole. By default, it does not.
+func WithMaxLikelihood(ml bool) Option {
+	return func(o *options) {
+		o.maxLikelihood = ml
+	}
+}
+
+// WithInheritBitWidth sets whether the decoder starts each block from
+// the bit width of the last block that decoded successfully. By default,
+// it does not.
+func WithInheritBitWidth(inherit bool) Option {
+	return func(o *options) {
+		o.inheritBitWidth = inherit
+	}
+}
+
+// WithClassLimits sets the limits between the pulse classes, for the
+// classifier and decoder. By default, DefaultClassLimits are used.
+func WithClassLimits(limits ClassLimits) Option {
+	return func(o *options) {
+		o.limits = limits
+	}
+}
+
+// WithLogger sets the logger to use.
+func WithLogger(l *log.Logger) Option {
+	return func(o *options) {
+		o.log = l
+	}
+}
+
+// WithEvents sets where to send pipeline events.
+func WithEvents(sink events.Sink) Option {
+	return func(o *options) {
+		o.events = sink
+	}
+}
+
+// CheckOptions returns an error if any of the given options is not
+// valid, such as a bit rate that is too high for the sample rate. The
+// With constructors panic on such options, so options that come from
+// outside the program should be checked with this first.
+func CheckOptions(opts ...Option) error {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.err != nil {
+		return o.err
+	}
+	if o.bitWidth != 0 {
+		return CheckBitWidth(o.bitWidth)
+	}
+	return nil
+}
+
+func applyOptions(opts []Option) options {
+	if err := CheckOptions(opts...); err != nil {
+		panic(err)
+	}
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// NewEdgeDetectWith creates an edge detector for the given samples,
+// configured by the given options.
+func NewEdgeDetectWith[S sample.Type](
+	samples []S, opts ...Option,
+) *EdgeDetectOf[S] {
+	o := applyOptions(opts)
+	e := NewEdgeDetectOf(samples, o.noiseFloor)
+	e.NoiseProfile = o.noiseProfile
+	e.Log = o.log
+	e.WeightedZero = o.weightedZero
+	switch {
+	case o.maxCrossingTime > 0:
+		e.MaxCrossingTime = o.maxCrossingTime
+	case o.bitWidth > 0:
+		e.MaxCrossingTime = int(o.bitWidth + 0.5)
+	}
+	return e
+}
+
+// NewDecoderWith creates a decoder for the given edge source,
+// configured by the given options.
+//
+// If a bit width is given, it also updates the edge source's max
+// crossing time (unless that option is also given).
+func NewDecoderWith(ed EdgeSource, opts ...Option) *Decoder {
+	o := applyOptions(opts)
+	d := NewDecoder(ed)
+	d.Log = o.log
+	d.Events = o.events
+	d.MaxBits = o.maxBits
+	d.MaxSamples = o.maxSamples
+	d.MaxGap = o.maxGap
+	d.MaxNoisePulses = o.maxNoisePulses
+	d.SampleRate = o.sampleRate
+	d.HealTiny = o.healTiny
+	d.MaxLikelihood = o.maxLikelihood
+	d.InheritBitWidth = o.inheritBitWidth
+	d.Limits = o.limits
+	if o.bitWidth > 0 {
+		d.SetBitWidth(int(o.bitWidth + 0.5))
+	}
+	if o.maxCrossingTime > 0 {
+		ed.SetMaxCrossingTime(o.maxCrossingTime)
+	}
+	return d
+}
+
+// NewPulseClassifierWith creates a pulse classifier for the given edge
+// detector, configured by the given options.
+//
+// If a bit width is given, it also updates the edge detector's max
+// crossing time (unless that option is also given).
+func NewPulseClassifierWith[S sample.Type](
+	ed *EdgeDetectOf[S], opts ...Option,
+) *PulseClassifierOf[S] {
+	o := applyOptions(opts)
+	c := NewPulseClassifierOf(ed)
+	c.Log = o.log
+	c.Events = o.events
+	c.Limits = o.limits
+	c.HealTiny = o.healTiny
+	c.LeadInPulses = o.leadInPulses
+	if o.bitWidth > 0 {
+		c.SetBitWidth(o.bitWidth)
+	}
+	if o.maxCrossingTime > 0 {
+		ed.MaxCrossingTime = o.maxCrossingTime
+	}
+	return c
+}
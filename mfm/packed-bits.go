@@ -0,0 +1,71 @@
+package mfm
+
+// PackedBits is a compact form of a block of MFM bits, as found in the
+// Bits field of the decoder, storing 8 bits per byte instead of one.
+//
+// The decoder reuses its Bits slice for each block, so the bits of a block
+// that are to be kept after the next one is decoded must be copied out;
+// packing them does that while using 1/8 of the memory. This is the form
+// that the blocks of a pipeline and of a BitLog keep their bits in.
+type PackedBits struct {
+	// The packed bits, with the first bit in the high bit of data[0].
+	data []byte
+
+	// The number of bits.
+	n int
+}
+
+// PackBits returns the given bits (one per byte, each 0 or 1) packed into
+// a new PackedBits.
+func PackBits(bits []byte) PackedBits {
+	var p PackedBits
+	p.Append(bits...)
+	return p
+}
+
+// Append adds the given bits (one per byte, each 0 or 1) to the end.
+func (p *PackedBits) Append(bits ...byte) {
+	if need := (p.n + len(bits) + 7) / 8; need > cap(p.data) {
+		data := make([]byte, len(p.data), max(need, 2*cap(p.data)))
+		copy(data, p.data)
+		p.data = data
+	}
+	for _, b := range bits {
+		if p.n%8 == 0 {
+			p.data = append(p.data, 0)
+		}
+		if b != 0 {
+			p.data[p.n/8] |= 0x80 >> (p.n % 8)
+		}
+		p.n++
+	}
+}
+
+// Len returns the number of bits.
+func (p PackedBits) Len() int {
+	return p.n
+}
+
+// Bit returns the bit at the given index, as 0 or 1. It panics if the
+// index is out of range.
+func (p PackedBits) Bit(i int) byte {
+	if i < 0 || i >= p.n {
+		panic("bit index out of range")
+	}
+	return p.data[i/8] >> (7 - i%8) & 1
+}
+
+// Unpack appends the bits (one per byte) to dst, and returns the result,
+// in the form that the decoder and studybox.DecodeBlock use.
+func (p PackedBits) Unpack(dst []byte) []byte {
+	for i := 0; i < p.n; i++ {
+		dst = append(dst, p.data[i/8]>>(7-i%8)&1)
+	}
+	return dst
+}
+
+// Bytes returns the packed bits; the last byte is padded with 0 bits. The
+// returned slice shares its memory with p, so must not be modified.
+func (p PackedBits) Bytes() []byte {
+	return p.data
+}
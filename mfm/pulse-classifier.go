@@ -2,6 +2,10 @@ package mfm
 
 import (
 	"fmt"
+
+	"github.com/edorfaus/sb-mfm-decode/events"
+	"github.com/edorfaus/sb-mfm-decode/log"
+	"github.com/edorfaus/sb-mfm-decode/sample"
 )
 
 type PulseClass uint8
@@ -18,8 +22,69 @@ const (
 	PulseHuge
 )
 
-type PulseClassifier struct {
-	Edges *EdgeDetect
+// ClassLimits are the limits between the pulse classes, as the pulse
+// width relative to the bit width. A pulse that is shorter than Tiny is
+// PulseTiny, one that is shorter than Short (but not Tiny) is PulseShort,
+// and so on; pulses that are at least Long are PulseHuge.
+//
+// The zero value means to use DefaultClassLimits.
+type ClassLimits struct {
+	Tiny, Short, Medium, Long float64
+}
+
+// DefaultClassLimits are the limits halfway between the expected pulse
+// widths, as explained in PulseClassifierOf.Next.
+var DefaultClassLimits = ClassLimits{
+	Tiny:   3.0 / 4,
+	Short:  5.0 / 4,
+	Medium: 7.0 / 4,
+	Long:   9.0 / 4,
+}
+
+// Classify returns the class of a pulse of the given width, for the given
+// bit width, according to these limits.
+func (l ClassLimits) Classify(width, bitWidth float64) PulseClass {
+	if l == (ClassLimits{}) {
+		l = DefaultClassLimits
+	}
+	switch {
+	case width < bitWidth*l.Tiny:
+		return PulseTiny
+	case width < bitWidth*l.Short:
+		return PulseShort
+	case width < bitWidth*l.Medium:
+		return PulseMedium
+	case width < bitWidth*l.Long:
+		return PulseLong
+	default:
+		return PulseHuge
+	}
+}
+
+// widened returns these limits with the outer ones moved out, by a fifth
+// of Tiny and a ninth of Long, so that only pulses that are further off
+// are invalid; the defaults then become 0.6 and 2.5. The limits between
+// the valid classes stay where they are.
+func (l ClassLimits) widened() ClassLimits {
+	if l == (ClassLimits{}) {
+		l = DefaultClassLimits
+	}
+	l.Tiny *= 4.0 / 5
+	l.Long *= 10.0 / 9
+	return l
+}
+
+// DefaultLeadInPulses is the default number of pulses of the lead-in
+// that a PulseClassifierOf finds the bit width from.
+const DefaultLeadInPulses = 8
+
+// PulseClassifier is a PulseClassifierOf that works on int samples.
+type PulseClassifier = PulseClassifierOf[int]
+
+// PulseClassifierOf classifies the pulses between the edges found by an
+// edge detector, where the S type parameter is the type of the samples.
+type PulseClassifierOf[S sample.Type] struct {
+	Edges *EdgeDetectOf[S]
 
 	// The expected/detected width of an MFM data bit (aka short pulse).
 	// This is updated automatically, based on the pulses seen so far.
@@ -31,6 +96,18 @@ type PulseClassifier struct {
 	// The width in samples of the current pulse.
 	Width float64
 
+	// Whether to heal pulses that were split in two by a glitch, when the
+	// two Tiny halves together make a valid pulse.
+	HealTiny bool
+
+	// The number of pulses of the lead-in that the bit width is found
+	// from, when it is not known; if 0, DefaultLeadInPulses is used.
+	LeadInPulses int
+
+	// The start of the current pulse, which is usually the previous edge,
+	// but not if the pulse was healed.
+	start float64
+
 	// List of bit recent widths, used to calculate the current width.
 	BitWidths []float64
 
@@ -39,28 +116,60 @@ type PulseClassifier struct {
 
 	// The sum of the values currently in the BitWidths slice.
 	BWTotal float64
+
+	// The limits between the pulse classes; if zero, the defaults are
+	// used.
+	Limits ClassLimits
+
+	// The logger to use; if nil, the edge detector's logger is used.
+	Log *log.Logger
+
+	// Where to send pipeline events (anomalies, resyncs); may be nil.
+	Events events.Sink
+
+	// The edges that have been looked ahead at; see Peek.
+	ahead lookahead
+
+	// The state before the last call to Next, and the edges it moved on
+	// by, for Undo; and the state before the current pulse was added to
+	// the bit width, for Revise.
+	undo     PulseState
+	consumed []aheadEdge
+	canUndo  bool
+	revise   PulseState
 }
 
 func NewPulseClassifier(ed *EdgeDetect) *PulseClassifier {
-	return &PulseClassifier{
+	return NewPulseClassifierOf(ed)
+}
+
+func NewPulseClassifierOf[S sample.Type](
+	ed *EdgeDetectOf[S],
+) *PulseClassifierOf[S] {
+	return &PulseClassifierOf[S]{
 		Edges: ed,
 
 		BitWidths: make([]float64, 0, 16),
 	}
 }
 
-func (c *PulseClassifier) Next() bool {
-	if !c.Edges.Next() {
+func (c *PulseClassifierOf[S]) Next() bool {
+	c.saveState(&c.undo)
+	c.consumed, c.canUndo = c.consumed[:0], false
+	if !c.nextEdge() {
 		return false
 	}
+	c.canUndo = true
 
-	c.Width = c.Edges.CurZero - c.Edges.PrevZero
+	c.start = c.Edges.PrevZero
+	c.Width = c.Edges.CurZero - c.start
 
 	if c.BitWidth == 0 {
 		// When the bit width is not set, the data must start with a
 		// lead-in, which can then be used to figure out the bit width.
 		if !c.peekAtLeadIn() {
 			c.Class = PulseUnknown
+			c.sendAnomaly()
 			return true
 		}
 	}
@@ -88,37 +197,71 @@ func (c *PulseClassifier) Next() bool {
 	// Thus, at (w*1/2+w*2/2)/2 = w*(1/2+2/2)/2 = w*(3/2)/2 = w*3/4
 	// and at   (w*4/2+w*5/2)/2 = w*(4/2+5/2)/2 = w*(9/2)/2 = w*9/4
 	//
-	// For comparisons, we use the fact that t < w*a/b => t*b < w*a
-	// (given b>0) to avoid needing to do divisions.
+	// Those are the DefaultClassLimits, which can be changed by setting
+	// the Limits field.
 
-	pulseWidth, bitWidth := c.Width, c.BitWidth
+	c.Class = c.Limits.Classify(c.Width, c.BitWidth)
+	if c.Class == PulseTiny && c.HealTiny {
+		c.healTiny()
+	}
+	c.saveState(&c.revise)
+	c.addClassWidth()
 
-	switch {
-	case pulseWidth*4 < bitWidth*3:
-		// less than 2 half-bit widths
-		c.Class = PulseTiny
-	case pulseWidth*4 < bitWidth*5:
+	c.sendAnomaly()
+
+	return true
+}
+
+// addClassWidth adds the bit width of the current pulse, as given by its
+// width and class, to the recent bit widths, if it is a valid pulse.
+func (c *PulseClassifierOf[S]) addClassWidth() {
+	switch c.Class {
+	case PulseShort:
 		// 2 half-bit widths
-		c.Class = PulseShort
-		c.addBitWidth(pulseWidth)
-	case pulseWidth*4 < bitWidth*7:
+		c.addBitWidth(c.Width)
+	case PulseMedium:
 		// 3 half-bit widths
-		c.Class = PulseMedium
-		c.addBitWidth(pulseWidth * 2 / 3)
-	case pulseWidth*4 < bitWidth*9:
+		c.addBitWidth(c.Width * 2 / 3)
+	case PulseLong:
 		// 4 half-bit widths
-		c.Class = PulseLong
-		c.addBitWidth(pulseWidth / 2)
-	default:
-		// more than 4 half-bit widths
-		c.Class = PulseHuge
+		c.addBitWidth(c.Width / 2)
 	}
+}
 
-	return true
+// Pulse returns the current pulse.
+func (c *PulseClassifierOf[S]) Pulse() Pulse {
+	return Pulse{
+		Class:    c.Class,
+		Start:    c.start,
+		End:      c.Edges.CurZero,
+		BitWidth: c.BitWidth,
+	}
+}
+
+// sendAnomaly sends an anomaly event if the current pulse is invalid,
+// unless it touches a none, as those are expected at block boundaries.
+func (c *PulseClassifierOf[S]) sendAnomaly() {
+	if c.Events == nil || c.Class.Valid() || c.TouchesNone() {
+		return
+	}
+	events.Send(c.Events, events.Event{
+		Type:     events.Anomaly,
+		Pos:      c.Edges.PrevZero,
+		End:      c.Edges.CurZero,
+		BitWidth: c.BitWidth,
+		Detail:   "pulse class " + c.Class.String(),
+	})
+}
+
+func (c *PulseClassifierOf[S]) log() *log.Logger {
+	if c.Log != nil {
+		return c.Log
+	}
+	return c.Edges.log()
 }
 
 // TouchesNone returns true if either edge of the pulse is EdgeToNone.
-func (c *PulseClassifier) TouchesNone() bool {
+func (c *PulseClassifierOf[S]) TouchesNone() bool {
 	return c.Edges.PrevType == EdgeToNone ||
 		c.Edges.CurType == EdgeToNone
 }
@@ -129,9 +272,12 @@ func (c *PulseClassifier) TouchesNone() bool {
 //
 // Calling this before starting to classify data is optional, but makes
 // it possible to classify data that does not have an initial lead-in.
-func (c *PulseClassifier) SetBitWidth(bitWidth float64) {
-	if bitWidth < 2 {
-		panic(fmt.Errorf("invalid bit width: %v", bitWidth))
+//
+// It panics if the bit width is not valid (see CheckBitWidth); for bit
+// widths that come from outside the program, use TrySetBitWidth instead.
+func (c *PulseClassifierOf[S]) SetBitWidth(bitWidth float64) {
+	if err := CheckBitWidth(bitWidth); err != nil {
+		panic(err)
 	}
 
 	// Reset the bit widths slice, and override it with the given value.
@@ -147,7 +293,17 @@ func (c *PulseClassifier) SetBitWidth(bitWidth float64) {
 	c.updateCrossingTime(bitWidth)
 }
 
-func (c *PulseClassifier) addBitWidth(bitWidth float64) {
+// TrySetBitWidth is like SetBitWidth, but returns an error instead of
+// panicking if the bit width is not valid.
+func (c *PulseClassifierOf[S]) TrySetBitWidth(bitWidth float64) error {
+	if err := CheckBitWidth(bitWidth); err != nil {
+		return err
+	}
+	c.SetBitWidth(bitWidth)
+	return nil
+}
+
+func (c *PulseClassifierOf[S]) addBitWidth(bitWidth float64) {
 	bws := c.BitWidths
 	if len(bws) < cap(bws) {
 		c.BWTotal += bitWidth
@@ -166,7 +322,7 @@ func (c *PulseClassifier) addBitWidth(bitWidth float64) {
 	c.updateCrossingTime(bitWidth)
 }
 
-func (c *PulseClassifier) updateCrossingTime(bitWidth float64) {
+func (c *PulseClassifierOf[S]) updateCrossingTime(bitWidth float64) {
 	// TODO: figure out what would be a good value for this
 	c.Edges.MaxCrossingTime = int(bitWidth + 0.5)
 }
@@ -174,17 +330,24 @@ func (c *PulseClassifier) updateCrossingTime(bitWidth float64) {
 // peekAtLeadIn is called when the BitWidth is 0, to peek ahead at the
 // lead-in and use it to figure out the bit width to use.
 // It returns false if it was unable to figure out the bit width.
-func (c *PulseClassifier) peekAtLeadIn() bool {
+func (c *PulseClassifierOf[S]) peekAtLeadIn() bool {
 	// The lead-in is a sequence of zero bits (short pulses), which can
-	// be seen as a sequence of equidistant edges. To peek ahead at
-	// those edges without consuming them, we make a backup copy of the
-	// edge detector and restore it afterwards.
-	edgesBackup := *c.Edges
+	// be seen as a sequence of equidistant edges. Those edges are looked
+	// at through the lookahead, so they are not consumed, and are not
+	// found again afterwards unless the max crossing time changes.
+	maxTime := c.Edges.MaxCrossingTime
+	ok := false
 	defer func() {
-		*c.Edges = edgesBackup
+		if !ok {
+			c.Edges.MaxCrossingTime = maxTime
+		}
 	}()
 
-	if c.Edges.PrevType == EdgeToNone {
+	// The pulse that is being looked at, and how many edges ahead of the
+	// current one it ends.
+	prev, cur, n := c.Edges.Prev(), c.Edges.Cur(), 0
+
+	if prev.Type == EdgeToNone {
 		// This is (probably) the empty area before the first pulse.
 
 		if c.Edges.MaxCrossingTime == 0 {
@@ -193,20 +356,20 @@ func (c *PulseClassifier) peekAtLeadIn() bool {
 			c.updateCrossingTime(width)
 		}
 
-		if !c.Edges.Next() {
+		st, found := c.peekEdge(1)
+		if !found {
 			return false
 		}
 
 		// Since the max crossing time might be wrong, use this pulse to
 		// set it and then re-do the edge, in case its width changes.
-		width := c.Edges.CurZero - c.Edges.PrevZero
-
-		*c.Edges = edgesBackup
-		c.updateCrossingTime(width)
+		c.Edges.MaxCrossingTime = maxTime
+		c.updateCrossingTime(st.Cur.Zero - st.Prev.Zero)
 
-		if !c.Edges.Next() {
+		if st, found = c.peekEdge(1); !found {
 			return false
 		}
+		prev, cur, n = st.Prev, st.Cur, 1
 	}
 
 	// We want to look at more than one pulse, since some of the early
@@ -216,35 +379,53 @@ func (c *PulseClassifier) peekAtLeadIn() bool {
 	// TODO: adjust this to make use of the BitWidths functionality, and
 	// to keep more than just the final average value.
 
+	pulses := c.LeadInPulses
+	if pulses <= 0 {
+		pulses = DefaultLeadInPulses
+	}
 	total := 0.0
 	count := 0
 	for {
-		if c.TouchesNone() {
+		if prev.Type == EdgeToNone || cur.Type == EdgeToNone {
 			// ToNone pulses are not reliable for timing, and indicate
 			// that there aren't really (enough) proper pulses here.
 			return false
 		}
 
-		width := c.Edges.CurZero - c.Edges.PrevZero
+		width := cur.Zero - prev.Zero
 
 		total += width
 		count++
-		if count >= 8 {
+		if count >= pulses {
 			break
 		}
 
 		c.updateCrossingTime(total / float64(count))
-		if !c.Edges.Next() {
+		n++
+		st, found := c.peekEdge(n)
+		if !found {
 			return false
 		}
+		prev, cur = st.Prev, st.Cur
 	}
 
 	// Breaking out of the loop indicates we have enough pulses for now,
 	// so average them and use that as the bit width.
+	if total/float64(count) < 2 {
+		// Too short to be MFM bits; this must be noise or glitches.
+		return false
+	}
+	ok = true
 	c.SetBitWidth(total / float64(count))
-
-	// Copy the crossing time to the backup so it works after restore.
-	edgesBackup.MaxCrossingTime = c.Edges.MaxCrossingTime
+	c.log().F(
+		3, "Lead-in bit width: %.4f at %.3f\n",
+		c.BitWidth, c.Edges.CurZero,
+	)
+	events.Send(c.Events, events.Event{
+		Type:     events.Resync,
+		Pos:      c.Edges.PrevZero,
+		BitWidth: c.BitWidth,
+	})
 
 	return true
 }
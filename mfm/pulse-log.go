@@ -0,0 +1,130 @@
+package mfm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// PulseRecord is a pulse as listed in a pulse log, along with the number
+// it had in the log and the types of the edges before and after it.
+type PulseRecord struct {
+	Pulse
+
+	// The number of the pulse, counting from 0 at the start of the input.
+	Number int
+
+	// The types of the edges at the start and end of the pulse.
+	PrevType, CurType EdgeType
+}
+
+// TouchesNone returns true if the pulse starts or ends with an edge to
+// none, and so is not a proper pulse of the MFM signal.
+func (r PulseRecord) TouchesNone() bool {
+	return r.PrevType == EdgeToNone || r.CurType == EdgeToNone
+}
+
+// ReadPulseLog reads a pulse log, as written by the classify program when
+// it outputs detail info about all pulses, and returns the pulses in it,
+// so that tools can work on a saved classification run without having to
+// parse its text themselves, or to run the classifier again.
+//
+// Each line of the log has the pulse number, the kind of pulse (its class
+// and the types of its edges, e.g. "S:HL"), the start and end of it, its
+// width, and the bit width it was classified with. The header line is
+// ignored, as is the width, since it follows from the start and end.
+func ReadPulseLog(r io.Reader) ([]PulseRecord, error) {
+	var pulses []PulseRecord
+
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 || fields[0] == "Pulse" {
+			continue
+		}
+		if len(fields) < 6 {
+			return nil, fmt.Errorf("pulse log line %v: too few fields", line)
+		}
+
+		p, err := parsePulse(fields)
+		if err != nil {
+			return nil, fmt.Errorf("pulse log line %v: %w", line, err)
+		}
+		pulses = append(pulses, p)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	return pulses, nil
+}
+
+// LoadPulseLog reads the pulse log in the given file, as by ReadPulseLog.
+func LoadPulseLog(filename string) ([]PulseRecord, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadPulseLog(f)
+}
+
+// Pulses returns the pulses of the given records, e.g. for use in a
+// PulseList.
+func Pulses(records []PulseRecord) []Pulse {
+	pulses := make([]Pulse, len(records))
+	for i, r := range records {
+		pulses[i] = r.Pulse
+	}
+	return pulses
+}
+
+// ParsePulseClass returns the pulse class with the given name, as given by
+// its String method.
+func ParsePulseClass(s string) (PulseClass, error) {
+	for c := PulseUnknown; c <= PulseHuge; c++ {
+		if c.String() == s {
+			return c, nil
+		}
+	}
+	return PulseUnknown, fmt.Errorf("bad pulse class %q", s)
+}
+
+// parsePulse parses the fields of a pulse log line.
+func parsePulse(fields []string) (PulseRecord, error) {
+	var p PulseRecord
+
+	var err error
+	if p.Number, err = strconv.Atoi(fields[0]); err != nil {
+		return p, fmt.Errorf("bad pulse number: %w", err)
+	}
+
+	class, types, ok := strings.Cut(fields[1], ":")
+	if !ok || len(types) != 2 {
+		return p, fmt.Errorf("bad pulse kind %q", fields[1])
+	}
+	if p.Class, err = ParsePulseClass(class); err != nil {
+		return p, err
+	}
+	if p.PrevType, err = parseEdgeType(types[:1]); err != nil {
+		return p, err
+	}
+	if p.CurType, err = parseEdgeType(types[1:]); err != nil {
+		return p, err
+	}
+
+	if p.Start, err = strconv.ParseFloat(fields[2], 64); err != nil {
+		return p, fmt.Errorf("bad pulse start: %w", err)
+	}
+	if p.End, err = strconv.ParseFloat(fields[3], 64); err != nil {
+		return p, fmt.Errorf("bad pulse end: %w", err)
+	}
+	if p.BitWidth, err = strconv.ParseFloat(fields[5], 64); err != nil {
+		return p, fmt.Errorf("bad bit width: %w", err)
+	}
+
+	return p, nil
+}
@@ -0,0 +1,194 @@
+package mfm
+
+import (
+	"math"
+)
+
+// HalfBits is the part of a block that was decoded in one direction by
+// DecodeForward or DecodeBackward, as the MFM bits (both clock and data
+// bits) between two of the edges of the block, in forward order.
+//
+// The bits start and end with the 1-bits of the first and last edge, but
+// unlike the bits from the Decoder, they are not aligned to the clock
+// and data bit pairs, since the part may not include the block's start.
+type HalfBits struct {
+	Bits []byte
+
+	// The indexes (in the given edges) of the first and last edge that
+	// the bits cover.
+	First, Last int
+
+	// The bit width at the end of the part where the decoding stopped,
+	// which is the last edge for DecodeForward, and the first edge for
+	// DecodeBackward.
+	BitWidth float64
+}
+
+// DecodeForward decodes the given edges of a block, from the start, until
+// it reaches the end or a pulse that is not a valid MFM pulse.
+//
+// The edges should be those of a single block, not including the edges
+// to none. If the bit width is 0, it is taken from the first pulse, which
+// should then be part of the lead-in.
+func DecodeForward(
+	edges []Edge, bitWidth float64, limits ClassLimits,
+) HalfBits {
+	h := HalfBits{BitWidth: bitWidth}
+	if len(edges) == 0 {
+		h.Last = -1
+		return h
+	}
+	if h.BitWidth <= 0 && len(edges) > 1 {
+		h.BitWidth = float64(edges[1].Index - edges[0].Index)
+	}
+
+	h.Bits = append(h.Bits, 1)
+	for i := 1; i < len(edges); i++ {
+		width := edges[i].Index - edges[i-1].Index
+		n, bw := halfBitsOf(width, h.BitWidth, limits)
+		if n == 0 {
+			break
+		}
+		h.Bits = appendPulse(h.Bits, n)
+		h.Last, h.BitWidth = i, bw
+	}
+	return h
+}
+
+// DecodeBackward decodes the given edges of a block, from the end, until
+// it reaches the start or a pulse that is not a valid MFM pulse. This can
+// recover the end of a block that has damage near its start.
+//
+// The edges should be those of a single block, not including the edges
+// to none. The bit width must be given, as there is no lead-in at the end
+// of a block; the one found by DecodeForward usually works.
+func DecodeBackward(
+	edges []Edge, bitWidth float64, limits ClassLimits,
+) HalfBits {
+	last := len(edges) - 1
+	h := HalfBits{First: last, Last: last, BitWidth: bitWidth}
+	if last < 0 {
+		return h
+	}
+
+	// The bits are collected backwards, and then reversed; since a pulse
+	// is all 0s after its first bit, that is the same as appending it.
+	h.Bits = append(h.Bits, 1)
+	for i := last; i > 0; i-- {
+		width := edges[i].Index - edges[i-1].Index
+		n, bw := halfBitsOf(width, h.BitWidth, limits)
+		if n == 0 {
+			break
+		}
+		h.Bits = appendPulse(h.Bits, n)
+		h.First, h.BitWidth = i-1, bw
+	}
+	for i, j := 0, len(h.Bits)-1; i < j; i, j = i+1, j-1 {
+		h.Bits[i], h.Bits[j] = h.Bits[j], h.Bits[i]
+	}
+	return h
+}
+
+// Reconcile combines the results of decoding the same edges forward and
+// backward into the MFM bits of the whole block, using the forward bits
+// up to where that pass stopped, and the backward bits after that.
+//
+// If there is a gap between the two parts, its length in bits can only be
+// estimated from the bit width, and a wrong guess shifts the bits of the
+// rest of the block; the gap is also assumed to have no real edges in it.
+// So, this returns several candidates, with the most likely ones first;
+// they can then be checked by decoding their data.
+func Reconcile(edges []Edge, fwd, rev HalfBits) [][]byte {
+	if fwd.Last < 0 || len(fwd.Bits) == 0 {
+		return nil
+	}
+	if rev.First <= fwd.Last {
+		// The passes overlap, so the backward bits can be joined to the
+		// forward ones at the last edge of the forward pass.
+		bits := append([]byte(nil), fwd.Bits...)
+		skip := 0
+		for e := rev.First; e < fwd.Last; e++ {
+			skip = nextOne(rev.Bits, skip)
+		}
+		return [][]byte{append(bits, rev.Bits[skip+1:]...)}
+	}
+
+	// The pulses next to where each pass stopped may be parts of the
+	// damage that happened to look valid, so also try leaving them out.
+	bw := (fwd.BitWidth + rev.BitWidth) / 2
+	var cands [][]byte
+	for _, trim := range [][2]int{{0, 0}, {0, 1}, {1, 0}, {1, 1}} {
+		fwdBits, last := fwd.Bits, fwd.Last
+		if trim[0] > 0 {
+			if last == 0 {
+				continue
+			}
+			fwdBits = fwdBits[:prevOne(fwdBits, len(fwdBits)-1)+1]
+			last--
+		}
+		revBits, first := rev.Bits, rev.First
+		if trim[1] > 0 {
+			if first == len(edges)-1 {
+				continue
+			}
+			revBits = revBits[nextOne(revBits, 0):]
+			first++
+		}
+
+		gap := float64(edges[first].Index - edges[last].Index)
+		n := int(math.Round(gap / (bw / 2)))
+		for _, d := range []int{0, -1, 1} {
+			if n+d < 1 {
+				continue
+			}
+			bits := make([]byte, 0, len(fwdBits)+n+d+len(revBits))
+			bits = append(bits, fwdBits...)
+			for i := 1; i < n+d; i++ {
+				bits = append(bits, 0)
+			}
+			cands = append(cands, append(bits, revBits...))
+		}
+	}
+	return cands
+}
+
+// halfBitsOf returns the number of half-bits in a pulse of the given
+// width, and the bit width as updated by it, or 0 if it is not valid.
+func halfBitsOf(
+	width int, bitWidth float64, limits ClassLimits,
+) (int, float64) {
+	w := float64(width)
+	switch limits.Classify(w, bitWidth) {
+	case PulseShort:
+		return 2, w
+	case PulseMedium:
+		return 3, w * 2 / 3
+	case PulseLong:
+		return 4, w / 2
+	}
+	return 0, bitWidth
+}
+
+// appendPulse appends the bits of a pulse of n half-bits that follows a
+// 1-bit: n-1 0-bits and then a 1-bit.
+func appendPulse(bits []byte, n int) []byte {
+	for i := 1; i < n; i++ {
+		bits = append(bits, 0)
+	}
+	return append(bits, 1)
+}
+
+// prevOne returns the index of the previous 1-bit before the given index,
+// or -1 if there is none.
+func prevOne(bits []byte, i int) int {
+	for i--; i >= 0 && bits[i] == 0; i-- {
+	}
+	return i
+}
+
+// nextOne returns the index of the next 1-bit after the given index.
+func nextOne(bits []byte, i int) int {
+	for i++; i < len(bits) && bits[i] == 0; i++ {
+	}
+	return i
+}
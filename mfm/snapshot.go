@@ -0,0 +1,197 @@
+package mfm
+
+// Snapshots hold the state of a pipeline component at some point, so
+// that it can later be restored to that point, e.g. to peek ahead at the
+// data, to try different interpretations of it, or to retry from a known
+// good point. The samples and settings like the logger are not included.
+
+// EdgeState is a snapshot of the state of an EdgeSource.
+type EdgeState struct {
+	// The current and previous edges.
+	Cur, Prev Edge
+
+	// The max crossing time in use.
+	MaxCrossingTime int
+
+	// The position in the list of edges, for sources that have one.
+	Pos int
+
+	// The number of edges that have not been counted in the metrics.
+	edges int
+}
+
+// Snapshotter is an EdgeSource that supports snapshots of its state.
+type Snapshotter interface {
+	Snapshot() EdgeState
+	Restore(st EdgeState)
+}
+
+// Snapshot returns a snapshot of the current state of the edge detector.
+func (e *EdgeDetectOf[S]) Snapshot() EdgeState {
+	return EdgeState{
+		Cur:             e.Cur(),
+		Prev:            e.Prev(),
+		MaxCrossingTime: e.MaxCrossingTime,
+		edges:           e.edges,
+	}
+}
+
+// Restore restores the edge detector to the state in the given snapshot.
+func (e *EdgeDetectOf[S]) Restore(st EdgeState) {
+	e.CurIndex, e.CurType, e.CurZero = st.Cur.Index, st.Cur.Type, st.Cur.Zero
+	e.PrevIndex, e.PrevType = st.Prev.Index, st.Prev.Type
+	e.PrevZero = st.Prev.Zero
+	e.CurMethod, e.PrevMethod = st.Cur.Method, st.Prev.Method
+	e.MaxCrossingTime = st.MaxCrossingTime
+	e.edges = st.edges
+}
+
+// Clone returns a copy of the edge detector, which shares the samples,
+// but otherwise works independently of the original.
+func (e *EdgeDetectOf[S]) Clone() *EdgeDetectOf[S] {
+	c := *e
+	return &c
+}
+
+// Snapshot returns a snapshot of the current state of the edge list.
+func (l *EdgeList) Snapshot() EdgeState {
+	return EdgeState{Cur: l.Cur(), Prev: l.Prev(), Pos: l.pos}
+}
+
+// Restore restores the edge list to the state in the given snapshot.
+func (l *EdgeList) Restore(st EdgeState) {
+	l.pos = st.Pos
+}
+
+// PulseState is a snapshot of the state of a PulseClassifier, including
+// the state of its edge detector.
+type PulseState struct {
+	Edges EdgeState
+
+	BitWidth  float64
+	Class     PulseClass
+	Width     float64
+	Start     float64
+	BitWidths []float64
+	BWIndex   int
+	BWTotal   float64
+}
+
+// Snapshot returns a snapshot of the current state of the classifier.
+func (c *PulseClassifierOf[S]) Snapshot() PulseState {
+	return PulseState{
+		Edges:     c.Edges.Snapshot(),
+		BitWidth:  c.BitWidth,
+		Class:     c.Class,
+		Width:     c.Width,
+		Start:     c.start,
+		BitWidths: append([]float64(nil), c.BitWidths...),
+		BWIndex:   c.BWIndex,
+		BWTotal:   c.BWTotal,
+	}
+}
+
+// Restore restores the classifier (and its edge detector) to the state
+// in the given snapshot. The lookahead is kept if the snapshot is of the
+// same position, and otherwise emptied; the last Next cannot be undone.
+func (c *PulseClassifierOf[S]) Restore(st PulseState) {
+	c.Edges.Restore(st.Edges)
+	c.BitWidth, c.Class, c.Width = st.BitWidth, st.Class, st.Width
+	c.start = st.Start
+	// Keep the capacity, since that is the size of the rolling average.
+	c.BitWidths = append(c.BitWidths[:0], st.BitWidths...)
+	c.BWIndex, c.BWTotal = st.BWIndex, st.BWTotal
+	c.canUndo = false
+}
+
+// Clone returns a copy of the classifier, with its own clone of the edge
+// detector, which works independently of the original.
+func (c *PulseClassifierOf[S]) Clone() *PulseClassifierOf[S] {
+	n := *c
+	n.Edges = c.Edges.Clone()
+	n.BitWidths = append(
+		make([]float64, 0, cap(c.BitWidths)), c.BitWidths...,
+	)
+	n.ahead.edges = append([]aheadEdge(nil), c.ahead.edges...)
+	n.consumed = append([]aheadEdge(nil), c.consumed...)
+	n.undo.BitWidths = append([]float64(nil), c.undo.BitWidths...)
+	n.revise.BitWidths = append([]float64(nil), c.revise.BitWidths...)
+	return &n
+}
+
+// DecoderState is a snapshot of the state of a Decoder, including the
+// state of its edge source if that is a Snapshotter.
+type DecoderState struct {
+	// The state of the edge source; only valid if HasEdges is true.
+	Edges    EdgeState
+	HasEdges bool
+
+	BitWidth   int
+	StartIndex int
+	EndIndex   int
+	Bits       []byte
+	Confidence []byte
+	Bridges    []Bridge
+	Ending     Ending
+	Info       BlockInfo
+}
+
+// Snapshot returns a snapshot of the current state of the decoder.
+func (d *Decoder) Snapshot() DecoderState {
+	st := DecoderState{
+		BitWidth:   d.BitWidth,
+		StartIndex: d.StartIndex,
+		EndIndex:   d.EndIndex,
+		Bits:       append([]byte(nil), d.Bits...),
+		Confidence: append([]byte(nil), d.Confidence...),
+		Bridges:    append([]Bridge(nil), d.Bridges...),
+		Ending:     d.Ending,
+		Info:       d.Info,
+	}
+	if s, ok := d.Edge.(Snapshotter); ok {
+		st.Edges, st.HasEdges = s.Snapshot(), true
+	}
+	return st
+}
+
+// Restore restores the decoder to the state in the given snapshot. The
+// edge source is also restored, if the snapshot includes its state.
+func (d *Decoder) Restore(st DecoderState) {
+	if s, ok := d.Edge.(Snapshotter); ok && st.HasEdges {
+		s.Restore(st.Edges)
+	}
+	d.BitWidth = st.BitWidth
+	d.StartIndex, d.EndIndex = st.StartIndex, st.EndIndex
+	d.Bits = append(d.Bits[:0], st.Bits...)
+	d.Confidence = append(d.Confidence[:0], st.Confidence...)
+	d.Bridges = append(d.Bridges[:0], st.Bridges...)
+	d.Ending = st.Ending
+	d.Info = st.Info
+}
+
+// Clone returns a copy of the decoder, which works independently of the
+// original. This requires the edge source to be an EdgeDetect or an
+// EdgeList (or something else with a Clone method returning itself);
+// otherwise, it returns nil.
+func (d *Decoder) Clone() *Decoder {
+	var edges EdgeSource
+	switch e := d.Edge.(type) {
+	case interface{ Clone() EdgeSource }:
+		edges = e.Clone()
+	case *EdgeDetect:
+		edges = e.Clone()
+	case *EdgeList:
+		c := *e
+		edges = &c
+	default:
+		return nil
+	}
+	n := *d
+	n.Edge = edges
+	n.Bits = append([]byte(nil), d.Bits...)
+	n.Confidence = append([]byte(nil), d.Confidence...)
+	n.Bridges = append([]Bridge(nil), d.Bridges...)
+	n.mlEdges, n.mlSteps = nil, nil
+	n.ahead.edges = append([]aheadEdge(nil), d.ahead.edges...)
+	return &n
+}
@@ -0,0 +1,189 @@
+package mfm
+
+import (
+	"github.com/edorfaus/sb-mfm-decode/log"
+)
+
+// These interfaces are the connections between the stages of decoding,
+// so that a stage can be replaced by something else that provides the
+// same data, e.g. edges loaded from a saved edge log instead of found
+// by the EdgeDetect, or flux transitions from some other kind of input.
+
+// Edge is a single edge, as found by an EdgeSource.
+type Edge struct {
+	// The index (in samples) of the edge.
+	Index int
+	// The type of the edge.
+	Type EdgeType
+	// The interpolated sample offset of the edge.
+	Zero float64
+	// How the zero crossing of the edge was placed.
+	Method ZeroMethod
+}
+
+// EdgeSource is a source of edges, such as the EdgeDetect.
+//
+// Like the EdgeDetect, it is expected to start with a (virtual) edge to
+// none before the first real edge, and to end every sequence of high and
+// low edges with an edge to none.
+type EdgeSource interface {
+	// Next moves to the next edge, returning false if there are none.
+	Next() bool
+
+	// Cur returns the current edge, and Prev the one before it.
+	Cur() Edge
+	Prev() Edge
+
+	// SetMaxCrossingTime sets the maximum time (in samples) between a
+	// high and a low edge before it is an edge to none instead. Sources
+	// that do not detect the edges themselves may ignore this.
+	SetMaxCrossingTime(samples int)
+
+	// Len returns the total number of samples that the edges are in, for
+	// use in progress reports.
+	Len() int
+}
+
+// Pulse is a single classified pulse, as provided by a PulseSource.
+type Pulse struct {
+	// The class of the pulse.
+	Class PulseClass
+	// The start and end (sample offsets) of the pulse.
+	Start, End float64
+	// The bit width that was used to classify the pulse.
+	BitWidth float64
+}
+
+// Width returns the width of the pulse, in samples.
+func (p Pulse) Width() float64 {
+	return p.End - p.Start
+}
+
+// Confidence returns how close the width of the pulse is to the middle of
+// the nearest valid pulse class, for its bit width: 1 in the middle,
+// falling to 0 at the limits of the class, or negative if it is invalid.
+func (p Pulse) Confidence() float64 {
+	return pulseConfidence(p.Width(), p.BitWidth)
+}
+
+// PulseSource is a source of classified pulses, such as the
+// PulseClassifier.
+type PulseSource interface {
+	// Next moves to the next pulse, returning false if there are none.
+	Next() bool
+
+	// Pulse returns the current pulse.
+	Pulse() Pulse
+}
+
+// PulseSink is something that receives pulses as they are classified,
+// such as by the Decoder.
+type PulseSink interface {
+	Pulse(p Pulse)
+}
+
+// PulseFunc is an adapter that allows using an ordinary function as a
+// PulseSink.
+type PulseFunc func(p Pulse)
+
+func (f PulseFunc) Pulse(p Pulse) {
+	f(p)
+}
+
+// BitSink is something that receives the blocks of bits decoded by a
+// Decoder, as used by Decoder.DecodeTo.
+type BitSink interface {
+	// Block is called with each block, given as its start and end sample
+	// index and its bits (both clock and data bits), along with the error
+	// that occurred while decoding it, if any. The bits slice is only
+	// valid until Block returns. If Block returns an error, decoding
+	// stops, and that error is returned.
+	Block(start, end int, bits []byte, err error) error
+}
+
+// logSource is implemented by sources that have a logger, which is then
+// used by the next stage unless it has its own.
+type logSource interface {
+	Logger() *log.Logger
+}
+
+// EdgeList is an EdgeSource that provides the edges from a list, such
+// as one that was loaded from a saved edge log.
+type EdgeList struct {
+	// The edges, which should follow the rules of EdgeSource, except
+	// that the initial edge to none should not be included.
+	Edges []Edge
+
+	// The total number of samples that the edges are in.
+	Samples int
+
+	pos int
+}
+
+func (l *EdgeList) Next() bool {
+	// Like the EdgeDetect, the calls that find no more edges still move
+	// on, to the end of the samples, so that the last edge becomes the
+	// previous one, and then so does the end.
+	if l.pos <= len(l.Edges)+1 {
+		l.pos++
+	}
+	return l.pos <= len(l.Edges)
+}
+
+func (l *EdgeList) Cur() Edge {
+	return l.at(l.pos - 1)
+}
+
+func (l *EdgeList) Prev() Edge {
+	return l.at(l.pos - 2)
+}
+
+func (l *EdgeList) at(i int) Edge {
+	if i < 0 {
+		return Edge{Type: EdgeToNone}
+	}
+	if i < len(l.Edges) {
+		return l.Edges[i]
+	}
+	// Past the last edge, it is at the end of the samples, as with the
+	// EdgeDetect, unless the edges go further.
+	end := l.Samples
+	if len(l.Edges) > 0 {
+		end = max(end, l.Edges[len(l.Edges)-1].Index)
+	}
+	return Edge{
+		Index: end, Type: EdgeToNone, Zero: float64(end),
+		Method: ZeroBoundary,
+	}
+}
+
+// SetMaxCrossingTime does nothing, since the edges are already known.
+func (l *EdgeList) SetMaxCrossingTime(samples int) {}
+
+func (l *EdgeList) Len() int {
+	return l.Samples
+}
+
+// PulseList is a PulseSource that provides the pulses from a list, such
+// as one that was read from a saved pulse log.
+type PulseList struct {
+	Pulses []Pulse
+
+	pos int
+}
+
+func (l *PulseList) Next() bool {
+	if l.pos >= len(l.Pulses) {
+		return false
+	}
+	l.pos++
+	return true
+}
+
+// Pulse returns the current pulse.
+func (l *PulseList) Pulse() Pulse {
+	if l.pos < 1 || l.pos > len(l.Pulses) {
+		return Pulse{}
+	}
+	return l.Pulses[l.pos-1]
+}
@@ -0,0 +1,130 @@
+package mfm
+
+import (
+	"math"
+
+	"github.com/edorfaus/sb-mfm-decode/sample"
+)
+
+// leadInRun is the number of Short pulses in a row that are taken to be a
+// lead-in, whose pulses are measured directly instead of by the tracked
+// bit width.
+const leadInRun = 16
+
+// minSpeedPulses is the fewest pulses that a window must have for its
+// speed to be used, as a few stray pulses (e.g. where a block failed to
+// decode) can be far off.
+const minSpeedPulses = 16
+
+// SpeedPoint is the tape speed within one window of the input, as found
+// from the bit widths of the pulses in it.
+type SpeedPoint struct {
+	// The start and end of the window (sample offsets).
+	Start, End float64
+
+	// The number of pulses that the speed was found from.
+	Pulses int
+
+	// The mean bit width of the pulses, in samples.
+	BitWidth float64
+
+	// The speed relative to the nominal, e.g. 1.02 if the tape was played
+	// 2% fast (which makes the bits narrower).
+	Speed float64
+}
+
+// SpeedTracker estimates the speed that a tape was played at over the
+// input, in windows of a fixed length, from the pulses of a Decoder. It
+// is a PulseSink; the pulses must be given in order.
+//
+// In a lead-in, where every pulse is Short, the width of each pulse is
+// one bit width, so it is used as is; elsewhere, the bit width that the
+// pulses were classified with is used, which follows the speed but lags
+// behind it a little.
+type SpeedTracker struct {
+	// The length of each window, in samples.
+	Window int
+
+	// The nominal bit width, in samples, which the speed is relative to.
+	Nominal float64
+
+	points []SpeedPoint
+
+	// The start of the current window, the number of pulses and the sum
+	// of their bit widths in it, and the number of Short pulses in a row.
+	start float64
+	count int
+	sum   float64
+	run   int
+}
+
+// NewSpeedTracker creates a new SpeedTracker with the given window length
+// and nominal bit width, in samples.
+func NewSpeedTracker(window int, nominal float64) *SpeedTracker {
+	if window < 1 {
+		window = 1
+	}
+	return &SpeedTracker{Window: window, Nominal: nominal}
+}
+
+// Pulse implements PulseSink. Pulses that are not of a valid class, or
+// that do not have a bit width, are ignored.
+func (t *SpeedTracker) Pulse(p Pulse) {
+	if p.Class < PulseShort || p.Class > PulseLong || p.BitWidth <= 0 {
+		t.run = 0
+		return
+	}
+	bw := p.BitWidth
+	if p.Class == PulseShort {
+		t.run++
+		if t.run >= leadInRun {
+			bw = p.Width()
+		}
+	} else {
+		t.run = 0
+	}
+
+	w := float64(t.Window)
+	if p.Start >= t.start+w {
+		t.flush()
+		t.start = math.Floor(p.Start/w) * w
+	}
+	t.count++
+	t.sum += bw
+}
+
+// Points returns the speed in each window that had enough pulses in it,
+// from the pulses given so far.
+func (t *SpeedTracker) Points() []SpeedPoint {
+	t.flush()
+	return t.points
+}
+
+// Curve returns the speed over the input as a curve, with a point in the
+// middle of each window that had enough pulses in it.
+func (t *SpeedTracker) Curve() sample.SpeedCurve {
+	var c sample.SpeedCurve
+	for _, p := range t.Points() {
+		i := int((p.Start + p.End) / 2)
+		c = append(c, sample.SpeedPoint{Index: i, Speed: p.Speed})
+	}
+	return c
+}
+
+// flush adds the point of the current window, if it had enough pulses,
+// and resets the sums for the next window.
+func (t *SpeedTracker) flush() {
+	if t.count < minSpeedPulses {
+		t.count, t.sum = 0, 0
+		return
+	}
+	bw := t.sum / float64(t.count)
+	t.points = append(t.points, SpeedPoint{
+		Start:    t.start,
+		End:      t.start + float64(t.Window),
+		Pulses:   t.count,
+		BitWidth: bw,
+		Speed:    t.Nominal / bw,
+	})
+	t.count, t.sum = 0, 0
+}
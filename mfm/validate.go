@@ -0,0 +1,104 @@
+package mfm
+
+import (
+	"context"
+
+	"github.com/edorfaus/sb-mfm-decode/metrics"
+	"github.com/edorfaus/sb-mfm-decode/sample"
+)
+
+// Disagreement is a pulse that the PulseClassifier and the Decoder gave
+// different classes, along with the bit width that each of them used.
+type Disagreement struct {
+	// The sample indexes of the edges at the start and end of the pulse.
+	Start, End int
+
+	Classifier         PulseClass
+	ClassifierBitWidth float64
+
+	Decoder         PulseClass
+	DecoderBitWidth int
+}
+
+// CrossValidate runs both a PulseClassifier and a Decoder on the given
+// samples, and returns the pulses that they classified differently.
+//
+// Since they keep track of the bit width separately, and in different
+// ways, they can disagree on pulses that are close to the limit between
+// two classes, which is where a decode is likely to silently go wrong.
+//
+// Each of them gets its own edge detector, configured by the options.
+// Only the pulses that both of them saw (with the same edges) are
+// compared, so pulses that touch an edge to none are not included, nor
+// the first pulse of a block where the decoder finds the bit width.
+func CrossValidate[S sample.Type](
+	ctx context.Context, samples []S, opts ...Option,
+) ([]Disagreement, error) {
+	type pulse struct {
+		start, end int
+		class      PulseClass
+		bitWidth   int
+	}
+
+	var pulses []pulse
+	d := NewDecoderWith(NewEdgeDetectWith(samples, opts...), opts...)
+	d.Pulses = PulseFunc(func(p Pulse) {
+		pulses = append(pulses, pulse{
+			int(p.Start), int(p.End), p.Class, int(p.BitWidth),
+		})
+	})
+	if err := d.DecodeTo(ctx, discardBits{}); err != nil {
+		return nil, err
+	}
+
+	ed := NewEdgeDetectWith(samples, opts...)
+	c := NewPulseClassifierWith(ed, opts...)
+
+	var found []Disagreement
+	done := ctx.Done()
+	i := 0
+	for bitWidth := c.BitWidth; c.Next(); bitWidth = c.BitWidth {
+		if isDone(done) {
+			return nil, ctx.Err()
+		}
+		if c.TouchesNone() {
+			continue
+		}
+		if bitWidth == 0 {
+			// The bit width was just found from the lead-in.
+			bitWidth = c.BitWidth
+		}
+
+		start, end := c.Edges.PrevIndex, c.Edges.CurIndex
+		for i < len(pulses) && pulses[i].end < end {
+			i++
+		}
+		if i >= len(pulses) {
+			break
+		}
+		p := pulses[i]
+		if p.end != end || p.start != start || p.class == c.Class {
+			continue
+		}
+
+		found = append(found, Disagreement{
+			Start:              start,
+			End:                end,
+			Classifier:         c.Class,
+			ClassifierBitWidth: bitWidth,
+			Decoder:            p.class,
+			DecoderBitWidth:    p.bitWidth,
+		})
+	}
+
+	metrics.Count("disagreements", len(found))
+
+	return found, nil
+}
+
+// discardBits is a BitSink that ignores the blocks it is given.
+type discardBits struct{}
+
+func (discardBits) Block(start, end int, bits []byte, err error) error {
+	return nil
+}
@@ -0,0 +1,207 @@
+package mfm
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/edorfaus/sb-mfm-decode/metrics"
+)
+
+// In MFM, a clock bit is only 1 when the data bits on both sides of it
+// are 0, so which pulse lengths can come next depends on whether the
+// previous edge was a clock bit (0) or a data bit (1):
+//
+// After a clock bit, the next data bit is 0, so the next edge is either
+// the clock bit after that (2 half-bits) or the data bit after that (3).
+//
+// After a data bit, the next edge is either the next data bit (2), or
+// the clock bit after a 0 data bit (3), or the data bit after that (4).
+//
+// The greedy decoder picks the closest length for each pulse on its own,
+// which fails the block if that length is not allowed where it is. The
+// max-likelihood decoder instead uses the Viterbi algorithm to find the
+// sequence of allowed lengths that best fits the whole block.
+
+// mlMove is a pulse length that is allowed after a given previous bit.
+type mlMove struct {
+	// The length of the pulse in half-bits.
+	n int
+	// The previous bit after the pulse.
+	to byte
+	// The bits to add for the pulse.
+	bits []byte
+}
+
+// mlMoves are the allowed moves, by the previous bit.
+var mlMoves = [2][]mlMove{
+	0: {
+		{n: 2, to: 0, bits: []byte{1, 0}},
+		{n: 3, to: 1, bits: []byte{1, 0, 0, 1}},
+	},
+	1: {
+		{n: 2, to: 1, bits: []byte{0, 1}},
+		{n: 3, to: 0, bits: []byte{0, 0}},
+		{n: 4, to: 1, bits: []byte{0, 0, 0, 1}},
+	},
+}
+
+// mlStep is the best way to reach a state after a pulse: the state it
+// came from, the move that was used, and the bit width at that point.
+type mlStep struct {
+	from     byte
+	move     byte
+	bitWidth float64
+}
+
+// decodeML decodes the rest of the current block, starting from the
+// current edge with the given previous bit, by finding the sequence of
+// pulse lengths that best fits the block as a whole.
+//
+// Each pulse must still be a valid pulse according to the class limits,
+// but it can be decoded as one of the other valid classes, if that fits
+// the rest of the block better. The bit width is tracked separately for
+// each of the candidate sequences, so that they can drift as the tape
+// speed does.
+func (d *Decoder) decodeML(ctx context.Context, prevBit byte) error {
+	done := ctx.Done()
+	startBW := float64(d.BitWidth)
+	checkBW := startBW
+
+	// The edges of the pulses of the block, with one more than pulses.
+	edges := append(d.mlEdges[:0], d.Edge.Cur().Index)
+	defer func() {
+		d.mlEdges = edges
+	}()
+	for d.Edge.Cur().Type != EdgeToNone && d.Edge.Next() {
+		if isDone(done) {
+			return ctx.Err()
+		}
+		d.progress.Update(d.Edge.Cur().Index, d.Edge.Len())
+
+		if err := d.checkLimits(len(d.Bits) + 2*len(edges)); err != nil {
+			return err
+		}
+
+		// The pulses are checked against a smoothed bit width, so that a
+		// single misplaced edge does not make the next pulse invalid; but
+		// the edge source's max crossing time is set as by the greedy
+		// decoder, so that it finds the same edges.
+		delta := d.Edge.Cur().Index - d.Edge.Prev().Index
+		class := d.limits().Classify(float64(delta), checkBW)
+		if len(edges) == 1 && d.skipDamaged(class) {
+			edges[0] = d.Edge.Cur().Index
+			continue
+		}
+		switch class {
+		case PulseTiny:
+			return fmt.Errorf(
+				"bad data: edge distance too short: delta %v, bw %.2f",
+				delta, checkBW,
+			)
+		case PulseHuge:
+			return fmt.Errorf(
+				"bad data: edge distance too long: delta %v, bw %.2f",
+				delta, checkBW,
+			)
+		}
+		n := int(class-PulseShort) + 2
+		checkBW = (3*checkBW + float64(delta*2)/float64(n)) / 4
+		d.SetBitWidth(delta * 2 / n)
+		edges = append(edges, d.Edge.Cur().Index)
+		if d.inherited && len(edges) > DefaultLeadInPulses {
+			d.inherited = false
+		}
+	}
+
+	if d.Edge.Cur().Type != EdgeToNone {
+		return fmt.Errorf("edge detector did not end with EdgeToNone")
+	}
+
+	// Find the best way to reach each state after each pulse, where the
+	// cost of a pulse is the square of its distance (in half-bits) from
+	// the length of the move.
+	inf := math.Inf(1)
+	cost := [2]float64{inf, inf}
+	cost[prevBit] = 0
+	bitWidth := [2]float64{startBW, startBW}
+	steps := d.mlSteps[:0]
+	for i := 1; i < len(edges); i++ {
+		w := float64(edges[i] - edges[i-1])
+		next := [2]float64{inf, inf}
+		var nextBW [2]float64
+		var step [2]mlStep
+		for from := range cost {
+			if math.IsInf(cost[from], 1) {
+				continue
+			}
+			bw := bitWidth[from]
+			for k, m := range mlMoves[from] {
+				e := 2*w/bw - float64(m.n)
+				c := cost[from] + e*e
+				if c >= next[m.to] {
+					continue
+				}
+				next[m.to] = c
+				nextBW[m.to] = (3*bw + 2*w/float64(m.n)) / 4
+				step[m.to] = mlStep{
+					from: byte(from), move: byte(k), bitWidth: bw,
+				}
+			}
+		}
+		steps = append(steps, step)
+		cost, bitWidth = next, nextBW
+	}
+	d.mlSteps = steps
+
+	// Trace the best sequence back from its end, keeping its steps in the
+	// first element, and then add its bits.
+	state := byte(0)
+	if cost[1] < cost[0] {
+		state = 1
+	}
+	if len(steps) > 0 && bitWidth[state] >= 2 {
+		defer d.SetBitWidth(int(bitWidth[state] + 0.5))
+	}
+	for i := len(steps) - 1; i >= 0; i-- {
+		steps[i][0] = steps[i][state]
+		state = steps[i][0].from
+	}
+
+	changed := 0
+	for i := range steps {
+		st := steps[i][0]
+		m := mlMoves[st.from][st.move]
+		class := PulseShort + PulseClass(m.n-2)
+		start, end := edges[i], edges[i+1]
+		if class != d.Limits.Classify(float64(end-start), st.bitWidth) {
+			changed++
+		}
+		d.Info.addPulse(class, st.bitWidth)
+		if d.Pulses != nil {
+			d.Pulses.Pulse(Pulse{
+				Class:    class,
+				Start:    float64(start),
+				End:      float64(end),
+				BitWidth: st.bitWidth,
+			})
+		}
+		d.addCells(st.from, start, end, m.n)
+		e := float64(2*(end-start))/st.bitWidth - float64(m.n)
+		d.addBits(softConfidence(1-2*math.Abs(e)), m.bits...)
+	}
+	if err := d.checkLimits(len(d.Bits)); err != nil {
+		return err
+	}
+
+	if changed > 0 {
+		d.log().F(
+			3, "Max-likelihood decode changed %v of %v pulses at %v\n",
+			changed, len(steps), d.StartIndex,
+		)
+		metrics.Count("ml-changed-pulses", changed)
+	}
+
+	d.Ending = EndClean
+	return nil
+}
@@ -0,0 +1,333 @@
+package pipeline
+
+import (
+	"context"
+	"io"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/edorfaus/sb-mfm-decode/cache"
+	"github.com/edorfaus/sb-mfm-decode/log"
+	"github.com/edorfaus/sb-mfm-decode/metrics"
+	"github.com/edorfaus/sb-mfm-decode/pool"
+	"github.com/edorfaus/sb-mfm-decode/quality"
+	"github.com/edorfaus/sb-mfm-decode/wav"
+)
+
+// Result is the result of decoding a single input file.
+type Result struct {
+	// The input file that was decoded.
+	Input string
+
+	// The metadata of the input file, and its number of samples (per
+	// channel), if it could be opened.
+	Meta    wav.Meta
+	Samples int
+
+	// The channel of the input file that was decoded.
+	Channel int
+
+	// The blocks that were decoded from the file, including the ones
+	// that failed to decode (which have their Err field set).
+	Blocks []*Block
+
+	// The error that stopped the file from being fully processed, if
+	// any; if this is set, Blocks may only hold some of the blocks.
+	Err error
+
+	// How long it took to process the file.
+	Duration time.Duration
+
+	// The quality report of the decode.
+	Quality quality.Report
+
+	// If Err is set, this is a checkpoint that can be used to resume
+	// decoding the file after the last block in Blocks (if any).
+	Checkpoint *Checkpoint
+}
+
+// FailedBlocks returns the number of blocks that failed to decode.
+func (r *Result) FailedBlocks() int {
+	n := 0
+	for _, b := range r.Blocks {
+		if b.Err != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// BlockErrors returns the errors of the blocks that failed to decode.
+func (r *Result) BlockErrors() []error {
+	var errs []error
+	for _, b := range r.Blocks {
+		if b.Err != nil {
+			errs = append(errs, b.Err)
+		}
+	}
+	return errs
+}
+
+// DecodeFile decodes all the blocks of the given WAVE file, by streaming
+// it through a Stream with the given configuration.
+//
+// If the context is cancelled, it stops as soon as possible, and the
+// context's error is returned in the result.
+func DecodeFile(ctx context.Context, filename string, cfg Config) *Result {
+	return decodeFile(ctx, filename, cfg, nil)
+}
+
+// ResumeFile continues decoding the input file of the given checkpoint,
+// from that checkpoint, as if by DecodeFile. The blocks that were saved
+// in the checkpoint are included at the start of the result.
+func ResumeFile(ctx context.Context, cp *Checkpoint, cfg Config) *Result {
+	return decodeFile(ctx, cp.Input, cfg, cp)
+}
+
+func decodeFile(
+	ctx context.Context, filename string, cfg Config, cp *Checkpoint,
+) *Result {
+	start := time.Now()
+	res := &Result{Input: filename}
+	defer func() {
+		res.Duration = time.Since(start)
+	}()
+
+	r, err := wav.OpenReader(filename)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	defer r.Close()
+	decodeReader(ctx, res, r, cfg, cp)
+	return res
+}
+
+// DecodeChannels decodes each of the data channels of the given WAVE file,
+// as given by the roles of its channels (see wav.OpenDataReaders), through
+// a Stream of its own with the given configuration, all at the same time.
+// It returns the result of each data channel, in order.
+//
+// If the file could not be opened, the error is returned instead.
+func DecodeChannels(
+	ctx context.Context, filename string, roles []wav.Role, cfg Config,
+) ([]*Result, error) {
+	readers, err := wav.OpenDataReaders(filename, roles)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Pool == nil {
+		cfg.Pool = pool.Ints
+	}
+
+	results := make([]*Result, len(readers))
+	var wg sync.WaitGroup
+	for i, r := range readers {
+		res := &Result{Input: filename}
+		results[i] = res
+
+		// The channels are cached apart, as they have other samples.
+		cfg := cfg
+		if cfg.Cache != nil {
+			cfg.CacheKey = cache.Key(cfg.CacheKey, r.Channel)
+		}
+
+		wg.Add(1)
+		go func(r *wav.Reader) {
+			defer wg.Done()
+			defer r.Close()
+			start := time.Now()
+			decodeReader(ctx, res, r, cfg, nil)
+			res.Duration = time.Since(start)
+		}(r)
+	}
+	wg.Wait()
+	return results, nil
+}
+
+// decodeReader decodes the blocks of the given reader into the result, as
+// for decodeFile.
+func decodeReader(
+	ctx context.Context, res *Result, r *wav.Reader, cfg Config,
+	cp *Checkpoint,
+) {
+	start := time.Now()
+	res.Meta, res.Samples, res.Channel = r.Meta, r.Frames, r.Channel
+
+	s := NewStream(r, r.Meta.SampleRate, r.Meta.BitDepth, cfg)
+	defer s.Close()
+
+	if cp != nil {
+		if err := s.Resume(*cp); err != nil {
+			res.Err = err
+			return
+		}
+		res.Blocks = append(res.Blocks, cp.Blocks...)
+	}
+
+	for {
+		b, err := s.NextContext(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			res.Err = err
+			res.Checkpoint = res.makeCheckpoint(s)
+			res.Quality = s.Quality()
+			return
+		}
+		res.Blocks = append(res.Blocks, b)
+	}
+
+	res.Quality = s.Quality()
+	metrics.Add("decode-file", r.Frames, time.Since(start))
+}
+
+// makeCheckpoint makes a checkpoint for the current state of the given
+// stream, including the blocks decoded so far.
+func (r *Result) makeCheckpoint(s *Stream) *Checkpoint {
+	cp := s.Checkpoint()
+	cp.Input = r.Input
+	cp.Blocks = append([]*Block(nil), r.Blocks...)
+	return &cp
+}
+
+// Scheduler decodes multiple input files concurrently, with a bounded
+// number of workers that share a buffer pool.
+type Scheduler struct {
+	// The maximum number of files to decode at the same time; if 0, the
+	// number of CPUs is used.
+	Workers int
+
+	// The maximum time to spend on each file; if 0, there is no limit.
+	FileTimeout time.Duration
+
+	// The configuration to use for each file. If its Pool is nil, the
+	// shared pool.Ints pool is used, so the workers can reuse buffers.
+	Config Config
+
+	// If set, this is called with each result as soon as it is done, in
+	// the order they finish. The calls are not made concurrently.
+	OnResult func(res *Result)
+
+	// The logger to use; if nil, the package logger is used.
+	Log *log.Logger
+}
+
+// Run decodes the given input files, and returns their results in the
+// same order as the inputs.
+//
+// If the context is cancelled, the files that have not been started yet
+// are not decoded, and their results have the context's error.
+func (s *Scheduler) Run(ctx context.Context, inputs []string) []*Result {
+	workers := s.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if workers > len(inputs) {
+		workers = len(inputs)
+	}
+
+	cfg := s.Config
+	if cfg.Pool == nil {
+		cfg.Pool = pool.Ints
+	}
+
+	results := make([]*Result, len(inputs))
+	jobs := make(chan int)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				res := s.decodeFile(ctx, inputs[i], cfg)
+				s.log().F(
+					2, "Decoded %v: %v blocks in %v\n",
+					res.Input, len(res.Blocks), res.Duration,
+				)
+
+				mu.Lock()
+				results[i] = res
+				if s.OnResult != nil {
+					s.OnResult(res)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+feed:
+	for i := range inputs {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	for i, res := range results {
+		if res == nil {
+			results[i] = &Result{Input: inputs[i], Err: ctx.Err()}
+		}
+	}
+
+	return results
+}
+
+func (s *Scheduler) decodeFile(
+	ctx context.Context, filename string, cfg Config,
+) *Result {
+	if s.FileTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.FileTimeout)
+		defer cancel()
+	}
+	return DecodeFile(ctx, filename, cfg)
+}
+
+func (s *Scheduler) log() *log.Logger {
+	if s.Log != nil {
+		return s.Log
+	}
+	return logger
+}
+
+// Summary is a summary of the results of decoding several files.
+type Summary struct {
+	// The number of files, and how many of them failed with an error.
+	Files, FailedFiles int
+
+	// The number of blocks, and how many of them failed to decode.
+	Blocks, FailedBlocks int
+
+	// The total number of decoded bytes.
+	Bytes int
+
+	// The total time spent decoding the files; since they are decoded
+	// concurrently, this may be longer than the time it took to run.
+	Duration time.Duration
+}
+
+// Summarize returns a summary of the given results.
+func Summarize(results []*Result) Summary {
+	var sum Summary
+	for _, res := range results {
+		sum.Files++
+		if res.Err != nil {
+			sum.FailedFiles++
+		}
+		sum.Blocks += len(res.Blocks)
+		sum.FailedBlocks += res.FailedBlocks()
+		for _, b := range res.Blocks {
+			sum.Bytes += len(b.Data)
+		}
+		sum.Duration += res.Duration
+	}
+	return sum
+}
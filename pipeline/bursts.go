@@ -0,0 +1,213 @@
+package pipeline
+
+import (
+	"io"
+)
+
+// The settings of the burst scan of IndexBursts, in frames of burstFrame
+// peak widths (about that many bits): how many inactive frames a burst can
+// have in a row before it ends, how many active frames it must have to be
+// kept, how many frames of margin are kept around it, so that the cleanup
+// and the edge detection see the quiet before and after it, and how many
+// frames of signal that is not active it can follow before and after its
+// active frames before the quiet.
+const (
+	burstFrame     = 16
+	burstMaxGap    = 4
+	burstMinFrames = 8
+	burstMargin    = 4
+	burstMaxTail   = 64
+)
+
+// The range of zero crossings per peak width that a frame must have to be
+// active: MFM has one every 1 to 2 bit widths, while audio that leaks into
+// the data channel mostly has fewer, and noise more.
+const (
+	burstMinCrossings = 0.45
+	burstMaxCrossings = 1.25
+)
+
+// Burst is a part of the input that has data in it, as found by
+// IndexBursts, as the sample index of its start, and the index just after
+// its end.
+type Burst struct {
+	Start, End int
+}
+
+// burstSpan is a burst as it is being found by IndexBursts, with how far
+// its margins can reach without going into the signal around it; to is -1
+// while that is not known yet.
+type burstSpan struct {
+	Burst
+	from, to int
+}
+
+// BurstScan is the settings of IndexBursts.
+type BurstScan struct {
+	NoiseFloor int
+	PeakWidth  int
+
+	// The region of the input to scan, as for Config.Start and End; the
+	// source must already be at Start.
+	Start, End int
+}
+
+// IndexBursts scans the samples of the given source for the bursts of data
+// in them, without decoding them, for inputs that have long passages of
+// audio (or silence) between the bursts, so that only the bursts need to
+// be decoded.
+//
+// This is a cheap scan: it only looks at the level and the rate of zero
+// crossings of the samples in frames of a few bit widths, marking those
+// that look like MFM as active, and joining them into bursts. A burst
+// follows the signal around its active frames out to the quiet on either
+// side (such as the partial frames at the ends of a block, or noise at the
+// end of it), so that it does not cut a block into fragments, and includes
+// a margin of the quiet around that.
+func IndexBursts(src SampleSource, scan BurstScan) ([]Burst, error) {
+	pw := max(scan.PeakWidth, 1)
+	frame := burstFrame * pw
+	margin, maxTail := burstMargin*frame, burstMaxTail*frame
+
+	var spans []burstSpan
+	newSpan := burstSpan{Burst: Burst{Start: -1}, to: -1}
+	cur, active, gap, tail := newSpan, 0, 0, -1
+	endBurst := func() {
+		if cur.Start >= 0 && active >= burstMinFrames {
+			spans = append(spans, cur)
+		}
+		cur, active, gap, tail = newSpan, 0, 0, -1
+	}
+	// The start of the current run of frames that are not quiet (or -1),
+	// and the end of the one before it.
+	loudFrom, loudEnd := -1, scan.Start
+
+	buf := make([]int, frame)
+	pos, eof := scan.Start, false
+	for !eof && (scan.End <= 0 || pos < scan.End) {
+		n := frame
+		if scan.End > 0 {
+			n = min(n, scan.End-pos)
+		}
+		n, err := readFull(src, buf[:n])
+		if err == io.EOF {
+			eof = true
+		} else if err != nil {
+			return nil, err
+		}
+
+		isActive, loud := false, false
+		if n > 0 {
+			isActive, loud = burstActive(buf[:n], scan.NoiseFloor, pw)
+		}
+		if !loud && loudFrom >= 0 {
+			loudFrom, loudEnd = -1, pos
+		} else if loud && loudFrom < 0 {
+			loudFrom = pos
+		}
+
+		switch {
+		case isActive:
+			if cur.Start < 0 {
+				// Follow the signal back to the quiet before it.
+				cur.Start, cur.from = loudFrom, loudEnd
+				if loudFrom < pos-maxTail {
+					cur.Start = pos - maxTail
+					cur.from = cur.Start
+				}
+			}
+			if n := len(spans); n > 0 && spans[n-1].to < 0 {
+				spans[n-1].to = cur.Start
+			}
+			cur.End, cur.to = pos+n, -1
+			active++
+			gap, tail = 0, pos+n
+		case cur.Start < 0:
+			if n := len(spans); loud && n > 0 && spans[n-1].to < 0 {
+				spans[n-1].to = pos
+			}
+		default:
+			if loud && tail >= 0 && pos+n-tail <= maxTail {
+				// Follow the signal on to the quiet after it.
+				cur.End = pos + n
+			} else {
+				tail = -1
+				if loud && cur.to < 0 {
+					cur.to = pos
+				}
+			}
+			if gap++; gap > burstMaxGap && tail < 0 {
+				endBurst()
+			}
+		}
+		pos += n
+	}
+	endBurst()
+
+	// Add the margins, as far as they stay in the quiet, joining the
+	// bursts that then overlap.
+	var out []Burst
+	for _, sp := range spans {
+		b := sp.Burst
+		b.Start = max(b.Start-margin, scan.Start, sp.from)
+		b.End = min(b.End+margin, pos)
+		if sp.to >= 0 {
+			b.End = min(b.End, sp.to)
+		}
+		if n := len(out); n > 0 && b.Start <= out[n-1].End {
+			out[n-1].End = b.End
+			continue
+		}
+		out = append(out, b)
+	}
+	return out, nil
+}
+
+// burstActive returns whether the given frame of samples looks like MFM
+// of the given peak width, and whether it is loud: it is loud if its
+// range is wider than the noise, and active if it is loud and crosses its
+// middle (with hysteresis at half the noise floor) about as often as MFM
+// does.
+func burstActive(v []int, noiseFloor, peakWidth int) (active, loud bool) {
+	lo, hi := v[0], v[0]
+	for _, x := range v {
+		lo, hi = min(lo, x), max(hi, x)
+	}
+	if hi-lo <= 2*noiseFloor {
+		return false, false
+	}
+
+	mid, h := (lo+hi)/2, noiseFloor/2
+	crossings, state := 0, 0
+	for _, x := range v {
+		s := 0
+		if x > mid+h {
+			s = 1
+		} else if x < mid-h {
+			s = -1
+		}
+		if s != 0 && s != state {
+			if state != 0 {
+				crossings++
+			}
+			state = s
+		}
+	}
+	rate := float64(crossings) * float64(peakWidth) / float64(len(v))
+	return rate >= burstMinCrossings && rate <= burstMaxCrossings, true
+}
+
+// readFull reads samples from the source until the buffer is full, and
+// returns how many it read; at the end of the source, that may be fewer,
+// along with io.EOF.
+func readFull(src SampleSource, buf []int) (int, error) {
+	n := 0
+	for n < len(buf) {
+		m, err := src.ReadSamples(buf[n:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
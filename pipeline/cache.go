@@ -0,0 +1,67 @@
+package pipeline
+
+import (
+	"github.com/edorfaus/sb-mfm-decode/cache"
+	"github.com/edorfaus/sb-mfm-decode/metrics"
+)
+
+// cleanEntry is the cache entry of the cleaned samples of a segment.
+type cleanEntry struct {
+	// The samples from before the DC offset filter, which are only kept
+	// if failed blocks are retried or recleaned.
+	Raw []int
+
+	// The cleaned samples.
+	Samples []int
+}
+
+// cleanKey returns the cache key of the cleaned samples of the given
+// segment at the start of the buffer. This covers everything that the
+// samples depend on: which samples they are, how they were read, and all
+// of the cleaning settings.
+func (s *Stream) cleanKey(seg []int) string {
+	c := &s.cfg
+	return cache.Key(
+		"clean", c.CacheKey, s.base, len(seg), s.rate, s.upsample, s.gain,
+		c.SpeedCurve, c.NoClean, c.NoiseFloor, c.NoiseProfile, c.PeakWidth,
+		c.MaxPeakWidths, c.Interference, c.InterferenceHarmonics, c.Wiener,
+		c.Gate, c.GateAttack, c.GateRelease, c.GateHold, c.Retry, c.Reclean,
+	)
+}
+
+// loadCleaned replaces the given segment with its cleaned samples from
+// the cache, and returns whether they were there.
+func (s *Stream) loadCleaned(seg []int) bool {
+	if s.cfg.Cache == nil {
+		return false
+	}
+	var e cleanEntry
+	if !s.cfg.Cache.Load("clean", s.cleanKey(seg), &e) {
+		return false
+	}
+	if len(e.Samples) != len(seg) || s.keepRaw() && len(e.Raw) != len(seg) {
+		s.log().Warn("cache: cleaned samples of the wrong length")
+		return false
+	}
+	copy(seg, e.Samples)
+	if s.keepRaw() {
+		if s.raw == nil {
+			s.raw = s.cfg.Pool.Get(s.cfg.BufferSamples)
+		}
+		s.raw = append(s.raw[:0], e.Raw...)
+	}
+	metrics.Count("cached-segments", 1)
+	return true
+}
+
+// storeCleaned stores the given cleaned segment in the cache.
+func (s *Stream) storeCleaned(seg []int) {
+	if s.cfg.Cache == nil {
+		return
+	}
+	e := cleanEntry{Samples: seg}
+	if s.keepRaw() {
+		e.Raw = s.raw
+	}
+	s.cfg.Cache.Store("clean", s.cleanKey(seg), &e)
+}
@@ -0,0 +1,191 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/edorfaus/sb-mfm-decode/mfm"
+)
+
+// Checkpoint is a saved point in the decoding of an input, which can be
+// used to resume decoding from that point, e.g. after the decode was
+// interrupted, or to re-decode the rest with different settings.
+type Checkpoint struct {
+	// The input file, if known; this is only used by ResumeFile.
+	Input string `json:"input,omitempty"`
+
+	// The sample index to resume reading the input at. This is always
+	// in a quiet area between blocks, where the stream split the input.
+	Pos int `json:"pos"`
+
+	// The sample index where the last block that was returned ended;
+	// when resuming, the blocks that end before or at this are skipped.
+	Done int `json:"done"`
+
+	// The bit width to use for the first block after Pos, or 0 to take
+	// it from the lead-in of that block.
+	BitWidth int `json:"bit_width"`
+
+	// The bit width of the last block that decoded successfully before
+	// Pos, or 0 if none did, for Config.InheritBitWidth.
+	GoodBitWidth int `json:"good_bit_width,omitempty"`
+
+	// The gain the input was normalized by, or 0 if it was not (yet), for
+	// Config.Normalize; resuming with it keeps the level the same as it
+	// was before the checkpoint.
+	Gain float64 `json:"gain,omitempty"`
+
+	// The blocks that had been decoded before the checkpoint, if any.
+	// These are not used by the stream, but are kept with the checkpoint
+	// so the output is complete after resuming.
+	Blocks []*Block `json:"blocks,omitempty"`
+}
+
+// Checkpoint returns a checkpoint for the current state of the stream,
+// which can be given to Resume on a new stream for the same input to
+// continue after the last block that this stream returned.
+//
+// The Input and Blocks fields of the checkpoint are not set.
+func (s *Stream) Checkpoint() Checkpoint {
+	cp := Checkpoint{
+		Pos:          s.base,
+		Done:         s.done,
+		BitWidth:     s.bitWidth,
+		GoodBitWidth: s.goodBitWidth,
+		Gain:         s.gain,
+	}
+	if !s.started {
+		cp.Pos = s.cfg.Start
+	}
+	return cp
+}
+
+// Resume makes the stream continue from the given checkpoint, instead of
+// starting at the configured Start. This must be called before the first
+// call to Next, and the source must be at the start of the input.
+func (s *Stream) Resume(cp Checkpoint) error {
+	if s.started {
+		return errors.New("cannot resume a stream that has been started")
+	}
+	if cp.Pos < 0 || cp.Done < 0 || cp.BitWidth < 0 || cp.GoodBitWidth < 0 ||
+		cp.Gain < 0 {
+		return fmt.Errorf("invalid checkpoint: %+v", cp)
+	}
+	if s.cfg.End > 0 && cp.Pos >= s.cfg.End {
+		return fmt.Errorf(
+			"checkpoint at %v is past the end of the region", cp.Pos,
+		)
+	}
+	s.cfg.Start = cp.Pos
+	s.done = cp.Done
+	s.bitWidth = cp.BitWidth
+	s.goodBitWidth = cp.GoodBitWidth
+	s.gain = cp.Gain
+	return nil
+}
+
+// LoadCheckpoint reads a checkpoint from the given JSON file.
+func LoadCheckpoint(filename string) (*Checkpoint, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	cp := &Checkpoint{}
+	if err := json.Unmarshal(data, cp); err != nil {
+		return nil, fmt.Errorf("reading checkpoint %v: %w", filename, err)
+	}
+	return cp, nil
+}
+
+// Save writes the checkpoint to the given file as JSON.
+func (cp *Checkpoint) Save(filename string) error {
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append(data, '\n'), 0o666)
+}
+
+// jsonBlock is the JSON form of a Block, which has the error as text.
+type jsonBlock struct {
+	Start    int           `json:"start"`
+	End      int           `json:"end"`
+	BitWidth int           `json:"bit_width"`
+	Bits     []byte        `json:"bits"`
+	Conf     []byte        `json:"confidence,omitempty"`
+	Data     []byte        `json:"data,omitempty"`
+	DataConf []byte        `json:"data_confidence,omitempty"`
+	BitConf  []byte        `json:"data_bit_confidence,omitempty"`
+	Err      string        `json:"error,omitempty"`
+	Retry    *RetryParams  `json:"retry,omitempty"`
+	Reversed bool          `json:"reversed,omitempty"`
+	Bridges  []jsonBridge  `json:"bridges,omitempty"`
+	Ending   mfm.Ending    `json:"ending,omitempty"`
+	Info     mfm.BlockInfo `json:"info"`
+}
+
+// jsonBridge is the JSON form of an mfm.Bridge.
+type jsonBridge struct {
+	Start    int `json:"start"`
+	End      int `json:"end"`
+	FirstBit int `json:"first_bit"`
+	Bits     int `json:"bits"`
+}
+
+// MarshalJSON implements json.Marshaler; the error is saved as its text.
+func (b *Block) MarshalJSON() ([]byte, error) {
+	jb := jsonBlock{
+		Start:    b.Start,
+		End:      b.End,
+		BitWidth: b.BitWidth,
+		Bits:     b.Bits.Unpack(nil),
+		Conf:     b.Confidence,
+		Data:     b.Data,
+		DataConf: b.DataConfidence,
+		BitConf:  b.DataBitConfidence,
+		Retry:    b.Retry,
+		Reversed: b.Reversed,
+		Ending:   b.Ending,
+		Info:     b.Info,
+	}
+	if b.Err != nil {
+		jb.Err = b.Err.Error()
+	}
+	for _, br := range b.Bridges {
+		jb.Bridges = append(jb.Bridges, jsonBridge(br))
+	}
+	return json.Marshal(jb)
+}
+
+// UnmarshalJSON implements json.Unmarshaler. Since only the text of the
+// error was saved, the Err field gets a plain error with that text.
+func (b *Block) UnmarshalJSON(data []byte) error {
+	var jb jsonBlock
+	if err := json.Unmarshal(data, &jb); err != nil {
+		return err
+	}
+	*b = Block{
+		Start:    jb.Start,
+		End:      jb.End,
+		BitWidth: jb.BitWidth,
+		Bits:     mfm.PackBits(jb.Bits),
+		Data:     jb.Data,
+		Retry:    jb.Retry,
+		Reversed: jb.Reversed,
+		Ending:   jb.Ending,
+		Info:     jb.Info,
+
+		Confidence:        jb.Conf,
+		DataConfidence:    jb.DataConf,
+		DataBitConfidence: jb.BitConf,
+	}
+	if jb.Err != "" {
+		b.Err = errors.New(jb.Err)
+	}
+	for _, br := range jb.Bridges {
+		b.Bridges = append(b.Bridges, mfm.Bridge(br))
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package pipeline
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/edorfaus/sb-mfm-decode/mfm"
+)
+
+// PulseFeatures is the features of one pulse of a block, labelled with
+// the class it was given and whether its block decoded, as training data
+// for experimenting with other ways of classifying the pulses (e.g. with
+// machine learning) on hard captures.
+type PulseFeatures struct {
+	// The index of the block that the pulse is in, from 0, and whether
+	// that block decoded.
+	Block int
+	OK    bool
+
+	// The start of the pulse (a sample offset, counted from the start of
+	// the input), its width, and the bit width it was classified with.
+	Start, Width, BitWidth float64
+
+	// The largest distance from 0 of the cleaned samples of the pulse;
+	// 0 if the samples were not cleaned (see Config.NoClean).
+	Amplitude int
+
+	// The widths of the pulses before and after this one in the block;
+	// 0 if there is none.
+	PrevWidth, NextWidth float64
+
+	// The class the pulse was given by the decoder.
+	Class mfm.PulseClass
+}
+
+// FeatureCollector collects the PulseFeatures of the blocks of a Stream,
+// by hooking into its Cleaned and Pulses callbacks (after any that were
+// already set, which are still called). The max-likelihood decoder only
+// gives the pulses of the blocks that it could decode, so with it, the
+// blocks that failed have no features.
+type FeatureCollector struct {
+	// The pulses of the block that is being decoded.
+	pulses []mfm.Pulse
+
+	// The cleaned samples of the current segment, and the sample index
+	// of the first of them.
+	seg      []int
+	segStart int
+
+	// The index of the next block.
+	block int
+}
+
+// NewFeatureCollector creates a FeatureCollector for the given stream,
+// which must not have been used yet.
+func NewFeatureCollector(s *Stream) *FeatureCollector {
+	c := &FeatureCollector{}
+
+	cleaned := s.Cleaned
+	s.Cleaned = func(start int, samples []int) {
+		c.seg = append(c.seg[:0], samples...)
+		c.segStart = start
+		if cleaned != nil {
+			cleaned(start, samples)
+		}
+	}
+
+	pulses := s.Pulses
+	s.Pulses = mfm.PulseFunc(func(p mfm.Pulse) {
+		c.pulses = append(c.pulses, p)
+		if pulses != nil {
+			pulses.Pulse(p)
+		}
+	})
+
+	return c
+}
+
+// Block returns the features of the pulses of the given block, which
+// must be the one that the stream just returned; every block must be
+// given to it, in order.
+//
+// Only the pulses that start within the block ([b.Start, b.End)) are
+// included, as the decoder also gives the pulses of the blocks that the
+// stream skips when resuming, and of the damage it skips before a block.
+func (c *FeatureCollector) Block(b *Block) []PulseFeatures {
+	start, end := float64(b.Start), float64(b.End)
+	var pulses []mfm.Pulse
+	rest := c.pulses[:0]
+	for _, p := range c.pulses {
+		switch {
+		case p.Start >= end:
+			rest = append(rest, p)
+		case p.Start >= start:
+			pulses = append(pulses, p)
+		}
+	}
+
+	features := make([]PulseFeatures, len(pulses))
+	for i, p := range pulses {
+		f := PulseFeatures{
+			Block:     c.block,
+			OK:        b.Err == nil,
+			Start:     p.Start,
+			Width:     p.Width(),
+			BitWidth:  p.BitWidth,
+			Amplitude: c.amplitude(p),
+			Class:     p.Class,
+		}
+		if i > 0 {
+			f.PrevWidth = pulses[i-1].Width()
+		}
+		if i+1 < len(pulses) {
+			f.NextWidth = pulses[i+1].Width()
+		}
+		features[i] = f
+	}
+	c.pulses = rest
+	c.block++
+	return features
+}
+
+// amplitude returns the largest distance from 0 of the cleaned samples
+// within the given pulse.
+func (c *FeatureCollector) amplitude(p mfm.Pulse) int {
+	from := max(int(math.Ceil(p.Start))-c.segStart, 0)
+	to := min(int(math.Floor(p.End))-c.segStart+1, len(c.seg))
+	amp := 0
+	for i := from; i < to; i++ {
+		v := c.seg[i]
+		if v < 0 {
+			v = -v
+		}
+		amp = max(amp, v)
+	}
+	return amp
+}
+
+// FeatureWriter writes PulseFeatures as CSV, with a header line naming
+// the columns, and one line per pulse. The columns are all numbers,
+// except for the class, which is its name; this form can be read as is
+// by most data analysis tools, and converted to others (e.g. Parquet).
+type FeatureWriter struct {
+	out    *bufio.Writer
+	header bool
+}
+
+// NewFeatureWriter creates a FeatureWriter that writes to w. Its Flush
+// method must be called after the last pulse has been written.
+func NewFeatureWriter(w io.Writer) *FeatureWriter {
+	return &FeatureWriter{out: bufio.NewWriter(w)}
+}
+
+// Write writes the given features.
+func (w *FeatureWriter) Write(features []PulseFeatures) error {
+	if !w.header {
+		w.header = true
+		fmt.Fprintln(
+			w.out, "block,ok,start,width,bit_width,rel_width,amplitude,"+
+				"prev_width,next_width,class",
+		)
+	}
+	for _, f := range features {
+		ok, rel := 0, 0.0
+		if f.OK {
+			ok = 1
+		}
+		if f.BitWidth > 0 {
+			rel = f.Width / f.BitWidth
+		}
+		_, err := fmt.Fprintf(
+			w.out, "%v,%v,%.3f,%.3f,%.3f,%.4f,%v,%.3f,%.3f,%v\n",
+			f.Block, ok, f.Start, f.Width, f.BitWidth, rel, f.Amplitude,
+			f.PrevWidth, f.NextWidth, f.Class,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush writes any buffered data to the underlying writer.
+func (w *FeatureWriter) Flush() error {
+	return w.out.Flush()
+}
@@ -0,0 +1,185 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// JobStatus is how the decode of a file in a Job ended.
+type JobStatus string
+
+const (
+	// JobDone means that the file was decoded to the end, although some
+	// of its blocks may have failed.
+	JobDone JobStatus = "done"
+	// JobFailed means that the decode stopped with an error, e.g. because
+	// the file could not be read.
+	JobFailed JobStatus = "failed"
+)
+
+// JobEntry is the state of a file in a Job, as recorded when its decode
+// ended.
+type JobEntry struct {
+	Input  string    `json:"input"`
+	Status JobStatus `json:"status"`
+	Err    string    `json:"error,omitempty"`
+
+	// The size and modification time of the input when it was decoded,
+	// to tell if it has changed since then.
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+
+	// The number of blocks, how many failed, and the decoded bytes.
+	Blocks       int `json:"blocks"`
+	FailedBlocks int `json:"failed_blocks"`
+	Bytes        int `json:"bytes"`
+
+	// When the decode ended, and how long it took.
+	Finished time.Time     `json:"finished"`
+	Duration time.Duration `json:"duration"`
+}
+
+// Job is the state of a batch of files being decoded, as kept in a job
+// file, so that a run that was interrupted (or crashed) can be resumed by
+// skipping the files that were already decoded.
+//
+// The job file has one JSON line per file that was done, which is added
+// as soon as that file is done, so at most the line that was being
+// written when it stopped is lost; such a partial line is ignored. If the
+// same file is recorded more than once, the last entry is used.
+type Job struct {
+	entries map[string]*JobEntry
+	f       *os.File
+}
+
+// OpenJob opens the given job file, reading the state recorded in it (if
+// it exists), and creating it if it does not.
+func OpenJob(filename string) (*Job, error) {
+	j := &Job{entries: map[string]*JobEntry{}}
+
+	data, err := os.ReadFile(filename)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	// A last line without a newline was only partly written, so it is
+	// ignored, and then replaced by the next line that is written.
+	end := bytes.LastIndexByte(data, '\n') + 1
+	if end < len(data) {
+		logger.F(1, "Ignoring partial last line of job file %v\n", filename)
+	}
+	for i, line := range bytes.Split(data[:end], []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		e := &JobEntry{}
+		if err := json.Unmarshal(line, e); err != nil {
+			return nil, fmt.Errorf(
+				"reading job file %v: line %v: %w", filename, i+1, err,
+			)
+		}
+		j.entries[e.Input] = e
+	}
+
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE, 0o666)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(int64(end)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(int64(end), io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	j.f = f
+	return j, nil
+}
+
+// Entry returns the recorded state of the given input, or nil if it has
+// not been recorded.
+func (j *Job) Entry(input string) *JobEntry {
+	return j.entries[input]
+}
+
+// Entries returns the number of inputs that have been recorded.
+func (j *Job) Entries() int {
+	return len(j.entries)
+}
+
+// Done returns true if the given input has been decoded to the end, and
+// has not changed since then.
+func (j *Job) Done(input string) bool {
+	e := j.entries[input]
+	if e == nil || e.Status != JobDone {
+		return false
+	}
+	fi, err := os.Stat(input)
+	if err != nil {
+		return false
+	}
+	return fi.Size() == e.Size && fi.ModTime().Equal(e.ModTime)
+}
+
+// Pending returns the inputs that are not Done, in the same order.
+func (j *Job) Pending(inputs []string) []string {
+	var pending []string
+	for _, in := range inputs {
+		if !j.Done(in) {
+			pending = append(pending, in)
+		}
+	}
+	return pending
+}
+
+// Record records the result of decoding a file, and writes it to the job
+// file. Results that were stopped by their context being cancelled are
+// not recorded, as the file was not done; they are redone when resuming.
+// (A file that timed out is recorded as failed, as it would again.)
+func (j *Job) Record(res *Result) error {
+	if errors.Is(res.Err, context.Canceled) {
+		return nil
+	}
+
+	e := &JobEntry{
+		Input:        res.Input,
+		Status:       JobDone,
+		Blocks:       len(res.Blocks),
+		FailedBlocks: res.FailedBlocks(),
+		Finished:     time.Now(),
+		Duration:     res.Duration,
+	}
+	if res.Err != nil {
+		e.Status, e.Err = JobFailed, res.Err.Error()
+	}
+	for _, b := range res.Blocks {
+		e.Bytes += len(b.Data)
+	}
+	if fi, err := os.Stat(res.Input); err == nil {
+		e.Size, e.ModTime = fi.Size(), fi.ModTime()
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := j.f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := j.f.Sync(); err != nil {
+		return err
+	}
+	j.entries[e.Input] = e
+	return nil
+}
+
+// Close closes the job file.
+func (j *Job) Close() error {
+	return j.f.Close()
+}
@@ -0,0 +1,238 @@
+package pipeline
+
+import (
+	"io"
+	"sort"
+
+	"github.com/edorfaus/sb-mfm-decode/filter"
+	"github.com/edorfaus/sb-mfm-decode/metrics"
+	"github.com/edorfaus/sb-mfm-decode/mfm"
+	"github.com/edorfaus/sb-mfm-decode/wav"
+)
+
+// MergeChannels merges the results of decoding several channels of the
+// given WAVE file that recorded the same data (e.g. through different
+// preamps), as given by DecodeChannels with the given roles and
+// configuration, into one list of blocks, in order.
+//
+// The blocks of the channels that overlap are taken to be readings of the
+// same block, and the best of them is used (as for Retry), if it decoded
+// and covers all of the others. Otherwise, the samples of the block are
+// read again from each of the channels, cleaned and edge detected, and
+// their edges are merged pulse by pulse (see mfm.MergeEdges) and decoded;
+// if that decodes to more data than the best reading, it is used.
+//
+// The pulses are only merged if the blocks have the positions of the
+// input samples, so not if the input was upsampled or resampled by a
+// SpeedCurve. If the file could not be read again, the error is returned.
+func MergeChannels(
+	filename string, roles []wav.Role, results []*Result, cfg Config,
+) ([]*Block, error) {
+	var all []*Block
+	for _, res := range results {
+		all = append(all, res.Blocks...)
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].Start < all[j].Start
+	})
+
+	m, err := newChannelMerger(filename, roles, results, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer m.close()
+
+	var out []*Block
+	for i := 0; i < len(all); {
+		j, end := i+1, all[i].End
+		for ; j < len(all) && all[j].Start < end; j++ {
+			end = max(end, all[j].End)
+		}
+		b, err := m.merge(all[i:j])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, b)
+		i = j
+	}
+	return out, nil
+}
+
+// channelMerger merges the pulses of the channels of a block, for
+// MergeChannels; a nil channelMerger only picks the best reading.
+type channelMerger struct {
+	// The readers of the data channels.
+	readers []*wav.Reader
+
+	// A Stream that is not read from, which has the configuration that
+	// the channels were decoded with, after its defaults were filled in.
+	s *Stream
+}
+
+// newChannelMerger returns a channelMerger for the given results, or nil
+// if their pulses cannot be merged.
+func newChannelMerger(
+	filename string, roles []wav.Role, results []*Result, cfg Config,
+) (*channelMerger, error) {
+	if len(results) < 2 || len(cfg.SpeedCurve) > 0 {
+		return nil, nil
+	}
+	meta := results[0].Meta
+	cfg.BufferSamples = 1
+	s := NewStream(NewSliceSource(nil), meta.SampleRate, meta.BitDepth, cfg)
+	if s.upsample > 1 {
+		s.Close()
+		return nil, nil
+	}
+
+	readers, err := wav.OpenDataReaders(filename, roles)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return &channelMerger{readers: readers, s: s}, nil
+}
+
+// close closes the readers of the channels.
+func (m *channelMerger) close() {
+	if m == nil {
+		return
+	}
+	for _, r := range m.readers {
+		r.Close()
+	}
+	m.s.Close()
+}
+
+// merge returns the block that the given readings of the same block give
+// together, as for MergeChannels.
+func (m *channelMerger) merge(readings []*Block) (*Block, error) {
+	best := readings[0]
+	for _, b := range readings[1:] {
+		if retryScore(b) > retryScore(best) {
+			best = b
+		}
+	}
+	start, end := best.Start, best.End
+	for _, b := range readings {
+		start, end = min(start, b.Start), max(end, b.End)
+	}
+	if m == nil || best.Err == nil && best.Start == start && best.End == end {
+		return best, nil
+	}
+
+	// The best reading failed, or only decoded part of the block (e.g. up
+	// to a dropout, where another channel went on further).
+	merged, err := m.mergePulses(start, end)
+	if err != nil || merged == nil || retryScore(merged) <= retryScore(best) {
+		return best, err
+	}
+	metrics.Count("merged-blocks", 1)
+	return merged, nil
+}
+
+// mergePulses reads the samples from start to end (and some of the quiet
+// around them) from each of the channels, merges their edges, and decodes
+// the block that overlaps the most with that range from them. It returns
+// that block, or nil if there is none that decodes.
+func (m *channelMerger) mergePulses(start, end int) (*Block, error) {
+	cfg := m.s.cfg
+
+	// Include some of the quiet area around the block, for the filter
+	// and edge detector to see where the block starts and ends, as for
+	// Retry.
+	margin := cfg.GapSamples / 2
+	from := max(start-margin, 0)
+	raw := make([]int, end+margin-from)
+	bitWidth := mfm.ExpectedBitWidth(cfg.BitRate, m.s.rate)
+
+	channels := make([]*mfm.EdgeList, len(m.readers))
+	for i, r := range m.readers {
+		if err := r.Seek(from); err != nil {
+			return nil, err
+		}
+		n, err := readFull(r, raw)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if channels[i] = m.edges(raw[:n], from, bitWidth); channels[i] == nil {
+			return nil, nil
+		}
+	}
+	merged, _ := mfm.MergeEdges(channels, bitWidth)
+
+	d := mfm.NewDecoderWith(
+		merged,
+		mfm.WithMaxGap(cfg.MaxGap),
+		mfm.WithMaxBits(cfg.MaxBlockBits),
+		mfm.WithMaxSamples(cfg.MaxBlockSamples),
+		mfm.WithLogger(m.s.Log),
+	)
+	var b *Block
+	bestOverlap := 0
+	for {
+		err := d.NextBlock()
+		if err == mfm.EOD {
+			break
+		}
+		if err != nil {
+			for d.Edge.Cur().Type != mfm.EdgeToNone && d.Edge.Next() {
+			}
+			continue
+		}
+		bStart, bEnd := from+d.StartIndex, from+d.EndIndex
+		overlap := min(bEnd, end) - max(bStart, start)
+		if overlap <= bestOverlap {
+			continue
+		}
+		data, err := m.s.format().DecodeBlock(d.Bits)
+		if err != nil || len(data) == 0 {
+			continue
+		}
+		bestOverlap = overlap
+		b = &Block{
+			Start:    bStart,
+			End:      bEnd,
+			BitWidth: d.BitWidth,
+			Bits:     mfm.PackBits(d.Bits),
+			Data:     data,
+			Ending:   d.Ending,
+			Info:     d.Info,
+
+			Confidence: append([]byte(nil), d.Confidence...),
+		}
+	}
+	if b != nil {
+		m.s.finishInfo(b)
+	}
+	return b, nil
+}
+
+// edges cleans the given raw samples of a channel (in place), which start
+// at the given sample index, and returns their edges; or nil if they
+// could not be cleaned.
+func (m *channelMerger) edges(
+	raw []int, from int, bitWidth float64,
+) *mfm.EdgeList {
+	cfg := m.s.cfg
+	profile := cfg.NoiseProfile.From(from)
+	if !cfg.NoClean {
+		f := filter.NewDCOffsetWith(
+			filter.WithNoiseFloor(cfg.NoiseFloor),
+			filter.WithNoiseProfile(profile),
+			filter.WithPeakWidth(cfg.PeakWidth),
+			filter.WithMaxPeakWidths(cfg.MaxPeakWidths),
+			filter.WithLogger(m.s.Log),
+		)
+		if err := f.Run(raw, raw); err != nil {
+			return nil
+		}
+	}
+	ed := mfm.NewEdgeDetectWith(
+		raw,
+		mfm.WithNoiseFloor(cfg.NoiseFloor),
+		mfm.WithNoiseProfile(profile),
+		mfm.WithMaxCrossingTime(int(bitWidth+0.5)),
+	)
+	return mfm.CollectEdges(ed)
+}
@@ -0,0 +1,166 @@
+package pipeline
+
+import (
+	"math"
+
+	"golang.org/x/exp/slices"
+
+	"github.com/edorfaus/sb-mfm-decode/metrics"
+	"github.com/edorfaus/sb-mfm-decode/mfm"
+)
+
+// The most of the start of a block that its lead-in is looked for in, in
+// expected bit widths, and the fewest pulses of it that are needed to
+// estimate the settings from.
+const (
+	recleanLeadIn    = 64
+	recleanMinPulses = 16
+)
+
+// reclean cleans the samples of a failed block again, by themselves, with
+// a peak width and noise floor estimated from its own lead-in, decodes
+// them, and replaces the result of the block with that, if it is better.
+// The given end is the end of the samples of the block, which may be
+// after b.End.
+//
+// This is for blocks whose level or speed is far enough from the rest of
+// the input that the configured settings do not suit them, such as those
+// recorded separately, or after a dropout that upset the cleanup.
+func (s *Stream) reclean(b *Block, end int) {
+	// Include some of the quiet area around the block, as for retry; the
+	// noise floor is partly estimated from the quiet before it.
+	margin := s.cfg.GapSamples / 2
+	from := max(b.Start-s.base-margin, 0)
+	to := min(end-s.base+margin, len(s.raw))
+	if from >= to || b.Start-s.base < from {
+		return
+	}
+	raw := s.raw[from:to]
+
+	p, ok := s.estimateLeadIn(raw, b.Start-s.base-from)
+	if !ok {
+		s.log().F(2, "Reclean of block at %v: no usable lead-in\n", b.Start)
+		return
+	}
+	metrics.Count("recleaned-blocks", 1)
+
+	buf := make([]int, len(raw))
+	c := s.retryWith(p, nil, raw, buf, s.base+from, b)
+	if c == nil || retryScore(c) <= retryScore(b) {
+		return
+	}
+	s.log().F(2, "Recleaned block at %v: %+v\n", b.Start, *c.Retry)
+	if c.Err == nil {
+		metrics.Count("recovered-blocks", 1)
+	}
+	*b = *c
+}
+
+// estimateLeadIn estimates the settings to clean and decode a block with,
+// from its lead-in, which starts at the given index of the raw samples:
+// the bit width (for the peak width and the max crossing time) from the
+// widths of its pulses, which are all one bit width, and the noise floor
+// from their level and that of the quiet before the block. It returns
+// false if the block does not start with enough of a lead-in for that.
+func (s *Stream) estimateLeadIn(raw []int, start int) (RetryParams, bool) {
+	expected := mfm.ExpectedBitWidth(s.cfg.BitRate, s.rate)
+	window := raw[start:min(start+int(recleanLeadIn*expected), len(raw))]
+	if len(window) == 0 {
+		return RetryParams{}, false
+	}
+
+	// The DC offset is not removed from the raw samples, so the levels are
+	// taken around their mean, and the crossings have hysteresis at a
+	// quarter of the mean level, to not be set off by noise.
+	mean := meanOf(window)
+	level := 0.0
+	for _, v := range window {
+		level += math.Abs(float64(v) - mean)
+	}
+	level /= float64(len(window))
+	h := level / 4
+
+	var widths []int
+	var peaks []float64
+	state, last, peak := 0, -1, 0.0
+	for i, v := range window {
+		d := float64(v) - mean
+		peak = math.Max(peak, math.Abs(d))
+		sign := 0
+		if d > h {
+			sign = 1
+		} else if d < -h {
+			sign = -1
+		}
+		if sign == 0 || sign == state {
+			continue
+		}
+		if state != 0 {
+			if last >= 0 {
+				widths = append(widths, i-last)
+				peaks = append(peaks, peak)
+			}
+			last = i
+		}
+		state, peak = sign, 0
+	}
+	if len(widths) < recleanMinPulses {
+		return RetryParams{}, false
+	}
+
+	// The lead-in is the pulses at the start that are about as wide as the
+	// first few of them; it must have enough of those to go by.
+	w := median(slices.Clone(widths[:recleanMinPulses]))
+	run := 0
+	for _, v := range widths {
+		if math.Abs(float64(v)-w) > w/4 {
+			break
+		}
+		run++
+	}
+	if run < recleanMinPulses {
+		return RetryParams{}, false
+	}
+	bitWidth := 0.0
+	for _, v := range widths[:run] {
+		bitWidth += float64(v)
+	}
+	bitWidth /= float64(run)
+	amp := median(slices.Clone(peaks[:run]))
+
+	// Take the noise floor at a quarter of the level of the lead-in, but
+	// above the noise before the block, if that leaves enough margin.
+	noiseFloor := amp / 4
+	if quiet := raw[:start]; len(quiet) > 0 {
+		qm, noise := meanOf(quiet), 0.0
+		for _, v := range quiet {
+			noise = math.Max(noise, math.Abs(float64(v)-qm))
+		}
+		noiseFloor = math.Max(noiseFloor, math.Min(noise*5/4, amp/2))
+	}
+
+	return RetryParams{
+		NoiseFloor:      max(int(noiseFloor+0.5), 1),
+		MaxCrossingTime: int(bitWidth + 0.5),
+		PeakWidth:       int(math.Ceil(bitWidth)),
+		Local:           true,
+	}, true
+}
+
+func meanOf(v []int) float64 {
+	sum := 0.0
+	for _, x := range v {
+		sum += float64(x)
+	}
+	return sum / float64(len(v))
+}
+
+// median returns the median of the given values, reordering them.
+func median[T int | float64](v []T) float64 {
+	slices.Sort(v)
+	n := len(v)
+	if n%2 == 1 {
+		return float64(v[n/2])
+	}
+	return float64(v[n/2-1]+v[n/2]) / 2
+}
@@ -0,0 +1,97 @@
+package pipeline
+
+import (
+	"io"
+	"math"
+
+	"github.com/edorfaus/sb-mfm-decode/sample"
+)
+
+// Resampler is a SampleSource that corrects the speed of the samples of
+// another source by a speed curve, so that a tape that was played at a
+// varying speed (e.g. on a deck with a worn belt) reads as if it had been
+// played at its nominal speed. The samples are linearly interpolated.
+//
+// It can also upsample the source, for inputs whose sample rate is too
+// low to decode as they are, returning Upsample samples for each sample
+// of the source.
+//
+// The sample indexes of the curve are counted from the start of the
+// source; those of the samples it returns are of the corrected samples.
+type Resampler struct {
+	Curve sample.SpeedCurve
+
+	// The factor to upsample the source by; 0 is the same as 1.
+	Upsample int
+
+	src SampleSource
+
+	// The buffered samples of the source, the index of the first of them,
+	// and whether the source is at its end.
+	in   []int
+	base int
+	eof  bool
+
+	// The position in the source of the next sample to return.
+	pos float64
+}
+
+func NewResampler(src SampleSource, curve sample.SpeedCurve) *Resampler {
+	return &Resampler{Curve: curve, src: src}
+}
+
+// ReadSamples reads the next corrected samples into buf, and returns how
+// many were read. At the end of the source, it returns 0 and io.EOF.
+func (r *Resampler) ReadSamples(buf []int) (int, error) {
+	n := 0
+	for n < len(buf) {
+		i := int(r.pos) - r.base
+		if i+1 >= len(r.in) && !r.eof {
+			if err := r.fill(i); err != nil {
+				return n, err
+			}
+			continue
+		}
+		if i >= len(r.in) {
+			break
+		}
+
+		v := float64(r.in[i])
+		if i+1 < len(r.in) {
+			t := r.pos - math.Floor(r.pos)
+			v += t * float64(r.in[i+1]-r.in[i])
+		}
+		buf[n] = int(math.Round(v))
+		n++
+
+		// A tape that was played fast has its bits too close together, so
+		// it takes less of the source to make each corrected sample.
+		r.pos += 1 / (r.Curve.At(r.pos) * float64(max(r.Upsample, 1)))
+	}
+	if n == 0 && len(buf) > 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// fill drops the buffered samples before the given one, and reads more
+// samples from the source after the rest.
+func (r *Resampler) fill(keep int) error {
+	keep = max(keep, 0)
+	if keep > 0 {
+		r.in = append(r.in[:0], r.in[keep:]...)
+		r.base += keep
+	}
+	if cap(r.in) < len(r.in)+readChunk {
+		in := make([]int, len(r.in), len(r.in)+readChunk)
+		copy(in, r.in)
+		r.in = in
+	}
+	n, err := r.src.ReadSamples(r.in[len(r.in):cap(r.in)])
+	r.in = r.in[:len(r.in)+n]
+	if err == io.EOF {
+		r.eof = true
+		return nil
+	}
+	return err
+}
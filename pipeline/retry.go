@@ -0,0 +1,202 @@
+package pipeline
+
+import (
+	"github.com/edorfaus/sb-mfm-decode/filter"
+	"github.com/edorfaus/sb-mfm-decode/metrics"
+	"github.com/edorfaus/sb-mfm-decode/mfm"
+	"github.com/edorfaus/sb-mfm-decode/sample"
+)
+
+// RetryParams are the settings that a failed block was decoded with when
+// it was retried.
+type RetryParams struct {
+	// The noise floor used for cleaning and edge detection.
+	NoiseFloor int `json:"noise_floor"`
+
+	// The max crossing time of the edge detector.
+	MaxCrossingTime int `json:"max_crossing_time"`
+
+	// The peak width used for cleaning, if not the configured one, and
+	// whether the settings were estimated from the block's own lead-in
+	// (see Config.Reclean).
+	PeakWidth int  `json:"peak_width,omitempty"`
+	Local     bool `json:"local,omitempty"`
+}
+
+// These are the factors to multiply the configured noise floor and the
+// expected bit width (for the max crossing time) by, when retrying. The
+// first of each is the original setting.
+var (
+	retryNoiseFloors   = []float64{1, 0.5, 0.75, 1.5, 2}
+	retryCrossingTimes = []float64{1, 0.75, 1.25, 1.5}
+)
+
+// retry decodes the samples of a failed block again, with each of a range
+// of different settings, and replaces the result of the block with the
+// best one it finds, if that is better than the original. The given end
+// is the end of the samples of the block, which may be after b.End.
+func (s *Stream) retry(b *Block, end int) {
+	metrics.Count("retried-blocks", 1)
+
+	// Include some of the quiet area around the block, for the filter
+	// and edge detector to see where the block starts and ends.
+	margin := s.cfg.GapSamples / 2
+	from, to := b.Start-s.base-margin, end-s.base+margin
+	if from < 0 {
+		from = 0
+	}
+	if to > len(s.raw) {
+		to = len(s.raw)
+	}
+	if from >= to {
+		return
+	}
+	raw := s.raw[from:to]
+	buf := make([]int, len(raw))
+
+	best, bestScore := b, retryScore(b)
+	bitWidth := mfm.ExpectedBitWidth(s.cfg.BitRate, s.rate)
+	for _, nf := range retryNoiseFloors {
+		for _, ct := range retryCrossingTimes {
+			if nf == 1 && ct == 1 {
+				// This is what the block was first decoded with.
+				continue
+			}
+			p := RetryParams{
+				NoiseFloor:      int(float64(s.noiseFloorAt(b.Start)) * nf),
+				MaxCrossingTime: int(bitWidth*ct + 0.5),
+			}
+			profile := s.cfg.NoiseProfile.From(s.base + from).Scale(nf)
+			c := s.retryWith(p, profile, raw, buf, s.base+from, b)
+			if c == nil {
+				continue
+			}
+			if score := retryScore(c); score > bestScore {
+				best, bestScore = c, score
+			}
+		}
+	}
+
+	if best != b {
+		s.log().F(
+			2, "Retried block at %v: %+v\n", b.Start, *best.Retry,
+		)
+		if best.Err == nil {
+			metrics.Count("recovered-blocks", 1)
+		}
+		*b = *best
+	}
+}
+
+// retryWith decodes the given raw samples with the given settings (and
+// noise profile, if any, counted from raw[0]), using buf for the cleaned
+// samples, and returns the block that overlaps the
+// most with the given failed block (or nil if none of them do). The base
+// is the sample index of raw[0].
+func (s *Stream) retryWith(
+	p RetryParams, profile sample.NoiseProfile, raw, buf []int, base int,
+	failed *Block,
+) *Block {
+	copy(buf, raw)
+
+	if !s.cfg.NoClean {
+		peakWidth := s.cfg.PeakWidth
+		if p.PeakWidth > 0 {
+			peakWidth = p.PeakWidth
+		}
+		f := filter.NewDCOffsetWith(
+			filter.WithNoiseFloor(p.NoiseFloor),
+			filter.WithNoiseProfile(profile),
+			filter.WithPeakWidth(peakWidth),
+			filter.WithMaxPeakWidths(s.cfg.MaxPeakWidths),
+			filter.WithLogger(s.Log),
+		)
+		if err := f.Run(buf, buf); err != nil {
+			return nil
+		}
+	}
+	if s.cfg.Gate {
+		if err := s.gate(p.NoiseFloor).Run(buf, buf); err != nil {
+			return nil
+		}
+	}
+	if s.cfg.Wiener {
+		f := filter.NewWiener(p.NoiseFloor, 0)
+		f.Log = s.Log
+		if err := f.Run(buf, buf); err != nil {
+			return nil
+		}
+	}
+
+	opts := []mfm.Option{
+		mfm.WithNoiseFloor(p.NoiseFloor),
+		mfm.WithNoiseProfile(profile),
+		mfm.WithMaxCrossingTime(p.MaxCrossingTime),
+		mfm.WithWeightedZero(s.cfg.WeightedEdges),
+		mfm.WithMaxGap(s.cfg.MaxGap),
+		mfm.WithMaxNoisePulses(s.cfg.MaxNoisePulses),
+		mfm.WithHealTiny(s.cfg.HealTiny),
+		mfm.WithMaxLikelihood(s.cfg.MaxLikelihood),
+		mfm.WithInheritBitWidth(s.cfg.InheritBitWidth),
+		mfm.WithMaxBits(s.cfg.MaxBlockBits),
+		mfm.WithMaxSamples(s.cfg.MaxBlockSamples),
+		mfm.WithLogger(s.Log),
+	}
+	if s.bitWidth > 0 {
+		opts = append(opts, mfm.WithBitWidth(float64(s.bitWidth)))
+	}
+	d := mfm.NewDecoderWith(mfm.NewEdgeDetectWith(buf, opts...), opts...)
+	d.LastGoodBitWidth = s.lastGoodBitWidth()
+
+	var best *Block
+	bestOverlap := 0
+	for {
+		err := d.NextBlock()
+		if err == mfm.EOD {
+			break
+		}
+
+		start, end := base+d.StartIndex, base+d.EndIndex
+		overlap := min(end, failed.End) - max(start, failed.Start)
+		if overlap > bestOverlap {
+			bestOverlap = overlap
+			best = &Block{
+				Start:    start,
+				End:      end,
+				BitWidth: d.BitWidth,
+				Bits:     mfm.PackBits(d.Bits),
+				Err:      err,
+				Retry:    &p,
+				Bridges:  bridges(d, base),
+				Ending:   d.Ending,
+				Info:     d.Info,
+
+				Confidence: append([]byte(nil), d.Confidence...),
+			}
+		}
+
+		if err != nil {
+			for d.Edge.Cur().Type != mfm.EdgeToNone && d.Edge.Next() {
+			}
+		}
+	}
+
+	if best != nil && best.Err == nil {
+		bits := best.Bits.Unpack(nil)
+		best.Data, best.Err = s.format().DecodeBlock(bits)
+	}
+	return best
+}
+
+// retryScore returns a score for how good the result of decoding a block
+// is, for choosing the best one; a higher score is better.
+func retryScore(b *Block) int {
+	if b.Err == nil && len(b.Data) > 0 {
+		// Any block that decodes is better than every one that doesn't,
+		// and then the more data, the better. A block without any data
+		// is not counted, as that is likely just a bit of noise.
+		return 1<<30 + len(b.Data)
+	}
+	// Otherwise, the further it got, the better.
+	return b.Bits.Len()
+}
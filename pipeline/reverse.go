@@ -0,0 +1,88 @@
+package pipeline
+
+import (
+	"github.com/edorfaus/sb-mfm-decode/metrics"
+	"github.com/edorfaus/sb-mfm-decode/mfm"
+)
+
+// reverse decodes the edges of a failed block both forward and backward,
+// and if reconciling the two gives bits that decode, replaces the result
+// of the block with that. The given end is the end of the samples of the
+// block, which may be after b.End.
+func (s *Stream) reverse(b *Block, end int) {
+	metrics.Count("reversed-blocks", 1)
+
+	edges := s.blockEdges(b.Start, end)
+	if len(edges) < 2 {
+		return
+	}
+
+	bitWidth := float64(s.bitWidth)
+	fwd := mfm.DecodeForward(edges, bitWidth, mfm.ClassLimits{})
+	if bitWidth == 0 {
+		// The backward pass needs a bit width to start from, and the best
+		// guess for it is the one from the lead-in.
+		bitWidth = float64(edges[1].Index - edges[0].Index)
+	}
+	rev := mfm.DecodeBackward(edges, bitWidth, mfm.ClassLimits{})
+
+	for _, bits := range mfm.Reconcile(edges, fwd, rev) {
+		data, err := s.format().DecodeBlock(bits)
+		if err != nil || len(data) == 0 {
+			continue
+		}
+		s.log().F(
+			2, "Reversed block at %v: edges %v-%v forward, %v-%v back\n",
+			b.Start, 0, fwd.Last, rev.First, len(edges)-1,
+		)
+		metrics.Count("recovered-blocks", 1)
+		b.End = edges[len(edges)-1].Index
+		b.Bits, b.Data, b.Err = mfm.PackBits(bits), data, nil
+		b.Confidence = nil
+		b.Reversed = true
+		b.Bridges = nil
+		return
+	}
+}
+
+// blockEdges detects the edges of the cleaned samples of the current
+// segment from start to end, and returns those that are not edges to
+// none. Both the given and the returned indexes are counted from the
+// start of the input.
+func (s *Stream) blockEdges(start, end int) []mfm.Edge {
+	// Include some of the quiet area around the block, for the edge
+	// detector to see where the block starts and ends.
+	margin := s.cfg.GapSamples / 2
+	from, to := start-s.base-margin, end-s.base+margin
+	if from < 0 {
+		from = 0
+	}
+	if to > s.segLen {
+		to = s.segLen
+	}
+	if from >= to {
+		return nil
+	}
+
+	bitWidth := mfm.ExpectedBitWidth(s.cfg.BitRate, s.rate)
+	ed := mfm.NewEdgeDetectWith(
+		s.buf[from:to],
+		mfm.WithNoiseFloor(s.cfg.NoiseFloor),
+		mfm.WithNoiseProfile(s.cfg.NoiseProfile.From(s.base+from)),
+		mfm.WithMaxCrossingTime(int(bitWidth+0.5)),
+		mfm.WithWeightedZero(s.cfg.WeightedEdges),
+		mfm.WithLogger(s.Log),
+	)
+
+	var edges []mfm.Edge
+	for ed.Next() {
+		e := ed.Cur()
+		e.Index += s.base + from
+		e.Zero += float64(s.base + from)
+		if e.Index < start || e.Index > end || e.Type == mfm.EdgeToNone {
+			continue
+		}
+		edges = append(edges, e)
+	}
+	return edges
+}
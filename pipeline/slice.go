@@ -0,0 +1,42 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+)
+
+// SliceSource is a SampleSeeker that reads from samples that are already
+// in memory, e.g. to decode the same samples several times.
+type SliceSource struct {
+	Samples []int
+
+	pos int
+}
+
+func NewSliceSource(samples []int) *SliceSource {
+	return &SliceSource{Samples: samples}
+}
+
+// ReadSamples reads the next samples into buf, continuing from where the
+// previous call left off, and returns how many were read. At the end of
+// the samples, it returns 0 and io.EOF.
+func (s *SliceSource) ReadSamples(buf []int) (int, error) {
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	if s.pos >= len(s.Samples) {
+		return 0, io.EOF
+	}
+	n := copy(buf, s.Samples[s.pos:])
+	s.pos += n
+	return n, nil
+}
+
+// Seek sets the sample that the next call to ReadSamples starts at.
+func (s *SliceSource) Seek(sample int) error {
+	if sample < 0 || sample > len(s.Samples) {
+		return fmt.Errorf("bad sample: %v", sample)
+	}
+	s.pos = sample
+	return nil
+}
@@ -0,0 +1,432 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/edorfaus/sb-mfm-decode/sample"
+	"github.com/edorfaus/sb-mfm-decode/studybox"
+)
+
+// Spec is a declarative description of a decode: the inputs, where the
+// outputs go, and the stages of the pipeline with their settings, so that
+// a recipe for recovering a hard tape can be saved, shared, and run again
+// with exactly the same settings. It is stored as JSON, e.g.:
+//
+//	{
+//	  "version": 1,
+//	  "inputs": ["side-a.wav"],
+//	  "output": "out",
+//	  "stages": [
+//	    {"stage": "resample", "params": {"curve": "side-a-speed.csv"}},
+//	    {"stage": "hum", "params": {"freq": 50, "harmonics": 4}},
+//	    {"stage": "clean"},
+//	    {"stage": "edges", "params": {"noise_floor": 800}},
+//	    {"stage": "decode", "params": {"ml": true, "retry": true}},
+//	    {"stage": "bytes", "params": {"check": "crc16"}}
+//	  ]
+//	}
+//
+// The stages are those of a Stream, and must be given in the order that
+// it runs them: resample, hum, clean, gate, wiener, edges, decode, bytes.
+// Each of them is optional, and can only be given once; clean, gate and
+// wiener are only run if they are given, while the others use their
+// defaults if they are not. See the *Params types for the settings of
+// each stage.
+//
+// Unknown stages and settings are errors, so that a misspelled setting
+// does not silently change the result.
+type Spec struct {
+	// The version of the spec format; 0 is taken to be 1, which is the
+	// only one so far.
+	Version int `json:"version"`
+
+	// The input files, and the directory to write the outputs to (one
+	// listing per input, named after it); if empty, the current one.
+	// When the spec is loaded from a file, relative paths in it (these,
+	// and those of the files that stages read) are relative to the
+	// directory of that file.
+	Inputs []string `json:"inputs"`
+	Output string   `json:"output,omitempty"`
+
+	// The number of files to decode at once; if 0, the number of CPUs.
+	Workers int `json:"workers,omitempty"`
+
+	// The sample rate to use instead of that of the inputs, the MFM bit
+	// rate, and the number of samples to hold in memory at once; if 0,
+	// the defaults. See Config.
+	SampleRate    int `json:"sample_rate,omitempty"`
+	BitRate       int `json:"bit_rate,omitempty"`
+	BufferSamples int `json:"buffer_samples,omitempty"`
+
+	// The region of each input to decode; see Config.
+	Start int `json:"start,omitempty"`
+	End   int `json:"end,omitempty"`
+
+	Stages []StageSpec `json:"stages"`
+
+	// The directory that relative paths are relative to.
+	dir string
+}
+
+// StageSpec is a stage of a Spec, with its settings, which are given by
+// the *Params type of that stage.
+type StageSpec struct {
+	Stage  string          `json:"stage"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// ResampleParams are the settings of the resample stage, which corrects
+// the speed that the tape was played at; see Config.Speed and SpeedCurve.
+type ResampleParams struct {
+	Speed float64 `json:"speed,omitempty"`
+
+	// A CSV file of the speed over time, as read by sample.ReadSpeedCurve.
+	Curve string `json:"curve,omitempty"`
+}
+
+// HumParams are the settings of the hum stage, which removes a periodic
+// interference; see Config.Interference.
+type HumParams struct {
+	// The frequency, in Hz; if negative, it is detected.
+	Freq      float64 `json:"freq"`
+	Harmonics int     `json:"harmonics,omitempty"`
+}
+
+// CleanParams are the settings of the clean stage, which removes the DC
+// offset of the samples. It also uses the noise floor of the edges stage.
+type CleanParams struct {
+	PeakWidth     int `json:"peak_width,omitempty"`
+	MaxPeakWidths int `json:"max_peak_widths,omitempty"`
+}
+
+// GateParams are the settings of the gate stage, which zeroes the quiet
+// parts of the samples; see Config.Gate. The times are in samples; if 0,
+// they are based on the peak width.
+type GateParams struct {
+	Attack  int `json:"attack,omitempty"`
+	Release int `json:"release,omitempty"`
+	Hold    int `json:"hold,omitempty"`
+}
+
+// EdgesParams are the settings of the edges stage, which finds the edges
+// of the signal.
+type EdgesParams struct {
+	// The noise floor; if not given, the default for the bit depth.
+	NoiseFloor *int `json:"noise_floor,omitempty"`
+
+	// The noise floor in dBFS (below 0), instead of as a sample value.
+	NoiseFloorDB *float64 `json:"noise_floor_db,omitempty"`
+
+	// A CSV file of the noise floor over time, as read by
+	// sample.ReadNoiseProfile, which is used instead of the noise floor.
+	NoiseProfile string `json:"noise_profile,omitempty"`
+
+	// Whether to place the edges by the slope between the peaks; see
+	// Config.WeightedEdges.
+	Weighted bool `json:"weighted,omitempty"`
+}
+
+// DecodeParams are the settings of the decode stage, which decodes the
+// MFM bits of the blocks; see the fields of Config with the same names.
+type DecodeParams struct {
+	MaxGap         float64 `json:"max_gap,omitempty"`
+	MaxNoisePulses int     `json:"noise_pulses,omitempty"`
+	HealTiny       bool    `json:"heal,omitempty"`
+	MaxLikelihood  bool    `json:"ml,omitempty"`
+	Inherit        bool    `json:"inherit,omitempty"`
+	Retry          bool    `json:"retry,omitempty"`
+	Reclean        bool    `json:"reclean,omitempty"`
+	Reverse        bool    `json:"reverse,omitempty"`
+
+	MaxBlockBits    int `json:"max_bits,omitempty"`
+	MaxBlockSamples int `json:"max_samples,omitempty"`
+	MaxFailedBlocks int `json:"max_failed,omitempty"`
+}
+
+// BytesParams are the settings of the bytes stage, which decodes the
+// bytes of the blocks from their bits.
+type BytesParams struct {
+	// The block depth the bytes are interleaved with; if 0 or 1, they
+	// are not.
+	Interleave int `json:"interleave,omitempty"`
+
+	// The data check, by name, as for studybox.ParseChecker.
+	Check string `json:"check,omitempty"`
+}
+
+// specStages are the names of the stages, in the order they must be in.
+var specStages = []string{
+	"resample", "hum", "clean", "gate", "wiener", "edges", "decode",
+	"bytes",
+}
+
+// ReadSpec reads a Spec in JSON form. Relative paths in it are relative
+// to the current directory.
+func ReadSpec(r io.Reader) (*Spec, error) {
+	s := &Spec{}
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(s); err != nil {
+		return nil, fmt.Errorf("bad pipeline spec: %w", err)
+	}
+	return s, nil
+}
+
+// LoadSpec reads the Spec in the given file, as by ReadSpec, except that
+// relative paths in it are relative to the directory of that file.
+func LoadSpec(filename string) (*Spec, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s, err := ReadSpec(f)
+	if err != nil {
+		return nil, err
+	}
+	s.dir = filepath.Dir(filename)
+	return s, nil
+}
+
+// WriteSpec writes the given Spec in JSON form, indented for reading.
+func WriteSpec(w io.Writer, s *Spec) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(s)
+}
+
+// path returns the given path from the spec, made relative to the
+// directory of the spec file (if any).
+func (s *Spec) path(p string) string {
+	if p == "" || filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(s.dir, p)
+}
+
+// Pipeline is a decode that is ready to run, as made from a Spec.
+type Pipeline struct {
+	// The input files, and the directory to write the outputs to.
+	Inputs []string
+	OutDir string
+
+	// The number of files to decode at once; if 0, the number of CPUs.
+	Workers int
+
+	// The configuration of the decode of each input.
+	Config Config
+}
+
+// FromSpec makes a Pipeline from the given Spec, checking its stages and
+// settings, and reading the files that they refer to.
+func FromSpec(s *Spec) (*Pipeline, error) {
+	if s.Version != 0 && s.Version != 1 {
+		return nil, fmt.Errorf("unsupported spec version: %v", s.Version)
+	}
+	if len(s.Inputs) == 0 {
+		return nil, fmt.Errorf("the spec has no inputs")
+	}
+	if s.Workers < 0 || s.Start < 0 || s.End < 0 {
+		return nil, fmt.Errorf("workers, start and end cannot be negative")
+	}
+
+	p := &Pipeline{
+		OutDir:  s.path(s.Output),
+		Workers: s.Workers,
+		Config: Config{
+			NoiseFloor:    -1,
+			SampleRate:    s.SampleRate,
+			BitRate:       s.BitRate,
+			BufferSamples: s.BufferSamples,
+			Start:         s.Start,
+			End:           s.End,
+			NoClean:       true,
+		},
+	}
+	if p.OutDir == "" {
+		p.OutDir = "."
+	}
+	for _, in := range s.Inputs {
+		p.Inputs = append(p.Inputs, s.path(in))
+	}
+
+	next := 0
+	for _, st := range s.Stages {
+		i := next
+		for i < len(specStages) && specStages[i] != st.Stage {
+			i++
+		}
+		if i == len(specStages) {
+			return nil, fmt.Errorf(
+				"unknown, repeated or misplaced stage: %q (the stages"+
+					" must be in this order: %v)",
+				st.Stage, strings.Join(specStages, ", "),
+			)
+		}
+		next = i + 1
+		if err := s.applyStage(&p.Config, st); err != nil {
+			return nil, fmt.Errorf("stage %v: %w", st.Stage, err)
+		}
+	}
+	return p, nil
+}
+
+// applyStage applies the settings of the given stage to the config.
+func (s *Spec) applyStage(cfg *Config, st StageSpec) error {
+	switch st.Stage {
+	case "resample":
+		var sp ResampleParams
+		if err := decodeParams(st.Params, &sp); err != nil {
+			return err
+		}
+		if sp.Speed < 0 {
+			return fmt.Errorf("speed cannot be negative")
+		}
+		cfg.Speed = sp.Speed
+		if sp.Curve != "" {
+			c, err := sample.LoadSpeedCurve(s.path(sp.Curve))
+			if err != nil {
+				return err
+			}
+			cfg.SpeedCurve = c
+		}
+
+	case "hum":
+		var hp HumParams
+		if err := decodeParams(st.Params, &hp); err != nil {
+			return err
+		}
+		if hp.Freq == 0 {
+			return fmt.Errorf("freq must be given")
+		}
+		cfg.Interference = hp.Freq
+		cfg.InterferenceHarmonics = hp.Harmonics
+
+	case "clean":
+		var cp CleanParams
+		if err := decodeParams(st.Params, &cp); err != nil {
+			return err
+		}
+		cfg.NoClean = false
+		cfg.PeakWidth = cp.PeakWidth
+		cfg.MaxPeakWidths = cp.MaxPeakWidths
+
+	case "gate":
+		var gp GateParams
+		if err := decodeParams(st.Params, &gp); err != nil {
+			return err
+		}
+		if gp.Attack < 0 || gp.Release < 0 || gp.Hold < 0 {
+			return fmt.Errorf("times cannot be negative")
+		}
+		cfg.Gate = true
+		cfg.GateAttack = gp.Attack
+		cfg.GateRelease = gp.Release
+		cfg.GateHold = gp.Hold
+
+	case "wiener":
+		if err := decodeParams(st.Params, &struct{}{}); err != nil {
+			return err
+		}
+		cfg.Wiener = true
+
+	case "edges":
+		var ep EdgesParams
+		if err := decodeParams(st.Params, &ep); err != nil {
+			return err
+		}
+		if ep.NoiseFloor != nil {
+			if *ep.NoiseFloor < 0 {
+				return fmt.Errorf("noise floor cannot be negative")
+			}
+			cfg.NoiseFloor = *ep.NoiseFloor
+		}
+		if ep.NoiseFloorDB != nil {
+			if ep.NoiseFloor != nil {
+				return fmt.Errorf("noise floor given both ways")
+			}
+			if *ep.NoiseFloorDB >= 0 {
+				return fmt.Errorf("noise floor in dB must be below 0")
+			}
+			cfg.NoiseFloorDB = *ep.NoiseFloorDB
+		}
+		if ep.NoiseProfile != "" {
+			np, err := sample.LoadNoiseProfile(s.path(ep.NoiseProfile))
+			if err != nil {
+				return err
+			}
+			cfg.NoiseProfile = np
+		}
+		cfg.WeightedEdges = ep.Weighted
+
+	case "decode":
+		var dp DecodeParams
+		if err := decodeParams(st.Params, &dp); err != nil {
+			return err
+		}
+		cfg.MaxGap = dp.MaxGap
+		cfg.MaxNoisePulses = dp.MaxNoisePulses
+		cfg.HealTiny = dp.HealTiny
+		cfg.MaxLikelihood = dp.MaxLikelihood
+		cfg.InheritBitWidth = dp.Inherit
+		cfg.Retry = dp.Retry
+		cfg.Reclean = dp.Reclean
+		cfg.Reverse = dp.Reverse
+		cfg.MaxBlockBits = dp.MaxBlockBits
+		cfg.MaxBlockSamples = dp.MaxBlockSamples
+		cfg.MaxFailedBlocks = dp.MaxFailedBlocks
+
+	case "bytes":
+		var bp BytesParams
+		if err := decodeParams(st.Params, &bp); err != nil {
+			return err
+		}
+		check, err := studybox.ParseChecker(bp.Check)
+		if err != nil {
+			return err
+		}
+		cfg.Check = check
+		if bp.Interleave > 1 {
+			cfg.Interleaving = studybox.BlockInterleave{
+				Depth: bp.Interleave,
+			}
+		}
+	}
+	return nil
+}
+
+// decodeParams decodes the given stage settings into v, which must be a
+// pointer to the *Params type of the stage. Unknown settings are errors.
+func decodeParams(params json.RawMessage, v any) error {
+	if len(params) == 0 {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(params))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("bad params: %w", err)
+	}
+	return nil
+}
+
+// Run decodes the inputs of the pipeline, as by a Scheduler, and returns
+// their results in the same order as the inputs. The given function, if
+// not nil, is called with each result as soon as it is done, as by
+// Scheduler.OnResult.
+func (p *Pipeline) Run(
+	ctx context.Context, onResult func(res *Result),
+) []*Result {
+	sched := Scheduler{
+		Workers:  p.Workers,
+		Config:   p.Config,
+		OnResult: onResult,
+	}
+	return sched.Run(ctx, p.Inputs)
+}
@@ -0,0 +1,1167 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+
+	"golang.org/x/exp/slices"
+
+	"github.com/edorfaus/sb-mfm-decode/cache"
+	"github.com/edorfaus/sb-mfm-decode/events"
+	"github.com/edorfaus/sb-mfm-decode/filter"
+	"github.com/edorfaus/sb-mfm-decode/log"
+	"github.com/edorfaus/sb-mfm-decode/metrics"
+	"github.com/edorfaus/sb-mfm-decode/mfm"
+	"github.com/edorfaus/sb-mfm-decode/pool"
+	"github.com/edorfaus/sb-mfm-decode/quality"
+	"github.com/edorfaus/sb-mfm-decode/sample"
+	"github.com/edorfaus/sb-mfm-decode/studybox"
+	"github.com/edorfaus/sb-mfm-decode/wav"
+)
+
+// logger is the logger used by this package.
+var logger = log.Named("pipeline")
+
+// DefaultBufferSamples is the default maximum number of samples that a
+// Stream holds in memory at once (4Mi samples, which takes 32MiB).
+const DefaultBufferSamples = 4 * 1024 * 1024
+
+// readChunk is the maximum number of samples to read at once, to limit
+// the size of the reader's own buffer.
+const readChunk = 64 * 1024
+
+// peakWidthTolerance is how far (as a fraction) the measured bit width can
+// be from the nominal one before the peak width is based on it instead.
+// This is wide enough that a tape that is only a little off speed keeps
+// the nominal peak width, which the DC offset filter has some room for.
+const peakWidthTolerance = 0.1
+
+// SampleSource is a source of samples that can be read a chunk at a time,
+// such as a wav.Reader. At the end of the data, it returns io.EOF.
+type SampleSource interface {
+	ReadSamples(buf []int) (int, error)
+}
+
+// SampleSeeker is a SampleSource that can also move to a given sample,
+// such as a wav.Reader; this is used to skip to the start of a region.
+type SampleSeeker interface {
+	SampleSource
+	Seek(sample int) error
+}
+
+// Config holds the settings for a Stream.
+type Config struct {
+	// The noise floor; if negative, filter.DefaultNoiseFloor is used.
+	NoiseFloor int
+
+	// The noise floor in dBFS, which is used instead of NoiseFloor if it
+	// is not 0, converted to a sample value for the bit depth. If it is
+	// not valid for the bit depth (see sample.CheckDB), reading from the
+	// stream fails.
+	NoiseFloorDB float64
+
+	// The noise floor over the input, if it varies; when set, this is
+	// used instead of NoiseFloor, both for cleaning the samples and for
+	// detecting edges. The sample indexes are counted from the start of
+	// the input.
+	NoiseProfile sample.NoiseProfile
+
+	// The peak width for the DC offset filter; if 0, it is calculated
+	// from the bit rate and sample rate, and then measured from the pulse
+	// spacing of the first samples (see mfm.MeasureBitWidth), which is
+	// used instead if it is far enough off, e.g. for an off-speed tape.
+	PeakWidth int
+
+	// The MFM bit rate; if 0, mfm.DefaultBitRate is used.
+	BitRate int
+
+	// The sample rate of the input; if 0, the one given to NewStream is
+	// used. This is for files whose header gives the wrong rate.
+	SampleRate int
+
+	// The speed the tape was played at, relative to its nominal speed,
+	// e.g. 1.02 if it was played 2% fast; if 0, it is taken to be 1. The
+	// sample rate is divided by this, so that the bit widths (and times)
+	// are worked out from the rate the tape was recorded at.
+	Speed float64
+
+	// The speed the tape was played at over the input, if it varies; when
+	// set, the input is resampled by it (see Resampler) before anything
+	// else is done with it, after which Speed still applies. The sample
+	// indexes of the curve are counted from the start of the input, while
+	// all others (of the region, the noise profile and the blocks) are
+	// then counted in the corrected samples.
+	SpeedCurve sample.SpeedCurve
+
+	// Whether to skip cleaning the input with the DC offset filter.
+	NoClean bool
+
+	// How to normalize the input before anything else is done with it,
+	// e.g. so that the default noise floor suits a capture that was made
+	// too quietly; if nil, it is not normalized. The level of the whole
+	// input is not known while streaming it, so the gain is measured from
+	// the first buffer of samples, and then applied to all of them.
+	Normalize *wav.Normalizer
+
+	// The frequency (in Hz) of a periodic interference to remove from the
+	// input before cleaning it, such as bias tone leakage or power supply
+	// whine, along with the given number of its harmonics (including it);
+	// if negative, it is detected in each segment, and if 0, nothing is
+	// removed. See filter.Comb.
+	Interference          float64
+	InterferenceHarmonics int
+
+	// Whether to run a noise gate on the samples (see filter.Gate), which
+	// zeroes the quiet parts between the blocks. With NoClean, this is a
+	// cheaper alternative to the DC offset filter for clean captures;
+	// otherwise, it is run after that filter. The attack, release and
+	// hold times of the gate are in samples; if 0, they are based on the
+	// peak width (see filter.NewGate).
+	Gate                              bool
+	GateAttack, GateRelease, GateHold int
+
+	// Whether to also run a Wiener filter on the samples after cleaning
+	// them, to attenuate the noise before detecting the edges, for very
+	// poor captures. This is done even if NoClean is set.
+	Wiener bool
+
+	// The maximum number of samples to hold in memory at once; if 0,
+	// DefaultBufferSamples is used. Blocks that are longer than this
+	// will be split into several blocks.
+	BufferSamples int
+
+	// The minimum number of quiet samples between two blocks for the
+	// stream to split the input between them; if 0, this is set to 8
+	// peak widths. This must be long enough that it cannot happen in
+	// the middle of a block, so it is raised to be longer than MaxGap.
+	GapSamples int
+
+	// The region of the input to decode, as the sample index to start
+	// at, and the index to stop before (or 0 for the end of the input).
+	// The block positions are still counted from the start of the input.
+	//
+	// The region should start in a quiet area before a block, as the
+	// cleanup and edge detection cannot recover a block that they only
+	// see part of.
+	Start, End int
+
+	// Whether to skip the audio-only passages of the input: the bursts of
+	// data in the region are first found by a cheap scan (IndexBursts),
+	// and then only those are decoded. This needs a source that is a
+	// SampleSeeker (and not upsampled or resampled by a speed curve), to
+	// go back to the bursts after the scan; otherwise, or for a live
+	// input, the whole region is decoded as usual.
+	SkipAudio bool
+
+	// The pool to take the sample buffer from, and return it to when the
+	// stream is closed; if nil, the buffer is allocated normally.
+	Pool *pool.Pool[int]
+
+	// If set, the cleaned samples of each segment are kept in this cache,
+	// and taken from it instead of cleaning them again when the same
+	// input is decoded again with the same cleaning settings. CacheKey
+	// must then identify the samples that the stream is given, e.g. by
+	// the cache.HashFile of the input file and how it was read.
+	Cache    *cache.Cache
+	CacheKey string
+
+	// Whether the input is live, e.g. from a sound card, so that reading
+	// it waits for the samples to arrive. Each segment is then decoded
+	// as soon as the gap after it has been read, instead of when the
+	// buffer is full, so that the blocks are returned while it plays.
+	Live bool
+
+	// Whether to retry decoding blocks that fail, with a range of other
+	// settings, keeping the best result. This needs a second buffer, to
+	// keep the samples from before they were cleaned.
+	Retry bool
+
+	// Whether to clean the samples of a block that fails again, by
+	// themselves, with a peak width and noise floor estimated from the
+	// block's own lead-in instead of the configured ones, and decode it
+	// again, keeping the result if it is better. This is done before any
+	// Retry, and needs the same second buffer.
+	Reclean bool
+
+	// Whether to decode blocks that still fail both forward and backward
+	// from the ends of the block, and try to reconcile the two, which can
+	// recover blocks that are damaged near the start.
+	Reverse bool
+
+	// Whether to place the edges by the slope between the peaks around
+	// them, instead of by the two samples around zero, for pulses that are
+	// not symmetric. See mfm.EdgeDetectOf.WeightedZero.
+	WeightedEdges bool
+
+	// The longest dropout within a block, in bit widths, that is bridged
+	// with unknown bits instead of splitting the block; if 0, dropouts are
+	// not bridged.
+	MaxGap float64
+
+	// The most invalid pulses at the end of a block to trim off as noise,
+	// instead of failing the block; if 0, nothing is trimmed.
+	MaxNoisePulses int
+
+	// Whether to heal pulses that were split in two by a glitch, by
+	// merging pairs of Tiny pulses that together make a valid one.
+	HealTiny bool
+
+	// The safety limits, so that a damaged or garbage input cannot run
+	// away with memory or time; if 0, there is no limit. A block with
+	// more MFM bits, or more samples, than its limit fails to decode
+	// (see mfm.Decoder); a peak longer than its limit (in peak widths)
+	// fails the cleaning of the segment it is in (see filter.DCOffsetOf);
+	// and the stream stops after the given number of failed blocks in a
+	// row. Each of these gives a sample.LimitError.
+	MaxBlockBits    int
+	MaxBlockSamples int
+	MaxPeakWidths   int
+	MaxFailedBlocks int
+
+	// Whether to decode each block as a whole, as the most likely valid
+	// sequence of pulses, instead of pulse by pulse.
+	MaxLikelihood bool
+
+	// Whether to start each block from the bit width of the last block
+	// that decoded successfully, even across segments, instead of from
+	// its lead-in, so that blocks whose lead-in was lost to a dropout can
+	// still be decoded. See mfm.Decoder.InheritBitWidth.
+	InheritBitWidth bool
+
+	// How the bytes of each block are interleaved on the tape; if nil,
+	// they are not.
+	Interleaving studybox.Interleaving
+
+	// The integrity check to run on the bytes of each block, in addition
+	// to their framing; if nil, there is none.
+	Check studybox.Checker
+}
+
+// Block is a block of data decoded by a Stream.
+type Block struct {
+	// The sample indexes of the start and end of the block, counted from
+	// the start of the input.
+	Start, End int
+
+	// The bit width (in samples) at the end of the block.
+	BitWidth int
+
+	// The MFM bits of the block, both clock and data bits, packed to keep
+	// the blocks of a long tape small.
+	Bits mfm.PackedBits
+
+	// The confidence of each of the MFM bits, as given by the decoder;
+	// nil if it is not known, as for reversed blocks.
+	Confidence []byte
+
+	// The decoded data bytes of the block, if it could be decoded.
+	Data []byte
+
+	// The confidence of each of the data bytes, and of each of their data
+	// bits (8 per byte), in the same order as the bytes; nil if the
+	// block could not be decoded, or its Confidence is not known.
+	DataConfidence    []byte
+	DataBitConfidence []byte
+
+	// The error that occurred while decoding the block, if any; this is
+	// either an error from the MFM decoder, or from decoding the bytes.
+	Err error
+
+	// If the block failed to decode at first, and was then decoded with
+	// a better result when retried, these are the settings it used.
+	Retry *RetryParams
+
+	// Whether the block was recovered by reconciling forward and backward
+	// decoding of it.
+	Reversed bool
+
+	// The dropouts that were bridged in the block, with their positions
+	// counted from the start of the input.
+	Bridges []mfm.Bridge
+
+	// How the block ended, as seen by the MFM decoder.
+	Ending mfm.Ending
+
+	// The metadata of the block, from the MFM decoder; its positions and
+	// counts are updated to match the final result of the block.
+	Info mfm.BlockInfo
+}
+
+// ID returns the identifier of the block, as by studybox.BlockID from its
+// start and its data, or its bits if it could not be decoded.
+func (b *Block) ID() string {
+	if b.Err != nil {
+		return studybox.BlockID(b.Start, b.Bits.Unpack(nil))
+	}
+	return studybox.BlockID(b.Start, b.Data)
+}
+
+// Stream decodes blocks from a SampleSource, while only holding a fixed
+// number of samples in memory at once, so that arbitrarily long inputs
+// can be processed.
+//
+// It does this by reading samples into a buffer, splitting the buffer at
+// a quiet gap between blocks, and then cleaning, edge detecting and
+// decoding the part before that gap, before moving on to the rest.
+type Stream struct {
+	// The logger to use; if nil, the package logger is used.
+	Log *log.Logger
+
+	// Where to send the pipeline events, with their positions counted
+	// from the start of the input; may be nil. The events of retried
+	// blocks are not sent. The end event of each block is only sent once
+	// its bytes have been decoded and checked (and it has been retried,
+	// if it failed), for its final result: BlockEnd if it decoded,
+	// ChecksumFailure if its MFM decoded but its bytes did not, or
+	// BlockError if its MFM did not. To get a callback for each kind of
+	// event, use events.Observe.
+	Events events.Sink
+
+	// If set, this is called with the samples of each segment after they
+	// have been cleaned, along with the index of the first of them, e.g.
+	// to keep them for decoding again later. It must not modify or keep
+	// the given slice.
+	Cleaned func(start int, samples []int)
+
+	// If set, this is given the pulses found by the decoder, with their
+	// positions counted from the start of the input, e.g. to know where
+	// each edge of a block was. As with Events, the pulses of retried
+	// blocks are not sent.
+	Pulses mfm.PulseSink
+
+	// If set, this is given the half-bit cells that the decoder laid over
+	// the signal (see mfm.Cell), with their positions counted from the
+	// start of the input, e.g. to draw them over it. Their bit indexes
+	// are into the Bits of the block, which is returned after its cells
+	// have all been sent. As with Pulses, they are those of the first
+	// decode of each block, so they do not match the bits of a block that
+	// was retried or reversed.
+	Cells mfm.CellSink
+
+	src  SampleSource
+	rate int
+	cfg  Config
+
+	// The factor the input is upsampled by; 1 if it is not.
+	upsample int
+
+	// The bit depth of the input, and the gain it is normalized by, for
+	// Config.Normalize; gain is 0 until it has been measured.
+	bits int
+	gain float64
+
+	// Whether the peak width (and the gap length) are to be measured from
+	// the input, because they were not given.
+	measurePeak bool
+	measureGap  bool
+
+	// The buffered samples, and the sample index of buf[0].
+	buf     []int
+	base    int
+	eof     bool
+	started bool
+
+	// The bursts of data to decode, and the index of the current one, if
+	// the audio between them is skipped; bursts is nil if it is not.
+	bursts []Burst
+	burst  int
+
+	// The samples of the current segment from before they were cleaned,
+	// if failed blocks are retried or recleaned.
+	raw []int
+
+	// The length of the segment currently being decoded, and the decoder
+	// for it; dec is nil when there is no current segment.
+	segLen int
+	dec    *mfm.Decoder
+
+	// The type of the end event that the decoder sent for its current
+	// block, which is held back until the block is done (see Events).
+	blockEnd events.Type
+
+	// The bit width to carry over from one segment to the next, and that
+	// of the last block that decoded successfully, for InheritBitWidth.
+	bitWidth     int
+	goodBitWidth int
+
+	// The end of the last block that was returned; blocks that end
+	// before this are skipped, which is used when resuming.
+	done int
+
+	// The number of failed blocks in a row just before done, and the
+	// error that stopped the stream when they got too many (or when its
+	// configuration was not valid).
+	failed  int
+	stopErr error
+
+	// The quality measurements of the decode so far.
+	quality quality.Collector
+}
+
+// NewStream creates a new Stream reading from the given source, which
+// has the given sample rate and bit depth.
+//
+// If the sample rate is too low to decode the input as it is (below 2 *
+// bit rate), the input is upsampled by the factor of mfm.UpsampleFactor
+// (see Resampler), with a warning. As with Config.SpeedCurve, the sample
+// indexes of the region, the noise profile and the blocks are then
+// counted in the upsampled samples.
+func NewStream(src SampleSource, rate, bits int, cfg Config) *Stream {
+	if cfg.SampleRate <= 0 {
+		cfg.SampleRate = rate
+	}
+	rate = cfg.SampleRate
+	if cfg.Speed > 0 {
+		rate = int(float64(rate)/cfg.Speed + 0.5)
+	}
+	// NewStream cannot fail, so a noise floor that is not valid for the
+	// bit depth instead stops the stream when it is first read from.
+	var stopErr error
+	if cfg.NoiseFloorDB != 0 {
+		stopErr = sample.CheckDB(cfg.NoiseFloorDB, bits)
+		cfg.NoiseFloor = sample.FromDB(cfg.NoiseFloorDB, bits)
+	}
+	if cfg.NoiseFloor < 0 {
+		cfg.NoiseFloor = filter.DefaultNoiseFloor(bits)
+	}
+	if cfg.BitRate == 0 {
+		cfg.BitRate = mfm.DefaultBitRate
+	}
+	up := mfm.UpsampleFactor(cfg.BitRate, rate)
+	rate *= up
+	measurePeak := cfg.PeakWidth <= 0
+	if measurePeak {
+		cfg.PeakWidth = filter.MfmPeakWidth(cfg.BitRate, rate)
+	}
+	if cfg.BufferSamples <= 0 {
+		cfg.BufferSamples = DefaultBufferSamples
+	}
+	if len(cfg.SpeedCurve) > 0 || up > 1 {
+		r := NewResampler(src, cfg.SpeedCurve)
+		r.Upsample = up
+		src = r
+	}
+	measureGap := cfg.GapSamples <= 0
+	if measureGap {
+		cfg.GapSamples = 8 * cfg.PeakWidth
+	}
+	cfg.GapSamples = coverMaxGap(cfg.GapSamples, cfg.PeakWidth, cfg.MaxGap)
+	return &Stream{
+		src:         src,
+		rate:        rate,
+		upsample:    up,
+		bits:        bits,
+		measurePeak: measurePeak,
+		measureGap:  measureGap && measurePeak,
+		cfg:         cfg,
+		buf:         cfg.Pool.Get(cfg.BufferSamples)[:0],
+		stopErr:     stopErr,
+	}
+}
+
+// Close releases the sample buffer of the stream, returning it to the
+// pool (if any). The stream must not be used after this.
+func (s *Stream) Close() {
+	s.cfg.Pool.Put(s.buf)
+	s.cfg.Pool.Put(s.raw)
+	s.buf, s.raw = nil, nil
+	s.dec = nil
+}
+
+// Quality returns the quality report of the decode so far.
+func (s *Stream) Quality() quality.Report {
+	return s.quality.Report()
+}
+
+// Config returns the configuration of the stream, with defaults filled in.
+func (s *Stream) Config() Config {
+	return s.cfg
+}
+
+// SampleRate returns the sample rate that the stream decodes the input
+// with, after it has been corrected for the Speed (and any upsampling).
+func (s *Stream) SampleRate() int {
+	return s.rate
+}
+
+func (s *Stream) log() *log.Logger {
+	if s.Log != nil {
+		return s.Log
+	}
+	return logger
+}
+
+// Next returns the next decoded block, or io.EOF at the end of the input.
+//
+// If a block could not be decoded, the block is still returned, with
+// its Err field set. If an error is returned instead, then a part of the
+// input could not be processed at all; Next may still be called again
+// to continue with the rest of the input, unless the error is from the
+// SampleSource, or the stream stopped at its MaxFailedBlocks limit.
+func (s *Stream) Next() (*Block, error) {
+	return s.NextContext(context.Background())
+}
+
+// NextContext is like Next, but it stops early (returning the context's
+// error) if the context is cancelled.
+func (s *Stream) NextContext(ctx context.Context) (*Block, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if err := s.checkFailed(); err != nil {
+			return nil, err
+		}
+
+		if s.dec != nil {
+			err := s.dec.NextBlockContext(ctx)
+			if err != nil && err == ctx.Err() {
+				return nil, err
+			}
+			if err != mfm.EOD {
+				b := s.makeBlock(err)
+				if b.End <= s.done {
+					continue
+				}
+				s.done = b.End
+				s.failed++
+				if b.Err == nil {
+					s.failed = 0
+				}
+				return b, nil
+			}
+			s.bitWidth = s.dec.BitWidth
+			s.goodBitWidth = s.dec.LastGoodBitWidth
+			s.consume(s.segLen)
+			continue
+		}
+
+		if err := s.fill(); err != nil {
+			return nil, err
+		}
+		if len(s.buf) == 0 {
+			more, err := s.nextBurst()
+			if err != nil {
+				return nil, err
+			}
+			if more {
+				continue
+			}
+			return nil, io.EOF
+		}
+		if s.measurePeak {
+			s.measurePeakWidth()
+		}
+
+		if err := s.startSegment(ctx, s.findCut()); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// checkFailed returns the error that stops the stream, if it has had too
+// many failed blocks in a row.
+func (s *Stream) checkFailed() error {
+	limit := s.cfg.MaxFailedBlocks
+	if s.stopErr == nil && limit > 0 && s.failed >= limit {
+		s.stopErr = &sample.LimitError{
+			Limit: "failed blocks in a row", Max: limit, Index: s.done,
+		}
+	}
+	return s.stopErr
+}
+
+// fill reads samples into the buffer until it is full, or until the end
+// of the input (or region) has been reached.
+func (s *Stream) fill() error {
+	if !s.started {
+		s.started = true
+		if s.upsample > 1 {
+			s.log().Warn(fmt.Sprintf(
+				"sample rate too low for bit rate %v, upsampling %vx to %v",
+				s.cfg.BitRate, s.upsample, s.rate,
+			))
+		}
+		if s.cfg.SkipAudio {
+			if err := s.indexBursts(); err != nil {
+				return err
+			}
+		}
+		if err := s.skipTo(s.regionStart()); err != nil {
+			return err
+		}
+	}
+
+	from := len(s.buf)
+
+	// The buffer may have more room than was asked for, as the pool
+	// rounds it up, but only BufferSamples are to be held at once.
+	size := s.cfg.BufferSamples
+	for !s.eof && len(s.buf) < size {
+		if s.cfg.Live && s.gapCut() >= 0 {
+			break
+		}
+		to := len(s.buf) + readChunk
+		if to > size {
+			to = size
+		}
+		if end := s.regionEnd(); end > 0 && s.base+to >= end {
+			to = end - s.base
+			if to <= len(s.buf) {
+				s.eof = true
+				break
+			}
+		}
+		n, err := s.src.ReadSamples(s.buf[len(s.buf):to])
+		s.buf = s.buf[:len(s.buf)+n]
+		if err == io.EOF {
+			s.eof = true
+		} else if err != nil {
+			return err
+		}
+	}
+	if s.cfg.Normalize != nil {
+		s.normalize(from)
+	}
+	return nil
+}
+
+// normalize normalizes the samples that were read into the buffer from
+// the given index on, for Config.Normalize. The first time, the gain is
+// measured from the whole buffer, which is then all normalized.
+func (s *Stream) normalize(from int) {
+	if s.gain == 0 {
+		s.gain = s.cfg.Normalize.Gain(s.buf, s.bits)
+		from = 0
+		s.log().F(
+			1, "Normalized to %v, gain %.3f\n", s.cfg.Normalize, s.gain,
+		)
+	}
+	wav.Amplify(s.buf[from:], s.bits, s.gain)
+}
+
+// skipTo moves the source forward to the given sample index, by seeking
+// if the source supports it, or otherwise by reading and discarding. The
+// buffer must be empty.
+func (s *Stream) skipTo(start int) error {
+	if start <= s.base {
+		return nil
+	}
+
+	if seeker, ok := s.src.(SampleSeeker); ok {
+		if err := seeker.Seek(start); err != nil {
+			return err
+		}
+		s.base = start
+		return nil
+	}
+
+	buf := s.buf[:s.cfg.BufferSamples]
+	for s.base < start {
+		n := start - s.base
+		if n > len(buf) {
+			n = len(buf)
+		}
+		n, err := s.src.ReadSamples(buf[:n])
+		s.base += n
+		if err == io.EOF {
+			s.eof = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexBursts finds the bursts of data in the region, for SkipAudio, and
+// moves the source back to the start of the region; if the source cannot
+// do that, the whole region is decoded instead.
+func (s *Stream) indexBursts() error {
+	seeker, ok := s.src.(SampleSeeker)
+	if !ok || s.cfg.Live {
+		s.log().Warn("cannot skip audio: input is live, or not seekable")
+		return nil
+	}
+	if err := s.skipTo(s.cfg.Start); err != nil {
+		return err
+	}
+
+	done := s.log().Time(1, "Indexing bursts of data...")
+	bursts, err := IndexBursts(s.src, BurstScan{
+		NoiseFloor: s.noiseFloorAt(s.cfg.Start),
+		PeakWidth:  s.cfg.PeakWidth,
+		Start:      s.cfg.Start,
+		End:        s.cfg.End,
+	})
+	if err != nil {
+		return err
+	}
+	if err := seeker.Seek(s.cfg.Start); err != nil {
+		return err
+	}
+	s.base = s.cfg.Start
+	done(" done in")
+
+	total := 0
+	for _, b := range bursts {
+		total += b.End - b.Start
+	}
+	s.log().F(
+		1, "Found %v bursts of data, %v samples in all\n",
+		len(bursts), total,
+	)
+
+	s.bursts = append([]Burst{}, bursts...)
+	if len(bursts) == 0 {
+		s.eof = true
+	}
+	return nil
+}
+
+// regionStart returns the sample index to start reading at: the start of
+// the current burst, if the audio is skipped, or of the region.
+func (s *Stream) regionStart() int {
+	if s.burst < len(s.bursts) {
+		return s.bursts[s.burst].Start
+	}
+	return s.cfg.Start
+}
+
+// regionEnd returns the sample index to stop reading before: the end of
+// the current burst, if the audio is skipped, or of the region (0 for the
+// end of the input).
+func (s *Stream) regionEnd() int {
+	if s.burst < len(s.bursts) {
+		return s.bursts[s.burst].End
+	}
+	return s.cfg.End
+}
+
+// nextBurst moves on to the next burst of data, if the audio is skipped
+// and there is another one, returning whether it did.
+func (s *Stream) nextBurst() (bool, error) {
+	if s.burst+1 >= len(s.bursts) {
+		return false, nil
+	}
+	s.burst++
+	s.eof = false
+	return true, s.skipTo(s.regionStart())
+}
+
+// findCut finds where to split the buffered samples, returning the
+// length of the segment to be processed next.
+func (s *Stream) findCut() int {
+	if cut := s.gapCut(); cut >= 0 {
+		return cut
+	}
+
+	n := len(s.buf)
+	if s.eof {
+		// There's no more input, so process everything that's left.
+		return n
+	}
+
+	// The buffer is full, but no gap was found, so we have no choice
+	// but to split the block.
+	s.log().WarnAt(s.base+n, "block too long for buffer, splitting it")
+	return n
+}
+
+// gapCut returns where to cut the buffer in the first long enough quiet
+// area after the data, or -1 if there is no such area (yet).
+func (s *Stream) gapCut() int {
+	n, w, gap := len(s.buf), s.cfg.PeakWidth, s.cfg.GapSamples
+
+	// Skip past the quiet area at the start, which is left there by the
+	// previous cut, to find the start of the data.
+	i := 0
+	for i+w <= n && s.quiet(i, i+w) {
+		i += w
+	}
+	if i+w > n && n > gap {
+		// It is all quiet; keep a little of it for the next segment.
+		return n - gap/2
+	}
+
+	// Look for a long enough quiet area after the data, and cut in the
+	// middle of it, leaving enough quiet on both sides for the filter
+	// and edge detector to see the end and the start of the blocks.
+	runStart := -1
+	for ; i+w <= n; i += w {
+		if !s.quiet(i, i+w) {
+			runStart = -1
+			continue
+		}
+		if runStart < 0 {
+			runStart = i
+		}
+		if i+w-runStart >= gap {
+			return runStart + gap/2
+		}
+	}
+	return -1
+}
+
+// coverMaxGap returns the given gap length (in samples), raised if needed
+// to be longer than a dropout of maxGap bit widths (of about the peak
+// width), so that the stream does not split a block at a dropout that
+// the decoder would bridge.
+func coverMaxGap(gap, peakWidth int, maxGap float64) int {
+	if maxGap <= 0 {
+		return gap
+	}
+	return max(gap, int(math.Ceil(maxGap*float64(peakWidth)))+peakWidth)
+}
+
+// measurePeakWidth measures the bit width from the buffered samples, and
+// uses it for the peak width (and the gap length) instead of the nominal
+// one, if they are far enough apart. This is only done once, before the
+// first segment is cleaned.
+func (s *Stream) measurePeakWidth() {
+	s.measurePeak = false
+	bw := mfm.MeasureBitWidth(s.buf, s.noiseFloorAt(s.base))
+	expected := mfm.ExpectedBitWidth(s.cfg.BitRate, s.rate)
+	if bw <= 0 || math.Abs(bw/expected-1) <= peakWidthTolerance {
+		return
+	}
+	s.cfg.PeakWidth = int(math.Ceil(bw))
+	if s.measureGap {
+		s.cfg.GapSamples = 8 * s.cfg.PeakWidth
+	}
+	s.cfg.GapSamples = coverMaxGap(
+		s.cfg.GapSamples, s.cfg.PeakWidth, s.cfg.MaxGap,
+	)
+	s.log().F(
+		1, "Measured bit width %.2f (nominal %.2f), using peak width %v\n",
+		bw, expected, s.cfg.PeakWidth,
+	)
+}
+
+// quiet returns true if the given range of samples is within the noise,
+// as measured by the difference between the lowest and highest value.
+func (s *Stream) quiet(from, to int) bool {
+	v := s.buf[from:to]
+	return slices.Max(v)-slices.Min(v) <= 2*s.noiseFloorAt(s.base+from)
+}
+
+// noiseFloorAt returns the noise floor at the given sample index of the
+// input.
+func (s *Stream) noiseFloorAt(i int) int {
+	if len(s.cfg.NoiseProfile) == 0 {
+		return s.cfg.NoiseFloor
+	}
+	return s.cfg.NoiseProfile.At(i)
+}
+
+// startSegment cleans the first segLen samples of the buffer (in place),
+// and sets up the decoder for them.
+func (s *Stream) startSegment(ctx context.Context, segLen int) error {
+	seg := s.buf[:segLen]
+
+	if !s.loadCleaned(seg) {
+		if err := s.clean(ctx, seg); err != nil {
+			return err
+		}
+		s.storeCleaned(seg)
+	}
+	cleaned := !s.cfg.NoClean || s.cfg.Gate || s.cfg.Wiener
+	if s.Cleaned != nil && cleaned {
+		s.Cleaned(s.base, seg)
+	}
+
+	s.quality.AddSamples(seg, s.noiseFloorAt(s.base))
+
+	expected := mfm.ExpectedBitWidth(s.cfg.BitRate, s.rate)
+	opts := []mfm.Option{
+		mfm.WithNoiseFloor(s.cfg.NoiseFloor),
+		mfm.WithNoiseProfile(s.cfg.NoiseProfile.From(s.base)),
+		mfm.WithLogger(s.Log),
+		mfm.WithEvents(s.segmentEvents()),
+		mfm.WithWeightedZero(s.cfg.WeightedEdges),
+		mfm.WithMaxGap(s.cfg.MaxGap),
+		mfm.WithMaxNoisePulses(s.cfg.MaxNoisePulses),
+		mfm.WithHealTiny(s.cfg.HealTiny),
+		mfm.WithMaxLikelihood(s.cfg.MaxLikelihood),
+		mfm.WithInheritBitWidth(s.cfg.InheritBitWidth),
+		mfm.WithMaxBits(s.cfg.MaxBlockBits),
+		mfm.WithMaxSamples(s.cfg.MaxBlockSamples),
+	}
+	if s.bitWidth > 0 {
+		opts = append(opts, mfm.WithBitWidth(float64(s.bitWidth)))
+	} else {
+		// Leave the bit width unset, so it is taken from the lead-in.
+		opts = append(opts, mfm.WithMaxCrossingTime(int(expected+0.5)))
+	}
+	ed := mfm.NewEdgeDetectWith(seg, opts...)
+	s.dec = mfm.NewDecoderWith(ed, opts...)
+	s.dec.LastGoodBitWidth = s.goodBitWidth
+	s.dec.Pulses = s.segmentPulses()
+	if s.Cells != nil {
+		base := float64(s.base)
+		s.dec.Cells = mfm.CellFunc(func(c mfm.Cell) {
+			c.Pos += base
+			s.Cells.Cell(c)
+		})
+	}
+	s.segLen = segLen
+
+	return nil
+}
+
+// clean cleans the given samples of the start of the buffer (in place),
+// as set up by the config. If that fails, the samples are consumed.
+func (s *Stream) clean(ctx context.Context, seg []int) error {
+	if s.cfg.Interference != 0 {
+		// If it is negative, leave Freq at 0 to detect it.
+		f := filter.NewComb(s.rate, math.Max(s.cfg.Interference, 0))
+		f.Harmonics = s.cfg.InterferenceHarmonics
+		f.NoiseFloor = s.noiseFloorAt(s.base)
+		f.Log = s.Log
+		if err := f.Run(seg, seg); err != nil {
+			base := s.base
+			s.consume(len(seg))
+			return fmt.Errorf("filtering samples at %v: %w", base, err)
+		}
+	}
+
+	if s.keepRaw() {
+		if s.raw == nil {
+			s.raw = s.cfg.Pool.Get(s.cfg.BufferSamples)
+		}
+		s.raw = append(s.raw[:0], seg...)
+	}
+
+	if !s.cfg.NoClean {
+		f := filter.NewDCOffsetWith(
+			filter.WithNoiseFloor(s.cfg.NoiseFloor),
+			filter.WithNoiseProfile(s.cfg.NoiseProfile.From(s.base)),
+			filter.WithPeakWidth(s.cfg.PeakWidth),
+			filter.WithMaxPeakWidths(s.cfg.MaxPeakWidths),
+			filter.WithLogger(s.Log),
+		)
+		if err := f.RunContext(ctx, seg, seg); err != nil {
+			if err == ctx.Err() {
+				return err
+			}
+			base := s.base
+			s.consume(len(seg))
+			return fmt.Errorf("cleaning samples at %v: %w", base, err)
+		}
+	}
+	if s.cfg.Gate {
+		f := s.gate(s.noiseFloorAt(s.base))
+		if err := f.Run(seg, seg); err != nil {
+			base := s.base
+			s.consume(len(seg))
+			return fmt.Errorf("gating samples at %v: %w", base, err)
+		}
+	}
+	if s.cfg.Wiener {
+		f := filter.NewWiener(s.noiseFloorAt(s.base), 0)
+		f.Log = s.Log
+		if err := f.Run(seg, seg); err != nil {
+			base := s.base
+			s.consume(len(seg))
+			return fmt.Errorf("filtering samples at %v: %w", base, err)
+		}
+	}
+	return nil
+}
+
+// gate returns the noise gate to run on the samples, as set up by the
+// config, with the given noise floor.
+func (s *Stream) gate(noiseFloor int) *filter.Gate {
+	f := filter.NewGate(noiseFloor, s.cfg.PeakWidth)
+	if s.cfg.GateAttack > 0 {
+		f.Attack = s.cfg.GateAttack
+	}
+	if s.cfg.GateRelease > 0 {
+		f.Release = s.cfg.GateRelease
+	}
+	if s.cfg.GateHold > 0 {
+		f.Hold = s.cfg.GateHold
+	}
+	f.Log = s.Log
+	return f
+}
+
+// segmentPulses returns an mfm.PulseSink for the decoder of the current
+// segment, which sends its pulses to the quality measurements, and to the
+// Pulses sink with their positions counted from the start of the input.
+func (s *Stream) segmentPulses() mfm.PulseSink {
+	if s.Pulses == nil {
+		return &s.quality
+	}
+	base := float64(s.base)
+	return mfm.PulseFunc(func(p mfm.Pulse) {
+		s.quality.Pulse(p)
+		p.Start += base
+		p.End += base
+		s.Pulses.Pulse(p)
+	})
+}
+
+// segmentEvents returns an events.Sink for the decoder of the current
+// segment, which moves the positions of its events to be counted from the
+// start of the input, before sending them on.
+func (s *Stream) segmentEvents() events.Sink {
+	base := float64(s.base)
+	return events.Func(func(ev events.Event) {
+		if ev.Type == events.BlockEnd || ev.Type == events.BlockError {
+			s.blockEnd = ev.Type
+			return
+		}
+		ev.Pos += base
+		if ev.End != 0 {
+			ev.End += base
+		}
+		s.sendEvent(ev)
+	})
+}
+
+// sendEvent sends the given event to the quality measurements, and to
+// the Events sink.
+func (s *Stream) sendEvent(ev events.Event) {
+	events.Send(&s.quality, ev)
+	events.Send(s.Events, ev)
+}
+
+// consume drops the first n samples of the buffer, along with the decoder
+// for them, if any.
+func (s *Stream) consume(n int) {
+	s.buf = s.buf[:copy(s.buf, s.buf[n:])]
+	s.base += n
+	s.dec = nil
+	s.segLen = 0
+}
+
+// keepRaw returns whether the samples of each segment are kept from
+// before they were cleaned, for retrying or recleaning failed blocks.
+func (s *Stream) keepRaw() bool {
+	return s.cfg.Retry || s.cfg.Reclean
+}
+
+// lastGoodBitWidth returns the bit width of the last block that decoded
+// successfully, or 0 if none has.
+func (s *Stream) lastGoodBitWidth() int {
+	if s.dec != nil {
+		return s.dec.LastGoodBitWidth
+	}
+	return s.goodBitWidth
+}
+
+// bridges returns the dropouts that the given decoder bridged in its
+// current block, with their positions moved by the given base.
+func bridges(d *mfm.Decoder, base int) []mfm.Bridge {
+	var bs []mfm.Bridge
+	for _, b := range d.Bridges {
+		b.Start += base
+		b.End += base
+		bs = append(bs, b)
+	}
+	return bs
+}
+
+// format returns the format of the bytes of the blocks.
+func (s *Stream) format() studybox.Format {
+	return studybox.Format{
+		Interleaving: s.cfg.Interleaving,
+		Check:        s.cfg.Check,
+	}
+}
+
+// finishInfo updates the metadata and data confidence of the given block
+// to match its final result, after any retry or reverse decoding of it.
+func (s *Stream) finishInfo(b *Block) {
+	b.DataConfidence, b.DataBitConfidence = nil, nil
+	if b.Err == nil && len(b.Data) > 0 {
+		b.DataConfidence, b.DataBitConfidence = s.format().Confidence(
+			b.Bits.Unpack(nil), b.Confidence,
+		)
+	}
+
+	info := &b.Info
+	info.ID = b.ID()
+	info.Start, info.End = b.Start, b.End
+	info.StartTime = float64(b.Start) / float64(s.rate)
+	info.EndTime = float64(b.End) / float64(s.rate)
+	info.Bits, info.Bytes = b.Bits.Len(), len(b.Data)
+	info.Ending = b.Ending
+}
+
+// makeBlock makes a Block from the current state of the decoder, after
+// it has decoded a block with the given result.
+func (s *Stream) makeBlock(err error) *Block {
+	d := s.dec
+	b := &Block{
+		Start:    s.base + d.StartIndex,
+		End:      s.base + d.EndIndex,
+		BitWidth: d.BitWidth,
+		Bits:     mfm.PackBits(d.Bits),
+		Err:      err,
+		Bridges:  bridges(d, s.base),
+		Ending:   d.Ending,
+		Info:     d.Info,
+
+		Confidence: append([]byte(nil), d.Confidence...),
+	}
+	defer s.sendBlockEnd(b)
+	defer s.finishInfo(b)
+
+	if err != nil {
+		// Skip the rest of the failed block, so the decoder can continue
+		// with the next one.
+		for d.Edge.Cur().Type != mfm.EdgeToNone && d.Edge.Next() {
+		}
+		end := s.base + d.Edge.Cur().Index
+		if s.cfg.Reclean {
+			s.reclean(b, end)
+		}
+		if b.Err != nil && s.cfg.Retry {
+			s.retry(b, end)
+		}
+		if b.Err != nil && s.cfg.Reverse {
+			s.reverse(b, end)
+		}
+		return b
+	}
+
+	b.Data, b.Err = s.format().DecodeBlock(d.Bits)
+	if b.Err != nil && s.cfg.Reclean {
+		s.reclean(b, b.End)
+	}
+	if b.Err != nil && s.cfg.Retry {
+		s.retry(b, b.End)
+	}
+	if b.Err != nil && s.cfg.Reverse {
+		s.reverse(b, b.End)
+	}
+	metrics.Count("bytes", len(b.Data))
+	return b
+}
+
+// sendBlockEnd sends the end event of the given block, which the decoder
+// ended with an event of the type in blockEnd, now that the block is done.
+func (s *Stream) sendBlockEnd(b *Block) {
+	ev := events.Event{
+		Type:     events.BlockEnd,
+		Pos:      float64(b.Start),
+		End:      float64(b.End),
+		BitWidth: float64(b.BitWidth),
+		Bits:     b.Bits.Len(),
+		Detail:   b.Ending.String(),
+	}
+	switch {
+	case b.Err == nil:
+	case s.blockEnd == events.BlockEnd:
+		ev.Type, ev.Detail = events.ChecksumFailure, b.Err.Error()
+	default:
+		ev.Type, ev.Detail = events.BlockError, b.Err.Error()
+	}
+	s.blockEnd = ""
+	s.sendEvent(ev)
+}
@@ -0,0 +1,56 @@
+// Package pool provides pools of reusable buffers, so that processing
+// many files (or many parts of one file) does not need to allocate new
+// full-length buffers for each of them.
+package pool
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// Pool is a pool of buffers of the element type T.
+//
+// The buffers are grouped by their capacity, in power-of-2 size classes,
+// so that a buffer that was put back can be reused for any request that
+// fits in its class.
+//
+// The zero value is an empty pool ready for use, and it is safe for
+// concurrent use. A nil *Pool is also valid, and just allocates new
+// buffers without keeping any, so the use of a pool can be optional.
+type Pool[T any] struct {
+	classes [bits.UintSize]sync.Pool
+}
+
+// Ints is a shared pool of int buffers, for use as the default pool.
+var Ints = &Pool[int]{}
+
+// Get returns a buffer of length n, taking it from the pool if possible.
+// The contents of the returned buffer are not cleared, so they may be
+// left over from an earlier use.
+func (p *Pool[T]) Get(n int) []T {
+	if n <= 0 {
+		return nil
+	}
+	if p == nil {
+		return make([]T, n)
+	}
+	// Round the capacity up to the size class, so it can be reused.
+	class := bits.Len(uint(n - 1))
+	if v, ok := p.classes[class].Get().(*[]T); ok {
+		return (*v)[:n]
+	}
+	return make([]T, n, 1<<class)
+}
+
+// Put returns the given buffer to the pool, for reuse by a later Get.
+// The buffer must not be used after this.
+func (p *Pool[T]) Put(buf []T) {
+	if p == nil || cap(buf) == 0 {
+		return
+	}
+	// Round the capacity down to the size class, so it is big enough
+	// for any request of that class.
+	class := bits.Len(uint(cap(buf))) - 1
+	buf = buf[:0]
+	p.classes[class].Put(&buf)
+}
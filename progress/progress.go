@@ -0,0 +1,44 @@
+package progress
+
+// Func is a progress callback. It is given the current position (in
+// samples) and the total number of samples that are being processed.
+type Func func(pos, total int)
+
+// Reporter calls a progress function whenever the position has moved at
+// least a given number of samples since the last call.
+//
+// The zero value is a valid Reporter that does nothing.
+type Reporter struct {
+	fn    Func
+	every int
+	next  int
+}
+
+// Set sets the progress function, and how many samples should be
+// processed between each call to it. Setting fn to nil disables it.
+func (r *Reporter) Set(every int, fn Func) {
+	if every < 1 {
+		every = 1
+	}
+	r.fn, r.every, r.next = fn, every, 0
+}
+
+// Update calls the progress function if the position has moved far
+// enough since the last call.
+func (r *Reporter) Update(pos, total int) {
+	if r.fn == nil || pos < r.next {
+		return
+	}
+	r.fn(pos, total)
+	r.next = pos + r.every
+}
+
+// Done calls the progress function to report that all the samples have
+// been processed, unless that has already been reported.
+func (r *Reporter) Done(total int) {
+	if r.fn == nil || r.next > total {
+		return
+	}
+	r.fn(total, total)
+	r.next = total + 1
+}
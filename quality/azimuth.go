@@ -0,0 +1,201 @@
+package quality
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/edorfaus/sb-mfm-decode/mfm"
+)
+
+// The correlation below which two channels are taken to not share the
+// data signal (such as the audio and data channels of most captures), so
+// that the delay between them means nothing.
+const minChannelCorrelation = 0.3
+
+// ChannelDelay is the delay between two channels of a capture that both
+// have the data signal, from MeasureChannelDelay.
+type ChannelDelay struct {
+	// The delay of the second channel behind the first, in samples (with
+	// a fraction), and in seconds; negative if it is ahead.
+	Lag   float64 `json:"lag"`
+	Delay float64 `json:"delay"`
+
+	// The delay as a phase shift (in degrees) of the highest frequency of
+	// the MFM signal, which is that of the short pulses, half the bit rate,
+	// and as a part of a bit width.
+	Phase float64 `json:"phase"`
+	Bits  float64 `json:"bits"`
+
+	// The normalized cross-correlation of the channels at that delay. It
+	// is negative if one of the channels has its polarity inverted.
+	Correlation float64 `json:"correlation"`
+}
+
+// MeasureChannelDelay cross-correlates the two given channels in the MFM
+// band (from a quarter to a half of the bit rate, in Hz), and returns the
+// delay between them where they correlate the most.
+//
+// When the same track is read into both channels (as with a stereo head on
+// a mono track), a delay between them means that the head is tilted
+// compared to the track, that is, that its azimuth is off, which also
+// loses the treble of the signal that the edges need.
+//
+// The delay is only searched for within one bit width either way, since
+// the lead-in repeats every two bit widths; azimuth errors are smaller
+// than that.
+func MeasureChannelDelay(a, b []int, rate, bitRate int) (ChannelDelay, error) {
+	if bitRate == 0 {
+		bitRate = mfm.DefaultBitRate
+	}
+	bw, err := mfm.BitWidthFor(bitRate, rate)
+	if err != nil {
+		return ChannelDelay{}, err
+	}
+	n := min(len(a), len(b))
+	maxLag := int(math.Ceil(bw))
+	if n <= 2*maxLag {
+		return ChannelDelay{}, fmt.Errorf(
+			"too few samples to correlate: %v", n,
+		)
+	}
+
+	// The filter is the same for both channels, so its own phase shift
+	// does not change the delay between them.
+	fa := bandPass(a[:n], rate, bitRate)
+	fb := bandPass(b[:n], rate, bitRate)
+	energy := math.Sqrt(sumSquares(fa) * sumSquares(fb))
+	if energy == 0 {
+		return ChannelDelay{}, fmt.Errorf("no signal in the MFM band")
+	}
+
+	corr := make([]float64, 2*maxLag+1)
+	best := maxLag
+	for i := range corr {
+		lag := i - maxLag
+		sum := 0.0
+		for k := max(0, -lag); k < n && k+lag < n; k++ {
+			sum += fa[k] * fb[k+lag]
+		}
+		corr[i] = sum / energy
+		if math.Abs(corr[i]) > math.Abs(corr[best]) {
+			best = i
+		}
+	}
+
+	// Fit a parabola through the peak and its neighbors, for the delay
+	// between the samples.
+	lag := float64(best - maxLag)
+	if best > 0 && best < len(corr)-1 {
+		l, c, r := corr[best-1], corr[best], corr[best+1]
+		if d := l - 2*c + r; d != 0 {
+			lag += 0.5 * (l - r) / d
+		}
+	}
+
+	d := ChannelDelay{
+		Lag:         lag,
+		Delay:       lag / float64(rate),
+		Bits:        lag / bw,
+		Correlation: corr[best],
+	}
+	d.Phase = 360 * d.Delay * float64(bitRate) / 2
+	return d, nil
+}
+
+// bandPass filters the samples with a second-order band-pass filter for
+// the MFM band, centered between a quarter and a half of the bit rate.
+func bandPass(samples []int, rate, bitRate int) []float64 {
+	f0 := float64(bitRate) / (2 * math.Sqrt2)
+	q := f0 / (float64(bitRate) / 4)
+	w := 2 * math.Pi * f0 / float64(rate)
+	alpha := math.Sin(w) / (2 * q)
+	a0 := 1 + alpha
+	b0, b2 := alpha/a0, -alpha/a0
+	a1, a2 := -2*math.Cos(w)/a0, (1-alpha)/a0
+
+	out := make([]float64, len(samples))
+	var x1, x2, y1, y2 float64
+	for i, v := range samples {
+		x := float64(v)
+		y := b0*x + b2*x2 - a1*y1 - a2*y2
+		x1, x2 = x, x1
+		y1, y2 = y, y1
+		out[i] = y
+	}
+	return out
+}
+
+func sumSquares(v []float64) float64 {
+	sum := 0.0
+	for _, x := range v {
+		sum += x * x
+	}
+	return sum
+}
+
+func checkAzimuth(c Capture) Finding {
+	f := Finding{Check: "azimuth"}
+
+	if len(c.Channels) < 2 {
+		f.Message = "mono capture, nothing to compare"
+		return f
+	}
+
+	// Compare the data channel to the other channel that correlates the
+	// most with it, if any of them has the data signal too.
+	var best ChannelDelay
+	other := -1
+	for i, ch := range c.Channels {
+		if i == c.Data {
+			continue
+		}
+		d, err := MeasureChannelDelay(
+			c.Channels[c.Data], ch, c.SampleRate, c.BitRate,
+		)
+		if err != nil {
+			continue
+		}
+		corr := math.Abs(d.Correlation)
+		if other < 0 || corr > math.Abs(best.Correlation) {
+			best, other = d, i
+		}
+	}
+	if other < 0 || math.Abs(best.Correlation) < minChannelCorrelation {
+		f.Message = "no other channel has the data signal, so the azimuth " +
+			"cannot be measured"
+		if other >= 0 {
+			f.Message += fmt.Sprintf(
+				" (best correlation %.2f)", best.Correlation,
+			)
+		}
+		return f
+	}
+
+	dir := "behind"
+	if best.Lag < 0 {
+		dir = "ahead of"
+	}
+	f.Message = fmt.Sprintf(
+		"channel %v is %.2f samples (%.1f µs, %.0f°) %v the data "+
+			"channel, correlation %.2f",
+		other, math.Abs(best.Lag), math.Abs(best.Delay)*1e6,
+		math.Abs(best.Phase), dir, best.Correlation,
+	)
+	if best.Correlation < 0 {
+		f.Message += ", with inverted polarity"
+	}
+
+	bits := math.Abs(best.Bits)
+	switch {
+	case bits > 0.25:
+		f.Severity = SeverityProblem
+	case bits > 0.1:
+		f.Severity = SeverityWarning
+	}
+	if f.Severity != SeverityOK {
+		f.Advice = "the azimuth of the playback head looks off; adjust it " +
+			"until the delay is close to 0, as that also recovers the " +
+			"treble that the edges need"
+	}
+	return f
+}
@@ -0,0 +1,404 @@
+package quality
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/edorfaus/sb-mfm-decode/mfm"
+)
+
+// Severity is how bad the result of a capture check is.
+type Severity int
+
+const (
+	// SeverityOK means that the check found nothing wrong.
+	SeverityOK Severity = iota
+	// SeverityWarning means that the capture may decode worse than it
+	// could, or that something looks unusual.
+	SeverityWarning
+	// SeverityProblem means that the capture is likely to decode badly,
+	// or not at all, and should be redone if possible.
+	SeverityProblem
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityOK:
+		return "ok"
+	case SeverityWarning:
+		return "warning"
+	case SeverityProblem:
+		return "PROBLEM"
+	default:
+		return fmt.Sprintf("[bad Severity=%d]", int(s))
+	}
+}
+
+// Finding is the result of a single capture check.
+type Finding struct {
+	// The name of the check, e.g. "clipping".
+	Check string `json:"check"`
+
+	Severity Severity `json:"severity"`
+
+	// What the check measured, and what to do about it (if anything).
+	Message string `json:"message"`
+	Advice  string `json:"advice,omitempty"`
+}
+
+// Capture is a recording to check with CheckCapture, before it has been
+// cleaned in any way.
+type Capture struct {
+	// The samples of each channel, and which of them has the data.
+	Channels [][]int
+	Data     int
+
+	SampleRate int
+	BitDepth   int
+
+	// The noise floor that the decode will use, which must be at least
+	// 1, and the MFM bit rate.
+	NoiseFloor int
+	BitRate    int
+}
+
+// CheckCapture runs a set of quick checks on a capture, to find problems
+// with how it was recorded before spending time on decoding it.
+//
+// The checks are for clipping, DC offset, the signal level compared to
+// the noise floor, the sample rate compared to the bit rate, the balance
+// between the channels, the delay between them (for the azimuth of the
+// playback head, if more than one has the data signal), and mains hum.
+//
+// As with the samples of package wav, 8-bit ones are unsigned; they are
+// made signed before checking them, as the checks expect.
+func CheckCapture(c Capture) []Finding {
+	if c.BitDepth == 8 {
+		c.Channels = signed8(c.Channels)
+	}
+	data := c.Channels[c.Data]
+	fullScale := 1 << (c.BitDepth - 1)
+
+	mean := 0.0
+	for _, v := range data {
+		mean += float64(v)
+	}
+	if len(data) > 0 {
+		mean /= float64(len(data))
+	}
+
+	return []Finding{
+		checkClipping(data, fullScale),
+		checkDCOffset(mean, fullScale),
+		checkLevel(data, mean, fullScale, c.NoiseFloor),
+		checkSampleRate(c.SampleRate, c.BitRate),
+		checkBalance(c.Channels, c.Data, c.NoiseFloor),
+		checkAzimuth(c),
+		checkHum(data, mean, c.SampleRate, c.NoiseFloor),
+	}
+}
+
+func checkClipping(data []int, fullScale int) Finding {
+	f := Finding{Check: "clipping"}
+
+	// Samples at the very top or bottom of the range may have been cut
+	// off there, and the longest run of them shows if they really were.
+	clipped, run, longest := 0, 0, 0
+	for _, v := range data {
+		if v >= fullScale-1 || v <= -fullScale {
+			clipped++
+			run++
+			if run > longest {
+				longest = run
+			}
+		} else {
+			run = 0
+		}
+	}
+
+	ratio := 0.0
+	if len(data) > 0 {
+		ratio = float64(clipped) / float64(len(data))
+	}
+	f.Message = fmt.Sprintf(
+		"%v samples (%.3f%%) at full scale, longest run %v",
+		clipped, ratio*100, longest,
+	)
+	switch {
+	case ratio > 0.001 || longest >= 3:
+		f.Severity = SeverityProblem
+	case clipped > 0:
+		f.Severity = SeverityWarning
+	}
+	if f.Severity != SeverityOK {
+		f.Advice = "lower the recording level (or the playback volume), " +
+			"since clipping distorts where the edges are"
+	}
+	return f
+}
+
+func checkDCOffset(mean float64, fullScale int) Finding {
+	f := Finding{Check: "dc-offset"}
+
+	ratio := math.Abs(mean) / float64(fullScale)
+	f.Message = fmt.Sprintf(
+		"mean sample value %.1f (%.2f%% of full scale)", mean, ratio*100,
+	)
+	switch {
+	case ratio > 0.1:
+		f.Severity = SeverityProblem
+	case ratio > 0.02:
+		f.Severity = SeverityWarning
+	}
+	if f.Severity != SeverityOK {
+		f.Advice = "the cleanup removes the offset, but it wastes headroom " +
+			"and may clip; check the input for a DC-coupled connection"
+	}
+	return f
+}
+
+func checkLevel(data []int, mean float64, fullScale, noiseFloor int) Finding {
+	f := Finding{Check: "level"}
+
+	// The samples within the noise floor include those of the edges as
+	// they cross it, so the noise is estimated from the median of them
+	// instead of their mean, using a histogram of their magnitudes.
+	var signal float64
+	var signalN, noiseN int
+	var hist [64]int
+	nf := float64(noiseFloor)
+	for _, v := range data {
+		d := float64(v) - mean
+		if d <= nf && d >= -nf {
+			hist[min(int(math.Abs(d)/nf*64), 63)]++
+			noiseN++
+		} else {
+			signal += d * d
+			signalN++
+		}
+	}
+	if signalN == 0 {
+		f.Severity = SeverityProblem
+		f.Message = fmt.Sprintf(
+			"no samples are outside of the noise floor (%v)", noiseFloor,
+		)
+		f.Advice = "raise the recording level, or check that the right " +
+			"input is recorded"
+		return f
+	}
+
+	signalRMS := math.Sqrt(signal / float64(signalN))
+	noiseRMS := 0.0
+	for i, n := 0, 0; i < len(hist) && noiseN > 0; i++ {
+		if n += hist[i]; 2*n >= noiseN {
+			// For normally distributed noise, the median magnitude is
+			// about 0.6745 of the standard deviation.
+			noiseRMS = (float64(i) + 0.5) / 64 * nf / 0.6745
+			break
+		}
+	}
+	f.Message = fmt.Sprintf(
+		"signal level %.1f dBFS (%.1fx the noise floor)",
+		dBFS(signalRMS, fullScale), signalRMS/nf,
+	)
+	if noiseRMS > 0 {
+		f.Message += fmt.Sprintf(", SNR %.1f dB", 20*math.Log10(
+			signalRMS/noiseRMS,
+		))
+	}
+
+	switch {
+	case signalRMS < 2*nf:
+		f.Severity = SeverityProblem
+		f.Advice = "raise the recording level, or lower the noise floor " +
+			"if the noise allows it"
+	case noiseRMS > nf/3:
+		f.Severity = SeverityWarning
+		f.Advice = "the noise is close to the noise floor, so it may be " +
+			"seen as edges; raise the noise floor, or reduce the noise"
+	case signalRMS < 4*nf:
+		f.Severity = SeverityWarning
+		f.Advice = "the signal is weak; raising the recording level " +
+			"would give more margin over the noise floor"
+	}
+	return f
+}
+
+func checkSampleRate(rate, bitRate int) Finding {
+	f := Finding{Check: "sample-rate"}
+
+	if bitRate == 0 {
+		bitRate = mfm.DefaultBitRate
+	}
+	bw, err := mfm.BitWidthFor(bitRate, rate)
+	if err != nil {
+		// Too low to decode at all without upsampling it first.
+		f.Severity = SeverityProblem
+		f.Message = err.Error()
+		f.Advice = "re-record at a higher sample rate, at least 44100 Hz " +
+			"is recommended; or upsample the capture before decoding it"
+		return f
+	}
+	f.Message = fmt.Sprintf(
+		"%v Hz gives %.2f samples per bit at %v bits per second",
+		rate, bw, bitRate,
+	)
+
+	// The pulses differ by half a bit width, which needs a few samples to
+	// be told apart reliably despite jitter.
+	switch {
+	case bw < 4:
+		f.Severity = SeverityProblem
+	case bw < 8:
+		f.Severity = SeverityWarning
+	}
+	if f.Severity != SeverityOK {
+		f.Advice = "record at a higher sample rate, " +
+			"at least 44100 Hz is recommended"
+	}
+	return f
+}
+
+func checkBalance(channels [][]int, data, noiseFloor int) Finding {
+	f := Finding{Check: "channels"}
+
+	if len(channels) < 2 {
+		f.Message = "mono capture, nothing to compare"
+		return f
+	}
+
+	levels := make([]float64, len(channels))
+	loud := data
+	for i, ch := range channels {
+		levels[i] = rms(ch)
+		if levels[i] > levels[loud] {
+			loud = i
+		}
+	}
+
+	f.Message = fmt.Sprintf("RMS levels of the channels: %.1f", levels[0])
+	for _, l := range levels[1:] {
+		f.Message += fmt.Sprintf(", %.1f", l)
+	}
+
+	nf := float64(noiseFloor)
+	switch {
+	case levels[data] < nf/2 && levels[loud] > nf:
+		f.Severity = SeverityProblem
+		f.Advice = fmt.Sprintf(
+			"the data is read from channel %v, which looks silent, while "+
+				"channel %v is not; swap the channels when recording",
+			data, loud,
+		)
+	case levels[loud] > 2*levels[data]:
+		f.Severity = SeverityWarning
+		f.Advice = fmt.Sprintf(
+			"channel %v is much louder than the data channel (%v); "+
+				"check that the data is in the right channel",
+			loud, data,
+		)
+	}
+	return f
+}
+
+func checkHum(data []int, mean float64, rate, noiseFloor int) Finding {
+	f := Finding{Check: "hum"}
+
+	// The windows are a tenth of a second, which is a whole number of
+	// cycles of each of the frequencies that are checked.
+	size := rate / 10
+	if size < 1 || len(data) < size {
+		f.Message = "too short to check for hum"
+		return f
+	}
+
+	// The data itself has some energy at these frequencies, so the hum
+	// is only measured in the quiet windows, which are between the blocks
+	// of data.
+	nf := float64(noiseFloor)
+	var windows []int
+	for i := 0; i+size <= len(data); i += size {
+		if rms(data[i:i+size]) <= 2*nf {
+			windows = append(windows, i)
+		}
+	}
+	if len(windows) == 0 {
+		f.Message = "no quiet parts to check for hum in"
+		return f
+	}
+
+	var freq int
+	var amp float64
+	for _, hz := range []int{50, 60, 100, 120} {
+		sum := 0.0
+		for _, i := range windows {
+			sum += goertzel(data[i:i+size], mean, hz, rate)
+		}
+		if a := sum / float64(len(windows)); a > amp {
+			freq, amp = hz, a
+		}
+	}
+
+	f.Message = fmt.Sprintf(
+		"strongest at %v Hz, amplitude %.1f (%.0f%% of the noise floor)",
+		freq, amp, amp/nf*100,
+	)
+	switch {
+	case amp > nf:
+		f.Severity = SeverityProblem
+	case amp > nf/4:
+		f.Severity = SeverityWarning
+	}
+	if f.Severity != SeverityOK {
+		f.Advice = "check the grounding of the player and recorder, or " +
+			"use a battery-powered player"
+	}
+	return f
+}
+
+// goertzel returns the amplitude of the given frequency in the samples,
+// after subtracting the mean.
+func goertzel(samples []int, mean float64, freq, rate int) float64 {
+	coeff := 2 * math.Cos(2*math.Pi*float64(freq)/float64(rate))
+	var s1, s2 float64
+	for _, v := range samples {
+		s := float64(v) - mean + coeff*s1 - s2
+		s1, s2 = s, s1
+	}
+	power := s1*s1 + s2*s2 - coeff*s1*s2
+	return 2 * math.Sqrt(math.Max(power, 0)) / float64(len(samples))
+}
+
+// signed8 returns a copy of the given channels of unsigned 8-bit samples,
+// with silence moved from 128 to 0.
+func signed8(channels [][]int) [][]int {
+	out := make([][]int, len(channels))
+	for i, ch := range channels {
+		out[i] = make([]int, len(ch))
+		for j, v := range ch {
+			out[i][j] = v - 128
+		}
+	}
+	return out
+}
+
+func rms(samples []int) float64 {
+	if len(samples) == 0 {
+		return 0
+	}
+	mean := 0.0
+	for _, v := range samples {
+		mean += float64(v)
+	}
+	mean /= float64(len(samples))
+	sum := 0.0
+	for _, v := range samples {
+		d := float64(v) - mean
+		sum += d * d
+	}
+	return math.Sqrt(sum / float64(len(samples)))
+}
+
+func dBFS(level float64, fullScale int) float64 {
+	return 20 * math.Log10(level/float64(fullScale))
+}
@@ -0,0 +1,220 @@
+package quality
+
+import (
+	"github.com/edorfaus/sb-mfm-decode/mfm"
+)
+
+// DefaultMinRun is the default GapSettings.MinRun: the number of pulses
+// in a row with widths that fit MFM, below which they are taken to be
+// noise rather than data.
+const DefaultMinRun = 16
+
+// GapSettings are the settings of AnalyzeGaps.
+type GapSettings struct {
+	SampleRate int
+
+	// The bit depth of the samples, for their levels in dBFS; if 0, it is
+	// taken to be 16.
+	BitDepth int
+
+	// The noise floor that the decode used.
+	NoiseFloor int
+
+	// The level (in sample values) that weak pulses must reach, which is
+	// below the noise floor; if 0, it is a quarter of the noise floor.
+	WeakLevel int
+
+	// The bit width (in samples) that pulses are compared to; if 0, it is
+	// the mean bit width of the blocks.
+	BitWidth float64
+
+	// The number of pulses with MFM widths in a row that a gap must have
+	// for it to be flagged; if 0, DefaultMinRun is used.
+	MinRun int
+}
+
+// Gap is the measurements of a gap between decoded blocks, where the
+// decoder saw no signal, from AnalyzeGaps.
+type Gap struct {
+	// The sample indexes of the start and end of the gap, and the index
+	// of the block before it (-1 for the gap before the first block).
+	Start, End int
+	After      int
+
+	// The length of the gap in seconds, if the sample rate is known.
+	Duration float64
+
+	// The RMS and peak levels of the samples in the gap, in dBFS, and the
+	// RMS level as a part of the noise floor.
+	Noise      float64
+	Peak       float64
+	NoiseRatio float64
+
+	// The number of pulses that reach the noise floor, and of those that
+	// only reach the weak level, found by zero crossings of the samples
+	// with hysteresis at those levels.
+	Pulses     int
+	WeakPulses int
+
+	// The longest run of weak (or stronger) pulses in a row whose widths
+	// fit MFM: between 1 and 2 bit widths, with some tolerance.
+	LongestRun int
+
+	// Whether the gap likely holds data that was not decoded, as it has a
+	// run of at least MinRun pulses that fit MFM, and why.
+	Suspect bool
+	Reason  string
+}
+
+// AnalyzeGaps measures the gaps between the given decoded blocks of the
+// given (cleaned) samples, including those before the first block and
+// after the last, and flags those that likely hold data that was not
+// decoded, such as a block that was too weak to be seen as one, so that
+// they can be looked at by hand, or decoded again with other settings.
+//
+// The blocks must be in order; their Start and End are used for where
+// the gaps are, and their BitWidth for what pulse widths fit MFM.
+func AnalyzeGaps(samples []int, blocks []mfm.BlockInfo, s GapSettings) []Gap {
+	if s.BitDepth <= 0 {
+		s.BitDepth = 16
+	}
+	if s.WeakLevel <= 0 {
+		s.WeakLevel = s.NoiseFloor / 4
+	}
+	if s.MinRun <= 0 {
+		s.MinRun = DefaultMinRun
+	}
+	if s.BitWidth <= 0 {
+		n := 0
+		for _, b := range blocks {
+			if b.BitWidth > 0 {
+				s.BitWidth += b.BitWidth
+				n++
+			}
+		}
+		if n > 0 {
+			s.BitWidth /= float64(n)
+		}
+	}
+
+	var gaps []Gap
+	start := 0
+	for i := 0; i <= len(blocks); i++ {
+		end := len(samples)
+		if i < len(blocks) {
+			end = min(blocks[i].Start, end)
+		}
+		if end > start {
+			gaps = append(gaps, measureGap(samples, start, end, i-1, s))
+		}
+		if i < len(blocks) {
+			start = max(blocks[i].End, start)
+		}
+	}
+	return gaps
+}
+
+func measureGap(samples []int, start, end, after int, s GapSettings) Gap {
+	g := Gap{Start: start, End: end, After: after}
+	if s.SampleRate > 0 {
+		g.Duration = float64(end-start) / float64(s.SampleRate)
+	}
+
+	fullScale := 1 << (s.BitDepth - 1)
+	data := samples[start:end]
+	peak := 0
+	for _, v := range data {
+		peak = max(peak, abs(v))
+	}
+	r := rms(data)
+	g.Noise, g.Peak = dBFS(r, fullScale), dBFS(float64(peak), fullScale)
+	if s.NoiseFloor > 0 {
+		g.NoiseRatio = r / float64(s.NoiseFloor)
+	}
+
+	g.Pulses = len(pulseWidths(data, s.NoiseFloor))
+	weak := pulseWidths(data, s.WeakLevel)
+	g.WeakPulses = len(weak)
+	g.LongestRun = longestRun(weak, s.BitWidth)
+
+	if g.LongestRun >= s.MinRun {
+		g.Suspect = true
+		g.Reason = "weak pulses below the noise floor"
+		if g.Pulses >= s.MinRun {
+			g.Reason = "pulses above the noise floor"
+		}
+	}
+	return g
+}
+
+// pulseWidths returns the widths of the pulses of the given samples: the
+// distances between their zero crossings, with hysteresis at the given
+// level, so that a crossing is only counted once the samples reach the
+// level on the other side. The parts before the first crossing and after
+// the last are not counted, as their widths are not known.
+func pulseWidths(data []int, level int) []int {
+	if level <= 0 {
+		return nil
+	}
+	var widths []int
+	state, last := 0, -1
+	for i, v := range data {
+		var s int
+		switch {
+		case v > level:
+			s = 1
+		case v < -level:
+			s = -1
+		default:
+			continue
+		}
+		if s == state {
+			continue
+		}
+		if state != 0 {
+			// Place the crossing at the first sample on the new side.
+			at := i
+			for at > 0 && data[at-1]*s > 0 {
+				at--
+			}
+			if last >= 0 {
+				widths = append(widths, at-last)
+			}
+			last = at
+		}
+		state = s
+	}
+	return widths
+}
+
+// longestRun returns the length of the longest run of widths in a row that
+// fit MFM pulses of the given bit width: 2, 3 or 4 half bit widths, taken
+// as anything from 0.75 to 2.25 bit widths.
+func longestRun(widths []int, bitWidth float64) int {
+	if bitWidth <= 0 {
+		return 0
+	}
+	low, high := 0.75*bitWidth, 2.25*bitWidth
+	best, run := 0, 0
+	for _, w := range widths {
+		if f := float64(w); f >= low && f <= high {
+			run++
+			best = max(best, run)
+		} else {
+			run = 0
+		}
+	}
+	return best
+}
+
+// SuspectGaps returns the gaps that are flagged as likely holding data
+// that was not decoded.
+func SuspectGaps(gaps []Gap) []Gap {
+	var out []Gap
+	for _, g := range gaps {
+		if g.Suspect {
+			out = append(out, g)
+		}
+	}
+	return out
+}
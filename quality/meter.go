@@ -0,0 +1,151 @@
+package quality
+
+import (
+	"math"
+
+	"github.com/edorfaus/sb-mfm-decode/mfm"
+)
+
+// meterChunk is the number of samples in each of the chunks that a Meter
+// measures the noise in, picking the quietest of them.
+const meterChunk = 256
+
+// Meter keeps running measurements of a live capture, for showing while
+// it is being recorded, so that the gain and azimuth can be adjusted
+// without waiting for a full pass.
+//
+// The samples are added with AddSamples, before they are cleaned, and the
+// pulses from the decoder through the mfm.PulseSink interface. Each call
+// to Reading returns the measurements since the previous one.
+type Meter struct {
+	SampleRate int
+	BitDepth   int
+
+	// The noise floor that the decode uses, to compare the noise to.
+	NoiseFloor int
+
+	// The measurements of the current window.
+	samples, clipped int
+	peak             int
+	sum, sumSq       float64
+	noise            float64
+	noiseChunks      int
+	chunk            []int
+
+	// The pulse measurements, which are kept from the last window that
+	// had pulses, since pulses only come while there is data.
+	pulses, badPulses int
+	bitWidth, conf    float64
+	last              Reading
+}
+
+// Reading is a set of measurements from a Meter.
+type Reading struct {
+	// The number of samples measured, and how many were at full scale.
+	Samples int
+	Clipped int
+
+	// The peak and RMS levels of the input, in dBFS.
+	Peak float64
+	RMS  float64
+
+	// The level of the noise, in dBFS and as a part of the noise floor,
+	// from the quietest part of the input. If the noise is more than
+	// about a third of the noise floor, it may be seen as edges.
+	Noise      float64
+	NoiseRatio float64
+
+	// The number of pulses, how many of them were invalid, and the bit
+	// rate (bits per second) that they were read at.
+	Pulses    int
+	BadPulses int
+	BitRate   float64
+
+	// The mean confidence of the valid pulses, from 0 (at the limits of
+	// their classes) to 1 (right in the middle of them).
+	Confidence float64
+}
+
+// AddSamples adds the given samples (before cleaning) to the measurements.
+func (m *Meter) AddSamples(samples []int) {
+	fullScale := 1 << (m.BitDepth - 1)
+	for _, v := range samples {
+		m.samples++
+		if v >= fullScale-1 || v <= -fullScale {
+			m.clipped++
+		}
+		if a := abs(v); a > m.peak {
+			m.peak = a
+		}
+		m.sum += float64(v)
+		m.sumSq += float64(v) * float64(v)
+
+		if m.chunk = append(m.chunk, v); len(m.chunk) == meterChunk {
+			if r := rms(m.chunk); r < m.noise || m.noiseChunks == 0 {
+				m.noise = r
+			}
+			m.noiseChunks++
+			m.chunk = m.chunk[:0]
+		}
+	}
+}
+
+// Pulse implements mfm.PulseSink.
+func (m *Meter) Pulse(p mfm.Pulse) {
+	m.pulses++
+	c := p.Confidence()
+	if c < 0 {
+		m.badPulses++
+		return
+	}
+	m.bitWidth += p.BitWidth
+	m.conf += c
+}
+
+// Reading returns the measurements since the previous reading, and starts
+// a new set of them. The pulse measurements are those of the last reading
+// that had pulses.
+func (m *Meter) Reading() Reading {
+	r := m.last
+	r.Samples, r.Clipped = m.samples, m.clipped
+	r.Peak, r.RMS, r.Noise, r.NoiseRatio = math.Inf(-1), math.Inf(-1), 0, 0
+
+	fullScale := 1 << (m.BitDepth - 1)
+	if m.samples > 0 {
+		n := float64(m.samples)
+		mean := m.sum / n
+		r.Peak = dBFS(float64(m.peak), fullScale)
+		r.RMS = dBFS(math.Sqrt(math.Max(m.sumSq/n-mean*mean, 0)), fullScale)
+		r.Noise = dBFS(m.noise, fullScale)
+		if m.NoiseFloor > 0 {
+			r.NoiseRatio = m.noise / float64(m.NoiseFloor)
+		}
+	}
+
+	if valid := m.pulses - m.badPulses; m.pulses > 0 {
+		r.Pulses, r.BadPulses = m.pulses, m.badPulses
+		r.BitRate, r.Confidence = 0, 0
+		if valid > 0 {
+			bw := m.bitWidth / float64(valid)
+			r.BitRate = float64(m.SampleRate) / bw
+			r.Confidence = m.conf / float64(valid)
+		}
+		m.last = r
+	}
+
+	*m = Meter{
+		SampleRate: m.SampleRate,
+		BitDepth:   m.BitDepth,
+		NoiseFloor: m.NoiseFloor,
+		chunk:      m.chunk[:0],
+		last:       m.last,
+	}
+	return r
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,159 @@
+// Package quality measures how good the input signal and the decode of
+// it were, as a report that can be kept along with the decoded data.
+package quality
+
+import (
+	"math"
+
+	"github.com/edorfaus/sb-mfm-decode/events"
+	"github.com/edorfaus/sb-mfm-decode/mfm"
+)
+
+// Report holds the quality measurements of a decode.
+type Report struct {
+	// The estimated signal-to-noise ratio, in dB. This is 0 if there was
+	// not enough signal or noise to estimate it.
+	SNR float64 `json:"snr_db"`
+
+	// The mean power of the samples that are above and below the noise
+	// floor, which the SNR is estimated from.
+	SignalPower float64 `json:"signal_power"`
+	NoisePower  float64 `json:"noise_power"`
+
+	// The number of pulses, and how many of them were too short (Tiny)
+	// or too long (Huge) to be valid MFM pulses.
+	Pulses     int `json:"pulses"`
+	TinyPulses int `json:"tiny_pulses"`
+	HugePulses int `json:"huge_pulses"`
+
+	// The timing jitter of the valid pulses, per class.
+	Short  Jitter `json:"short"`
+	Medium Jitter `json:"medium"`
+	Long   Jitter `json:"long"`
+
+	// The range of the bit width (in samples) over the decode.
+	MinBitWidth float64 `json:"min_bit_width"`
+	MaxBitWidth float64 `json:"max_bit_width"`
+
+	// The number of times the bit width was found from a lead-in.
+	Resyncs int `json:"resyncs"`
+
+	// The number of blocks, how many of them failed to decode as MFM, and
+	// how many failed the integrity check of their data (the framing of
+	// the StudyBox bytes, and the configured checker, if any).
+	Blocks         int `json:"blocks"`
+	FailedBlocks   int `json:"failed_blocks"`
+	ChecksumErrors int `json:"checksum_errors"`
+}
+
+// Jitter is the timing jitter of a class of pulses, measured as how far
+// the width of each pulse is from the expected width for its class, in
+// samples.
+type Jitter struct {
+	Count int `json:"count"`
+
+	// The mean and variance of the deviation from the expected width.
+	Mean     float64 `json:"mean"`
+	Variance float64 `json:"variance"`
+
+	// The sum of squared differences from the mean, for Welford's
+	// algorithm; the variance is calculated from this.
+	m2 float64
+}
+
+func (j *Jitter) add(dev float64) {
+	j.Count++
+	delta := dev - j.Mean
+	j.Mean += delta / float64(j.Count)
+	j.m2 += delta * (dev - j.Mean)
+	j.Variance = j.m2 / float64(j.Count)
+}
+
+// Collector collects the measurements for a Report.
+//
+// It is a mfm.PulseSink, for the pulses from the decoder (or classifier),
+// and an events.Sink, for the resyncs and block results. The samples are
+// measured separately, with AddSamples.
+type Collector struct {
+	report Report
+
+	// The sums of the squares of the signal and noise samples, and the
+	// number of each.
+	signal, noise   float64
+	signalN, noiseN int
+}
+
+// AddSamples measures the signal and noise levels of the given samples,
+// which should already be cleaned of DC offset. Samples that are within
+// the noise floor are counted as noise, the rest as signal.
+func (c *Collector) AddSamples(samples []int, noiseFloor int) {
+	for _, v := range samples {
+		sq := float64(v) * float64(v)
+		if v <= noiseFloor && v >= -noiseFloor {
+			c.noise += sq
+			c.noiseN++
+		} else {
+			c.signal += sq
+			c.signalN++
+		}
+	}
+}
+
+// Pulse implements mfm.PulseSink.
+func (c *Collector) Pulse(p mfm.Pulse) {
+	r := &c.report
+	r.Pulses++
+
+	bw := p.BitWidth
+	if bw > 0 && (bw < r.MinBitWidth || r.MinBitWidth == 0) {
+		r.MinBitWidth = bw
+	}
+	if bw > r.MaxBitWidth {
+		r.MaxBitWidth = bw
+	}
+
+	// The expected widths are 2, 3 and 4 half-bit widths.
+	switch p.Class {
+	case mfm.PulseTiny:
+		r.TinyPulses++
+	case mfm.PulseHuge:
+		r.HugePulses++
+	case mfm.PulseShort:
+		r.Short.add(p.Width() - bw)
+	case mfm.PulseMedium:
+		r.Medium.add(p.Width() - bw*3/2)
+	case mfm.PulseLong:
+		r.Long.add(p.Width() - bw*2)
+	}
+}
+
+// Event implements events.Sink.
+func (c *Collector) Event(ev events.Event) {
+	switch ev.Type {
+	case events.Resync:
+		c.report.Resyncs++
+	case events.BlockEnd:
+		c.report.Blocks++
+	case events.BlockError:
+		c.report.Blocks++
+		c.report.FailedBlocks++
+	case events.ChecksumFailure:
+		c.report.Blocks++
+		c.report.ChecksumErrors++
+	}
+}
+
+// Report returns the report of the measurements so far.
+func (c *Collector) Report() Report {
+	r := c.report
+	if c.signalN > 0 {
+		r.SignalPower = c.signal / float64(c.signalN)
+	}
+	if c.noiseN > 0 {
+		r.NoisePower = c.noise / float64(c.noiseN)
+	}
+	if r.SignalPower > 0 && r.NoisePower > 0 {
+		r.SNR = 10 * math.Log10(r.SignalPower/r.NoisePower)
+	}
+	return r
+}
@@ -0,0 +1,392 @@
+// Package report makes reports of decodes, for keeping along with the
+// decoded data, e.g. as a record of how a tape was preserved.
+package report
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/edorfaus/sb-mfm-decode/mfm"
+	"github.com/edorfaus/sb-mfm-decode/pipeline"
+	"github.com/edorfaus/sb-mfm-decode/studybox"
+)
+
+// Capture is the decode of a single capture (input file) to report on.
+type Capture struct {
+	// The result of decoding the capture.
+	Result *pipeline.Result
+
+	// The settings that the capture was decoded with, in the order they
+	// should be listed.
+	Params []Param
+
+	// The samples of the data channel of the capture, for showing the
+	// waveform around each error; if nil, the waveforms are not shown.
+	Samples []int
+
+	// When the report was made; if zero, the current time is used. With
+	// several captures, the latest of them is used.
+	Time time.Time
+}
+
+// Param is a setting that a decode was done with.
+type Param struct {
+	Name  string
+	Value string
+}
+
+// SnippetSamples is the number of samples shown on each side of an error
+// in its waveform snippet.
+const SnippetSamples = 150
+
+// WriteHTML writes the report of the given captures (of a single tape) as
+// a standalone HTML page, with the summary of the tape, and for each of
+// the captures: a summary of its decode, the settings it used, the status
+// of each block, and the position of each error, with a snippet of the
+// waveform around it (as inline SVG).
+func WriteHTML(w io.Writer, captures ...*Capture) error {
+	page := htmlPage{}
+
+	results := make([]*pipeline.Result, len(captures))
+	for i, c := range captures {
+		results[i] = c.Result
+		if c.Time.After(page.time) {
+			page.time = c.Time
+		}
+		page.Captures = append(page.Captures, htmlCapture(c))
+	}
+	if page.time.IsZero() {
+		page.time = time.Now()
+	}
+	page.Time = page.time.Format(time.RFC3339)
+
+	switch len(captures) {
+	case 0:
+		page.Title = "no captures"
+	case 1:
+		page.Title = results[0].Input
+	default:
+		page.Title = fmt.Sprintf(
+			"%v and %v more", results[0].Input, len(results)-1,
+		)
+	}
+
+	sum := Summarize(results...)
+	page.Summary = []Param{
+		{"Captures", fmt.Sprintf(
+			"%v (%v failed)", sum.Captures, sum.FailedCaptures,
+		)},
+		{"Length", fmt.Sprintf("%.3f s", sum.Duration)},
+		{"Blocks", fmt.Sprintf(
+			"%v good, %v failed", sum.GoodBlocks, sum.FailedBlocks,
+		)},
+		{"Data bytes", fmt.Sprint(sum.Bytes)},
+		{"Data rate", fmt.Sprintf("%.1f bytes/s", sum.DataRate)},
+		{"Decode time", sum.DecodeTime.Round(time.Millisecond).String()},
+	}
+	page.Recapture = sum.Recapture
+
+	return htmlTemplate.Execute(w, page)
+}
+
+// htmlCapture returns the part of the HTML report for the given capture.
+func htmlCapture(c *Capture) htmlSection {
+	res := c.Result
+	meta := res.Meta
+
+	page := htmlSection{
+		Input:  res.Input,
+		Params: c.Params,
+	}
+
+	bytes := 0
+	for i, b := range res.Blocks {
+		bytes += len(b.Data)
+		row := htmlBlock{
+			Index:    i,
+			ID:       b.ID(),
+			Start:    seconds(b.Start, meta.SampleRate),
+			End:      seconds(b.End, meta.SampleRate),
+			Bits:     b.Bits.Len(),
+			Bytes:    len(b.Data),
+			BitWidth: fmt.Sprintf("%.3f", b.Info.BitWidth),
+			Ending:   b.Ending.String(),
+			Status:   "ok",
+			OK:       b.Err == nil,
+		}
+		switch {
+		case b.Retry != nil:
+			row.Notes = "retried"
+		case b.Reversed:
+			row.Notes = "reversed"
+		}
+		if b.Err != nil {
+			row.Status = b.Err.Error()
+
+			pos := ErrorPos(b)
+			page.Errors = append(page.Errors, htmlError{
+				Block: i,
+				ID:    row.ID,
+				Pos:   pos,
+				Time:  seconds(pos, meta.SampleRate),
+				Err:   b.Err.Error(),
+				SVG:   snippet(c.Samples, pos, meta.BitDepth),
+			})
+		}
+		page.Blocks = append(page.Blocks, row)
+	}
+
+	q := res.Quality
+	summary := []Param{
+		{"Input", res.Input},
+		{"Format", fmt.Sprintf(
+			"%v Hz, %v-bit, %v channel(s)",
+			meta.SampleRate, meta.BitDepth, meta.NumChannels,
+		)},
+	}
+	if res.Samples > 0 {
+		summary = append(summary, Param{
+			"Length", seconds(res.Samples, meta.SampleRate) + " s",
+		})
+	}
+	summary = append(summary,
+		Param{"Decode time", res.Duration.Round(time.Millisecond).String()},
+		Param{"Blocks", fmt.Sprint(len(res.Blocks))},
+		Param{"Failed blocks", fmt.Sprint(res.FailedBlocks())},
+		Param{"Data bytes", fmt.Sprint(bytes)},
+		Param{"SNR", fmt.Sprintf("%.1f dB", q.SNR)},
+		Param{"Bit width", fmt.Sprintf(
+			"%.3f to %.3f samples", q.MinBitWidth, q.MaxBitWidth,
+		)},
+		Param{"Pulses", fmt.Sprintf(
+			"%v (%v tiny, %v huge)", q.Pulses, q.TinyPulses, q.HugePulses,
+		)},
+		Param{"Jitter (short/medium/long)", fmt.Sprintf(
+			"%.3f / %.3f / %.3f samples", math.Sqrt(q.Short.Variance),
+			math.Sqrt(q.Medium.Variance), math.Sqrt(q.Long.Variance),
+		)},
+		Param{"Resyncs", fmt.Sprint(q.Resyncs)},
+		Param{"Checksum errors", fmt.Sprint(q.ChecksumErrors)},
+	)
+	if res.Err != nil {
+		summary = append(summary, Param{"Stopped by", res.Err.Error()})
+	}
+	page.Summary = summary
+
+	return page
+}
+
+// ErrorPos returns the sample index where the error of the given block
+// was found, as near as can be told: where the decoder stopped, or the
+// first byte that could not be decoded, or (for errors in the data as a
+// whole) the end of the block.
+func ErrorPos(b *pipeline.Block) int {
+	bitWidth := b.Info.BitWidth
+	if bitWidth <= 0 {
+		bitWidth = float64(b.BitWidth)
+	}
+
+	// The number of MFM bits (half-bits) before the error.
+	bits := b.Bits.Unpack(nil)
+	n := len(bits)
+	if b.Ending != mfm.EndUnknown {
+		if rest, err := studybox.SkipLeadIn(bits); err == nil {
+			n = len(bits) - len(rest) + len(b.Data)*studybox.BitsPerByte*2
+		}
+	}
+
+	pos := b.Start + int(float64(n)*bitWidth/2)
+	if pos > b.End {
+		pos = b.End
+	}
+	return pos
+}
+
+// snippet returns an SVG image of the samples around the given position,
+// with that position marked, or "" if there are no samples.
+func snippet(samples []int, pos, bits int) template.HTML {
+	if len(samples) == 0 || bits < 2 {
+		return ""
+	}
+	from := max(pos-SnippetSamples, 0)
+	to := min(pos+SnippetSamples, len(samples))
+	if from >= to {
+		return ""
+	}
+
+	const width, height = 600, 120
+	xScale := float64(width) / float64(2*SnippetSamples)
+	yScale := float64(height) / 2 / float64(int(1)<<(bits-1))
+	x := func(i int) float64 {
+		return float64(i-pos+SnippetSamples) * xScale
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(
+		&sb, `<svg xmlns="http://www.w3.org/2000/svg" width="%v"`+
+			` height="%v" viewBox="0 0 %v %v">`,
+		width, height, width, height,
+	)
+	fmt.Fprintf(
+		&sb, `<line x1="0" y1="%v" x2="%v" y2="%v" class="axis"/>`,
+		height/2, width, height/2,
+	)
+	fmt.Fprintf(
+		&sb, `<line x1="%.1f" y1="0" x2="%.1f" y2="%v" class="mark"/>`,
+		x(pos), x(pos), height,
+	)
+	sb.WriteString(`<polyline class="wave" points="`)
+	for i := from; i < to; i++ {
+		y := float64(height)/2 - float64(samples[i])*yScale
+		fmt.Fprintf(&sb, "%.1f,%.1f ", x(i), y)
+	}
+	sb.WriteString(`"/></svg>`)
+
+	return template.HTML(sb.String())
+}
+
+func seconds(samples, rate int) string {
+	if rate <= 0 {
+		return "?"
+	}
+	return fmt.Sprintf("%.3f", float64(samples)/float64(rate))
+}
+
+// htmlPage is the data of the HTML report.
+type htmlPage struct {
+	Title     string
+	Time      string
+	Summary   []Param
+	Recapture []Region
+	Captures  []htmlSection
+
+	time time.Time
+}
+
+// htmlSection is the part of the HTML report for a single capture.
+type htmlSection struct {
+	Input   string
+	Summary []Param
+	Params  []Param
+	Blocks  []htmlBlock
+	Errors  []htmlError
+}
+
+// htmlBlock is a row of the block table of the HTML report.
+type htmlBlock struct {
+	Index      int
+	ID         string
+	Start, End string
+	Bits       int
+	Bytes      int
+	BitWidth   string
+	Ending     string
+	Status     string
+	Notes      string
+	OK         bool
+}
+
+// htmlError is an error of the HTML report, with its waveform.
+type htmlError struct {
+	Block int
+	ID    string
+	Pos   int
+	Time  string
+	Err   string
+	SVG   template.HTML
+}
+
+var htmlTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Decode report: {{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ccc; padding: 0.2em 0.6em; text-align: left; }
+tr.fail td { background: #fdd; }
+tr.ok td.status { color: #070; }
+svg { border: 1px solid #ccc; background: #fafafa; }
+svg .axis { stroke: #bbb; }
+svg .mark { stroke: #d00; stroke-dasharray: 4 3; }
+svg .wave { stroke: #036; fill: none; stroke-width: 1; }
+</style>
+</head>
+<body>
+<h1>Decode report: {{.Title}}</h1>
+<p>Generated {{.Time}}</p>
+
+<h2>Tape summary</h2>
+<table>
+{{- range .Summary}}
+<tr><th>{{.Name}}</th><td>{{.Value}}</td></tr>
+{{- end}}
+</table>
+
+{{- if .Recapture}}
+
+<h3>Regions to capture again</h3>
+<table>
+<tr><th>Input</th><th>From (s)</th><th>To (s)</th><th>Blocks</th>
+<th>Error</th></tr>
+{{- range .Recapture}}
+<tr><td>{{.Input}}</td><td>{{printf "%.3f" .StartTime}}</td>
+<td>{{printf "%.3f" .EndTime}}</td><td>{{.Blocks}}</td><td>{{.Err}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+
+{{- range .Captures}}
+
+<h2>Capture: {{.Input}}</h2>
+
+<h3>Summary</h3>
+<table>
+{{- range .Summary}}
+<tr><th>{{.Name}}</th><td>{{.Value}}</td></tr>
+{{- end}}
+</table>
+
+{{- if .Params}}
+
+<h3>Settings</h3>
+<table>
+{{- range .Params}}
+<tr><th>{{.Name}}</th><td>{{.Value}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+
+<h3>Blocks</h3>
+<table>
+<tr><th>#</th><th>ID</th><th>Start (s)</th><th>End (s)</th><th>Bits</th>
+<th>Bytes</th><th>Bit width</th><th>Ending</th><th>Status</th>
+<th>Notes</th></tr>
+{{- range .Blocks}}
+<tr class="{{if .OK}}ok{{else}}fail{{end}}"><td>{{.Index}}</td>
+<td>{{.ID}}</td><td>{{.Start}}</td><td>{{.End}}</td><td>{{.Bits}}</td>
+<td>{{.Bytes}}</td><td>{{.BitWidth}}</td><td>{{.Ending}}</td>
+<td class="status">{{.Status}}</td><td>{{.Notes}}</td></tr>
+{{- end}}
+</table>
+
+{{- if .Errors}}
+
+<h3>Errors</h3>
+{{- range .Errors}}
+<h4>Block {{.Block}} ({{.ID}}) at {{.Time}} s (sample {{.Pos}})</h4>
+<p>{{.Err}}</p>
+{{- if .SVG}}
+<p>{{.SVG}}</p>
+{{- end}}
+{{- end}}
+{{- end}}
+{{- end}}
+</body>
+</html>
+`))
@@ -0,0 +1,184 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/edorfaus/sb-mfm-decode/pipeline"
+)
+
+// Summary is the tape-level statistics of the decodes of one or more
+// captures of a tape, e.g. one for each side of it, or of each part of it
+// that was recorded separately.
+//
+// The blocks are counted as decoded; on a StudyBox tape, each page has
+// its data in one block, so these are also the counts of its pages.
+type Summary struct {
+	// The number of captures, and how many of them could not be fully
+	// decoded (e.g. because the file could not be read to the end).
+	Captures       int `json:"captures"`
+	FailedCaptures int `json:"failed_captures"`
+
+	// The number of blocks, and how many of them were (not) decoded.
+	Blocks       int `json:"blocks"`
+	GoodBlocks   int `json:"good_blocks"`
+	FailedBlocks int `json:"failed_blocks"`
+
+	// The number of data bytes in the blocks that were decoded.
+	Bytes int `json:"bytes"`
+
+	// The total length of the captures, and of the blocks that were
+	// decoded, in seconds.
+	Duration     float64 `json:"duration"`
+	DataDuration float64 `json:"data_duration"`
+
+	// The data rate achieved, in bytes of decoded data per second of the
+	// captures.
+	DataRate float64 `json:"data_rate"`
+
+	// The total time that the decodes took.
+	DecodeTime time.Duration `json:"decode_time"`
+
+	// The regions of the captures that could not be decoded, and so may
+	// need to be captured again (e.g. with other settings, or another
+	// player).
+	Recapture []Region `json:"recapture,omitempty"`
+}
+
+// Region is a part of a capture.
+type Region struct {
+	// The input file of the capture.
+	Input string `json:"input"`
+
+	// The sample indexes of the start and end of the region, and the same
+	// in seconds from the start of the capture.
+	Start     int     `json:"start"`
+	End       int     `json:"end"`
+	StartTime float64 `json:"start_time"`
+	EndTime   float64 `json:"end_time"`
+
+	// The number of blocks in the region, and the first error in it.
+	Blocks int    `json:"blocks"`
+	Err    string `json:"error"`
+}
+
+// Summarize returns the summary of the given results, which should be of
+// the captures of a single tape, in order.
+func Summarize(results ...*pipeline.Result) *Summary {
+	s := &Summary{}
+	for _, res := range results {
+		s.Add(res)
+	}
+	return s
+}
+
+// Add adds the result of decoding another capture to the summary.
+func (s *Summary) Add(res *pipeline.Result) {
+	first := len(s.Recapture)
+	s.Captures++
+	if res.Err != nil {
+		s.FailedCaptures++
+	}
+	s.DecodeTime += res.Duration
+
+	rate := float64(res.Meta.SampleRate)
+	if rate > 0 {
+		s.Duration += float64(res.Samples) / rate
+	}
+
+	// Consecutive failed blocks are merged into a single region.
+	var region *Region
+	for _, b := range res.Blocks {
+		s.Blocks++
+		if b.Err == nil {
+			s.GoodBlocks++
+			s.Bytes += len(b.Data)
+			if rate > 0 {
+				s.DataDuration += float64(b.End-b.Start) / rate
+			}
+			region = nil
+			continue
+		}
+		s.FailedBlocks++
+
+		if region == nil {
+			s.Recapture = append(s.Recapture, Region{
+				Input: res.Input,
+				Start: b.Start,
+				Err:   b.Err.Error(),
+			})
+			region = &s.Recapture[len(s.Recapture)-1]
+		}
+		region.End = b.End
+		region.Blocks++
+	}
+
+	// If the decode stopped early, the rest of the capture is unknown.
+	if res.Err != nil {
+		start := 0
+		if n := len(res.Blocks); n > 0 {
+			start = res.Blocks[n-1].End
+		}
+		if region != nil {
+			start = region.Start
+			s.Recapture = s.Recapture[:len(s.Recapture)-1]
+		}
+		end := res.Samples
+		if end < start {
+			end = start
+		}
+		s.Recapture = append(s.Recapture, Region{
+			Input: res.Input,
+			Start: start,
+			End:   end,
+			Err:   res.Err.Error(),
+		})
+	}
+
+	if rate > 0 {
+		for i := first; i < len(s.Recapture); i++ {
+			r := &s.Recapture[i]
+			r.StartTime = float64(r.Start) / rate
+			r.EndTime = float64(r.End) / rate
+		}
+	}
+
+	if s.Duration > 0 {
+		s.DataRate = float64(s.Bytes) / s.Duration
+	}
+}
+
+// WriteText writes the summary as human-readable text.
+func (s *Summary) WriteText(w io.Writer) error {
+	_, err := fmt.Fprintf(
+		w, "Captures: %v (%v failed), %.3f s, decoded in %v\n"+
+			"Blocks: %v good, %v failed, of %v\n"+
+			"Data: %v bytes in %.3f s of blocks, %.1f bytes/s overall\n",
+		s.Captures, s.FailedCaptures, s.Duration,
+		s.DecodeTime.Round(time.Millisecond),
+		s.GoodBlocks, s.FailedBlocks, s.Blocks,
+		s.Bytes, s.DataDuration, s.DataRate,
+	)
+	if err != nil {
+		return err
+	}
+	for _, r := range s.Recapture {
+		_, err := fmt.Fprintf(
+			w, "Recapture: %v from %.3f to %.3f s (%v blocks): %v\n",
+			r.Input, r.StartTime, r.EndTime, r.Blocks, r.Err,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteJSON writes the summary as (indented) JSON.
+func (s *Summary) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(s)
+}
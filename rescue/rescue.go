@@ -0,0 +1,373 @@
+// Package rescue keeps track of which bytes of a decoded tape can be
+// relied on, in the form of the map files of GNU ddrescue: a payload of
+// the data of all the blocks of a capture, along with a map of the
+// ranges of it that were decoded well, and those that were not (e.g.
+// bridged dropouts, or blocks that failed), so that later captures of the
+// same tape can be used to fill in just the missing ranges.
+package rescue
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Status is the status of a range of bytes, as one of the characters that
+// ddrescue uses for them. Only Finished and Bad are made by this package,
+// but the others are accepted when reading a map, and taken as bad.
+type Status byte
+
+const (
+	// Finished means that the bytes were decoded well.
+	Finished Status = '+'
+	// Bad means that the bytes are unknown, or unreliable.
+	Bad Status = '-'
+
+	// The other statuses of ddrescue, for ranges that it has not (fully)
+	// tried to read yet.
+	NonTried   Status = '?'
+	NonTrimmed Status = '*'
+	NonScraped Status = '/'
+)
+
+// Valid returns true if the status is one of the known statuses.
+func (s Status) Valid() bool {
+	switch s {
+	case Finished, Bad, NonTried, NonTrimmed, NonScraped:
+		return true
+	}
+	return false
+}
+
+func (s Status) String() string {
+	return string(s)
+}
+
+// Range is a range of bytes of the payload with the same status.
+type Range struct {
+	Pos, Size int
+	Status    Status
+}
+
+// End returns the position just after the last byte of the range.
+func (r Range) End() int {
+	return r.Pos + r.Size
+}
+
+// Map is the status of each byte of a payload, as a list of ranges that
+// are in order, do not overlap, and have no gaps between them, starting
+// at position 0. Neighbouring ranges have different statuses.
+type Map []Range
+
+// Size returns the size of the payload that the map covers.
+func (m Map) Size() int {
+	if len(m) == 0 {
+		return 0
+	}
+	return m[len(m)-1].End()
+}
+
+// Add adds the given number of bytes with the given status to the end of
+// the map, joining them to the last range if it has the same status.
+func (m *Map) Add(size int, status Status) {
+	if size <= 0 {
+		return
+	}
+	if n := len(*m); n > 0 && (*m)[n-1].Status == status {
+		(*m)[n-1].Size += size
+		return
+	}
+	*m = append(*m, Range{Pos: m.Size(), Size: size, Status: status})
+}
+
+// At returns the status of the byte at the given position, or NonTried if
+// it is outside of the map.
+func (m Map) At(pos int) Status {
+	i := sort.Search(len(m), func(i int) bool { return m[i].End() > pos })
+	if pos < 0 || i == len(m) {
+		return NonTried
+	}
+	return m[i].Status
+}
+
+// Bad returns the ranges of the map that are not Finished.
+func (m Map) Bad() []Range {
+	var bad []Range
+	for _, r := range m {
+		if r.Status != Finished {
+			bad = append(bad, r)
+		}
+	}
+	return bad
+}
+
+// BadBytes returns the number of bytes of the map that are not Finished.
+func (m Map) BadBytes() int {
+	n := 0
+	for _, r := range m.Bad() {
+		n += r.Size
+	}
+	return n
+}
+
+// Write writes the map in the form of a ddrescue map file, with the given
+// tool named in its heading comment.
+func (m Map) Write(w io.Writer, tool string) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# Mapfile. Created by %v\n", tool)
+	// The current position and status are of the reading that ddrescue
+	// was doing; here, the reading is always done.
+	fmt.Fprintf(bw, "# current_pos  current_status  current_pass\n")
+	fmt.Fprintf(bw, "0x%08X     %v               1\n", 0, Finished)
+	fmt.Fprintf(bw, "#      pos        size  status\n")
+	for _, r := range m {
+		fmt.Fprintf(bw, "0x%08X  0x%08X  %v\n", r.Pos, r.Size, r.Status)
+	}
+	return bw.Flush()
+}
+
+// Read reads a map in the form of a ddrescue map file. Lines starting
+// with # are comments, and the first other line is the status line,
+// which is ignored. The ranges must be in order, without gaps, starting
+// at 0; neighbouring ranges with the same status are joined.
+func Read(r io.Reader) (Map, error) {
+	var m Map
+	sc := bufio.NewScanner(r)
+	status := false
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		if !status {
+			status = true
+			continue
+		}
+
+		f := strings.Fields(text)
+		var rg Range
+		var err error
+		if len(f) == 3 {
+			rg.Pos, err = parseInt(f[0])
+		}
+		if len(f) == 3 && err == nil {
+			rg.Size, err = parseInt(f[1])
+		}
+		if len(f) == 3 && len(f[2]) == 1 {
+			rg.Status = Status(f[2][0])
+		}
+		if len(f) != 3 || err != nil || rg.Size <= 0 || !rg.Status.Valid() {
+			return nil, fmt.Errorf("map line %v: bad range %q", line, text)
+		}
+		if rg.Pos != m.Size() {
+			return nil, fmt.Errorf(
+				"map line %v: range at %v, expected %v", line, rg.Pos,
+				m.Size(),
+			)
+		}
+		m.Add(rg.Size, rg.Status)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if !status {
+		return nil, fmt.Errorf("map has no status line")
+	}
+	return m, nil
+}
+
+// parseInt parses a position or size of a map, which ddrescue writes in
+// hex with a 0x prefix, but which may also be decimal (or octal).
+func parseInt(s string) (int, error) {
+	v, err := strconv.ParseInt(s, 0, 64)
+	if err == nil && v < 0 {
+		err = fmt.Errorf("negative value: %v", v)
+	}
+	return int(v), err
+}
+
+// Load reads the map in the given file, as by Read.
+func Load(filename string) (Map, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Read(f)
+}
+
+// Save writes the map to the given file, as by Write.
+func (m Map) Save(filename, tool string) (retErr error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := f.Close(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+	return m.Write(f, tool)
+}
+
+// MapName returns the name of the map file of the given payload file,
+// which is the name of the payload with ".map" added.
+func MapName(payload string) string {
+	return payload + ".map"
+}
+
+// DefaultBlockSize is the default Payload.BlockSize, which leaves room
+// for the largest blocks that have been seen, of a few hundred bytes.
+const DefaultBlockSize = 1024
+
+// Payload is the data of the blocks of a capture, one after the other,
+// along with the map of which of its bytes can be relied on.
+//
+// Each block takes BlockSize bytes of the payload, whether or not it
+// decoded, so that the blocks are at the same positions in the payloads
+// of all captures of a tape, and a block that failed in one of them can be
+// filled in from another.
+type Payload struct {
+	Data []byte
+	Map  Map
+
+	// The size of the range of the payload that each block takes; if 0,
+	// it is DefaultBlockSize.
+	BlockSize int
+}
+
+// AddBlock adds the data of a block to the payload, padded with zeros to
+// the block size. The confidence of each byte of it (as from
+// studybox.Confidence) gives the bytes that are bad: those with a
+// confidence below minConf, e.g. 1 for only the ones that are unknown
+// (such as those of a bridged dropout). If the confidence is nil, the
+// bytes are taken as good, unless failed is set, which marks the whole
+// range of the block as bad (for a block that failed, which may have
+// decoded only some of its bytes, or none).
+//
+// The padding of a block that decoded is good, as the block is known to
+// end there; it returns an error if the data does not fit in the block
+// size, in which case nothing is added.
+func (p *Payload) AddBlock(data, conf []byte, minConf int, failed bool) error {
+	size := p.BlockSize
+	if size <= 0 {
+		size = DefaultBlockSize
+	}
+	if len(data) > size {
+		return fmt.Errorf(
+			"block of %v bytes does not fit in the block size of %v",
+			len(data), size,
+		)
+	}
+	p.Data = append(p.Data, data...)
+	p.Data = append(p.Data, make([]byte, size-len(data))...)
+	if failed {
+		p.Map.Add(size, Bad)
+		return nil
+	}
+	if len(conf) != len(data) {
+		p.Map.Add(len(data), Finished)
+	} else {
+		for _, c := range conf {
+			if int(c) < minConf {
+				p.Map.Add(1, Bad)
+			} else {
+				p.Map.Add(1, Finished)
+			}
+		}
+	}
+	p.Map.Add(size-len(data), Finished)
+	return nil
+}
+
+// LoadPayload reads a payload from the given file, along with its map from
+// the file named by MapName. The map must cover the whole payload.
+func LoadPayload(filename string) (*Payload, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	m, err := Load(MapName(filename))
+	if err != nil {
+		return nil, err
+	}
+	if m.Size() != len(data) {
+		return nil, fmt.Errorf(
+			"map of %v covers %v bytes, but it has %v", filename, m.Size(),
+			len(data),
+		)
+	}
+	return &Payload{Data: data, Map: m}, nil
+}
+
+// Save writes the payload to the given file, and its map to the file named
+// by MapName, which names the given tool as having made it.
+func (p *Payload) Save(filename, tool string) error {
+	if err := os.WriteFile(filename, p.Data, 0o666); err != nil {
+		return err
+	}
+	return p.Map.Save(MapName(filename), tool)
+}
+
+// Merge merges the given payloads of captures of the same tape into the
+// best known payload, block by block: each byte is taken from the first
+// payload that has it Finished, or if none do, from the first payload, as
+// Bad. The payloads must have the same number of blocks of the given size
+// (see Payload.BlockSize), so that their blocks line up.
+//
+// It also returns the number of bytes that were Finished in more than one
+// payload, but with different values; those are marked Bad, as it is not
+// known which of them is right, and they show that the payloads may not
+// be of the same tape.
+func Merge(blockSize int, payloads ...*Payload) (*Payload, int, error) {
+	if blockSize <= 0 {
+		blockSize = DefaultBlockSize
+	}
+	size := 0
+	for i, p := range payloads {
+		if len(p.Data)%blockSize != 0 {
+			return nil, 0, fmt.Errorf(
+				"payload %v: %v bytes is not a whole number of blocks of %v",
+				i+1, len(p.Data), blockSize,
+			)
+		}
+		if i > 0 && len(p.Data) != size {
+			return nil, 0, fmt.Errorf(
+				"payload %v has %v blocks, but payload 1 has %v; some "+
+					"blocks are missing from one of them",
+				i+1, len(p.Data)/blockSize, size/blockSize,
+			)
+		}
+		size = len(p.Data)
+	}
+
+	out := &Payload{Data: make([]byte, size), BlockSize: blockSize}
+	conflicts := 0
+	for i := 0; i < size; i++ {
+		status := NonTried
+		conflict := false
+		for _, p := range payloads {
+			s := p.Map.At(i)
+			switch {
+			case s == Finished && status == Finished:
+				if p.Data[i] != out.Data[i] {
+					conflict = true
+				}
+			case s == Finished && !conflict:
+				out.Data[i], status = p.Data[i], Finished
+			case status == NonTried:
+				out.Data[i], status = p.Data[i], Bad
+			}
+		}
+		if conflict {
+			conflicts++
+			status = Bad
+		}
+		out.Map.Add(1, status)
+	}
+	return out, conflicts, nil
+}
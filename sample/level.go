@@ -0,0 +1,128 @@
+package sample
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Level is a sample level, such as a noise floor, given either as a
+// sample value, or in dBFS (decibels relative to the full scale of the
+// samples), which does not depend on the bit depth of the input.
+//
+// A level in dBFS must be below 0dB, so a non-zero DB means that the
+// level is in dBFS, and Value is not used.
+type Level struct {
+	Value int
+	DB    float64
+}
+
+// ParseLevel parses a level, which is either an integer sample value, or a
+// number of decibels with a "dB" or "dBFS" suffix, e.g. "-34dB".
+func ParseLevel(s string) (Level, error) {
+	t := strings.TrimSpace(s)
+	lower := strings.ToLower(t)
+	for _, suffix := range []string{"dbfs", "db"} {
+		if !strings.HasSuffix(lower, suffix) {
+			continue
+		}
+		num := strings.TrimSpace(t[:len(t)-len(suffix)])
+		db, err := strconv.ParseFloat(num, 64)
+		if err != nil {
+			return Level{}, fmt.Errorf("bad level in dB: %q", s)
+		}
+		// The bit depth is not known yet, so this only rejects levels
+		// that are too low for any of them; see Level.Check.
+		if err := CheckDB(db, 32); err != nil {
+			return Level{}, err
+		}
+		return Level{DB: db}, nil
+	}
+	v, err := strconv.Atoi(t)
+	if err != nil {
+		return Level{}, fmt.Errorf("bad level: %q", s)
+	}
+	return Level{Value: v}, nil
+}
+
+// Unset returns true if the level was not given, which is shown by a
+// negative Value (and no DB), for the default to be used instead.
+func (l Level) Unset() bool {
+	return l.DB == 0 && l.Value < 0
+}
+
+// Check returns an error if the level is in dBFS, and is not a valid level
+// for samples of the given number of bits (see CheckDB).
+func (l Level) Check(bits int) error {
+	if l.DB == 0 {
+		return nil
+	}
+	return CheckDB(l.DB, bits)
+}
+
+// Samples returns the level as a sample value, for samples of the given
+// number of bits. If the level is unset, that is returned as it is. A
+// level in dBFS should be checked with Check first, as one that is below
+// 1 sample value is returned as 0.
+func (l Level) Samples(bits int) int {
+	if l.DB == 0 {
+		return l.Value
+	}
+	return FromDB(l.DB, bits)
+}
+
+func (l Level) String() string {
+	if l.DB == 0 {
+		return strconv.Itoa(l.Value)
+	}
+	return strconv.FormatFloat(l.DB, 'g', -1, 64) + "dB"
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (l Level) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, as by ParseLevel.
+func (l *Level) UnmarshalText(text []byte) error {
+	v, err := ParseLevel(string(text))
+	if err != nil {
+		return err
+	}
+	*l = v
+	return nil
+}
+
+// CheckDB returns an error if the given level in dBFS is not below 0, or
+// is so low that it is below 1 sample value (which FromDB would round to
+// 0) for samples of the given number of bits, or the number of bits is
+// not one that samples can have.
+func CheckDB(db float64, bits int) error {
+	if math.IsNaN(db) || math.IsInf(db, 0) || db >= 0 {
+		return fmt.Errorf("level must be below 0dB: %v", db)
+	}
+	if bits < 2 || bits > 32 {
+		return fmt.Errorf("invalid bit depth: %v", bits)
+	}
+	if FromDB(db, bits) < 1 {
+		return fmt.Errorf(
+			"level %vdB is below 1 sample value for %v-bit samples", db, bits,
+		)
+	}
+	return nil
+}
+
+// FromDB returns the sample value of the given level in dBFS, for samples
+// of the given number of bits.
+func FromDB(db float64, bits int) int {
+	full := float64(int(1) << (bits - 1))
+	return int(math.Round(full * math.Pow(10, db/20)))
+}
+
+// ToDB returns the level in dBFS of the given sample value, for samples
+// of the given number of bits; it is -Inf for 0.
+func ToDB(v, bits int) float64 {
+	full := float64(int(1) << (bits - 1))
+	return 20 * math.Log10(math.Abs(float64(v))/full)
+}
@@ -0,0 +1,27 @@
+package sample
+
+import (
+	"fmt"
+)
+
+// LimitError is the error of an input that went past one of the safety
+// limits of the processing, such as the most bits in a block. Those are
+// there so that a damaged or garbage input cannot make the processing
+// use unbounded memory or time; hitting one usually means that the input
+// is not what it was expected to be.
+type LimitError struct {
+	// What was limited, e.g. "bits in a block".
+	Limit string
+
+	// The limit that was exceeded.
+	Max int
+
+	// The sample index that it was exceeded at.
+	Index int
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf(
+		"too many %v at %v: over the limit of %v", e.Limit, e.Index, e.Max,
+	)
+}
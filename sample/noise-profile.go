@@ -0,0 +1,120 @@
+package sample
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// NoiseProfile is a noise floor that varies over the samples of a
+// capture, e.g. because the hiss of the tape changes, as a list of levels
+// that each apply from their start until the start of the next one. The
+// first level also applies before its start.
+//
+// The levels must be sorted by their start. An empty profile has no noise
+// floor; the users of one then use their single noise floor instead.
+type NoiseProfile []NoiseLevel
+
+// NoiseLevel is the noise floor from a given sample index.
+type NoiseLevel struct {
+	Start int
+	Floor int
+}
+
+// At returns the noise floor at the given sample index, or 0 if the
+// profile is empty.
+func (p NoiseProfile) At(i int) int {
+	if len(p) == 0 {
+		return 0
+	}
+	n := sort.Search(len(p), func(j int) bool { return p[j].Start > i })
+	if n == 0 {
+		return p[0].Floor
+	}
+	return p[n-1].Floor
+}
+
+// From returns the part of the profile from the given sample index, with
+// the starts counted from there, for use on a part of the samples.
+func (p NoiseProfile) From(start int) NoiseProfile {
+	if len(p) == 0 {
+		return nil
+	}
+	out := NoiseProfile{{Start: 0, Floor: p.At(start)}}
+	for _, l := range p {
+		if l.Start > start {
+			out = append(out, NoiseLevel{l.Start - start, l.Floor})
+		}
+	}
+	return out
+}
+
+// Scale returns the profile with its noise floors multiplied by the given
+// factor.
+func (p NoiseProfile) Scale(factor float64) NoiseProfile {
+	if len(p) == 0 || factor == 1 {
+		return p
+	}
+	out := make(NoiseProfile, len(p))
+	for i, l := range p {
+		out[i] = NoiseLevel{l.Start, int(float64(l.Floor) * factor)}
+	}
+	return out
+}
+
+// ReadNoiseProfile reads a noise profile in CSV form, with the start (as a
+// sample index) and the noise floor of one level per line, in order. Empty
+// lines, lines starting with #, and a header line, are ignored.
+func ReadNoiseProfile(r io.Reader) (NoiseProfile, error) {
+	var p NoiseProfile
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || text[0] == '#' || text == "start,floor" {
+			continue
+		}
+
+		start, floor, ok := strings.Cut(text, ",")
+		var l NoiseLevel
+		var err error
+		if ok {
+			l.Start, err = strconv.Atoi(strings.TrimSpace(start))
+		}
+		if ok && err == nil {
+			l.Floor, err = strconv.Atoi(strings.TrimSpace(floor))
+		}
+		if !ok || err != nil || l.Start < 0 || l.Floor < 0 {
+			return nil, fmt.Errorf(
+				"noise profile line %v: bad level %q", line, text,
+			)
+		}
+		if len(p) > 0 && l.Start <= p[len(p)-1].Start {
+			return nil, fmt.Errorf(
+				"noise profile line %v: levels are out of order", line,
+			)
+		}
+		p = append(p, l)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(p) == 0 {
+		return nil, fmt.Errorf("noise profile has no levels")
+	}
+	return p, nil
+}
+
+// LoadNoiseProfile reads the noise profile in the given file, as by
+// ReadNoiseProfile.
+func LoadNoiseProfile(filename string) (NoiseProfile, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadNoiseProfile(f)
+}
@@ -0,0 +1,54 @@
+// Package sample defines the integer types that can be used to hold
+// audio samples, so that the processing code can be used with smaller
+// types than int, to save memory on long captures.
+package sample
+
+// Type is the set of types that can be used to hold samples.
+//
+// Since int is 64 bits on most platforms, using int16 for 16-bit input
+// takes only a quarter of the memory.
+type Type interface {
+	~int16 | ~int32 | ~int
+}
+
+// Bits returns the number of bits in the given sample type.
+func Bits[S Type]() int {
+	bits := 1
+	for v := S(1); v > 0; v <<= 1 {
+		bits++
+	}
+	return bits
+}
+
+// Max returns the largest value that fits in the given sample type.
+func Max[S Type]() S {
+	v := S(1) << (Bits[S]() - 2)
+	return v | (v - 1)
+}
+
+// Min returns the smallest value that fits in the given sample type.
+func Min[S Type]() S {
+	return -Max[S]() - 1
+}
+
+// Clamp converts the given value to the given sample type, saturating
+// it if it is outside of the range of that type (instead of wrapping).
+func Clamp[S Type](v int) S {
+	s := S(v)
+	if int(s) == v {
+		return s
+	}
+	if v < 0 {
+		return Min[S]()
+	}
+	return Max[S]()
+}
+
+// Convert converts the given samples to another sample type, saturating
+// any values that do not fit. The result is appended to out.
+func Convert[To, From Type](out []To, in []From) []To {
+	for _, v := range in {
+		out = append(out, Clamp[To](int(v)))
+	}
+	return out
+}
@@ -0,0 +1,110 @@
+package sample
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SpeedCurve is the speed that a tape was played at over a capture,
+// relative to its nominal speed (e.g. 1.02 if it was 2% fast), as a list
+// of points with straight lines between them. Before the first point and
+// after the last, the speed stays at the value of that point.
+//
+// The points must be sorted by their index. An empty curve is taken to
+// mean that the tape was played at its nominal speed.
+type SpeedCurve []SpeedPoint
+
+// SpeedPoint is the tape speed at a given sample index.
+type SpeedPoint struct {
+	Index int
+	Speed float64
+}
+
+// At returns the speed at the given sample index, or 1 if the curve is
+// empty.
+func (c SpeedCurve) At(i float64) float64 {
+	if len(c) == 0 {
+		return 1
+	}
+	n := sort.Search(len(c), func(j int) bool {
+		return float64(c[j].Index) > i
+	})
+	if n == 0 {
+		return c[0].Speed
+	}
+	if n == len(c) {
+		return c[n-1].Speed
+	}
+	a, b := c[n-1], c[n]
+	t := (i - float64(a.Index)) / float64(b.Index-a.Index)
+	return a.Speed + (b.Speed-a.Speed)*t
+}
+
+// WriteSpeedCurve writes the given speed curve in CSV form, as read by
+// ReadSpeedCurve, with a header line.
+func WriteSpeedCurve(w io.Writer, c SpeedCurve) error {
+	out := bufio.NewWriter(w)
+	fmt.Fprintln(out, "index,speed")
+	for _, p := range c {
+		fmt.Fprintf(out, "%v,%.6f\n", p.Index, p.Speed)
+	}
+	return out.Flush()
+}
+
+// ReadSpeedCurve reads a speed curve in CSV form, with the sample index
+// and the speed of one point per line, in order. Empty lines, lines
+// starting with #, and a header line, are ignored.
+func ReadSpeedCurve(r io.Reader) (SpeedCurve, error) {
+	var c SpeedCurve
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || text[0] == '#' || text == "index,speed" {
+			continue
+		}
+
+		index, speed, ok := strings.Cut(text, ",")
+		var p SpeedPoint
+		var err error
+		if ok {
+			p.Index, err = strconv.Atoi(strings.TrimSpace(index))
+		}
+		if ok && err == nil {
+			p.Speed, err = strconv.ParseFloat(strings.TrimSpace(speed), 64)
+		}
+		if !ok || err != nil || p.Index < 0 || !(p.Speed > 0) {
+			return nil, fmt.Errorf(
+				"speed curve line %v: bad point %q", line, text,
+			)
+		}
+		if len(c) > 0 && p.Index <= c[len(c)-1].Index {
+			return nil, fmt.Errorf(
+				"speed curve line %v: points are out of order", line,
+			)
+		}
+		c = append(c, p)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(c) == 0 {
+		return nil, fmt.Errorf("speed curve has no points")
+	}
+	return c, nil
+}
+
+// LoadSpeedCurve reads the speed curve in the given file, as by
+// ReadSpeedCurve.
+func LoadSpeedCurve(filename string) (SpeedCurve, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadSpeedCurve(f)
+}
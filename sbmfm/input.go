@@ -0,0 +1,199 @@
+package sbmfm
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/edorfaus/sb-mfm-decode/filter"
+	"github.com/edorfaus/sb-mfm-decode/pipeline"
+	"github.com/edorfaus/sb-mfm-decode/sample"
+	"github.com/edorfaus/sb-mfm-decode/wav"
+)
+
+// Input is a recording that has been loaded into memory, so that it can
+// be decoded several times with different options (e.g. while tuning
+// them) without reading the file again each time.
+//
+// It also keeps the samples as cleaned by the latest decode, so that the
+// next decode can skip the cleaning if it would clean them the same way.
+// This is not done when failed blocks are retried or recleaned, since that
+// needs the samples from before they were cleaned.
+type Input struct {
+	// The format of the recording.
+	Meta wav.Meta
+
+	samples []int
+
+	// Whether the samples have already been cleaned, by Clean, so that
+	// decoding them does not clean them again.
+	clean bool
+
+	// The cleaned samples, and the settings that they were cleaned with;
+	// cleaned is nil if there are none.
+	cleaned  []int
+	cleanKey cleanKey
+}
+
+// cleanKey holds the options that affect how the samples are cleaned.
+type cleanKey struct {
+	noiseFloor, bitRate, bufferSamples, start, end int
+
+	// The noise floor in dBFS, and the normalization, as a string, since
+	// the options hold a pointer.
+	noiseFloorDB float64
+	normalize    string
+
+	// The sample rate, and the speed it is corrected for, which set the
+	// peak width (along with the bit rate).
+	sampleRate int
+	speed      float64
+}
+
+// Load loads the StudyBox data channel of the given WAVE file.
+func Load(path string) (*Input, error) {
+	r, err := wav.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	in := &Input{Meta: r.Meta, samples: make([]int, r.Frames)}
+	n := 0
+	for n < len(in.samples) {
+		c, err := r.ReadSamples(in.samples[n:])
+		n += c
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	in.samples = in.samples[:n]
+	return in, nil
+}
+
+// Decode decodes the recording with the given options, as DecodeFile
+// does with a file.
+func (in *Input) Decode(opts *Options) (*Result, error) {
+	return in.DecodeContext(context.Background(), opts)
+}
+
+// DecodeContext is like Decode, but it stops early (returning the
+// context's error) if the context is cancelled.
+func (in *Input) DecodeContext(
+	ctx context.Context, opts *Options,
+) (*Result, error) {
+	start := time.Now()
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	src := source{meta: in.Meta, frames: len(in.samples)}
+	if opts.NoClean || opts.Retry || opts.Reclean || in.clean {
+		src.src, src.cleaned = pipeline.NewSliceSource(in.samples), in.clean
+		return decode(ctx, src, opts, start)
+	}
+
+	key := cleanKey{
+		noiseFloor:    opts.NoiseFloor,
+		noiseFloorDB:  opts.NoiseFloorDB,
+		normalize:     opts.Normalize.String(),
+		bitRate:       opts.BitRate,
+		sampleRate:    opts.SampleRate,
+		speed:         opts.Speed,
+		bufferSamples: opts.BufferSamples,
+		start:         opts.Start,
+		end:           opts.End,
+	}
+	if in.cleaned != nil && key == in.cleanKey {
+		src.src, src.cleaned = pipeline.NewSliceSource(in.cleaned), true
+		return decode(ctx, src, opts, start)
+	}
+
+	// Keep the samples as they are cleaned by this decode, for the next.
+	// Any that are not cleaned (outside of the region) are left as 0.
+	if in.cleaned == nil {
+		in.cleaned = make([]int, len(in.samples))
+	} else {
+		for i := range in.cleaned {
+			in.cleaned[i] = 0
+		}
+	}
+	src.src = pipeline.NewSliceSource(in.samples)
+	src.capture = func(start int, samples []int) {
+		copy(in.cleaned[start:], samples)
+	}
+	res, err := decode(ctx, src, opts, start)
+	if err != nil {
+		in.cleaned = nil
+	} else {
+		in.cleanKey = key
+	}
+	return res, err
+}
+
+// Samples returns the samples of the recording, which must not be changed.
+func (in *Input) Samples() []int {
+	return in.samples
+}
+
+// Cleaned returns true if the recording was cleaned by Clean.
+func (in *Input) Cleaned() bool {
+	return in.clean
+}
+
+// Clean returns a copy of the recording with its signal cleaned up by the
+// cleanup filter (filter.DCOffset) that decoding runs, with the
+// normalization, noise floor, bit rate, sample rate and speed of the given
+// options, e.g. to look at or save the cleaned signal. The whole recording
+// is normalized and cleaned, in one piece, and decoding the copy does not
+// clean it again.
+func (in *Input) Clean(opts *Options) (*Input, error) {
+	return in.CleanContext(context.Background(), opts)
+}
+
+// CleanContext is like Clean, but it stops early (returning the context's
+// error) if the context is cancelled.
+func (in *Input) CleanContext(
+	ctx context.Context, opts *Options,
+) (*Input, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if in.clean {
+		return in, nil
+	}
+	peakWidth, err := peakWidthFor(in.Meta.SampleRate, opts)
+	if err != nil {
+		return nil, err
+	}
+	noiseFloor := opts.NoiseFloor
+	if opts.NoiseFloorDB != 0 {
+		bits := in.Meta.BitDepth
+		if err := sample.CheckDB(opts.NoiseFloorDB, bits); err != nil {
+			return nil, err
+		}
+		noiseFloor = sample.FromDB(opts.NoiseFloorDB, bits)
+	}
+	if noiseFloor == 0 {
+		noiseFloor = filter.DefaultNoiseFloor(in.Meta.BitDepth)
+	}
+
+	out := &Input{
+		Meta:    in.Meta,
+		samples: make([]int, len(in.samples)),
+		clean:   true,
+	}
+	samples := in.samples
+	if opts.Normalize != nil {
+		samples = append([]int(nil), samples...)
+		opts.Normalize.Normalize(samples, in.Meta.BitDepth)
+	}
+	f := filter.NewDCOffset(noiseFloor, peakWidth)
+	if err := f.RunContext(ctx, samples, out.samples); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,340 @@
+// Package sbmfm provides a simple way to decode StudyBox tape recordings,
+// without having to set up each stage of the decoding pipeline.
+//
+// For example:
+//
+//	res, err := sbmfm.DecodeFile("tape.wav", nil)
+//	if err != nil {
+//		return err
+//	}
+//	for _, b := range res.Blocks {
+//		if b.Err == nil {
+//			use(b.Data)
+//		}
+//	}
+package sbmfm
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/edorfaus/sb-mfm-decode/events"
+	"github.com/edorfaus/sb-mfm-decode/filter"
+	"github.com/edorfaus/sb-mfm-decode/log"
+	"github.com/edorfaus/sb-mfm-decode/mfm"
+	"github.com/edorfaus/sb-mfm-decode/pipeline"
+	"github.com/edorfaus/sb-mfm-decode/quality"
+	"github.com/edorfaus/sb-mfm-decode/studybox"
+	"github.com/edorfaus/sb-mfm-decode/wav"
+)
+
+// Options holds the options for decoding. The zero value (or a nil
+// pointer) gives the defaults, which should work for most recordings.
+type Options struct {
+	// The noise floor; if 0, it is based on the bit depth of the input.
+	NoiseFloor int
+
+	// The noise floor in dBFS (below 0), which is used instead of
+	// NoiseFloor if it is not 0; it must be at least 1 sample value for
+	// the bit depth of the input (see sample.CheckDB).
+	NoiseFloorDB float64
+
+	// How to normalize the input before decoding it, e.g. so that the
+	// default noise floor suits a capture that was made too quietly; if
+	// nil, it is not normalized. See pipeline.Config.Normalize.
+	Normalize *wav.Normalizer
+
+	// The MFM bit rate; if 0, the StudyBox bit rate is used.
+	BitRate int
+
+	// The sample rate to use instead of the one in the file's header, for
+	// capture tools that write the wrong one; if 0, the header's is used.
+	SampleRate int
+
+	// The speed the tape was played at, relative to its nominal speed
+	// (e.g. 1.02 if it was 2% fast), to correct the sample rate for; if
+	// 0, no correction is made.
+	Speed float64
+
+	// Whether to skip cleaning up the input signal before decoding it.
+	NoClean bool
+
+	// Whether to retry decoding the blocks that fail, with a range of
+	// other settings.
+	Retry bool
+
+	// Whether to clean the blocks that fail again, with settings estimated
+	// from their own lead-in, and decode them again.
+	Reclean bool
+
+	// Whether to also decode the blocks that fail backwards, from their
+	// end, to recover blocks that are damaged near the start.
+	Reverse bool
+
+	// The longest dropout within a block, in bit widths, to bridge with
+	// unknown bits instead of splitting the block there; 0 means never.
+	MaxGap float64
+
+	// The most invalid pulses at the end of a block to trim off as noise
+	// instead of failing the block; 0 means none.
+	MaxNoisePulses int
+
+	// Whether to heal pulses that were split in two by a glitch, instead
+	// of failing the block.
+	HealTiny bool
+
+	// Whether to decode each block as the most likely valid sequence of
+	// pulses, instead of pulse by pulse.
+	MaxLikelihood bool
+
+	// Whether to start each block from the bit width of the last block
+	// that decoded successfully, for blocks whose lead-in was damaged.
+	InheritBitWidth bool
+
+	// How the bytes of each block are interleaved on the tape, for formats
+	// that do that; if nil, they are not.
+	Interleaving studybox.Interleaving
+
+	// The integrity check to run on the bytes of each block, such as a
+	// checksum, for formats that have one; if nil, only the framing of
+	// the bytes is checked.
+	Check studybox.Checker
+
+	// The region of the input to decode, as the sample index to start
+	// at, and the index to stop before (or 0 for the end of the input).
+	Start, End int
+
+	// The maximum number of samples to keep in memory at once; if 0,
+	// the pipeline's default is used.
+	BufferSamples int
+
+	// Where to write log output, and at what level; if nil, nothing is
+	// written (but warnings are still collected in the result).
+	Log      io.Writer
+	LogLevel int
+
+	// What to call as the decode progresses, e.g. to update a UI; may be
+	// nil. The events.Callbacks type is a simple way to make one.
+	Observer events.Observer
+}
+
+// Block is a decoded block of data.
+type Block struct {
+	// The sample indexes of the start and end of the block.
+	Start, End int
+
+	// The decoded bytes of the block, if it could be decoded.
+	Data []byte
+
+	// How sure the decoder was of each of the bytes, from 0 (unknown) to
+	// 255 (certain); nil if that is not known.
+	Confidence []byte
+
+	// The error that occurred while decoding the block, if any.
+	Err error
+}
+
+// Report holds some statistics about a decode.
+type Report struct {
+	// The format of the input; the sample rate is the one that was used,
+	// after any correction.
+	SampleRate, BitDepth int
+
+	// The number of samples in the input (per channel).
+	Samples int
+
+	// The number of blocks, and how many of them failed to decode.
+	Blocks, FailedBlocks int
+
+	// The total number of decoded bytes.
+	Bytes int
+
+	// How long the decode took.
+	Duration time.Duration
+}
+
+// Result is the result of decoding a file.
+type Result struct {
+	// The blocks that were found, including the ones that failed.
+	Blocks []Block
+
+	// Statistics about the decode.
+	Report Report
+
+	// Measurements of the quality of the signal and the decode.
+	Quality quality.Report
+
+	// The warnings that were issued during the decode, by kind.
+	Warnings []log.WarningKind
+}
+
+// DecodeFile decodes the StudyBox data in the given WAVE file.
+//
+// If an error occurs that stops the decode, the error is returned along
+// with a result that holds what was decoded before that (if anything).
+func DecodeFile(path string, opts *Options) (*Result, error) {
+	return DecodeFileContext(context.Background(), path, opts)
+}
+
+// DecodeFileContext is like DecodeFile, but it stops early (returning the
+// context's error) if the context is cancelled.
+func DecodeFileContext(
+	ctx context.Context, path string, opts *Options,
+) (*Result, error) {
+	start := time.Now()
+	r, err := wav.OpenReader(path)
+	if err != nil {
+		res := &Result{}
+		res.Report.Duration = time.Since(start)
+		return res, err
+	}
+	defer r.Close()
+
+	src := source{src: r, meta: r.Meta, frames: r.Frames}
+	return decode(ctx, src, opts, start)
+}
+
+// source is the input of a decode.
+type source struct {
+	src    pipeline.SampleSource
+	meta   wav.Meta
+	frames int
+
+	// Whether the samples have already been cleaned, so that the pipeline
+	// does not need to do it.
+	cleaned bool
+
+	// If set, this is given the samples as they are cleaned.
+	capture func(start int, samples []int)
+}
+
+// decode decodes the samples of the given source. The given start time
+// is when the decode started, for the report.
+func decode(
+	ctx context.Context, src source, opts *Options, start time.Time,
+) (*Result, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	logTo, level := opts.Log, opts.LogLevel
+	if logTo == nil {
+		logTo, level = io.Discard, -1
+	}
+	lg := log.New("sbmfm", level, logTo)
+	lg.SetWarnings(log.NewWarnings())
+
+	res := &Result{}
+	var s *pipeline.Stream
+	defer func() {
+		res.Report.Duration = time.Since(start)
+		res.Warnings = lg.Warnings().Kinds()
+		if s != nil {
+			res.Quality = s.Quality()
+		}
+	}()
+
+	meta := src.meta
+	res.Report.SampleRate = meta.SampleRate
+	res.Report.BitDepth = meta.BitDepth
+	res.Report.Samples = src.frames
+
+	if err := checkRates(meta.SampleRate, opts); err != nil {
+		return res, err
+	}
+
+	noiseFloor := opts.NoiseFloor
+	if noiseFloor == 0 {
+		noiseFloor = -1
+	}
+	// Samples that were already cleaned were normalized before that.
+	normalize := opts.Normalize
+	if src.cleaned {
+		normalize = nil
+	}
+	s = pipeline.NewStream(src.src, meta.SampleRate, meta.BitDepth,
+		pipeline.Config{
+			NoiseFloor:    noiseFloor,
+			NoiseFloorDB:  opts.NoiseFloorDB,
+			BitRate:       opts.BitRate,
+			SampleRate:    opts.SampleRate,
+			Speed:         opts.Speed,
+			NoClean:       opts.NoClean || src.cleaned,
+			Normalize:     normalize,
+			BufferSamples: opts.BufferSamples,
+			Start:         opts.Start,
+			End:           opts.End,
+			Retry:         opts.Retry,
+			Reclean:       opts.Reclean,
+			Reverse:       opts.Reverse,
+
+			MaxGap:          opts.MaxGap,
+			MaxNoisePulses:  opts.MaxNoisePulses,
+			HealTiny:        opts.HealTiny,
+			MaxLikelihood:   opts.MaxLikelihood,
+			InheritBitWidth: opts.InheritBitWidth,
+			Interleaving:    opts.Interleaving,
+			Check:           opts.Check,
+		},
+	)
+	res.Report.SampleRate = s.SampleRate()
+	s.Log = lg
+	s.Cleaned = src.capture
+	if opts.Observer != nil {
+		s.Events = events.Observe(opts.Observer)
+	}
+	defer s.Close()
+
+	for {
+		b, err := s.NextContext(ctx)
+		if err == io.EOF {
+			return res, nil
+		}
+		if err != nil {
+			return res, err
+		}
+
+		res.Blocks = append(res.Blocks, Block{
+			Start: b.Start,
+			End:   b.End,
+			Data:  b.Data,
+			Err:   b.Err,
+
+			Confidence: b.DataConfidence,
+		})
+		res.Report.Blocks++
+		if b.Err != nil {
+			res.Report.FailedBlocks++
+		}
+		res.Report.Bytes += len(b.Data)
+	}
+}
+
+// checkRates returns an error if the input cannot be decoded at the rates
+// given by its header and the options, so that bad headers and options
+// give an error instead of a panic.
+func checkRates(rate int, opts *Options) error {
+	_, err := peakWidthFor(rate, opts)
+	return err
+}
+
+// peakWidthFor returns the peak width that the input is cleaned with, for
+// its sample rate (from its header) and the given options.
+func peakWidthFor(rate int, opts *Options) (int, error) {
+	if opts.SampleRate > 0 {
+		rate = opts.SampleRate
+	}
+	if opts.Speed < 0 {
+		return 0, fmt.Errorf("invalid speed: %v", opts.Speed)
+	}
+	if opts.Speed > 0 {
+		rate = int(float64(rate)/opts.Speed + 0.5)
+	}
+	bitRate := opts.BitRate
+	if bitRate == 0 {
+		bitRate = mfm.DefaultBitRate
+	}
+	return filter.PeakWidthFor(bitRate, rate)
+}
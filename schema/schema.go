@@ -0,0 +1,127 @@
+// Package schema defines the machine-readable (JSON) forms of the
+// statistics that some of the commands output, so that analysis scripts
+// can read them without parsing text tables, whose layout may change.
+//
+// Each form has a Schema name and a Version. The version is increased
+// whenever a field is removed, renamed, or changes meaning; new fields
+// may be added without increasing it, so readers should ignore fields
+// that they do not know.
+package schema
+
+import (
+	"fmt"
+)
+
+// Version is the current version of the schemas in this package.
+const Version = 1
+
+// Header identifies the schema and version of a JSON output.
+type Header struct {
+	Schema  string `json:"schema"`
+	Version int    `json:"version"`
+}
+
+// Check returns an error if the header is not for the given schema, or
+// is for a newer version of it than this package knows.
+func (h Header) Check(schema string) error {
+	if h.Schema != schema {
+		return fmt.Errorf("schema: got %q, expected %q", h.Schema, schema)
+	}
+	if h.Version < 1 || h.Version > Version {
+		return fmt.Errorf(
+			"schema: unsupported %v version %v", schema, h.Version,
+		)
+	}
+	return nil
+}
+
+// The schema names of the outputs.
+const (
+	EdgeStatsSchema   = "zc-edges/stats"
+	PulseStatsSchema  = "pulse-stats"
+	ManifestSchema    = "manifest"
+	CalibrationSchema = "calibration"
+)
+
+// EdgeStats is the JSON form of the edge duration statistics written by
+// zc-edges --stats.
+type EdgeStats struct {
+	Header
+
+	// The groups of edge durations, in order of their Group.
+	Groups []EdgeGroup `json:"groups"`
+
+	// The number of distinct groups that had edges of each type.
+	Distinct EdgeCounts `json:"distinct_widths"`
+}
+
+// NewEdgeStats returns an EdgeStats with its header set.
+func NewEdgeStats() *EdgeStats {
+	return &EdgeStats{Header: Header{EdgeStatsSchema, Version}}
+}
+
+// EdgeGroup is the statistics of the edge durations that are in one
+// group, which is the duration in samples rounded down.
+type EdgeGroup struct {
+	Group int `json:"group"`
+
+	// The number of edges of each type whose previous edge was of that
+	// type, so this is the number of high, low and none pulses.
+	EdgeCounts
+
+	Min      float64 `json:"min"`
+	Max      float64 `json:"max"`
+	Mean     float64 `json:"mean"`
+	StDev    float64 `json:"stdev"`
+	Variance float64 `json:"variance"`
+}
+
+// EdgeCounts is a number of edges (or groups of them) by type.
+type EdgeCounts struct {
+	High  int `json:"high"`
+	Low   int `json:"low"`
+	None  int `json:"none"`
+	Total int `json:"total"`
+}
+
+// PulseStats is the JSON form of the pulse statistics written by
+// pulse-stats.
+type PulseStats struct {
+	Header
+
+	// The statistics of each pair of consecutive pulse classes that was
+	// seen, in order of the second class and then the first.
+	Pairs []PulsePair `json:"pairs"`
+
+	// The widths of all the pulses, and the bit widths they were
+	// classified with.
+	Pulses    Summary `json:"all_pulses"`
+	BitWidths Summary `json:"bit_widths"`
+}
+
+// NewPulseStats returns a PulseStats with its header set.
+func NewPulseStats() *PulseStats {
+	return &PulseStats{Header: Header{PulseStatsSchema, Version}}
+}
+
+// PulsePair is the statistics of the pairs of consecutive pulses of the
+// given classes (as given by mfm.PulseClass.String).
+type PulsePair struct {
+	First  string `json:"first"`
+	Second string `json:"second"`
+	Count  int    `json:"count"`
+
+	// The widths of the first and second pulses, and the difference
+	// between them (second - first).
+	FirstWidth  Summary `json:"first_width"`
+	SecondWidth Summary `json:"second_width"`
+	Difference  Summary `json:"difference"`
+}
+
+// Summary is the count, range and mean of some values.
+type Summary struct {
+	Count int     `json:"count"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Mean  float64 `json:"mean"`
+}
@@ -0,0 +1,550 @@
+// Package service runs the decoder as a service that other programs can
+// drive, such as GUIs and notebooks that are not written in Go, without
+// running the command line tools and parsing their text output.
+//
+// The protocol is JSON over a pair of streams (e.g. the stdin and stdout
+// of cmd/serve.go): each request is a JSON object on a line of its own,
+// and each is answered, in order, by a response on a line of its own:
+//
+//	{"id": 1, "op": "load", "params": {"path": "tape.wav"}}
+//	{"id": 1, "result": {"input": "in1", "sample_rate": 48000, ...}}
+//
+// The id is optional, and is returned as it was given, to match the
+// responses to the requests. If the request fails, the response has an
+// error instead of a result, with a message and the exit code that the
+// command line tools would have exited with for it (see exitcode):
+//
+//	{"id": 2, "error": {"message": "unknown input: in9", "code": 2}}
+//
+// The operations are:
+//
+//   - load: loads the data channel of a WAVE file (path) into memory, as
+//     an input, and returns its ID and format.
+//   - clean: cleans the signal of an input (input, and the options of
+//     decode), as a new input, and returns its ID; with output, it also
+//     writes the cleaned signal to that WAVE file.
+//   - decode: decodes an input (input, or path to decode a file without
+//     loading it) with the given options, keeps the result, and returns
+//     its ID, report and blocks.
+//   - report: returns the report, quality measurements and warnings of a
+//     decode (result).
+//   - close: forgets an input or result (id), to free its memory.
+//   - ops: returns the names of the operations.
+//
+// The parameters are described by the *Params types, and the results by
+// the *Result types.
+package service
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/edorfaus/sb-mfm-decode/exitcode"
+	"github.com/edorfaus/sb-mfm-decode/log"
+	"github.com/edorfaus/sb-mfm-decode/quality"
+	"github.com/edorfaus/sb-mfm-decode/sample"
+	"github.com/edorfaus/sb-mfm-decode/sbmfm"
+	"github.com/edorfaus/sb-mfm-decode/studybox"
+	"github.com/edorfaus/sb-mfm-decode/wav"
+)
+
+// MaxRequestSize is the longest that a request line can be, in bytes.
+const MaxRequestSize = 1 << 20
+
+// Request is a request to the service.
+type Request struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Op     string          `json:"op"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// Response is the response to a request; it has either a result or an
+// error.
+type Response struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Result any             `json:"result,omitempty"`
+	Error  *Error          `json:"error,omitempty"`
+}
+
+// Error is the error of a request that failed.
+type Error struct {
+	Message string `json:"message"`
+	Code    int    `json:"code"`
+}
+
+// Server holds the state of the service: the inputs and results that the
+// requests have made, by their IDs.
+type Server struct {
+	// Where the decodes write their log output, and at what level; if
+	// nil, nothing is written (but warnings are still reported).
+	Log      io.Writer
+	LogLevel int
+
+	inputs  map[string]*sbmfm.Input
+	results map[string]*sbmfm.Result
+	lastID  int
+}
+
+// New returns a new Server, with no inputs or results.
+func New() *Server {
+	return &Server{
+		inputs:  map[string]*sbmfm.Input{},
+		results: map[string]*sbmfm.Result{},
+	}
+}
+
+// ops are the operations of the service, by name.
+var ops = map[string]func(*Server, context.Context, json.RawMessage) (
+	any, error,
+){
+	"load":   (*Server).load,
+	"clean":  (*Server).clean,
+	"decode": (*Server).decode,
+	"report": (*Server).report,
+	"close":  (*Server).close,
+	"ops":    (*Server).listOps,
+}
+
+// Serve reads requests from r and writes their responses to w, one at a
+// time, until r ends (which is not an error) or the context is cancelled.
+// Requests that cannot be parsed are answered with an error.
+func (s *Server) Serve(ctx context.Context, r io.Reader, w io.Writer) error {
+	in := bufio.NewScanner(r)
+	in.Buffer(make([]byte, 0, 64*1024), MaxRequestSize)
+	out := bufio.NewWriter(w)
+	enc := json.NewEncoder(out)
+	for in.Scan() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		line := strings.TrimSpace(in.Text())
+		if line == "" {
+			continue
+		}
+
+		var resp Response
+		var req Request
+		if err := json.Unmarshal([]byte(line), &req); err != nil {
+			resp.Error = &Error{
+				Message: "bad request: " + err.Error(),
+				Code:    exitcode.Usage,
+			}
+		} else {
+			resp = s.Handle(ctx, req)
+		}
+
+		if err := enc.Encode(resp); err != nil {
+			return err
+		}
+		if err := out.Flush(); err != nil {
+			return err
+		}
+	}
+	return in.Err()
+}
+
+// Handle runs a single request, and returns its response.
+func (s *Server) Handle(ctx context.Context, req Request) Response {
+	resp := Response{ID: req.ID}
+	op, ok := ops[req.Op]
+	if !ok {
+		resp.Error = &Error{
+			Message: fmt.Sprintf("unknown op: %q", req.Op),
+			Code:    exitcode.Usage,
+		}
+		return resp
+	}
+	res, err := op(s, ctx, req.Params)
+	if err != nil {
+		resp.Error = &Error{Message: err.Error(), Code: exitcode.Of(err)}
+		return resp
+	}
+	resp.Result = res
+	return resp
+}
+
+// LoadParams are the parameters of the load operation.
+type LoadParams struct {
+	Path string `json:"path"`
+}
+
+// LoadResult is the result of the load and clean operations.
+type LoadResult struct {
+	Input      string `json:"input"`
+	SampleRate int    `json:"sample_rate"`
+	BitDepth   int    `json:"bit_depth"`
+	Samples    int    `json:"samples"`
+	Cleaned    bool   `json:"cleaned"`
+}
+
+func (s *Server) load(_ context.Context, params json.RawMessage) (
+	any, error,
+) {
+	var p LoadParams
+	if err := parseParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.Path == "" {
+		return nil, usageError("no path given")
+	}
+	in, err := sbmfm.Load(p.Path)
+	if err != nil {
+		return nil, err
+	}
+	return s.addInput(in), nil
+}
+
+// Options are the decoding options that the clean and decode operations
+// take, as for sbmfm.Options; the noise floor may be given in dBFS.
+type Options struct {
+	NoiseFloor   int     `json:"noise_floor,omitempty"`
+	NoiseFloorDB float64 `json:"noise_floor_db,omitempty"`
+
+	BitRate    int     `json:"bit_rate,omitempty"`
+	SampleRate int     `json:"sample_rate,omitempty"`
+	Speed      float64 `json:"speed,omitempty"`
+
+	NoClean        bool    `json:"no_clean,omitempty"`
+	Retry          bool    `json:"retry,omitempty"`
+	Reclean        bool    `json:"reclean,omitempty"`
+	Reverse        bool    `json:"reverse,omitempty"`
+	MaxGap         float64 `json:"max_gap,omitempty"`
+	MaxNoisePulses int     `json:"noise_pulses,omitempty"`
+	HealTiny       bool    `json:"heal,omitempty"`
+	MaxLikelihood  bool    `json:"ml,omitempty"`
+	Inherit        bool    `json:"inherit,omitempty"`
+
+	// The block depth the bytes are interleaved with, and the data check
+	// by name, as for the bytes stage of a pipeline spec.
+	Interleave int    `json:"interleave,omitempty"`
+	Check      string `json:"check,omitempty"`
+
+	Start         int `json:"start,omitempty"`
+	End           int `json:"end,omitempty"`
+	BufferSamples int `json:"buffer_samples,omitempty"`
+}
+
+// resolve returns the options as sbmfm.Options, for input of the given
+// bit depth, logging to where the server logs.
+func (o Options) resolve(bits int, s *Server) (*sbmfm.Options, error) {
+	opts := &sbmfm.Options{
+		NoiseFloor:      o.NoiseFloor,
+		BitRate:         o.BitRate,
+		SampleRate:      o.SampleRate,
+		Speed:           o.Speed,
+		NoClean:         o.NoClean,
+		Retry:           o.Retry,
+		Reclean:         o.Reclean,
+		Reverse:         o.Reverse,
+		MaxGap:          o.MaxGap,
+		MaxNoisePulses:  o.MaxNoisePulses,
+		HealTiny:        o.HealTiny,
+		MaxLikelihood:   o.MaxLikelihood,
+		InheritBitWidth: o.Inherit,
+		Start:           o.Start,
+		End:             o.End,
+		BufferSamples:   o.BufferSamples,
+		Log:             s.Log,
+		LogLevel:        s.LogLevel,
+	}
+	if o.NoiseFloorDB != 0 {
+		if o.NoiseFloor != 0 {
+			return nil, usageError(
+				"cannot give both noise_floor and noise_floor_db",
+			)
+		}
+		if err := sample.CheckDB(o.NoiseFloorDB, bits); err != nil {
+			return nil, usageError(err.Error())
+		}
+		opts.NoiseFloor = sample.FromDB(o.NoiseFloorDB, bits)
+	}
+	if o.Check != "" {
+		check, err := studybox.ParseChecker(o.Check)
+		if err != nil {
+			return nil, usageError(err.Error())
+		}
+		opts.Check = check
+	}
+	if o.Interleave > 1 {
+		opts.Interleaving = studybox.BlockInterleave{Depth: o.Interleave}
+	}
+	return opts, nil
+}
+
+// CleanParams are the parameters of the clean operation.
+type CleanParams struct {
+	Options
+
+	Input string `json:"input"`
+
+	// If given, the cleaned signal is also written to this WAVE file.
+	Output string `json:"output,omitempty"`
+}
+
+func (s *Server) clean(ctx context.Context, params json.RawMessage) (
+	any, error,
+) {
+	var p CleanParams
+	if err := parseParams(params, &p); err != nil {
+		return nil, err
+	}
+	in, err := s.input(p.Input)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := p.resolve(in.Meta.BitDepth, s)
+	if err != nil {
+		return nil, err
+	}
+	out, err := in.CleanContext(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	if p.Output != "" {
+		err := wav.SaveMono(
+			p.Output, out.Meta.SampleRate, out.Meta.BitDepth, out.Samples(),
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s.addInput(out), nil
+}
+
+// DecodeParams are the parameters of the decode operation.
+type DecodeParams struct {
+	Options
+
+	// The input to decode, or the path of a WAVE file to decode instead.
+	Input string `json:"input,omitempty"`
+	Path  string `json:"path,omitempty"`
+
+	// Whether to leave the blocks out of the result, e.g. when only the
+	// report is wanted, and whether to include the confidence of their
+	// bytes in it.
+	NoBlocks   bool `json:"no_blocks,omitempty"`
+	Confidence bool `json:"confidence,omitempty"`
+}
+
+// DecodeResult is the result of the decode operation.
+type DecodeResult struct {
+	Result string       `json:"result"`
+	Report ReportResult `json:"report"`
+	Blocks []Block      `json:"blocks,omitempty"`
+
+	// The error that stopped the decode early, if any; the blocks are
+	// then those that were decoded before it.
+	Err string `json:"error,omitempty"`
+}
+
+// Block is a decoded block, as in the result of the decode operation. The
+// data and confidence are in base64, as usual for JSON.
+type Block struct {
+	Start      int    `json:"start"`
+	End        int    `json:"end"`
+	Data       []byte `json:"data"`
+	Confidence []byte `json:"confidence,omitempty"`
+	Err        string `json:"error,omitempty"`
+}
+
+func (s *Server) decode(ctx context.Context, params json.RawMessage) (
+	any, error,
+) {
+	var p DecodeParams
+	if err := parseParams(params, &p); err != nil {
+		return nil, err
+	}
+	if (p.Input == "") == (p.Path == "") {
+		return nil, usageError("give either an input or a path")
+	}
+
+	var res *sbmfm.Result
+	var err error
+	if p.Input != "" {
+		in, e := s.input(p.Input)
+		if e != nil {
+			return nil, e
+		}
+		opts, e := p.resolve(in.Meta.BitDepth, s)
+		if e != nil {
+			return nil, e
+		}
+		res, err = in.DecodeContext(ctx, opts)
+	} else {
+		// The noise floor in dBFS is converted for the bit depth of the
+		// file, which is read from its header first.
+		var bits int
+		if p.NoiseFloorDB != 0 {
+			r, e := wav.OpenReader(p.Path)
+			if e != nil {
+				return nil, e
+			}
+			bits = r.Meta.BitDepth
+			r.Close()
+		}
+		opts, e := p.resolve(bits, s)
+		if e != nil {
+			return nil, e
+		}
+		res, err = sbmfm.DecodeFileContext(ctx, p.Path, opts)
+	}
+	if res == nil || (err != nil && res.Report.Samples == 0) {
+		return nil, err
+	}
+
+	s.lastID++
+	id := fmt.Sprintf("res%d", s.lastID)
+	s.results[id] = res
+
+	out := DecodeResult{Result: id, Report: reportOf(res)}
+	if err != nil {
+		out.Err = err.Error()
+	}
+	if !p.NoBlocks {
+		out.Blocks = make([]Block, len(res.Blocks))
+		for i, b := range res.Blocks {
+			out.Blocks[i] = Block{Start: b.Start, End: b.End, Data: b.Data}
+			if p.Confidence {
+				out.Blocks[i].Confidence = b.Confidence
+			}
+			if b.Err != nil {
+				out.Blocks[i].Err = b.Err.Error()
+			}
+		}
+	}
+	return out, nil
+}
+
+// ResultParams are the parameters of the report operation.
+type ResultParams struct {
+	Result string `json:"result"`
+}
+
+// ReportResult is the result of the report operation.
+type ReportResult struct {
+	SampleRate   int     `json:"sample_rate"`
+	BitDepth     int     `json:"bit_depth"`
+	Samples      int     `json:"samples"`
+	Blocks       int     `json:"blocks"`
+	FailedBlocks int     `json:"failed_blocks"`
+	Bytes        int     `json:"bytes"`
+	Duration     float64 `json:"duration"`
+
+	Quality  quality.Report `json:"quality"`
+	Warnings []Warning      `json:"warnings,omitempty"`
+}
+
+// Warning is a kind of warning from a decode, and how many there were.
+type Warning struct {
+	Kind  string `json:"kind"`
+	Count int    `json:"count"`
+}
+
+func (s *Server) report(_ context.Context, params json.RawMessage) (
+	any, error,
+) {
+	var p ResultParams
+	if err := parseParams(params, &p); err != nil {
+		return nil, err
+	}
+	res, ok := s.results[p.Result]
+	if !ok {
+		return nil, usageError("unknown result: " + p.Result)
+	}
+	return reportOf(res), nil
+}
+
+func reportOf(res *sbmfm.Result) ReportResult {
+	r := res.Report
+	out := ReportResult{
+		SampleRate:   r.SampleRate,
+		BitDepth:     r.BitDepth,
+		Samples:      r.Samples,
+		Blocks:       r.Blocks,
+		FailedBlocks: r.FailedBlocks,
+		Bytes:        r.Bytes,
+		Duration:     r.Duration.Seconds(),
+		Quality:      res.Quality,
+	}
+	for _, w := range res.Warnings {
+		out.Warnings = append(out.Warnings, Warning{w.Kind, w.Count})
+	}
+	return out
+}
+
+// CloseParams are the parameters of the close operation.
+type CloseParams struct {
+	ID string `json:"id"`
+}
+
+func (s *Server) close(_ context.Context, params json.RawMessage) (
+	any, error,
+) {
+	var p CloseParams
+	if err := parseParams(params, &p); err != nil {
+		return nil, err
+	}
+	if _, ok := s.inputs[p.ID]; ok {
+		delete(s.inputs, p.ID)
+	} else if _, ok := s.results[p.ID]; ok {
+		delete(s.results, p.ID)
+	} else {
+		return nil, usageError("unknown id: " + p.ID)
+	}
+	return struct{}{}, nil
+}
+
+// opNames are the names of the ops, for listOps, which cannot use ops
+// itself, as that would make its initialization depend on itself.
+var opNames = []string{"clean", "close", "decode", "load", "ops", "report"}
+
+func (s *Server) listOps(context.Context, json.RawMessage) (any, error) {
+	return opNames, nil
+}
+
+func (s *Server) input(id string) (*sbmfm.Input, error) {
+	if id == "" {
+		return nil, usageError("no input given")
+	}
+	in, ok := s.inputs[id]
+	if !ok {
+		return nil, usageError("unknown input: " + id)
+	}
+	return in, nil
+}
+
+func (s *Server) addInput(in *sbmfm.Input) LoadResult {
+	s.lastID++
+	id := fmt.Sprintf("in%d", s.lastID)
+	s.inputs[id] = in
+	log.F(2, "Service: %v is %v samples\n", id, len(in.Samples()))
+	return LoadResult{
+		Input:      id,
+		SampleRate: in.Meta.SampleRate,
+		BitDepth:   in.Meta.BitDepth,
+		Samples:    len(in.Samples()),
+		Cleaned:    in.Cleaned(),
+	}
+}
+
+// parseParams parses the parameters of a request into p, failing on any
+// that are unknown, so that typos are not silently ignored.
+func parseParams(params json.RawMessage, p any) error {
+	if len(params) == 0 {
+		return nil
+	}
+	dec := json.NewDecoder(strings.NewReader(string(params)))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(p); err != nil {
+		return usageError("bad params: " + err.Error())
+	}
+	return nil
+}
+
+func usageError(msg string) error {
+	return exitcode.New(exitcode.Usage, "%v", msg)
+}
@@ -0,0 +1,35 @@
+package spectrum
+
+// bitRateFrame is the frame size that the bit rate is estimated with,
+// which at 44.1kHz gives bins of about 5 Hz.
+const bitRateFrame = 8192
+
+// bitRateRange is how far from the nominal bit rate the estimate can be,
+// as a fraction of it, and bitRateThreshold is how prominent the line it
+// is found from must be.
+const bitRateRange, bitRateThreshold = 0.25, 20
+
+// BitRate estimates the MFM bit rate of the given samples, which have the
+// given sample rate, searching near the given nominal bit rate; it returns
+// 0 if it cannot be found.
+//
+// In MFM, every transition is at a multiple of half a bit, so the changes
+// of the signal form a pulse train whose spectrum has a line at twice the
+// bit rate, even though the signal itself does not. This finds that line,
+// in the spectrum of the size of the differences between the samples.
+func BitRate(samples []int, sampleRate int, nominal float64) float64 {
+	changes := make([]int, len(samples))
+	for i := 1; i < len(samples); i++ {
+		d := samples[i] - samples[i-1]
+		changes[i] = max(d, -d)
+	}
+
+	p := MeasurePower(changes, sampleRate, bitRateFrame, nil)
+	freq, prominence := p.Line(
+		2*nominal*(1-bitRateRange), 2*nominal*(1+bitRateRange),
+	)
+	if prominence < bitRateThreshold {
+		return 0
+	}
+	return freq / 2
+}
@@ -0,0 +1,59 @@
+package spectrum
+
+// Spectrogram is the power spectrum of a signal over time, as a number of
+// columns that each hold the mean power of the frames in one span of the
+// samples, for showing how it changes over a capture.
+type Spectrogram struct {
+	SampleRate int
+
+	// The size of the frames, which sets the number of frequency bins of
+	// each column (size/2+1, from 0 Hz up to half the sample rate).
+	FrameSize int
+
+	// The number of samples that each column covers.
+	ColumnSamples int
+
+	// The columns, in order of time.
+	Columns []*Power
+}
+
+// NewSpectrogram computes the spectrogram of the given samples, which have
+// the given sample rate, from frames of the given size (as by Frames),
+// with at most the given number of columns. Frames are grouped into
+// columns by where they start.
+func NewSpectrogram(
+	samples []int, sampleRate, size, columns int,
+) *Spectrogram {
+	s := &Spectrogram{
+		SampleRate:    sampleRate,
+		FrameSize:     size,
+		ColumnSamples: max((len(samples)+columns-1)/columns, size/2),
+	}
+	n := (len(samples) + s.ColumnSamples - 1) / s.ColumnSamples
+	for i := 0; i < n; i++ {
+		p := NewPower(size)
+		p.BinWidth = float64(sampleRate) / float64(size)
+		s.Columns = append(s.Columns, p)
+	}
+	Frames(samples, size, func(start int, x []complex128) {
+		i := min(max(start, 0)/s.ColumnSamples, n-1)
+		if i >= 0 {
+			s.Columns[i].Add(x)
+		}
+	})
+	return s
+}
+
+// Total returns the power spectrum of the whole signal, from all of the
+// columns together.
+func (s *Spectrogram) Total() *Power {
+	t := NewPower(s.FrameSize)
+	t.BinWidth = float64(s.SampleRate) / float64(s.FrameSize)
+	for _, c := range s.Columns {
+		for i, v := range c.Sum {
+			t.Sum[i] += v
+		}
+		t.Frames += c.Frames
+	}
+	return t
+}
@@ -0,0 +1,234 @@
+// Package spectrum analyses the frequency content of a signal, by way of
+// the short-time Fourier transform: the signal is split into overlapping
+// frames, which are windowed and transformed separately.
+package spectrum
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"math/cmplx"
+
+	"golang.org/x/exp/slices"
+)
+
+// FFT transforms the given values in place, with the radix-2 fast Fourier
+// transform; their number must be a power of 2. If inverse is true, this
+// does the inverse transform instead, including the division by the size.
+func FFT(x []complex128, inverse bool) {
+	n := len(x)
+	if n&(n-1) != 0 {
+		panic(fmt.Sprintf("FFT size is not a power of 2: %v", n))
+	}
+	if n <= 1 {
+		return
+	}
+
+	// Put the values in bit-reversed order.
+	shift := bits.UintSize - bits.TrailingZeros(uint(n))
+	for i := range x {
+		j := int(bits.Reverse(uint(i)) >> shift)
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+
+	sign := -1.0
+	if inverse {
+		sign = 1
+	}
+	for size := 2; size <= n; size *= 2 {
+		step := cmplx.Rect(1, sign*2*math.Pi/float64(size))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for i := start; i < start+size/2; i++ {
+				a, b := x[i], w*x[i+size/2]
+				x[i], x[i+size/2] = a+b, a-b
+				w *= step
+			}
+		}
+	}
+
+	if inverse {
+		scale := complex(1/float64(n), 0)
+		for i := range x {
+			x[i] *= scale
+		}
+	}
+}
+
+// Window returns a periodic Hann window of the given size, square-rooted,
+// so that using it both before and after the transform makes frames that
+// overlap by half add up to the original signal.
+func Window(size int) []float64 {
+	w := make([]float64, size)
+	for i := range w {
+		w[i] = math.Sqrt(0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(size)))
+	}
+	return w
+}
+
+// Frames calls fn for each frame of the given size of the samples, which
+// overlap by half, with the start of the frame (which is negative for the
+// first one, so that every sample is in two frames) and its spectrum (as
+// by FFT, after applying the Window). The spectrum is reused for the next
+// frame, so fn must copy it to keep it; fn may change it.
+//
+// Samples outside of the input are taken to be 0.
+func Frames(samples []int, size int, fn func(start int, x []complex128)) {
+	w := Window(size)
+	x := make([]complex128, size)
+	for start := -size / 2; start < len(samples); start += size / 2 {
+		for i := range x {
+			v := 0.0
+			if j := start + i; j >= 0 && j < len(samples) {
+				v = float64(samples[j]) * w[i]
+			}
+			x[i] = complex(v, 0)
+		}
+		FFT(x, false)
+		fn(start, x)
+	}
+}
+
+// Power is an estimate of the power spectrum of a signal, as the mean of
+// the power in each frequency bin over a number of frames.
+type Power struct {
+	// The summed power of each bin, from 0 Hz up to half the sample rate.
+	Sum []float64
+
+	// The number of frames that were added.
+	Frames int
+
+	// The width of each bin, in Hz, or 0 if the sample rate is unknown
+	// (which the methods that work in Hz need).
+	BinWidth float64
+}
+
+// NewPower returns an empty Power for frames of the given size.
+func NewPower(size int) *Power {
+	return &Power{Sum: make([]float64, size/2+1)}
+}
+
+// MeasurePower returns the power spectrum of the given samples, which have
+// the given sample rate, from frames of the given size (as by Frames). If
+// include is not nil, only the frames it returns true for are used; it is
+// given the index of the frame, counting from 0.
+func MeasurePower(
+	samples []int, sampleRate, size int, include func(frame int) bool,
+) *Power {
+	p := NewPower(size)
+	p.BinWidth = float64(sampleRate) / float64(size)
+	n := 0
+	Frames(samples, size, func(start int, x []complex128) {
+		if include == nil || include(n) {
+			p.Add(x)
+		}
+		n++
+	})
+	return p
+}
+
+// Add adds the spectrum of a frame (as given by Frames) to the estimate.
+func (p *Power) Add(x []complex128) {
+	for i := range p.Sum {
+		re, im := real(x[i]), imag(x[i])
+		p.Sum[i] += re*re + im*im
+	}
+	p.Frames++
+}
+
+// Mean returns the mean power of the given bin, or 0 if no frames were
+// added.
+func (p *Power) Mean(bin int) float64 {
+	if p.Frames == 0 {
+		return 0
+	}
+	return p.Sum[bin] / float64(p.Frames)
+}
+
+// Freq returns the frequency of the middle of the given bin, in Hz.
+func (p *Power) Freq(bin int) float64 {
+	return float64(bin) * p.BinWidth
+}
+
+// bins returns the range of bins that cover the given frequencies, within
+// the bins that have neighbours on both sides (for refine).
+func (p *Power) bins(from, to float64) (first, last int) {
+	if p.BinWidth <= 0 {
+		return 1, 0
+	}
+	first = max(int(from/p.BinWidth+0.5), 1)
+	last = min(int(to/p.BinWidth+0.5), len(p.Sum)-2)
+	return first, last
+}
+
+// Peak returns the frequency with the most power between the given ones,
+// in Hz, or 0 if there is none (e.g. if no frames were added).
+func (p *Power) Peak(from, to float64) float64 {
+	first, last := p.bins(from, to)
+	best := -1
+	for i := first; i <= last; i++ {
+		if p.Sum[i] > 0 && (best < 0 || p.Sum[i] > p.Sum[best]) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return 0
+	}
+	return p.refine(best)
+}
+
+// lineSpan is how many bins on each side of a line it is compared to, and
+// lineSkip is how many next to it are skipped, since the window spreads
+// the line into them.
+const lineSpan, lineSkip = 16, 2
+
+// Line finds the most prominent narrow line of the spectrum between the
+// given frequencies, such as a hum or a tone, and returns its frequency
+// (in Hz) and how many times more power it has than the median of the
+// frequencies near it (which it has in common with most broad signals).
+// If there is no power there, it returns 0 for both.
+func (p *Power) Line(from, to float64) (freq, prominence float64) {
+	first, last := p.bins(from, to)
+	best := -1
+	near := make([]float64, 0, 2*lineSpan)
+	for i := first; i <= last; i++ {
+		near = near[:0]
+		lo, hi := max(i-lineSpan, 1), min(i+lineSpan, len(p.Sum)-1)
+		for j := lo; j <= hi; j++ {
+			if j < i-lineSkip || j > i+lineSkip {
+				near = append(near, p.Sum[j])
+			}
+		}
+		if len(near) == 0 {
+			continue
+		}
+		slices.Sort(near)
+		median := near[len(near)/2]
+		if median <= 0 {
+			continue
+		}
+		if r := p.Sum[i] / median; r > prominence {
+			best, prominence = i, r
+		}
+	}
+	if best < 0 {
+		return 0, 0
+	}
+	return p.refine(best), prominence
+}
+
+// refine returns the frequency of the peak at the given bin, refined to
+// between the bins by fitting a parabola to it and its neighbours (in dB).
+func (p *Power) refine(bin int) float64 {
+	a, b, c := p.Sum[bin-1], p.Sum[bin], p.Sum[bin+1]
+	offset := 0.0
+	if a > 0 && b > 0 && c > 0 {
+		la, lb, lc := math.Log(a), math.Log(b), math.Log(c)
+		if d := la - 2*lb + lc; d < 0 {
+			offset = 0.5 * (la - lc) / d
+		}
+	}
+	return (float64(bin) + offset) * p.BinWidth
+}
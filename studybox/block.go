@@ -0,0 +1,77 @@
+package studybox
+
+import (
+	"fmt"
+)
+
+// In studybox, after the MFM lead-in (0s then 1), there's a 0-bit
+// before each byte of data. So, more or less, each byte takes 9 bits.
+
+// BitsPerByte is the number of data bits used to store each byte,
+// including the leading 0-bit.
+const BitsPerByte = 9
+
+// SkipLeadIn returns the given MFM bits (both clock and data bits) with
+// the lead-in removed, or an error if no proper lead-in was found.
+func SkipLeadIn(bits []byte) ([]byte, error) {
+	// The lead-in is a data sequence of 0s followed by a single 1.
+	// Adding the clock, each data bit gets expanded into 2 stored bits,
+	// such that the lead-in becomes a sequence of 10 followed by a 01,
+	// like this: 101010...101001.
+
+	i := 0
+	for i+1 < len(bits) && bits[i] == 1 && bits[i+1] == 0 {
+		i += 2
+	}
+
+	if i == 0 {
+		return bits, fmt.Errorf("lead-in: no lead-in found")
+	}
+
+	if i+1 >= len(bits) || bits[i] != 0 || bits[i+1] != 1 {
+		return bits, fmt.Errorf("lead-in: end marker not found")
+	}
+
+	return bits[i+2:], nil
+}
+
+// DataBits returns the data bits of the given MFM bits, which are given
+// as clock and data bit pairs. The result is appended to out.
+func DataBits(out, bits []byte) []byte {
+	for i := 1; i < len(bits); i += 2 {
+		out = append(out, bits[i])
+	}
+	return out
+}
+
+// Bytes assembles the given data bits into bytes, appending them to out.
+//
+// Each byte is expected to be preceded by a 0-bit, and the bits of the
+// byte are taken as most significant bit first. That bit order has not
+// been verified against known-good tape dumps yet, so it is experimental,
+// and may change (along with the bytes of every decoded block).
+//
+// Any trailing bits that are not enough to make a whole byte are
+// ignored, as the end of a block usually has a few bits of noise.
+func Bytes(out, dataBits []byte) ([]byte, error) {
+	for i := 0; i+BitsPerByte <= len(dataBits); i += BitsPerByte {
+		if dataBits[i] != 0 {
+			return out, fmt.Errorf(
+				"framing error: byte %v does not start with a 0-bit",
+				i/BitsPerByte,
+			)
+		}
+		b := byte(0)
+		for _, bit := range dataBits[i+1 : i+BitsPerByte] {
+			b = b<<1 | bit&1
+		}
+		out = append(out, b)
+	}
+	return out, nil
+}
+
+// DecodeBlock decodes the given MFM bits of a block (as produced by the
+// mfm.Decoder) into the bytes of that block.
+func DecodeBlock(bits []byte) ([]byte, error) {
+	return Format{}.DecodeBlock(bits)
+}
@@ -0,0 +1,226 @@
+package studybox
+
+import (
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+// Checker is an integrity check of the bytes of a block, such as a
+// checksum, which a Format runs on the bytes once they have been
+// assembled. This lets formats that have such a check plug it in, while
+// using the same MFM decoding and byte assembly.
+//
+// The checks in this package are generic ones, for other formats and for
+// testing; none of them is the checksum of the StudyBox format (if it has
+// one), which is not known, so its bytes are only checked by their framing
+// (the 0-bit before each byte), which Bytes does.
+type Checker interface {
+	// Check returns an error if the given bytes fail the check. Any
+	// check bytes (e.g. a checksum) are included at the end of them.
+	Check(data []byte) error
+}
+
+// CheckFunc is an adapter that allows using an ordinary function as a
+// Checker.
+type CheckFunc func(data []byte) error
+
+func (f CheckFunc) Check(data []byte) error {
+	return f(data)
+}
+
+// Checks is a Checker that runs several checkers in order, and fails
+// with the error of the first one that fails.
+type Checks []Checker
+
+func (cs Checks) Check(data []byte) error {
+	for _, c := range cs {
+		if err := c.Check(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sealer is a Checker that can also make data pass its check, by setting
+// the check bytes at the end of it, e.g. after the data has been edited.
+type Sealer interface {
+	Checker
+
+	// Seal sets the check bytes at the end of the given data (which must
+	// already have room for them) from the bytes before them.
+	Seal(data []byte) error
+}
+
+// Seal sets the check bytes at the end of the given data for the given
+// checker, which must be a Sealer; if it is nil, nothing is done.
+func Seal(c Checker, data []byte) error {
+	if c == nil {
+		return nil
+	}
+	s, ok := c.(Sealer)
+	if !ok {
+		return fmt.Errorf("cannot seal data for check %T", c)
+	}
+	return s.Seal(data)
+}
+
+// Seal seals the data for each of the checkers in order, and then checks
+// it with all of them. That fails if their check bytes overlap (as those
+// of the checkers in this package do, being at the end of the data), as a
+// later checker then overwrites those of an earlier one.
+func (cs Checks) Seal(data []byte) error {
+	for _, c := range cs {
+		if err := Seal(c, data); err != nil {
+			return err
+		}
+	}
+	if err := cs.Check(data); err != nil {
+		return fmt.Errorf("cannot seal overlapping checks: %w", err)
+	}
+	return nil
+}
+
+// ByteCheck is a generic Checker for a check byte at the end of the data,
+// which is made by folding the bytes before it with the function, from 0.
+type ByteCheck func(sum, b byte) byte
+
+// XORCheck checks that the last byte of the data is the XOR of all the
+// bytes before it.
+var XORCheck = ByteCheck(func(sum, b byte) byte { return sum ^ b })
+
+// SumCheck checks that the last byte of the data is the sum (modulo 256)
+// of all the bytes before it.
+var SumCheck = ByteCheck(func(sum, b byte) byte { return sum + b })
+
+func (f ByteCheck) sum(data []byte) byte {
+	sum := byte(0)
+	for _, b := range data {
+		sum = f(sum, b)
+	}
+	return sum
+}
+
+func (f ByteCheck) Check(data []byte) error {
+	if len(data) < 1 {
+		return fmt.Errorf("check byte: no check byte")
+	}
+	sum := f.sum(data[:len(data)-1])
+	if got := data[len(data)-1]; got != sum {
+		return fmt.Errorf("check byte: got %02x, expected %02x", got, sum)
+	}
+	return nil
+}
+
+func (f ByteCheck) Seal(data []byte) error {
+	if len(data) < 1 {
+		return fmt.Errorf("check byte: no room for the check byte")
+	}
+	data[len(data)-1] = f.sum(data[:len(data)-1])
+	return nil
+}
+
+// Parity is a Checker that checks that the data has an even number of
+// 1-bits in total, which is the case if it ends with a parity byte that
+// makes it so.
+type Parity struct{}
+
+// EvenParity is the Parity check.
+var EvenParity = Parity{}
+
+func (Parity) Check(data []byte) error {
+	n := 0
+	for _, b := range data {
+		n += bits.OnesCount8(b)
+	}
+	if n%2 != 0 {
+		return fmt.Errorf("parity: odd number of 1-bits")
+	}
+	return nil
+}
+
+// Seal sets the parity byte to 0 or 1, whichever makes the number of
+// 1-bits even.
+func (Parity) Seal(data []byte) error {
+	if len(data) < 1 {
+		return fmt.Errorf("parity: no room for the parity byte")
+	}
+	n := 0
+	for _, b := range data[:len(data)-1] {
+		n += bits.OnesCount8(b)
+	}
+	data[len(data)-1] = byte(n % 2)
+	return nil
+}
+
+// CRC16 is a Checker for a 16-bit CRC with the given polynomial and
+// initial value, which is stored in the last two bytes of the data, most
+// significant byte first.
+type CRC16 struct {
+	Poly, Init uint16
+}
+
+// CRC16CCITT is the common CCITT variant of CRC-16 (as used by e.g. the
+// floppy disk formats that use MFM).
+var CRC16CCITT = CRC16{Poly: 0x1021, Init: 0xFFFF}
+
+// Sum returns the CRC of the given bytes.
+func (c CRC16) Sum(data []byte) uint16 {
+	crc := c.Init
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ c.Poly
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func (c CRC16) Check(data []byte) error {
+	if len(data) < 2 {
+		return fmt.Errorf("crc: no CRC bytes")
+	}
+	n := len(data) - 2
+	got := uint16(data[n])<<8 | uint16(data[n+1])
+	if sum := c.Sum(data[:n]); got != sum {
+		return fmt.Errorf("crc: got %04x, expected %04x", got, sum)
+	}
+	return nil
+}
+
+func (c CRC16) Seal(data []byte) error {
+	if len(data) < 2 {
+		return fmt.Errorf("crc: no room for the CRC bytes")
+	}
+	n := len(data) - 2
+	sum := c.Sum(data[:n])
+	data[n], data[n+1] = byte(sum>>8), byte(sum)
+	return nil
+}
+
+// ParseChecker returns the generic Checker with the given name, for use
+// in command-line flags: "none" (or "") for no check, "xor", "sum",
+// "parity", or "crc16".
+//
+// Only one check can be given: each of them keeps its check bytes at the
+// end of the data, so no two of them can pass on the same data (see
+// Checks.Seal).
+func ParseChecker(name string) (Checker, error) {
+	switch strings.TrimSpace(name) {
+	case "", "none":
+		return nil, nil
+	case "xor":
+		return XORCheck, nil
+	case "sum":
+		return SumCheck, nil
+	case "parity":
+		return EvenParity, nil
+	case "crc16":
+		return CRC16CCITT, nil
+	}
+	return nil, fmt.Errorf("unknown check: %q", name)
+}
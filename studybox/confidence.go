@@ -0,0 +1,48 @@
+package studybox
+
+// Confidence returns how sure the decoder was of each of the bytes that
+// DecodeBlock returns for the given MFM bits, and of each of the data bits
+// of those bytes (8 per byte, most significant bit first), given the
+// confidence of each of the MFM bits (as from the mfm.Decoder).
+//
+// The confidence of a byte is the lowest of its data bits, including the
+// 0-bit before it, since any of them being wrong makes the byte wrong.
+//
+// It returns nil if the confidence does not match the bits, or there is
+// no proper lead-in.
+func Confidence(bits, conf []byte) (bytes, dataBits []byte) {
+	return Format{}.Confidence(bits, conf)
+}
+
+// Confidence is like the Confidence function, but for the bytes as given
+// by this format's DecodeBlock, i.e. after deinterleaving them.
+func (f Format) Confidence(bits, conf []byte) (bytes, dataBits []byte) {
+	if len(conf) != len(bits) {
+		return nil, nil
+	}
+	rest, err := SkipLeadIn(bits)
+	if err != nil {
+		return nil, nil
+	}
+	conf = DataBits(nil, conf[len(bits)-len(rest):])
+
+	for i := 0; i+BitsPerByte <= len(conf); i += BitsPerByte {
+		lowest := conf[i]
+		for _, c := range conf[i+1 : i+BitsPerByte] {
+			if c < lowest {
+				lowest = c
+			}
+			dataBits = append(dataBits, c)
+		}
+		bytes = append(bytes, lowest)
+	}
+	if f.Interleaving != nil {
+		order := f.Interleaving.Order(len(bytes))
+		if len(order) != len(bytes) {
+			return nil, nil
+		}
+		bytes = reorder(nil, bytes, order, 1, false)
+		dataBits = reorder(nil, dataBits, order, 8, false)
+	}
+	return bytes, dataBits
+}
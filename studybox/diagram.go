@@ -0,0 +1,186 @@
+package studybox
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Diagram draws the MFM bits of a block as a text timing diagram, for bug
+// reports and for documenting the format. Each line of the diagram is one
+// frame of the block: a part of the lead-in, or a byte with the 0-bit
+// before it. It shows the signal, with a transition for each 1-bit; the
+// clock and data bits, with the boundaries of the bit cells, and a ! after
+// each clock bit that breaks the MFM rule; and what the frame holds.
+//
+// For example, the end of a lead-in of 12 0-bits, and a byte of 0x0f
+// after it (the 0-bit before it and its 8 bits), are drawn like this:
+//
+//	             _______             ___
+//	18  |_______|       |___________|
+//	    | 1   0 | 1   0 | 1   0 | 0   1
+//	     lead-in                 sync
+//
+//	    ________         _______         ___________         _______         ___
+//	26          |_______|       |_______|           |_______|       |_______|
+//	    | 0   0 | 1   0 | 1   0 | 1   0 | 1   0 | 0   1 | 0   1 | 0   1 | 0   1
+//	     byte 0 = 0f
+//
+// The bytes are in the order they are on the tape, before any
+// deinterleaving.
+type Diagram struct {
+	// The range of bytes to draw, by index; if To is 0, up to the end of
+	// the block. The lead-in is only drawn if From is 0.
+	From, To int
+}
+
+// The width of the drawing of a half-bit, and of the position at the
+// start of each line, in characters.
+const diagramHalfBit, diagramMargin = 4, 8
+
+// Write writes the diagram of the given MFM bits (both clock and data
+// bits) to w.
+func (d *Diagram) Write(w io.Writer, bits []byte) error {
+	out := bufio.NewWriter(w)
+	dw := diagramWriter{out: out}
+
+	// The lead-in, and the sync bit after it, as found by SkipLeadIn.
+	rest, err := SkipLeadIn(bits)
+	if err != nil {
+		rest = bits
+	}
+	leadIn := (len(bits) - len(rest)) / 2
+	for from := 0; from < leadIn; from += BitsPerByte {
+		to := min(from+BitsPerByte, leadIn)
+		if d.From == 0 {
+			dw.line(bits, from, to, "lead-in", leadIn-1)
+		} else {
+			dw.skip(bits, from, to)
+		}
+	}
+
+	n := len(bits) / 2
+	for i, from := 0, leadIn; from < n; i, from = i+1, from+BitsPerByte {
+		if d.To > 0 && i >= d.To {
+			break
+		}
+		to := min(from+BitsPerByte, n)
+		if i < d.From {
+			dw.skip(bits, from, to)
+			continue
+		}
+		dw.line(bits, from, to, frameLabel(bits, i, from, to), -1)
+	}
+	return out.Flush()
+}
+
+// frameLabel returns the label of the given byte, whose frame is the given
+// data bits.
+func frameLabel(bits []byte, i, from, to int) string {
+	if to-from < BitsPerByte {
+		return fmt.Sprintf("%v bits left over", to-from)
+	}
+	if bits[2*from+1] != 0 {
+		return fmt.Sprintf("byte %v: framing error", i)
+	}
+	v := 0
+	for j := from + 1; j < to; j++ {
+		v = v<<1 | int(bits[2*j+1])
+	}
+	return fmt.Sprintf("byte %v = %02x", i, v)
+}
+
+// diagramWriter draws the lines of a Diagram, keeping track of the level
+// of the signal between them.
+type diagramWriter struct {
+	out  *bufio.Writer
+	high bool
+}
+
+// skip moves past the given data bits without drawing them.
+func (dw *diagramWriter) skip(bits []byte, from, to int) {
+	for i := 2 * from; i < 2*to; i++ {
+		if bits[i] != 0 {
+			dw.high = !dw.high
+		}
+	}
+}
+
+// line draws the given data bits as one line of the diagram, with the
+// given label; if sync is within them, that data bit is labeled as the
+// sync bit that ends the lead-in.
+func (dw *diagramWriter) line(
+	bits []byte, from, to int, label string, sync int,
+) {
+	var top, signal, cells, labels strings.Builder
+	margin := strings.Repeat(" ", diagramMargin)
+	top.WriteString(margin)
+	fmt.Fprintf(&signal, "%6d  ", 2*from)
+	cells.WriteString(margin)
+	labels.WriteString(margin)
+
+	for j := from; j < to; j++ {
+		for h := 0; h < 2; h++ {
+			bit := bits[2*j+h]
+			if bit != 0 {
+				dw.high = !dw.high
+				top.WriteByte(' ')
+				signal.WriteByte('|')
+			} else {
+				dw.level(&top, &signal, 1)
+			}
+			dw.level(&top, &signal, diagramHalfBit-1)
+
+			mark := byte(' ')
+			if h == 0 && bit != clockBit(bits, j) {
+				mark = '!'
+			}
+			sep := " "
+			if h == 0 {
+				sep = "|"
+			}
+			fmt.Fprintf(&cells, "%s %d%c", sep, bit, mark)
+		}
+	}
+	labels.WriteString(" " + label)
+	if sync >= from && sync < to {
+		col := diagramMargin + (sync-from)*2*diagramHalfBit + 1
+		labels.WriteString(strings.Repeat(" ", max(col-labels.Len(), 1)))
+		labels.WriteString("sync")
+	}
+
+	rows := []*strings.Builder{&top, &signal, &cells, &labels}
+	for _, row := range rows {
+		dw.out.WriteString(strings.TrimRight(row.String(), " "))
+		dw.out.WriteByte('\n')
+	}
+	dw.out.WriteByte('\n')
+}
+
+// level draws the given number of columns of the current level.
+func (dw *diagramWriter) level(top, signal *strings.Builder, n int) {
+	for i := 0; i < n; i++ {
+		if dw.high {
+			top.WriteByte('_')
+			signal.WriteByte(' ')
+		} else {
+			top.WriteByte(' ')
+			signal.WriteByte('_')
+		}
+	}
+}
+
+// clockBit returns what the clock bit of the given data bit should be, by
+// the MFM rule: 1 only between two 0 data bits. The data bit before the
+// first one is taken to be 0.
+func clockBit(bits []byte, j int) byte {
+	prev := byte(0)
+	if j > 0 {
+		prev = bits[2*j-1]
+	}
+	if prev == 0 && bits[2*j+1] == 0 {
+		return 1
+	}
+	return 0
+}
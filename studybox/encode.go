@@ -0,0 +1,38 @@
+package studybox
+
+// EncodeBlock encodes the given bytes into the MFM bits of a block (both
+// clock and data bits), with a lead-in of the given number of 0-bits.
+// This is the reverse of DecodeBlock, and is mainly useful for testing.
+func EncodeBlock(data []byte, leadIn int) []byte {
+	dataBits := make([]byte, 0, leadIn+1+len(data)*BitsPerByte)
+	for i := 0; i < leadIn; i++ {
+		dataBits = append(dataBits, 0)
+	}
+	dataBits = append(dataBits, 1)
+	for _, b := range data {
+		dataBits = append(dataBits, 0)
+		for i := 7; i >= 0; i-- {
+			dataBits = append(dataBits, b>>i&1)
+		}
+	}
+	return MFMBits(make([]byte, 0, len(dataBits)*2), dataBits)
+}
+
+// MFMBits returns the MFM bits (clock and data bit pairs) for the given
+// data bits, appended to out. This is the reverse of DataBits.
+//
+// In MFM, the clock bit is only set between two 0 data bits; the data
+// bit before the first one is taken to be 0.
+func MFMBits(out, dataBits []byte) []byte {
+	prev := byte(0)
+	for _, bit := range dataBits {
+		bit &= 1
+		clock := byte(0)
+		if prev == 0 && bit == 0 {
+			clock = 1
+		}
+		out = append(out, clock, bit)
+		prev = bit
+	}
+	return out
+}
@@ -0,0 +1,152 @@
+package studybox
+
+import (
+	"fmt"
+)
+
+// Format is how the bytes of a block are handled once they have been
+// assembled from the data bits: how they are reordered, and how their
+// integrity is checked. The zero value is the plain StudyBox format, as
+// far as it is known: the bytes are in order, and only their framing is
+// checked.
+type Format struct {
+	// The interleaving of the bytes on the tape, which is undone before
+	// they are checked; if nil, they are not interleaved.
+	Interleaving Interleaving
+
+	// The integrity check to run on the (deinterleaved) bytes; if nil,
+	// only the framing of the bytes is checked.
+	Check Checker
+}
+
+// DecodeBlock decodes the given MFM bits of a block (as produced by the
+// mfm.Decoder) into the bytes of that block, in their original order,
+// and checks them. The bytes are returned even if they fail the check,
+// which is then reported as a *CheckError.
+func (f Format) DecodeBlock(bits []byte) ([]byte, error) {
+	bits, err := SkipLeadIn(bits)
+	if err != nil {
+		return nil, err
+	}
+	dataBits := DataBits(make([]byte, 0, len(bits)/2), bits)
+	data, err := Bytes(make([]byte, 0, len(dataBits)/BitsPerByte), dataBits)
+	if err != nil {
+		return data, err
+	}
+	if f.Interleaving != nil {
+		data, err = Deinterleave(f.Interleaving, nil, data)
+		if err != nil {
+			return data, err
+		}
+	}
+	if f.Check != nil {
+		if err := f.Check.Check(data); err != nil {
+			return data, &CheckError{Err: err}
+		}
+	}
+	return data, nil
+}
+
+// Interleaving is an order that the bytes of a block are stored on the
+// tape in, other than their original order, e.g. to spread a burst of
+// errors on the tape over several parts of the data.
+type Interleaving interface {
+	// Order returns, for a block of n bytes, the index in the original
+	// data of each byte in the order that they are on the tape. It must
+	// return each index from 0 to n-1 exactly once.
+	Order(n int) []int
+}
+
+// Deinterleave puts the given bytes, as they were on the tape, back into
+// their original order, and appends them to out.
+func Deinterleave(il Interleaving, out, data []byte) ([]byte, error) {
+	order := il.Order(len(data))
+	if len(order) != len(data) {
+		return out, fmt.Errorf(
+			"deinterleave: order of %v bytes for %v", len(order), len(data),
+		)
+	}
+	return reorder(out, data, order, 1, false), nil
+}
+
+// Interleave puts the given bytes into the order that they are stored in
+// on the tape, and appends them to out. This is the reverse of
+// Deinterleave, and is mainly useful for testing.
+func Interleave(il Interleaving, out, data []byte) ([]byte, error) {
+	order := il.Order(len(data))
+	if len(order) != len(data) {
+		return out, fmt.Errorf(
+			"interleave: order of %v bytes for %v", len(order), len(data),
+		)
+	}
+	return reorder(out, data, order, 1, true), nil
+}
+
+// reorder appends the given units (of the given size) to out, either
+// moved from their tape order into the original order, or the reverse.
+// The order must have one entry per unit.
+func reorder(out, data []byte, order []int, size int, toTape bool) []byte {
+	start := len(out)
+	out = append(out, data...)
+	res := out[start:]
+	for k, i := range order {
+		from, to := k, i
+		if toTape {
+			from, to = i, k
+		}
+		copy(res[to*size:(to+1)*size], data[from*size:(from+1)*size])
+	}
+	return out
+}
+
+// BlockInterleave is the common block interleaving, where the data is
+// split into Depth parts of (nearly) equal length, and the tape then
+// holds the first byte of each part, then the second byte of each, and
+// so on. If a part is shorter than the others, it is skipped once it has
+// run out. A Depth of 0 or 1 means no interleaving.
+type BlockInterleave struct {
+	Depth int
+}
+
+func (b BlockInterleave) Order(n int) []int {
+	depth := b.Depth
+	if depth < 1 {
+		depth = 1
+	}
+	if depth > n {
+		depth = n
+	}
+	order := make([]int, 0, n)
+	if n == 0 {
+		return order
+	}
+
+	// The first n%depth parts get one more byte than the others.
+	short, extra := n/depth, n%depth
+	for col := 0; col <= short; col++ {
+		for part := 0; part < depth; part++ {
+			size, start := short, part*short+min(part, extra)
+			if part < extra {
+				size++
+			}
+			if col < size {
+				order = append(order, start+col)
+			}
+		}
+	}
+	return order
+}
+
+// CheckError is the error of a block whose bytes were decoded, but failed
+// the integrity check of its Format.
+type CheckError struct {
+	Err error
+}
+
+func (e *CheckError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *CheckError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,28 @@
+package studybox
+
+import (
+	"crypto/sha256"
+	"fmt"
+)
+
+// BlockID returns the identifier of the block (or page) that starts at
+// the given sample index, and has the given content: its data bytes if
+// it was decoded, or else its MFM bits. The ID is the start followed by
+// the first bytes of a hash of the content, e.g. "123456-9c3e21d0", so
+// that it is the same for the same block whichever tool found it, and is
+// still easy to find in the input.
+//
+// The end of the block is left out, as it is where the decoder lost the
+// signal, which is not kept where only the data of a page is (as in a
+// tape image), and is the part of the block most likely to vary.
+func BlockID(start int, content []byte) string {
+	sum := sha256.Sum256(content)
+	return fmt.Sprintf("%v-%x", start, sum[:4])
+}
+
+// ID returns the identifier of the page, as by BlockID from the start of
+// its lead-in and its data; this is the same as that of the block it was
+// decoded from, if its lead-in is known.
+func (p *TapePage) ID() string {
+	return BlockID(p.LeadIn, p.Data)
+}
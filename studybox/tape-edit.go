@@ -0,0 +1,139 @@
+package studybox
+
+import (
+	"fmt"
+)
+
+// These methods edit the pages of a Tape, e.g. to patch the few bad bytes
+// of a page that was recovered from a damaged tape, or to make a tape for
+// testing. Those that change the data of a page take the Checker that the
+// pages are checked with (or nil if none), and seal the data for it, so
+// that the check bytes match the new data; see Seal.
+//
+// The audio of the tape is not changed, so it no longer matches the data
+// that was edited; cmd/convert.go can render new audio for the pages.
+
+// page returns the page with the given index, or an error if there is
+// none.
+func (t *Tape) page(i int) (*TapePage, error) {
+	if i < 0 || i >= len(t.Pages) {
+		return nil, fmt.Errorf(
+			"no page %v, the tape has %v", i, len(t.Pages),
+		)
+	}
+	return &t.Pages[i], nil
+}
+
+// SetPageData replaces the data of the given page with the given bytes
+// (which should have room for the check bytes), sealed for the check.
+func (t *Tape) SetPageData(i int, data []byte, check Checker) error {
+	p, err := t.page(i)
+	if err != nil {
+		return err
+	}
+	data = append([]byte(nil), data...)
+	if err := Seal(check, data); err != nil {
+		return fmt.Errorf("page %v: %w", i, err)
+	}
+	p.Data = data
+	return nil
+}
+
+// PatchPage overwrites the data of the given page with the given bytes,
+// from the given offset, and seals it again for the check. The patch must
+// be within the data.
+func (t *Tape) PatchPage(i, offset int, patch []byte, check Checker) error {
+	p, err := t.page(i)
+	if err != nil {
+		return err
+	}
+	if offset < 0 || offset+len(patch) > len(p.Data) {
+		return fmt.Errorf(
+			"page %v: patch of %v bytes at %v is outside its %v bytes",
+			i, len(patch), offset, len(p.Data),
+		)
+	}
+	data := append([]byte(nil), p.Data...)
+	copy(data[offset:], patch)
+	return t.SetPageData(i, data, check)
+}
+
+// InsertPage inserts the given page before the page with the given index,
+// or at the end if that is the number of pages, with its data sealed for
+// the check. Its positions should fit between those of the pages around
+// it; see Validate.
+func (t *Tape) InsertPage(i int, p TapePage, check Checker) error {
+	if i < 0 || i > len(t.Pages) {
+		return fmt.Errorf(
+			"cannot insert page at %v, the tape has %v", i, len(t.Pages),
+		)
+	}
+	p.Data = append([]byte(nil), p.Data...)
+	if err := Seal(check, p.Data); err != nil {
+		return fmt.Errorf("page %v: %w", i, err)
+	}
+	t.Pages = append(t.Pages, TapePage{})
+	copy(t.Pages[i+1:], t.Pages[i:])
+	t.Pages[i] = p
+	return nil
+}
+
+// End returns the sample index of the end of the data of the last page,
+// as estimated from the given bit rate and sample rate, or 0 if the tape
+// has no pages; e.g. for placing a page after it.
+func (t *Tape) End(bitRate, sampleRate int) int {
+	if len(t.Pages) == 0 {
+		return 0
+	}
+	p := t.Pages[len(t.Pages)-1]
+	bits := len(p.Data) * BitsPerByte
+	return p.Start + int(int64(bits)*int64(sampleRate)/int64(bitRate))
+}
+
+// RemovePage removes the page with the given index.
+func (t *Tape) RemovePage(i int) error {
+	if _, err := t.page(i); err != nil {
+		return err
+	}
+	t.Pages = append(t.Pages[:i], t.Pages[i+1:]...)
+	return nil
+}
+
+// Reseal seals the data of every page for the check again, e.g. after
+// editing them directly, or to move a tape to a format with a check.
+func (t *Tape) Reseal(check Checker) error {
+	for i := range t.Pages {
+		if err := Seal(check, t.Pages[i].Data); err != nil {
+			return fmt.Errorf("page %v: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Validate returns an error if the positions of the pages are not valid:
+// each page must start its data after its lead-in, and after the data of
+// the page before it has started. Pages whose positions are both 0 are
+// taken to have unknown positions, and are not checked.
+func (t *Tape) Validate() error {
+	prev := -1
+	for i, p := range t.Pages {
+		if p.LeadIn == 0 && p.Start == 0 {
+			continue
+		}
+		if p.LeadIn < 0 || p.Start < p.LeadIn {
+			return fmt.Errorf(
+				"page %v: bad positions: lead-in at %v, start at %v",
+				i, p.LeadIn, p.Start,
+			)
+		}
+		if prev >= 0 && p.LeadIn <= t.Pages[prev].Start {
+			return fmt.Errorf(
+				"page %v: lead-in at %v is not after the start of page"+
+					" %v at %v",
+				i, p.LeadIn, prev, t.Pages[prev].Start,
+			)
+		}
+		prev = i
+	}
+	return nil
+}
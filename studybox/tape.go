@@ -0,0 +1,204 @@
+package studybox
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Tape is a StudyBox tape image, as in the .studybox files used by
+// emulators: the data of each page of the tape, along with the audio of
+// the tape (so that it can be played back while the pages are loaded).
+//
+// The file is a sequence of chunks, each with a 4-byte ID and a 32-bit
+// length, followed by that many bytes. It starts with an "STBX" chunk with
+// the version, followed by a "PAGE" chunk for each page, and an "AUDI"
+// chunk with the audio. All numbers are little-endian.
+//
+// When written, it also has a "PGID" chunk after the pages, with the ID of
+// each page (see TapePage.ID) on a line of its own, for cross-referencing
+// them with the outputs of other tools; as the IDs follow from the pages,
+// this chunk is skipped when reading, as other readers would skip it.
+type Tape struct {
+	Pages []TapePage
+
+	// The audio of the tape, as a complete file of the given type; nil if
+	// the tape image has no audio.
+	AudioType AudioType
+	Audio     []byte
+}
+
+// TapePage is a page of a Tape.
+type TapePage struct {
+	// The sample indexes (in the audio) of the start of the lead-in of the
+	// page, and of the start of its data, after the lead-in.
+	LeadIn int
+	Start  int
+
+	// The data bytes of the page.
+	Data []byte
+}
+
+// AudioType is the type of the audio of a Tape.
+type AudioType uint32
+
+// The known audio types.
+const (
+	AudioWAV  AudioType = 0
+	AudioFLAC AudioType = 1
+)
+
+func (t AudioType) String() string {
+	switch t {
+	case AudioWAV:
+		return "WAV"
+	case AudioFLAC:
+		return "FLAC"
+	}
+	return fmt.Sprintf("AudioType(%v)", uint32(t))
+}
+
+// TapeVersion is the version of the tape image format that is written.
+const TapeVersion = 0x100
+
+// ReadTape reads a tape image. Chunks of unknown types are skipped.
+//
+// The data of a chunk is read as it comes, rather than allocated up front
+// from the length in its header, so that a corrupt length makes this fail
+// at the end of the input instead of allocating up to 4 GiB for it.
+func ReadTape(r io.Reader) (*Tape, error) {
+	t := &Tape{}
+	for i := 0; ; i++ {
+		var hdr [8]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			if err == io.EOF && i > 0 {
+				return t, nil
+			}
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, fmt.Errorf("tape image: chunk %v: %w", i, err)
+		}
+		id := string(hdr[:4])
+		if i == 0 && id != "STBX" {
+			return nil, fmt.Errorf("tape image: not a .studybox file")
+		}
+		data, err := readChunk(r, id, binary.LittleEndian.Uint32(hdr[4:]))
+		if err != nil {
+			return nil, fmt.Errorf("tape image: %v chunk: %w", id, err)
+		}
+		if err := t.addChunk(id, data); err != nil {
+			return nil, fmt.Errorf("tape image: %v chunk: %w", id, err)
+		}
+	}
+}
+
+// readChunk reads the data of a chunk of the given type and length,
+// growing the buffer as the data comes in; chunks of unknown types are
+// skipped, returning nil.
+func readChunk(r io.Reader, id string, n uint32) ([]byte, error) {
+	var (
+		buf bytes.Buffer
+		got int64
+		err error
+	)
+	switch id {
+	case "STBX", "PAGE", "AUDI":
+		got, err = buf.ReadFrom(io.LimitReader(r, int64(n)))
+	default:
+		got, err = io.CopyN(io.Discard, r, int64(n))
+	}
+	if err == nil && got < int64(n) || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (t *Tape) addChunk(id string, data []byte) error {
+	le := binary.LittleEndian
+	switch id {
+	case "STBX":
+		if len(data) < 4 {
+			return fmt.Errorf("too short")
+		}
+		if v := le.Uint32(data); v != TapeVersion {
+			return fmt.Errorf("unsupported version: %#x", v)
+		}
+	case "PAGE":
+		if len(data) < 8 {
+			return fmt.Errorf("too short")
+		}
+		t.Pages = append(t.Pages, TapePage{
+			LeadIn: int(le.Uint32(data)),
+			Start:  int(le.Uint32(data[4:])),
+			Data:   data[8:],
+		})
+	case "AUDI":
+		if len(data) < 4 {
+			return fmt.Errorf("too short")
+		}
+		t.AudioType, t.Audio = AudioType(le.Uint32(data)), data[4:]
+	}
+	return nil
+}
+
+// LoadTape reads the tape image in the given file, as by ReadTape.
+func LoadTape(filename string) (*Tape, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadTape(f)
+}
+
+// Write writes the tape image.
+func (t *Tape) Write(w io.Writer) error {
+	buf := bufio.NewWriter(w)
+	le := binary.LittleEndian
+	chunk := func(id string, fields []uint32, data []byte) {
+		buf.WriteString(id)
+		n := 4*len(fields) + len(data)
+		buf.Write(le.AppendUint32(nil, uint32(n)))
+		for _, f := range fields {
+			buf.Write(le.AppendUint32(nil, f))
+		}
+		buf.Write(data)
+	}
+
+	chunk("STBX", []uint32{TapeVersion}, nil)
+	var ids []byte
+	for i := range t.Pages {
+		p := &t.Pages[i]
+		chunk("PAGE", []uint32{uint32(p.LeadIn), uint32(p.Start)}, p.Data)
+		ids = append(append(ids, p.ID()...), '\n')
+	}
+	if len(t.Pages) > 0 {
+		chunk("PGID", nil, ids)
+	}
+	if t.Audio != nil {
+		chunk("AUDI", []uint32{uint32(t.AudioType)}, t.Audio)
+	}
+
+	return buf.Flush()
+}
+
+// Save writes the tape image to the given file.
+func (t *Tape) Save(filename string) (retErr error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := f.Close(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+	return t.Write(f)
+}
@@ -0,0 +1,203 @@
+package synth
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+)
+
+// DefectKind is the kind of a defect added by an Injector.
+type DefectKind uint8
+
+const (
+	// DefectFlip is a pulse with its polarity flipped, which merges it
+	// with the pulses on either side of it.
+	DefectFlip DefectKind = iota
+	// DefectGlitch is a short pulse of the opposite polarity, inserted
+	// in the middle of another pulse.
+	DefectGlitch
+	// DefectClip is a part of the signal that is clipped.
+	DefectClip
+	// DefectDrop is a part of the signal that is lost.
+	DefectDrop
+)
+
+func (k DefectKind) String() string {
+	switch k {
+	case DefectFlip:
+		return "flip"
+	case DefectGlitch:
+		return "glitch"
+	case DefectClip:
+		return "clip"
+	case DefectDrop:
+		return "drop"
+	default:
+		return fmt.Sprintf("[bad DefectKind=%d]", int(k))
+	}
+}
+
+// Defect is a defect that was added to the signal by an Injector.
+type Defect struct {
+	Kind DefectKind
+
+	// The part of the signal (in samples) that the defect is in.
+	Start, End float64
+}
+
+// Injector adds defects to the signal of a Synth, either at the given
+// positions, or at random positions within the blocks. The random
+// positions are taken from a seeded source, so that they are the same
+// every time, as long as the seed and the signal are the same.
+//
+// The defects should be added after all the blocks have been added to
+// the Synth, and before it is rendered.
+type Injector struct {
+	Synth *Synth
+
+	// The defects that have been added so far, in the order they were
+	// added.
+	Defects []Defect
+
+	rng *rand.Rand
+}
+
+// NewInjector creates an Injector for the given Synth, which uses the
+// given seed for choosing random positions.
+func NewInjector(s *Synth, seed int64) *Injector {
+	return &Injector{
+		Synth: s,
+		rng:   rand.New(rand.NewSource(seed)),
+	}
+}
+
+// FlipPulse flips the polarity of the pulse that starts at the given
+// transition (by index into the transitions). It panics if there is no
+// such pulse, or if it is not a pulse (e.g. it is between blocks).
+func (in *Injector) FlipPulse(i int) {
+	tr := in.Synth.Transitions
+	if i < 0 || i+1 >= len(tr) || tr[i].Level == 0 {
+		panic(fmt.Errorf("no pulse at transition %v", i))
+	}
+	tr[i].Level = -tr[i].Level
+	in.add(DefectFlip, tr[i].At, tr[i+1].At)
+}
+
+// Glitch inserts a pulse of the given width (in samples) at the given
+// position, with the opposite polarity of the signal at that position.
+// If there is no signal there, the glitch is a high pulse.
+func (in *Injector) Glitch(at, width float64) {
+	s := in.Synth
+	i := sort.Search(len(s.Transitions), func(i int) bool {
+		return s.Transitions[i].At > at
+	})
+	level := 0.0
+	if i > 0 {
+		level = s.Transitions[i-1].Level
+	}
+	glitch := -level
+	if glitch == 0 {
+		glitch = 1
+	}
+
+	s.Transitions = append(s.Transitions, Transition{}, Transition{})
+	copy(s.Transitions[i+2:], s.Transitions[i:])
+	s.Transitions[i] = Transition{at, glitch}
+	s.Transitions[i+1] = Transition{at + width, level}
+	in.add(DefectGlitch, at, at+width)
+}
+
+// Clip clips the signal in the given part of it (in samples) at the given
+// limit, relative to the amplitude.
+func (in *Injector) Clip(start, length int, limit float64) {
+	in.Synth.Clips = append(in.Synth.Clips, Clip{start, length, limit})
+	in.add(DefectClip, float64(start), float64(start+length))
+}
+
+// Drop removes the signal in the given part of it (in samples), leaving
+// only the noise and DC offset.
+func (in *Injector) Drop(start, length int) {
+	in.Synth.Dropouts = append(in.Synth.Dropouts, Dropout{start, length, 0})
+	in.add(DefectDrop, float64(start), float64(start+length))
+}
+
+// RandomFlips flips the polarity of n pulses, chosen at random.
+func (in *Injector) RandomFlips(n int) {
+	for ; n > 0; n-- {
+		in.FlipPulse(in.randomPulse())
+	}
+}
+
+// RandomGlitches inserts n glitches of the given width, at random
+// positions within the blocks.
+func (in *Injector) RandomGlitches(n int, width float64) {
+	for ; n > 0; n-- {
+		in.Glitch(in.randomPos(0), width)
+	}
+}
+
+// RandomClips clips n parts of the given length, at random positions
+// within the blocks, at the given limit.
+func (in *Injector) RandomClips(n, length int, limit float64) {
+	for ; n > 0; n-- {
+		in.Clip(int(in.randomPos(length)), length, limit)
+	}
+}
+
+// RandomDrops drops n parts of the given length, at random positions
+// within the blocks.
+func (in *Injector) RandomDrops(n, length int) {
+	for ; n > 0; n-- {
+		in.Drop(int(in.randomPos(length)), length)
+	}
+}
+
+func (in *Injector) add(kind DefectKind, start, end float64) {
+	in.Defects = append(in.Defects, Defect{kind, start, end})
+}
+
+// randomPulse returns the index of a random transition that starts a
+// pulse. It panics if there are no pulses.
+func (in *Injector) randomPulse() int {
+	tr := in.Synth.Transitions
+	var pulses []int
+	for i := 0; i+1 < len(tr); i++ {
+		if tr[i].Level != 0 && tr[i+1].Level != 0 {
+			pulses = append(pulses, i)
+		}
+	}
+	if len(pulses) == 0 {
+		panic("no pulses to choose from")
+	}
+	return pulses[in.rng.Intn(len(pulses))]
+}
+
+// randomPos returns a random position within the blocks, where there is
+// room for the given length before the end of the block (if possible).
+// It panics if there are no blocks.
+func (in *Injector) randomPos(length int) float64 {
+	blocks := in.Synth.Blocks
+	if len(blocks) == 0 {
+		panic("no blocks to choose from")
+	}
+
+	// Choose the block by its length, so every position is equally
+	// likely to be chosen.
+	total := 0.0
+	for _, b := range blocks {
+		total += b.End - b.Start
+	}
+	pos := in.rng.Float64() * total
+	for _, b := range blocks {
+		size := b.End - b.Start
+		if pos >= size {
+			pos -= size
+			continue
+		}
+		if room := size - float64(length); room > 0 {
+			return b.Start + pos*room/size
+		}
+		return b.Start
+	}
+	return blocks[len(blocks)-1].Start
+}
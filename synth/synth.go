@@ -0,0 +1,318 @@
+// Package synth renders MFM bits into samples, like those that a tape
+// deck would produce, with configurable imperfections. This is meant for
+// testing and simulation, to have inputs where the right answer is known.
+package synth
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+
+	"github.com/edorfaus/sb-mfm-decode/mfm"
+	"github.com/edorfaus/sb-mfm-decode/studybox"
+)
+
+// Signal holds the settings for how the signal is rendered. The zero
+// value of each of the imperfections means that it is not used.
+type Signal struct {
+	// The sample rate; if 0, 44100 is used.
+	SampleRate int
+
+	// The bit depth of the samples, which they are clamped to; if 0, 16
+	// is used.
+	BitDepth int
+
+	// The MFM bit rate; if 0, mfm.DefaultBitRate is used.
+	BitRate int
+
+	// The level of the signal when it is high (or low, when negated);
+	// if 0, it is 3/8 of the max sample value.
+	Amplitude int
+
+	// The time (in samples) that it takes the signal to go from one
+	// level to another; if 0, it changes instantly.
+	RiseTime float64
+
+	// The standard deviation of the noise added to the signal.
+	Noise float64
+
+	// If set, this gives the DC offset (in sample units) to add to the
+	// signal, at the given time in seconds from the start.
+	Drift func(t float64) float64
+
+	// The speed wobble, as the maximum relative change in speed (e.g.
+	// 0.02 for 2%), and the rate (in Hz) of the variation.
+	WobbleDepth float64
+	WobbleRate  float64
+
+	// The dropouts, where the signal is weakened (or lost).
+	Dropouts []Dropout
+
+	// The clipped parts of the signal.
+	Clips []Clip
+
+	// If set, the first transition of a block is to low instead of high.
+	// This can be changed between blocks.
+	StartLow bool
+
+	// The seed for the random numbers used for the noise.
+	Seed int64
+}
+
+// Dropout is a part of the signal that is weakened, by multiplying the
+// signal (but not the noise or the DC offset) by Gain.
+type Dropout struct {
+	// The sample index of the start, and the length in samples.
+	Start, Length int
+
+	// The gain, which is 0 for a complete loss of signal.
+	Gain float64
+}
+
+// Clip is a part of the signal that is clipped, as by an overdriven
+// amplifier. The clipping is done after adding the DC offset, but before
+// adding the noise.
+type Clip struct {
+	// The sample index of the start, and the length in samples.
+	Start, Length int
+
+	// The level to clip at, relative to the amplitude (e.g. 0.5 to clip
+	// at half the amplitude).
+	Limit float64
+}
+
+// Transition is a change in the level of the signal, as caused by a flux
+// transition on the tape, or by the start or end of a block.
+type Transition struct {
+	// The time (in samples) of the middle of the transition.
+	At float64
+
+	// The level after the transition: 1 for high, -1 for low, and 0 for
+	// no signal (as between blocks).
+	Level float64
+}
+
+// Span is a part of the signal, from Start to End (in samples).
+type Span struct {
+	Start, End float64
+}
+
+// Synth builds up the transitions of a signal, and renders it to samples.
+//
+// The transitions can be changed before rendering, e.g. to add defects;
+// they must be kept in order of time.
+type Synth struct {
+	Signal
+
+	// The transitions of the signal so far.
+	Transitions []Transition
+
+	// The spans of the blocks of the signal so far.
+	Blocks []Span
+
+	// The current time (in samples), and the level at that time.
+	pos   float64
+	level float64
+}
+
+// New creates a new Synth with the given settings, with the defaults
+// filled in.
+func New(sig Signal) *Synth {
+	if sig.SampleRate == 0 {
+		sig.SampleRate = 44100
+	}
+	if sig.BitDepth == 0 {
+		sig.BitDepth = 16
+	}
+	if sig.BitRate == 0 {
+		sig.BitRate = mfm.DefaultBitRate
+	}
+	if sig.Amplitude == 0 {
+		sig.Amplitude = maxValue(sig.BitDepth) * 3 / 8
+	}
+	return &Synth{Signal: sig}
+}
+
+// Len returns the current length of the signal, in samples.
+func (s *Synth) Len() int {
+	return int(math.Ceil(s.pos))
+}
+
+// Silence adds the given number of samples without any signal.
+func (s *Synth) Silence(samples int) {
+	s.setLevel(0)
+	s.pos += float64(samples)
+}
+
+// Block adds a block with the given data, encoded as for the StudyBox
+// with a lead-in of the given number of 0-bits.
+func (s *Synth) Block(data []byte, leadIn int) {
+	s.MFM(studybox.EncodeBlock(data, leadIn))
+}
+
+// MFM adds a block of the given MFM bits (both clock and data bits),
+// where each 1-bit is a flux transition, followed by the end of the
+// signal. Any 0-bits before the first 1-bit are silent.
+func (s *Synth) MFM(bits []byte) {
+	s.addBits(bits, s.halfBit)
+}
+
+// MFMAt adds a block of MFM bits like MFM, but with each bit at the time
+// (in samples) that the given function returns for its index, instead of
+// following on from the current time at the bit rate; the time after the
+// last bit is given for the index len(bits), and that of the half-bit
+// after that for len(bits)+1, which is needed if the block ends with a
+// 1-bit (see addBits). This is for lining the block up with one that was
+// decoded from a recording, whose speed varied.
+//
+// The times must increase with the index, and must not be before the
+// current time.
+func (s *Synth) MFMAt(bits []byte, at func(i int) float64) {
+	s.setLevel(0)
+	s.pos = at(0)
+	i := 0
+	s.addBits(bits, func() float64 {
+		i++
+		return at(i) - at(i-1)
+	})
+}
+
+// addBits adds a block of MFM bits, with the half-bit widths given by the
+// given function, followed by the end of the signal.
+//
+// The signal is kept up for at least a full bit width after the last
+// transition, as otherwise a block that ends with a 1-bit would end with
+// a pulse of only a half-bit, which is too short to be decoded.
+func (s *Synth) addBits(bits []byte, halfBit func() float64) {
+	start := -1.0
+	cells := 0
+	for _, bit := range bits {
+		if bit != 0 {
+			if start < 0 {
+				start = s.pos
+			}
+			s.flip()
+			cells = 0
+		}
+		s.pos += halfBit()
+		cells++
+	}
+	for start >= 0 && cells < 2 {
+		s.pos += halfBit()
+		cells++
+	}
+	s.setLevel(0)
+	if start >= 0 {
+		s.Blocks = append(s.Blocks, Span{start, s.pos})
+	}
+}
+
+// halfBit returns the width (in samples) of the current half-bit cell,
+// taking the speed wobble into account.
+func (s *Synth) halfBit() float64 {
+	w := float64(s.SampleRate) / float64(s.BitRate) / 2
+	if s.WobbleDepth != 0 && s.WobbleRate != 0 {
+		t := s.pos / float64(s.SampleRate)
+		w /= 1 + s.WobbleDepth*math.Sin(2*math.Pi*s.WobbleRate*t)
+	}
+	return w
+}
+
+// flip adds a flux transition at the current time, to the opposite level
+// of the current one (or to high if there is no signal, unless StartLow
+// is set).
+func (s *Synth) flip() {
+	if s.level > 0 || s.level == 0 && s.StartLow {
+		s.setLevel(-1)
+	} else {
+		s.setLevel(1)
+	}
+}
+
+func (s *Synth) setLevel(level float64) {
+	if level == s.level {
+		return
+	}
+	s.Transitions = append(s.Transitions, Transition{s.pos, level})
+	s.level = level
+}
+
+// Render renders the signal to samples.
+func (s *Synth) Render() []int {
+	// In case something has changed the transitions out of order.
+	tr := s.Transitions
+	sort.SliceStable(tr, func(i, j int) bool {
+		return tr[i].At < tr[j].At
+	})
+
+	out := make([]int, s.Len())
+	rng := rand.New(rand.NewSource(s.Seed))
+	half := s.RiseTime / 2
+	maxV := float64(maxValue(s.BitDepth))
+
+	k, base := 0, 0.0
+	for i := range out {
+		t := float64(i)
+
+		// Apply the transitions that are done, and then partially apply
+		// the ones that are still in progress.
+		for k < len(tr) && tr[k].At+half <= t {
+			base = tr[k].Level
+			k++
+		}
+		v, prev := base, base
+		for j := k; j < len(tr) && tr[j].At-half < t; j++ {
+			frac := (t - (tr[j].At - half)) / s.RiseTime
+			v += (tr[j].Level - prev) * frac
+			prev = tr[j].Level
+		}
+
+		v *= float64(s.Amplitude) * s.gain(i)
+		if s.Drift != nil {
+			v += s.Drift(t / float64(s.SampleRate))
+		}
+		if lim, ok := s.clip(i); ok {
+			v = math.Max(-lim, math.Min(lim, v))
+		}
+		if s.Noise != 0 {
+			v += rng.NormFloat64() * s.Noise
+		}
+
+		out[i] = int(math.Round(math.Max(-maxV-1, math.Min(maxV, v))))
+	}
+
+	return out
+}
+
+// gain returns the gain of the signal at the given sample index, as set
+// by the dropouts.
+func (s *Synth) gain(i int) float64 {
+	g := 1.0
+	for _, d := range s.Dropouts {
+		if i >= d.Start && i < d.Start+d.Length {
+			g *= d.Gain
+		}
+	}
+	return g
+}
+
+// clip returns the level (in sample units) to clip the signal at, at the
+// given sample index, and false if it is not clipped there.
+func (s *Synth) clip(i int) (float64, bool) {
+	lim, ok := 0.0, false
+	for _, c := range s.Clips {
+		if i < c.Start || i >= c.Start+c.Length {
+			continue
+		}
+		l := c.Limit * float64(s.Amplitude)
+		if !ok || l < lim {
+			lim, ok = l, true
+		}
+	}
+	return lim, ok
+}
+
+// maxValue returns the maximum sample value for the given bit depth.
+func maxValue(bitDepth int) int {
+	return 1<<(bitDepth-1) - 1
+}
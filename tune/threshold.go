@@ -0,0 +1,92 @@
+package tune
+
+import (
+	"context"
+	"math"
+
+	"github.com/edorfaus/sb-mfm-decode/filter"
+	"github.com/edorfaus/sb-mfm-decode/mfm"
+)
+
+// NoiseFloors returns the given number of noise floors to try, spread
+// evenly on a log scale from a quarter of the default noise floor for the
+// given bit depth to four times it, so that the default is in the middle.
+func NoiseFloors(bits, n int) []int {
+	nf := float64(filter.DefaultNoiseFloor(bits))
+	if n < 2 {
+		return []int{int(nf)}
+	}
+	var floors []int
+	for i := 0; i < n; i++ {
+		f := nf / 4 * math.Pow(16, float64(i)/float64(n-1))
+		v := max(int(math.Round(f)), 1)
+		if len(floors) == 0 || v != floors[len(floors)-1] {
+			floors = append(floors, v)
+		}
+	}
+	return floors
+}
+
+// Thresholds tries each of the given noise floors on the given samples,
+// with the given initial bit width and the default class limits, and
+// returns their scores in the same order as the floors.
+// This shows how the edges, pulses and blocks change with the noise
+// floor, for picking one from the data instead of by trial and error;
+// see PickNoiseFloor.
+//
+// The grid gives the cleaning settings; its other settings are not used.
+// Floors that the cleaning fails with are left out.
+func Thresholds(
+	ctx context.Context, samples []int, floors []int, bitWidth float64,
+	grid Grid,
+) ([]Score, error) {
+	grid.NoiseFloors = floors
+	grid.BitWidths = []float64{bitWidth}
+	grid.Limits = []mfm.ClassLimits{{}}
+	return sweep(ctx, samples, grid)
+}
+
+// PickNoiseFloor returns the noise floor to use, from the scores of a
+// range of them (as returned by Thresholds, in order). Of the floors that
+// decoded as many good blocks and bytes as the best one, it picks the one
+// in the middle of the longest run of them, since that is the furthest
+// from where the results change, and so the least likely to be thrown off
+// by a change in the noise later in the input. If no blocks decoded, it
+// picks the one with the most valid pulses; and it returns 0 if there are
+// no scores.
+func PickNoiseFloor(scores []Score) int {
+	if len(scores) == 0 {
+		return 0
+	}
+	best := scores[0]
+	for _, s := range scores[1:] {
+		if s.better(best) {
+			best = s
+		}
+	}
+	if best.GoodBlocks == 0 {
+		for _, s := range scores {
+			if s.ValidPulses > best.ValidPulses {
+				best = s
+			}
+		}
+		return best.NoiseFloor
+	}
+
+	// Find the longest run of scores that are as good as the best one.
+	runStart, runLen, bestStart, bestLen := 0, 0, 0, 0
+	for i, s := range scores {
+		if s.GoodBlocks != best.GoodBlocks || s.Bytes != best.Bytes {
+			runLen = 0
+			continue
+		}
+		if runLen == 0 {
+			runStart = i
+		}
+		runLen++
+		if runLen > bestLen {
+			bestStart, bestLen = runStart, runLen
+		}
+	}
+	return scores[bestStart+(bestLen-1)/2].NoiseFloor
+}
@@ -0,0 +1,217 @@
+// Package tune finds good decoding settings for an input, by trying a grid
+// of settings on a part of it, and scoring how well each of them works.
+package tune
+
+import (
+	"context"
+	"sort"
+
+	"github.com/edorfaus/sb-mfm-decode/filter"
+	"github.com/edorfaus/sb-mfm-decode/mfm"
+	"github.com/edorfaus/sb-mfm-decode/studybox"
+)
+
+// Params is a set of decoding settings.
+type Params struct {
+	// The noise floor used for cleaning and edge detection.
+	NoiseFloor int
+
+	// The initial bit width; if 0, it is taken from the lead-in.
+	BitWidth float64
+
+	// The limits between the pulse classes; if zero, the defaults.
+	Limits mfm.ClassLimits
+}
+
+// Score is how well a set of settings worked.
+type Score struct {
+	Params
+
+	// The number of edges that were found (not counting those to or from
+	// silence), the number of pulses, and how many of them were valid.
+	Edges, Pulses, ValidPulses int
+
+	// The number of blocks, and how many of them decoded to bytes.
+	Blocks, GoodBlocks int
+
+	// The number of decoded bytes.
+	Bytes int
+}
+
+// ValidRatio returns the fraction of the pulses that were valid.
+func (s Score) ValidRatio() float64 {
+	if s.Pulses == 0 {
+		return 0
+	}
+	return float64(s.ValidPulses) / float64(s.Pulses)
+}
+
+// better returns true if s is a better score than o: more good blocks,
+// then more bytes, then a higher ratio of valid pulses.
+func (s Score) better(o Score) bool {
+	if s.GoodBlocks != o.GoodBlocks {
+		return s.GoodBlocks > o.GoodBlocks
+	}
+	if s.Bytes != o.Bytes {
+		return s.Bytes > o.Bytes
+	}
+	return s.ValidRatio() > o.ValidRatio()
+}
+
+// Grid is the settings to try; every combination of them is tried.
+type Grid struct {
+	NoiseFloors []int
+	BitWidths   []float64
+	Limits      []mfm.ClassLimits
+
+	// Whether to skip cleaning the samples before decoding them.
+	NoClean bool
+
+	// The peak width for the cleaning filter.
+	PeakWidth int
+
+	// The max crossing time of the edge detector, for the bit width of 0
+	// (taken from the lead-in); without it, the edge detector does not
+	// bridge the zero crossings, and the signal breaks up into many tiny
+	// blocks. The other bit widths set it from themselves.
+	MaxCrossingTime int
+}
+
+// DefaultGrid returns a grid of settings around the defaults for the
+// given sample rate and bit depth, or an error if the sample rate is too
+// low to decode at (see mfm.BitWidthFor).
+func DefaultGrid(rate, bits int) (Grid, error) {
+	nf := filter.DefaultNoiseFloor(bits)
+	bw, err := mfm.BitWidthFor(mfm.DefaultBitRate, rate)
+	if err != nil {
+		return Grid{}, err
+	}
+
+	// The limits between the valid classes are shifted a bit each way.
+	d := mfm.DefaultClassLimits
+	lo, hi := d, d
+	lo.Short, lo.Medium = d.Short-0.05, d.Medium-0.05
+	hi.Short, hi.Medium = d.Short+0.05, d.Medium+0.05
+
+	return Grid{
+		NoiseFloors: []int{
+			nf / 2, nf * 3 / 4, nf, nf * 3 / 2, nf * 2, nf * 3,
+		},
+		BitWidths: []float64{0, bw * 0.95, bw, bw * 1.05},
+		Limits:    []mfm.ClassLimits{d, lo, hi},
+		PeakWidth: filter.MfmPeakWidth(mfm.DefaultBitRate, rate),
+
+		MaxCrossingTime: int(bw + 0.5),
+	}, nil
+}
+
+// Sweep tries every combination of the settings in the grid on the given
+// samples, and returns their scores, with the best one first.
+//
+// The samples are not modified. For a long input, it is best to give it
+// only a representative part of it, since each setting is tried on all
+// of the given samples.
+func Sweep(
+	ctx context.Context, samples []int, grid Grid,
+) ([]Score, error) {
+	scores, err := sweep(ctx, samples, grid)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(scores, func(i, j int) bool {
+		return scores[i].better(scores[j])
+	})
+	return scores, nil
+}
+
+// sweep is Sweep without the sorting, so the scores are in grid order.
+func sweep(
+	ctx context.Context, samples []int, grid Grid,
+) ([]Score, error) {
+	var scores []Score
+	buf := make([]int, len(samples))
+	for _, nf := range grid.NoiseFloors {
+		// The cleaning only depends on the noise floor, so it is done
+		// once for each of them.
+		copy(buf, samples)
+		if !grid.NoClean {
+			f := filter.NewDCOffset(nf, grid.PeakWidth)
+			if err := f.RunContext(ctx, buf, buf); err != nil {
+				if err == ctx.Err() {
+					return nil, err
+				}
+				continue
+			}
+		}
+
+		for _, bw := range grid.BitWidths {
+			for _, lim := range grid.Limits {
+				p := Params{NoiseFloor: nf, BitWidth: bw, Limits: lim}
+				s, err := try(ctx, buf, p, grid.MaxCrossingTime)
+				if err != nil {
+					return nil, err
+				}
+				scores = append(scores, s)
+			}
+		}
+	}
+	return scores, nil
+}
+
+// try scores the given settings on the given (cleaned) samples, with the
+// given max crossing time if the bit width is taken from the lead-in.
+func try(
+	ctx context.Context, samples []int, p Params, maxCrossingTime int,
+) (Score, error) {
+	s := Score{Params: p}
+
+	opts := []mfm.Option{
+		mfm.WithNoiseFloor(p.NoiseFloor),
+		mfm.WithClassLimits(p.Limits),
+	}
+	if p.BitWidth > 0 {
+		opts = append(opts, mfm.WithBitWidth(p.BitWidth))
+	} else if maxCrossingTime > 0 {
+		opts = append(opts, mfm.WithMaxCrossingTime(maxCrossingTime))
+	}
+
+	c := mfm.NewPulseClassifierWith(
+		mfm.NewEdgeDetectWith(samples, opts...), opts...,
+	)
+	for c.Next() {
+		if c.Edges.CurType != mfm.EdgeToNone {
+			s.Edges++
+		}
+		if c.TouchesNone() {
+			continue
+		}
+		s.Pulses++
+		if c.Class.Valid() {
+			s.ValidPulses++
+		}
+	}
+
+	d := mfm.NewDecoderWith(mfm.NewEdgeDetectWith(samples, opts...), opts...)
+	err := d.DecodeTo(ctx, blockSink{&s})
+
+	return s, err
+}
+
+// blockSink is a BitSink that decodes the bytes of the blocks, and counts
+// the results in the score.
+type blockSink struct {
+	s *Score
+}
+
+func (b blockSink) Block(start, end int, bits []byte, err error) error {
+	b.s.Blocks++
+	if err != nil {
+		return nil
+	}
+	data, err := studybox.DecodeBlock(bits)
+	if err == nil && len(data) > 0 {
+		b.s.GoodBlocks++
+		b.s.Bytes += len(data)
+	}
+	return nil
+}
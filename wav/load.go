@@ -3,22 +3,47 @@ package wav
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"os"
+	"time"
 
 	"github.com/go-audio/audio"
 	"github.com/go-audio/wav"
 
 	"github.com/edorfaus/sb-mfm-decode/log"
+	"github.com/edorfaus/sb-mfm-decode/metrics"
+	"github.com/edorfaus/sb-mfm-decode/sample"
 )
 
+// logger is the logger used by this package.
+var logger = log.Named("wav")
+
 type Meta struct {
 	SampleRate  int
 	BitDepth    int
 	NumChannels int
+
+	// The role of each channel; if nil, the channels have their
+	// DefaultRoles. See SetRoles.
+	Roles []Role
+}
+
+// FormatError is the error of a file that is not a WAVE file of a format
+// that is supported, or whose headers are damaged.
+type FormatError struct {
+	Err error
+}
+
+func (e *FormatError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *FormatError) Unwrap() error {
+	return e.Err
 }
 
 func readFile(filename string) ([]byte, error) {
-	defer log.Time(1, "Reading: %v ...", filename)(" done in")
+	defer logger.Time(1, "Reading: %v ...", filename)(" done in")
 	return os.ReadFile(filename)
 }
 
@@ -31,43 +56,130 @@ func LoadDataChannel(filename string) ([]int, Meta, error) {
 		return data, meta, err
 	}
 
-	// Multiple channels, keep the second (right channel, if stereo).
+	// Multiple channels, keep the data channel.
 
-	defer log.Time(1, "Extracting data channel...")(" done in")
+	// This is done in place, by compacting the data channel into the
+	// front of the buffer, to avoid allocating a second full-size one.
+	// Since the read index is never behind the write index, this does
+	// not overwrite anything that has not already been read.
+	n := len(data) / meta.NumChannels
 
-	// Make a new buffer so we can release the oversized one.
-	out := make([]int, len(data)/meta.NumChannels)
+	defer logger.TimeStage(
+		1, "extract", n, "Extracting data channel...",
+	)(" done in")
 
-	for i, j := 0, 1; i < len(out); i, j = i+1, j+meta.NumChannels {
-		out[i] = data[j]
+	ch, step := DataChannel(meta.NumChannels), meta.NumChannels
+	for i, j := 0, ch; i < n; i, j = i+1, j+step {
+		data[i] = data[j]
 	}
 
-	meta.NumChannels = 1
+	meta.NumChannels, meta.Roles = 1, nil
 
-	return out, meta, nil
+	// Limit the capacity too, so that appending to the result does not
+	// silently reuse the leftover part of the buffer.
+	return data[:n:n], meta, nil
+}
+
+// LoadDifference loads the data signal of a differential capture from
+// the given file, as the Difference of its first two channels.
+func LoadDifference(filename string) ([]int, Meta, error) {
+	data, meta, err := LoadInterleaved(filename)
+	if err != nil {
+		return nil, meta, err
+	}
+	if err := checkChannel(0, true, meta); err != nil {
+		return nil, meta, &FormatError{err}
+	}
+
+	// This is done in place, like in LoadDataChannel.
+	n, step := len(data)/meta.NumChannels, meta.NumChannels
+
+	defer logger.TimeStage(
+		1, "extract", n, "Extracting channel difference...",
+	)(" done in")
+
+	for i, j := 0, 0; i < n; i, j = i+1, j+step {
+		data[i] = Difference(data[j], data[j+1], meta.BitDepth)
+	}
+
+	meta.NumChannels, meta.Roles = 1, nil
+
+	return data[:n:n], meta, nil
+}
+
+// LoadChannels loads the wave samples of each of the channels of the
+// given file, for when more than the data channel is of interest.
+func LoadChannels(filename string) ([][]int, Meta, error) {
+	data, meta, err := LoadInterleaved(filename)
+	if err != nil {
+		return nil, meta, err
+	}
+
+	n, step := len(data)/meta.NumChannels, meta.NumChannels
+
+	defer logger.TimeStage(
+		1, "extract", n*step, "Extracting %v channels...", step,
+	)(" done in")
+
+	channels := make([][]int, step)
+	for ch := range channels {
+		c := make([]int, n)
+		for i, j := 0, ch; i < n; i, j = i+1, j+step {
+			c[i] = data[j]
+		}
+		channels[ch] = c
+	}
+
+	return channels, meta, nil
+}
+
+// LoadDataChannels loads the wave samples of each of the data channels of
+// the given file, as given by the roles of its channels (or by their
+// DefaultRoles, if roles is nil), in order. The returned metadata is that
+// of the whole file, with those roles, so its Channels(RoleData) are the
+// channels that were loaded.
+func LoadDataChannels(filename string, roles []Role) ([][]int, Meta, error) {
+	channels, meta, err := LoadChannels(filename)
+	if err != nil {
+		return nil, meta, err
+	}
+	if roles != nil {
+		if err := meta.SetRoles(roles); err != nil {
+			return nil, meta, err
+		}
+	}
+
+	var data [][]int
+	for _, ch := range meta.Channels(RoleData) {
+		data = append(data, channels[ch])
+	}
+	return data, meta, nil
 }
 
 // LoadInterleaved loads the wave samples from the given file, without
 // de-interleaving them if there's more than one channel.
 func LoadInterleaved(filename string) ([]int, Meta, error) {
+	start := time.Now()
+
 	fileData, err := readFile(filename)
 	if err != nil {
 		return nil, Meta{}, err
 	}
 
-	defer log.Time(1, "Decoding WAVE data...\n")("Decoding done in")
+	defer logger.Time(1, "Decoding WAVE data...\n")("Decoding done in")
 
 	d := wav.NewDecoder(bytes.NewReader(fileData))
 
 	if err := d.FwdToPCM(); err != nil {
-		return nil, Meta{}, err
+		return nil, Meta{}, &FormatError{err}
 	}
 
 	if d.BitDepth < 8 || d.BitDepth > 64 || d.BitDepth%8 != 0 {
-		return nil, Meta{}, fmt.Errorf("bad bit depth: %v", d.BitDepth)
+		err := fmt.Errorf("bad bit depth: %v", d.BitDepth)
+		return nil, Meta{}, &FormatError{err}
 	}
 	expectedSamples := int(d.PCMLen() / int64(d.BitDepth/8))
-	log.Ln(2, "Expected samples:", expectedSamples)
+	logger.Ln(2, "Expected samples:", expectedSamples)
 
 	// +1 just in case our calculation isn't quite right.
 	buf := &audio.IntBuffer{
@@ -75,25 +187,25 @@ func LoadInterleaved(filename string) ([]int, Meta, error) {
 	}
 	n, err := d.PCMBuffer(buf)
 	if err != nil {
-		return nil, Meta{}, err
+		return nil, Meta{}, &FormatError{err}
 	}
 	buf.Data = buf.Data[:n]
-	log.Ln(2, "     Got samples:", n)
+	logger.Ln(2, "     Got samples:", n)
 
 	if n > expectedSamples {
-		log.Warn("unexpected sample, may have lost some")
+		logger.Warn("unexpected sample, may have lost some")
 	}
 	if n < expectedSamples {
-		log.Warn("got fewer samples than expected")
+		logger.Warn("got fewer samples than expected")
 	}
 
 	if err := d.Err(); err != nil {
-		return nil, Meta{}, err
+		return nil, Meta{}, &FormatError{err}
 	}
 
 	if buf.Format == nil || buf.Format.NumChannels < 1 {
 		err := fmt.Errorf("missing or bad PCM format information")
-		return nil, Meta{}, err
+		return nil, Meta{}, &FormatError{err}
 	}
 
 	meta := Meta{
@@ -101,5 +213,68 @@ func LoadInterleaved(filename string) ([]int, Meta, error) {
 		BitDepth:    buf.SourceBitDepth,
 		NumChannels: buf.Format.NumChannels,
 	}
+
+	metrics.Add("load", len(buf.Data), time.Since(start))
+
 	return buf.Data, meta, nil
 }
+
+// LoadDataChannelOf loads the wave samples for the data channel from the
+// given file, as the given sample type, e.g. int16 to save memory.
+//
+// Unlike LoadDataChannel, this reads the file a chunk at a time, so the
+// only full-length buffer it allocates is the one that is returned.
+func LoadDataChannelOf[S sample.Type](filename string) ([]S, Meta, error) {
+	return LoadDataChannelInto[S](filename, nil)
+}
+
+// LoadDataChannelInto is like LoadDataChannelOf, but it reuses the given
+// buffer if it is big enough, e.g. one that was taken from a pool.Pool.
+// If it is not, a new buffer is allocated (and the given one is unused).
+func LoadDataChannelInto[S sample.Type](
+	filename string, buf []S,
+) ([]S, Meta, error) {
+	start := time.Now()
+
+	r, err := OpenReader(filename)
+	if err != nil {
+		return nil, Meta{}, err
+	}
+	defer r.Close()
+
+	meta := r.Meta
+	if meta.BitDepth > sample.Bits[S]() {
+		return nil, meta, fmt.Errorf(
+			"%v-bit samples do not fit in %v-bit sample type",
+			meta.BitDepth, sample.Bits[S](),
+		)
+	}
+	logger.Ln(2, "Expected samples:", r.Frames)
+
+	out := buf[:0]
+	if cap(out) < r.Frames {
+		out = make([]S, 0, r.Frames)
+	}
+	chunk := make([]int, 64*1024)
+	for {
+		n, err := r.ReadSamples(chunk)
+		out = sample.Convert(out, chunk[:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, meta, err
+		}
+	}
+	logger.Ln(2, "     Got samples:", len(out))
+
+	if len(out) < r.Frames {
+		logger.Warn("got fewer samples than expected")
+	}
+
+	meta.NumChannels, meta.Roles = 1, nil
+
+	metrics.Add("load", len(out), time.Since(start))
+
+	return out, meta, nil
+}
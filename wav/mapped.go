@@ -0,0 +1,187 @@
+package wav
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Mapped gives access to the samples of a single channel of a WAVE file
+// that has been mapped into memory. The samples are only decoded when
+// they are asked for, so reading a small region of a large file is cheap.
+//
+// It can also be read sequentially with ReadSamples, like a Reader.
+type Mapped struct {
+	// The metadata of the file; NumChannels is the number of channels in
+	// the file, not the number of channels being read.
+	Meta Meta
+
+	// The channel that is being read; this defaults to the data channel.
+	Channel int
+
+	// Whether to read the difference of the first two channels instead
+	// of a single channel, as by Difference.
+	Differential bool
+
+	// The number of frames (samples per channel) in the file.
+	Frames int
+
+	// The PCM data of the file, and the position that ReadSamples is at.
+	pcm []byte
+	pos int
+
+	// The number of bytes per sample, and per frame (all channels).
+	sampleSize, frameSize int
+
+	unmap func() error
+}
+
+// OpenMapped maps the given file into memory, for reading the samples of
+// its data channel. The caller must call Close when done with it.
+//
+// On platforms where memory mapping is not supported, the file is read
+// into memory instead, but the samples are still decoded lazily.
+func OpenMapped(filename string) (*Mapped, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	// The mapping stays valid after the file is closed.
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := st.Size()
+	if size <= 0 || int64(int(size)) != size {
+		return nil, fmt.Errorf("bad file size: %v", size)
+	}
+
+	data, unmap, err := mapFile(f, int(size))
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := newMapped(data)
+	if err != nil {
+		unmap()
+		return nil, err
+	}
+	m.unmap = unmap
+	return m, nil
+}
+
+func newMapped(data []byte) (*Mapped, error) {
+	br := bytes.NewReader(data)
+	d, meta, err := parseHeader(br)
+	if err != nil {
+		return nil, err
+	}
+
+	// The decoder reads directly from br, so after parsing the headers
+	// it is positioned at the start of the PCM data.
+	start := len(data) - br.Len()
+	end := start + d.PCMSize
+	if end > len(data) {
+		logger.Warn("PCM data is truncated")
+		end = len(data)
+	}
+
+	m := &Mapped{
+		Meta:       meta,
+		Channel:    DataChannel(meta.NumChannels),
+		pcm:        data[start:end],
+		sampleSize: meta.BitDepth / 8,
+	}
+	m.frameSize = m.sampleSize * meta.NumChannels
+	m.Frames = len(m.pcm) / m.frameSize
+	return m, nil
+}
+
+// ReadAt decodes the samples of the channel starting at the given frame
+// into buf, and returns how many were decoded; this is less than len(buf)
+// only if the end of the data was reached (or the channel is invalid).
+func (m *Mapped) ReadAt(buf []int, frame int) int {
+	if frame < 0 || frame >= m.Frames {
+		return 0
+	}
+	if checkChannel(m.Channel, m.Differential, m.Meta) != nil {
+		return 0
+	}
+	n := len(buf)
+	if n > m.Frames-frame {
+		n = m.Frames - frame
+	}
+
+	if m.Differential {
+		ofs := frame * m.frameSize
+		for i := 0; i < n; i++ {
+			buf[i] = decodeDifference(m.pcm[ofs:], m.sampleSize)
+			ofs += m.frameSize
+		}
+		return n
+	}
+	ofs := frame*m.frameSize + m.Channel*m.sampleSize
+	for i := 0; i < n; i++ {
+		buf[i] = decodeSample(m.pcm[ofs:], m.sampleSize)
+		ofs += m.frameSize
+	}
+	return n
+}
+
+// Region returns the samples of the channel from the given frame up to
+// (but not including) the given end frame, in a newly allocated slice.
+func (m *Mapped) Region(from, to int) []int {
+	if to > m.Frames {
+		to = m.Frames
+	}
+	if from < 0 {
+		from = 0
+	}
+	if to <= from {
+		return nil
+	}
+	out := make([]int, to-from)
+	m.ReadAt(out, from)
+	return out
+}
+
+// ReadSamples reads up to len(buf) samples of the channel into buf,
+// continuing from where the previous call left off, and returns how many
+// were read. At the end of the data, it returns 0 and io.EOF.
+func (m *Mapped) ReadSamples(buf []int) (int, error) {
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	if err := checkChannel(m.Channel, m.Differential, m.Meta); err != nil {
+		return 0, err
+	}
+	n := m.ReadAt(buf, m.pos)
+	if n == 0 {
+		return 0, io.EOF
+	}
+	m.pos += n
+	return n, nil
+}
+
+// Seek sets the frame that the next call to ReadSamples starts at.
+func (m *Mapped) Seek(frame int) error {
+	if frame < 0 || frame > m.Frames {
+		return fmt.Errorf("bad frame: %v", frame)
+	}
+	m.pos = frame
+	return nil
+}
+
+// Close unmaps the file. The Mapped must not be used after this.
+func (m *Mapped) Close() error {
+	m.pcm = nil
+	if m.unmap == nil {
+		return nil
+	}
+	err := m.unmap()
+	m.unmap = nil
+	return err
+}
@@ -0,0 +1,112 @@
+package wav
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// Marker is a position in the samples of a WAVE file that is worth
+// looking at, such as where decoding reported an error, so that scrubbing
+// through the audio in an editor can land right on it.
+type Marker struct {
+	// The sample frame of the marker, and what it marks.
+	Frame int
+	Label string
+}
+
+// The frequency (in Hz) and length (in seconds) of the tones that are
+// added by AddMarkerTones, and their level as a part of full scale. The
+// tone is well below the MFM band, so that it is easy to tell apart.
+const (
+	MarkerToneFreq   = 1000
+	MarkerToneLength = 0.05
+	MarkerToneLevel  = 0.25
+)
+
+// AddMarkerTones adds a short tone to the samples at each of the markers,
+// which can be heard (and seen) in the audio, unlike cue points, which
+// not all programs show. The tones are mixed into the samples, and fade
+// in and out to not click; the result is clamped to the bit depth.
+func AddMarkerTones(samples []int, rate, bits int, markers []Marker) {
+	n := int(MarkerToneLength * float64(rate))
+	amp := MarkerToneLevel * float64(int(1)<<(bits-1))
+	high, low := (1<<(bits-1))-1, -(1 << (bits - 1))
+	for _, m := range markers {
+		for i := 0; i < n; i++ {
+			k := m.Frame + i
+			if k < 0 {
+				continue
+			}
+			if k >= len(samples) {
+				break
+			}
+			// A sine in a raised cosine envelope.
+			env := 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(n))
+			ph := 2 * math.Pi * MarkerToneFreq * float64(i) / float64(rate)
+			v := samples[k] + int(math.Round(amp*env*math.Sin(ph)))
+			samples[k] = min(max(v, low), high)
+		}
+	}
+}
+
+// writeCues appends a cue chunk with the given markers to the WAVE file,
+// along with an associated data list with their labels, which the
+// encoder does not support, and fixes the size of the RIFF chunk to
+// cover them. The file must be positioned at its end.
+func writeCues(f *os.File, markers []Marker) error {
+	if len(markers) == 0 {
+		return nil
+	}
+	end, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	var buf []byte
+	le := binary.LittleEndian
+	if end%2 != 0 {
+		// Chunks start on an even offset, so pad the one before.
+		buf = append(buf, 0)
+	}
+
+	buf = append(buf, "cue "...)
+	buf = le.AppendUint32(buf, uint32(4+24*len(markers)))
+	buf = le.AppendUint32(buf, uint32(len(markers)))
+	for i, m := range markers {
+		buf = le.AppendUint32(buf, uint32(i+1))
+		buf = le.AppendUint32(buf, uint32(m.Frame))
+		buf = append(buf, "data"...)
+		buf = le.AppendUint32(buf, 0)
+		buf = le.AppendUint32(buf, 0)
+		buf = le.AppendUint32(buf, uint32(m.Frame))
+	}
+
+	var labels []byte
+	labels = append(labels, "adtl"...)
+	for i, m := range markers {
+		labels = append(labels, "labl"...)
+		labels = le.AppendUint32(labels, uint32(4+len(m.Label)+1))
+		labels = le.AppendUint32(labels, uint32(i+1))
+		labels = append(labels, m.Label...)
+		labels = append(labels, 0)
+		if len(labels)%2 != 0 {
+			labels = append(labels, 0)
+		}
+	}
+	buf = append(buf, "LIST"...)
+	buf = le.AppendUint32(buf, uint32(len(labels)))
+	buf = append(buf, labels...)
+
+	if _, err := f.Write(buf); err != nil {
+		return err
+	}
+	size := end + int64(len(buf)) - 8
+	if size > math.MaxUint32 {
+		return fmt.Errorf("WAVE file too large for its markers")
+	}
+	_, err = f.WriteAt(le.AppendUint32(nil, uint32(size)), 4)
+	return err
+}
@@ -0,0 +1,18 @@
+//go:build !unix
+
+package wav
+
+import (
+	"io"
+	"os"
+)
+
+// mapFile reads the first size bytes of the given file into memory, as
+// memory mapping is not supported on this platform.
+func mapFile(f *os.File, size int) ([]byte, func() error, error) {
+	data := make([]byte, size)
+	if _, err := io.ReadFull(f, data); err != nil {
+		return nil, nil, err
+	}
+	return data, func() error { return nil }, nil
+}
@@ -0,0 +1,22 @@
+//go:build unix
+
+package wav
+
+import (
+	"os"
+	"syscall"
+)
+
+// mapFile maps the first size bytes of the given file into memory, and
+// returns the mapped data along with a function that unmaps it.
+func mapFile(f *os.File, size int) ([]byte, func() error, error) {
+	data, err := syscall.Mmap(
+		int(f.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() error {
+		return syscall.Munmap(data)
+	}, nil
+}
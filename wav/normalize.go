@@ -0,0 +1,195 @@
+package wav
+
+import (
+	"fmt"
+	"math"
+)
+
+// Normalization is how the level of the samples is measured, for
+// normalizing them.
+type Normalization int
+
+const (
+	// NormalizePeak measures the level by the sample that is furthest
+	// from silence.
+	NormalizePeak Normalization = iota
+
+	// NormalizeRMS measures the level by the root mean square of the
+	// samples, which a few loud clicks do not change much.
+	NormalizeRMS
+)
+
+// The default levels to normalize to, as a fraction of full scale, for
+// each kind of normalization. The RMS level is lower, since the quiet
+// parts between the blocks count towards it.
+const (
+	DefaultPeakLevel = 0.9
+	DefaultRMSLevel  = 0.25
+)
+
+// ParseNormalization returns the normalization by the given name, which
+// is either "peak" or "rms".
+func ParseNormalization(name string) (Normalization, error) {
+	switch name {
+	case "peak":
+		return NormalizePeak, nil
+	case "rms":
+		return NormalizeRMS, nil
+	}
+	return 0, fmt.Errorf("unknown normalization: %q", name)
+}
+
+func (n Normalization) String() string {
+	switch n {
+	case NormalizePeak:
+		return "peak"
+	case NormalizeRMS:
+		return "rms"
+	}
+	return fmt.Sprintf("Normalization(%d)", int(n))
+}
+
+// DefaultLevel returns the default level to normalize to, as a fraction
+// of full scale.
+func (n Normalization) DefaultLevel() float64 {
+	if n == NormalizeRMS {
+		return DefaultRMSLevel
+	}
+	return DefaultPeakLevel
+}
+
+// silence returns the sample value of silence, and the full scale (the
+// largest distance from it that a sample can have), for the given bit
+// depth. As with the samples, 8-bit ones are unsigned.
+func silence(bits int) (mid, full int) {
+	full = 1 << (bits - 1)
+	if bits == 8 {
+		return 128, full
+	}
+	return 0, full
+}
+
+// Level returns the level of the given samples, of the given bit depth,
+// as measured by the given normalization, as a fraction of full scale.
+func Level(samples []int, bits int, n Normalization) float64 {
+	mid, full := silence(bits)
+	if n == NormalizeRMS {
+		if len(samples) == 0 {
+			return 0
+		}
+		sum := 0.0
+		for _, v := range samples {
+			d := float64(v - mid)
+			sum += d * d
+		}
+		return math.Sqrt(sum/float64(len(samples))) / float64(full)
+	}
+
+	peak := 0
+	for _, v := range samples {
+		peak = max(peak, v-mid, mid-v)
+	}
+	return float64(peak) / float64(full)
+}
+
+// Normalize scales the given samples, of the given bit depth, in place,
+// so that their level (as measured by the given normalization) becomes
+// the given one, as a fraction of full scale. Samples that would then be
+// beyond full scale are clipped. It returns the gain that was applied;
+// silent samples are left as they are, with a gain of 1.
+//
+// This makes captures that were made at very different levels look the
+// same to the parts of the decoding that use fixed levels, such as the
+// default noise floor.
+func Normalize(
+	samples []int, bits int, n Normalization, level float64,
+) float64 {
+	gain := Gain(samples, bits, n, level)
+	Amplify(samples, bits, gain)
+	return gain
+}
+
+// Gain returns the gain that Normalize would apply to the given samples,
+// without applying it.
+func Gain(samples []int, bits int, n Normalization, level float64) float64 {
+	current := Level(samples, bits, n)
+	if current == 0 {
+		return 1
+	}
+	return level / current
+}
+
+// Amplify scales the given samples, of the given bit depth, in place, by
+// the given gain, clipping those that would then be beyond full scale.
+func Amplify(samples []int, bits int, gain float64) {
+	if gain == 1 {
+		return
+	}
+	mid, full := silence(bits)
+	for i, v := range samples {
+		s := int(math.Round(float64(v-mid) * gain))
+		samples[i] = mid + min(max(s, -full), full-1)
+	}
+}
+
+// Normalizer is a normalization of the samples to a level, as set by the
+// --normalize and --level options of the commands.
+type Normalizer struct {
+	// How the level of the samples is measured.
+	Kind Normalization
+
+	// The level to normalize to, as a fraction of full scale; if 0, the
+	// default level for the Kind is used.
+	Level float64
+}
+
+// ParseNormalizer returns the normalizer with the given name of its kind
+// ("peak" or "rms") and level, or nil if the name is empty, for no
+// normalization.
+func ParseNormalizer(name string, level float64) (*Normalizer, error) {
+	if level < 0 || level > 1 {
+		return nil, fmt.Errorf("level must be between 0 and 1")
+	}
+	if name == "" {
+		return nil, nil
+	}
+	kind, err := ParseNormalization(name)
+	if err != nil {
+		return nil, err
+	}
+	return &Normalizer{Kind: kind, Level: level}, nil
+}
+
+// TargetLevel returns the level to normalize to, as a fraction of full
+// scale.
+func (n *Normalizer) TargetLevel() float64 {
+	if n.Level == 0 {
+		return n.Kind.DefaultLevel()
+	}
+	return n.Level
+}
+
+// Gain returns the gain that normalizes the given samples, of the given
+// bit depth; a nil Normalizer returns 1.
+func (n *Normalizer) Gain(samples []int, bits int) float64 {
+	if n == nil {
+		return 1
+	}
+	return Gain(samples, bits, n.Kind, n.TargetLevel())
+}
+
+// Normalize normalizes the given samples, of the given bit depth, in
+// place, and returns the gain that was applied; a nil Normalizer leaves
+// them as they are, with a gain of 1.
+func (n *Normalizer) Normalize(samples []int, bits int) float64 {
+	gain := n.Gain(samples, bits)
+	Amplify(samples, bits, gain)
+	return gain
+}
+
+func (n *Normalizer) String() string {
+	if n == nil {
+		return "none"
+	}
+	return fmt.Sprintf("%v %v", n.TargetLevel(), n.Kind)
+}
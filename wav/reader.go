@@ -0,0 +1,289 @@
+package wav
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/go-audio/wav"
+)
+
+// Reader reads the samples of a single channel from a WAVE file, a chunk
+// at a time, so that the whole file does not have to be kept in memory.
+type Reader struct {
+	// The metadata of the file; NumChannels is the number of channels in
+	// the file, not the number of channels being read.
+	Meta Meta
+
+	// The channel that is being read; this defaults to the data channel,
+	// as chosen by LoadDataChannel.
+	Channel int
+
+	// Whether to read the difference of the first two channels instead
+	// of a single channel, as by Difference.
+	Differential bool
+
+	// The number of frames (samples per channel) in the file, according
+	// to the size of the PCM data chunk.
+	Frames int
+
+	f   *os.File
+	pcm io.Reader
+
+	// The file offset and size of the PCM data.
+	pcmStart int64
+	pcmSize  int
+
+	// The number of bytes per sample, and per frame (all channels).
+	sampleSize, frameSize int
+
+	raw []byte
+}
+
+// OpenReader opens the given file for reading the samples of its data
+// channel. The caller must call Close when done with it.
+func OpenReader(filename string) (*Reader, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := newReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// OpenDataReaders opens a Reader for each of the data channels of the
+// given file, as given by the roles of its channels (or by their
+// DefaultRoles, if roles is nil), in order; each has the roles in its Meta.
+// The readers are independent, so each can feed its own pipeline. The
+// caller must call Close on each of them when done with it.
+func OpenDataReaders(filename string, roles []Role) ([]*Reader, error) {
+	first, err := OpenReader(filename)
+	if err != nil {
+		return nil, err
+	}
+	if roles != nil {
+		if err := first.Meta.SetRoles(roles); err != nil {
+			first.Close()
+			return nil, err
+		}
+	}
+
+	var readers []*Reader
+	for _, ch := range first.Meta.Channels(RoleData) {
+		r := first
+		if len(readers) > 0 {
+			if r, err = OpenReader(filename); err != nil {
+				for _, r := range readers {
+					r.Close()
+				}
+				return nil, err
+			}
+			r.Meta.Roles = first.Meta.Roles
+		}
+		r.Channel = ch
+		readers = append(readers, r)
+	}
+	return readers, nil
+}
+
+// ReadMeta reads the headers of the given WAVE file data, and returns its
+// metadata, e.g. for a WAVE file that is embedded in another file.
+func ReadMeta(rs io.ReadSeeker) (Meta, error) {
+	_, meta, err := parseHeader(rs)
+	return meta, err
+}
+
+func newReader(f *os.File) (*Reader, error) {
+	d, meta, err := parseHeader(f)
+	if err != nil {
+		return nil, err
+	}
+
+	// The decoder reads directly from f, so it is now at the PCM data.
+	pcmStart, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Reader{
+		Meta:       meta,
+		Channel:    DataChannel(meta.NumChannels),
+		f:          f,
+		pcmStart:   pcmStart,
+		pcmSize:    d.PCMSize,
+		sampleSize: meta.BitDepth / 8,
+	}
+	r.frameSize = r.sampleSize * meta.NumChannels
+	r.Frames = d.PCMSize / r.frameSize
+	// Limit the reads to the PCM chunk, so that any chunks after it are
+	// not read as if they were samples.
+	r.pcm = io.LimitReader(f, int64(d.PCMSize))
+	return r, nil
+}
+
+// Seek sets the frame that the next call to ReadSamples starts at.
+func (r *Reader) Seek(frame int) error {
+	if frame < 0 || frame > r.Frames {
+		return fmt.Errorf("bad frame: %v", frame)
+	}
+	ofs := int64(frame) * int64(r.frameSize)
+	if _, err := r.f.Seek(r.pcmStart+ofs, io.SeekStart); err != nil {
+		return err
+	}
+	r.pcm = io.LimitReader(r.f, int64(r.pcmSize)-ofs)
+	return nil
+}
+
+// parseHeader reads the headers of a WAVE file, leaving the given reader
+// at the start of the PCM data, and checks that we support the format.
+// The errors are returned as a *FormatError.
+func parseHeader(rs io.ReadSeeker) (*wav.Decoder, Meta, error) {
+	d := wav.NewDecoder(rs)
+	if err := d.FwdToPCM(); err != nil {
+		return nil, Meta{}, &FormatError{err}
+	}
+	if err := d.Err(); err != nil {
+		return nil, Meta{}, &FormatError{err}
+	}
+	if d.PCMChunk == nil {
+		err := fmt.Errorf("PCM data not found")
+		return nil, Meta{}, &FormatError{err}
+	}
+
+	switch d.BitDepth {
+	case 8, 16, 24, 32:
+	default:
+		err := fmt.Errorf("bad bit depth: %v", d.BitDepth)
+		return nil, Meta{}, &FormatError{err}
+	}
+	if d.NumChans < 1 {
+		err := fmt.Errorf("missing or bad PCM format information")
+		return nil, Meta{}, &FormatError{err}
+	}
+
+	meta := Meta{
+		SampleRate:  int(d.SampleRate),
+		BitDepth:    int(d.BitDepth),
+		NumChannels: int(d.NumChans),
+	}
+	return d, meta, nil
+}
+
+// DataChannel returns the index of the channel that is used as the data
+// channel, for a file with the given number of channels.
+func DataChannel(numChannels int) int {
+	if numChannels > 1 {
+		// Multiple channels, use the second (right channel, if stereo).
+		return 1
+	}
+	return 0
+}
+
+// ReadSamples reads up to len(buf) samples of the channel into buf, and
+// returns how many were read. At the end of the data, it returns 0 and
+// io.EOF. A partial frame at the end of the data is ignored.
+func (r *Reader) ReadSamples(buf []int) (int, error) {
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	if err := checkChannel(r.Channel, r.Differential, r.Meta); err != nil {
+		return 0, err
+	}
+
+	size := len(buf) * r.frameSize
+	if cap(r.raw) < size {
+		r.raw = make([]byte, size)
+	}
+	raw := r.raw[:size]
+
+	m, err := io.ReadFull(r.pcm, raw)
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	n := m / r.frameSize
+	if r.Differential {
+		for i := 0; i < n; i++ {
+			buf[i] = decodeDifference(raw[i*r.frameSize:], r.sampleSize)
+		}
+		return n, nil
+	}
+	ofs := r.Channel * r.sampleSize
+	for i := 0; i < n; i++ {
+		buf[i] = decodeSample(raw[i*r.frameSize+ofs:], r.sampleSize)
+	}
+	return n, nil
+}
+
+// checkChannel checks that the given channel (or the first two channels,
+// if differential) can be read from a file with the given metadata.
+func checkChannel(channel int, differential bool, meta Meta) error {
+	if differential {
+		if meta.NumChannels < 2 {
+			return fmt.Errorf(
+				"differential input needs 2 channels, file has %v",
+				meta.NumChannels,
+			)
+		}
+		return nil
+	}
+	if channel < 0 || channel >= meta.NumChannels {
+		return fmt.Errorf("bad channel: %v", channel)
+	}
+	return nil
+}
+
+// Difference returns the data signal of a differential capture, where
+// the same signal is recorded on both channels with opposite polarity, so
+// that any hum that is common to both cancels out. It is half of the left
+// sample minus the right one, so that it fits in the given bit depth; as
+// with the samples, 8-bit ones are unsigned.
+//
+// The halving rounds down rather than toward zero, so that every step of
+// the difference is the same size, without twice as wide a step at zero.
+func Difference(left, right, bits int) int {
+	if bits == 8 {
+		return (left-right)>>1 + 128
+	}
+	return (left - right) >> 1
+}
+
+// decodeDifference decodes the first two samples of the given size (in
+// bytes) from the start of b, and returns their Difference.
+func decodeDifference(b []byte, size int) int {
+	return Difference(
+		decodeSample(b, size), decodeSample(b[size:], size), size*8,
+	)
+}
+
+// decodeSample decodes a single little-endian sample of the given size
+// (in bytes) from the start of b. This matches the go-audio decoder, so
+// 8-bit samples are unsigned.
+func decodeSample(b []byte, size int) int {
+	switch size {
+	case 1:
+		return int(b[0])
+	case 2:
+		return int(int16(binary.LittleEndian.Uint16(b)))
+	case 3:
+		v := int32(b[0]) | int32(b[1])<<8 | int32(b[2])<<16
+		// Sign-extend from 24 to 32 bits.
+		return int(v<<8) >> 8
+	default:
+		return int(int32(binary.LittleEndian.Uint32(b)))
+	}
+}
+
+// Close closes the underlying file.
+func (r *Reader) Close() error {
+	return r.f.Close()
+}
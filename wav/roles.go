@@ -0,0 +1,126 @@
+package wav
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Role is what a channel of a WAVE file holds, for routing the channels
+// of a capture with more than one track (e.g. both sides of a tape, as
+// recorded at once with a four-track deck) to where they are used.
+type Role int
+
+const (
+	// RoleUnused is a channel that is not used for anything.
+	RoleUnused Role = iota
+
+	// RoleData is a channel with a StudyBox data track, to be decoded.
+	RoleData
+
+	// RoleAudio is a channel with the audio track of the tape, which is
+	// kept as it is (e.g. for the audio of a tape image).
+	RoleAudio
+
+	// RoleSync is a channel with a sync or reference signal, such as a
+	// pilot tone, that is not decoded as data.
+	RoleSync
+)
+
+var roleNames = [...]string{
+	RoleUnused: "unused",
+	RoleData:   "data",
+	RoleAudio:  "audio",
+	RoleSync:   "sync",
+}
+
+func (r Role) String() string {
+	if r >= 0 && int(r) < len(roleNames) {
+		return roleNames[r]
+	}
+	return fmt.Sprintf("Role(%d)", int(r))
+}
+
+// ParseRoles parses a comma-separated list of channel roles, one for each
+// channel in order, e.g. "audio,data" for the usual stereo capture. Each
+// role can be given by its name, or by the first letter of it.
+func ParseRoles(s string) ([]Role, error) {
+	var roles []Role
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		r, ok := parseRole(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown channel role: %q", name)
+		}
+		roles = append(roles, r)
+	}
+	return roles, nil
+}
+
+func parseRole(name string) (Role, bool) {
+	for r, n := range roleNames {
+		if name == n || len(name) == 1 && name[0] == n[0] {
+			return Role(r), true
+		}
+	}
+	return RoleUnused, false
+}
+
+// DefaultRoles returns the roles of the channels of a file with the given
+// number of channels, when none are given: the DataChannel is the data,
+// and the others are audio.
+func DefaultRoles(numChannels int) []Role {
+	roles := make([]Role, numChannels)
+	for i := range roles {
+		roles[i] = RoleAudio
+	}
+	if numChannels > 0 {
+		roles[DataChannel(numChannels)] = RoleData
+	}
+	return roles
+}
+
+// SetRoles sets the roles of the channels, which must be one for each
+// channel, with at least one of them being data.
+func (m *Meta) SetRoles(roles []Role) error {
+	if len(roles) != m.NumChannels {
+		return fmt.Errorf(
+			"got %v channel roles for %v channels", len(roles), m.NumChannels,
+		)
+	}
+	data := false
+	for _, r := range roles {
+		if r < 0 || int(r) >= len(roleNames) {
+			return fmt.Errorf("bad channel role: %v", r)
+		}
+		data = data || r == RoleData
+	}
+	if !data {
+		return fmt.Errorf("no data channel among the channel roles")
+	}
+	m.Roles = append([]Role(nil), roles...)
+	return nil
+}
+
+// RoleOf returns the role of the given channel; if the roles have not
+// been set, these are the DefaultRoles.
+func (m Meta) RoleOf(channel int) Role {
+	if channel < 0 || channel >= m.NumChannels {
+		return RoleUnused
+	}
+	if len(m.Roles) != m.NumChannels {
+		return DefaultRoles(m.NumChannels)[channel]
+	}
+	return m.Roles[channel]
+}
+
+// Channels returns the indexes of the channels with the given role, in
+// order.
+func (m Meta) Channels(role Role) []int {
+	var chs []int
+	for ch := 0; ch < m.NumChannels; ch++ {
+		if m.RoleOf(ch) == role {
+			chs = append(chs, ch)
+		}
+	}
+	return chs
+}
@@ -6,12 +6,18 @@ import (
 
 	"github.com/go-audio/audio"
 	"github.com/go-audio/wav"
-
-	"github.com/edorfaus/sb-mfm-decode/log"
 )
 
-func SaveMono(fn string, rate, bits int, samples []int) (er error) {
-	defer log.Time(1, "Saving WAVE to: %v ...", fn)(" done in")
+func SaveMono(fn string, rate, bits int, samples []int) error {
+	return saveMono(fn, rate, bits, samples, nil)
+}
+
+func saveMono(
+	fn string, rate, bits int, samples []int, markers []Marker,
+) (er error) {
+	defer logger.TimeStage(
+		1, "save", len(samples), "Saving WAVE to: %v ...", fn,
+	)(" done in")
 
 	f, err := os.Create(fn)
 	if err != nil {
@@ -43,19 +49,37 @@ func SaveMono(fn string, rate, bits int, samples []int) (er error) {
 		return err
 	}
 
-	return nil
+	return writeCues(f, markers)
+}
+
+func SaveChannels(fn string, rate, bits int, data ...[]int) error {
+	return SaveMarked(fn, rate, bits, nil, data...)
 }
 
-func SaveChannels(fn string, rate, bits int, data ...[]int) (e error) {
+// SaveMarked is like SaveChannels, but also adds a cue point for each of
+// the given markers, labeled with its label, which audio editors show as
+// markers (or regions) that can be jumped to.
+func SaveMarked(
+	fn string, rate, bits int, markers []Marker, data ...[]int,
+) (e error) {
 	numChannels := len(data)
 	if numChannels <= 0 {
 		return fmt.Errorf("must have at least one channel of samples")
 	}
 	if numChannels == 1 {
-		return SaveMono(fn, rate, bits, data[0])
+		return saveMono(fn, rate, bits, data[0], markers)
 	}
 
-	defer log.Time(1, "Saving WAVE to: %v ...", fn)(" done in")
+	maxSamples := 0
+	for _, ch := range data {
+		if len(ch) > maxSamples {
+			maxSamples = len(ch)
+		}
+	}
+
+	defer logger.TimeStage(
+		1, "save", maxSamples*numChannels, "Saving WAVE to: %v ...", fn,
+	)(" done in")
 
 	f, err := os.Create(fn)
 	if err != nil {
@@ -67,13 +91,6 @@ func SaveChannels(fn string, rate, bits int, data ...[]int) (e error) {
 		}
 	}()
 
-	maxSamples := 0
-	for _, ch := range data {
-		if len(ch) > maxSamples {
-			maxSamples = len(ch)
-		}
-	}
-
 	// Buffer 1M samples at a time (takes 8M RAM, writes 2M at a time),
 	// rounded down to the nearest whole number of frames.
 	bufFrames := 1024 * 1024 / numChannels
@@ -122,5 +139,5 @@ func SaveChannels(fn string, rate, bits int, data ...[]int) (e error) {
 		return err
 	}
 
-	return nil
+	return writeCues(f, markers)
 }